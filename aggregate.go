@@ -0,0 +1,243 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+)
+
+// Aggregate is a read model that folds the messages published on a family
+// of topics into a single state.
+type Aggregate interface {
+	// Unsubscribe stops the aggregate from receiving further messages.
+	Unsubscriber
+
+	// State returns the current state.
+	State() interface{}
+
+	// Watch returns the current state, and calls the handler with each new
+	// state after that, in order, until the returned Unsubscriber is used.
+	// The handler is called from the aggregate's subscriber, so it should
+	// not block.
+	Watch(handler func(state interface{})) (interface{}, Unsubscriber)
+}
+
+// AggregateConfig is the argument struct for NewAggregate.
+type AggregateConfig struct {
+	// Hub is the hub the aggregate subscribes to. It must implement
+	// Barrierer.
+	Hub Hub
+
+	// Matcher defines the family of topics that are folded into the state.
+	Matcher TopicMatcher
+
+	// Reducer is a function of the form `func(state S, event E) S` that
+	// returns the state with the event applied. The state is passed by
+	// value, so reducers of map or slice states should copy them rather
+	// than change them in place, as the previous state may still be in use.
+	// For structured hubs E may be any type that a handler could take.
+	// For simple hubs the published data must be assignable to E.
+	Reducer interface{}
+
+	// Initial is the state before any events are applied. If it is nil the
+	// zero value of S is used.
+	Initial interface{}
+}
+
+// Validate checks that the config values are valid.
+func (config AggregateConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if _, ok := config.Hub.(Barrierer); !ok {
+		return errors.NotValidf("Hub %T without Barrier", config.Hub)
+	}
+	if config.Matcher == nil {
+		return errors.NotValidf("missing Matcher")
+	}
+	stateType, _, err := checkReducer(config.Reducer)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if config.Initial != nil {
+		if !reflect.TypeOf(config.Initial).AssignableTo(stateType) {
+			return errors.NotValidf("Initial of type %T for state %v", config.Initial, stateType)
+		}
+	}
+	return nil
+}
+
+// checkReducer returns the state and event types of the reducer.
+func checkReducer(reducer interface{}) (reflect.Type, reflect.Type, error) {
+	if reducer == nil {
+		return nil, nil, errors.NotValidf("missing Reducer")
+	}
+	t := reflect.TypeOf(reducer)
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 1 || t.In(0) != t.Out(0) {
+		return nil, nil, errors.NotValidf("Reducer of type %T, expected func(S, E) S", reducer)
+	}
+	return t.In(0), t.In(1), nil
+}
+
+// aggregateIdx is used to give each aggregate a unique barrier topic.
+var aggregateIdx uint64
+
+// NewAggregate subscribes to the topics that the matcher matches, and
+// folds each message into the state using the reducer. If the hub retains
+// messages, the retained messages are folded first, so the state can be
+// rebuilt from the hub. NewAggregate returns once the retained messages
+// have been applied.
+func NewAggregate(config AggregateConfig) (Aggregate, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	stateType, eventType, _ := checkReducer(config.Reducer)
+	state := reflect.New(stateType).Elem()
+	if config.Initial != nil {
+		state.Set(reflect.ValueOf(config.Initial))
+	}
+	a := &aggregate{
+		reducer:   reflect.ValueOf(config.Reducer),
+		eventType: eventType,
+		state:     state,
+	}
+	if shub, ok := config.Hub.(*structuredHub); ok {
+		a.decoder = &shub.decoder
+	}
+
+	// The aggregate also matches its own barrier topic, so it can wait for
+	// the retained messages without knowing the topics.
+	barrier := Topic(fmt.Sprintf("pubsub.aggregate.%d", atomic.AddUint64(&aggregateIdx, 1)))
+	matcher := &aggregateMatcher{matcher: config.Matcher, barrier: barrier}
+	var handler interface{} = a.handle
+	if a.decoder != nil {
+		handler = a.handleStructured
+	}
+	subscription, err := config.Hub.Subscribe(matcher, handler, DeliverAllRetained())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	a.subscription = subscription
+	done, err := config.Hub.(Barrierer).Barrier(barrier)
+	if err != nil {
+		subscription.Unsubscribe()
+		return nil, errors.Trace(err)
+	}
+	<-done.Complete()
+	return a, nil
+}
+
+type aggregate struct {
+	reducer      reflect.Value
+	eventType    reflect.Type
+	decoder      *decoder
+	subscription Unsubscriber
+
+	mu       sync.Mutex
+	state    reflect.Value
+	watchers []*aggregateWatcher
+}
+
+// aggregateMatcher matches the topics of the aggregate and its barrier.
+type aggregateMatcher struct {
+	matcher TopicMatcher
+	barrier Topic
+}
+
+// Match implements TopicMatcher.
+func (m *aggregateMatcher) Match(topic Topic) bool {
+	return topic == m.barrier || m.matcher.Match(topic)
+}
+
+// String returns the description of the aggregate's matcher.
+func (m *aggregateMatcher) String() string {
+	return describeMatcher(m.matcher)
+}
+
+// handle is the handler used with simple hubs.
+func (a *aggregate) handle(ctx context.Context, topic Topic, data interface{}) {
+	event := reflect.ValueOf(data)
+	if !event.IsValid() {
+		event = reflect.Zero(a.eventType)
+	} else if !event.Type().AssignableTo(a.eventType) {
+		reportSubscriberError(ctx, PhaseDispatch, topic,
+			errors.Errorf("aggregate event of type %T, expected %v", data, a.eventType))
+		return
+	}
+	a.apply(event)
+}
+
+// handleStructured is the handler used with structured hubs.
+func (a *aggregate) handleStructured(ctx context.Context, topic Topic, data map[string]interface{}, err error) {
+	if err != nil {
+		return
+	}
+	event, err := a.decoder.toHanderType(a.eventType, data)
+	if err != nil {
+		reportSubscriberError(ctx, PhaseDecode, topic, err)
+		return
+	}
+	a.apply(event)
+}
+
+// apply folds the event into the state and passes the new state to the
+// watchers.
+func (a *aggregate) apply(event reflect.Value) {
+	a.mu.Lock()
+	a.state = a.reducer.Call([]reflect.Value{a.state, event})[0]
+	state := a.state.Interface()
+	watchers := a.watchers
+	a.mu.Unlock()
+
+	for _, watcher := range watchers {
+		watcher.handler(state)
+	}
+}
+
+// Unsubscribe implements Aggregate.
+func (a *aggregate) Unsubscribe() {
+	a.subscription.Unsubscribe()
+}
+
+// State implements Aggregate.
+func (a *aggregate) State() interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state.Interface()
+}
+
+// Watch implements Aggregate.
+func (a *aggregate) Watch(handler func(state interface{})) (interface{}, Unsubscriber) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	watcher := &aggregateWatcher{aggregate: a, handler: handler}
+	// The watchers slice is replaced rather than changed, so apply can
+	// call the watchers without holding the mutex.
+	a.watchers = append(a.watchers[:len(a.watchers):len(a.watchers)], watcher)
+	return a.state.Interface(), watcher
+}
+
+type aggregateWatcher struct {
+	aggregate *aggregate
+	handler   func(interface{})
+}
+
+// Unsubscribe implements Unsubscriber, and removes the watcher.
+func (w *aggregateWatcher) Unsubscribe() {
+	a := w.aggregate
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, watcher := range a.watchers {
+		if watcher == w {
+			a.watchers = append(a.watchers[:i:i], a.watchers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type AggregateSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&AggregateSuite{})
+
+func sum(state, event int) int {
+	return state + event
+}
+
+type Deposit struct {
+	Account string `json:"account"`
+	Amount  int    `json:"amount"`
+}
+
+func balances(state map[string]int, event Deposit) map[string]int {
+	result := make(map[string]int, len(state)+1)
+	for account, amount := range state {
+		result[account] = amount
+	}
+	result[event.Account] += event.Amount
+	return result
+}
+
+func (*AggregateSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	for _, test := range []struct {
+		config pubsub.AggregateConfig
+		err    string
+	}{{
+		config: pubsub.AggregateConfig{Matcher: topic, Reducer: sum},
+		err:    "missing Hub not valid",
+	}, {
+		config: pubsub.AggregateConfig{Hub: hub, Reducer: sum},
+		err:    "missing Matcher not valid",
+	}, {
+		config: pubsub.AggregateConfig{Hub: hub, Matcher: topic},
+		err:    "missing Reducer not valid",
+	}, {
+		config: pubsub.AggregateConfig{Hub: hub, Matcher: topic, Reducer: func(int, int) string { return "" }},
+		err:    `Reducer of type func\(int, int\) string, expected func\(S, E\) S not valid`,
+	}, {
+		config: pubsub.AggregateConfig{Hub: hub, Matcher: topic, Reducer: sum, Initial: "zero"},
+		err:    "Initial of type string for state int not valid",
+	}} {
+		_, err := pubsub.NewAggregate(test.config)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (*AggregateSuite) TestRetainedAndLive(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 10})
+	for _, t := range []pubsub.Topic{first, second, firstdot} {
+		_, err := hub.Publish(t, 1)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	aggregate, err := pubsub.NewAggregate(pubsub.AggregateConfig{
+		Hub:     hub,
+		Matcher: pubsub.MatchRegex("^first"),
+		Reducer: sum,
+		Initial: 100,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer aggregate.Unsubscribe()
+	c.Assert(aggregate.State(), gc.Equals, 102)
+
+	states := make(chan interface{}, 10)
+	state, watcher := aggregate.Watch(func(state interface{}) {
+		states <- state
+	})
+	c.Assert(state, gc.Equals, 102)
+	_, err = hub.Publish(first, 5)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(second, 5)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case state := <-states:
+		c.Assert(state, gc.Equals, 107)
+	case <-time.After(time.Second):
+		c.Fatal("watcher not called")
+	}
+
+	watcher.Unsubscribe()
+	result, err := hub.Publish(first, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	c.Assert(aggregate.State(), gc.Equals, 108)
+	select {
+	case state := <-states:
+		c.Fatalf("unexpected state %v", state)
+	default:
+	}
+	// The barrier topic isn't passed to the reducer.
+	c.Assert(hub.(pubsub.Reporter).Report()["published"], gc.Equals, uint64(6))
+}
+
+func (*AggregateSuite) TestStructured(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{Retain: 10},
+	})
+	_, err := hub.Publish(first, Deposit{Account: "a", Amount: 10})
+	c.Assert(err, jc.ErrorIsNil)
+	aggregate, err := pubsub.NewAggregate(pubsub.AggregateConfig{
+		Hub:     hub,
+		Matcher: first,
+		Reducer: balances,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer aggregate.Unsubscribe()
+	c.Assert(aggregate.State(), jc.DeepEquals, map[string]int{"a": 10})
+
+	for _, deposit := range []Deposit{{"b", 5}, {"a", 1}} {
+		result, err := hub.Publish(first, deposit)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, result)
+	}
+	c.Assert(aggregate.State(), jc.DeepEquals, map[string]int{"a": 11, "b": 5})
+}
+
+func (*AggregateSuite) TestWrongEventType(c *gc.C) {
+	collector := &errorCollector{}
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ErrorHandler: collector.handle})
+	aggregate, err := pubsub.NewAggregate(pubsub.AggregateConfig{
+		Hub:     hub,
+		Matcher: topic,
+		Reducer: sum,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer aggregate.Unsubscribe()
+	for _, data := range []interface{}{"bad", 2} {
+		result, err := hub.Publish(topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, result)
+	}
+	c.Assert(aggregate.State(), gc.Equals, 2)
+	reported := collector.get()
+	c.Assert(reported, gc.HasLen, 1)
+	c.Assert(reported[0].Phase, gc.Equals, pubsub.PhaseDispatch)
+	c.Assert(reported[0], gc.ErrorMatches, `dispatch "testing" for subscriber 0: aggregate event of type string, expected int`)
+}
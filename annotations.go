@@ -0,0 +1,155 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+type annotationsKey struct{}
+
+// WithAnnotations returns a context carrying the annotations, merged with
+// any annotations already in the context. Where the same key is in both,
+// the value passed in wins. When the context is passed to the PublishCtx
+// method of a structured hub, the annotations are added to the published
+// data in the same way as the hub's own annotations. Context annotations
+// take precedence over the hub's annotations.
+//
+// This allows middleware along a request path to accumulate metadata that
+// is then included in every message published while handling the request.
+func WithAnnotations(ctx context.Context, annotations map[string]interface{}) context.Context {
+	existing := AnnotationsFromContext(ctx)
+	merged := make(map[string]interface{}, len(existing)+len(annotations))
+	for key, value := range existing {
+		merged[key] = value
+	}
+	for key, value := range annotations {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, annotationsKey{}, merged)
+}
+
+// AnnotationsFromContext returns the annotations added to the context with
+// WithAnnotations. The result must not be modified.
+func AnnotationsFromContext(ctx context.Context) map[string]interface{} {
+	annotations, _ := ctx.Value(annotationsKey{}).(map[string]interface{})
+	return annotations
+}
+
+// annotate sets the values of the annotations in the data if and only if
+// the data doesn't already have a value, or the value is the zero value of
+// its type. The keys that are set are recorded in the provenance, if it
+// isn't nil, as coming from the source.
+func annotate(data, annotations map[string]interface{}, provenance Provenance, source string) {
+	for key, defaultValue := range annotations {
+		if value, exists := data[key]; !exists || isZero(value) {
+			data[key] = defaultValue
+			provenance.record(key, source)
+		}
+	}
+}
+
+func isZero(value interface{}) bool {
+	return value == nil || reflect.ValueOf(value).IsZero()
+}
+
+// ConflictPolicy defines what an annotation layer does when the published
+// data already has a value for one of its keys.
+type ConflictPolicy int
+
+const (
+	// FillMissing only sets the values that the data doesn't have, or that
+	// are the zero value of their type. This is how the hub's Annotations
+	// are applied.
+	FillMissing ConflictPolicy = iota
+
+	// Override always sets the values, replacing those in the data.
+	Override
+
+	// Reject fails the publish if the data has a different, non-zero,
+	// value for one of the keys.
+	Reject
+)
+
+// AnnotationProvider returns the annotations for a message being published
+// on the topic, using the context passed to PublishCtx.
+type AnnotationProvider func(ctx context.Context, topic Topic) map[string]interface{}
+
+// AnnotationLayer is a set of annotations that a structured hub adds to
+// the published data, such as the metadata of a namespace of topics. See
+// StructuredHubConfig.AnnotationLayers.
+type AnnotationLayer struct {
+	// Name identifies the layer in errors.
+	Name string
+
+	// Annotations are the fixed annotations of the layer, and Provider, if
+	// set, returns further annotations for each message. Where the same
+	// key is in both, the value from the Provider is used.
+	Annotations map[string]interface{}
+	Provider    AnnotationProvider
+
+	// Policy defines what happens when the data already has a value for
+	// one of the keys of the layer.
+	Policy ConflictPolicy
+
+	// Topics, if set, limits the layer to the messages published on the
+	// topics it matches, so each pattern of topics can carry its own
+	// metadata, such as an api-version for MatchRegex(`^api\.`), while
+	// the other topics stay lean. Without it, the layer applies to every
+	// message.
+	Topics TopicMatcher
+}
+
+// values returns the annotations of the layer for the message.
+func (layer AnnotationLayer) values(ctx context.Context, topic Topic) map[string]interface{} {
+	if layer.Provider == nil {
+		return layer.Annotations
+	}
+	provided := layer.Provider(ctx, topic)
+	if len(layer.Annotations) == 0 {
+		return provided
+	}
+	merged := make(map[string]interface{}, len(layer.Annotations)+len(provided))
+	for key, value := range layer.Annotations {
+		merged[key] = value
+	}
+	for key, value := range provided {
+		merged[key] = value
+	}
+	return merged
+}
+
+// applyLayers adds the annotations of each layer to the data, in order,
+// following the policy of each layer, and records the keys each layer sets
+// in the provenance, which may be nil.
+func applyLayers(ctx context.Context, topic Topic, data map[string]interface{}, layers []AnnotationLayer, provenance Provenance) error {
+	for _, layer := range layers {
+		if layer.Topics != nil && !layer.Topics.Match(topic) {
+			continue
+		}
+		annotations := layer.values(ctx, topic)
+		source := ProvenanceLayerPrefix + layer.Name
+		switch layer.Policy {
+		case Override:
+			for key, value := range annotations {
+				data[key] = value
+				provenance.record(key, source)
+			}
+		case Reject:
+			for key, value := range annotations {
+				existing, exists := data[key]
+				if exists && !isZero(existing) && !reflect.DeepEqual(existing, value) {
+					return errors.Errorf("annotation %q of layer %q conflicts with value %v", key, layer.Name, existing)
+				}
+			}
+			annotate(data, annotations, provenance, source)
+		default:
+			annotate(data, annotations, provenance, source)
+		}
+	}
+	return nil
+}
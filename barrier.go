@@ -0,0 +1,38 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+)
+
+// Barrier implements Barrierer.
+func (h *simplehub) Barrier(topic Topic) (Completer, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	done := make(chan struct{})
+	wait := sync.WaitGroup{}
+	handle := &doneHandle{done: done}
+	// Standbys of failover groups are included, as they may still have
+	// messages queued from when they were the primary.
+	for _, s := range h.subscribers {
+		if s.topicMatcher.Match(topic) {
+			wait.Add(1)
+			s.notify(&handlerCallback{
+				topic:   topic,
+				wg:      &wait,
+				handle:  handle,
+				barrier: true,
+			})
+		}
+	}
+
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+
+	return handle, nil
+}
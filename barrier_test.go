@@ -0,0 +1,118 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type BarrierSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&BarrierSuite{})
+
+func (*BarrierSuite) TestNoSubscribers(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	barrier, err := hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-barrier.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("barrier did not complete")
+	}
+}
+
+func (*BarrierSuite) TestWaitsForQueuedMessages(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	_, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	// A subscriber to another topic is not waited for.
+	other := newBlockingHandler()
+	_, err = hub.Subscribe(pubsub.Topic("other"), other.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish("other", nil)
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i := 0; i < 3; i++ {
+		_, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	barrier, err := hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, handler)
+	select {
+	case <-barrier.Complete():
+		c.Fatal("barrier completed early")
+	case <-time.After(veryShortTime):
+	}
+
+	close(handler.release)
+	select {
+	case <-barrier.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("barrier did not complete")
+	}
+	// The handler isn't called for the barrier itself.
+	c.Assert(handler.get(), jc.DeepEquals, []interface{}{0, 1, 2})
+	// The barrier doesn't use a sequence number.
+	c.Assert(hub.(pubsub.Reporter).Report()["published"], gc.Equals, uint64(4))
+	close(other.release)
+}
+
+func (*BarrierSuite) TestParallel(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	_, err := hub.Subscribe(topic, handler.handle, pubsub.Parallel(2))
+	c.Assert(err, jc.ErrorIsNil)
+	for _, key := range []string{"a", "b"} {
+		_, err := hub.(pubsub.ContextPublisher).PublishCtx(pubsub.WithOrderingKey(context.Background(), key), topic, key)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	barrier, err := hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, handler)
+	waitStarted(c, handler)
+	close(handler.release)
+	select {
+	case <-barrier.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("barrier did not complete")
+	}
+	c.Assert(handler.get(), jc.SameContents, []interface{}{"a", "b"})
+}
+
+func (*BarrierSuite) TestBarrierFromHandler(c *gc.C) {
+	// A barrier queued from within a handler is behind the messages
+	// already queued for the handler's own subscriber, so waiting on it
+	// would deadlock, but it completes once the handler returns.
+	hub := pubsub.NewSimpleHub()
+	barriers := make(chan pubsub.Completer, 1)
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) {
+		barrier, err := hub.(pubsub.Barrierer).Barrier(topic)
+		c.Check(err, jc.ErrorIsNil)
+		barriers <- barrier
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case barrier := <-barriers:
+		select {
+		case <-barrier.Complete():
+		case <-time.After(time.Second):
+			c.Fatal("barrier did not complete")
+		}
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/juju/pubsub"
+)
+
+// newBenchHub returns a hub with count subscribers, half of which match
+// the topic.
+func newBenchHub(b *testing.B, config *pubsub.SimpleHubConfig, count int) pubsub.Hub {
+	hub := pubsub.NewSimpleHubWithConfig(config)
+	for i := 0; i < count; i++ {
+		matcher := topic
+		if i%2 == 1 {
+			matcher = pubsub.Topic(fmt.Sprintf("other-%d", i))
+		}
+		if _, err := hub.Subscribe(matcher, func(pubsub.Topic, interface{}) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return hub
+}
+
+func benchmarkPublishParallel(b *testing.B, config *pubsub.SimpleHubConfig) {
+	hub := newBenchHub(b, config, 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := hub.Publish(topic, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPublish(b *testing.B) {
+	hub := newBenchHub(b, nil, 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hub.Publish(topic, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPublishWithTap shows the cost of a tap that counts the
+// messages, to compare with BenchmarkPublish.
+func BenchmarkPublishWithTap(b *testing.B) {
+	hub := newBenchHub(b, nil, 10)
+	var count int64
+	if _, err := hub.(pubsub.SyncTapper).TapSync(topic, func(pubsub.Topic, interface{}) { count++ }); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hub.Publish(topic, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishParallel(b *testing.B) {
+	benchmarkPublishParallel(b, nil)
+}
+
+// BenchmarkPublishParallelRetained shows the cost of the hub mutex, which
+// Publish still takes when the hub retains messages.
+func BenchmarkPublishParallelRetained(b *testing.B) {
+	benchmarkPublishParallel(b, &pubsub.SimpleHubConfig{Retain: 1})
+}
+
+// BenchmarkPublishWhileSubscribing publishes while another goroutine
+// keeps subscribing and unsubscribing.
+func BenchmarkPublishWhileSubscribing(b *testing.B) {
+	hub := newBenchHub(b, nil, 10)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sub, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			sub.Unsubscribe()
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := hub.Publish(topic, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package boltstore provides a pubsub.Store that keeps the records in a
+// BoltDB file.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/juju/pubsub"
+)
+
+var logger = loggo.GetLogger("pubsub.boltstore")
+
+// reopenTimeout is how long Compact waits for the lock on the file when it
+// opens it again, so it can't hang if closing the file didn't release it.
+const reopenTimeout = 10 * time.Second
+
+// Store is a pubsub.Store backed by a BoltDB file. Each stream is kept in
+// its own bucket, keyed by the big endian encoding of the record sequence.
+type Store struct {
+	mutex sync.RWMutex
+	path  string
+	db    *bolt.DB
+}
+
+var _ pubsub.Store = (*Store)(nil)
+
+// Open opens the BoltDB file at the path, creating it if necessary.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "opening %q", path)
+	}
+	return &Store{path: path, db: db}, nil
+}
+
+// Close closes the underlying BoltDB file.
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return errors.Trace(s.db.Close())
+}
+
+// value is the serialized form of a record within a bucket.
+type value struct {
+	Topic pubsub.Topic `json:"topic"`
+	Data  []byte       `json:"data,omitempty"`
+}
+
+func sequenceKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
+
+// Put implements pubsub.Store.
+func (s *Store) Put(stream string, records ...pubsub.Record) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(stream))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		last, _ := bucket.Cursor().Last()
+		for _, record := range records {
+			key := sequenceKey(record.Sequence)
+			if last != nil && bytes.Compare(last, key) >= 0 {
+				return errors.NotValidf("sequence %d in stream %q", record.Sequence, stream)
+			}
+			bytes, err := json.Marshal(value{Topic: record.Topic, Data: record.Data})
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := bucket.Put(key, bytes); err != nil {
+				return errors.Trace(err)
+			}
+			last = key
+		}
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+// GetRange implements pubsub.Store.
+func (s *Store) GetRange(stream string, from, to uint64) ([]pubsub.Record, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []pubsub.Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(stream))
+		if bucket == nil {
+			return nil
+		}
+		end := sequenceKey(to)
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(sequenceKey(from)); k != nil && bytes.Compare(k, end) < 0; k, v = cursor.Next() {
+			var stored value
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return errors.Annotatef(err, "record %d in stream %q", binary.BigEndian.Uint64(k), stream)
+			}
+			result = append(result, pubsub.Record{
+				Sequence: binary.BigEndian.Uint64(k),
+				Topic:    stored.Topic,
+				Data:     stored.Data,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// Trim implements pubsub.Store.
+func (s *Store) Trim(stream string, before uint64) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(stream))
+		if bucket == nil {
+			return nil
+		}
+		end := sequenceKey(before)
+		cursor := bucket.Cursor()
+		// Deleting through the cursor moves it on to the next key.
+		for k, _ := cursor.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if k, _ := cursor.First(); k == nil {
+			return errors.Trace(tx.DeleteBucket([]byte(stream)))
+		}
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+// Compact rewrites the BoltDB file to release the space left behind by
+// trimmed records. BoltDB never shrinks its file, so stores that trim
+// regularly should be compacted periodically. Other calls on the store
+// wait until the compaction is complete.
+func (s *Store) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tempPath := s.path + ".compact"
+	if err := s.compactInto(tempPath); err != nil {
+		os.Remove(tempPath)
+		return errors.Trace(err)
+	}
+	// The live file is only closed once the compacted copy is complete,
+	// and from then on it is opened again whatever happens, so a failed
+	// compaction never leaves the store without a database.
+	if err := s.db.Close(); err != nil {
+		os.Remove(tempPath)
+		return s.reopen(errors.Annotate(err, "closing for compaction"))
+	}
+	if err := os.Rename(tempPath, s.path); err != nil {
+		os.Remove(tempPath)
+		return s.reopen(errors.Annotatef(err, "replacing %q with compacted file", s.path))
+	}
+	return s.reopen(nil)
+}
+
+// compactInto writes a compacted copy of the database to the path.
+func (s *Store) compactInto(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	dst, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return errors.Annotate(err, "opening compaction file")
+	}
+	if err := bolt.Compact(dst, s.db, 0); err != nil {
+		dst.Close()
+		return errors.Annotate(err, "compacting")
+	}
+	return errors.Trace(dst.Close())
+}
+
+// reopen opens the file at the store's path after Compact has closed it.
+// The cause is the error that stopped the compaction, if there was one,
+// and is what's returned unless the file can't be opened either.
+func (s *Store) reopen(cause error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: reopenTimeout})
+	if err != nil {
+		if cause != nil {
+			logger.Errorf("compacting %q: %v", s.path, cause)
+		}
+		return errors.Annotatef(err, "reopening %q", s.path)
+	}
+	s.db = db
+	return errors.Trace(cause)
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package boltstore_test
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/boltstore"
+)
+
+type StoreSuite struct {
+	testing.LoggingCleanupSuite
+	path  string
+	store *boltstore.Store
+}
+
+var _ = gc.Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *gc.C) {
+	s.LoggingCleanupSuite.SetUpTest(c)
+	s.path = filepath.Join(c.MkDir(), "store.db")
+	store, err := boltstore.Open(s.path)
+	c.Assert(err, jc.ErrorIsNil)
+	s.store = store
+}
+
+func (s *StoreSuite) TearDownTest(c *gc.C) {
+	c.Check(s.store.Close(), jc.ErrorIsNil)
+	s.LoggingCleanupSuite.TearDownTest(c)
+}
+
+func (s *StoreSuite) put(c *gc.C, stream string, from, to uint64) {
+	for i := from; i <= to; i++ {
+		err := s.store.Put(stream, pubsub.Record{Sequence: i, Topic: "topic", Data: []byte{byte(i)}})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+}
+
+func (s *StoreSuite) TestPutGetRange(c *gc.C) {
+	s.put(c, "stream", 1, 3)
+	s.put(c, "other", 1, 1)
+
+	records, err := s.store.GetRange("stream", 2, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, jc.DeepEquals, []pubsub.Record{
+		{Sequence: 2, Topic: "topic", Data: []byte{2}},
+		{Sequence: 3, Topic: "topic", Data: []byte{3}},
+	})
+	records, err = s.store.GetRange("stream", 0, 2)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, jc.DeepEquals, []pubsub.Record{
+		{Sequence: 1, Topic: "topic", Data: []byte{1}},
+	})
+	records, err = s.store.GetRange("missing", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestPutOutOfOrder(c *gc.C) {
+	s.put(c, "stream", 1, 3)
+	err := s.store.Put("stream", pubsub.Record{Sequence: 3})
+	c.Assert(err, gc.ErrorMatches, `sequence 3 in stream "stream" not valid`)
+}
+
+func (s *StoreSuite) TestTrim(c *gc.C) {
+	s.put(c, "stream", 1, 5)
+	err := s.store.Trim("stream", 4)
+	c.Assert(err, jc.ErrorIsNil)
+	records, err := s.store.GetRange("stream", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(records, gc.HasLen, 2)
+	c.Check(records[0].Sequence, gc.Equals, uint64(4))
+
+	err = s.store.Trim("stream", math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	records, err = s.store.GetRange("stream", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, gc.HasLen, 0)
+	// The stream can be written to again after being emptied.
+	s.put(c, "stream", 1, 1)
+}
+
+func (s *StoreSuite) TestCompact(c *gc.C) {
+	s.put(c, "stream", 1, 500)
+	err := s.store.Trim("stream", 500)
+	c.Assert(err, jc.ErrorIsNil)
+	before, err := os.Stat(s.path)
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.store.Compact()
+	c.Assert(err, jc.ErrorIsNil)
+	after, err := os.Stat(s.path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(after.Size() <= before.Size(), jc.IsTrue)
+
+	records, err := s.store.GetRange("stream", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, jc.DeepEquals, []pubsub.Record{
+		{Sequence: 500, Topic: "topic", Data: []byte{244}},
+	})
+}
+
+func (s *StoreSuite) TestCompactFailed(c *gc.C) {
+	s.put(c, "stream", 1, 3)
+	// A directory in the way of the compaction file stops the compaction.
+	err := os.MkdirAll(filepath.Join(s.path+".compact", "blocked"), 0700)
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.store.Compact()
+	c.Assert(err, gc.NotNil)
+
+	// The store still has the records, and can take more.
+	s.put(c, "stream", 4, 4)
+	records, err := s.store.GetRange("stream", 3, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, gc.HasLen, 2)
+}
@@ -0,0 +1,341 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+)
+
+// BridgeRulesChangedTopic is the topic that a bridge publishes a
+// BridgeRulesChanged message on, on its source hub, whenever its rules are
+// changed. The messages describe the bridges of the hub they are published
+// on, so bridges never forward them, whatever their rules.
+const BridgeRulesChangedTopic Topic = "pubsub.bridge.rules-changed"
+
+// BridgeRulesChanged is the message published when the rules of a bridge
+// change.
+type BridgeRulesChanged struct {
+	Bridge  string   `json:"bridge"`
+	Added   string   `json:"added,omitempty"`
+	Removed string   `json:"removed,omitempty"`
+	Rules   []string `json:"rules"`
+}
+
+// BridgeRule determines which messages are forwarded by a bridge. A message
+// is forwarded if its topic matches at least one allow rule, and doesn't
+// match any deny rule.
+type BridgeRule struct {
+	// Name identifies the rule within the bridge.
+	Name string
+
+	// Matcher determines which topics the rule applies to.
+	Matcher TopicMatcher
+
+	// Deny is true if messages matching the rule are not to be forwarded.
+	Deny bool
+}
+
+// BridgeConfig is the argument struct for NewBridge.
+type BridgeConfig struct {
+	// Name identifies the bridge in the rule change messages.
+	Name string
+
+	// Source is the hub that the messages are forwarded from. It must
+	// implement ChanSubscriber.
+	Source Hub
+
+	// Target is the hub that the messages are forwarded to. It must
+	// implement ContextPublisher.
+	Target Hub
+
+	// Rules are the initial forwarding rules. With no rules, no messages
+	// are forwarded.
+	Rules []BridgeRule
+
+	// SourceSchemas and TargetSchemas are the schema versions used on each
+	// side of the bridge. When both are set, the bridge negotiates the
+	// version of each topic registered on both sides, and migrates the
+	// forwarded messages to that version.
+	SourceSchemas *Schemas
+	TargetSchemas *Schemas
+
+	// Redactor, if set, masks the secret values of the messages before
+	// they are forwarded. It is used for bridges to untrusted hubs, and
+	// the forwarded data is always in its map form.
+	Redactor *Redactor
+
+	// Transport names the transport in the PeerTransportHeader of the
+	// forwarded messages. It defaults to "bridge".
+	Transport string
+
+	// MaxHops is the number of times a message may have been forwarded
+	// between hubs for the bridge to forward it again. It defaults to
+	// DefaultMaxHops.
+	MaxHops int
+}
+
+// Validate checks that the config has all the required values.
+func (config BridgeConfig) Validate() error {
+	if config.Source == nil {
+		return errors.NotValidf("missing Source")
+	}
+	if config.Target == nil {
+		return errors.NotValidf("missing Target")
+	}
+	if _, ok := config.Source.(ChanSubscriber); !ok {
+		return errors.NotValidf("Source %T without SubscribeChan", config.Source)
+	}
+	if _, ok := config.Target.(ContextPublisher); !ok {
+		return errors.NotValidf("Target %T without PublishCtx", config.Target)
+	}
+	if config.MaxHops < 0 {
+		return errors.NotValidf("negative MaxHops")
+	}
+	names := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if err := rule.validate(); err != nil {
+			return errors.Trace(err)
+		}
+		if names[rule.Name] {
+			return errors.NotValidf("duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
+
+func (rule BridgeRule) validate() error {
+	if rule.Name == "" {
+		return errors.NotValidf("rule with missing Name")
+	}
+	if rule.Matcher == nil {
+		return errors.NotValidf("rule %q with missing Matcher", rule.Name)
+	}
+	return nil
+}
+
+// Bridge forwards the messages published on one hub to another hub. The
+// rules that determine which messages are forwarded can be changed while
+// the bridge is running.
+type Bridge interface {
+	// Unsubscribe stops the bridge forwarding messages.
+	Unsubscriber
+
+	// AddRule adds a new rule to the bridge. The name of the rule must not
+	// already be in use.
+	AddRule(rule BridgeRule) error
+
+	// RemoveRule removes the named rule from the bridge.
+	RemoveRule(name string) error
+
+	// Rules returns the current rules of the bridge.
+	Rules() []BridgeRule
+
+	// SchemaVersions returns the schema version that was negotiated for
+	// each topic registered on both sides of the bridge.
+	SchemaVersions() map[Topic]int
+}
+
+type bridge struct {
+	name   string
+	source Hub
+	target Hub
+	logger loggo.Logger
+
+	mutex sync.Mutex
+	rules []BridgeRule
+
+	schemas  map[Topic]*negotiatedTopic
+	redactor *Redactor
+
+	transport string
+	maxHops   int
+
+	closer   func()
+	finished chan struct{}
+}
+
+// NewBridge creates a bridge that starts forwarding messages from the
+// source hub to the target hub straight away. Messages are forwarded in the
+// order they were published. Data published on a structured hub is
+// forwarded in its map[string]interface{} form, and the headers of the
+// messages are forwarded with them.
+//
+// The forwarded messages are given the peer headers, recording the ID of
+// the hub they were first published on, the transport, and the number of
+// times they have been forwarded (see PeerFromContext). Care still needs
+// to be taken when bridging hubs in both directions, as a message that is
+// allowed by the rules of both bridges is forwarded back and forth until
+// it has been forwarded MaxHops times.
+//
+// If the schemas of both hubs are given, the schema versions are negotiated
+// when the bridge is created, and NewBridge fails if a topic has no
+// version that the source's current version can be migrated to. Messages
+// on negotiated topics are forwarded in the negotiated version, with the
+// SchemaVersionHeader set. Messages that can't be migrated are dropped.
+func NewBridge(config BridgeConfig) (Bridge, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	schemas, err := negotiateSchemas(config.SourceSchemas, config.TargetSchemas)
+	if err != nil {
+		return nil, errors.Annotate(err, "negotiating schemas")
+	}
+	messages, closer, err := SubscribeChan(config.Source, MatchAll, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if config.Transport == "" {
+		config.Transport = "bridge"
+	}
+	b := &bridge{
+		name:      config.Name,
+		source:    config.Source,
+		target:    config.Target,
+		logger:    loggo.GetLogger("pubsub.bridge"),
+		rules:     append([]BridgeRule(nil), config.Rules...),
+		schemas:   schemas,
+		redactor:  config.Redactor,
+		closer:    closer,
+		transport: config.Transport,
+		maxHops:   config.MaxHops,
+		finished:  make(chan struct{}),
+	}
+	go b.loop(messages)
+	return b, nil
+}
+
+func (b *bridge) loop(messages <-chan Message) {
+	defer close(b.finished)
+	for message := range messages {
+		if message.Topic == BridgeRulesChangedTopic || !b.allowed(message.Topic) {
+			continue
+		}
+		data, err := b.redactor.Redact(message.Topic, message.Data)
+		if err != nil {
+			b.logger.Errorf("bridge %q redacting %q: %v", b.name, message.Topic, err)
+			continue
+		}
+		headers := message.Delivery.Headers
+		if schema, ok := b.schemas[message.Topic]; ok {
+			var err error
+			data, headers, err = schema.convert(data, headers)
+			if err != nil {
+				b.logger.Errorf("bridge %q forwarding %q: %v", b.name, message.Topic, err)
+				continue
+			}
+		}
+		headers, err = forwardedHeaders(b.source, headers, b.transport, b.maxHops)
+		if err != nil {
+			b.logger.Warningf("bridge %q forwarding %q: %v", b.name, message.Topic, err)
+			continue
+		}
+		ctx := WithHeaders(context.Background(), headers)
+		if _, err := PublishCtx(ctx, b.target, message.Topic, data); err != nil {
+			b.logger.Errorf("bridge %q forwarding %q: %v", b.name, message.Topic, err)
+		}
+	}
+}
+
+func (b *bridge) allowed(topic Topic) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	allowed := false
+	for _, rule := range b.rules {
+		if !rule.Matcher.Match(topic) {
+			continue
+		}
+		if rule.Deny {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// Unsubscribe implements Unsubscriber.
+func (b *bridge) Unsubscribe() {
+	b.closer()
+	<-b.finished
+}
+
+// AddRule implements Bridge.
+func (b *bridge) AddRule(rule BridgeRule) error {
+	if err := rule.validate(); err != nil {
+		return errors.Trace(err)
+	}
+	b.mutex.Lock()
+	for _, existing := range b.rules {
+		if existing.Name == rule.Name {
+			b.mutex.Unlock()
+			return errors.AlreadyExistsf("rule %q", rule.Name)
+		}
+	}
+	b.rules = append(b.rules, rule)
+	event := b.changedEvent()
+	b.mutex.Unlock()
+
+	event.Added = rule.Name
+	b.publishChanged(event)
+	return nil
+}
+
+// RemoveRule implements Bridge.
+func (b *bridge) RemoveRule(name string) error {
+	b.mutex.Lock()
+	found := false
+	for i, existing := range b.rules {
+		if existing.Name == name {
+			b.rules = append(b.rules[:i:i], b.rules[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		b.mutex.Unlock()
+		return errors.NotFoundf("rule %q", name)
+	}
+	event := b.changedEvent()
+	b.mutex.Unlock()
+
+	event.Removed = name
+	b.publishChanged(event)
+	return nil
+}
+
+// Rules implements Bridge.
+func (b *bridge) Rules() []BridgeRule {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]BridgeRule(nil), b.rules...)
+}
+
+// SchemaVersions implements Bridge.
+func (b *bridge) SchemaVersions() map[Topic]int {
+	result := make(map[Topic]int, len(b.schemas))
+	for topic, schema := range b.schemas {
+		result[topic] = schema.version
+	}
+	return result
+}
+
+// changedEvent returns the event describing the current rules. The mutex
+// must be held.
+func (b *bridge) changedEvent() BridgeRulesChanged {
+	event := BridgeRulesChanged{Bridge: b.name}
+	for _, rule := range b.rules {
+		event.Rules = append(event.Rules, rule.Name)
+	}
+	return event
+}
+
+func (b *bridge) publishChanged(event BridgeRulesChanged) {
+	if _, err := b.source.Publish(BridgeRulesChangedTopic, event); err != nil {
+		b.logger.Errorf("bridge %q publishing rule change: %v", b.name, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type BridgeSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&BridgeSuite{})
+
+func (*BridgeSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	for i, test := range []struct {
+		config pubsub.BridgeConfig
+		err    string
+	}{{
+		config: pubsub.BridgeConfig{Target: hub},
+		err:    "missing Source not valid",
+	}, {
+		config: pubsub.BridgeConfig{Source: hub},
+		err:    "missing Target not valid",
+	}, {
+		config: pubsub.BridgeConfig{Source: hub, Target: hub, Rules: []pubsub.BridgeRule{{Matcher: first}}},
+		err:    "rule with missing Name not valid",
+	}, {
+		config: pubsub.BridgeConfig{Source: hub, Target: hub, Rules: []pubsub.BridgeRule{{Name: "a"}}},
+		err:    `rule "a" with missing Matcher not valid`,
+	}, {
+		config: pubsub.BridgeConfig{Source: hub, Target: hub, Rules: []pubsub.BridgeRule{
+			{Name: "a", Matcher: first}, {Name: "a", Matcher: second},
+		}},
+		err: `duplicate rule "a" not valid`,
+	}, {
+		config: pubsub.BridgeConfig{Source: hub, Target: hub, MaxHops: -1},
+		err:    "negative MaxHops not valid",
+	}} {
+		c.Logf("test %d", i)
+		err := test.config.Validate()
+		c.Check(err, gc.ErrorMatches, test.err)
+		bridge, err := pubsub.NewBridge(test.config)
+		c.Check(err, gc.ErrorMatches, test.err)
+		c.Check(bridge, gc.IsNil)
+	}
+}
+
+func receive(c *gc.C, messages <-chan pubsub.Message) pubsub.Message {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(time.Second):
+		c.Fatal("message not received")
+	}
+	return pubsub.Message{}
+}
+
+func (*BridgeSuite) TestForwarding(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	target := pubsub.NewSimpleHub()
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Name:   "test",
+		Source: source,
+		Target: target,
+		Rules: []pubsub.BridgeRule{
+			{Name: "firsts", Matcher: pubsub.MatchRegex("^first")},
+			{Name: "no-dots", Matcher: firstdot, Deny: true},
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	messages, closer, err := target.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	for _, t := range []pubsub.Topic{firstdot, second, first} {
+		_, err := source.Publish(t, string(t))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	message := receive(c, messages)
+	c.Check(message.Topic, gc.Equals, first)
+	c.Check(message.Data, gc.Equals, "first")
+}
+
+func (*BridgeSuite) TestRulesChangedNotForwarded(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	target := pubsub.NewSimpleHub()
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Name:   "test",
+		Source: source,
+		Target: target,
+		Rules:  []pubsub.BridgeRule{{Name: "all", Matcher: pubsub.MatchAll}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	messages, closer, err := target.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	err = bridge.AddRule(pubsub.BridgeRule{Name: "second", Matcher: second})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = source.Publish(first, "first")
+	c.Assert(err, jc.ErrorIsNil)
+	// The rule change was published before the message, so if it were
+	// forwarded it would be received first.
+	message := receive(c, messages)
+	c.Check(message.Topic, gc.Equals, first)
+}
+
+func (*BridgeSuite) TestRuntimeRuleChanges(c *gc.C) {
+	source := pubsub.NewStructuredHub(nil)
+	target := pubsub.NewSimpleHub()
+	changes, closeChanges, err := source.(pubsub.ChanSubscriber).SubscribeChan(pubsub.BridgeRulesChangedTopic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closeChanges()
+
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Name:   "test",
+		Source: source,
+		Target: target,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	messages, closer, err := target.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	err = bridge.AddRule(pubsub.BridgeRule{Name: "second", Matcher: second})
+	c.Assert(err, jc.ErrorIsNil)
+	err = bridge.AddRule(pubsub.BridgeRule{Name: "second", Matcher: first})
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+	message := receive(c, changes)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{
+		"bridge": "test",
+		"added":  "second",
+		"rules":  []interface{}{"second"},
+	})
+
+	_, err = source.Publish(first, JustOrigin{"first"})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = source.Publish(second, JustOrigin{"second"})
+	c.Assert(err, jc.ErrorIsNil)
+	message = receive(c, messages)
+	c.Check(message.Topic, gc.Equals, second)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"origin": "second"})
+
+	err = bridge.RemoveRule("second")
+	c.Assert(err, jc.ErrorIsNil)
+	err = bridge.RemoveRule("second")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	message = receive(c, changes)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{
+		"bridge":  "test",
+		"removed": "second",
+		"rules":   nil,
+	})
+	c.Check(bridge.Rules(), gc.HasLen, 0)
+
+	result, err := source.Publish(second, JustOrigin{"second"})
+	c.Assert(err, jc.ErrorIsNil)
+	<-result.Complete()
+	select {
+	case message := <-messages:
+		c.Fatalf("unexpected message %#v", message)
+	case <-time.After(10 * veryShortTime):
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type dropOnCancelKey struct{}
+
+// WithDropOnCancel returns a context that, when passed to PublishCtx,
+// makes the subscribers drop the message rather than handle it if the
+// context is done before they get to it. This avoids handling messages
+// that have become moot, such as the progress of an operation that has
+// since been abandoned. A handler that has already started is not
+// interrupted.
+//
+// The Completer returned from PublishCtx still completes once all the
+// subscribers have handled or dropped the message, and implements
+// DropCounter so the publisher can find out how many dropped it.
+func WithDropOnCancel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dropOnCancelKey{}, true)
+}
+
+func dropOnCancel(ctx context.Context) bool {
+	drop, _ := ctx.Value(dropOnCancelKey{}).(bool)
+	return drop
+}
+
+// DropCounter is implemented by the Completers returned from the hubs.
+type DropCounter interface {
+	// Dropped returns the number of subscribers that dropped the message
+	// because the context it was published with was cancelled. See
+	// WithDropOnCancel. The count is only final once the Completer is
+	// complete.
+	Dropped() int
+}
+
+// Dropped implements DropCounter.
+func (d *doneHandle) Dropped() int {
+	return int(atomic.LoadInt32(&d.dropped))
+}
+
+// cancelled returns true if the call was published to be dropped when
+// its context is done, and it is. The drop is counted.
+func (h *handlerCallback) cancelled() bool {
+	if h.cancel == nil || h.cancel.Err() == nil {
+		return false
+	}
+	atomic.AddInt32(&h.handle.dropped, 1)
+	return true
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type CancelSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&CancelSuite{})
+
+// publishWhileBlocked publishes a message that blocks the subscriber, then
+// publishes a second with the context, which is cancelled before the
+// subscriber is unblocked. It returns the data handled and the Completer
+// of the second message.
+func publishWhileBlocked(c *gc.C, ctx context.Context) ([]interface{}, pubsub.Completer) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	_, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, "first")
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, handler)
+
+	result, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, "second")
+	c.Assert(err, jc.ErrorIsNil)
+	cancel()
+	close(handler.release)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	return handler.get(), result
+}
+
+func (*CancelSuite) TestDropOnCancel(c *gc.C) {
+	handled, result := publishWhileBlocked(c, pubsub.WithDropOnCancel(context.Background()))
+	c.Check(handled, jc.DeepEquals, []interface{}{"first"})
+	c.Check(result.(pubsub.DropCounter).Dropped(), gc.Equals, 1)
+}
+
+func (*CancelSuite) TestCancelWithoutDrop(c *gc.C) {
+	handled, result := publishWhileBlocked(c, context.Background())
+	c.Check(handled, jc.DeepEquals, []interface{}{"first", "second"})
+	c.Check(result.(pubsub.DropCounter).Dropped(), gc.Equals, 0)
+}
+
+func (*CancelSuite) TestNotCancelled(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	received := make(chan interface{}, 1)
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) {
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.(pubsub.ContextPublisher).PublishCtx(pubsub.WithDropOnCancel(context.Background()), topic, "data")
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	c.Check(<-received, gc.Equals, "data")
+	c.Check(result.(pubsub.DropCounter).Dropped(), gc.Equals, 0)
+}
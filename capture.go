@@ -0,0 +1,123 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+)
+
+// Captures are the parts of a topic captured by the pattern that matched
+// it, so a handler subscribed to a pattern such as `^unit\.(.+)\.status$`
+// gets the unit without parsing the topic again.
+type Captures struct {
+	// Groups are the captured parts of the topic, in the order of the
+	// groups of the pattern. Groups that didn't take part in the match
+	// are empty.
+	Groups []string
+
+	// Named holds the captured parts of the named groups of the pattern,
+	// such as `(?P<unit>.+)`.
+	Named map[string]string
+}
+
+// CapturingMatcher is implemented by the topic matchers that capture parts
+// of the topics they match, such as those returned by MatchRegex. The
+// hub passes the captures of the subscription's matcher to its handler,
+// which gets them with CapturesFromContext.
+type CapturingMatcher interface {
+	TopicMatcher
+
+	// Capture returns the captures for the topic, or false if the topic
+	// doesn't match or the pattern has no groups.
+	Capture(topic Topic) (Captures, bool)
+}
+
+type capturesKey struct{}
+
+func withCaptures(ctx context.Context, captures Captures) context.Context {
+	return context.WithValue(ctx, capturesKey{}, captures)
+}
+
+// CapturesFromContext returns the parts of the topic captured by the
+// matcher of the subscription, for the message being handled. The bool
+// result is false if the matcher doesn't capture anything.
+func CapturesFromContext(ctx context.Context) (Captures, bool) {
+	captures, ok := ctx.Value(capturesKey{}).(Captures)
+	return captures, ok
+}
+
+// capturingMatcher returns the matcher if it can capture parts of the
+// topics, or nil, so subscribers that can't capture anything don't match
+// the topic a second time.
+func capturingMatcher(matcher TopicMatcher) CapturingMatcher {
+	switch m := matcher.(type) {
+	case *regexMatcher:
+		if m.match.NumSubexp() == 0 {
+			return nil
+		}
+	case *wildcardMatcher:
+		if !m.hasWildcards() {
+			return nil
+		}
+	case *anyMatcher:
+		for _, matcher := range m.matchers {
+			if capturingMatcher(matcher) != nil {
+				return m
+			}
+		}
+		return nil
+	}
+	capturing, _ := matcher.(CapturingMatcher)
+	return capturing
+}
+
+// captureTopic adds the captures of the matcher for the topic to the
+// context. The matcher may be nil.
+func captureTopic(ctx context.Context, matcher CapturingMatcher, topic Topic) context.Context {
+	if matcher == nil {
+		return ctx
+	}
+	captures, ok := matcher.Capture(topic)
+	if !ok {
+		return ctx
+	}
+	return withCaptures(ctx, captures)
+}
+
+// Capture implements CapturingMatcher.
+func (m *regexMatcher) Capture(topic Topic) (Captures, bool) {
+	if m.match.NumSubexp() == 0 {
+		return Captures{}, false
+	}
+	matches := m.match.FindStringSubmatch(string(topic))
+	if matches == nil {
+		return Captures{}, false
+	}
+	captures := Captures{Groups: matches[1:]}
+	for i, name := range m.match.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if captures.Named == nil {
+			captures.Named = make(map[string]string)
+		}
+		captures.Named[name] = matches[i]
+	}
+	return captures, true
+}
+
+// Capture implements CapturingMatcher, using the first of the matchers
+// that matches the topic.
+func (m *anyMatcher) Capture(topic Topic) (Captures, bool) {
+	for _, matcher := range m.matchers {
+		if !matcher.Match(topic) {
+			continue
+		}
+		if capturing, ok := matcher.(CapturingMatcher); ok {
+			return capturing.Capture(topic)
+		}
+		return Captures{}, false
+	}
+	return Captures{}, false
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type CaptureSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&CaptureSuite{})
+
+// captureResult is what a handler found in its context.
+type captureResult struct {
+	captures pubsub.Captures
+	ok       bool
+}
+
+func captureHandler(results chan<- captureResult) func(context.Context, pubsub.Topic, interface{}) {
+	return func(ctx context.Context, _ pubsub.Topic, _ interface{}) {
+		captures, ok := pubsub.CapturesFromContext(ctx)
+		results <- captureResult{captures: captures, ok: ok}
+	}
+}
+
+func receiveCaptures(c *gc.C, results <-chan captureResult) captureResult {
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	return captureResult{}
+}
+
+func (*CaptureSuite) TestRegexCaptures(c *gc.C) {
+	matcher := pubsub.MatchRegex(`^unit\.(?P<unit>[^.]+)\.(status|workload)$`)
+	capturing, ok := matcher.(pubsub.CapturingMatcher)
+	c.Assert(ok, jc.IsTrue)
+
+	captures, ok := capturing.Capture("unit.mysql/0.status")
+	c.Assert(ok, jc.IsTrue)
+	c.Check(captures, jc.DeepEquals, pubsub.Captures{
+		Groups: []string{"mysql/0", "status"},
+		Named:  map[string]string{"unit": "mysql/0"},
+	})
+	_, ok = capturing.Capture("machine.0.status")
+	c.Check(ok, jc.IsFalse)
+	_, ok = pubsub.MatchRegex(`^unit\.`).(pubsub.CapturingMatcher).Capture("unit.mysql/0")
+	c.Check(ok, jc.IsFalse)
+}
+
+func (*CaptureSuite) TestHandlerContext(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	results := make(chan captureResult, 1)
+	_, err := hub.Subscribe(pubsub.MatchRegex(`^unit\.(.+)\.status$`), captureHandler(results))
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish("unit.mysql/0.status", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	result := receiveCaptures(c, results)
+	c.Check(result.ok, jc.IsTrue)
+	c.Check(result.captures.Groups, jc.DeepEquals, []string{"mysql/0"})
+	c.Check(result.captures.Named, gc.IsNil)
+}
+
+func (*CaptureSuite) TestNoCaptures(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	results := make(chan captureResult, 1)
+	_, err := hub.Subscribe(pubsub.MatchRegex(`^unit\.`), captureHandler(results))
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish("unit.mysql/0.status", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(receiveCaptures(c, results).ok, jc.IsFalse)
+}
+
+func (*CaptureSuite) TestMatchAny(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	results := make(chan captureResult, 1)
+	_, err := hub.Subscribe(pubsub.MatchAny(
+		pubsub.Topic("machine.added"),
+		pubsub.MatchRegex(`^unit\.(.+)\.status$`),
+	), captureHandler(results))
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish("unit.mysql/0.status", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	result := receiveCaptures(c, results)
+	c.Check(result.ok, jc.IsTrue)
+	c.Check(result.captures.Groups, jc.DeepEquals, []string{"mysql/0"})
+
+	_, err = hub.Publish("machine.added", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(receiveCaptures(c, results).ok, jc.IsFalse)
+}
+
+func (*CaptureSuite) TestMultiplexer(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	unsub, multi, err := pubsub.NewMultiplexer(hub)
+	c.Assert(err, jc.ErrorIsNil)
+	defer unsub.Unsubscribe()
+	results := make(chan captureResult, 1)
+	err = multi.Add(pubsub.MatchRegex(`^unit\.(?P<unit>.+)\.status$`), func(ctx context.Context, _ pubsub.Topic, _ Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		captures, ok := pubsub.CapturesFromContext(ctx)
+		results <- captureResult{captures: captures, ok: ok}
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish("unit.mysql/0.status", Emitter{})
+	c.Assert(err, jc.ErrorIsNil)
+	result := receiveCaptures(c, results)
+	c.Check(result.ok, jc.IsTrue)
+	c.Check(result.captures.Named, jc.DeepEquals, map[string]string{"unit": "mysql/0"})
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Message is a published message as received from a channel returned by
+// SubscribeChan.
+type Message struct {
+	Topic    Topic
+	Data     interface{}
+	Delivery Delivery
+}
+
+// SubscribeChan implements ChanSubscriber.
+func (h *simplehub) SubscribeChan(matcher TopicMatcher, buffer int) (<-chan Message, func(), error) {
+	if buffer < 0 {
+		return nil, nil, errors.NotValidf("negative buffer size")
+	}
+	var (
+		mutex    sync.Mutex
+		closed   bool
+		messages = make(chan Message, buffer)
+		done     = make(chan struct{})
+	)
+	handler := func(ctx context.Context, topic Topic, data interface{}) {
+		delivery, _ := DeliveryFromContext(ctx)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case messages <- Message{Topic: topic, Data: data, Delivery: delivery}:
+		case <-done:
+		}
+	}
+	// The channel is subscribed to the simple hub directly, so the data for
+	// a structured hub is always the map[string]interface{}. The messages
+	// are read after the handler returns, so maps that are reused are
+	// copied.
+	unsub, err := h.Subscribe(matcher, handler, copyPooled())
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var once sync.Once
+	closer := func() {
+		once.Do(func() {
+			// Closing done first makes sure that a handler blocked on
+			// sending a message releases the mutex.
+			close(done)
+			unsub.Unsubscribe()
+			mutex.Lock()
+			defer mutex.Unlock()
+			closed = true
+			close(messages)
+		})
+	}
+	return messages, closer, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ChannelSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ChannelSuite{})
+
+func (*ChannelSuite) TestNegativeBuffer(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, -1)
+	c.Check(err, gc.ErrorMatches, "negative buffer size not valid")
+	c.Check(messages, gc.IsNil)
+	c.Check(closer, gc.IsNil)
+}
+
+func (*ChannelSuite) TestReceiveInOrder(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchRegex("^first"), 0)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	for _, t := range []pubsub.Topic{first, second, firstdot} {
+		_, err := hub.Publish(t, string(t))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	var received []pubsub.Message
+	for len(received) < 2 {
+		select {
+		case message := <-messages:
+			received = append(received, message)
+		case <-time.After(time.Second):
+			c.Fatal("message not received")
+		}
+	}
+	c.Assert(received, jc.DeepEquals, []pubsub.Message{
+		{Topic: first, Data: "first", Delivery: pubsub.Delivery{Sequence: 1}},
+		{Topic: firstdot, Data: "first.next", Delivery: pubsub.Delivery{Sequence: 3}},
+	})
+}
+
+func (*ChannelSuite) TestCloseWithBlockedSend(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 0)
+	c.Assert(err, jc.ErrorIsNil)
+
+	var result pubsub.Completer
+	for i := 0; i < 3; i++ {
+		result, err = hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	// Nothing is reading, so the handler is blocked sending.
+	closer()
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	// Calling the closer again is fine.
+	closer()
+	for range messages {
+	}
+}
+
+func (*ChannelSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(topic, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	_, err = hub.Publish(topic, JustOrigin{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case message := <-messages:
+		c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"origin": "test"})
+	case <-time.After(time.Second):
+		c.Fatal("message not received")
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/juju/errors"
+)
+
+const topicDirective = "//pubsub:topic "
+
+// payload is a structure type declared with a topic directive.
+type payload struct {
+	name   string
+	topic  string
+	fields []field
+}
+
+// field is an exported field of a payload structure.
+type field struct {
+	name      string
+	key       string
+	typ       string
+	omitEmpty bool
+
+	// kind is one of "string", "bool", "int", "uint" or "float" for the
+	// types that are handled directly, and empty for those that fall back
+	// to JSON.
+	kind string
+	bits int
+}
+
+var basicTypes = map[string]struct {
+	kind string
+	bits int
+}{
+	"string":  {"string", 0},
+	"bool":    {"bool", 0},
+	"int":     {"int", 64},
+	"int8":    {"int", 8},
+	"int16":   {"int", 16},
+	"int32":   {"int", 32},
+	"rune":    {"int", 32},
+	"int64":   {"int", 64},
+	"uint":    {"uint", 64},
+	"uint8":   {"uint", 8},
+	"byte":    {"uint", 8},
+	"uint16":  {"uint", 16},
+	"uint32":  {"uint", 32},
+	"uint64":  {"uint", 64},
+	"float32": {"float", 32},
+	"float64": {"float", 64},
+}
+
+// generateDir parses the non-test Go files in the directory, other than
+// the output file, and generates the code for the payload types in them.
+func generateDir(dir, output string) ([]byte, error) {
+	fset := token.NewFileSet()
+	filter := func(info os.FileInfo) bool {
+		name := info.Name()
+		return !strings.HasSuffix(name, "_test.go") && name != output
+	}
+	packages, err := parser.ParseDir(fset, dir, filter, parser.ParseComments)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(packages) != 1 {
+		return nil, errors.Errorf("expected one package in %q, found %d", dir, len(packages))
+	}
+	for name, pkg := range packages {
+		var filenames []string
+		for filename := range pkg.Files {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+		var files []*ast.File
+		for _, filename := range filenames {
+			files = append(files, pkg.Files[filename])
+		}
+		return generate(name, files)
+	}
+	panic("unreachable")
+}
+
+// generate returns the formatted source for the payload types declared in
+// the files.
+func generate(pkg string, files []*ast.File) ([]byte, error) {
+	var payloads []payload
+	for _, file := range files {
+		found, err := findPayloads(file)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		payloads = append(payloads, found...)
+	}
+	if len(payloads) == 0 {
+		return nil, errors.NotFoundf("payload types")
+	}
+
+	var body bytes.Buffer
+	for _, p := range payloads {
+		writePayload(&body, p)
+	}
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// Code generated by pubsubgen. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	source.WriteString("import (\n")
+	if bytes.Contains(body.Bytes(), []byte("fmt.")) {
+		source.WriteString("\t\"fmt\"\n\n")
+	}
+	source.WriteString("\t\"github.com/juju/pubsub\"\n)\n")
+	source.Write(body.Bytes())
+	result, err := format.Source(source.Bytes())
+	if err != nil {
+		return nil, errors.Annotate(err, "formatting generated code")
+	}
+	return result, nil
+}
+
+func findPayloads(file *ast.File) ([]payload, error) {
+	var payloads []payload
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(gen.Specs) == 1 {
+				doc = gen.Doc
+			}
+			topic, ok := findTopic(doc)
+			if !ok {
+				continue
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				return nil, errors.NotValidf("topic directive on non-structure type %s", ts.Name.Name)
+			}
+			fields, err := structFields(st)
+			if err != nil {
+				return nil, errors.Annotatef(err, "type %s", ts.Name.Name)
+			}
+			payloads = append(payloads, payload{
+				name:   ts.Name.Name,
+				topic:  topic,
+				fields: fields,
+			})
+		}
+	}
+	return payloads, nil
+}
+
+func findTopic(doc *ast.CommentGroup) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	for _, comment := range doc.List {
+		if strings.HasPrefix(comment.Text, topicDirective) {
+			topic := strings.TrimSpace(strings.TrimPrefix(comment.Text, topicDirective))
+			return topic, topic != ""
+		}
+	}
+	return "", false
+}
+
+func structFields(st *ast.StructType) ([]field, error) {
+	var fields []field
+	for _, f := range st.Fields.List {
+		if len(f.Names) == 0 {
+			return nil, errors.NotSupportedf("embedded field %s", types.ExprString(f.Type))
+		}
+		var tag string
+		if f.Tag != nil {
+			tag = strings.Trim(f.Tag.Value, "`")
+		}
+		for _, name := range f.Names {
+			if !name.IsExported() {
+				continue
+			}
+			key, omitEmpty, skip, err := parseTag(name.Name, tag)
+			if err != nil {
+				return nil, errors.Annotatef(err, "field %s", name.Name)
+			}
+			if skip {
+				continue
+			}
+			result := field{
+				name:      name.Name,
+				key:       key,
+				typ:       types.ExprString(f.Type),
+				omitEmpty: omitEmpty,
+			}
+			if ident, ok := f.Type.(*ast.Ident); ok {
+				basic := basicTypes[ident.Name]
+				result.kind = basic.kind
+				result.bits = basic.bits
+			}
+			fields = append(fields, result)
+		}
+	}
+	return fields, nil
+}
+
+// parseTag returns the map key for the field, using the same rules as the
+// encoding/json package.
+func parseTag(name, tag string) (key string, omitEmpty, skip bool, err error) {
+	value, ok := reflect.StructTag(tag).Lookup("json")
+	if !ok {
+		return name, false, false, nil
+	}
+	if value == "-" {
+		return "", false, true, nil
+	}
+	parts := strings.Split(value, ",")
+	key = parts[0]
+	if key == "" {
+		key = name
+	}
+	for _, option := range parts[1:] {
+		if option != "omitempty" {
+			return "", false, false, errors.NotSupportedf("json option %q", option)
+		}
+		omitEmpty = true
+	}
+	return key, omitEmpty, false, nil
+}
+
+func writePayload(w *bytes.Buffer, p payload) {
+	topicConst := p.name + "Topic"
+	publish := exportedAs(p.name, "Publish") + upperFirst(p.name)
+	subscribe := exportedAs(p.name, "Subscribe") + upperFirst(p.name)
+
+	fmt.Fprintf(w, "\n// %s is the topic that %s is published on.\n", topicConst, p.name)
+	fmt.Fprintf(w, "const %s pubsub.Topic = %q\n", topicConst, p.topic)
+
+	fmt.Fprintf(w, "\n// MarshalMap implements pubsub.MapMarshaler.\n")
+	fmt.Fprintf(w, "func (v %s) MarshalMap() (map[string]interface{}, error) {\n", p.name)
+	fmt.Fprintf(w, "result := make(map[string]interface{}, %d)\n", len(p.fields))
+	for _, f := range p.fields {
+		writeEncode(w, f)
+	}
+	fmt.Fprintf(w, "return result, nil\n}\n")
+
+	fmt.Fprintf(w, "\n// UnmarshalMap implements pubsub.MapUnmarshaler.\n")
+	fmt.Fprintf(w, "func (v *%s) UnmarshalMap(data map[string]interface{}) error {\n", p.name)
+	for _, f := range p.fields {
+		writeDecode(w, f)
+	}
+	fmt.Fprintf(w, "return nil\n}\n")
+
+	fmt.Fprintf(w, "\n// %s publishes the payload on %s.\n", publish, topicConst)
+	fmt.Fprintf(w, "func %s(hub pubsub.StructuredHub, payload %s) (pubsub.Completer, error) {\n", publish, p.name)
+	fmt.Fprintf(w, "return hub.Publish(%s, payload)\n}\n", topicConst)
+
+	fmt.Fprintf(w, "\n// %s subscribes the handler to %s.\n", subscribe, topicConst)
+	fmt.Fprintf(w, "func %s(hub pubsub.StructuredHub, handler func(pubsub.Topic, %s, error)) (pubsub.Subscription, error) {\n", subscribe, p.name)
+	fmt.Fprintf(w, "return hub.Subscribe(%s, func(topic pubsub.Topic, data map[string]interface{}, err error) {\n", topicConst)
+	fmt.Fprintf(w, "var payload %s\n", p.name)
+	fmt.Fprintf(w, "if err == nil {\nerr = payload.UnmarshalMap(data)\n}\n")
+	fmt.Fprintf(w, "handler(topic, payload, err)\n})\n}\n")
+}
+
+func writeEncode(w *bytes.Buffer, f field) {
+	value := "v." + f.name
+	switch f.kind {
+	case "int", "uint", "float":
+		// Numbers are always float64 values after a round trip through
+		// JSON.
+		value = "float64(v." + f.name + ")"
+	}
+	if f.kind == "" {
+		if f.omitEmpty {
+			fmt.Fprintf(w, "if !pubsub.IsEmptyValue(v.%s) {\n", f.name)
+		} else {
+			fmt.Fprintf(w, "{\n")
+		}
+		fmt.Fprintf(w, "value, err := pubsub.EncodeValue(v.%s)\n", f.name)
+		fmt.Fprintf(w, "if err != nil {\nreturn nil, fmt.Errorf(\"field %s: %%v\", err)\n}\n", f.name)
+		fmt.Fprintf(w, "result[%q] = value\n}\n", f.key)
+		return
+	}
+	if f.omitEmpty {
+		zero := "0"
+		switch f.kind {
+		case "string":
+			zero = `""`
+		case "bool":
+			zero = "false"
+		}
+		fmt.Fprintf(w, "if v.%s != %s {\nresult[%q] = %s\n}\n", f.name, zero, f.key, value)
+		return
+	}
+	fmt.Fprintf(w, "result[%q] = %s\n", f.key, value)
+}
+
+func writeDecode(w *bytes.Buffer, f field) {
+	fmt.Fprintf(w, "if value, ok := pubsub.MapValue(data, %q); ok && value != nil {\n", f.key)
+	if f.kind == "" {
+		fmt.Fprintf(w, "if err := pubsub.DecodeValue(value, &v.%s); err != nil {\n", f.name)
+		fmt.Fprintf(w, "return fmt.Errorf(\"field %s: %%v\", err)\n}\n}\n", f.name)
+		return
+	}
+	var call, decodedType string
+	switch f.kind {
+	case "string":
+		call, decodedType = "pubsub.DecodeString(value)", "string"
+	case "bool":
+		call, decodedType = "pubsub.DecodeBool(value)", "bool"
+	case "int":
+		call, decodedType = fmt.Sprintf("pubsub.DecodeInt(value, %d)", f.bits), "int64"
+	case "uint":
+		call, decodedType = fmt.Sprintf("pubsub.DecodeUint(value, %d)", f.bits), "uint64"
+	case "float":
+		call, decodedType = fmt.Sprintf("pubsub.DecodeFloat(value, %d)", f.bits), "float64"
+	}
+	fmt.Fprintf(w, "decoded, err := %s\n", call)
+	fmt.Fprintf(w, "if err != nil {\nreturn fmt.Errorf(\"field %s: %%v\", err)\n}\n", f.name)
+	if f.typ == decodedType {
+		fmt.Fprintf(w, "v.%s = decoded\n}\n", f.name)
+	} else {
+		fmt.Fprintf(w, "v.%s = %s(decoded)\n}\n", f.name, f.typ)
+	}
+}
+
+// exportedAs returns the prefix capitalised to match whether name is
+// exported, so the generated functions are exported if the type is.
+func exportedAs(name, prefix string) string {
+	if ast.IsExported(name) {
+		return prefix
+	}
+	return strings.ToLower(prefix[:1]) + prefix[1:]
+}
+
+func upperFirst(s string) string {
+	runes := []rune(s)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type GenerateSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&GenerateSuite{})
+
+func (*GenerateSuite) TestGolden(c *gc.C) {
+	// The golden file is regenerated with:
+	//   go run . -output payload_gen.go testdata
+	expected, err := ioutil.ReadFile("testdata/payload_gen.go")
+	c.Assert(err, jc.ErrorIsNil)
+	source, err := generateDir("testdata", "payload_gen.go")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(source), gc.Equals, string(expected))
+}
+
+func generateSource(c *gc.C, source string) ([]byte, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "source.go", source, parser.ParseComments)
+	c.Assert(err, jc.ErrorIsNil)
+	return generate("source", []*ast.File{file})
+}
+
+func (*GenerateSuite) TestNoPayloads(c *gc.C) {
+	_, err := generateSource(c, "package source\n\ntype Thing struct{}\n")
+	c.Assert(err, gc.ErrorMatches, "payload types not found")
+}
+
+func (*GenerateSuite) TestNotStructure(c *gc.C) {
+	_, err := generateSource(c, "package source\n\n//pubsub:topic thing\ntype Thing string\n")
+	c.Assert(err, gc.ErrorMatches, "topic directive on non-structure type Thing not valid")
+}
+
+func (*GenerateSuite) TestEmbeddedField(c *gc.C) {
+	_, err := generateSource(c, "package source\n\ntype Base struct{}\n\n//pubsub:topic thing\ntype Thing struct {\n\tBase\n}\n")
+	c.Assert(err, gc.ErrorMatches, "type Thing: embedded field Base not supported")
+}
+
+func (*GenerateSuite) TestUnsupportedOption(c *gc.C) {
+	_, err := generateSource(c, "package source\n\n//pubsub:topic thing\ntype Thing struct {\n\tCount int `json:\"count,string\"`\n}\n")
+	c.Assert(err, gc.ErrorMatches, `type Thing: field Count: json option "string" not supported`)
+}
+
+func (*GenerateSuite) TestGroupedDeclaration(c *gc.C) {
+	source, err := generateSource(c, `package source
+
+type (
+	//pubsub:topic first
+	First struct{}
+
+	Second struct{}
+)
+`)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(source), jc.Contains, `const FirstTopic pubsub.Topic = "first"`)
+	c.Assert(string(source), gc.Not(jc.Contains), "Second")
+	// No field needs an error, so fmt isn't imported.
+	c.Assert(string(source), gc.Not(jc.Contains), `"fmt"`)
+}
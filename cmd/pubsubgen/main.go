@@ -0,0 +1,57 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// The pubsubgen command generates code that lets payload structures be
+// published on and received from a structured hub without the reflection
+// and marshalling round trips of the dynamic API.
+//
+// Payload types are declared by adding a directive naming the topic to the
+// doc comment of the structure:
+//
+//	//pubsub:topic machine.changed
+//	type MachineChanged struct {
+//	    Name   string `json:"name"`
+//	    Status string `json:"status,omitempty"`
+//	}
+//
+// and running pubsubgen in the package directory, normally from a
+// go:generate comment:
+//
+//	//go:generate pubsubgen
+//
+// For each payload type, the generated file defines a constant for the
+// topic, MarshalMap and UnmarshalMap methods that implement
+// pubsub.MapMarshaler and pubsub.MapUnmarshaler, and Publish and Subscribe
+// functions that take and give the payload type. Fields of types with no
+// special handling, such as nested structures, fall back to JSON for that
+// field alone.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	output := flag.String("output", "pubsub_gen.go", "name of the file to generate")
+	flag.Parse()
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	if err := run(dir, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "pubsubgen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, output string) error {
+	source, err := generateDir(dir, output)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, output), source, 0644)
+}
@@ -0,0 +1,30 @@
+package payload
+
+import "time"
+
+//go:generate pubsubgen
+
+// MachineChanged is published when a machine changes.
+//
+//pubsub:topic machine.changed
+type MachineChanged struct {
+	Name    string    `json:"name"`
+	Status  string    `json:"status,omitempty"`
+	Cores   int       `json:"cores"`
+	Load    float32   `json:"load,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+	Updated time.Time `json:"updated"`
+	Dying   bool
+	Ignored string `json:"-"`
+	local   string
+}
+
+// Unrelated has no directive so nothing is generated for it.
+type Unrelated struct {
+	Value string
+}
+
+//pubsub:topic unit.removed
+type unitRemoved struct {
+	ID uint16 `json:"id"`
+}
@@ -0,0 +1,145 @@
+// Code generated by pubsubgen. DO NOT EDIT.
+
+package payload
+
+import (
+	"fmt"
+
+	"github.com/juju/pubsub"
+)
+
+// MachineChangedTopic is the topic that MachineChanged is published on.
+const MachineChangedTopic pubsub.Topic = "machine.changed"
+
+// MarshalMap implements pubsub.MapMarshaler.
+func (v MachineChanged) MarshalMap() (map[string]interface{}, error) {
+	result := make(map[string]interface{}, 7)
+	result["name"] = v.Name
+	if v.Status != "" {
+		result["status"] = v.Status
+	}
+	result["cores"] = float64(v.Cores)
+	if v.Load != 0 {
+		result["load"] = float64(v.Load)
+	}
+	if !pubsub.IsEmptyValue(v.Tags) {
+		value, err := pubsub.EncodeValue(v.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("field Tags: %v", err)
+		}
+		result["tags"] = value
+	}
+	{
+		value, err := pubsub.EncodeValue(v.Updated)
+		if err != nil {
+			return nil, fmt.Errorf("field Updated: %v", err)
+		}
+		result["updated"] = value
+	}
+	result["Dying"] = v.Dying
+	return result, nil
+}
+
+// UnmarshalMap implements pubsub.MapUnmarshaler.
+func (v *MachineChanged) UnmarshalMap(data map[string]interface{}) error {
+	if value, ok := pubsub.MapValue(data, "name"); ok && value != nil {
+		decoded, err := pubsub.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("field Name: %v", err)
+		}
+		v.Name = decoded
+	}
+	if value, ok := pubsub.MapValue(data, "status"); ok && value != nil {
+		decoded, err := pubsub.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("field Status: %v", err)
+		}
+		v.Status = decoded
+	}
+	if value, ok := pubsub.MapValue(data, "cores"); ok && value != nil {
+		decoded, err := pubsub.DecodeInt(value, 64)
+		if err != nil {
+			return fmt.Errorf("field Cores: %v", err)
+		}
+		v.Cores = int(decoded)
+	}
+	if value, ok := pubsub.MapValue(data, "load"); ok && value != nil {
+		decoded, err := pubsub.DecodeFloat(value, 32)
+		if err != nil {
+			return fmt.Errorf("field Load: %v", err)
+		}
+		v.Load = float32(decoded)
+	}
+	if value, ok := pubsub.MapValue(data, "tags"); ok && value != nil {
+		if err := pubsub.DecodeValue(value, &v.Tags); err != nil {
+			return fmt.Errorf("field Tags: %v", err)
+		}
+	}
+	if value, ok := pubsub.MapValue(data, "updated"); ok && value != nil {
+		if err := pubsub.DecodeValue(value, &v.Updated); err != nil {
+			return fmt.Errorf("field Updated: %v", err)
+		}
+	}
+	if value, ok := pubsub.MapValue(data, "Dying"); ok && value != nil {
+		decoded, err := pubsub.DecodeBool(value)
+		if err != nil {
+			return fmt.Errorf("field Dying: %v", err)
+		}
+		v.Dying = decoded
+	}
+	return nil
+}
+
+// PublishMachineChanged publishes the payload on MachineChangedTopic.
+func PublishMachineChanged(hub pubsub.StructuredHub, payload MachineChanged) (pubsub.Completer, error) {
+	return hub.Publish(MachineChangedTopic, payload)
+}
+
+// SubscribeMachineChanged subscribes the handler to MachineChangedTopic.
+func SubscribeMachineChanged(hub pubsub.StructuredHub, handler func(pubsub.Topic, MachineChanged, error)) (pubsub.Subscription, error) {
+	return hub.Subscribe(MachineChangedTopic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		var payload MachineChanged
+		if err == nil {
+			err = payload.UnmarshalMap(data)
+		}
+		handler(topic, payload, err)
+	})
+}
+
+// unitRemovedTopic is the topic that unitRemoved is published on.
+const unitRemovedTopic pubsub.Topic = "unit.removed"
+
+// MarshalMap implements pubsub.MapMarshaler.
+func (v unitRemoved) MarshalMap() (map[string]interface{}, error) {
+	result := make(map[string]interface{}, 1)
+	result["id"] = float64(v.ID)
+	return result, nil
+}
+
+// UnmarshalMap implements pubsub.MapUnmarshaler.
+func (v *unitRemoved) UnmarshalMap(data map[string]interface{}) error {
+	if value, ok := pubsub.MapValue(data, "id"); ok && value != nil {
+		decoded, err := pubsub.DecodeUint(value, 16)
+		if err != nil {
+			return fmt.Errorf("field ID: %v", err)
+		}
+		v.ID = uint16(decoded)
+	}
+	return nil
+}
+
+// publishUnitRemoved publishes the payload on unitRemovedTopic.
+func publishUnitRemoved(hub pubsub.StructuredHub, payload unitRemoved) (pubsub.Completer, error) {
+	return hub.Publish(unitRemovedTopic, payload)
+}
+
+// subscribeUnitRemoved subscribes the handler to unitRemovedTopic.
+func subscribeUnitRemoved(hub pubsub.StructuredHub, handler func(pubsub.Topic, unitRemoved, error)) (pubsub.Subscription, error) {
+	return hub.Subscribe(unitRemovedTopic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		var payload unitRemoved
+		if err == nil {
+			err = payload.UnmarshalMap(data)
+		}
+		handler(topic, payload, err)
+	})
+}
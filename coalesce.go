@@ -0,0 +1,118 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+// CoalesceRule has the hub collapse identical messages published on the
+// matching topics while an earlier one is still waiting in the queue of a
+// subscriber, so a slow subscriber handles each distinct message once
+// rather than catching up on repeats. The later messages are delivered as
+// the one already waiting, and the Coalesced field of its Delivery counts
+// them. The Completers of the later messages complete once it has been
+// handled.
+//
+// Messages are only coalesced with those on the same topic, with the same
+// ordering key, that haven't yet been passed to the handler. Messages
+// retried by a RetryPolicy, and those of durable subscriptions, are never
+// coalesced.
+type CoalesceRule struct {
+	// Matcher selects the topics whose messages are coalesced.
+	Matcher TopicMatcher
+
+	// Key, if set, returns the key that identifies the message, and
+	// messages with the same key are identical. If it is not set, the
+	// data of the messages are compared with reflect.DeepEqual. For
+	// structured hubs the data is the map form of the data. The key is
+	// called once for each message published on the matching topics, and
+	// must not call any methods of the hub.
+	Key func(topic Topic, data interface{}) string
+}
+
+// Validate checks that the rule is valid.
+func (r CoalesceRule) Validate() error {
+	if r.Matcher == nil {
+		return errors.NotValidf("missing Matcher")
+	}
+	return nil
+}
+
+// coalesce identifies the messages that a message may be coalesced with.
+type coalesce struct {
+	// byKey is true if the messages are compared by key rather than by
+	// their data.
+	byKey bool
+	key   string
+}
+
+// coalesceFor returns how the message is compared with the messages
+// waiting in the queues, or nil if no rule matches its topic.
+func (h *simplehub) coalesceFor(topic Topic, data interface{}) *coalesce {
+	for _, rule := range h.coalesceRules {
+		if !rule.Matcher.Match(topic) {
+			continue
+		}
+		if rule.Key == nil {
+			return &coalesce{}
+		}
+		return &coalesce{byKey: true, key: rule.Key(topic, data)}
+	}
+	return nil
+}
+
+// identical returns true if the call can be delivered as the waiting one.
+func (c *coalesce) identical(waiting, call *handlerCallback) bool {
+	if waiting.topic != call.topic || waiting.key != call.key {
+		return false
+	}
+	if c.byKey {
+		return waiting.coalesce.key == c.key
+	}
+	return reflect.DeepEqual(waiting.data, call.data)
+}
+
+// coalesced merges the call into an identical call waiting in the queue,
+// and returns true if there was one. The mutex must be held.
+func (s *subscriber) coalesced(call *handlerCallback) bool {
+	if call.coalesce == nil || s.durable != nil {
+		return false
+	}
+	for _, waiting := range s.coalescing[call.topic] {
+		if call.coalesce.identical(waiting, call) {
+			waiting.mu.Lock()
+			waiting.merged = append(waiting.merged, call)
+			waiting.mu.Unlock()
+			return true
+		}
+	}
+	if s.coalescing == nil {
+		s.coalescing = make(map[Topic][]*handlerCallback)
+	}
+	s.coalescing[call.topic] = append(s.coalescing[call.topic], call)
+	return false
+}
+
+// stopCoalescing is called when the call leaves the queue, so no more
+// calls are merged into it. The mutex must be held.
+func (s *subscriber) stopCoalescing(call *handlerCallback) {
+	if call.coalesce == nil {
+		return
+	}
+	waiting := s.coalescing[call.topic]
+	for i, existing := range waiting {
+		if existing == call {
+			waiting = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(s.coalescing, call.topic)
+		return
+	}
+	s.coalescing[call.topic] = waiting
+}
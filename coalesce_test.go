@@ -0,0 +1,149 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type CoalesceSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&CoalesceSuite{})
+
+// coalesceReceiver blocks in its handler until released, and records the
+// data and coalesced count of each message.
+type coalesceReceiver struct {
+	blocking *blockingHandler
+
+	mutex     sync.Mutex
+	coalesced []string
+}
+
+func newCoalesceReceiver() *coalesceReceiver {
+	return &coalesceReceiver{blocking: newBlockingHandler()}
+}
+
+func (r *coalesceReceiver) handle(ctx context.Context, topic pubsub.Topic, data interface{}) {
+	delivery, _ := pubsub.DeliveryFromContext(ctx)
+	r.mutex.Lock()
+	r.coalesced = append(r.coalesced, fmt.Sprintf("%v:%d", data, delivery.Coalesced))
+	r.mutex.Unlock()
+	r.blocking.handle(topic, data)
+}
+
+func (r *coalesceReceiver) get() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.coalesced
+}
+
+func publishAll(c *gc.C, hub pubsub.Hub, topic pubsub.Topic, values ...interface{}) []pubsub.Completer {
+	var results []pubsub.Completer
+	for _, value := range values {
+		result, err := hub.Publish(topic, value)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	return results
+}
+
+func (*CoalesceSuite) TestCoalesceIdentical(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Coalesce: []pubsub.CoalesceRule{{Matcher: topic}},
+	})
+	receiver := newCoalesceReceiver()
+	_, err := hub.Subscribe(pubsub.MatchAll, receiver.handle)
+	c.Assert(err, jc.ErrorIsNil)
+
+	results := publishAll(c, hub, topic, "x")
+	waitStarted(c, receiver.blocking)
+	// The message being handled isn't coalesced with.
+	results = append(results, publishAll(c, hub, topic, "x", "y", "x", "y", "z")...)
+	// Nor are those on other topics.
+	results = append(results, publishAll(c, hub, first, "z", "z")...)
+	checkNotComplete(c, results[2])
+	close(receiver.blocking.release)
+	for _, result := range results {
+		waitComplete(c, result)
+	}
+	c.Check(receiver.get(), jc.DeepEquals, []string{
+		"x:0", "x:1", "y:1", "z:0", "z:0", "z:0",
+	})
+}
+
+func (*CoalesceSuite) TestCoalesceByKey(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			Coalesce: []pubsub.CoalesceRule{{
+				Matcher: pubsub.MatchAll,
+				Key: func(_ pubsub.Topic, data interface{}) string {
+					return fmt.Sprint(data.(map[string]interface{})["id"])
+				},
+			}},
+		},
+	})
+	receiver := newCoalesceReceiver()
+	_, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		receiver.handle(ctx, topic, data.Origin)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	results := publishAll(c, hub, topic, Emitter{Origin: "first", ID: 1})
+	waitStarted(c, receiver.blocking)
+	results = append(results, publishAll(c, hub, topic,
+		Emitter{Origin: "second", ID: 2},
+		Emitter{Origin: "third", ID: 2},
+		Emitter{Origin: "fourth", ID: 3},
+	)...)
+	close(receiver.blocking.release)
+	for _, result := range results {
+		waitComplete(c, result)
+	}
+	// The first of the coalesced messages is the one delivered.
+	c.Check(receiver.get(), jc.DeepEquals, []string{"first:0", "second:1", "fourth:0"})
+}
+
+func (*CoalesceSuite) TestCoalesceDrained(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Coalesce: []pubsub.CoalesceRule{{Matcher: topic}},
+	})
+	receiver := newCoalesceReceiver()
+	sub, err := hub.Subscribe(topic, receiver.handle)
+	c.Assert(err, jc.ErrorIsNil)
+
+	publishAll(c, hub, topic, "x")
+	waitStarted(c, receiver.blocking)
+	results := publishAll(c, hub, topic, "y", "y")
+	messages := sub.Drain()
+	c.Assert(messages, gc.HasLen, 1)
+	c.Check(messages[0].Data, gc.Equals, "y")
+	c.Check(messages[0].Delivery.Coalesced, gc.Equals, 1)
+	for _, result := range results {
+		waitComplete(c, result)
+	}
+
+	// Once drained, messages aren't coalesced with the drained ones.
+	results = publishAll(c, hub, topic, "y")
+	close(receiver.blocking.release)
+	waitComplete(c, results[0])
+	c.Check(receiver.get(), jc.DeepEquals, []string{"x:0", "y:0"})
+}
+
+func (*CoalesceSuite) TestCoalesceRuleValidate(c *gc.C) {
+	err := pubsub.CoalesceRule{}.Validate()
+	c.Check(err, gc.ErrorMatches, "missing Matcher not valid")
+	c.Check(err, jc.Satisfies, errors.IsNotValid)
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+)
+
+// DefaultCompressionThreshold is the size in bytes of the smallest
+// serialized payload that is compressed, if the CompressionConfig doesn't
+// give a threshold.
+const DefaultCompressionThreshold = 1024
+
+// DefaultMaxDecompressedSize is the size in bytes of the largest payload
+// that GzipCompressor decompresses.
+const DefaultMaxDecompressedSize = 64 << 20
+
+// compressedPrefix starts the frame of each compressed payload, and is
+// followed by the name of the compressor, a zero byte, and the compressed
+// bytes. Payloads serialized as JSON never start with a zero byte.
+var compressedPrefix = []byte("\x00pubsub-compressed:")
+
+// Compressor compresses and decompresses serialized payloads. GzipCompressor
+// is provided, and other algorithms, such as zstd, can be used by
+// implementing this interface.
+type Compressor interface {
+	// Name identifies the algorithm in the compressed payloads.
+	Name() string
+
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress is given payloads read from peers and stores, so it
+	// should refuse to decompress payloads beyond a maximum size rather
+	// than let a small payload expand without limit.
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCompressor compresses payloads with gzip, and decompresses those of
+// up to DefaultMaxDecompressedSize bytes.
+var GzipCompressor Compressor = gzipCompressor{maxSize: DefaultMaxDecompressedSize}
+
+// NewGzipCompressor returns a Compressor like GzipCompressor that
+// decompresses payloads of up to maxSize bytes.
+func NewGzipCompressor(maxSize int) (Compressor, error) {
+	if maxSize <= 0 {
+		return nil, errors.NotValidf("maxSize %d", maxSize)
+	}
+	return gzipCompressor{maxSize: maxSize}, nil
+}
+
+type gzipCompressor struct {
+	maxSize int
+}
+
+// Name implements Compressor.
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+// Compress implements Compressor.
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor.
+func (c gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader.Close()
+	// One byte more than the maximum is read to tell whether there is
+	// more.
+	result, err := ioutil.ReadAll(io.LimitReader(reader, int64(c.maxSize)+1))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(result) > c.maxSize {
+		return nil, errors.NotValidf("payload decompressing to more than %d bytes", c.maxSize)
+	}
+	return result, nil
+}
+
+// CompressionMetrics is told the sizes of each payload that is compressed.
+type CompressionMetrics interface {
+	Compressed(compressor string, uncompressed, compressed int)
+}
+
+// CompressionConfig is the argument struct for CompressingMarshaller.
+type CompressionConfig struct {
+	// Compressor compresses the payloads that are at least Threshold
+	// bytes when serialized.
+	Compressor Compressor
+
+	// Decompressors are the further algorithms that can be read, for
+	// payloads written by peers or by earlier versions that compressed
+	// with a different algorithm. The Compressor can always be read.
+	Decompressors []Compressor
+
+	// Threshold is the serialized size in bytes from which payloads are
+	// compressed. It defaults to DefaultCompressionThreshold.
+	Threshold int
+
+	// Metrics, if set, is told the sizes of the compressed payloads.
+	Metrics CompressionMetrics
+}
+
+// Validate checks that the config values are valid.
+func (config CompressionConfig) Validate() error {
+	if config.Compressor == nil {
+		return errors.NotValidf("missing Compressor")
+	}
+	if config.Threshold < 0 {
+		return errors.NotValidf("negative Threshold")
+	}
+	return nil
+}
+
+// CompressingMarshaller returns a Marshaller that compresses the payloads
+// serialized by the marshaller that are at least the threshold size. The
+// compressed payloads are framed with the name of the compressor, so they
+// can be told apart from payloads that weren't compressed, and from those
+// compressed with another algorithm. Unmarshal reads both. Use it as the
+// Marshaller of a DurableConfig to compress the messages spilled to a
+// store, or as the Codec of a WireBridgeConfig to compress the messages
+// sent over a connection, in which case the other end must be able to
+// decompress them.
+func CompressingMarshaller(marshaller Marshaller, config CompressionConfig) (Marshaller, error) {
+	if marshaller == nil {
+		return nil, errors.NotValidf("missing marshaller")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if config.Threshold == 0 {
+		config.Threshold = DefaultCompressionThreshold
+	}
+	m := &compressingMarshaller{
+		marshaller:    marshaller,
+		config:        config,
+		decompressors: map[string]Compressor{config.Compressor.Name(): config.Compressor},
+	}
+	for _, decompressor := range config.Decompressors {
+		m.decompressors[decompressor.Name()] = decompressor
+	}
+	return m, nil
+}
+
+type compressingMarshaller struct {
+	marshaller    Marshaller
+	config        CompressionConfig
+	decompressors map[string]Compressor
+}
+
+// Marshal implements Marshaller.
+func (m *compressingMarshaller) Marshal(value interface{}) ([]byte, error) {
+	data, err := m.marshaller.Marshal(value)
+	if err != nil || len(data) < m.config.Threshold {
+		return data, err
+	}
+	compressed, err := m.config.Compressor.Compress(data)
+	if err != nil {
+		return nil, errors.Annotatef(err, "compressing with %s", m.config.Compressor.Name())
+	}
+	if m.config.Metrics != nil {
+		m.config.Metrics.Compressed(m.config.Compressor.Name(), len(data), len(compressed))
+	}
+	name := m.config.Compressor.Name()
+	framed := make([]byte, 0, len(compressedPrefix)+len(name)+1+len(compressed))
+	framed = append(framed, compressedPrefix...)
+	framed = append(framed, name...)
+	framed = append(framed, 0)
+	return append(framed, compressed...), nil
+}
+
+// Unmarshal implements Marshaller.
+func (m *compressingMarshaller) Unmarshal(data []byte, value interface{}) error {
+	if bytes.HasPrefix(data, compressedPrefix) {
+		rest := data[len(compressedPrefix):]
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return errors.NotValidf("compressed payload without compressor name")
+		}
+		name := string(rest[:end])
+		decompressor, ok := m.decompressors[name]
+		if !ok {
+			return errors.NotSupportedf("compression %q", name)
+		}
+		decompressed, err := decompressor.Decompress(rest[end+1:])
+		if err != nil {
+			return errors.Annotatef(err, "decompressing with %s", name)
+		}
+		data = decompressed
+	}
+	return m.marshaller.Unmarshal(data, value)
+}
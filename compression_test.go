@@ -0,0 +1,216 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type CompressionSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&CompressionSuite{})
+
+type compressionMetrics struct {
+	mutex sync.Mutex
+	sizes [][2]int
+}
+
+func (m *compressionMetrics) Compressed(compressor string, uncompressed, compressed int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sizes = append(m.sizes, [2]int{uncompressed, compressed})
+}
+
+// reversingCompressor stands in for another algorithm.
+type reversingCompressor struct{}
+
+func (reversingCompressor) Name() string { return "reverse" }
+
+func (reversingCompressor) Compress(data []byte) ([]byte, error) {
+	result := make([]byte, len(data))
+	for i, b := range data {
+		result[len(data)-1-i] = b
+	}
+	return result, nil
+}
+
+func (r reversingCompressor) Decompress(data []byte) ([]byte, error) {
+	return r.Compress(data)
+}
+
+func (*CompressionSuite) TestValidate(c *gc.C) {
+	_, err := pubsub.CompressingMarshaller(nil, pubsub.CompressionConfig{Compressor: pubsub.GzipCompressor})
+	c.Check(err, gc.ErrorMatches, "missing marshaller not valid")
+	_, err = pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{})
+	c.Check(err, gc.ErrorMatches, "missing Compressor not valid")
+	_, err = pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{
+		Compressor: pubsub.GzipCompressor,
+		Threshold:  -1,
+	})
+	c.Check(err, gc.ErrorMatches, "negative Threshold not valid")
+}
+
+func (*CompressionSuite) TestThreshold(c *gc.C) {
+	metrics := &compressionMetrics{}
+	marshaller, err := pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{
+		Compressor: pubsub.GzipCompressor,
+		Threshold:  100,
+		Metrics:    metrics,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	small := map[string]interface{}{"value": "small"}
+	data, err := marshaller.Marshal(small)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(string(data), gc.Equals, `{"value":"small"}`)
+
+	large := map[string]interface{}{"value": strings.Repeat("large", 100)}
+	data, err = marshaller.Marshal(large)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(bytes.HasPrefix(data, []byte("\x00pubsub-compressed:gzip\x00")), jc.IsTrue)
+	c.Check(len(data) < 100, jc.IsTrue)
+
+	for _, expected := range []map[string]interface{}{small, large} {
+		encoded, err := marshaller.Marshal(expected)
+		c.Assert(err, jc.ErrorIsNil)
+		var result map[string]interface{}
+		c.Assert(marshaller.Unmarshal(encoded, &result), jc.ErrorIsNil)
+		c.Check(result, jc.DeepEquals, expected)
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	c.Assert(metrics.sizes, gc.HasLen, 2)
+	c.Check(metrics.sizes[0][0], gc.Equals, 512)
+	c.Check(metrics.sizes[0][1], gc.Equals, len(data)-len("\x00pubsub-compressed:gzip\x00"))
+}
+
+func (*CompressionSuite) TestDecompressors(c *gc.C) {
+	reversing, err := pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{
+		Compressor: reversingCompressor{},
+		Threshold:  1,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := reversing.Marshal("hello")
+	c.Assert(err, jc.ErrorIsNil)
+
+	gzipOnly, err := pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{
+		Compressor: pubsub.GzipCompressor,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	var result string
+	err = gzipOnly.Unmarshal(data, &result)
+	c.Check(err, gc.ErrorMatches, `compression "reverse" not supported`)
+
+	both, err := pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{
+		Compressor:    pubsub.GzipCompressor,
+		Decompressors: []pubsub.Compressor{reversingCompressor{}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(both.Unmarshal(data, &result), jc.ErrorIsNil)
+	c.Check(result, gc.Equals, "hello")
+
+	err = both.Unmarshal([]byte("\x00pubsub-compressed:gzip"), &result)
+	c.Check(err, gc.ErrorMatches, "compressed payload without compressor name not valid")
+}
+
+func (*CompressionSuite) TestMaxDecompressedSize(c *gc.C) {
+	_, err := pubsub.NewGzipCompressor(0)
+	c.Check(err, gc.ErrorMatches, "maxSize 0 not valid")
+	compressor, err := pubsub.NewGzipCompressor(100)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(compressor.Name(), gc.Equals, "gzip")
+
+	// A small payload that expands beyond the maximum is refused.
+	compressed, err := compressor.Compress(make([]byte, 101))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(len(compressed) < 100, jc.IsTrue)
+	_, err = compressor.Decompress(compressed)
+	c.Check(err, gc.ErrorMatches, "payload decompressing to more than 100 bytes not valid")
+
+	compressed, err = compressor.Compress(make([]byte, 100))
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := compressor.Decompress(compressed)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(data, gc.HasLen, 100)
+
+	// Payloads compressed by the limited compressor are read by the
+	// default one.
+	data, err = pubsub.GzipCompressor.Decompress(compressed)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(data, gc.HasLen, 100)
+}
+
+func (*CompressionSuite) TestWireBridge(c *gc.C) {
+	codec, err := pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{
+		Compressor: pubsub.GzipCompressor,
+		Threshold:  1,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	source := pubsub.NewSimpleHub()
+	target := pubsub.NewSimpleHub()
+	messages, closer, err := target.(pubsub.ChanSubscriber).SubscribeChan(topic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	sourceConn, targetConn := net.Pipe()
+	for _, config := range []pubsub.WireBridgeConfig{
+		{Hub: source, Conn: sourceConn, Codec: codec, Forward: pubsub.MatchAll},
+		{Hub: target, Conn: targetConn, Codec: codec},
+	} {
+		bridge, err := pubsub.NewWireBridge(config)
+		c.Assert(err, jc.ErrorIsNil)
+		defer bridge.Unsubscribe()
+	}
+
+	_, err = source.Publish(topic, map[string]interface{}{"origin": "source"})
+	c.Assert(err, jc.ErrorIsNil)
+	message := receive(c, messages)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"origin": "source"})
+}
+
+func (*CompressionSuite) TestDurableSpill(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	marshaller, err := pubsub.CompressingMarshaller(pubsub.JSONMarshaller, pubsub.CompressionConfig{
+		Compressor: pubsub.GzipCompressor,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle, pubsub.Named("durable"), pubsub.Durable(pubsub.DurableConfig{
+		Store:      store,
+		SpillAfter: 1,
+		Marshaller: marshaller,
+	}))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	large := strings.Repeat("x", 10000)
+	var done pubsub.Completer
+	for i := 0; i < 3; i++ {
+		done, err = hub.Publish(topic, large)
+		c.Assert(err, jc.ErrorIsNil)
+		if i == 0 {
+			waitStarted(c, handler)
+		}
+	}
+	records, err := store.GetRange("durable", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(records, gc.HasLen, 1)
+	c.Check(len(records[0].Data) < 1000, jc.IsTrue)
+
+	close(handler.release)
+	waitComplete(c, done)
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{large, large, large})
+}
@@ -0,0 +1,259 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package consulkv provides a pubsub.KeyValueStore that watches and writes
+// the keys of a consul agent through its KV HTTP API, so a key-value bridge
+// can publish the changes to consul keys on a hub.
+package consulkv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+
+	"github.com/juju/pubsub"
+)
+
+var logger = loggo.GetLogger("pubsub.consulkv")
+
+// DefaultWaitTime is how long each blocking query waits for a change
+// unless the store is configured otherwise.
+const DefaultWaitTime = 5 * time.Minute
+
+// Config is the argument struct for New.
+type Config struct {
+	// Address is the URL of the consul agent, such as
+	// "http://127.0.0.1:8500".
+	Address string
+
+	// Token, if set, is sent as the ACL token of each request.
+	Token string
+
+	// Client makes the requests. It defaults to http.DefaultClient, and
+	// must not time out requests before the WaitTime has passed.
+	Client *http.Client
+
+	// WaitTime is how long each blocking query waits for a change before
+	// it is made again. It defaults to DefaultWaitTime.
+	WaitTime time.Duration
+}
+
+// Validate checks that the config values are valid.
+func (config Config) Validate() error {
+	if config.Address == "" {
+		return errors.NotValidf("missing Address")
+	}
+	if _, err := url.Parse(config.Address); err != nil {
+		return errors.NotValidf("Address %q", config.Address)
+	}
+	if config.WaitTime < 0 {
+		return errors.NotValidf("negative WaitTime")
+	}
+	return nil
+}
+
+// Store is a pubsub.KeyValueStore backed by the KV store of a consul agent.
+// Watches are made with blocking queries on the prefix, and the keys that
+// changed between the results are reported in the order consul modified
+// them, with their ModifyIndex as the revision.
+type Store struct {
+	address  string
+	token    string
+	client   *http.Client
+	waitTime time.Duration
+}
+
+var _ pubsub.KeyValueStore = (*Store)(nil)
+
+// New returns a Store for the consul agent of the config.
+func New(config Config) (*Store, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := &Store{
+		address:  config.Address,
+		token:    config.Token,
+		client:   config.Client,
+		waitTime: config.WaitTime,
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+	if s.waitTime == 0 {
+		s.waitTime = DefaultWaitTime
+	}
+	return s, nil
+}
+
+// Put implements pubsub.KeyValueStore.
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	response, err := s.do(ctx, http.MethodPut, key, nil, bytes.NewReader(value))
+	if err != nil {
+		return errors.Annotatef(err, "writing %q", key)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("writing %q: %s", key, responseError(response))
+	}
+	return nil
+}
+
+// kvPair is an entry of the result of a KV query. Consul sends the value
+// base64 encoded, which is how encoding/json decodes a []byte.
+type kvPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// Watch implements pubsub.KeyValueStore. The first query is made before
+// Watch returns, so an agent that can't be reached is reported as an
+// error. Later failures are logged, and close the channel.
+func (s *Store) Watch(ctx context.Context, prefix string) (<-chan pubsub.KeyEvent, error) {
+	pairs, index, err := s.list(ctx, prefix, 0)
+	if err != nil {
+		return nil, errors.Annotatef(err, "watching %q", prefix)
+	}
+	events := make(chan pubsub.KeyEvent)
+	go func() {
+		defer close(events)
+		known := make(map[string]kvPair)
+		var initial []pubsub.KeyEvent
+		for _, pair := range pairs {
+			known[pair.Key] = pair
+			initial = append(initial, pubsub.KeyEvent{Key: pair.Key, Value: pair.Value, Revision: index})
+		}
+		if !send(ctx, events, initial) {
+			return
+		}
+		for {
+			pairs, next, err := s.list(ctx, prefix, index)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Errorf("watching %q: %v", prefix, err)
+				}
+				return
+			}
+			if next < index {
+				// The index went backwards, such as when the agent's
+				// state was restored, so the keys are compared again
+				// from the start.
+				next = 0
+			}
+			var changes []pubsub.KeyEvent
+			changes, known = diff(known, pairs, next)
+			if !send(ctx, events, changes) {
+				return
+			}
+			index = next
+		}
+	}()
+	return events, nil
+}
+
+// diff returns the events for the changes from the known pairs to the
+// current ones, in the order they were made, along with the current pairs
+// by key. The keys that are gone are reported as deleted at the index.
+func diff(known map[string]kvPair, pairs []kvPair, index uint64) ([]pubsub.KeyEvent, map[string]kvPair) {
+	current := make(map[string]kvPair, len(pairs))
+	var changes []pubsub.KeyEvent
+	for _, pair := range pairs {
+		current[pair.Key] = pair
+		if previous, ok := known[pair.Key]; ok && previous.ModifyIndex == pair.ModifyIndex {
+			continue
+		}
+		changes = append(changes, pubsub.KeyEvent{Key: pair.Key, Value: pair.Value, Revision: pair.ModifyIndex})
+	}
+	var deleted []string
+	for key := range known {
+		if _, ok := current[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(deleted)
+	for _, key := range deleted {
+		changes = append(changes, pubsub.KeyEvent{Key: key, Revision: index, Deleted: true})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Revision < changes[j].Revision
+	})
+	return changes, current
+}
+
+func send(ctx context.Context, events chan<- pubsub.KeyEvent, changes []pubsub.KeyEvent) bool {
+	for _, event := range changes {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// list returns the pairs under the prefix, in key order, and the index of
+// the result. If index is not zero, the query blocks until the keys change
+// after it, or the wait time passes.
+func (s *Store) list(ctx context.Context, prefix string, index uint64) ([]kvPair, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", strconv.FormatInt(int64(s.waitTime/time.Second), 10)+"s")
+	}
+	response, err := s.do(ctx, http.MethodGet, prefix, query, nil)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	defer response.Body.Close()
+	next, err := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, errors.NotValidf("X-Consul-Index %q", response.Header.Get("X-Consul-Index"))
+	}
+	var pairs []kvPair
+	switch response.StatusCode {
+	case http.StatusNotFound:
+		// There are no keys with the prefix.
+	case http.StatusOK:
+		if err := json.NewDecoder(response.Body).Decode(&pairs); err != nil {
+			return nil, 0, errors.Annotate(err, "decoding keys")
+		}
+	default:
+		return nil, 0, errors.New(responseError(response))
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	return pairs, next, nil
+}
+
+func (s *Store) do(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := s.address + "/v1/kv/" + (&url.URL{Path: key}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	request = request.WithContext(ctx)
+	if s.token != "" {
+		request.Header.Set("X-Consul-Token", s.token)
+	}
+	response, err := s.client.Do(request)
+	return response, errors.Trace(err)
+}
+
+func responseError(response *http.Response) string {
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return response.Status + ": " + string(bytes.TrimSpace(message))
+}
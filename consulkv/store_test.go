@@ -0,0 +1,229 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package consulkv_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/consulkv"
+)
+
+// fakeConsul serves the parts of the consul KV API used by the store.
+type fakeConsul struct {
+	mutex   sync.Mutex
+	index   uint64
+	keys    map[string]fakeKey
+	changed chan struct{}
+	tokens  []string
+}
+
+type fakeKey struct {
+	value  []byte
+	modify uint64
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:   1,
+		keys:    make(map[string]fakeKey),
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeConsul) set(key string, value []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.index++
+	f.keys[key] = fakeKey{value: value, modify: f.index}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) delete(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.index++
+	delete(f.keys, key)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	f.mutex.Lock()
+	f.tokens = append(f.tokens, r.Header.Get("X-Consul-Token"))
+	f.mutex.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.set(key, value)
+		w.Write([]byte("true"))
+	case http.MethodGet:
+		wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		f.mutex.Lock()
+		for wait > 0 && f.index <= wait {
+			changed := f.changed
+			f.mutex.Unlock()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			f.mutex.Lock()
+		}
+		type pair struct {
+			Key         string
+			Value       []byte
+			ModifyIndex uint64
+		}
+		var pairs []pair
+		for name, value := range f.keys {
+			if strings.HasPrefix(name, key) {
+				pairs = append(pairs, pair{name, value.value, value.modify})
+			}
+		}
+		index := f.index
+		f.mutex.Unlock()
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+type StoreSuite struct {
+	testing.LoggingCleanupSuite
+	consul *fakeConsul
+	server *httptest.Server
+	store  *consulkv.Store
+}
+
+var _ = gc.Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *gc.C) {
+	s.LoggingCleanupSuite.SetUpTest(c)
+	s.consul = newFakeConsul()
+	s.server = httptest.NewServer(s.consul)
+	store, err := consulkv.New(consulkv.Config{
+		Address: s.server.URL,
+		Token:   "secret",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	s.store = store
+}
+
+func (s *StoreSuite) TearDownTest(c *gc.C) {
+	s.server.Close()
+	s.LoggingCleanupSuite.TearDownTest(c)
+}
+
+func nextEvent(c *gc.C, events <-chan pubsub.KeyEvent) pubsub.KeyEvent {
+	select {
+	case event, ok := <-events:
+		c.Assert(ok, jc.IsTrue)
+		return event
+	case <-time.After(time.Second):
+		c.Fatal("event not received")
+	}
+	return pubsub.KeyEvent{}
+}
+
+func (*StoreSuite) TestValidate(c *gc.C) {
+	_, err := consulkv.New(consulkv.Config{})
+	c.Check(err, gc.ErrorMatches, "missing Address not valid")
+	_, err = consulkv.New(consulkv.Config{Address: "http://localhost:8500", WaitTime: -time.Second})
+	c.Check(err, gc.ErrorMatches, "negative WaitTime not valid")
+}
+
+func (s *StoreSuite) TestWatch(c *gc.C) {
+	s.consul.set("config/b", []byte("2"))
+	s.consul.set("config/a", []byte("1"))
+	s.consul.set("other/x", []byte("x"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := s.store.Watch(ctx, "config/")
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The current values come first, in key order.
+	c.Check(nextEvent(c, events), jc.DeepEquals, pubsub.KeyEvent{Key: "config/a", Value: []byte("1"), Revision: 4})
+	c.Check(nextEvent(c, events), jc.DeepEquals, pubsub.KeyEvent{Key: "config/b", Value: []byte("2"), Revision: 4})
+
+	err = s.store.Put(ctx, "config/c", []byte("3"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(nextEvent(c, events), jc.DeepEquals, pubsub.KeyEvent{Key: "config/c", Value: []byte("3"), Revision: 5})
+
+	s.consul.delete("config/a")
+	c.Check(nextEvent(c, events), jc.DeepEquals, pubsub.KeyEvent{Key: "config/a", Revision: 6, Deleted: true})
+
+	s.consul.set("config/b", []byte("two"))
+	c.Check(nextEvent(c, events), jc.DeepEquals, pubsub.KeyEvent{Key: "config/b", Value: []byte("two"), Revision: 7})
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		c.Check(ok, jc.IsFalse)
+	case <-time.After(time.Second):
+		c.Fatal("events not closed")
+	}
+	s.consul.mutex.Lock()
+	defer s.consul.mutex.Unlock()
+	for _, token := range s.consul.tokens {
+		c.Check(token, gc.Equals, "secret")
+	}
+}
+
+func (s *StoreSuite) TestWatchUnreachable(c *gc.C) {
+	s.server.Close()
+	_, err := s.store.Watch(context.Background(), "config/")
+	c.Check(err, gc.ErrorMatches, `watching "config/": .*`)
+}
+
+func (s *StoreSuite) TestBridge(c *gc.C) {
+	s.consul.set("config/db/host", []byte(`{"name":"db0"}`))
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	bridge, err := pubsub.NewKeyValueBridge(pubsub.KeyValueBridgeConfig{
+		Hub:    hub,
+		Store:  s.store,
+		Prefix: "config/",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	for _, expected := range []string{"db0", "db1"} {
+		select {
+		case message := <-messages:
+			c.Check(message.Topic, gc.Equals, pubsub.Topic("db.host"))
+			c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"name": expected})
+		case <-time.After(time.Second):
+			c.Fatal("message not received")
+		}
+		s.consul.set("config/db/host", []byte(`{"name":"db1"}`))
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ContentTypeHeader is the header that holds the content type of the
+// encoded data of a message. See WithContentType.
+const ContentTypeHeader = "pubsub-content-type"
+
+// WithContentType returns a context that, when passed to PublishCtx, marks
+// the published data, which should be a []byte, as being encoded with the
+// content type. The content type is added to any headers already attached
+// to the context.
+func WithContentType(ctx context.Context, contentType string) context.Context {
+	headers := make(Headers)
+	for key, value := range headersFromPublishContext(ctx) {
+		headers[key] = value
+	}
+	headers[ContentTypeHeader] = contentType
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// ContentTypeFromContext returns the content type of the data of the
+// message being handled. The bool result is false if the message was
+// published without one.
+func ContentTypeFromContext(ctx context.Context) (string, bool) {
+	contentType, ok := HeadersFromContext(ctx)[ContentTypeHeader]
+	return contentType, ok
+}
+
+// AcceptContentTypes is a subscribe option that limits the content types
+// of the messages passed to the handler, in order of preference. Messages
+// with another content type are converted to the first accepted type that
+// the hub has a codec for, using the Codecs of the hub config, and the
+// content type header seen by the handler is changed to match. Messages
+// that can't be converted are not passed to the handler, and a
+// *ContentTypeError is reported to the hub's ErrorHandler. Messages
+// without a content type are always passed on unchanged. This allows the
+// publishers of a live hub to move from one encoding to another while
+// their subscribers catch up.
+func AcceptContentTypes(contentTypes ...string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.accept = contentTypes
+	}
+}
+
+// ContentTypeError is the error reported when the data of a message can't
+// be converted to a content type that the subscription accepts.
+type ContentTypeError struct {
+	// ContentType is the content type of the message.
+	ContentType string
+
+	// Accepted are the content types accepted by the subscription.
+	Accepted []string
+
+	// Err is the error converting the data, if a conversion was tried.
+	Err error
+}
+
+// Error implements error.
+func (e *ContentTypeError) Error() string {
+	accepted := strings.Join(e.Accepted, ", ")
+	if e.Err != nil {
+		return fmt.Sprintf("converting content type %q to one of [%s]: %v", e.ContentType, accepted, e.Err)
+	}
+	return fmt.Sprintf("content type %q not accepted, no codec to convert it to one of [%s]", e.ContentType, accepted)
+}
+
+// convertContent returns the data and headers to pass to the handler for
+// the call, converting the data to an accepted content type if needed.
+func (s *subscriber) convertContent(call *handlerCallback) (interface{}, Headers, error) {
+	contentType, ok := call.headers[ContentTypeHeader]
+	if !ok || len(s.accept) == 0 {
+		return call.data, call.headers, nil
+	}
+	for _, accepted := range s.accept {
+		if accepted == contentType {
+			return call.data, call.headers, nil
+		}
+	}
+	fail := func(err error) (interface{}, Headers, error) {
+		return nil, nil, &ContentTypeError{
+			ContentType: contentType,
+			Accepted:    s.accept,
+			Err:         err,
+		}
+	}
+	source, ok := s.codecs[contentType]
+	if !ok {
+		return fail(nil)
+	}
+	for _, accepted := range s.accept {
+		target, ok := s.codecs[accepted]
+		if !ok {
+			continue
+		}
+		encoded, ok := call.data.([]byte)
+		if !ok {
+			return fail(errors.Errorf("data of type %T, expected []byte", call.data))
+		}
+		var value interface{}
+		if err := source.Unmarshal(encoded, &value); err != nil {
+			return fail(errors.Annotatef(err, "decoding %q", contentType))
+		}
+		converted, err := target.Marshal(value)
+		if err != nil {
+			return fail(errors.Annotatef(err, "encoding %q", accepted))
+		}
+		headers := make(Headers, len(call.headers))
+		for key, value := range call.headers {
+			headers[key] = value
+		}
+		headers[ContentTypeHeader] = accepted
+		return converted, headers, nil
+	}
+	return fail(nil)
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ContentTypeSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ContentTypeSuite{})
+
+const (
+	jsonContent     = "application/json"
+	prefixedContent = "application/x-prefixed"
+)
+
+// prefixedMarshaller is JSON with a prefix, standing in for another
+// encoding.
+type prefixedMarshaller struct{}
+
+var prefix = []byte("prefixed:")
+
+func (prefixedMarshaller) Marshal(data interface{}) ([]byte, error) {
+	encoded, err := pubsub.JSONMarshaller.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), prefix...), encoded...), nil
+}
+
+func (prefixedMarshaller) Unmarshal(data []byte, target interface{}) error {
+	if !bytes.HasPrefix(data, prefix) {
+		return errors.New("missing prefix")
+	}
+	return pubsub.JSONMarshaller.Unmarshal(data[len(prefix):], target)
+}
+
+type contentReceiver struct {
+	data        chan []byte
+	contentType chan string
+}
+
+func newContentReceiver() *contentReceiver {
+	return &contentReceiver{
+		data:        make(chan []byte, 10),
+		contentType: make(chan string, 10),
+	}
+}
+
+func (r *contentReceiver) handle(ctx context.Context, topic pubsub.Topic, data interface{}) {
+	contentType, _ := pubsub.ContentTypeFromContext(ctx)
+	r.contentType <- contentType
+	r.data <- data.([]byte)
+}
+
+func (*ContentTypeSuite) newHub(errs chan<- *pubsub.HubError) pubsub.Hub {
+	return pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Codecs: map[string]pubsub.Marshaller{
+			jsonContent:     pubsub.JSONMarshaller,
+			prefixedContent: prefixedMarshaller{},
+		},
+		ErrorHandler: func(err *pubsub.HubError) {
+			errs <- err
+		},
+	})
+}
+
+func publishContent(c *gc.C, hub pubsub.Hub, contentType string, data []byte) {
+	ctx := context.Background()
+	if contentType != "" {
+		ctx = pubsub.WithContentType(ctx, contentType)
+	}
+	done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, data)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+}
+
+func (s *ContentTypeSuite) TestConverted(c *gc.C) {
+	hub := s.newHub(make(chan *pubsub.HubError, 10))
+	receiver := newContentReceiver()
+	sub, err := hub.Subscribe(topic, receiver.handle, pubsub.AcceptContentTypes(jsonContent))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishContent(c, hub, prefixedContent, []byte(`prefixed:{"id":42}`))
+	c.Check(string(<-receiver.data), gc.Equals, `{"id":42}`)
+	c.Check(<-receiver.contentType, gc.Equals, jsonContent)
+}
+
+func (s *ContentTypeSuite) TestAcceptedUnchanged(c *gc.C) {
+	hub := s.newHub(make(chan *pubsub.HubError, 10))
+	receiver := newContentReceiver()
+	sub, err := hub.Subscribe(topic, receiver.handle, pubsub.AcceptContentTypes(jsonContent, prefixedContent))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishContent(c, hub, prefixedContent, []byte(`prefixed:{"id":42}`))
+	c.Check(string(<-receiver.data), gc.Equals, `prefixed:{"id":42}`)
+	c.Check(<-receiver.contentType, gc.Equals, prefixedContent)
+
+	publishContent(c, hub, "", []byte(`anything`))
+	c.Check(string(<-receiver.data), gc.Equals, `anything`)
+	c.Check(<-receiver.contentType, gc.Equals, "")
+}
+
+func (s *ContentTypeSuite) TestNoCodec(c *gc.C) {
+	errs := make(chan *pubsub.HubError, 10)
+	hub := s.newHub(errs)
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {
+		c.Error("handler called")
+	}, pubsub.AcceptContentTypes(jsonContent))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishContent(c, hub, "application/msgpack", []byte{0x80})
+	hubErr := <-errs
+	c.Check(hubErr.Phase, gc.Equals, pubsub.PhaseDecode)
+	c.Check(hubErr, gc.ErrorMatches, `decode "testing" for subscriber 0: content type "application/msgpack" not accepted, no codec to convert it to one of \[application/json\]`)
+	contentErr, ok := errors.Cause(hubErr).(*pubsub.ContentTypeError)
+	c.Assert(ok, jc.IsTrue)
+	c.Check(contentErr.ContentType, gc.Equals, "application/msgpack")
+	c.Check(contentErr.Accepted, jc.DeepEquals, []string{jsonContent})
+}
+
+func (s *ContentTypeSuite) TestConversionFails(c *gc.C) {
+	errs := make(chan *pubsub.HubError, 10)
+	hub := s.newHub(errs)
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {
+		c.Error("handler called")
+	}, pubsub.AcceptContentTypes(jsonContent))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishContent(c, hub, prefixedContent, []byte(`{"id":42}`))
+	c.Check(<-errs, gc.ErrorMatches, `decode "testing" for subscriber 0: converting content type "application/x-prefixed" to one of \[application/json\]: decoding "application/x-prefixed": missing prefix`)
+}
@@ -0,0 +1,233 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Contracts collect the payloads that the modules of a program publish,
+// and the types that its subscribers decode them into, so a test can check
+// that every example published on a topic decodes into every type
+// expected by the subscribers that match the topic. It catches the drift
+// between producers and consumers that are written and changed separately,
+// such as a renamed field or topic, before the messages are lost at
+// runtime.
+//
+// Each module registers its own examples and expectations, usually from a
+// function that the test of the program calls, and the test then calls
+// Check or Verify with the configuration of the program's hub.
+type Contracts struct {
+	mutex        sync.Mutex
+	examples     []contractExample
+	expectations []contractExpectation
+}
+
+type contractExample struct {
+	publisher string
+	topic     Topic
+	payload   interface{}
+}
+
+type contractExpectation struct {
+	subscriber string
+	matcher    TopicMatcher
+	expected   interface{}
+}
+
+// NewContracts returns an empty set of contracts.
+func NewContracts() *Contracts {
+	return &Contracts{}
+}
+
+// Example registers a payload that the publisher publishes on the topic.
+// The payload is anything that can be published on a structured hub.
+// Publishers that send payloads in different shapes on the same topic
+// should register an example of each.
+func (c *Contracts) Example(publisher string, topic Topic, payload interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.examples = append(c.examples, contractExample{
+		publisher: publisher,
+		topic:     topic,
+		payload:   payload,
+	})
+}
+
+// Expect registers the type that the subscriber decodes the messages on
+// the topics that match the matcher into. The expected value is either a
+// value of the type, or the handler that the subscriber passes to
+// Subscribe, in which case the type is that of the handler's data
+// argument.
+func (c *Contracts) Expect(subscriber string, matcher TopicMatcher, expected interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expectations = append(c.expectations, contractExpectation{
+		subscriber: subscriber,
+		matcher:    matcher,
+		expected:   expected,
+	})
+}
+
+// ContractViolation describes an example that doesn't satisfy the
+// expectation of a subscriber.
+type ContractViolation struct {
+	Publisher  string
+	Subscriber string
+	Topic      Topic
+
+	// Example is the type of the example payload, and Expected is the type
+	// the subscriber decodes it into.
+	Example  reflect.Type
+	Expected reflect.Type
+
+	// Err is the error decoding the example, if it couldn't be decoded.
+	Err error
+
+	// Missing are the fields of the expected type that the example has no
+	// value for, named as they are in DecodeReport.
+	Missing []string
+
+	// NoExample is true if no example is published on any topic that
+	// matches the subscriber, in which case the Publisher, Topic and
+	// Example are empty.
+	NoExample bool
+}
+
+// String describes the violation.
+func (v ContractViolation) String() string {
+	if v.NoExample {
+		return fmt.Sprintf("subscriber %q expecting %v: no example published", v.Subscriber, v.Expected)
+	}
+	prefix := fmt.Sprintf("publisher %q example %v on %q to subscriber %q expecting %v",
+		v.Publisher, v.Example, v.Topic, v.Subscriber, v.Expected)
+	if v.Err != nil {
+		return fmt.Sprintf("%s: %v", prefix, v.Err)
+	}
+	return fmt.Sprintf("%s: missing %s", prefix, strings.Join(v.Missing, ", "))
+}
+
+// Check decodes each example into the types expected by the subscribers
+// that match its topic, in the same way as a structured hub created with
+// the config would, and returns the violations it finds. Examples that
+// decode but leave some fields of the expected type without a value are
+// violations too, with the fields in Missing; tests with subscribers that
+// have optional fields can filter them out. Expectations without any
+// example on a matching topic are also returned as violations, as the
+// topic was most likely renamed.
+//
+// The error is only for examples that can't be serialized at all, and
+// expectations that aren't valid.
+func (c *Contracts) Check(config *StructuredHubConfig) ([]ContractViolation, error) {
+	if config == nil {
+		config = new(StructuredHubConfig)
+	}
+	// The hub is only used to serialize and decode the messages, it
+	// doesn't publish anything.
+	copied := *config
+	hub := NewStructuredHub(&copied).(*structuredHub)
+
+	c.mutex.Lock()
+	examples := append([]contractExample(nil), c.examples...)
+	expectations := append([]contractExpectation(nil), c.expectations...)
+	c.mutex.Unlock()
+
+	serialized := make([]map[string]interface{}, len(examples))
+	for i, example := range examples {
+		asMap, err := hub.toStringMap(example.payload)
+		if err != nil {
+			return nil, errors.Annotatef(err, "example %T of %q on %q", example.payload, example.publisher, example.topic)
+		}
+		serialized[i] = asMap
+	}
+
+	var violations []ContractViolation
+	for _, expectation := range expectations {
+		expected, err := hub.expectedType(expectation.expected)
+		if err != nil {
+			return nil, errors.Annotatef(err, "expectation of %q", expectation.subscriber)
+		}
+		matched := false
+		for i, example := range examples {
+			if !expectation.matcher.Match(example.topic) {
+				continue
+			}
+			matched = true
+			violation := ContractViolation{
+				Publisher:  example.publisher,
+				Subscriber: expectation.subscriber,
+				Topic:      example.topic,
+				Example:    reflect.TypeOf(example.payload),
+				Expected:   expected,
+			}
+			report := new(DecodeReport)
+			if expected.Kind() != reflect.Struct || expected == fieldsType {
+				report = nil
+			}
+			if _, err := hub.decoder.decode(expected, serialized[i], report); err != nil {
+				violation.Err = err
+			} else if report != nil && len(report.Missing) > 0 {
+				violation.Missing = report.Missing
+			} else {
+				continue
+			}
+			violations = append(violations, violation)
+		}
+		if !matched {
+			violations = append(violations, ContractViolation{
+				Subscriber: expectation.subscriber,
+				Expected:   expected,
+				NoExample:  true,
+			})
+		}
+	}
+	return violations, nil
+}
+
+// Verify is Check for tests that want every contract to be satisfied. It
+// returns an error describing all the violations, if there are any.
+func (c *Contracts) Verify(config *StructuredHubConfig) error {
+	violations, err := c.Check(config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	lines := make([]string, len(violations))
+	for i, violation := range violations {
+		lines[i] = violation.String()
+	}
+	sort.Strings(lines)
+	return errors.Errorf("%d contract violations:\n  %s", len(violations), strings.Join(lines, "\n  "))
+}
+
+// expectedType returns the type of the expected value, or of the data
+// argument if it is a handler.
+func (h *structuredHub) expectedType(expected interface{}) (reflect.Type, error) {
+	rt := reflect.TypeOf(expected)
+	if rt == nil {
+		return nil, errors.NotValidf("nil expected type")
+	}
+	if rt.Kind() != reflect.Func {
+		if rt.Kind() == reflect.Ptr {
+			rt = rt.Elem()
+		}
+		return rt, nil
+	}
+	callback, err := h.newCallback(expected, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if callback.union != nil {
+		return nil, errors.NotSupportedf("union handler")
+	}
+	return callback.dataType, nil
+}
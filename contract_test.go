@@ -0,0 +1,91 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"reflect"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ContractSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ContractSuite{})
+
+// Renamed is Emitter after the publisher renamed a field.
+type Renamed struct {
+	Origin  string `json:"origin"`
+	Content string `json:"content"`
+	ID      int    `json:"id"`
+}
+
+func (*ContractSuite) TestSatisfied(c *gc.C) {
+	contracts := pubsub.NewContracts()
+	contracts.Example("emitter", topic, Emitter{Origin: "o", Message: "m", ID: 1})
+	contracts.Example("json", topic, map[string]interface{}{"origin": "o", "message": "m", "id": 2})
+	contracts.Expect("value", topic, &Emitter{})
+	contracts.Expect("handler", pubsub.MatchAll, func(pubsub.Topic, Emitter, error) {})
+	contracts.Expect("partial", topic, JustOrigin{})
+
+	violations, err := contracts.Check(nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(violations, gc.HasLen, 0)
+	c.Check(contracts.Verify(nil), jc.ErrorIsNil)
+}
+
+func (*ContractSuite) TestViolations(c *gc.C) {
+	contracts := pubsub.NewContracts()
+	contracts.Example("renamed", topic, Renamed{Origin: "o", Content: "m", ID: 1})
+	contracts.Example("other", second, Emitter{})
+	contracts.Expect("decodes", topic, func(pubsub.Topic, Emitter, error) {})
+	contracts.Expect("wrong", topic, BadID{})
+	contracts.Expect("moved", first, Emitter{})
+
+	violations, err := contracts.Check(nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(violations, gc.HasLen, 3)
+
+	c.Check(violations[0].Publisher, gc.Equals, "renamed")
+	c.Check(violations[0].Subscriber, gc.Equals, "decodes")
+	c.Check(violations[0].Topic, gc.Equals, topic)
+	c.Check(violations[0].Example, gc.Equals, reflect.TypeOf(Renamed{}))
+	c.Check(violations[0].Expected, gc.Equals, reflect.TypeOf(Emitter{}))
+	c.Check(violations[0].Err, jc.ErrorIsNil)
+	c.Check(violations[0].Missing, jc.DeepEquals, []string{"message"})
+
+	c.Check(violations[1].Subscriber, gc.Equals, "wrong")
+	c.Check(violations[1].Err, gc.ErrorMatches, ".*cannot unmarshal number.*")
+
+	c.Check(violations[2], jc.DeepEquals, pubsub.ContractViolation{
+		Subscriber: "moved",
+		Expected:   reflect.TypeOf(Emitter{}),
+		NoExample:  true,
+	})
+
+	err = contracts.Verify(nil)
+	c.Check(err, gc.ErrorMatches, `(?s)3 contract violations:
+  publisher "renamed" example pubsub_test.Renamed on "testing" to subscriber "decodes" expecting pubsub_test.Emitter: missing message
+  publisher "renamed" example pubsub_test.Renamed on "testing" to subscriber "wrong" expecting pubsub_test.BadID: .*
+  subscriber "moved" expecting pubsub_test.Emitter: no example published`)
+}
+
+func (*ContractSuite) TestBadExample(c *gc.C) {
+	contracts := pubsub.NewContracts()
+	contracts.Example("broken", topic, BrokenPayload{})
+	_, err := contracts.Check(nil)
+	c.Check(err, gc.ErrorMatches, `example pubsub_test.BrokenPayload of "broken" on "testing": marshalling: .*broken`)
+}
+
+func (*ContractSuite) TestBadExpectation(c *gc.C) {
+	contracts := pubsub.NewContracts()
+	contracts.Expect("bad", topic, func(string) {})
+	_, err := contracts.Check(nil)
+	c.Check(err, gc.ErrorMatches, `expectation of "bad": expected 3 args.*`)
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// DecodeHook is called for each field of a handler's structure when the
+// published map is being converted into that structure. The from type is
+// the type of the value in the published map, the to type is the type of
+// the structure field, and data is the value itself.
+//
+// The value returned replaces the value in the map before it is passed
+// through the hub's Marshaller, so the returned value must serialize into
+// something the field can be unmarshalled from. Values of the field's own
+// type, or values that implement encoding.TextMarshaler, are the most common
+// results. If the hook does not want to change the value, it should return
+// the data unchanged.
+//
+// Fields are matched to the keys of the map using the name in the `json`
+// struct tag if there is one, or the field name if not. As with the
+// encoding/json package, the match is case insensitive.
+//
+// The hook is also called for the elements of slices and arrays, and for
+// the values of maps, with the to type being the element type.
+type DecodeHook func(from, to reflect.Type, data interface{}) (interface{}, error)
+
+// applyDecodeHook returns a copy of the data with the hook applied to all
+// the values that correspond to fields in the structure type rt. The data
+// passed in is never modified as it is shared between all the subscribers.
+func applyDecodeHook(hook DecodeHook, rt reflect.Type, data map[string]interface{}) (map[string]interface{}, error) {
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt.Kind() != reflect.Struct {
+		return data, nil
+	}
+	result := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		result[key] = value
+	}
+	if err := applyDecodeHookFields(hook, rt, result, make(map[string]bool)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// applyDecodeHookFields applies the hook to the values in data for the
+// fields of the structure type rt. As with encoding/json, the fields of
+// embedded structures without a name in their tag are found in the same
+// map, and are shadowed by the fields of the outer structure, so they are
+// handled after them and the keys already done are skipped.
+func applyDecodeHookFields(hook DecodeHook, rt reflect.Type, data map[string]interface{}, done map[string]bool) error {
+	var embedded []reflect.Type
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name, ok := fieldKey(field)
+		if !ok {
+			continue
+		}
+		if field.Anonymous && strings.Split(field.Tag.Get("json"), ",")[0] == "" {
+			elem := field.Type
+			if elem.Kind() == reflect.Ptr {
+				elem = elem.Elem()
+			}
+			if elem.Kind() == reflect.Struct {
+				// The Marshaller can't allocate a pointer to an
+				// unexported structure, so its fields are never set.
+				if field.PkgPath == "" || field.Type.Kind() != reflect.Ptr {
+					embedded = append(embedded, elem)
+				}
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			// Unexported fields are never set by the Marshaller.
+			continue
+		}
+		key, ok := findKey(data, name)
+		if !ok || done[key] {
+			continue
+		}
+		done[key] = true
+		value, err := applyDecodeHookValue(hook, field.Type, data[key])
+		if err != nil {
+			return errors.Annotatef(err, "field %q", field.Name)
+		}
+		data[key] = value
+	}
+	for _, elem := range embedded {
+		if err := applyDecodeHookFields(hook, elem, data, done); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func applyDecodeHookValue(hook DecodeHook, to reflect.Type, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	value, err := hook(reflect.TypeOf(value), to, value)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	elem := to
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		switch elem.Kind() {
+		case reflect.Struct:
+			return applyDecodeHook(hook, elem, v)
+		case reflect.Map:
+			result := make(map[string]interface{}, len(v))
+			for key, item := range v {
+				converted, err := applyDecodeHookValue(hook, elem.Elem(), item)
+				if err != nil {
+					return nil, errors.Annotatef(err, "key %q", key)
+				}
+				result[key] = converted
+			}
+			return result, nil
+		}
+	case []interface{}:
+		if elem.Kind() == reflect.Slice || elem.Kind() == reflect.Array {
+			result := make([]interface{}, len(v))
+			for i, item := range v {
+				converted, err := applyDecodeHookValue(hook, elem.Elem(), item)
+				if err != nil {
+					return nil, errors.Annotatef(err, "index %d", i)
+				}
+				result[i] = converted
+			}
+			return result, nil
+		}
+	}
+	return value, nil
+}
+
+// fieldKey returns the map key that the field is expected to be found at.
+// The bool result is false if the field is explicitly skipped.
+func fieldKey(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
+
+func findKey(data map[string]interface{}, name string) (string, bool) {
+	if _, ok := data[name]; ok {
+		return name, true
+	}
+	for key := range data {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
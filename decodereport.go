@@ -0,0 +1,115 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"sort"
+)
+
+// DecodeReport describes how the published data of a structured hub
+// matched the structure of a handler. Fields are named by their map keys,
+// with the keys of nested structures joined with dots. Each slice is
+// sorted.
+//
+// Handlers with a structure argument that also take a context.Context can
+// get the report for each message with DecodeReportFromContext. The report
+// is available whether or not decoding succeeded, so it can be used to log
+// precise diagnostics along with the error.
+type DecodeReport struct {
+	// Unknown are the keys in the published data that don't correspond to
+	// any field of the structure, and so were ignored.
+	Unknown []string
+
+	// Missing are the fields of the structure that had no value in the
+	// published data, and so were left as zero values.
+	Missing []string
+
+	// Coerced are the fields whose values were changed by the hub's
+	// DecodeHook before being decoded.
+	Coerced []string
+}
+
+// Clean returns true if every field matched and nothing was coerced.
+func (r DecodeReport) Clean() bool {
+	return len(r.Unknown) == 0 && len(r.Missing) == 0 && len(r.Coerced) == 0
+}
+
+type decodeReportKey struct{}
+
+func withDecodeReport(ctx context.Context, report *DecodeReport) context.Context {
+	return context.WithValue(ctx, decodeReportKey{}, report)
+}
+
+// DecodeReportFromContext returns the DecodeReport for the message being
+// handled. The bool result is false if the handler's data argument is not
+// a structure, or the context was not passed to a handler by a structured
+// hub.
+func DecodeReportFromContext(ctx context.Context) (DecodeReport, bool) {
+	report, ok := ctx.Value(decodeReportKey{}).(*DecodeReport)
+	if !ok || report == nil {
+		return DecodeReport{}, false
+	}
+	return *report, true
+}
+
+// matchFields records the unknown and missing fields of the structure type
+// rt for the data.
+func (r *DecodeReport) matchFields(prefix string, rt reflect.Type, data map[string]interface{}) {
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt.Kind() != reflect.Struct {
+		return
+	}
+	used := make(map[string]bool)
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name, ok := fieldKey(field)
+		if !ok {
+			continue
+		}
+		key, ok := findKey(data, name)
+		if !ok {
+			r.Missing = append(r.Missing, prefix+name)
+			continue
+		}
+		used[key] = true
+		if nested, ok := data[key].(map[string]interface{}); ok {
+			r.matchFields(prefix+name+".", field.Type, nested)
+		}
+	}
+	for key := range data {
+		if !used[key] {
+			r.Unknown = append(r.Unknown, prefix+key)
+		}
+	}
+}
+
+// findCoerced records the keys whose values differ between the original
+// data and the data returned from the decode hook.
+func (r *DecodeReport) findCoerced(prefix string, original, hooked map[string]interface{}) {
+	for key, value := range original {
+		changed := hooked[key]
+		originalMap, ok1 := value.(map[string]interface{})
+		changedMap, ok2 := changed.(map[string]interface{})
+		if ok1 && ok2 {
+			r.findCoerced(prefix+key+".", originalMap, changedMap)
+			continue
+		}
+		if !reflect.DeepEqual(value, changed) {
+			r.Coerced = append(r.Coerced, prefix+key)
+		}
+	}
+}
+
+func (r *DecodeReport) sort() {
+	sort.Strings(r.Unknown)
+	sort.Strings(r.Missing)
+	sort.Strings(r.Coerced)
+}
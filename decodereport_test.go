@@ -0,0 +1,135 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type DecodeReportSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&DecodeReportSuite{})
+
+type reportInner struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+type reportPayload struct {
+	Name   string      `json:"name"`
+	Count  int         `json:"count"`
+	Inner  reportInner `json:"inner"`
+	Hidden string      `json:"-"`
+}
+
+// decodeReport publishes the data, and returns the report and error given
+// to a handler taking a reportPayload.
+func decodeReport(c *gc.C, config *pubsub.StructuredHubConfig, data map[string]interface{}) (pubsub.DecodeReport, bool, error) {
+	type result struct {
+		report pubsub.DecodeReport
+		ok     bool
+		err    error
+	}
+	hub := pubsub.NewStructuredHub(config)
+	results := make(chan result, 1)
+	_, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, payload reportPayload, err error) {
+		report, ok := pubsub.DecodeReportFromContext(ctx)
+		results <- result{report, ok, err}
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, data)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case r := <-results:
+		return r.report, r.ok, r.err
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	panic("unreachable")
+}
+
+func (*DecodeReportSuite) TestClean(c *gc.C) {
+	report, ok, err := decodeReport(c, nil, map[string]interface{}{
+		"name":  "fred",
+		"count": 2,
+		"inner": map[string]interface{}{"host": "example.com", "port": 80},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(report.Clean(), jc.IsTrue)
+}
+
+func (*DecodeReportSuite) TestUnknownAndMissing(c *gc.C) {
+	report, ok, err := decodeReport(c, nil, map[string]interface{}{
+		"NAME":   "fred",
+		"extra":  true,
+		"Hidden": "ignored",
+		"inner":  map[string]interface{}{"host": "example.com", "scheme": "https"},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(report, jc.DeepEquals, pubsub.DecodeReport{
+		Unknown: []string{"Hidden", "extra", "inner.scheme"},
+		Missing: []string{"count", "inner.port"},
+	})
+}
+
+func (*DecodeReportSuite) TestReportWithError(c *gc.C) {
+	report, ok, err := decodeReport(c, nil, map[string]interface{}{
+		"name":  42,
+		"count": 1,
+		"inner": map[string]interface{}{"host": "example.com", "port": 80},
+	})
+	c.Assert(err, gc.ErrorMatches, "unmarshalling data: .*")
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(report.Clean(), jc.IsTrue)
+}
+
+func (*DecodeReportSuite) TestCoerced(c *gc.C) {
+	hook := func(from, to reflect.Type, data interface{}) (interface{}, error) {
+		if s, ok := data.(string); ok && from.Kind() == reflect.String {
+			return strings.ToLower(s), nil
+		}
+		return data, nil
+	}
+	report, ok, err := decodeReport(c, &pubsub.StructuredHubConfig{DecodeHook: hook}, map[string]interface{}{
+		"name":  "Fred",
+		"count": 1,
+		"inner": map[string]interface{}{"host": "EXAMPLE.com", "port": 80},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(report, jc.DeepEquals, pubsub.DecodeReport{
+		Coerced: []string{"inner.host", "name"},
+	})
+}
+
+func (*DecodeReportSuite) TestNoReportForMaps(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	results := make(chan bool, 1)
+	_, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data map[string]interface{}, err error) {
+		_, ok := pubsub.DecodeReportFromContext(ctx)
+		results <- ok
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, map[string]interface{}{})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case ok := <-results:
+		c.Assert(ok, jc.IsFalse)
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
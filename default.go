@@ -0,0 +1,62 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+var (
+	defaultMutex sync.Mutex
+	defaultHub   Hub
+)
+
+// Default returns the process wide default hub. Applications that only
+// ever want one hub can use it rather than passing a hub to everything
+// that needs one. Unless SetDefault has been called, the first call
+// creates a structured hub with the default config.
+func Default() Hub {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	if defaultHub == nil {
+		defaultHub = NewStructuredHub(nil)
+	}
+	return defaultHub
+}
+
+// SetDefault replaces the process wide default hub, and returns the
+// previous one, which is nil if Default had not yet been called. This
+// allows tests to install their own hub and restore the original after.
+// Setting a nil hub means the next call to Default creates a new one.
+//
+// Subscriptions made on the previous hub are not moved to the new one, so
+// the default should be set before anything subscribes to it.
+func SetDefault(hub Hub) Hub {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	previous := defaultHub
+	defaultHub = hub
+	return previous
+}
+
+// The Provide functions have signatures suitable for registering with
+// dependency injection containers, such as wire.NewSet or fx.Provide, so
+// components that take a Hub or StructuredHub are given the default hub.
+
+// ProvideDefault returns the default hub.
+func ProvideDefault() Hub {
+	return Default()
+}
+
+// ProvideDefaultStructured returns the default hub as a StructuredHub, or
+// an error if the default hub was set to a hub that isn't structured.
+func ProvideDefaultStructured() (StructuredHub, error) {
+	hub, ok := Default().(StructuredHub)
+	if !ok {
+		return nil, errors.NotValidf("default hub %T as structured hub", Default())
+	}
+	return hub, nil
+}
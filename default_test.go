@@ -0,0 +1,49 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type DefaultSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&DefaultSuite{})
+
+func (s *DefaultSuite) SetUpTest(c *gc.C) {
+	s.LoggingCleanupSuite.SetUpTest(c)
+	previous := pubsub.SetDefault(nil)
+	s.AddCleanup(func(*gc.C) { pubsub.SetDefault(previous) })
+}
+
+func (*DefaultSuite) TestDefaultCreatedOnce(c *gc.C) {
+	hub := pubsub.Default()
+	c.Assert(hub, gc.NotNil)
+	c.Assert(pubsub.Default(), gc.Equals, hub)
+	c.Assert(pubsub.ProvideDefault(), gc.Equals, hub)
+
+	structured, err := pubsub.ProvideDefaultStructured()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(structured, gc.Equals, hub)
+}
+
+func (*DefaultSuite) TestSetDefault(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	previous := pubsub.SetDefault(hub)
+	c.Assert(previous, gc.IsNil)
+	c.Assert(pubsub.Default(), gc.Equals, hub)
+
+	_, err := pubsub.ProvideDefaultStructured()
+	c.Assert(err, gc.ErrorMatches, `default hub \*pubsub.simplehub as structured hub not valid`)
+
+	previous = pubsub.SetDefault(nil)
+	c.Assert(previous, gc.Equals, hub)
+	c.Assert(pubsub.Default(), gc.Not(gc.Equals), hub)
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+)
+
+// Delivery holds the information about the delivery of a message to a
+// particular handler. Handlers that take a context.Context as their first
+// argument can get the Delivery using DeliveryFromContext.
+type Delivery struct {
+	// Sequence is the hub sequence number of the published message. Every
+	// call to Publish on a hub is given the next sequence number, starting
+	// at one, regardless of the topic. Consumers can use the sequence to
+	// order messages across topics, detect gaps, and checkpoint progress.
+	// Note that messages published at the same time by different
+	// goroutines may arrive out of sequence order. See Hub.Publish.
+	Sequence uint64
+
+	// OrderingKey is the ordering key the message was published with, if
+	// any. See WithOrderingKey.
+	OrderingKey string
+
+	// Headers are the headers the message was published with, if any. See
+	// WithHeaders.
+	Headers Headers
+
+	// Retry is zero for the first delivery of the message to the
+	// subscriber, and counts the retries after that. See RetryPolicy.
+	Retry int
+
+	// Coalesced is the number of identical messages published while this
+	// one was waiting in the queue of the subscriber, which are delivered
+	// as this one. See CoalesceRule.
+	Coalesced int
+}
+
+type deliveryKey struct{}
+
+func withDelivery(ctx context.Context, delivery Delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, delivery)
+}
+
+// DeliveryFromContext returns the Delivery for the message being handled.
+// The bool result is false if the context was not passed to a handler by
+// a hub.
+func DeliveryFromContext(ctx context.Context) (Delivery, bool) {
+	delivery, ok := ctx.Value(deliveryKey{}).(Delivery)
+	return delivery, ok
+}
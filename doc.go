@@ -18,6 +18,18 @@
 // their topic matcher in the order that the messages were published to the
 // hub.
 //
+// Handlers may publish messages themselves. Publishing never waits on any
+// handler, so this never deadlocks. The message published from within the
+// handler is queued behind every message already queued for each subscriber,
+// including the handler's own subscriber, so it is not delivered to anyone
+// before the messages that were published ahead of it. A handler that waits
+// on the Completer of a message that is also delivered to that handler's own
+// subscription deadlocks, as that message can't be processed until the
+// handler returns. If the hub has a MaxInFlight limit, a handler that waits
+// on the Completer of any message it published can also deadlock the hub,
+// as the handlers of that message may be waiting for the slot held by the
+// waiting handler.
+//
 // This package defines two types of Hubs.
 // * Simple hubs
 // * Structured hubs
@@ -41,4 +53,32 @@
 // The structured hub will try to serialize the published information into the
 // struct specified. If there is an error marshalling, that error is passed to
 // the callback as the error parameter.
+//
+// String fields of the struct tagged `pubsub:"topic"`, such as a Topic, are set
+// to the topic of the message, so handlers that pass the struct on don't
+// need to copy the topic into it. The field is set even if the published
+// data has a value for it.
+//
+// Handlers that want the serialized form of the published data can use a
+// []byte as the second argument.
+//   func (Topic, []byte, error)
+//
+// Handlers of either type of hub may also return an error. The errors are
+// reported to the hub's ErrorHandler, and subscriptions with the Retry
+// option retry the message, eventually publishing it as a DeadLetter.
+//
+// The WithMarshaller subscribe option allows a subscription to use a
+// different Marshaller to the rest of the hub for its structures or bytes.
+//
+// Structures that implement MapMarshaler and MapUnmarshaler are converted
+// to and from the map form directly rather than through the Marshaller,
+// when the JSONMarshaller is in use. The pubsubgen tool in cmd/pubsubgen
+// generates these methods, along with typed Publish and Subscribe functions,
+// for structures declared with a "//pubsub:topic <topic>" directive.
+//
+// Handler functions for either type of hub may also take a context.Context as
+// an additional first argument. The context carries the Delivery information
+// for the message, such as the hub sequence number, which is retrieved with
+// DeliveryFromContext. The context is cancelled when the subscription is
+// unsubscribed, so long running handlers can stop early.
 package pubsub
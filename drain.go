@@ -0,0 +1,113 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// Drain implements Subscription.
+func (h *handle) Drain() []Message {
+	return h.sub.drain()
+}
+
+// drain removes the calls that are waiting to be handled, including those
+// spilled to a store, and returns them as messages. The drained calls are
+// marked done, so publishes waiting on them complete.
+func (s *subscriber) drain() []Message {
+	s.mutex.Lock()
+	var calls []*handlerCallback
+	for {
+		for message, ok := s.pending.Pop(); ok; message, ok = s.pending.Pop() {
+			calls = append(calls, message.call)
+		}
+		s.loadSpilled()
+		if s.pending.Len() == 0 {
+			// Either everything has been drained, or the store can't be
+			// read, and the error has been reported.
+			break
+		}
+	}
+	s.coalescing = nil
+	s.mutex.Unlock()
+
+	var messages []Message
+	for _, call := range calls {
+		// The spilled records are removed as they are drained, so they
+		// aren't restored for the next durable subscriber.
+		s.durableHandled(call)
+		if call.barrier {
+			call.done()
+			continue
+		}
+		if call.cancelled() {
+			s.recordDropped(call)
+			call.done()
+			continue
+		}
+		data := call.data
+		if call.pooled {
+			// The map is reused once the call is done.
+			data = copyValue(data)
+		}
+		messages = append(messages, Message{
+			Topic: call.topic,
+			Data:  data,
+			Delivery: Delivery{
+				Sequence:    call.sequence,
+				OrderingKey: call.key,
+				Headers:     call.headers,
+				Retry:       call.retry,
+				Coalesced:   len(call.merged),
+			},
+		})
+		call.done()
+	}
+	return messages
+}
+
+// Requeue implements Requeuer.
+func (h *simplehub) Requeue(messages []Message) (Completer, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	done := make(chan struct{})
+	wait := sync.WaitGroup{}
+	handle := &doneHandle{done: done}
+	now := time.Now()
+	for _, message := range messages {
+		size := h.quotas.measure(message.Data)
+		var served map[*queueGroup]bool
+		for _, s := range h.subscribers {
+			if !s.topicMatcher.Match(message.Topic) || h.isStandby(s) {
+				continue
+			}
+			s, ok := h.queueTarget(s, message.Delivery.OrderingKey, &served)
+			if !ok {
+				continue
+			}
+			wait.Add(1)
+			s.notify(&handlerCallback{
+				topic:    message.Topic,
+				data:     message.Data,
+				sequence: message.Delivery.Sequence,
+				key:      message.Delivery.OrderingKey,
+				headers:  message.Delivery.Headers,
+				retry:    message.Delivery.Retry,
+				wg:       &wait,
+				queued:   now,
+				size:     size,
+				handle:   handle,
+			})
+		}
+	}
+
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+
+	return handle, nil
+}
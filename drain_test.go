@@ -0,0 +1,136 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type DrainSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&DrainSuite{})
+
+func (*DrainSuite) TestDrainAndRequeue(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	// The old subscriber never becomes ready, so its messages stay queued.
+	old, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {
+		c.Error("old subscriber called")
+	}, pubsub.WarmUp(0))
+	c.Assert(err, jc.ErrorIsNil)
+
+	ctx := pubsub.WithHeaders(pubsub.WithOrderingKey(context.Background(), "key"), pubsub.Headers{"origin": "test"})
+	var results []pubsub.Completer
+	for i := 0; i < 3; i++ {
+		result, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	_, err = hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+
+	messages := old.Drain()
+	for _, result := range results {
+		waitComplete(c, result)
+	}
+	c.Check(old.Pending(), gc.Equals, 0)
+	c.Assert(messages, gc.HasLen, 3)
+	for i, message := range messages {
+		c.Check(message, jc.DeepEquals, pubsub.Message{
+			Topic: topic,
+			Data:  i,
+			Delivery: pubsub.Delivery{
+				Sequence:    uint64(i + 1),
+				OrderingKey: "key",
+				Headers:     pubsub.Headers{"origin": "test"},
+			},
+		})
+	}
+	c.Check(old.Drain(), gc.HasLen, 0)
+	old.Unsubscribe()
+
+	var (
+		mutex      sync.Mutex
+		deliveries []pubsub.Delivery
+	)
+	receiver := &orderedReceiver{}
+	sub, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		delivery, _ := pubsub.DeliveryFromContext(ctx)
+		mutex.Lock()
+		deliveries = append(deliveries, delivery)
+		mutex.Unlock()
+		receiver.handle(topic, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	done, err := hub.(pubsub.Requeuer).Requeue(messages)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{0, 1, 2})
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, delivery := range deliveries {
+		c.Check(delivery, jc.DeepEquals, messages[i].Delivery)
+	}
+}
+
+func (*DrainSuite) TestRequeueOnlyMatchingSubscribers(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	first := &orderedReceiver{}
+	sub, err := hub.Subscribe(pubsub.MatchAll, first.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	second := &orderedReceiver{}
+	sub, err = hub.Subscribe(topic, second.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	done, err := hub.(pubsub.Requeuer).Requeue([]pubsub.Message{
+		{Topic: topic, Data: "first", Delivery: pubsub.Delivery{Sequence: 10}},
+		{Topic: "other", Data: "second", Delivery: pubsub.Delivery{Sequence: 11}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(first.get(), jc.DeepEquals, []interface{}{"first", "second"})
+	c.Check(second.get(), jc.DeepEquals, []interface{}{"first"})
+}
+
+func (*DrainSuite) TestStructuredDrainAndRequeue(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	old, err := hub.Subscribe(topic, func(pubsub.Topic, Emitter, error) {
+		c.Error("old subscriber called")
+	}, pubsub.WarmUp(0))
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, Emitter{Origin: "origin", Message: "hello", ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+
+	messages := old.Drain()
+	waitComplete(c, result)
+	old.Unsubscribe()
+	c.Assert(messages, gc.HasLen, 1)
+	c.Check(messages[0].Data, jc.DeepEquals, map[string]interface{}{
+		"origin": "origin", "message": "hello", "id": float64(42),
+	})
+
+	received := make(chan Emitter, 1)
+	sub, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	done, err := hub.(pubsub.Requeuer).Requeue(messages)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(<-received, jc.DeepEquals, Emitter{Origin: "origin", Message: "hello", ID: 42})
+}
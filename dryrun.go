@@ -0,0 +1,100 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultRecentTopics is the number of distinct published topics a hub
+// remembers for DryRunPattern, if the SimpleHubConfig doesn't give a
+// number.
+const DefaultRecentTopics = 1024
+
+// recentTopics remembers the last distinct topics published on a hub. When
+// it is full the topic remembered first is forgotten, so a topic that is
+// still being published is soon remembered again.
+type recentTopics struct {
+	mutex sync.RWMutex
+	seen  map[Topic]struct{}
+	ring  []Topic
+	next  int
+}
+
+func newRecentTopics(size int) *recentTopics {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultRecentTopics
+	}
+	return &recentTopics{
+		seen: make(map[Topic]struct{}),
+		ring: make([]Topic, 0, size),
+	}
+}
+
+// add remembers the topic. A nil recentTopics remembers nothing.
+func (r *recentTopics) add(topic Topic) {
+	if r == nil {
+		return
+	}
+	r.mutex.RLock()
+	_, ok := r.seen[topic]
+	r.mutex.RUnlock()
+	if ok {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.seen[topic]; ok {
+		return
+	}
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, topic)
+	} else {
+		delete(r.seen, r.ring[r.next])
+		r.ring[r.next] = topic
+		r.next = (r.next + 1) % len(r.ring)
+	}
+	r.seen[topic] = struct{}{}
+}
+
+// topics returns the remembered topics, in no particular order.
+func (r *recentTopics) topics() []Topic {
+	if r == nil {
+		return nil
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]Topic(nil), r.ring...)
+}
+
+// DryRunPattern implements PatternDryRunner.
+func (h *simplehub) DryRunPattern(matcher TopicMatcher) []string {
+	candidates := make(map[Topic]struct{})
+	for _, topic := range h.recent.topics() {
+		candidates[topic] = struct{}{}
+	}
+	h.mutex.Lock()
+	subscribers := append([]*subscriber(nil), h.subscribers...)
+	h.mutex.Unlock()
+	for _, s := range subscribers {
+		s.mutex.Lock()
+		for topic := range s.matched {
+			candidates[topic] = struct{}{}
+		}
+		s.mutex.Unlock()
+	}
+
+	var result []string
+	for topic := range candidates {
+		if matcher.Match(topic) {
+			result = append(result, string(topic))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type DryRunSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&DryRunSuite{})
+
+func (*DryRunSuite) TestPublishedTopics(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	publishTopics(c, hub, "unit.added", "unit.removed", "machine.added", "unit.added")
+	c.Check(hub.(pubsub.PatternDryRunner).DryRunPattern(pubsub.MatchRegex(`^unit\.`)), jc.DeepEquals, []string{"unit.added", "unit.removed"})
+	c.Check(hub.(pubsub.PatternDryRunner).DryRunPattern(pubsub.MatchRegex(`\.added$`)), jc.DeepEquals, []string{"machine.added", "unit.added"})
+	c.Check(hub.(pubsub.PatternDryRunner).DryRunPattern(pubsub.Topic("unit.changed")), gc.HasLen, 0)
+}
+
+func (*DryRunSuite) TestRecentTopicsLimit(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		RecentTopics: 3,
+	})
+	for i := 0; i < 5; i++ {
+		publishTopics(c, hub, pubsub.Topic(fmt.Sprintf("topic.%d", i)))
+	}
+	c.Check(hub.(pubsub.PatternDryRunner).DryRunPattern(pubsub.MatchAll), jc.DeepEquals, []string{"topic.2", "topic.3", "topic.4"})
+
+	// Publishing on a forgotten topic remembers it again.
+	publishTopics(c, hub, "topic.0")
+	c.Check(hub.(pubsub.PatternDryRunner).DryRunPattern(pubsub.MatchAll), jc.DeepEquals, []string{"topic.0", "topic.3", "topic.4"})
+}
+
+func (*DryRunSuite) TestMatchedTopics(c *gc.C) {
+	// With the history disabled, the topics matched by the subscribers
+	// are still used.
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		RecentTopics: -1,
+	})
+	_, err := hub.Subscribe(pubsub.MatchRegex(`^unit\.`), func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	publishTopics(c, hub, "unit.added", "machine.added")
+	c.Check(hub.(pubsub.PatternDryRunner).DryRunPattern(pubsub.MatchAll), jc.DeepEquals, []string{"unit.added"})
+}
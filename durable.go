@@ -0,0 +1,273 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils/deque"
+)
+
+// DurableConfig defines how a durable subscription spills its queue to a
+// Store. See the Durable subscribe option.
+type DurableConfig struct {
+	// Store holds the spilled messages. The name of the subscription, set
+	// with the Named option, is used as the stream name, so each durable
+	// subscription sharing a store must have a different name.
+	Store Store
+
+	// SpillAfter is the number of messages kept in memory for the
+	// subscription. Once this many messages are queued, further messages
+	// are written to the store until the queue has been drained.
+	SpillAfter int
+
+	// Marshaller serializes the message data written to the store. If it
+	// is not set the JSONMarshaller is used. Wrap it with
+	// CompressingMarshaller to compress large messages.
+	Marshaller Marshaller
+}
+
+// Validate checks that the config values are valid.
+func (config DurableConfig) Validate() error {
+	if config.Store == nil {
+		return errors.NotValidf("missing Store")
+	}
+	if config.SpillAfter <= 0 {
+		return errors.NotValidf("SpillAfter %d", config.SpillAfter)
+	}
+	return nil
+}
+
+// Durable is a subscribe option that bounds the memory used by the queue
+// of a named subscription by spilling messages to a store, and gives the
+// subscription bounded durability. When a durable subscription is created
+// with the name of one that existed before, such as after a restart, any
+// spilled messages that were not handled are delivered first, before any
+// new messages. Only the spilled messages are kept, so messages held in
+// memory are lost when the process stops.
+//
+// The data of restored messages is whatever the Marshaller unmarshals into
+// an interface{}, so durable subscriptions are best suited to structured
+// hubs, where the data is already in its map form. The store is accessed
+// while messages are queued, so publishing slows down while a subscription
+// is spilling. Durable subscriptions can't be combined with Parallel or
+// Retry.
+func Durable(config DurableConfig) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.durable = &config
+	}
+}
+
+// spilledMessage is the form of the message written to the store.
+type spilledMessage struct {
+	Sequence uint64  `json:"sequence"`
+	Key      string  `json:"key,omitempty"`
+	Headers  Headers `json:"headers,omitempty"`
+	Data     []byte  `json:"data"`
+	Barrier  bool    `json:"barrier,omitempty"`
+}
+
+// durableQueue holds the details of the messages a subscriber has spilled
+// to the store. It is protected by the subscriber mutex.
+type durableQueue struct {
+	config DurableConfig
+	stream string
+
+	// head is the record sequence of the first spilled message, and next
+	// is the record sequence that the next spilled message is given.
+	head uint64
+	next uint64
+
+	// restored is the number of records at the head of the stream that
+	// were spilled before the subscriber was created, and calls holds the
+	// callbacks, without their data, of the messages spilled since.
+	restored int
+	calls    *deque.Deque
+}
+
+func newDurableQueue(stream string, config DurableConfig) (*durableQueue, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if stream == "" {
+		return nil, errors.NotValidf("durable subscription without a name")
+	}
+	if config.Marshaller == nil {
+		config.Marshaller = JSONMarshaller
+	}
+	records, err := config.Store.GetRange(stream, 0, math.MaxUint64)
+	if err != nil {
+		return nil, errors.Annotatef(err, "restoring %q", stream)
+	}
+	q := &durableQueue{
+		config:   config,
+		stream:   stream,
+		head:     1,
+		next:     1,
+		restored: len(records),
+		calls:    deque.New(),
+	}
+	if len(records) > 0 {
+		q.head = records[0].Sequence
+		q.next = records[len(records)-1].Sequence + 1
+	}
+	return q, nil
+}
+
+// len returns the number of spilled messages.
+func (q *durableQueue) len() int {
+	return q.restored + q.calls.Len()
+}
+
+// spill writes the message of the call to the store. If it succeeds the
+// call is kept without its data.
+func (q *durableQueue) spill(call *handlerCallback) error {
+	record, err := spilledRecord(q.config.Marshaller, q.next, call)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := q.config.Store.Put(q.stream, record); err != nil {
+		return errors.Annotatef(err, "spilling to %q", q.stream)
+	}
+	call.data = nil
+	call.record = q.next
+	q.next++
+	q.calls.PushBack(call)
+	return nil
+}
+
+// spilledRecord returns the record with the sequence that the message of
+// the call is written to the store as.
+func spilledRecord(marshaller Marshaller, sequence uint64, call *handlerCallback) (Record, error) {
+	data, err := marshaller.Marshal(call.data)
+	if err != nil {
+		return Record{}, errors.Annotate(err, "marshalling data")
+	}
+	value, err := json.Marshal(spilledMessage{
+		Sequence: call.sequence,
+		Key:      call.key,
+		Headers:  call.headers,
+		Data:     data,
+		Barrier:  call.barrier,
+	})
+	if err != nil {
+		return Record{}, errors.Trace(err)
+	}
+	return Record{Sequence: sequence, Topic: call.topic, Data: value}, nil
+}
+
+// load reads up to count spilled messages from the store, and returns
+// them as calls ready to be handled. Every record is decoded before any of
+// the calls are taken from the queue, so if one can't be the queue is left
+// as it was, and the same records are loaded next time.
+func (q *durableQueue) load(count int) ([]*handlerCallback, error) {
+	records, err := q.config.Store.GetRange(q.stream, q.head, q.head+uint64(count))
+	if err != nil {
+		return nil, errors.Annotatef(err, "loading from %q", q.stream)
+	}
+	messages := make([]spilledMessage, len(records))
+	data := make([]interface{}, len(records))
+	for i, record := range records {
+		if err := json.Unmarshal(record.Data, &messages[i]); err != nil {
+			return nil, errors.Annotatef(err, "record %d of %q", record.Sequence, q.stream)
+		}
+		if err := q.config.Marshaller.Unmarshal(messages[i].Data, &data[i]); err != nil {
+			return nil, errors.Annotatef(err, "record %d of %q", record.Sequence, q.stream)
+		}
+	}
+	result := make([]*handlerCallback, 0, len(records))
+	for i, record := range records {
+		var call *handlerCallback
+		if q.restored > 0 {
+			q.restored--
+			call = &handlerCallback{queued: time.Now()}
+		} else {
+			value, _ := q.calls.PopFront()
+			call = value.(*handlerCallback)
+		}
+		message := messages[i]
+		call.topic = record.Topic
+		call.data = data[i]
+		call.sequence = message.Sequence
+		call.key = message.Key
+		call.headers = message.Headers
+		call.barrier = message.Barrier
+		call.record = record.Sequence
+		result = append(result, call)
+		q.head = record.Sequence + 1
+	}
+	return result, nil
+}
+
+// handled removes the record of the handled call from the store.
+func (q *durableQueue) handled(call *handlerCallback) error {
+	if call.record == 0 {
+		return nil
+	}
+	return errors.Trace(q.config.Store.Trim(q.stream, call.record+1))
+}
+
+// notifyDurable queues the call for a durable subscriber, spilling it to
+// the store if the memory queue is full or messages have already been
+// spilled. The subscriber mutex must be held.
+func (s *subscriber) notifyDurable(call *handlerCallback) {
+	if s.durable.len() > 0 || s.pending.Len() >= s.durable.config.SpillAfter {
+		err := s.durable.spill(call)
+		if err == nil {
+			return
+		}
+		// The message is kept in memory rather than lost. This may break
+		// the ordering with messages already spilled.
+		s.reportError(&HubError{
+			Phase:          PhaseDispatch,
+			Topic:          call.topic,
+			Subscriber:     s.id,
+			SubscriberName: s.name,
+			Err:            err,
+		})
+	}
+	s.pending.Push(QueuedMessage{call: call})
+}
+
+// loadSpilled moves spilled messages back into memory when the memory
+// queue is empty. The subscriber mutex must be held.
+func (s *subscriber) loadSpilled() {
+	if s.durable == nil || s.pending.Len() > 0 || s.durable.len() == 0 {
+		return
+	}
+	calls, err := s.durable.load(s.durable.config.SpillAfter)
+	if err != nil {
+		s.reportError(&HubError{
+			Phase:          PhaseDispatch,
+			Subscriber:     s.id,
+			SubscriberName: s.name,
+			Err:            err,
+		})
+		return
+	}
+	for _, call := range calls {
+		s.pending.Push(QueuedMessage{call: call})
+	}
+}
+
+// durableHandled trims the store after a spilled message is handled.
+func (s *subscriber) durableHandled(call *handlerCallback) {
+	if s.durable == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.durable.handled(call); err != nil {
+		s.reportError(&HubError{
+			Phase:          PhaseDispatch,
+			Topic:          call.topic,
+			Subscriber:     s.id,
+			SubscriberName: s.name,
+			Err:            err,
+		})
+	}
+}
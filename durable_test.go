@@ -0,0 +1,244 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type DurableSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&DurableSuite{})
+
+func (*DurableSuite) TestValidation(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := func(pubsub.Topic, interface{}) {}
+	store := pubsub.NewMemoryStore()
+
+	_, err := hub.Subscribe(topic, handler, pubsub.Named("test"), pubsub.Durable(pubsub.DurableConfig{SpillAfter: 1}))
+	c.Check(err, gc.ErrorMatches, "missing Store not valid")
+	_, err = hub.Subscribe(topic, handler, pubsub.Named("test"), pubsub.Durable(pubsub.DurableConfig{Store: store}))
+	c.Check(err, gc.ErrorMatches, "SpillAfter 0 not valid")
+	_, err = hub.Subscribe(topic, handler, pubsub.Durable(pubsub.DurableConfig{Store: store, SpillAfter: 1}))
+	c.Check(err, gc.ErrorMatches, "durable subscription without a name not valid")
+	_, err = hub.Subscribe(topic, handler, pubsub.Named("test"), pubsub.Parallel(2),
+		pubsub.Durable(pubsub.DurableConfig{Store: store, SpillAfter: 1}))
+	c.Check(err, gc.ErrorMatches, "durable subscription with Parallel not valid")
+	_, err = hub.Subscribe(topic, handler, pubsub.Named("test"), pubsub.Retry(pubsub.RetryPolicy{MaxAttempts: 2}),
+		pubsub.Durable(pubsub.DurableConfig{Store: store, SpillAfter: 1}))
+	c.Check(err, gc.ErrorMatches, "durable subscription with Retry not valid")
+}
+
+// blockingHandler returns a handler that records the data it is called
+// with, and blocks until released.
+type blockingHandler struct {
+	mutex    sync.Mutex
+	received []interface{}
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (h *blockingHandler) handle(topic pubsub.Topic, data interface{}) {
+	h.started <- struct{}{}
+	<-h.release
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.received = append(h.received, data)
+}
+
+func (h *blockingHandler) get() []interface{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.received
+}
+
+func waitStarted(c *gc.C, h *blockingHandler) {
+	select {
+	case <-h.started:
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func storedCount(c *gc.C, store pubsub.Store, stream string) int {
+	records, err := store.GetRange(stream, 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	return len(records)
+}
+
+func (*DurableSuite) TestSpillKeepsOrder(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	hub := pubsub.NewStructuredHub(nil)
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		handler.handle(topic, data["value"])
+	}, pubsub.Named("durable"), pubsub.Durable(pubsub.DurableConfig{
+		Store:      store,
+		SpillAfter: 2,
+	}))
+	c.Assert(err, jc.ErrorIsNil)
+
+	var results []pubsub.Completer
+	for i := 0; i < 10; i++ {
+		result, err := hub.Publish(topic, map[string]interface{}{"value": i})
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+		if i == 0 {
+			waitStarted(c, handler)
+		}
+	}
+	// The first is being handled, two are in memory and the rest are in
+	// the store.
+	c.Check(sub.Pending(), gc.Equals, 9)
+	c.Check(storedCount(c, store, "durable"), gc.Equals, 7)
+
+	close(handler.release)
+	for _, result := range results {
+		select {
+		case <-result.Complete():
+		case <-time.After(time.Second):
+			c.Fatal("publish did not complete")
+		}
+	}
+	// The messages that went through the store come back in their JSON
+	// form, but all in the order they were published.
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{
+		0, 1, 2, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0,
+	})
+	c.Check(sub.Pending(), gc.Equals, 0)
+	c.Check(storedCount(c, store, "durable"), gc.Equals, 0)
+}
+
+func (*DurableSuite) TestRestore(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	config := pubsub.DurableConfig{Store: store, SpillAfter: 1}
+	hub := pubsub.NewSimpleHub()
+	first := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, first.handle, pubsub.Named("durable"), pubsub.Durable(config))
+	c.Assert(err, jc.ErrorIsNil)
+	for i := 0; i < 5; i++ {
+		_, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		if i == 0 {
+			waitStarted(c, first)
+		}
+	}
+	// The first is being handled, the second is in memory, and the last
+	// three are in the store. Unsubscribing loses the one in memory.
+	sub.Unsubscribe()
+	close(first.release)
+	c.Check(storedCount(c, store, "durable"), gc.Equals, 3)
+
+	// A new hub, as after a restart, with a subscriber of the same name
+	// gets the stored messages before the new ones.
+	hub = pubsub.NewSimpleHub()
+	second := newBlockingHandler()
+	close(second.release)
+	sub, err = hub.Subscribe(topic, second.handle, pubsub.Named("durable"), pubsub.Durable(config))
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, 5)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	// The new message was also spilled, as it was published while the
+	// stored messages were still queued.
+	c.Check(second.get(), jc.DeepEquals, []interface{}{2.0, 3.0, 4.0, 5.0})
+	c.Check(storedCount(c, store, "durable"), gc.Equals, 0)
+}
+
+// flakyMarshaller is the JSONMarshaller, except that the unmarshalling
+// number failOn fails.
+type flakyMarshaller struct {
+	mutex  sync.Mutex
+	calls  int
+	failOn int
+}
+
+func (m *flakyMarshaller) Marshal(data interface{}) ([]byte, error) {
+	return pubsub.JSONMarshaller.Marshal(data)
+}
+
+func (m *flakyMarshaller) Unmarshal(data []byte, v interface{}) error {
+	m.mutex.Lock()
+	m.calls++
+	fail := m.calls == m.failOn
+	m.mutex.Unlock()
+	if fail {
+		return errors.New("flaky")
+	}
+	return pubsub.JSONMarshaller.Unmarshal(data, v)
+}
+
+func (*DurableSuite) TestLoadFailureKeepsMessages(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	errs := make(chan *pubsub.HubError, 10)
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		ErrorHandler: func(err *pubsub.HubError) { errs <- err },
+	})
+	handler := newBlockingHandler()
+	_, err := hub.Subscribe(topic, handler.handle, pubsub.Named("durable"), pubsub.Durable(pubsub.DurableConfig{
+		Store:      store,
+		SpillAfter: 2,
+		// The second record of the first batch loaded can't be read.
+		Marshaller: &flakyMarshaller{failOn: 2},
+	}))
+	c.Assert(err, jc.ErrorIsNil)
+
+	var results []pubsub.Completer
+	for i := 0; i < 6; i++ {
+		result, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+		if i == 0 {
+			waitStarted(c, handler)
+		}
+	}
+	c.Check(storedCount(c, store, "durable"), gc.Equals, 3)
+	close(handler.release)
+
+	select {
+	case err := <-errs:
+		c.Check(err, gc.ErrorMatches, `.*record 2 of "durable": flaky`)
+	case <-time.After(time.Second):
+		c.Fatal("load error not reported")
+	}
+	// Nothing was taken from the store, so the next message published
+	// loads the whole batch again.
+	c.Check(storedCount(c, store, "durable"), gc.Equals, 3)
+	result, err := hub.Publish(topic, 6)
+	c.Assert(err, jc.ErrorIsNil)
+	results = append(results, result)
+	for i, result := range results {
+		select {
+		case <-result.Complete():
+		case <-time.After(time.Second):
+			c.Fatalf("publish %d did not complete", i)
+		}
+	}
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{
+		0, 1, 2, 3.0, 4.0, 5.0, 6.0,
+	})
+	c.Check(storedCount(c, store, "durable"), gc.Equals, 0)
+}
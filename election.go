@@ -0,0 +1,338 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// LeadershipTopicPrefix is the prefix of the topics that leadership claims
+// are published on. See LeadershipTopic.
+const LeadershipTopicPrefix = "pubsub.leadership."
+
+// LeadershipTopic returns the topic that the leadership of the named group
+// is claimed on.
+func LeadershipTopic(group string) Topic {
+	return Topic(LeadershipTopicPrefix + group)
+}
+
+const defaultLeadershipTTL = 15 * time.Second
+
+// LeadershipClaim is the message published on the leadership topic of a
+// group each time a candidate claims or renews the leadership, and when
+// the leader gives it up.
+type LeadershipClaim struct {
+	Group     string `json:"group"`
+	Candidate string `json:"candidate"`
+
+	// Time is when the claim was made, and TTL is how long it lasts
+	// unless it is renewed.
+	Time time.Time     `json:"time"`
+	TTL  time.Duration `json:"ttl"`
+
+	// Released is true when the leader gives up the leadership.
+	Released bool `json:"released,omitempty"`
+}
+
+// ElectionConfig is the argument struct for NewElection.
+type ElectionConfig struct {
+	// Hub is the hub that the claims are published on. For a candidate
+	// to see the leader as soon as it starts, rather than after the next
+	// renewal, the hub must retain messages. See SimpleHubConfig.Retain.
+	// Hubs other than those of this package must implement ChanSubscriber.
+	Hub Hub
+
+	// Group names the set of candidates that one leader is elected from.
+	Group string
+
+	// Candidate identifies this candidate within the group, and must be
+	// unique.
+	Candidate string
+
+	// TTL is how long a claim to the leadership lasts unless it is
+	// renewed. It defaults to 15 seconds.
+	TTL time.Duration
+
+	// Heartbeat is the interval between the renewals of the leader, and
+	// between the checks of the other candidates for a leader. It must be
+	// less than the TTL, and defaults to a third of it.
+	Heartbeat time.Duration
+
+	// OnElected, if set, is called when the candidate becomes the leader,
+	// and OnDeposed is called when it stops being the leader, including
+	// when the election is closed. The calls are made one at a time.
+	OnElected func()
+	OnDeposed func()
+}
+
+// Validate checks that the config values are valid.
+func (config ElectionConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if _, ok := config.Hub.(rawSubscriber); !ok {
+		if _, ok := config.Hub.(ChanSubscriber); !ok {
+			return errors.NotValidf("Hub %T without SubscribeChan", config.Hub)
+		}
+	}
+	if config.Group == "" {
+		return errors.NotValidf("missing Group")
+	}
+	if config.Candidate == "" {
+		return errors.NotValidf("missing Candidate")
+	}
+	if config.TTL < 0 {
+		return errors.NotValidf("negative TTL")
+	}
+	if config.Heartbeat < 0 {
+		return errors.NotValidf("negative Heartbeat")
+	}
+	ttl := config.TTL
+	if ttl == 0 {
+		ttl = defaultLeadershipTTL
+	}
+	if config.Heartbeat >= ttl {
+		return errors.NotValidf("Heartbeat %v not less than TTL %v", config.Heartbeat, ttl)
+	}
+	return nil
+}
+
+// Election elects one leader from the candidates of a group sharing a hub,
+// so that one of several identical instances performs the singleton
+// duties. The leader renews its claim every heartbeat, and when the claim
+// lapses the other candidates claim the leadership. Candidates may see
+// claims in different orders, as only hubs that retain messages deliver
+// them in the order they were published, so candidates that claim at the
+// same time agree on the winner by the time of the claims, and then by
+// their names. A candidate only takes its own claim as electing it once
+// it has stood for a heartbeat, by which time the claims made with it
+// have arrived.
+//
+// The election is only as reliable as the hub and the clocks of the
+// candidates, which use the time of each claim to decide when it lapses.
+// Duties that must never run twice at once need a lock held somewhere
+// stronger, such as a database.
+type Election struct {
+	config      ElectionConfig
+	unsubscribe func()
+
+	mutex  sync.Mutex
+	leader string
+	start  time.Time
+	since  time.Time
+	expiry time.Time
+	closed bool
+
+	// notify is held while the callbacks are made, so they are made one
+	// at a time and in order.
+	notify  sync.Mutex
+	leading bool
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewElection starts the candidate taking part in the election of the
+// group. The candidate waits for a heartbeat to see whether there is a
+// leader before claiming the leadership. Close must be called to stop it.
+func NewElection(config ElectionConfig) (*Election, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultLeadershipTTL
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = config.TTL / 3
+	}
+	e := &Election{
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	topic := LeadershipTopic(config.Group)
+	if raw, ok := config.Hub.(rawSubscriber); ok {
+		handler := func(_ Topic, data interface{}) {
+			e.observe(data)
+		}
+		sub, fetched, err := raw.subscribe(topic, handler, nil, true)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, message := range fetched {
+			e.observe(message.Data)
+		}
+		e.unsubscribe = sub.Unsubscribe
+	} else {
+		messages, closer, err := SubscribeChan(config.Hub, topic, 0)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		go func() {
+			for message := range messages {
+				e.observe(message.Data)
+			}
+		}()
+		e.unsubscribe = closer
+	}
+	go e.loop()
+	return e, nil
+}
+
+// observe records the claim. The data is the claim itself for simple hubs,
+// and its map form for structured hubs.
+func (e *Election) observe(data interface{}) {
+	claim, ok := data.(LeadershipClaim)
+	if !ok {
+		bytes, err := JSONMarshaller.Marshal(data)
+		if err == nil {
+			err = JSONMarshaller.Unmarshal(bytes, &claim)
+		}
+		if err != nil {
+			logger.Warningf("ignoring leadership claim %v: %v", data, err)
+			return
+		}
+	}
+	now := time.Now()
+	e.mutex.Lock()
+	switch {
+	case claim.Released:
+		if claim.Candidate == e.leader {
+			e.leader = ""
+			e.expiry = time.Time{}
+		}
+	case claim.Candidate == e.leader && e.expiry.After(now):
+		e.expiry = claim.Time.Add(claim.TTL)
+	case e.leader == "" || !e.expiry.After(now) || claim.precedes(e.start, e.leader):
+		// The start of the term is what competing claims are compared
+		// with, and since is when this candidate learned of it.
+		if claim.Candidate != e.leader {
+			e.since = now
+		}
+		e.leader = claim.Candidate
+		e.start = claim.Time
+		e.expiry = claim.Time.Add(claim.TTL)
+	}
+	e.mutex.Unlock()
+	e.update()
+}
+
+// precedes returns true if the claim wins over the claim of the candidate
+// made at the time, because it was made earlier, or at the same time by a
+// candidate whose name sorts first.
+func (claim LeadershipClaim) precedes(t time.Time, candidate string) bool {
+	if claim.Time.Equal(t) {
+		return claim.Candidate < candidate
+	}
+	return claim.Time.Before(t)
+}
+
+// Leader returns the current leader of the group, or false if there isn't
+// one.
+func (e *Election) Leader() (string, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.leader == "" || !e.expiry.After(time.Now()) {
+		return "", false
+	}
+	return e.leader, true
+}
+
+// IsLeader returns true if the candidate is the leader of the group.
+func (e *Election) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.isLeader()
+}
+
+// isLeader returns true if the candidate is the leader, and its claim has
+// stood for a heartbeat. The mutex must be held.
+func (e *Election) isLeader() bool {
+	now := time.Now()
+	return e.holdsClaim() && !now.Before(e.since.Add(e.config.Heartbeat))
+}
+
+// holdsClaim returns true if the candidate's claim is the current one. The
+// mutex must be held.
+func (e *Election) holdsClaim() bool {
+	return !e.closed && e.leader == e.config.Candidate && e.expiry.After(time.Now())
+}
+
+// update calls the callbacks if the candidate has become, or stopped
+// being, the leader.
+func (e *Election) update() {
+	e.notify.Lock()
+	defer e.notify.Unlock()
+	leading := e.IsLeader()
+	if leading == e.leading {
+		return
+	}
+	e.leading = leading
+	callback := e.config.OnDeposed
+	if leading {
+		callback = e.config.OnElected
+	}
+	if callback != nil {
+		callback()
+	}
+}
+
+func (e *Election) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.config.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+		e.mutex.Lock()
+		claim := e.leader == e.config.Candidate || e.leader == "" || !e.expiry.After(time.Now())
+		e.mutex.Unlock()
+		if claim {
+			if err := e.publish(false); err != nil {
+				logger.Warningf("claiming leadership of %q: %v", e.config.Group, err)
+			}
+		}
+		// The claim of the candidate may have lapsed.
+		e.update()
+	}
+}
+
+func (e *Election) publish(released bool) error {
+	_, err := e.config.Hub.Publish(LeadershipTopic(e.config.Group), LeadershipClaim{
+		Group:     e.config.Group,
+		Candidate: e.config.Candidate,
+		Time:      time.Now(),
+		TTL:       e.config.TTL,
+		Released:  released,
+	})
+	return errors.Trace(err)
+}
+
+// Close stops the candidate taking part in the election. If it is the
+// leader, it gives up the leadership so another candidate can take over
+// straight away, and OnDeposed is called.
+func (e *Election) Close() {
+	e.once.Do(func() {
+		close(e.stop)
+		<-e.done
+		e.mutex.Lock()
+		leader := e.holdsClaim()
+		e.closed = true
+		e.mutex.Unlock()
+		if leader {
+			if err := e.publish(true); err != nil {
+				logger.Warningf("releasing leadership of %q: %v", e.config.Group, err)
+			}
+		}
+		e.unsubscribe()
+		e.update()
+	})
+}
@@ -0,0 +1,247 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ElectionSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ElectionSuite{})
+
+// candidate records the leadership changes of an election.
+type candidate struct {
+	election *pubsub.Election
+	changes  chan bool
+}
+
+func newCandidate(c *gc.C, hub pubsub.Hub, name string) *candidate {
+	cand := &candidate{changes: make(chan bool, 10)}
+	election, err := pubsub.NewElection(pubsub.ElectionConfig{
+		Hub:       hub,
+		Group:     "workers",
+		Candidate: name,
+		TTL:       200 * time.Millisecond,
+		Heartbeat: 20 * time.Millisecond,
+		OnElected: func() { cand.changes <- true },
+		OnDeposed: func() { cand.changes <- false },
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	cand.election = election
+	return cand
+}
+
+// waitLeader waits for one of the candidates to be elected, and returns
+// it.
+func waitLeader(c *gc.C, candidates ...*candidate) *candidate {
+	leaders := make(map[*candidate]bool)
+	timeout := time.After(5 * time.Second)
+	for {
+		for _, cand := range candidates {
+			select {
+			case elected := <-cand.changes:
+				c.Assert(elected, jc.IsTrue)
+				leaders[cand] = true
+			default:
+			}
+		}
+		if len(leaders) > 0 {
+			c.Assert(leaders, gc.HasLen, 1)
+			for cand := range leaders {
+				return cand
+			}
+		}
+		select {
+		case <-timeout:
+			c.Fatal("no leader elected")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (*ElectionSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	for i, test := range []struct {
+		config pubsub.ElectionConfig
+		err    string
+	}{{
+		config: pubsub.ElectionConfig{Group: "g", Candidate: "a"},
+		err:    "missing Hub not valid",
+	}, {
+		config: pubsub.ElectionConfig{Hub: hub, Candidate: "a"},
+		err:    "missing Group not valid",
+	}, {
+		config: pubsub.ElectionConfig{Hub: hub, Group: "g"},
+		err:    "missing Candidate not valid",
+	}, {
+		config: pubsub.ElectionConfig{Hub: hub, Group: "g", Candidate: "a", TTL: -1},
+		err:    "negative TTL not valid",
+	}, {
+		config: pubsub.ElectionConfig{Hub: hub, Group: "g", Candidate: "a", Heartbeat: -1},
+		err:    "negative Heartbeat not valid",
+	}, {
+		config: pubsub.ElectionConfig{Hub: hub, Group: "g", Candidate: "a", TTL: time.Second, Heartbeat: time.Second},
+		err:    "Heartbeat 1s not less than TTL 1s not valid",
+	}, {
+		config: pubsub.ElectionConfig{Hub: hub, Group: "g", Candidate: "a", Heartbeat: time.Minute},
+		err:    "Heartbeat 1m0s not less than TTL 15s not valid",
+	}} {
+		c.Logf("test %d", i)
+		err := test.config.Validate()
+		c.Check(err, gc.ErrorMatches, test.err)
+		election, err := pubsub.NewElection(test.config)
+		c.Check(err, gc.ErrorMatches, test.err)
+		c.Check(election, gc.IsNil)
+	}
+}
+
+func (*ElectionSuite) TestSingleLeader(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var candidates []*candidate
+	for i := 0; i < 3; i++ {
+		cand := newCandidate(c, hub, fmt.Sprintf("worker-%d", i))
+		defer cand.election.Close()
+		candidates = append(candidates, cand)
+	}
+	leader := waitLeader(c, candidates...)
+	c.Check(leader.election.IsLeader(), jc.IsTrue)
+
+	// The leader keeps the leadership while it renews its claim.
+	time.Sleep(300 * time.Millisecond)
+	name, ok := leader.election.Leader()
+	c.Assert(ok, jc.IsTrue)
+	for _, cand := range candidates {
+		current, ok := cand.election.Leader()
+		c.Check(ok, jc.IsTrue)
+		c.Check(current, gc.Equals, name)
+		if cand != leader {
+			c.Check(cand.election.IsLeader(), jc.IsFalse)
+			c.Check(cand.changes, gc.HasLen, 0)
+		}
+	}
+}
+
+func (*ElectionSuite) TestFailover(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	alpha := newCandidate(c, hub, "first")
+	defer alpha.election.Close()
+	beta := newCandidate(c, hub, "second")
+	defer beta.election.Close()
+
+	leader := waitLeader(c, alpha, beta)
+	other := beta
+	if leader == beta {
+		other = alpha
+	}
+	leader.election.Close()
+	select {
+	case elected := <-leader.changes:
+		c.Check(elected, jc.IsFalse)
+	case <-time.After(time.Second):
+		c.Fatal("leader not deposed")
+	}
+	c.Check(leader.election.IsLeader(), jc.IsFalse)
+	c.Check(waitLeader(c, other), gc.Equals, other)
+	name, ok := other.election.Leader()
+	c.Check(ok, jc.IsTrue)
+	c.Check(name, gc.Not(gc.Equals), "")
+}
+
+func (*ElectionSuite) TestRetainedLeader(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 1})
+	alpha := newCandidate(c, hub, "first")
+	defer alpha.election.Close()
+	c.Check(waitLeader(c, alpha), gc.Equals, alpha)
+
+	// The new candidate knows the leader straight away.
+	late, err := pubsub.NewElection(pubsub.ElectionConfig{
+		Hub:       hub,
+		Group:     "workers",
+		Candidate: "late",
+		TTL:       200 * time.Millisecond,
+		Heartbeat: 20 * time.Millisecond,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer late.Close()
+	name, ok := late.Leader()
+	c.Check(ok, jc.IsTrue)
+	c.Check(name, gc.Equals, "first")
+}
+
+func (*ElectionSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	alpha := newCandidate(c, hub, "first")
+	defer alpha.election.Close()
+	beta := newCandidate(c, hub, "second")
+	defer beta.election.Close()
+	leader := waitLeader(c, alpha, beta)
+	c.Check(leader.election.IsLeader(), jc.IsTrue)
+}
+
+func (*ElectionSuite) TestConcurrentClaims(c *gc.C) {
+	// Two claims made at the same time, on hubs without retention, reach
+	// the candidates in different orders. The candidates still agree on
+	// the earlier claim.
+	now := time.Now()
+	claims := []pubsub.LeadershipClaim{
+		{Group: "workers", Candidate: "beta", Time: now.Add(time.Millisecond), TTL: time.Minute},
+		{Group: "workers", Candidate: "alpha", Time: now, TTL: time.Minute},
+		{Group: "workers", Candidate: "aardvark", Time: now, TTL: time.Minute},
+	}
+	for i, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}} {
+		c.Logf("order %d", i)
+		hub := pubsub.NewSimpleHub()
+		election, err := pubsub.NewElection(pubsub.ElectionConfig{
+			Hub:       hub,
+			Group:     "workers",
+			Candidate: "observer",
+			TTL:       time.Hour,
+			Heartbeat: time.Minute,
+		})
+		c.Assert(err, jc.ErrorIsNil)
+		for _, index := range order {
+			result, err := hub.Publish(pubsub.LeadershipTopic("workers"), claims[index])
+			c.Assert(err, jc.ErrorIsNil)
+			select {
+			case <-result.Complete():
+			case <-time.After(time.Second):
+				c.Fatal("claim not delivered")
+			}
+		}
+		leader, ok := election.Leader()
+		c.Check(ok, jc.IsTrue)
+		c.Check(leader, gc.Equals, "aardvark")
+		election.Close()
+	}
+}
+
+func (*ElectionSuite) TestConcurrentCandidates(c *gc.C) {
+	// The candidates all claim on the same heartbeat, on a hub that
+	// doesn't serialize the deliveries, and only one is elected.
+	hub := pubsub.NewSimpleHub()
+	var candidates []*candidate
+	for i := 0; i < 5; i++ {
+		cand := newCandidate(c, hub, fmt.Sprintf("worker-%d", i))
+		defer cand.election.Close()
+		candidates = append(candidates, cand)
+	}
+	leader := waitLeader(c, candidates...)
+	time.Sleep(100 * time.Millisecond)
+	for _, cand := range candidates {
+		c.Check(cand.election.IsLeader(), gc.Equals, cand == leader)
+		if cand != leader {
+			c.Check(cand.changes, gc.HasLen, 0)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+)
+
+// The names of the environment variables read by NewHubFromEnv, after the
+// prefix and an underscore.
+const (
+	// EnvHub is "structured", the default, or "simple".
+	EnvHub = "HUB"
+
+	// EnvQueueSize is the SimpleHubConfig.QueueSize.
+	EnvQueueSize = "QUEUE_SIZE"
+
+	// EnvMaxInFlight is the SimpleHubConfig.MaxInFlight.
+	EnvMaxInFlight = "MAX_IN_FLIGHT"
+
+	// EnvRetain is the SimpleHubConfig.Retain.
+	EnvRetain = "RETAIN"
+
+	// EnvMatcher is how published topics are matched to subscribers:
+	// "cached", the default, remembers the subscribers of each topic,
+	// "uncached" matches every topic published against every subscriber,
+	// and "tracked" also times the matches for the hub Report.
+	EnvMatcher = "MATCHER"
+
+	// EnvTopicCacheSize is the SimpleHubConfig.TopicCacheSize of the
+	// "cached" and "tracked" matchers.
+	EnvTopicCacheSize = "TOPIC_CACHE_SIZE"
+
+	// EnvSlowMatch is the SimpleHubConfig.SlowMatch, as a duration such
+	// as "5ms".
+	EnvSlowMatch = "SLOW_MATCH"
+
+	// EnvMetrics is a boolean that enables the counting of the messages
+	// the subscribers handle and drop with the Metrics passed to
+	// NewHubFromEnv, such as those of pubsubdebug.NewExpvarMetrics.
+	EnvMetrics = "METRICS"
+
+	// EnvLogLevel is the loggo level of the "pubsub" module, such as
+	// "DEBUG".
+	EnvLogLevel = "LOG_LEVEL"
+)
+
+// NewHubFromEnv returns a hub configured from the environment variables
+// that start with the prefix followed by an underscore, so services can
+// tune their hub without changing code. With the prefix "APP_PUBSUB", the
+// queue of each subscriber is bounded by APP_PUBSUB_QUEUE_SIZE, and so on
+// for the names above. Variables that aren't set leave the defaults of
+// the hub, and variables that can't be parsed are an error. The metrics
+// are only used if they are enabled, and must be given for them to be.
+func NewHubFromEnv(prefix string, metrics Metrics) (Hub, error) {
+	if prefix == "" {
+		return nil, errors.NotValidf("empty prefix")
+	}
+	env := envReader{prefix: prefix}
+	config := &SimpleHubConfig{
+		QueueSize:      env.int(EnvQueueSize),
+		MaxInFlight:    env.int(EnvMaxInFlight),
+		Retain:         env.int(EnvRetain),
+		TopicCacheSize: env.int(EnvTopicCacheSize),
+		SlowMatch:      env.duration(EnvSlowMatch),
+	}
+	switch matcher := env.get(EnvMatcher); matcher {
+	case "", "cached":
+	case "uncached":
+		config.TopicCacheSize = -1
+	case "tracked":
+		config.TrackMatchCost = true
+	default:
+		env.invalid(EnvMatcher, matcher)
+	}
+	if env.bool(EnvMetrics) {
+		if metrics == nil && env.err == nil {
+			env.err = errors.NotValidf("%s_%s without Metrics", prefix, EnvMetrics)
+		}
+		config.Metrics = metrics
+	}
+	level := loggo.UNSPECIFIED
+	if value := env.get(EnvLogLevel); value != "" {
+		var ok bool
+		if level, ok = loggo.ParseLevel(value); !ok {
+			env.invalid(EnvLogLevel, value)
+		}
+	}
+	hubType := env.get(EnvHub)
+	if hubType != "" && hubType != "simple" && hubType != "structured" {
+		env.invalid(EnvHub, hubType)
+	}
+	if env.err != nil {
+		return nil, errors.Trace(env.err)
+	}
+
+	if level != loggo.UNSPECIFIED {
+		loggo.GetLogger("pubsub").SetLogLevel(level)
+	}
+	if hubType == "simple" {
+		return NewSimpleHubWithConfig(config), nil
+	}
+	return NewStructuredHub(&StructuredHubConfig{SimpleHubConfig: *config}), nil
+}
+
+// envReader reads the environment variables with a prefix, and keeps the
+// first error.
+type envReader struct {
+	prefix string
+	err    error
+}
+
+func (r *envReader) get(name string) string {
+	return os.Getenv(r.prefix + "_" + name)
+}
+
+func (r *envReader) invalid(name, value string) {
+	if r.err == nil {
+		r.err = errors.NotValidf("%s_%s value %q", r.prefix, name, value)
+	}
+}
+
+func (r *envReader) int(name string) int {
+	value := r.get(name)
+	if value == "" {
+		return 0
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		r.invalid(name, value)
+	}
+	return result
+}
+
+func (r *envReader) bool(name string) bool {
+	value := r.get(name)
+	if value == "" {
+		return false
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		r.invalid(name, value)
+	}
+	return result
+}
+
+func (r *envReader) duration(name string) time.Duration {
+	value := r.get(name)
+	if value == "" {
+		return 0
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		r.invalid(name, value)
+	}
+	return result
+}
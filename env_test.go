@@ -0,0 +1,142 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"os"
+
+	"github.com/juju/loggo"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type EnvSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&EnvSuite{})
+
+// setEnv sets the environment variable until the end of the test.
+func (s *EnvSuite) setEnv(c *gc.C, name, value string) {
+	old, set := os.LookupEnv(name)
+	c.Assert(os.Setenv(name, value), jc.ErrorIsNil)
+	s.AddCleanup(func(*gc.C) {
+		if set {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func (*EnvSuite) TestDefaults(c *gc.C) {
+	hub, err := pubsub.NewHubFromEnv("PUBSUB_TEST_UNSET", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	_, ok := hub.(pubsub.StructuredHub)
+	c.Check(ok, jc.IsTrue)
+	_, ok = hub.(pubsub.Reporter).Report()["match-costs"]
+	c.Check(ok, jc.IsFalse)
+}
+
+func (s *EnvSuite) TestSimpleHub(c *gc.C) {
+	s.setEnv(c, "PUBSUB_TEST_HUB", "simple")
+	s.setEnv(c, "PUBSUB_TEST_MATCHER", "tracked")
+	hub, err := pubsub.NewHubFromEnv("PUBSUB_TEST", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	_, ok := hub.(pubsub.StructuredHub)
+	c.Check(ok, jc.IsFalse)
+	_, err = hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	_, ok = hub.(pubsub.Reporter).Report()["match-costs"]
+	c.Check(ok, jc.IsTrue)
+}
+
+func (s *EnvSuite) TestQueueSize(c *gc.C) {
+	s.setEnv(c, "PUBSUB_TEST_HUB", "simple")
+	s.setEnv(c, "PUBSUB_TEST_QUEUE_SIZE", "2")
+	hub, err := pubsub.NewHubFromEnv("PUBSUB_TEST", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	blocking := newBlockingHandler()
+	_, err = hub.Subscribe(topic, blocking.handle)
+	c.Assert(err, jc.ErrorIsNil)
+
+	var completers []pubsub.Completer
+	for i := 0; i < 4; i++ {
+		done, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		completers = append(completers, done)
+		if i == 0 {
+			waitStarted(c, blocking)
+		}
+	}
+	// The oldest of the queued messages is evicted.
+	waitComplete(c, completers[1])
+	close(blocking.release)
+	for _, done := range completers {
+		waitComplete(c, done)
+	}
+	c.Check(blocking.get(), jc.DeepEquals, []interface{}{0, 2, 3})
+}
+
+func (s *EnvSuite) TestMetrics(c *gc.C) {
+	metrics := &metricsRecorder{}
+	hub, err := pubsub.NewHubFromEnv("PUBSUB_TEST", metrics)
+	c.Assert(err, jc.ErrorIsNil)
+	s.checkDelivered(c, hub, metrics, 0)
+
+	s.setEnv(c, "PUBSUB_TEST_METRICS", "true")
+	hub, err = pubsub.NewHubFromEnv("PUBSUB_TEST", metrics)
+	c.Assert(err, jc.ErrorIsNil)
+	s.checkDelivered(c, hub, metrics, 1)
+
+	_, err = pubsub.NewHubFromEnv("PUBSUB_TEST", nil)
+	c.Check(err, gc.ErrorMatches, "PUBSUB_TEST_METRICS without Metrics not valid")
+}
+
+// checkDelivered publishes a message to a subscriber, and checks the
+// number of deliveries the metrics have recorded.
+func (*EnvSuite) checkDelivered(c *gc.C, hub pubsub.Hub, metrics *metricsRecorder, expected int) {
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	done, err := hub.Publish(topic, map[string]interface{}{})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(metrics.get(), gc.HasLen, expected)
+}
+
+func (s *EnvSuite) TestLogLevel(c *gc.C) {
+	s.setEnv(c, "PUBSUB_TEST_LOG_LEVEL", "trace")
+	_, err := pubsub.NewHubFromEnv("PUBSUB_TEST", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(loggo.GetLogger("pubsub").LogLevel(), gc.Equals, loggo.TRACE)
+}
+
+func (s *EnvSuite) TestErrors(c *gc.C) {
+	_, err := pubsub.NewHubFromEnv("", nil)
+	c.Check(err, gc.ErrorMatches, "empty prefix not valid")
+
+	for i, test := range []struct {
+		name  string
+		value string
+	}{
+		{"HUB", "fancy"},
+		{"QUEUE_SIZE", "lots"},
+		{"MATCHER", "regex"},
+		{"SLOW_MATCH", "5"},
+		{"METRICS", "please"},
+		{"LOG_LEVEL", "LOUD"},
+	} {
+		c.Logf("test %d: %s", i, test.name)
+		s.setEnv(c, "PUBSUB_TEST_"+test.name, test.value)
+		_, err := pubsub.NewHubFromEnv("PUBSUB_TEST", nil)
+		c.Check(err, gc.ErrorMatches, `PUBSUB_TEST_`+test.name+` value "`+test.value+`" not valid`)
+		s.setEnv(c, "PUBSUB_TEST_"+test.name, "")
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	defaultErrorWindow = time.Minute
+
+	// errorBuckets is the number of buckets the error window is split
+	// into. Counts leave the window one bucket at a time.
+	errorBuckets = 10
+)
+
+// Names of the counts kept for each subscriber, as shown in the hub Report.
+// Errors are counted by the phase they were reported in, so a recovered
+// panic is counted both as a panic and as a dispatch error.
+const (
+	countDropped = "dropped"
+	countPanics  = "panics"
+)
+
+// ErrorBudget configures how the errors of each subscriber of a hub are
+// counted, and what happens when a subscriber has too many of them.
+type ErrorBudget struct {
+	// Window is how far back the errors, panics and drops of each
+	// subscriber are counted. It defaults to one minute.
+	Window time.Duration
+
+	// MaxErrors is the number of errors a subscriber may have in the
+	// window before it is quarantined. Drops are not errors. Zero means
+	// that subscribers are never quarantined.
+	MaxErrors int
+
+	// Quarantine is how long a quarantined subscriber has its messages
+	// dropped rather than handled. Zero means until its handler is
+	// replaced. Replacing the handler always ends the quarantine.
+	Quarantine time.Duration
+
+	// RecoverPanics, if true, recovers the panics of the handlers of all
+	// the subscribers. Each panic is counted as a panic, and reported to
+	// the hub's ErrorHandler as a dispatch error, which also counts
+	// towards MaxErrors. The message is treated as handled. Without it,
+	// only the panics of the subscribers of failover groups with
+	// MaxPanics are recovered and counted, and any other panic crashes
+	// the process.
+	RecoverPanics bool
+}
+
+// ErrorMetrics may be implemented by the Metrics of a hub to also be told
+// about the errors of the subscribers, and their quarantines.
+type ErrorMetrics interface {
+	// Errored is called for each error reported for a subscriber.
+	Errored(labels map[string]string, topic Topic, phase Phase)
+
+	// Quarantined is called when a subscriber is quarantined, and again
+	// when its quarantine ends.
+	Quarantined(labels map[string]string, quarantined bool)
+}
+
+// errorTracker counts the errors of a subscriber over a sliding window.
+type errorTracker struct {
+	budget ErrorBudget
+	width  time.Duration
+
+	mutex   sync.Mutex
+	buckets [errorBuckets]errorBucket
+
+	// quarantined is true while the subscriber is quarantined, until the
+	// time given, or until it is released if that is zero.
+	quarantined bool
+	until       time.Time
+}
+
+type errorBucket struct {
+	number int64
+	counts map[string]int
+}
+
+func newErrorTracker(budget *ErrorBudget) *errorTracker {
+	var t errorTracker
+	if budget != nil {
+		t.budget = *budget
+	}
+	if t.budget.Window <= 0 {
+		t.budget.Window = defaultErrorWindow
+	}
+	t.width = t.budget.Window / errorBuckets
+	if t.width <= 0 {
+		t.width = 1
+	}
+	return &t
+}
+
+// add counts one of the kind, and returns true if the subscriber has
+// just gone over its error budget and been quarantined.
+func (t *errorTracker) add(kind string, isError bool, now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	number := now.UnixNano() / int64(t.width)
+	bucket := &t.buckets[number%errorBuckets]
+	if bucket.number != number || bucket.counts == nil {
+		bucket.number = number
+		bucket.counts = make(map[string]int)
+	}
+	bucket.counts[kind]++
+	if !isError || t.budget.MaxErrors <= 0 || t.quarantined {
+		return false
+	}
+	var total int
+	for kind, count := range t.counts(now) {
+		if kind != countDropped && kind != countPanics {
+			total += count
+		}
+	}
+	if total <= t.budget.MaxErrors {
+		return false
+	}
+	t.quarantined = true
+	if t.budget.Quarantine > 0 {
+		t.until = now.Add(t.budget.Quarantine)
+	}
+	return true
+}
+
+// counts returns the counts in the window. The mutex must be held.
+func (t *errorTracker) counts(now time.Time) map[string]int {
+	number := now.UnixNano() / int64(t.width)
+	result := make(map[string]int)
+	for _, bucket := range t.buckets {
+		if bucket.number <= number-errorBuckets || bucket.number > number {
+			continue
+		}
+		for kind, count := range bucket.counts {
+			result[kind] += count
+		}
+	}
+	return result
+}
+
+// checkQuarantine returns whether the subscriber is quarantined, and
+// whether its quarantine has just ended.
+func (t *errorTracker) checkQuarantine(now time.Time) (quarantined, ended bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.quarantined {
+		return false, false
+	}
+	if t.until.IsZero() || now.Before(t.until) {
+		return true, false
+	}
+	t.endQuarantine()
+	return false, true
+}
+
+// release ends the quarantine, if there is one, and returns true if there
+// was.
+func (t *errorTracker) release() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.quarantined {
+		return false
+	}
+	t.endQuarantine()
+	return true
+}
+
+// endQuarantine forgets the errors that caused the quarantine, so the
+// subscriber starts with its full budget. The mutex must be held.
+func (t *errorTracker) endQuarantine() {
+	t.quarantined = false
+	t.until = time.Time{}
+	t.buckets = [errorBuckets]errorBucket{}
+}
+
+// report adds the counts and quarantine of the subscriber to its report.
+func (t *errorTracker) report(result map[string]interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if counts := t.counts(time.Now()); len(counts) > 0 {
+		values := make(map[string]interface{}, len(counts))
+		for kind, count := range counts {
+			values[kind] = count
+		}
+		result["errors"] = values
+	}
+	if t.quarantined {
+		result["quarantined"] = true
+	}
+}
+
+// callHandler calls the handler, recovering any panic if the hub's
+// ErrorBudget asks for it.
+func (s *subscriber) callHandler(ctx context.Context, handler func(context.Context, Topic, interface{}) error, topic Topic, data interface{}) error {
+	if !s.errs.budget.RecoverPanics {
+		return handler(ctx, topic, data)
+	}
+	_, err := s.callRecoveringHandler(ctx, handler, topic, data)
+	return err
+}
+
+// callRecoveringHandler calls the handler, and recovers any panic, which is
+// counted and reported as a dispatch error. It returns true if the handler
+// panicked.
+func (s *subscriber) callRecoveringHandler(ctx context.Context, handler func(context.Context, Topic, interface{}) error, topic Topic, data interface{}) (panicked bool, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		panicked = true
+		s.errs.add(countPanics, false, time.Now())
+		s.reportError(&HubError{
+			Phase:          PhaseDispatch,
+			Topic:          topic,
+			Subscriber:     s.id,
+			SubscriberName: s.name,
+			Err:            errors.Errorf("handler panic: %v", r),
+		})
+	}()
+	return false, handler(ctx, topic, data)
+}
+
+// countingErrors returns a function that reports the errors of the
+// subscriber, counting them as it does.
+func (s *subscriber) countingErrors(report func(*HubError)) func(*HubError) {
+	return func(err *HubError) {
+		if report != nil {
+			report(err)
+		}
+		if metrics, ok := s.metrics.(ErrorMetrics); ok {
+			metrics.Errored(s.labels, err.Topic, err.Phase)
+		}
+		if s.errs.add(string(err.Phase), true, time.Now()) {
+			s.quarantineChanged(true)
+			if report != nil {
+				report(&HubError{
+					Phase:          PhaseDispatch,
+					Topic:          err.Topic,
+					Subscriber:     s.id,
+					SubscriberName: s.name,
+					Err:            errors.Errorf("quarantined after more than %d errors in %v", s.errs.budget.MaxErrors, s.errs.budget.Window),
+				})
+			}
+		}
+	}
+}
+
+// quarantined returns true if the subscriber's messages are to be dropped.
+func (s *subscriber) quarantined() bool {
+	quarantined, ended := s.errs.checkQuarantine(time.Now())
+	if ended {
+		s.quarantineChanged(false)
+	}
+	return quarantined
+}
+
+func (s *subscriber) quarantineChanged(quarantined bool) {
+	if quarantined {
+		logger.Warningf("subscriber %d quarantined", s.id)
+	} else {
+		logger.Infof("quarantine of subscriber %d ended", s.id)
+	}
+	if metrics, ok := s.metrics.(ErrorMetrics); ok {
+		metrics.Quarantined(s.labels, quarantined)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ErrorBudgetSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ErrorBudgetSuite{})
+
+type errorMetrics struct {
+	metricsRecorder
+
+	mutex       sync.Mutex
+	phases      []pubsub.Phase
+	quarantines []bool
+}
+
+func (m *errorMetrics) Errored(labels map[string]string, topic pubsub.Topic, phase pubsub.Phase) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.phases = append(m.phases, phase)
+}
+
+func (m *errorMetrics) Quarantined(labels map[string]string, quarantined bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.quarantines = append(m.quarantines, quarantined)
+}
+
+// erroringHandler counts its calls, and fails them all.
+type erroringHandler struct {
+	mutex sync.Mutex
+	calls int
+}
+
+func (h *erroringHandler) handle(pubsub.Topic, interface{}) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.calls++
+	return errors.New("boom")
+}
+
+func (h *erroringHandler) count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.calls
+}
+
+func publishCount(c *gc.C, hub pubsub.Hub, count int) {
+	for i := 0; i < count; i++ {
+		done, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+}
+
+func (*ErrorBudgetSuite) TestReportCounts(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := &erroringHandler{}
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishCount(c, hub, 2)
+	c.Check(hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"], jc.DeepEquals, map[string]interface{}{
+		"matcher":   "testing",
+		"pending":   0,
+		"delivered": uint64(2),
+		"errors":    map[string]interface{}{"handler": 2},
+	})
+}
+
+func (*ErrorBudgetSuite) TestQuarantineUntilReplaced(c *gc.C) {
+	metrics := &errorMetrics{}
+	errs := make(chan *pubsub.HubError, 10)
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Metrics:     metrics,
+		ErrorBudget: &pubsub.ErrorBudget{MaxErrors: 2},
+		ErrorHandler: func(err *pubsub.HubError) {
+			errs <- err
+		},
+	})
+	handler := &erroringHandler{}
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishCount(c, hub, 5)
+	c.Check(handler.count(), gc.Equals, 3)
+	for i := 0; i < 3; i++ {
+		c.Check(<-errs, gc.ErrorMatches, `handler "testing" for subscriber 0: boom`)
+	}
+	c.Check(<-errs, gc.ErrorMatches, `dispatch "testing" for subscriber 0: quarantined after more than 2 errors in 1m0s`)
+	report := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})
+	c.Check(report["quarantined"], jc.IsTrue)
+	c.Check(report["errors"], jc.DeepEquals, map[string]interface{}{"handler": 3, "dropped": 2})
+
+	receiver := &orderedReceiver{}
+	c.Assert(sub.Replace(receiver.handle), jc.ErrorIsNil)
+	publishCount(c, hub, 1)
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{0})
+	report = hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})
+	c.Check(report["quarantined"], gc.IsNil)
+	c.Check(report["errors"], gc.IsNil)
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	c.Check(metrics.phases, jc.DeepEquals, []pubsub.Phase{
+		pubsub.PhaseHandler, pubsub.PhaseHandler, pubsub.PhaseHandler,
+	})
+	c.Check(metrics.quarantines, jc.DeepEquals, []bool{true, false})
+	c.Check(metrics.get(), gc.HasLen, 6)
+}
+
+func (*ErrorBudgetSuite) TestQuarantinePeriod(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		ErrorBudget: &pubsub.ErrorBudget{
+			MaxErrors:  1,
+			Quarantine: 20 * time.Millisecond,
+		},
+	})
+	handler := &erroringHandler{}
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishCount(c, hub, 3)
+	c.Check(handler.count(), gc.Equals, 2)
+	time.Sleep(30 * time.Millisecond)
+	publishCount(c, hub, 1)
+	c.Check(handler.count(), gc.Equals, 3)
+}
+
+func (*ErrorBudgetSuite) TestWindow(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		ErrorBudget: &pubsub.ErrorBudget{
+			Window:    20 * time.Millisecond,
+			MaxErrors: 1,
+		},
+	})
+	handler := &erroringHandler{}
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 3; i++ {
+		// The errors are too far apart to use up the budget.
+		publishCount(c, hub, 1)
+		time.Sleep(30 * time.Millisecond)
+	}
+	c.Check(handler.count(), gc.Equals, 3)
+	c.Check(hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})["errors"], gc.IsNil)
+}
+
+func (*ErrorBudgetSuite) TestRecoverPanics(c *gc.C) {
+	errs := make(chan *pubsub.HubError, 10)
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		ErrorBudget: &pubsub.ErrorBudget{RecoverPanics: true},
+		ErrorHandler: func(err *pubsub.HubError) {
+			errs <- err
+		},
+	})
+	receiver := &orderedReceiver{}
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) {
+		if data == 0 {
+			panic("boom")
+		}
+		receiver.handle(topic, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishCount(c, hub, 2)
+	c.Check(<-errs, gc.ErrorMatches, `dispatch "testing" for subscriber 0: handler panic: boom`)
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{1})
+	report := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})
+	c.Check(report["errors"], jc.DeepEquals, map[string]interface{}{"dispatch": 1, "panics": 1})
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"github.com/juju/errors"
+)
+
+// ErrorPayload is the message published by PublishError, giving the
+// errors reported on result topics the same shape in every project.
+type ErrorPayload struct {
+	// Message is the text of the error.
+	Message string `json:"message"`
+
+	// Code identifies the kind of error, so subscribers can act on it
+	// without matching the message. See ErrorCoder.
+	Code string `json:"code,omitempty"`
+
+	// Stack is the juju/errors stack of the error, if it has more to say
+	// than the message.
+	Stack string `json:"stack,omitempty"`
+}
+
+// ErrorCoder is implemented by errors that carry their own code for
+// PublishError to publish.
+type ErrorCoder interface {
+	ErrorCode() string
+}
+
+// The codes given to the juju/errors kinds, and the constructors that
+// recreate them for the subscribers.
+var errorKinds = []struct {
+	code     string
+	is       func(error) bool
+	recreate func(error, string) error
+}{
+	{"not-found", errors.IsNotFound, errors.NewNotFound},
+	{"not-valid", errors.IsNotValid, errors.NewNotValid},
+	{"not-supported", errors.IsNotSupported, errors.NewNotSupported},
+	{"not-implemented", errors.IsNotImplemented, errors.NewNotImplemented},
+	{"already-exists", errors.IsAlreadyExists, errors.NewAlreadyExists},
+	{"unauthorized", errors.IsUnauthorized, errors.NewUnauthorized},
+	{"forbidden", errors.IsForbidden, errors.NewForbidden},
+	{"bad-request", errors.IsBadRequest, errors.NewBadRequest},
+	{"timeout", errors.IsTimeout, errors.NewTimeout},
+}
+
+// NewErrorPayload returns the payload that PublishError publishes for the
+// error. The code is the one the error gives if it implements
+// ErrorCoder, or the code of its juju/errors kind, such as "not-found".
+func NewErrorPayload(err error) ErrorPayload {
+	payload := ErrorPayload{Message: err.Error()}
+	if coder, ok := err.(ErrorCoder); ok {
+		payload.Code = coder.ErrorCode()
+	} else {
+		for _, kind := range errorKinds {
+			if kind.is(err) {
+				payload.Code = kind.code
+				break
+			}
+		}
+	}
+	if stack := errors.ErrorStack(err); stack != payload.Message {
+		payload.Stack = stack
+	}
+	return payload
+}
+
+// PublishError publishes the error on the topic as an ErrorPayload, for
+// the handlers subscribed with OnError. A nil error is not valid.
+func PublishError(hub Hub, topic Topic, err error) (Completer, error) {
+	if err == nil {
+		return nil, errors.NotValidf("nil error")
+	}
+	done, err := hub.Publish(topic, NewErrorPayload(err))
+	return done, errors.Trace(err)
+}
+
+// PublishedError is the error passed to the handlers subscribed with
+// OnError. Its Cause is an error of the juju/errors kind the code stands
+// for, so errors.IsNotFound and the like work on it as they did on the
+// published error.
+type PublishedError struct {
+	ErrorPayload
+}
+
+// Error implements error.
+func (e *PublishedError) Error() string {
+	return e.Message
+}
+
+// ErrorCode implements ErrorCoder.
+func (e *PublishedError) ErrorCode() string {
+	return e.Code
+}
+
+// Cause returns an error of the kind the code stands for, or nil if the
+// code isn't one of a juju/errors kind.
+func (e *PublishedError) Cause() error {
+	for _, kind := range errorKinds {
+		if kind.code == e.Code {
+			return kind.recreate(nil, e.Message)
+		}
+	}
+	return nil
+}
+
+// OnError subscribes the handler to the errors published on the topic
+// with PublishError. It works with the simple and structured hubs alike.
+// Messages on the topic that aren't error payloads are logged and skipped.
+func OnError(hub Hub, matcher TopicMatcher, handler func(error), options ...SubscribeOption) (Subscription, error) {
+	if handler == nil {
+		return nil, errors.NotValidf("nil handler")
+	}
+	callback := func(topic Topic, data interface{}) {
+		payload, ok := data.(ErrorPayload)
+		if !ok {
+			// Structured hubs hand over the map form of the payload.
+			bytes, err := JSONMarshaller.Marshal(data)
+			if err == nil {
+				err = JSONMarshaller.Unmarshal(bytes, &payload)
+			}
+			if err == nil && payload.Message == "" {
+				err = errors.NotValidf("missing message")
+			}
+			if err != nil {
+				logger.Warningf("ignoring error payload %v on %q: %v", data, topic, err)
+				return
+			}
+		}
+		handler(&PublishedError{ErrorPayload: payload})
+	}
+	if raw, ok := hub.(rawSubscriber); ok {
+		sub, _, err := raw.subscribe(matcher, callback, options, false)
+		return sub, errors.Trace(err)
+	}
+	sub, err := hub.Subscribe(matcher, callback, options...)
+	return sub, errors.Trace(err)
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ErrorTopicSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ErrorTopicSuite{})
+
+type codedError struct{}
+
+func (codedError) Error() string     { return "quota exceeded" }
+func (codedError) ErrorCode() string { return "quota" }
+
+func receiveError(c *gc.C, errs <-chan error) error {
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(time.Second):
+		c.Fatal("error handler not called")
+	}
+	return nil
+}
+
+func (*ErrorTopicSuite) TestPayload(c *gc.C) {
+	// Errors without a juju/errors stack have only their message.
+	payload := pubsub.NewErrorPayload(fmt.Errorf("boom"))
+	c.Check(payload, jc.DeepEquals, pubsub.ErrorPayload{Message: "boom"})
+
+	payload = pubsub.NewErrorPayload(codedError{})
+	c.Check(payload, jc.DeepEquals, pubsub.ErrorPayload{Message: "quota exceeded", Code: "quota"})
+
+	payload = pubsub.NewErrorPayload(errors.Annotate(errors.NotFoundf("unit"), "deploying"))
+	c.Check(payload.Message, gc.Equals, "deploying: unit not found")
+	c.Check(payload.Code, gc.Equals, "not-found")
+	c.Check(payload.Stack, gc.Matches, `(?s).*errortopic_test.go.*deploying`)
+}
+
+func (*ErrorTopicSuite) TestPublishNil(c *gc.C) {
+	_, err := pubsub.PublishError(pubsub.NewSimpleHub(), topic, nil)
+	c.Check(err, gc.ErrorMatches, "nil error not valid")
+}
+
+func (s *ErrorTopicSuite) TestSimpleHub(c *gc.C) {
+	s.checkRoundTrip(c, pubsub.NewSimpleHub())
+}
+
+func (s *ErrorTopicSuite) TestStructuredHub(c *gc.C) {
+	s.checkRoundTrip(c, pubsub.NewStructuredHub(nil))
+}
+
+func (*ErrorTopicSuite) checkRoundTrip(c *gc.C, hub pubsub.Hub) {
+	errs := make(chan error, 1)
+	_, err := pubsub.OnError(hub, topic, func(err error) {
+		errs <- err
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = pubsub.PublishError(hub, topic, errors.NotValidf("config"))
+	c.Assert(err, jc.ErrorIsNil)
+	received := receiveError(c, errs)
+	c.Check(received, gc.ErrorMatches, "config not valid")
+	c.Check(received, jc.Satisfies, errors.IsNotValid)
+	c.Check(received.(pubsub.ErrorCoder).ErrorCode(), gc.Equals, "not-valid")
+
+	_, err = pubsub.PublishError(hub, topic, codedError{})
+	c.Assert(err, jc.ErrorIsNil)
+	received = receiveError(c, errs)
+	c.Check(received, gc.ErrorMatches, "quota exceeded")
+	c.Check(received.(pubsub.ErrorCoder).ErrorCode(), gc.Equals, "quota")
+	c.Check(errors.Cause(received), gc.Equals, received)
+}
+
+func (*ErrorTopicSuite) TestNotAnErrorPayload(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	errs := make(chan error, 1)
+	_, err := pubsub.OnError(hub, topic, func(err error) {
+		errs <- err
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	done, err := hub.Publish(topic, Emitter{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	select {
+	case err := <-errs:
+		c.Fatalf("unexpected error %v", err)
+	default:
+	}
+}
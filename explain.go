@@ -0,0 +1,128 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MatchResult describes how the topic matcher of a subscriber relates to a
+// particular topic. It is returned from the Explain method of a Hub.
+type MatchResult struct {
+	// ID is the identifier of the subscriber within the hub.
+	ID int
+
+	// Matcher is the topic matcher that the subscriber was created with.
+	Matcher TopicMatcher
+
+	// Pattern is a human readable form of the matcher.
+	Pattern string
+
+	// Matched is true if the subscriber would be notified of the topic.
+	Matched bool
+
+	// NearMiss describes why the matcher nearly matched the topic. It is only
+	// set when Matched is false.
+	NearMiss string
+}
+
+// Explain implements Explainer.
+func (h *simplehub) Explain(topic Topic) []MatchResult {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var results []MatchResult
+	for _, s := range h.subscribers {
+		result := MatchResult{
+			ID:      s.id,
+			Matcher: s.topicMatcher,
+			Pattern: describeMatcher(s.topicMatcher),
+			Matched: s.topicMatcher.Match(topic),
+		}
+		if !result.Matched {
+			result.NearMiss = nearMiss(s.topicMatcher, topic)
+			if result.NearMiss == "" {
+				continue
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func describeMatcher(matcher TopicMatcher) string {
+	switch m := matcher.(type) {
+	case Topic:
+		return string(m)
+	case fmt.Stringer:
+		return m.String()
+	}
+	return fmt.Sprintf("%T", matcher)
+}
+
+// maxNearMissDistance is the largest edit distance between a topic and an
+// exact topic matcher that is reported as a near miss.
+const maxNearMissDistance = 2
+
+// nearMiss returns a description of why the matcher nearly matches the
+// topic, or the empty string if it isn't considered close.
+func nearMiss(matcher TopicMatcher, topic Topic) string {
+	switch m := matcher.(type) {
+	case Topic:
+		if strings.EqualFold(string(m), string(topic)) {
+			return "differs only in case"
+		}
+		if d := editDistance(string(m), string(topic)); d <= maxNearMissDistance {
+			return fmt.Sprintf("edit distance of %d", d)
+		}
+	case *regexMatcher:
+		expr := m.match.String()
+		if insensitive, err := regexp.Compile("(?i)" + expr); err == nil && insensitive.MatchString(string(topic)) {
+			return "matches if case is ignored"
+		}
+		if literal, _ := m.match.LiteralPrefix(); literal != "" && strings.HasPrefix(string(topic), literal) {
+			return fmt.Sprintf("topic has the literal prefix %q", literal)
+		}
+	case *anyMatcher:
+		for _, matcher := range m.matchers {
+			if reason := nearMiss(matcher, topic); reason != "" {
+				return fmt.Sprintf("%s: %s", describeMatcher(matcher), reason)
+			}
+		}
+	}
+	return ""
+}
+
+// editDistance returns the Levenshtein distance between the two strings.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
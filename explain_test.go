@@ -0,0 +1,70 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ExplainSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ExplainSuite{})
+
+func (*ExplainSuite) TestExplainNoSubscribers(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	c.Assert(hub.(pubsub.Explainer).Explain(first), gc.HasLen, 0)
+}
+
+func (*ExplainSuite) TestExplain(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	noop := func(pubsub.Topic, interface{}) {}
+	for _, matcher := range []pubsub.TopicMatcher{
+		first,
+		pubsub.Topic("First"),
+		pubsub.Topic("frist"),
+		second,
+		pubsub.MatchAll,
+		pubsub.MatchRegex("^first$"),
+		pubsub.MatchRegex("^FIRST"),
+		pubsub.MatchRegex("^unrelated"),
+	} {
+		_, err := hub.Subscribe(matcher, noop)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+
+	results := hub.(pubsub.Explainer).Explain(first)
+	for i := range results {
+		results[i].Matcher = nil
+	}
+	c.Assert(results, jc.DeepEquals, []pubsub.MatchResult{
+		{ID: 0, Pattern: "first", Matched: true},
+		{ID: 1, Pattern: "First", NearMiss: "differs only in case"},
+		{ID: 2, Pattern: "frist", NearMiss: "edit distance of 2"},
+		{ID: 4, Pattern: "all topics", Matched: true},
+		{ID: 5, Pattern: "^first$", Matched: true},
+		{ID: 6, Pattern: "^FIRST", NearMiss: "matches if case is ignored"},
+	})
+
+	results = hub.(pubsub.Explainer).Explain(firstdot)
+	c.Assert(results, gc.HasLen, 3)
+	c.Check(results[0].Pattern, gc.Equals, "all topics")
+	c.Check(results[1].Pattern, gc.Equals, "^first$")
+	c.Check(results[1].NearMiss, gc.Equals, `topic has the literal prefix "first"`)
+	c.Check(results[2].Pattern, gc.Equals, "^FIRST")
+}
+
+func (*ExplainSuite) TestExplainStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Subscribe(first, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	results := hub.(pubsub.Explainer).Explain(first)
+	c.Assert(results, gc.HasLen, 1)
+	c.Check(results[0].Matched, jc.IsTrue)
+}
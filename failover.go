@@ -0,0 +1,212 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// FailoverConfig defines a failover group. See the Failover subscribe
+// option.
+type FailoverConfig struct {
+	// Group is the name of the failover group. All the subscriptions with
+	// the same group name on a hub form the group.
+	Group string
+
+	// MaxPanics is the number of consecutive panics of the handler after
+	// which a primary is demoted. The panics are recovered and reported to
+	// the hub's ErrorHandler. Zero means that panics are not recovered,
+	// unless the hub's ErrorBudget has RecoverPanics set.
+	MaxPanics int
+
+	// HeartbeatTimeout is how long a primary may go without calling
+	// Heartbeat on its subscription before it is demoted. Zero means that
+	// heartbeats are not required.
+	HeartbeatTimeout time.Duration
+}
+
+// Failover is a subscribe option that makes the subscription part of a
+// failover group. Only the primary of a group, which is the first
+// subscription in the group, has its handler called. The others are warm
+// standbys. When the primary unsubscribes, panics MaxPanics times in a
+// row, or misses its heartbeat, the next subscription in the group is
+// promoted to primary. A demoted primary that is still subscribed becomes
+// the last standby of the group. Messages that were already queued for a
+// demoted primary are still delivered to it.
+//
+// Heartbeats are checked when messages are published, so a primary is
+// never demoted while the hub is idle.
+//
+// The subscriptions in a group should all use the same topic matcher, as
+// each message is only given to the primary if the primary's matcher
+// matches the topic.
+func Failover(config FailoverConfig) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.failover = &config
+	}
+}
+
+// Heartbeater is implemented by the Subscriptions returned from Subscribe.
+type Heartbeater interface {
+	// Heartbeat records that the subscriber is alive. It only has an
+	// effect for subscriptions in a failover group with a
+	// HeartbeatTimeout.
+	Heartbeat()
+}
+
+// failoverState is the failover state of a subscriber, and is protected by
+// the subscriber mutex.
+type failoverState struct {
+	config        FailoverConfig
+	panics        int
+	lastHeartbeat time.Time
+
+	// demote is the hub function called when the handler has panicked
+	// too many times.
+	demote func(*subscriber)
+}
+
+// Heartbeat implements Heartbeater.
+func (h *handle) Heartbeat() {
+	h.sub.mutex.Lock()
+	defer h.sub.mutex.Unlock()
+	if h.sub.failover != nil {
+		h.sub.failover.lastHeartbeat = time.Now()
+	}
+}
+
+// newFailover returns the failover state for a new subscriber.
+func (h *simplehub) newFailover(config *FailoverConfig) (*failoverState, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.Group == "" {
+		return nil, errors.NotValidf("failover without a group")
+	}
+	return &failoverState{
+		config:        *config,
+		lastHeartbeat: time.Now(),
+		demote:        h.demote,
+	}, nil
+}
+
+// joinFailover adds the subscriber to its failover group, if it has one.
+// The hub mutex must be held.
+func (h *simplehub) joinFailover(sub *subscriber) {
+	if sub.failover == nil {
+		return
+	}
+	if h.failover == nil {
+		h.failover = make(map[string][]*subscriber)
+	}
+	group := sub.failover.config.Group
+	h.failover[group] = append(h.failover[group], sub)
+}
+
+// removeFailover removes the subscriber from its failover group. The hub
+// mutex must be held.
+func (h *simplehub) removeFailover(sub *subscriber) {
+	if sub.failover == nil {
+		return
+	}
+	group := sub.failover.config.Group
+	members := h.failover[group]
+	wasPrimary := members[0] == sub
+	for i, member := range members {
+		if member == sub {
+			members = append(members[:i:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(h.failover, group)
+		return
+	}
+	h.failover[group] = members
+	if wasPrimary {
+		h.promoted(members[0])
+	}
+}
+
+// isStandby returns true if the subscriber is in a failover group and
+// isn't the primary. The hub mutex must be held.
+func (h *simplehub) isStandby(sub *subscriber) bool {
+	if sub.failover == nil {
+		return false
+	}
+	return h.failover[sub.failover.config.Group][0] != sub
+}
+
+// checkHeartbeats demotes the primaries that have missed their heartbeat.
+// The hub mutex must be held.
+func (h *simplehub) checkHeartbeats() {
+	now := time.Now()
+	for _, members := range h.failover {
+		primary := members[0]
+		primary.mutex.Lock()
+		timeout := primary.failover.config.HeartbeatTimeout
+		missed := timeout > 0 && now.Sub(primary.failover.lastHeartbeat) > timeout
+		primary.mutex.Unlock()
+		if missed {
+			h.logger.Warningf("subscriber %d missed failover heartbeat", primary.id)
+			h.rotate(primary)
+		}
+	}
+}
+
+// demote moves the subscriber to the end of its failover group if it is
+// the primary.
+func (h *simplehub) demote(sub *subscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.rotate(sub)
+}
+
+// rotate moves the primary to the end of its group, promoting the next
+// subscriber. The hub mutex must be held.
+func (h *simplehub) rotate(sub *subscriber) {
+	group := sub.failover.config.Group
+	members := h.failover[group]
+	if len(members) < 2 || members[0] != sub {
+		return
+	}
+	members = append(members[1:len(members):len(members)], sub)
+	h.failover[group] = members
+	h.promoted(members[0])
+}
+
+// promoted resets the failover state of the new primary so it gets a
+// fresh start.
+func (h *simplehub) promoted(sub *subscriber) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	sub.failover.panics = 0
+	sub.failover.lastHeartbeat = time.Now()
+	h.logger.Debugf("subscriber %d promoted to primary of failover group %q", sub.id, sub.failover.config.Group)
+}
+
+// callFailoverHandler calls the handler of a subscriber in a failover
+// group, recovering panics if the group demotes primaries that panic.
+func (s *subscriber) callFailoverHandler(ctx context.Context, handler func(context.Context, Topic, interface{}) error, topic Topic, data interface{}) error {
+	if s.failover.config.MaxPanics <= 0 {
+		return s.callHandler(ctx, handler, topic, data)
+	}
+	panicked, err := s.callRecoveringHandler(ctx, handler, topic, data)
+	s.mutex.Lock()
+	if !panicked {
+		s.failover.panics = 0
+		s.mutex.Unlock()
+		return err
+	}
+	s.failover.panics++
+	demote := s.failover.panics >= s.failover.config.MaxPanics
+	s.mutex.Unlock()
+	if demote {
+		s.failover.demote(s)
+	}
+	return err
+}
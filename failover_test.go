@@ -0,0 +1,144 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type FailoverSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&FailoverSuite{})
+
+// failoverRecorder records which member of a failover group handled each
+// message.
+type failoverRecorder struct {
+	mutex    sync.Mutex
+	handled  []string
+	panicFor map[string]bool
+}
+
+func (r *failoverRecorder) handler(name string) func(pubsub.Topic, interface{}) {
+	return func(topic pubsub.Topic, data interface{}) {
+		r.mutex.Lock()
+		panics := r.panicFor[name]
+		if !panics {
+			r.handled = append(r.handled, name)
+		}
+		r.mutex.Unlock()
+		if panics {
+			panic("bad handler")
+		}
+	}
+}
+
+func (r *failoverRecorder) get() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.handled
+}
+
+func publishAndWait(c *gc.C, hub pubsub.Hub) {
+	result, err := hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+}
+
+func (*FailoverSuite) TestMissingGroup(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {}, pubsub.Failover(pubsub.FailoverConfig{}))
+	c.Assert(err, gc.ErrorMatches, "failover without a group not valid")
+}
+
+func (*FailoverSuite) TestPromoteOnUnsubscribe(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder failoverRecorder
+	config := pubsub.FailoverConfig{Group: "group"}
+	primary, err := hub.Subscribe(topic, recorder.handler("primary"), pubsub.Failover(config))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, recorder.handler("standby"), pubsub.Failover(config))
+	c.Assert(err, jc.ErrorIsNil)
+
+	publishAndWait(c, hub)
+	primary.Unsubscribe()
+	publishAndWait(c, hub)
+	c.Assert(recorder.get(), jc.DeepEquals, []string{"primary", "standby"})
+}
+
+func (*FailoverSuite) TestPromoteOnPanics(c *gc.C) {
+	var errors []*pubsub.HubError
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		ErrorHandler: func(err *pubsub.HubError) {
+			errors = append(errors, err)
+		},
+	})
+	recorder := failoverRecorder{panicFor: map[string]bool{"primary": true}}
+	config := pubsub.FailoverConfig{Group: "group", MaxPanics: 2}
+	_, err := hub.Subscribe(topic, recorder.handler("primary"), pubsub.Failover(config))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, recorder.handler("standby"), pubsub.Failover(config))
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i := 0; i < 3; i++ {
+		publishAndWait(c, hub)
+	}
+	// The primary panicked twice and was demoted, so the standby handled
+	// the third message.
+	c.Assert(recorder.get(), jc.DeepEquals, []string{"standby"})
+	c.Assert(errors, gc.HasLen, 2)
+	c.Assert(errors[0], gc.ErrorMatches, `dispatch "testing" for subscriber 0: handler panic: bad handler`)
+
+	report := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})
+	c.Check(report["0"].(map[string]interface{})["standby"], jc.IsTrue)
+	c.Check(report["1"].(map[string]interface{})["standby"], jc.IsFalse)
+}
+
+func (*FailoverSuite) TestPromoteOnMissedHeartbeat(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder failoverRecorder
+	config := pubsub.FailoverConfig{Group: "group", HeartbeatTimeout: 200 * time.Millisecond}
+	primary, err := hub.Subscribe(topic, recorder.handler("primary"), pubsub.Failover(config))
+	c.Assert(err, jc.ErrorIsNil)
+	standby, err := hub.Subscribe(topic, recorder.handler("standby"), pubsub.Failover(config))
+	c.Assert(err, jc.ErrorIsNil)
+
+	time.Sleep(120 * time.Millisecond)
+	primary.(pubsub.Heartbeater).Heartbeat()
+	time.Sleep(120 * time.Millisecond)
+	publishAndWait(c, hub)
+
+	time.Sleep(250 * time.Millisecond)
+	publishAndWait(c, hub)
+
+	// The new primary heartbeats, so stays primary.
+	standby.(pubsub.Heartbeater).Heartbeat()
+	publishAndWait(c, hub)
+	c.Assert(recorder.get(), jc.DeepEquals, []string{"primary", "standby", "standby"})
+}
+
+func (*FailoverSuite) TestSeparateGroups(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder failoverRecorder
+	_, err := hub.Subscribe(topic, recorder.handler("a"), pubsub.Failover(pubsub.FailoverConfig{Group: "a"}))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, recorder.handler("b"), pubsub.Failover(pubsub.FailoverConfig{Group: "b"}))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, recorder.handler("plain"))
+	c.Assert(err, jc.ErrorIsNil)
+	publishAndWait(c, hub)
+	c.Assert(recorder.get(), jc.SameContents, []string{"a", "b", "plain"})
+}
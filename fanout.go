@@ -0,0 +1,47 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+// Priority is a subscribe option that orders the subscriber among the
+// subscribers of the hub. Each message is given to the matching
+// subscribers with the highest priority first, and to subscribers with the
+// same priority in the order they subscribed. Subscribers without the
+// option have priority zero, so by default messages are given to the
+// subscribers in the order they subscribed. The fan-out order is listed by
+// subscriber ID in the "fan-out-order" of the hub Report.
+//
+// Each subscriber handles its messages on its own goroutine, so the order
+// determines which subscriber is given a message first, not that its
+// handler has finished before the next subscriber's handler starts.
+func Priority(priority int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.priority = priority
+	}
+}
+
+// insertSubscriber returns a copy of the subscribers, which are in fan-out
+// order, with the new subscriber after all those with the same or higher
+// priority.
+func insertSubscriber(subscribers []*subscriber, sub *subscriber) []*subscriber {
+	i := len(subscribers)
+	for i > 0 && subscribers[i-1].priority < sub.priority {
+		i--
+	}
+	result := make([]*subscriber, 0, len(subscribers)+1)
+	result = append(result, subscribers[:i]...)
+	result = append(result, sub)
+	return append(result, subscribers[i:]...)
+}
+
+// withoutSubscriber returns a copy of the subscribers without the
+// subscriber.
+func withoutSubscriber(subscribers []*subscriber, sub *subscriber) []*subscriber {
+	result := make([]*subscriber, 0, len(subscribers))
+	for _, s := range subscribers {
+		if s != sub {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type FanOutSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&FanOutSuite{})
+
+func (*FanOutSuite) subscribe(c *gc.C, hub pubsub.Hub, options ...pubsub.SubscribeOption) pubsub.Subscription {
+	sub, err := hub.Subscribe(pubsub.MatchAll, func(pubsub.Topic, interface{}) {}, options...)
+	c.Assert(err, jc.ErrorIsNil)
+	return sub
+}
+
+func (s *FanOutSuite) TestSubscriptionOrder(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	for i := 0; i < 3; i++ {
+		s.subscribe(c, hub)
+	}
+	c.Check(hub.(pubsub.Reporter).Report()["fan-out-order"], jc.DeepEquals, []int{0, 1, 2})
+}
+
+func (s *FanOutSuite) TestPriorityOrder(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	s.subscribe(c, hub)                     // 0
+	s.subscribe(c, hub, pubsub.Priority(5)) // 1
+	s.subscribe(c, hub, pubsub.Priority(-1))
+	s.subscribe(c, hub, pubsub.Priority(5)) // 3
+	middle := s.subscribe(c, hub)           // 4
+	s.subscribe(c, hub, pubsub.Priority(10))
+	c.Check(hub.(pubsub.Reporter).Report()["fan-out-order"], jc.DeepEquals, []int{5, 1, 3, 0, 4, 2})
+
+	// Removing a subscriber keeps the order of the rest.
+	middle.Unsubscribe()
+	c.Check(hub.(pubsub.Reporter).Report()["fan-out-order"], jc.DeepEquals, []int{5, 1, 3, 0, 2})
+
+	subscribers := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})
+	c.Check(subscribers["5"].(map[string]interface{})["priority"], gc.Equals, 10)
+	_, ok := subscribers["0"].(map[string]interface{})["priority"]
+	c.Check(ok, jc.IsFalse)
+}
+
+func (s *FanOutSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Subscribe(pubsub.MatchAll, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(pubsub.MatchAll, func(pubsub.Topic, map[string]interface{}, error) {}, pubsub.Priority(1))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(hub.(pubsub.Reporter).Report()["fan-out-order"], jc.DeepEquals, []int{1, 0})
+}
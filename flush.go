@@ -0,0 +1,54 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+)
+
+// UnsubscribeFlush implements Subscription.
+func (h *handle) UnsubscribeFlush() Completer {
+	// A subscription that is still warming up couldn't flush its queue.
+	h.Ready()
+	return h.hub.unsubscribeFlush(h.sub.id)
+}
+
+func (h *simplehub) unsubscribeFlush(id int) Completer {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub := h.remove(id)
+	if sub == nil {
+		// Already unsubscribed, or already being flushed.
+		return completed()
+	}
+	h.departed(sub)
+	if h.flushing == nil {
+		h.flushing = make(map[int]*subscriber)
+	}
+	h.flushing[id] = sub
+
+	// The marker is queued behind all the messages already queued, so
+	// once it is reached they have all been handled.
+	done := make(chan struct{})
+	wait := sync.WaitGroup{}
+	handle := &doneHandle{done: done}
+	wait.Add(1)
+	sub.notify(&handlerCallback{
+		wg:      &wait,
+		handle:  handle,
+		barrier: true,
+	})
+	go func() {
+		wait.Wait()
+		h.mutex.Lock()
+		if _, ok := h.flushing[id]; ok {
+			delete(h.flushing, id)
+			sub.close()
+		}
+		h.mutex.Unlock()
+		close(done)
+	}()
+	return handle
+}
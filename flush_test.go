@@ -0,0 +1,108 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type FlushSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&FlushSuite{})
+
+// publishQueued publishes the values, waiting for the first to be passed
+// to the blocking handler, so the rest are queued.
+func publishQueued(c *gc.C, hub pubsub.Hub, handler *blockingHandler, values ...interface{}) []pubsub.Completer {
+	var completers []pubsub.Completer
+	for i, value := range values {
+		done, err := hub.Publish(topic, value)
+		c.Assert(err, jc.ErrorIsNil)
+		completers = append(completers, done)
+		if i == 0 {
+			waitStarted(c, handler)
+		}
+	}
+	return completers
+}
+
+func checkNotComplete(c *gc.C, completer pubsub.Completer) {
+	select {
+	case <-completer.Complete():
+		c.Fatal("completed early")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (*FlushSuite) TestUnsubscribeFlush(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	completers := publishQueued(c, hub, handler, 1, 2, 3)
+
+	flushed := sub.UnsubscribeFlush()
+	late, err := hub.Publish(topic, 4)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, late)
+	checkNotComplete(c, flushed)
+	checkNotComplete(c, completers[2])
+
+	close(handler.release)
+	waitComplete(c, flushed)
+	for _, done := range completers {
+		waitComplete(c, done)
+	}
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{1, 2, 3})
+	waitComplete(c, sub.UnsubscribeFlush())
+}
+
+func (*FlushSuite) TestUnsubscribeDiscards(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	completers := publishQueued(c, hub, handler, 1, 2, 3)
+
+	sub.Unsubscribe()
+	waitComplete(c, completers[1])
+	waitComplete(c, completers[2])
+	close(handler.release)
+	waitComplete(c, completers[0])
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{1})
+}
+
+func (*FlushSuite) TestUnsubscribeWhileFlushing(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	completers := publishQueued(c, hub, handler, 1, 2, 3)
+
+	flushed := sub.UnsubscribeFlush()
+	sub.Unsubscribe()
+	waitComplete(c, flushed)
+	waitComplete(c, completers[2])
+	close(handler.release)
+	waitComplete(c, completers[0])
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{1})
+}
+
+func (*FlushSuite) TestFlushWarmingUp(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder topicRecorder
+	sub, err := hub.Subscribe(topic, recorder.handle, pubsub.WarmUp(time.Hour))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, sub.UnsubscribeFlush())
+	c.Check(recorder.get(), jc.DeepEquals, []pubsub.Topic{topic})
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Handoff sends messages straight to the queue of a named subscriber,
+// without matching the topic against the subscribers of the hub. It is
+// for high frequency point to point streams, where the hub is used to
+// find the subscriber, but matching every message would be wasted work.
+//
+// Messages sent on a structured hub are serialized into their map form,
+// but they are not annotated, post processed or intercepted. Taps, retained
+// messages and delivery receipts are also skipped.
+type Handoff struct {
+	hub     *simplehub
+	sub     *subscriber
+	convert func(interface{}) (interface{}, error)
+}
+
+// handoffer is implemented by the hubs of this package.
+type handoffer interface {
+	handoff(name string) (*Handoff, error)
+}
+
+// NewHandoff returns a Handoff to the subscriber that was subscribed with
+// the name. It is an error if no subscriber, or more than one, has the
+// name.
+func NewHandoff(hub Hub, name string) (*Handoff, error) {
+	h, ok := hub.(handoffer)
+	if !ok {
+		return nil, errors.NotSupportedf("handoff on %T", hub)
+	}
+	handoff, err := h.handoff(name)
+	return handoff, errors.Trace(err)
+}
+
+func (h *simplehub) handoff(name string) (*Handoff, error) {
+	if name == "" {
+		return nil, errors.NotValidf("empty name")
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var found *subscriber
+	for _, s := range h.subscribers {
+		if s.name != name {
+			continue
+		}
+		if found != nil {
+			return nil, errors.NotValidf("handoff to %q with more than one subscriber", name)
+		}
+		found = s
+	}
+	if found == nil {
+		return nil, errors.NotFoundf("subscriber %q", name)
+	}
+	return &Handoff{hub: h, sub: found}, nil
+}
+
+func (h *structuredHub) handoff(name string) (*Handoff, error) {
+	handoff, err := h.simplehub.handoff(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	handoff.convert = func(data interface{}) (interface{}, error) {
+		return h.toStringMap(data)
+	}
+	return handoff, nil
+}
+
+// Send queues the message for the subscriber, whatever its topic. Once
+// the subscriber has unsubscribed, or been replaced with Resubscribe, Send
+// returns a NotFound error, so the sender can find out from the hub where
+// the stream should go next.
+func (d *Handoff) Send(topic Topic, data interface{}) (Completer, error) {
+	select {
+	case <-d.sub.done:
+		return nil, errors.NotFoundf("subscriber %q", d.sub.name)
+	default:
+	}
+	if d.convert != nil {
+		converted, err := d.convert(data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		data = converted
+	}
+	wait := &sync.WaitGroup{}
+	wait.Add(1)
+	done := make(chan struct{})
+	handle := &doneHandle{done: done}
+	d.sub.notify(&handlerCallback{
+		topic:    topic,
+		data:     data,
+		sequence: atomic.AddUint64(&d.hub.sequence, 1),
+		wg:       wait,
+		queued:   time.Now(),
+		handle:   handle,
+		direct:   true,
+	})
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+	return handle, nil
+}
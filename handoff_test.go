@@ -0,0 +1,104 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type HandoffSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&HandoffSuite{})
+
+func (*HandoffSuite) TestSimpleHub(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	received := make(chan pubsub.Message, 2)
+	_, err := hub.Subscribe(first, func(topic pubsub.Topic, data interface{}) {
+		received <- pubsub.Message{Topic: topic, Data: data}
+	}, pubsub.Named("stream"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	handoff, err := pubsub.NewHandoff(hub, "stream")
+	c.Assert(err, jc.ErrorIsNil)
+	// The topic isn't matched against the subscriber.
+	done, err := handoff.Send(second, "direct")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	_, err = hub.Publish(first, "published")
+	c.Assert(err, jc.ErrorIsNil)
+
+	for _, expected := range []pubsub.Message{
+		{Topic: second, Data: "direct"},
+		{Topic: first, Data: "published"},
+	} {
+		select {
+		case message := <-received:
+			c.Check(message, jc.DeepEquals, expected)
+		case <-time.After(time.Second):
+			c.Fatal("handler not called")
+		}
+	}
+}
+
+func (*HandoffSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan Emitter, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	}, pubsub.Named("stream"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	handoff, err := pubsub.NewHandoff(hub, "stream")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = handoff.Send(second, Emitter{Origin: "direct", ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data, jc.DeepEquals, Emitter{Origin: "direct", ID: 42})
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+
+	_, err = handoff.Send(second, "not a structure")
+	c.Check(err, gc.NotNil)
+}
+
+func (*HandoffSuite) TestErrors(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := func(pubsub.Topic, interface{}) {}
+	_, err := pubsub.NewHandoff(hub, "")
+	c.Check(err, gc.ErrorMatches, "empty name not valid")
+	_, err = pubsub.NewHandoff(hub, "missing")
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+
+	for i := 0; i < 2; i++ {
+		_, err = hub.Subscribe(topic, handler, pubsub.Named("twice"))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	_, err = pubsub.NewHandoff(hub, "twice")
+	c.Check(err, gc.ErrorMatches, `handoff to "twice" with more than one subscriber not valid`)
+}
+
+func (*HandoffSuite) TestUnsubscribed(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {}, pubsub.Named("stream"))
+	c.Assert(err, jc.ErrorIsNil)
+	handoff, err := pubsub.NewHandoff(hub, "stream")
+	c.Assert(err, jc.ErrorIsNil)
+
+	sub.Unsubscribe()
+	_, err = handoff.Send(topic, nil)
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+	c.Check(err, gc.ErrorMatches, `subscriber "stream" not found`)
+}
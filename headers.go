@@ -0,0 +1,42 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+)
+
+// Headers hold metadata about a message, such as its content type,
+// encoding or trace ID, that is carried alongside the published data rather
+// than in it.
+type Headers map[string]string
+
+type headersKey struct{}
+
+// WithHeaders returns a context that, when passed to PublishCtx, attaches
+// the headers to the published message. The headers are copied, so the map
+// can be reused after publishing. Handlers get the headers from their
+// context with HeadersFromContext, and they are included in the Delivery
+// of the message.
+func WithHeaders(ctx context.Context, headers Headers) context.Context {
+	copied := make(Headers, len(headers))
+	for key, value := range headers {
+		copied[key] = value
+	}
+	return context.WithValue(ctx, headersKey{}, copied)
+}
+
+func headersFromPublishContext(ctx context.Context) Headers {
+	headers, _ := ctx.Value(headersKey{}).(Headers)
+	return headers
+}
+
+// HeadersFromContext returns the headers of the message being handled, or
+// nil if the message has none or the context was not passed to a handler by
+// a hub. The headers are shared by all the subscribers of the message, so
+// they must not be modified.
+func HeadersFromContext(ctx context.Context) Headers {
+	delivery, _ := DeliveryFromContext(ctx)
+	return delivery.Headers
+}
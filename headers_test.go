@@ -0,0 +1,120 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type HeadersSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&HeadersSuite{})
+
+func (*HeadersSuite) TestSimpleHub(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	received := make(chan pubsub.Headers, 2)
+	_, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		received <- pubsub.HeadersFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	headers := pubsub.Headers{"content-type": "text/plain", "trace-id": "abc"}
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(pubsub.WithHeaders(context.Background(), headers), topic, "data")
+	c.Assert(err, jc.ErrorIsNil)
+	// The headers are copied when publishing.
+	headers["trace-id"] = "changed"
+	_, err = hub.Publish(topic, "data")
+	c.Assert(err, jc.ErrorIsNil)
+
+	for _, expected := range []pubsub.Headers{{"content-type": "text/plain", "trace-id": "abc"}, nil} {
+		select {
+		case headers := <-received:
+			c.Check(headers, jc.DeepEquals, expected)
+		case <-time.After(time.Second):
+			c.Fatal("handler not called")
+		}
+	}
+}
+
+func (*HeadersSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	type result struct {
+		data    Emitter
+		headers pubsub.Headers
+	}
+	received := make(chan result, 1)
+	_, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- result{data, pubsub.HeadersFromContext(ctx)}
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{"encoding": "gzip"})
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, Emitter{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case r := <-received:
+		// The headers don't appear in the payload.
+		c.Check(r.data, jc.DeepEquals, Emitter{Origin: "test"})
+		c.Check(r.headers, jc.DeepEquals, pubsub.Headers{"encoding": "gzip"})
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (*HeadersSuite) TestRetained(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 1})
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{"trace-id": "abc"})
+	_, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, "data")
+	c.Assert(err, jc.ErrorIsNil)
+	_, fetched, err := hub.(pubsub.FetchingSubscriber).SubscribeAndFetch(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(fetched, gc.HasLen, 1)
+	c.Assert(fetched[0].Delivery.Headers, jc.DeepEquals, pubsub.Headers{"trace-id": "abc"})
+}
+
+func (*HeadersSuite) TestBridge(c *gc.C) {
+	source := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: "source"})
+	target := pubsub.NewSimpleHub()
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Source: source,
+		Target: target,
+		Rules:  []pubsub.BridgeRule{{Name: "all", Matcher: pubsub.MatchAll}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+	received := make(chan pubsub.Headers, 1)
+	_, err = target.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		received <- pubsub.HeadersFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{"trace-id": "abc"})
+	_, err = source.(pubsub.ContextPublisher).PublishCtx(ctx, topic, "data")
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case headers := <-received:
+		c.Check(withoutPublishedAt(c, headers), jc.DeepEquals, pubsub.Headers{
+			"trace-id":                 "abc",
+			pubsub.PeerOriginHeader:    "source",
+			pubsub.PeerTransportHeader: "bridge",
+			pubsub.PeerHopsHeader:      "1",
+		})
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (*HeadersSuite) TestNotInHandlerContext(c *gc.C) {
+	c.Assert(pubsub.HeadersFromContext(context.Background()), gc.IsNil)
+}
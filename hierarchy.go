@@ -0,0 +1,191 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+)
+
+// Headers set on the messages forwarded between the hubs of a hierarchy.
+// HierarchyDirectionHeader is "up" for messages bubbled up from a child,
+// and "down" for messages scoped down from a parent. HierarchyChildHeader
+// is the name of the child the message was last forwarded from or to.
+const (
+	HierarchyDirectionHeader = "pubsub-hierarchy-direction"
+	HierarchyChildHeader     = "pubsub-hierarchy-child"
+)
+
+const (
+	directionUp   = "up"
+	directionDown = "down"
+)
+
+// ChildConfig is the argument struct for AttachChild.
+type ChildConfig struct {
+	// Name identifies the child among the children of the parent.
+	Name string
+
+	// Parent and Child are the hubs that are linked. Both must implement
+	// ContextPublisher, and the hub that messages are forwarded from must
+	// implement ChanSubscriber.
+	Parent Hub
+	Child  Hub
+
+	// Up matches the topics of the messages published on the child that
+	// bubble up to the parent. If it is not set, no messages bubble up.
+	Up TopicMatcher
+
+	// UpFilter, if set, is called for each message that Up matches, and
+	// only the messages it returns true for bubble up.
+	UpFilter func(Message) bool
+
+	// Down matches the topics of the messages published on the parent
+	// that are scoped down to the child. If it is not set, no messages
+	// are scoped down.
+	Down TopicMatcher
+
+	// DownFilter, if set, is called for each message that Down matches,
+	// and only the messages it returns true for are scoped down.
+	DownFilter func(Message) bool
+
+	// MaxHops is the number of times a message may have been forwarded
+	// between hubs for it to be forwarded again. It defaults to
+	// DefaultMaxHops.
+	MaxHops int
+}
+
+// Validate checks that the config values are valid.
+func (config ChildConfig) Validate() error {
+	if config.Name == "" {
+		return errors.NotValidf("missing Name")
+	}
+	if config.Parent == nil {
+		return errors.NotValidf("missing Parent")
+	}
+	if config.Child == nil {
+		return errors.NotValidf("missing Child")
+	}
+	if _, ok := config.Parent.(ContextPublisher); !ok {
+		return errors.NotValidf("Parent %T without PublishCtx", config.Parent)
+	}
+	if _, ok := config.Child.(ContextPublisher); !ok {
+		return errors.NotValidf("Child %T without PublishCtx", config.Child)
+	}
+	if config.Up != nil {
+		if _, ok := config.Child.(ChanSubscriber); !ok {
+			return errors.NotValidf("Child %T without SubscribeChan", config.Child)
+		}
+	}
+	if config.Down != nil {
+		if _, ok := config.Parent.(ChanSubscriber); !ok {
+			return errors.NotValidf("Parent %T without SubscribeChan", config.Parent)
+		}
+	}
+	if config.MaxHops < 0 {
+		return errors.NotValidf("negative MaxHops")
+	}
+	return nil
+}
+
+type childLink struct {
+	config ChildConfig
+	logger loggo.Logger
+
+	closers []func()
+	wg      sync.WaitGroup
+}
+
+// AttachChild links a child hub to its parent, so hierarchies such as
+// machine, unit and worker hubs can be built without setting up bridges in
+// each direction by hand. Messages published on the child that the Up
+// matcher matches are published on the parent, and messages published on
+// the parent that the Down matcher matches are published on the child,
+// keeping their ordering keys and headers.
+//
+// The forwarded messages are marked with the HierarchyDirectionHeader and
+// HierarchyChildHeader, so messages never travel back the way they came,
+// and with the peer headers, with "hierarchy" as the transport.
+// A message bubbled up from a child continues to bubble up through the
+// parent's own parent, and may be scoped down to the other children of the
+// parent, but is never scoped down to the child it came from. A message
+// scoped down to a child never bubbles up again.
+//
+// Unsubscribe the result to detach the child.
+func AttachChild(config ChildConfig) (Unsubscriber, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	link := &childLink{
+		config: config,
+		logger: loggo.GetLogger("pubsub.hierarchy"),
+	}
+	if config.Up != nil {
+		messages, closer, err := SubscribeChan(config.Child, config.Up, 0)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		link.start(messages, closer, directionUp)
+	}
+	if config.Down != nil {
+		messages, closer, err := SubscribeChan(config.Parent, config.Down, 0)
+		if err != nil {
+			link.Unsubscribe()
+			return nil, errors.Trace(err)
+		}
+		link.start(messages, closer, directionDown)
+	}
+	return link, nil
+}
+
+func (l *childLink) start(messages <-chan Message, closer func(), direction string) {
+	l.closers = append(l.closers, closer)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		for message := range messages {
+			l.forward(message, direction)
+		}
+	}()
+}
+
+func (l *childLink) forward(message Message, direction string) {
+	headers := message.Delivery.Headers
+	source, target, filter := l.config.Child, l.config.Parent, l.config.UpFilter
+	if direction == directionUp {
+		if headers[HierarchyDirectionHeader] == directionDown {
+			return
+		}
+	} else {
+		source, target, filter = l.config.Parent, l.config.Child, l.config.DownFilter
+		if headers[HierarchyDirectionHeader] == directionUp && headers[HierarchyChildHeader] == l.config.Name {
+			return
+		}
+	}
+	if filter != nil && !filter(message) {
+		return
+	}
+	forwarded, err := forwardedHeaders(source, headers, "hierarchy", l.config.MaxHops)
+	if err != nil {
+		l.logger.Warningf("child %q forwarding %q %s: %v", l.config.Name, message.Topic, direction, err)
+		return
+	}
+	forwarded[HierarchyDirectionHeader] = direction
+	forwarded[HierarchyChildHeader] = l.config.Name
+	ctx := WithHeaders(WithOrderingKey(context.Background(), message.Delivery.OrderingKey), forwarded)
+	if _, err := PublishCtx(ctx, target, message.Topic, message.Data); err != nil {
+		l.logger.Errorf("child %q forwarding %q %s: %v", l.config.Name, message.Topic, direction, err)
+	}
+}
+
+// Unsubscribe implements Unsubscriber.
+func (l *childLink) Unsubscribe() {
+	for _, closer := range l.closers {
+		closer()
+	}
+	l.wg.Wait()
+}
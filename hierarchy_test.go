@@ -0,0 +1,216 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type HierarchySuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&HierarchySuite{})
+
+func (*HierarchySuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	for i, test := range []struct {
+		config pubsub.ChildConfig
+		err    string
+	}{{
+		config: pubsub.ChildConfig{Parent: hub, Child: hub},
+		err:    "missing Name not valid",
+	}, {
+		config: pubsub.ChildConfig{Name: "child", Child: hub},
+		err:    "missing Parent not valid",
+	}, {
+		config: pubsub.ChildConfig{Name: "child", Parent: hub},
+		err:    "missing Child not valid",
+	}, {
+		config: pubsub.ChildConfig{Name: "child", Parent: hub, Child: hub, MaxHops: -1},
+		err:    "negative MaxHops not valid",
+	}} {
+		c.Logf("test %d", i)
+		c.Check(test.config.Validate(), gc.ErrorMatches, test.err)
+		_, err := pubsub.AttachChild(test.config)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func attachChild(c *gc.C, name string, parent, child pubsub.Hub, up, down pubsub.TopicMatcher) pubsub.Unsubscriber {
+	link, err := pubsub.AttachChild(pubsub.ChildConfig{
+		Name:   name,
+		Parent: parent,
+		Child:  child,
+		Up:     up,
+		Down:   down,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return link
+}
+
+func subscribeAll(c *gc.C, hub pubsub.Hub) (<-chan pubsub.Message, func()) {
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	return messages, closer
+}
+
+func expectMessage(c *gc.C, messages <-chan pubsub.Message, topic pubsub.Topic) pubsub.Message {
+	select {
+	case message := <-messages:
+		c.Assert(message.Topic, gc.Equals, topic)
+		return message
+	case <-time.After(time.Second):
+		c.Fatalf("message on %q not received", topic)
+	}
+	panic("unreachable")
+}
+
+func expectNoMessage(c *gc.C, messages <-chan pubsub.Message) {
+	select {
+	case message := <-messages:
+		c.Fatalf("unexpected message %#v", message)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func (*HierarchySuite) TestBubbleUp(c *gc.C) {
+	machine := pubsub.NewSimpleHub()
+	unit := pubsub.NewSimpleHub()
+	worker := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: "worker-hub"})
+	defer attachChild(c, "unit", machine, unit, pubsub.MatchRegex("^status"), nil).Unsubscribe()
+	defer attachChild(c, "worker", unit, worker, pubsub.MatchAll, nil).Unsubscribe()
+	machineMessages, closer := subscribeAll(c, machine)
+	defer closer()
+	unitMessages, closer := subscribeAll(c, unit)
+	defer closer()
+
+	ctx := pubsub.WithHeaders(pubsub.WithOrderingKey(context.Background(), "key"), pubsub.Headers{"origin": "worker"})
+	_, err := worker.(pubsub.ContextPublisher).PublishCtx(ctx, "status.changed", "idle")
+	c.Assert(err, jc.ErrorIsNil)
+	message := expectMessage(c, unitMessages, "status.changed")
+	c.Check(withoutPublishedAt(c, message.Delivery.Headers), jc.DeepEquals, pubsub.Headers{
+		"origin":                        "worker",
+		pubsub.HierarchyDirectionHeader: "up",
+		pubsub.HierarchyChildHeader:     "worker",
+		pubsub.PeerOriginHeader:         "worker-hub",
+		pubsub.PeerTransportHeader:      "hierarchy",
+		pubsub.PeerHopsHeader:           "1",
+	})
+	message = expectMessage(c, machineMessages, "status.changed")
+	c.Check(message.Data, gc.Equals, "idle")
+	c.Check(message.Delivery.OrderingKey, gc.Equals, "key")
+	c.Check(message.Delivery.Headers[pubsub.HierarchyChildHeader], gc.Equals, "unit")
+	c.Check(message.Delivery.Headers[pubsub.PeerOriginHeader], gc.Equals, "worker-hub")
+	c.Check(message.Delivery.Headers[pubsub.PeerHopsHeader], gc.Equals, "2")
+
+	// Only the status messages bubble up from the unit.
+	_, err = worker.Publish("log", "hello")
+	c.Assert(err, jc.ErrorIsNil)
+	expectMessage(c, unitMessages, "log")
+	expectNoMessage(c, machineMessages)
+}
+
+func (*HierarchySuite) TestScopeDown(c *gc.C) {
+	machine := pubsub.NewSimpleHub()
+	first := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: "first-hub"})
+	second := pubsub.NewSimpleHub()
+	defer attachChild(c, "first", machine, first, pubsub.MatchAll, pubsub.MatchAll).Unsubscribe()
+	defer attachChild(c, "second", machine, second, pubsub.MatchAll, pubsub.MatchAll).Unsubscribe()
+	machineMessages, closer := subscribeAll(c, machine)
+	defer closer()
+	firstMessages, closer := subscribeAll(c, first)
+	defer closer()
+	secondMessages, closer := subscribeAll(c, second)
+	defer closer()
+
+	_, err := machine.Publish("config", "changed")
+	c.Assert(err, jc.ErrorIsNil)
+	expectMessage(c, machineMessages, "config")
+	expectMessage(c, firstMessages, "config")
+	expectMessage(c, secondMessages, "config")
+
+	// A message from one child reaches its sibling, but doesn't come
+	// back to it, and the scoped down copy doesn't bubble up again.
+	_, err = first.Publish("event", "fired")
+	c.Assert(err, jc.ErrorIsNil)
+	expectMessage(c, firstMessages, "event")
+	expectMessage(c, machineMessages, "event")
+	message := expectMessage(c, secondMessages, "event")
+	c.Check(withoutPublishedAt(c, message.Delivery.Headers), jc.DeepEquals, pubsub.Headers{
+		pubsub.HierarchyDirectionHeader: "down",
+		pubsub.HierarchyChildHeader:     "second",
+		pubsub.PeerOriginHeader:         "first-hub",
+		pubsub.PeerTransportHeader:      "hierarchy",
+		pubsub.PeerHopsHeader:           "2",
+	})
+	expectNoMessage(c, firstMessages)
+	expectNoMessage(c, machineMessages)
+	expectNoMessage(c, secondMessages)
+}
+
+func (*HierarchySuite) TestFilters(c *gc.C) {
+	parent := pubsub.NewSimpleHub()
+	child := pubsub.NewSimpleHub()
+	link, err := pubsub.AttachChild(pubsub.ChildConfig{
+		Name:   "child",
+		Parent: parent,
+		Child:  child,
+		Up:     pubsub.MatchAll,
+		UpFilter: func(message pubsub.Message) bool {
+			return message.Data != "private"
+		},
+		Down: pubsub.MatchAll,
+		DownFilter: func(message pubsub.Message) bool {
+			return message.Data == "for-child"
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer link.Unsubscribe()
+	parentMessages, closer := subscribeAll(c, parent)
+	defer closer()
+	childMessages, closer := subscribeAll(c, child)
+	defer closer()
+
+	for _, data := range []string{"private", "public"} {
+		_, err := child.Publish("up", data)
+		c.Assert(err, jc.ErrorIsNil)
+		expectMessage(c, childMessages, "up")
+	}
+	c.Check(expectMessage(c, parentMessages, "up").Data, gc.Equals, "public")
+	for _, data := range []string{"for-parent", "for-child"} {
+		_, err := parent.Publish("down", data)
+		c.Assert(err, jc.ErrorIsNil)
+		expectMessage(c, parentMessages, "down")
+	}
+	c.Check(expectMessage(c, childMessages, "down").Data, gc.Equals, "for-child")
+	expectNoMessage(c, childMessages)
+}
+
+func (*HierarchySuite) TestDetach(c *gc.C) {
+	parent := pubsub.NewSimpleHub()
+	child := pubsub.NewSimpleHub()
+	link, err := pubsub.AttachChild(pubsub.ChildConfig{
+		Name:   "child",
+		Parent: parent,
+		Child:  child,
+		Up:     pubsub.MatchAll,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	parentMessages, closer := subscribeAll(c, parent)
+	defer closer()
+	link.Unsubscribe()
+
+	_, err = child.Publish("up", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	expectNoMessage(c, parentMessages)
+	c.Check(child.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// Phase describes where in the life of a message an error occurred.
+type Phase string
+
+const (
+	// PhasePublish errors occur when the published data is rejected, such
+	// as when it does not match the payload type registered for the topic.
+	PhasePublish Phase = "publish"
+
+	// PhaseSerialize errors occur when a structured hub converts the
+	// published data into its map form.
+	PhaseSerialize Phase = "serialize"
+
+	// PhaseDispatch errors occur when the hub is unable to call a handler
+	// with the data it was given.
+	PhaseDispatch Phase = "dispatch"
+
+	// PhaseDecode errors occur when a structured hub converts the map form
+	// of the data into the type that a handler wants.
+	PhaseDecode Phase = "decode"
+
+	// PhaseHandler errors are the errors returned by handlers.
+	PhaseHandler Phase = "handler"
+)
+
+// NoSubscriber is the Subscriber value of a HubError that is not specific
+// to a subscriber.
+const NoSubscriber = -1
+
+// HubError describes an error that occurred inside a hub. HubErrors are
+// passed to the ErrorHandler of the hub config. The errors themselves are
+// still returned from Publish or passed to the handler as they always were.
+type HubError struct {
+	Phase Phase
+	Topic Topic
+
+	// Subscriber is the ID of the subscriber that the error occurred for,
+	// as shown in the hub Report, or NoSubscriber for errors that occur
+	// while publishing. SubscriberName is the name given to the
+	// subscription with the Named option, if any.
+	Subscriber     int
+	SubscriberName string
+
+	Err error
+}
+
+// Error implements error.
+func (e *HubError) Error() string {
+	switch {
+	case e.Subscriber == NoSubscriber:
+		return fmt.Sprintf("%s %q: %v", e.Phase, e.Topic, e.Err)
+	case e.SubscriberName != "":
+		return fmt.Sprintf("%s %q for subscriber %d (%s): %v", e.Phase, e.Topic, e.Subscriber, e.SubscriberName, e.Err)
+	}
+	return fmt.Sprintf("%s %q for subscriber %d: %v", e.Phase, e.Topic, e.Subscriber, e.Err)
+}
+
+// Cause returns the underlying error, so errors.Cause works through the
+// HubError.
+func (e *HubError) Cause() error {
+	return errors.Cause(e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *HubError) Unwrap() error {
+	return e.Err
+}
+
+// reportError passes the error to the error handler, or logs it if there
+// isn't one.
+func (h *simplehub) reportError(err *HubError) {
+	if h.errorHandler != nil {
+		h.errorHandler(err)
+		return
+	}
+	h.logger.Debugf("%v", err)
+}
+
+// publishError reports an error that is about to be returned from
+// Publish, and returns it.
+func (h *simplehub) publishError(phase Phase, topic Topic, err error) error {
+	h.reportError(&HubError{
+		Phase:      phase,
+		Topic:      topic,
+		Subscriber: NoSubscriber,
+		Err:        err,
+	})
+	return err
+}
+
+type subscriberErrorsKey struct{}
+
+// subscriberErrors is added to the context passed to the handlers so the
+// structured hub can report decode errors for the subscriber.
+type subscriberErrors struct {
+	id     int
+	name   string
+	report func(*HubError)
+}
+
+func withSubscriberErrors(ctx context.Context, s *subscriber) context.Context {
+	if s.reportError == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, subscriberErrorsKey{}, subscriberErrors{
+		id:     s.id,
+		name:   s.name,
+		report: s.reportError,
+	})
+}
+
+// reportSubscriberError reports the error with the subscriber details
+// from the context, if the context came from a hub.
+func reportSubscriberError(ctx context.Context, phase Phase, topic Topic, err error) {
+	s, ok := ctx.Value(subscriberErrorsKey{}).(subscriberErrors)
+	if !ok {
+		return
+	}
+	s.report(&HubError{
+		Phase:          phase,
+		Topic:          topic,
+		Subscriber:     s.id,
+		SubscriberName: s.name,
+		Err:            err,
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type HubErrorSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&HubErrorSuite{})
+
+// errorCollector records the errors passed to an ErrorHandler.
+type errorCollector struct {
+	mutex  sync.Mutex
+	errors []*pubsub.HubError
+}
+
+func (e *errorCollector) handle(err *pubsub.HubError) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.errors = append(e.errors, err)
+}
+
+func (e *errorCollector) get() []*pubsub.HubError {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*pubsub.HubError(nil), e.errors...)
+}
+
+func (*HubErrorSuite) TestError(c *gc.C) {
+	err := &pubsub.HubError{
+		Phase:      pubsub.PhaseDecode,
+		Topic:      topic,
+		Subscriber: 3,
+		Err:        errors.NotValidf("thing"),
+	}
+	c.Check(err, gc.ErrorMatches, `decode "testing" for subscriber 3: thing not valid`)
+	c.Check(errors.IsNotValid(err), jc.IsTrue)
+	err.SubscriberName = "fred"
+	c.Check(err, gc.ErrorMatches, `decode "testing" for subscriber 3 \(fred\): thing not valid`)
+	err.Phase = pubsub.PhasePublish
+	err.Subscriber = pubsub.NoSubscriber
+	c.Check(err, gc.ErrorMatches, `publish "testing": thing not valid`)
+}
+
+func (*HubErrorSuite) TestSerializeError(c *gc.C) {
+	var collector errorCollector
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			ErrorHandler: collector.handle,
+		},
+		PostProcess: func(map[string]interface{}) (map[string]interface{}, error) {
+			return nil, errors.New("boom")
+		},
+	})
+	_, err := hub.Publish(topic, map[string]interface{}{})
+	c.Assert(err, gc.ErrorMatches, "boom")
+
+	reported := collector.get()
+	c.Assert(reported, gc.HasLen, 1)
+	c.Check(reported[0].Phase, gc.Equals, pubsub.PhaseSerialize)
+	c.Check(reported[0].Topic, gc.Equals, topic)
+	c.Check(reported[0].Subscriber, gc.Equals, pubsub.NoSubscriber)
+	c.Check(reported[0].Err, gc.Equals, err)
+}
+
+func (*HubErrorSuite) TestPublishError(c *gc.C) {
+	var collector errorCollector
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			ErrorHandler: collector.handle,
+		},
+	})
+	err := hub.RegisterTopic(topic, BadID{})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, Emitter{ID: 42})
+	c.Assert(pubsub.IsPayloadTypeError(err), jc.IsTrue)
+
+	reported := collector.get()
+	c.Assert(reported, gc.HasLen, 1)
+	c.Check(reported[0].Phase, gc.Equals, pubsub.PhasePublish)
+	c.Check(pubsub.IsPayloadTypeError(reported[0]), jc.IsTrue)
+}
+
+func (*HubErrorSuite) TestDecodeError(c *gc.C) {
+	var collector errorCollector
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			ErrorHandler: collector.handle,
+		},
+	})
+	var handlerErr error
+	_, err := hub.Subscribe(pubsub.MatchAll, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, func(topic pubsub.Topic, data BadID, err error) {
+		handlerErr = err
+	}, pubsub.Named("bad-id"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	result, err := hub.Publish(topic, Emitter{ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+
+	// The handler still gets the error, and the error handler gets it too.
+	c.Assert(handlerErr, gc.NotNil)
+	reported := collector.get()
+	c.Assert(reported, gc.HasLen, 1)
+	c.Check(reported[0].Phase, gc.Equals, pubsub.PhaseDecode)
+	c.Check(reported[0].Topic, gc.Equals, topic)
+	c.Check(reported[0].Subscriber, gc.Equals, 1)
+	c.Check(reported[0].SubscriberName, gc.Equals, "bad-id")
+	c.Check(reported[0].Err, gc.Equals, handlerErr)
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"math"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// DefaultLedgerSize is the number of message IDs a ledger remembers for
+// each subscriber if it isn't given a size.
+const DefaultLedgerSize = 10000
+
+// Ledger records the IDs of the messages that each named subscriber has
+// processed, so a subscriber that can't be idempotent isn't given the same
+// message twice when it is replayed, backfilled, or forwarded over more
+// than one path. See Idempotent.
+type Ledger interface {
+	// Seen returns true if the message with the ID has been recorded for
+	// the named subscriber.
+	Seen(subscriber, id string) (bool, error)
+
+	// Record records that the named subscriber has processed the message
+	// with the ID.
+	Record(subscriber, id string) error
+}
+
+// Idempotent has the subscription skip the messages whose MessageIDHeader
+// is already recorded in the ledger for it, and record the ID of each
+// message once the handler has returned without an error. Messages
+// without an ID are always handled. The subscription must be given a
+// name with Named, as the IDs are recorded by name, so a subscriber
+// restarted with the same name and a persistent ledger doesn't process
+// the messages again. The skipped messages are counted as duplicates in
+// the hub Report, and as dropped.
+//
+// The hubs only give messages an ID if they are configured to publish
+// DeliveryReceipts, or if the publisher sets one with WithHeaders.
+func Idempotent(ledger Ledger) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.ledger = ledger
+	}
+}
+
+// NewMemoryLedger returns a Ledger that remembers the last size message
+// IDs recorded for each subscriber in memory. A size of less than one
+// means DefaultLedgerSize.
+func NewMemoryLedger(size int) Ledger {
+	return newLedger(nil, size)
+}
+
+// NewStoreLedger returns a Ledger that remembers the last size message IDs
+// recorded for each subscriber in the store, so they survive restarts if
+// the store is persistent. The IDs of each subscriber are kept in the
+// stream "idempotency." followed by the name of the subscriber, and are
+// read from the store the first time the subscriber is checked. A size of
+// less than one means DefaultLedgerSize.
+func NewStoreLedger(store Store, size int) Ledger {
+	return newLedger(store, size)
+}
+
+// ledgerStreamPrefix is the prefix of the Store streams of a ledger.
+const ledgerStreamPrefix = "idempotency."
+
+type ledger struct {
+	store Store
+	size  int
+
+	mutex       sync.Mutex
+	subscribers map[string]*ledgerIDs
+}
+
+// ledgerIDs are the IDs recorded for a subscriber, with the sequence of
+// the record of each.
+type ledgerIDs struct {
+	ids   map[string]uint64
+	order []string
+	next  uint64
+}
+
+func newLedger(store Store, size int) *ledger {
+	if size < 1 {
+		size = DefaultLedgerSize
+	}
+	return &ledger{
+		store:       store,
+		size:        size,
+		subscribers: make(map[string]*ledgerIDs),
+	}
+}
+
+// idsFor returns the IDs recorded for the subscriber, loading them from
+// the store the first time. The mutex must be held.
+func (l *ledger) idsFor(subscriber string) (*ledgerIDs, error) {
+	if ids, ok := l.subscribers[subscriber]; ok {
+		return ids, nil
+	}
+	ids := &ledgerIDs{ids: make(map[string]uint64), next: 1}
+	if l.store != nil {
+		records, err := l.store.GetRange(ledgerStreamPrefix+subscriber, 0, math.MaxUint64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "loading ledger of %q", subscriber)
+		}
+		for _, record := range records {
+			ids.add(string(record.Data), record.Sequence)
+		}
+		if len(records) > 0 {
+			ids.next = records[len(records)-1].Sequence + 1
+		}
+		for len(ids.order) > l.size {
+			delete(ids.ids, ids.order[0])
+			ids.order = ids.order[1:]
+		}
+	}
+	l.subscribers[subscriber] = ids
+	return ids, nil
+}
+
+func (ids *ledgerIDs) add(id string, sequence uint64) {
+	ids.ids[id] = sequence
+	ids.order = append(ids.order, id)
+}
+
+// Seen implements Ledger.
+func (l *ledger) Seen(subscriber, id string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ids, err := l.idsFor(subscriber)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	_, seen := ids.ids[id]
+	return seen, nil
+}
+
+// Record implements Ledger.
+func (l *ledger) Record(subscriber, id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ids, err := l.idsFor(subscriber)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, seen := ids.ids[id]; seen {
+		return nil
+	}
+	stream := ledgerStreamPrefix + subscriber
+	sequence := ids.next
+	if l.store != nil {
+		if err := l.store.Put(stream, Record{Sequence: sequence, Data: []byte(id)}); err != nil {
+			return errors.Annotatef(err, "recording %q for %q", id, subscriber)
+		}
+	}
+	ids.next++
+	ids.add(id, sequence)
+	if len(ids.order) <= l.size {
+		return nil
+	}
+	delete(ids.ids, ids.order[0])
+	ids.order = ids.order[1:]
+	if l.store != nil {
+		if err := l.store.Trim(stream, ids.ids[ids.order[0]]); err != nil {
+			return errors.Annotatef(err, "trimming ledger of %q", subscriber)
+		}
+	}
+	return nil
+}
+
+// duplicate returns true if the call has a message ID that the ledger of
+// the subscriber has already recorded. Errors checking the ledger are
+// reported, and the message is handled.
+func (s *subscriber) duplicate(call *handlerCallback) bool {
+	id := call.headers[MessageIDHeader]
+	if s.ledger == nil || id == "" {
+		return false
+	}
+	seen, err := s.ledger.Seen(s.name, id)
+	if err != nil {
+		s.reportLedgerError(call, err)
+		return false
+	}
+	if seen {
+		s.mutex.Lock()
+		s.duplicates++
+		s.mutex.Unlock()
+	}
+	return seen
+}
+
+// recordProcessed records the message ID of the call in the ledger of the
+// subscriber.
+func (s *subscriber) recordProcessed(call *handlerCallback) {
+	id := call.headers[MessageIDHeader]
+	if s.ledger == nil || id == "" {
+		return
+	}
+	if err := s.ledger.Record(s.name, id); err != nil {
+		s.reportLedgerError(call, err)
+	}
+}
+
+func (s *subscriber) reportLedgerError(call *handlerCallback, err error) {
+	s.reportError(&HubError{
+		Phase:          PhaseDispatch,
+		Topic:          call.topic,
+		Subscriber:     s.id,
+		SubscriberName: s.name,
+		Err:            err,
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type IdempotencySuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&IdempotencySuite{})
+
+// publishWithIDs publishes a message with each of the IDs, and waits for
+// them all to be handled. Empty IDs are published without one.
+func publishWithIDs(c *gc.C, hub pubsub.Hub, ids ...string) {
+	for _, id := range ids {
+		ctx := context.Background()
+		if id != "" {
+			ctx = pubsub.WithHeaders(ctx, pubsub.Headers{pubsub.MessageIDHeader: id})
+		}
+		done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, id)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+}
+
+func (*IdempotencySuite) TestDuplicatesSkipped(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var mutex sync.Mutex
+	var received []interface{}
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data)
+	}, pubsub.Named("worker"), pubsub.Idempotent(pubsub.NewMemoryLedger(0)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	publishWithIDs(c, hub, "a", "b", "a", "", "", "b")
+	mutex.Lock()
+	c.Check(received, jc.DeepEquals, []interface{}{"a", "b", "", ""})
+	mutex.Unlock()
+	report := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})
+	c.Check(report["duplicates"], gc.Equals, uint64(2))
+}
+
+func (*IdempotencySuite) TestFailuresNotRecorded(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	calls := 0
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) error {
+		calls++
+		if calls == 1 {
+			return errors.New("boom")
+		}
+		return nil
+	}, pubsub.Named("worker"), pubsub.Idempotent(pubsub.NewMemoryLedger(0)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	publishWithIDs(c, hub, "a", "a", "a")
+	c.Check(calls, gc.Equals, 2)
+}
+
+func (*IdempotencySuite) TestSubscribersSeparate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	ledger := pubsub.NewMemoryLedger(0)
+	counts := make([]int, 2)
+	for i, name := range []string{"one", "two"} {
+		i := i
+		_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {
+			counts[i]++
+		}, pubsub.Named(name), pubsub.Idempotent(ledger))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	publishWithIDs(c, hub, "a", "a")
+	c.Check(counts, jc.DeepEquals, []int{1, 1})
+}
+
+func (*IdempotencySuite) TestStoreLedger(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	ledger := pubsub.NewStoreLedger(store, 2)
+	for _, id := range []string{"a", "b", "c"} {
+		c.Assert(ledger.Record("worker", id), jc.ErrorIsNil)
+	}
+	c.Check(storedCount(c, store, "idempotency.worker"), gc.Equals, 2)
+
+	// A new ledger on the same store remembers the last IDs.
+	ledger = pubsub.NewStoreLedger(store, 2)
+	for id, expected := range map[string]bool{"a": false, "b": true, "c": true} {
+		seen, err := ledger.Seen("worker", id)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(seen, gc.Equals, expected, gc.Commentf("id %q", id))
+	}
+	seen, err := ledger.Seen("other", "c")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(seen, jc.IsFalse)
+}
+
+func (*IdempotencySuite) TestNameRequired(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {}, pubsub.Idempotent(pubsub.NewMemoryLedger(0)))
+	c.Check(err, gc.ErrorMatches, "idempotent subscription without a name not valid")
+}
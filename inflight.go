@@ -0,0 +1,118 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"bytes"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// InFlightInfo describes a handler that is running, as returned by
+// InFlight.
+type InFlightInfo struct {
+	Topic          Topic
+	Sequence       uint64
+	Subscriber     int
+	SubscriberName string
+
+	// Started is when the handler was called.
+	Started time.Time
+
+	// Stack is the stack of the goroutine running the handler, sampled
+	// when InFlight was called. It is empty if the goroutine couldn't be
+	// found, which happens if the handler returned in the meantime.
+	Stack string
+}
+
+// InFlight returns the handlers that are running, with the one that has
+// been running longest first. It is meant for finding out in-process why
+// a publish doesn't complete, without a full goroutine dump. The handlers
+// of subscribers that have been unsubscribed are included only while the
+// subscriber is flushing, see UnsubscribeFlush.
+func (h *simplehub) InFlight() []InFlightInfo {
+	h.mutex.Lock()
+	subscribers := append([]*subscriber(nil), h.subscribers...)
+	for _, s := range h.flushing {
+		subscribers = append(subscribers, s)
+	}
+	h.mutex.Unlock()
+
+	var result []InFlightInfo
+	var goroutines []uint64
+	for _, s := range subscribers {
+		s.mutex.Lock()
+		for call, started := range s.running {
+			result = append(result, InFlightInfo{
+				Topic:          call.topic,
+				Sequence:       call.sequence,
+				Subscriber:     s.id,
+				SubscriberName: s.name,
+				Started:        started,
+			})
+			goroutines = append(goroutines, call.goroutine)
+		}
+		s.mutex.Unlock()
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	stacks := goroutineStacks()
+	for i := range result {
+		result[i].Stack = stacks[goroutines[i]]
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Started.Before(result[j].Started)
+	})
+	return result
+}
+
+var goroutinePrefix = []byte("goroutine ")
+
+// goroutineID returns the ID of the calling goroutine, from the header of
+// its stack trace.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	return parseGoroutineID(buf)
+}
+
+// parseGoroutineID returns the ID in a "goroutine 42 [running]:" header,
+// or zero if there isn't one.
+func parseGoroutineID(header []byte) uint64 {
+	if !bytes.HasPrefix(header, goroutinePrefix) {
+		return 0
+	}
+	header = header[len(goroutinePrefix):]
+	if end := bytes.IndexByte(header, ' '); end >= 0 {
+		header = header[:end]
+	}
+	id, err := strconv.ParseUint(string(header), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// goroutineStacks returns the stacks of all the goroutines by their ID.
+func goroutineStacks() map[uint64]string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := make(map[uint64]string)
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if id := parseGoroutineID(stack); id != 0 {
+			stacks[id] = string(stack)
+		}
+	}
+	return stacks
+}
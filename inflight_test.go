@@ -0,0 +1,63 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type InFlightSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&InFlightSuite{})
+
+func (*InFlightSuite) TestIdle(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(hub.(pubsub.InFlightReporter).InFlight(), gc.HasLen, 0)
+}
+
+func (*InFlightSuite) TestRunningHandlers(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	stuck := newBlockingHandler()
+	_, err := hub.Subscribe(first, stuck.handle, pubsub.Named("stuck"))
+	c.Assert(err, jc.ErrorIsNil)
+	parallel := newBlockingHandler()
+	_, err = hub.Subscribe(second, parallel.handle, pubsub.Parallel(2))
+	c.Assert(err, jc.ErrorIsNil)
+
+	before := time.Now()
+	done, err := hub.Publish(first, "first")
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, stuck)
+	ctx := pubsub.WithOrderingKey(context.Background(), "key")
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(ctx, second, "second")
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, parallel)
+
+	running := hub.(pubsub.InFlightReporter).InFlight()
+	c.Assert(running, gc.HasLen, 2)
+	c.Check(running[0].Topic, gc.Equals, first)
+	c.Check(running[0].Sequence, gc.Equals, uint64(1))
+	c.Check(running[0].SubscriberName, gc.Equals, "stuck")
+	c.Check(running[0].Started.Before(before), jc.IsFalse)
+	c.Check(running[1].Topic, gc.Equals, second)
+	c.Check(running[1].Subscriber, gc.Equals, 1)
+	for _, info := range running {
+		c.Check(info.Stack, gc.Matches, `(?s)goroutine \d+ .*blockingHandler\).handle.*`)
+	}
+
+	close(stuck.release)
+	close(parallel.release)
+	waitComplete(c, done)
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"github.com/juju/errors"
+)
+
+// Interceptor is called for each message published on a structured hub
+// whose topic matches the matcher the interceptor was added with. It is
+// called after the data has been converted to its map form and annotated,
+// and before the message is passed to any subscribers. It returns the
+// topic and data to publish in place of those passed in, which allows a
+// message to be rewritten, or moved from an old topic name to a new one.
+// If the bool result is false the message is dropped, and Publish returns
+// a Completer that is already complete.
+//
+// The data map belongs to the message being published, so the interceptor
+// may modify it and return it. Interceptors are called in the order they
+// were added, each seeing the results of those before it, and are matched
+// against the topic as rewritten by the earlier interceptors. They are
+// called on the publishing goroutine, so they should be quick.
+type Interceptor func(topic Topic, data map[string]interface{}) (Topic, map[string]interface{}, bool)
+
+type interceptor struct {
+	id          int
+	matcher     TopicMatcher
+	interceptor Interceptor
+}
+
+// Intercept implements StructuredHub.
+func (h *structuredHub) Intercept(matcher TopicMatcher, handler Interceptor) (Unsubscriber, error) {
+	if matcher == nil {
+		return nil, errors.NotValidf("missing matcher")
+	}
+	if handler == nil {
+		return nil, errors.NotValidf("missing interceptor")
+	}
+	h.interceptMutex.Lock()
+	defer h.interceptMutex.Unlock()
+	i := &interceptor{
+		id:          h.interceptIdx,
+		matcher:     matcher,
+		interceptor: handler,
+	}
+	h.interceptIdx++
+	h.interceptors = append(h.interceptors, i)
+	return &interceptHandle{hub: h, id: i.id}, nil
+}
+
+// intercept passes the message through the interceptors. The bool result
+// is false if the message was dropped.
+func (h *structuredHub) intercept(topic Topic, data map[string]interface{}) (Topic, map[string]interface{}, bool) {
+	h.interceptMutex.Lock()
+	interceptors := h.interceptors
+	h.interceptMutex.Unlock()
+
+	for _, i := range interceptors {
+		if !i.matcher.Match(topic) {
+			continue
+		}
+		var ok bool
+		topic, data, ok = i.interceptor(topic, data)
+		if !ok {
+			return topic, nil, false
+		}
+	}
+	return topic, data, true
+}
+
+func (h *structuredHub) removeInterceptor(id int) {
+	h.interceptMutex.Lock()
+	defer h.interceptMutex.Unlock()
+	for idx, i := range h.interceptors {
+		if i.id == id {
+			// The slice is copied rather than modified in place, as
+			// publishers may be iterating over the old one.
+			interceptors := make([]*interceptor, 0, len(h.interceptors)-1)
+			interceptors = append(interceptors, h.interceptors[:idx]...)
+			h.interceptors = append(interceptors, h.interceptors[idx+1:]...)
+			return
+		}
+	}
+}
+
+type interceptHandle struct {
+	hub *structuredHub
+	id  int
+}
+
+// Unsubscribe implements Unsubscriber, and removes the interceptor.
+func (h *interceptHandle) Unsubscribe() {
+	h.hub.removeInterceptor(h.id)
+}
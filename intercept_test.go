@@ -0,0 +1,111 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type InterceptSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&InterceptSuite{})
+
+func (*InterceptSuite) TestValidation(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Intercept(nil, func(t pubsub.Topic, d map[string]interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+		return t, d, true
+	})
+	c.Check(err, gc.ErrorMatches, "missing matcher not valid")
+	_, err = hub.Intercept(pubsub.MatchAll, nil)
+	c.Check(err, gc.ErrorMatches, "missing interceptor not valid")
+}
+
+// publishAndReceive publishes the data on the topic, and returns the
+// topic and data received by a subscriber to all topics, or false if the
+// subscriber wasn't called.
+func publishAndReceive(c *gc.C, hub pubsub.Hub, topic pubsub.Topic, data interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+	type message struct {
+		topic pubsub.Topic
+		data  map[string]interface{}
+	}
+	received := make(chan message, 1)
+	sub, err := hub.Subscribe(pubsub.MatchAll, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		received <- message{topic, data}
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	result, err := hub.Publish(topic, data)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	select {
+	case m := <-received:
+		return m.topic, m.data, true
+	default:
+		return "", nil, false
+	}
+}
+
+func (*InterceptSuite) TestRewrite(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Intercept(pubsub.Topic("old.name"), func(topic pubsub.Topic, data map[string]interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+		data["migrated"] = true
+		return "new.name", data, true
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	// Interceptors see the rewritten topic of earlier interceptors.
+	_, err = hub.Intercept(pubsub.Topic("new.name"), func(topic pubsub.Topic, data map[string]interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+		data["seen"] = true
+		return topic, data, true
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	topic, data, ok := publishAndReceive(c, hub, "old.name", map[string]interface{}{"value": "x"})
+	c.Assert(ok, jc.IsTrue)
+	c.Check(topic, gc.Equals, pubsub.Topic("new.name"))
+	c.Check(data, jc.DeepEquals, map[string]interface{}{
+		"value":    "x",
+		"migrated": true,
+		"seen":     true,
+	})
+
+	// Topics that don't match are left alone.
+	topic, data, ok = publishAndReceive(c, hub, "other", map[string]interface{}{"value": "y"})
+	c.Assert(ok, jc.IsTrue)
+	c.Check(topic, gc.Equals, pubsub.Topic("other"))
+	c.Check(data, jc.DeepEquals, map[string]interface{}{"value": "y"})
+}
+
+func (*InterceptSuite) TestVeto(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	enabled := false
+	interceptor, err := hub.Intercept(pubsub.MatchAll, func(topic pubsub.Topic, data map[string]interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+		return topic, data, enabled
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, _, ok := publishAndReceive(c, hub, topic, map[string]interface{}{})
+	c.Check(ok, jc.IsFalse)
+
+	enabled = true
+	_, _, ok = publishAndReceive(c, hub, topic, map[string]interface{}{})
+	c.Check(ok, jc.IsTrue)
+
+	enabled = false
+	interceptor.Unsubscribe()
+	_, _, ok = publishAndReceive(c, hub, topic, map[string]interface{}{})
+	c.Check(ok, jc.IsTrue)
+}
@@ -3,6 +3,13 @@
 
 package pubsub
 
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+)
+
 // Topic represents a message that can be subscribed to.
 type Topic string
 
@@ -14,10 +21,31 @@ type TopicMatcher interface {
 
 // Hub represents an in-process delivery mechanism. The hub maintains a
 // list of topic subscribers.
+//
+// The hubs from NewSimpleHub and NewStructuredHub also implement the
+// optional interfaces below, such as Reporter and Explainer. Code that is
+// given a Hub checks for them with a type assertion, so other
+// implementations of Hub only need Publish and Subscribe.
 type Hub interface {
-
 	// Publish will notifiy all the subscribers that are interested by calling
 	// their handler function.
+	//
+	// Publish never waits for handlers, so it is safe to call from inside
+	// a handler function. A message published from within a handler is
+	// queued for each subscriber after all the messages that were already
+	// queued for that subscriber.
+	//
+	// Messages published by one goroutine reach each subscriber in the
+	// order they were published. Publish doesn't block on Subscribe or on
+	// other calls to Publish, so messages published at the same time by
+	// different goroutines may be queued in a different order for each
+	// subscriber. Hubs that retain messages or have failover groups
+	// serialize their calls to Publish, so every subscriber sees their
+	// messages in sequence order.
+	//
+	// The matching subscribers are given each message in their fan-out
+	// order: highest Priority first, and in the order they subscribed for
+	// the same priority. The order is shown in the hub Report.
 	Publish(topic Topic, data interface{}) (Completer, error)
 
 	// Subscribe takes a topic matcher, and a handler function. If the matcher
@@ -25,7 +53,165 @@ type Hub interface {
 	// handler function does not match what the Hub expects an error is
 	// returned. The definition of the handler function depends on the hub
 	// implementation. Please see NewSimpleHub and NewStructuredHub.
-	Subscribe(matcher TopicMatcher, handler interface{}) (Unsubscriber, error)
+	// Options may be passed to configure the subscription.
+	Subscribe(matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, error)
+}
+
+// ContextPublisher is implemented by the hubs that take a context when
+// publishing.
+type ContextPublisher interface {
+	// PublishCtx is the same as Publish, but also takes a context. Values
+	// in the context, such as the ordering key set with WithOrderingKey,
+	// affect how the message is published.
+	PublishCtx(ctx context.Context, topic Topic, data interface{}) (Completer, error)
+}
+
+// LocalPublisher is implemented by the hubs that can wait for one of their
+// own subscriptions to handle a message.
+type LocalPublisher interface {
+	// PublishAndWaitLocal publishes the data in the same way as Publish,
+	// but the returned Completer completes as soon as the local
+	// subscription, which must be from the same hub, has handled the
+	// message, without waiting for the other subscribers. This lets a
+	// component that keeps its own derived state up to date through a
+	// subscription read its own writes. If the message is not queued for
+	// the subscription, because its matcher doesn't match the topic or it
+	// is a standby of a failover group, the Completer completes straight
+	// away.
+	PublishAndWaitLocal(topic Topic, data interface{}, local Subscription) (Completer, error)
+}
+
+// Barrierer is implemented by the hubs that can wait for their subscribers
+// to catch up.
+type Barrierer interface {
+	// Barrier queues a marker for every current subscriber whose matcher
+	// matches the topic, and returns a Completer that completes when they
+	// have all reached it, so everything queued for them before the
+	// barrier has been handled. The marker is not a message, so no handler
+	// is called for it, and it does not use a sequence number. This is
+	// useful in tests, and to wait for a change to propagate to all the
+	// subscribers before continuing.
+	Barrier(topic Topic) (Completer, error)
+}
+
+// Requeuer is implemented by the hubs that can queue drained messages
+// again.
+type Requeuer interface {
+	// Requeue queues messages taken from a subscription with Drain for the
+	// current subscribers whose matchers match their topics, in the order
+	// given. The messages keep their sequence numbers, ordering keys and
+	// headers, so a new subscriber can take over the work of the old one.
+	// The data is passed to the subscribers as it is, so for structured
+	// hubs it must be in the map[string]interface{} form. Requeued messages
+	// are not retained. The returned Completer completes once all the
+	// subscribers have handled all the messages.
+	Requeue(messages []Message) (Completer, error)
+}
+
+// MultiSubscriber is implemented by the hubs that can subscribe a handler
+// to a list of topics.
+type MultiSubscriber interface {
+	// SubscribeMulti subscribes the handler to each of the topics with a
+	// single subscription, as Subscribe does with a matcher that matches
+	// any of them, so there is one handle to unsubscribe. The handler is
+	// called for the messages on all the topics in the order they were
+	// published, and once for each message.
+	SubscribeMulti(topics []string, handler interface{}, options ...SubscribeOption) (Subscription, error)
+}
+
+// FetchingSubscriber is implemented by the hubs that can return the
+// retained messages along with a new subscription.
+type FetchingSubscriber interface {
+	// SubscribeAndFetch is the same as Subscribe, but also returns the most
+	// recent retained message of each topic that the matcher matches, in
+	// the order they were published. The subscription and the fetch happen
+	// atomically, so the handler is called for every message published
+	// after the returned messages and for none of the returned messages.
+	// Options that deliver retained messages are ignored. Hubs that don't
+	// retain messages return no messages.
+	SubscribeAndFetch(matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, []Message, error)
+}
+
+// Resubscriber is implemented by the hubs that can replace a subscription
+// without missing messages.
+type Resubscriber interface {
+	// Resubscribe replaces the subscription with a new one for the
+	// matcher and handler, as Unsubscribe and Subscribe would, but without
+	// a window in which messages are missed or handled twice. The
+	// messages queued for the old subscription whose topics the new
+	// matcher matches are handed to the new one in order, and the rest
+	// are dropped. A handler call already running for the old
+	// subscription is left to finish, and the new subscription isn't
+	// given the retained messages. Durable and Parallel subscriptions
+	// can't be resubscribed.
+	Resubscribe(old Subscription, matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, error)
+}
+
+// ChanSubscriber is implemented by the hubs that can deliver messages to a
+// channel.
+type ChanSubscriber interface {
+	// SubscribeChan subscribes to the topics matched by the matcher and
+	// returns a channel that receives the messages in the order they were
+	// published, along with a function to close the subscription. The
+	// channel has the specified buffer size. A subscriber that stops
+	// reading the channel only delays its own messages. Calling the close
+	// function unsubscribes, drops any queued messages, and closes the
+	// channel. For structured hubs the data of each message is the
+	// map[string]interface{} form.
+	SubscribeChan(matcher TopicMatcher, buffer int) (<-chan Message, func(), error)
+}
+
+// Explainer is implemented by the hubs that can explain which subscribers
+// match a topic.
+type Explainer interface {
+	// Explain returns the subscribers whose topic matchers match the topic,
+	// along with those that nearly match it. This is intended to help
+	// diagnose why a handler was not called for a particular topic.
+	Explain(topic Topic) []MatchResult
+}
+
+// PatternDryRunner is implemented by the hubs that can check a matcher
+// against the topics they have seen.
+type PatternDryRunner interface {
+	// DryRunPattern returns the topics that the matcher would match, out
+	// of the topics recently published on the hub and those matched by
+	// its subscribers, sorted. It is meant for checking a new pattern
+	// against real traffic before subscribing with it.
+	DryRunPattern(matcher TopicMatcher) []string
+}
+
+// InFlightReporter is implemented by the hubs that can report the handlers
+// that are running.
+type InFlightReporter interface {
+	// InFlight returns the handlers that are running, along with the
+	// stacks of their goroutines, to help diagnose a publish that never
+	// completes.
+	InFlight() []InFlightInfo
+}
+
+// SyncTapper is implemented by the hubs that can call a tap inline from
+// Publish.
+type SyncTapper interface {
+	// TapSync adds a tap that is called inline by Publish for each message
+	// whose topic the matcher matches, before the message is queued for
+	// the subscribers. Taps must be fast, see Tap. The tap is removed when
+	// the returned Unsubscriber is unsubscribed.
+	TapSync(matcher TopicMatcher, tap Tap) (Unsubscriber, error)
+}
+
+// TopicPinner is implemented by the hubs that can keep messages for
+// durable subscribers that have unsubscribed.
+type TopicPinner interface {
+	// PinTopic keeps the messages on the topics matched by the matcher
+	// for the named durable subscribers that have unsubscribed, such as
+	// while the component that owns one is being upgraded. The messages
+	// that such a subscriber would have been given are written to the
+	// store of its Durable config, and are delivered in order, before any
+	// new messages, when a durable subscriber with the same name
+	// subscribes again. Messages on topics that aren't pinned are not
+	// kept. The pin is removed when the returned Unsubscriber is
+	// unsubscribed.
+	PinTopic(matcher TopicMatcher) (Unsubscriber, error)
 }
 
 // Completer provides a way for the caller of publish to know when all of the
@@ -38,5 +224,87 @@ type Completer interface {
 
 // Unsubscriber provides a simple way to Unsubscribe.
 type Unsubscriber interface {
+	// Unsubscribe stops the handler being called for any more messages.
+	// The context passed to handlers that take one is cancelled, so a
+	// long running handler can stop early rather than finish work that
+	// is no longer wanted.
 	Unsubscribe()
 }
+
+// Subscription is returned from Subscribe. As well as being able to
+// unsubscribe, it allows the subscriber to monitor its own backlog, so it
+// can log or shed load when it falls behind.
+//
+// Unsubscribe discards the messages queued for the subscription that the
+// handler has not yet been called for. The Completers of the publishes
+// waiting on them complete as if they had been handled, and the messages
+// are counted as dropped. Use UnsubscribeFlush to handle them first.
+type Subscription interface {
+	Unsubscriber
+
+	// UnsubscribeFlush stops any more messages being queued for the
+	// subscription, but unlike Unsubscribe the handler is still called
+	// for the messages already queued. The returned Completer completes
+	// once they have all been handled and the subscription is closed.
+	// The Completers of the publishes of the queued messages complete as
+	// each is handled, as normal. A subscription that is still warming up
+	// is made ready. Calling Unsubscribe while the messages are being
+	// flushed discards the rest of them.
+	UnsubscribeFlush() Completer
+
+	// Pending returns the number of messages queued for the subscriber
+	// that the handler has not yet been called for.
+	Pending() int
+
+	// LastDelivered returns the time that the handler last finished
+	// handling a message, or the zero time if it never has.
+	LastDelivered() time.Time
+
+	// MatchedTopics returns the distinct topics of the messages that
+	// have been queued for the subscription, in order, to help find
+	// patterns that match more than was intended. Only the first 100
+	// topics are recorded; the hub Report shows when there were more.
+	MatchedTopics() []Topic
+
+	// Replace swaps the handler of the subscription for a new one, which
+	// must be valid for the hub in the same way as the handlers passed to
+	// Subscribe. Messages that are queued for the subscription keep their
+	// place, and are handled by the new handler. A call to the old handler
+	// that is already running is allowed to finish.
+	Replace(handler interface{}) error
+
+	// Ready starts the delivery of messages to a subscription created with
+	// the WarmUp option. It does nothing for other subscriptions, or if the
+	// subscription is already ready.
+	Ready()
+
+	// Drain removes the messages queued for the subscription that the
+	// handler has not yet been called for, and returns them in order,
+	// including any spilled to a store. Publishes waiting on the drained
+	// messages complete as if they had been handled. Messages already
+	// passed to the handler, or to a worker of a Parallel subscription,
+	// are not drained. Drain is intended for shutting down, so the
+	// messages can be passed to Requeuer.Requeue once a replacement subscriber
+	// is ready. Messages published after Drain returns are still queued
+	// until the subscription is unsubscribed.
+	Drain() []Message
+}
+
+// PublishCtx publishes the data with the hub's PublishCtx method if it is
+// a ContextPublisher, and with Publish, without the context, if not.
+func PublishCtx(ctx context.Context, hub Hub, topic Topic, data interface{}) (Completer, error) {
+	if publisher, ok := hub.(ContextPublisher); ok {
+		return publisher.PublishCtx(ctx, topic, data)
+	}
+	return hub.Publish(topic, data)
+}
+
+// SubscribeChan calls the hub's SubscribeChan method if it is a
+// ChanSubscriber, and returns an error if not.
+func SubscribeChan(hub Hub, matcher TopicMatcher, buffer int) (<-chan Message, func(), error) {
+	subscriber, ok := hub.(ChanSubscriber)
+	if !ok {
+		return nil, nil, errors.NotValidf("hub %T without SubscribeChan", hub)
+	}
+	return subscriber.SubscribeChan(matcher, buffer)
+}
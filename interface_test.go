@@ -0,0 +1,74 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type InterfaceSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&InterfaceSuite{})
+
+// minimalHub implements only the methods of the Hub interface, as a hub
+// from outside this package might.
+type minimalHub struct {
+	published []pubsub.Topic
+}
+
+func (h *minimalHub) Publish(topic pubsub.Topic, data interface{}) (pubsub.Completer, error) {
+	h.published = append(h.published, topic)
+	return pubsub.NewSimpleHub().Publish(topic, data)
+}
+
+func (h *minimalHub) Subscribe(matcher pubsub.TopicMatcher, handler interface{}, options ...pubsub.SubscribeOption) (pubsub.Subscription, error) {
+	return nil, errors.NotImplementedf("Subscribe")
+}
+
+func (*InterfaceSuite) TestPublishCtx(c *gc.C) {
+	hub := &minimalHub{}
+	_, err := pubsub.PublishCtx(context.Background(), hub, topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(hub.published, jc.DeepEquals, []pubsub.Topic{topic})
+}
+
+func (*InterfaceSuite) TestSubscribeChan(c *gc.C) {
+	_, _, err := pubsub.SubscribeChan(&minimalHub{}, topic, 0)
+	c.Check(err, gc.ErrorMatches, `hub \*pubsub_test.minimalHub without SubscribeChan not valid`)
+
+	messages, closer, err := pubsub.SubscribeChan(pubsub.NewSimpleHub(), topic, 0)
+	c.Assert(err, jc.ErrorIsNil)
+	closer()
+	_, ok := <-messages
+	c.Check(ok, jc.IsFalse)
+}
+
+func (*InterfaceSuite) TestComponentsCheckHubs(c *gc.C) {
+	hub := &minimalHub{}
+	_, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Source: hub,
+		Target: pubsub.NewSimpleHub(),
+	})
+	c.Check(err, gc.ErrorMatches, `Source \*pubsub_test.minimalHub without SubscribeChan not valid`)
+	_, err = pubsub.NewBridge(pubsub.BridgeConfig{
+		Source: pubsub.NewSimpleHub(),
+		Target: hub,
+	})
+	c.Check(err, gc.ErrorMatches, `Target \*pubsub_test.minimalHub without PublishCtx not valid`)
+	_, err = pubsub.NewAggregate(pubsub.AggregateConfig{
+		Hub:     hub,
+		Matcher: topic,
+		Reducer: func(state int, event int) int { return state + event },
+	})
+	c.Check(err, gc.ErrorMatches, `Hub \*pubsub_test.minimalHub without Barrier not valid`)
+}
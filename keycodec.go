@@ -0,0 +1,343 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// KeyCodec converts the keys of maps with a particular key type to and
+// from the strings used as keys in the map form of the published data. Key
+// codecs allow payloads to contain maps with keys that the Marshaller
+// can't use as object keys, such as structures.
+type KeyCodec struct {
+	// Encode converts a key into its string form.
+	Encode func(key interface{}) (string, error)
+
+	// Decode converts the string form back into a key. The value returned
+	// must be convertible to the key type.
+	Decode func(key string) (interface{}, error)
+}
+
+// payloadCodecs holds the conversions applied to the payloads of a
+// structured hub before they are passed to the Marshaller, and after.
+type payloadCodecs struct {
+	// keys holds the KeyCodec for each key type.
+	keys map[reflect.Type]KeyCodec
+
+	// text is true if values are converted to and from their canonical
+	// text form. See StructuredHubConfig.CanonicalText.
+	text bool
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	interfaceType     = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// needed returns true if values of the type contain maps with keys that
+// have a codec, or values with a canonical text form that is used. Values
+// held in interface types are not known until they are published, so they
+// are never converted.
+func (k payloadCodecs) needed(t reflect.Type) bool {
+	if len(k.keys) == 0 && !k.text {
+		return false
+	}
+	return k.neededSeen(t, make(map[reflect.Type]bool))
+}
+
+func (k payloadCodecs) neededSeen(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	if k.hasTextForm(t) {
+		return true
+	}
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return k.neededSeen(t.Elem(), seen)
+	case reflect.Map:
+		if _, ok := k.keys[t.Key()]; ok {
+			return true
+		}
+		return k.neededSeen(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" && !field.Anonymous {
+				continue
+			}
+			if k.neededSeen(field.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encode converts the value into one the Marshaller can serialize, by
+// replacing the maps with keys that have a codec with maps keyed by the
+// encoded strings. Structures that contain such maps are converted into
+// maps using the names from their `json` struct tags.
+func (k payloadCodecs) encode(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	t := v.Type()
+	if !k.needed(t) {
+		return v.Interface(), nil
+	}
+	if k.hasTextForm(t) {
+		return encodeText(v)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return k.encode(v.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		result := make([]interface{}, v.Len())
+		for i := range result {
+			item, err := k.encode(v.Index(i))
+			if err != nil {
+				return nil, errors.Annotatef(err, "index %d", i)
+			}
+			result[i] = item
+		}
+		return result, nil
+	case reflect.Map:
+		return k.encodeMap(v)
+	case reflect.Struct:
+		result := make(map[string]interface{})
+		if err := k.encodeStruct(v, result); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return result, nil
+	}
+	return v.Interface(), nil
+}
+
+func (k payloadCodecs) encodeMap(v reflect.Value) (interface{}, error) {
+	if v.IsNil() {
+		return nil, nil
+	}
+	codec, ok := k.keys[v.Type().Key()]
+	if !ok {
+		// The keys are left for the Marshaller.
+		result := reflect.MakeMapWithSize(reflect.MapOf(v.Type().Key(), interfaceType), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			value, err := k.encode(iter.Value())
+			if err != nil {
+				return nil, errors.Annotatef(err, "key %v", iter.Key())
+			}
+			result.SetMapIndex(iter.Key(), reflect.ValueOf(&value).Elem())
+		}
+		return result.Interface(), nil
+	}
+	result := make(map[string]interface{}, v.Len())
+	for iter := v.MapRange(); iter.Next(); {
+		key, err := codec.Encode(iter.Key().Interface())
+		if err != nil {
+			return nil, errors.Annotatef(err, "encoding key %v", iter.Key())
+		}
+		value, err := k.encode(iter.Value())
+		if err != nil {
+			return nil, errors.Annotatef(err, "key %v", iter.Key())
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// encodeStruct adds the fields of the structure to the map. The fields of
+// embedded structures without a name in their tag are added as if they
+// were fields of the outer structure.
+func (k payloadCodecs) encodeStruct(v reflect.Value, result map[string]interface{}) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		name, ok := fieldKey(field)
+		if !ok {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && name == field.Name {
+			if err := k.encodeStruct(v.Field(i), result); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		value, err := k.encode(v.Field(i))
+		if err != nil {
+			return errors.Annotatef(err, "field %q", field.Name)
+		}
+		if strings.Contains(field.Tag.Get("json"), ",omitempty") && IsEmptyValue(v.Field(i).Interface()) {
+			continue
+		}
+		result[name] = value
+	}
+	return nil
+}
+
+// decodeValue sets v, which must be addressable, from the data. Maps with
+// keys that have a codec are built directly, and everything else is
+// converted using the Marshaller.
+func (d decoder) decodeValue(v reflect.Value, data interface{}) error {
+	t := v.Type()
+	if data == nil || !d.codecs.needed(t) {
+		return d.unmarshalInto(v, data)
+	}
+	if d.codecs.hasTextForm(t) {
+		return decodeText(v, data)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		ptr := reflect.New(t.Elem())
+		if err := d.decodeValue(ptr.Elem(), data); err != nil {
+			return errors.Trace(err)
+		}
+		v.Set(ptr)
+		return nil
+	case reflect.Slice, reflect.Array:
+		items, ok := data.([]interface{})
+		if !ok {
+			return errors.Errorf("expected list for %v, got %T", t, data)
+		}
+		if t.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(t, len(items), len(items)))
+		}
+		for i := 0; i < len(items) && i < v.Len(); i++ {
+			if err := d.decodeValue(v.Index(i), items[i]); err != nil {
+				return errors.Annotatef(err, "index %d", i)
+			}
+		}
+		return nil
+	}
+	values, ok := data.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("expected map for %v, got %T", t, data)
+	}
+	if t.Kind() == reflect.Map {
+		return d.decodeMap(v, values)
+	}
+	return d.decodeStruct(v, values)
+}
+
+func (d decoder) decodeMap(v reflect.Value, values map[string]interface{}) error {
+	t := v.Type()
+	result := reflect.MakeMapWithSize(t, len(values))
+	for key, value := range values {
+		keyValue, err := d.decodeKey(t.Key(), key)
+		if err != nil {
+			return errors.Annotatef(err, "decoding key %q", key)
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		if err := d.decodeValue(elem, value); err != nil {
+			return errors.Annotatef(err, "key %q", key)
+		}
+		result.SetMapIndex(keyValue, elem)
+	}
+	v.Set(result)
+	return nil
+}
+
+// decodeKey converts the key using its codec, or the Marshaller if the
+// key type doesn't have one.
+func (d decoder) decodeKey(t reflect.Type, key string) (reflect.Value, error) {
+	codec, ok := d.codecs.keys[t]
+	if !ok {
+		keys := reflect.New(reflect.MapOf(t, interfaceType)).Elem()
+		if err := d.unmarshalInto(keys, map[string]interface{}{key: nil}); err != nil {
+			return reflect.Value{}, errors.Trace(err)
+		}
+		return keys.MapKeys()[0], nil
+	}
+	decoded, err := codec.Decode(key)
+	if err != nil {
+		return reflect.Value{}, errors.Trace(err)
+	}
+	value := reflect.ValueOf(decoded)
+	if !value.IsValid() || !value.Type().ConvertibleTo(t) {
+		return reflect.Value{}, errors.Errorf("codec returned %T, expected %v", decoded, t)
+	}
+	return value.Convert(t), nil
+}
+
+// decodeStruct sets the fields that need key codecs from their values in
+// the map, and the rest using the Marshaller.
+func (d decoder) decodeStruct(v reflect.Value, values map[string]interface{}) error {
+	rest := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		rest[key] = value
+	}
+	type codecField struct {
+		index []int
+		value interface{}
+	}
+	var fields []codecField
+	var collect func(t reflect.Type, index []int)
+	collect = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, ok := fieldKey(field)
+			if !ok || !d.codecs.needed(field.Type) {
+				continue
+			}
+			fieldIndex := append(index[:len(index):len(index)], i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct && name == field.Name {
+				collect(field.Type, fieldIndex)
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			if key, ok := findKey(rest, name); ok {
+				fields = append(fields, codecField{index: fieldIndex, value: rest[key]})
+				delete(rest, key)
+			}
+		}
+	}
+	collect(v.Type(), nil)
+	if err := d.unmarshalInto(v, rest); err != nil {
+		return errors.Trace(err)
+	}
+	for _, field := range fields {
+		if err := d.decodeValue(v.FieldByIndex(field.index), field.value); err != nil {
+			return errors.Annotatef(err, "field %q", v.Type().FieldByIndex(field.index).Name)
+		}
+	}
+	return nil
+}
+
+// unmarshalInto sets v, which must be addressable, by passing the data
+// through the Marshaller.
+func (d decoder) unmarshalInto(v reflect.Value, data interface{}) error {
+	bytes, err := d.marshaller.Marshal(data)
+	if err != nil {
+		return errors.Annotate(err, "marshalling data")
+	}
+	if err := d.limits.checkSize(bytes); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(d.limits.unmarshal(d.marshaller, bytes, v.Addr().Interface()))
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type KeyCodecSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&KeyCodecSuite{})
+
+type Cell struct {
+	Row, Col int
+}
+
+type Grid struct {
+	Name   string                  `json:"name"`
+	Cells  map[Cell]string         `json:"cells"`
+	Layers map[int]map[Cell]string `json:"layers,omitempty"`
+	Rows   []map[Cell]int          `json:"rows,omitempty"`
+}
+
+type Board struct {
+	Grid
+	Owner *Grid `json:"owner,omitempty"`
+}
+
+var cellCodec = pubsub.KeyCodec{
+	Encode: func(key interface{}) (string, error) {
+		cell := key.(Cell)
+		return fmt.Sprintf("%d:%d", cell.Row, cell.Col), nil
+	},
+	Decode: func(key string) (interface{}, error) {
+		var cell Cell
+		if _, err := fmt.Sscanf(key, "%d:%d", &cell.Row, &cell.Col); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return cell, nil
+	},
+}
+
+func newKeyCodecHub() pubsub.StructuredHub {
+	return pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		KeyCodecs: map[reflect.Type]pubsub.KeyCodec{
+			reflect.TypeOf(Cell{}): cellCodec,
+		},
+	})
+}
+
+func (*KeyCodecSuite) TestWithoutCodec(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Publish(topic, Grid{Cells: map[Cell]string{{1, 2}: "x"}})
+	c.Assert(err, gc.ErrorMatches, "marshalling: .*")
+}
+
+func (*KeyCodecSuite) TestMapForm(c *gc.C) {
+	hub := newKeyCodecHub()
+	var result map[string]interface{}
+	done := make(chan struct{})
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		result = data
+		close(done)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, Grid{
+		Name:  "grid",
+		Cells: map[Cell]string{{1, 2}: "x"},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	c.Assert(result, jc.DeepEquals, map[string]interface{}{
+		"name":  "grid",
+		"cells": map[string]interface{}{"1:2": "x"},
+	})
+}
+
+func (*KeyCodecSuite) TestRoundTrip(c *gc.C) {
+	hub := newKeyCodecHub()
+	var result Board
+	done := make(chan struct{})
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Board, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		result = data
+		close(done)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	board := Board{
+		Grid: Grid{
+			Name:   "grid",
+			Cells:  map[Cell]string{{1, 2}: "x", {3, 4}: "o"},
+			Layers: map[int]map[Cell]string{5: {{6, 7}: "y"}},
+			Rows:   []map[Cell]int{{{0, 1}: 1}, nil},
+		},
+		Owner: &Grid{
+			Name:  "owner",
+			Cells: map[Cell]string{{8, 9}: "z"},
+		},
+	}
+	_, err = hub.Publish(topic, board)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	c.Assert(result, jc.DeepEquals, board)
+}
+
+func (*KeyCodecSuite) TestEncodeError(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		KeyCodecs: map[reflect.Type]pubsub.KeyCodec{
+			reflect.TypeOf(Cell{}): {
+				Encode: func(interface{}) (string, error) {
+					return "", errors.New("boom")
+				},
+			},
+		},
+	})
+	_, err := hub.Publish(topic, Grid{Cells: map[Cell]string{{1, 2}: "x"}})
+	c.Assert(err, gc.ErrorMatches, `marshalling: field "Cells": encoding key {1 2}: boom`)
+}
+
+func (*KeyCodecSuite) TestDecodeError(c *gc.C) {
+	hub := newKeyCodecHub()
+	done := make(chan error, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Grid, err error) {
+		done <- err
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, map[string]interface{}{
+		"cells": map[string]interface{}{"bad": "x"},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case err := <-done:
+		c.Assert(err, gc.ErrorMatches, `unmarshalling data: field "Cells": decoding key "bad": .*`)
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+)
+
+// Headers set on the messages that a key-value bridge publishes for the
+// changes to the keys it watches. KeyHeader is the key that changed,
+// KeyRevisionHeader is the revision of the store that changed it, and
+// KeyDeletedHeader is set to "true" if the key was deleted.
+const (
+	KeyHeader         = "pubsub-kv-key"
+	KeyRevisionHeader = "pubsub-kv-revision"
+	KeyDeletedHeader  = "pubsub-kv-deleted"
+)
+
+// KeyEvent is a change to a key in a KeyValueStore.
+type KeyEvent struct {
+	Key   string
+	Value []byte
+
+	// Revision orders the changes to the store, such as the ModRevision
+	// of etcd or the ModifyIndex of consul.
+	Revision uint64
+
+	// Deleted is true if the key was removed, in which case the Value is
+	// nil.
+	Deleted bool
+}
+
+// KeyValueStore defines the parts of a key-value store, such as etcd or
+// consul, used by a key-value bridge. Adapters for the clients of those
+// stores implement Watch with an etcd watch on the prefix, or with
+// blocking queries on the consul KV endpoint, reporting the keys that
+// changed between the results, as the consulkv package does.
+// NewMemoryKeyValueStore provides an in-memory implementation.
+type KeyValueStore interface {
+	// Watch sends the current value of each key with the prefix, followed
+	// by the changes to those keys, on the returned channel in revision
+	// order. The channel is closed once the context is done, or if the
+	// watch fails.
+	Watch(ctx context.Context, prefix string) (<-chan KeyEvent, error)
+
+	// Put sets the value of the key.
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// KeyValueBridgeConfig is the argument struct for NewKeyValueBridge.
+type KeyValueBridgeConfig struct {
+	// Name identifies the bridge in its log messages.
+	Name string
+
+	// Hub is the hub that the changes to the keys are published on. It
+	// must implement ContextPublisher, and ChanSubscriber if WriteBack is
+	// set.
+	Hub Hub
+
+	// Store is the key-value store that is watched.
+	Store KeyValueStore
+
+	// Prefix is the prefix of the keys that are watched.
+	Prefix string
+
+	// KeyToTopic returns the topic that the changes to the key are
+	// published on, or false if the key is to be ignored. By default the
+	// prefix is removed from the key, and the slashes of the rest are
+	// replaced by dots, so "config/db/host" under the prefix "config/" is
+	// published on "db.host".
+	KeyToTopic func(key string) (Topic, bool)
+
+	// Codec decodes the values of the keys into the map form of the data
+	// that is published, and encodes the messages written back to the
+	// keys. It defaults to the JSONMarshaller, so the values must be
+	// JSON objects.
+	Codec Marshaller
+
+	// WriteBack, if set, matches the topics of the messages published on
+	// the hub that are written back to the store. The messages published
+	// by the bridge itself are never written back.
+	WriteBack TopicMatcher
+
+	// TopicToKey returns the key that a message written back is stored
+	// in, or false if the message is not to be written. By default it is
+	// the reverse of the default KeyToTopic.
+	TopicToKey func(topic Topic) (string, bool)
+
+	// Transport names the transport in the PeerTransportHeader of the
+	// published messages. It defaults to "keyvalue".
+	Transport string
+}
+
+// Validate checks that the config has all the required values.
+func (config KeyValueBridgeConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if _, ok := config.Hub.(ContextPublisher); !ok {
+		return errors.NotValidf("Hub %T without PublishCtx", config.Hub)
+	}
+	if config.WriteBack != nil {
+		if _, ok := config.Hub.(ChanSubscriber); !ok {
+			return errors.NotValidf("Hub %T without SubscribeChan", config.Hub)
+		}
+	}
+	if config.Store == nil {
+		return errors.NotValidf("missing Store")
+	}
+	return nil
+}
+
+type keyValueBridge struct {
+	name      string
+	hub       Hub
+	store     KeyValueStore
+	prefix    string
+	codec     Marshaller
+	transport string
+	logger    loggo.Logger
+
+	keyToTopic func(key string) (Topic, bool)
+	topicToKey func(topic Topic) (string, bool)
+
+	// written holds the values last written back to each key, so the
+	// watch doesn't publish them again.
+	mutex   sync.Mutex
+	written map[string][]byte
+
+	cancel   context.CancelFunc
+	closer   func()
+	finished sync.WaitGroup
+}
+
+// NewKeyValueBridge creates a bridge that publishes the changes to the keys
+// of a key-value store on the hub, so configuration held in stores such as
+// etcd or consul flows through the same hub as the events of the process.
+// The current values of the keys are published when the bridge starts,
+// followed by each change, in the order the store made them. Changes
+// that can't be decoded are logged and skipped. Deleted keys are published
+// with empty data and the KeyDeletedHeader set.
+//
+// If WriteBack is set, the messages published on the matching topics are
+// encoded and written to their keys, so a change published on the hub is
+// seen by the other processes watching the store. The change is not
+// published on the hub again when the watch reports it.
+func NewKeyValueBridge(config KeyValueBridgeConfig) (Unsubscriber, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	b := &keyValueBridge{
+		name:       config.Name,
+		hub:        config.Hub,
+		store:      config.Store,
+		prefix:     config.Prefix,
+		codec:      config.Codec,
+		transport:  config.Transport,
+		logger:     loggo.GetLogger("pubsub.keyvalue"),
+		keyToTopic: config.KeyToTopic,
+		topicToKey: config.TopicToKey,
+		written:    make(map[string][]byte),
+	}
+	if b.codec == nil {
+		b.codec = JSONMarshaller
+	}
+	if b.transport == "" {
+		b.transport = "keyvalue"
+	}
+	if b.keyToTopic == nil {
+		b.keyToTopic = b.defaultKeyToTopic
+	}
+	if b.topicToKey == nil {
+		b.topicToKey = b.defaultTopicToKey
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := b.store.Watch(ctx, b.prefix)
+	if err != nil {
+		cancel()
+		return nil, errors.Annotatef(err, "watching %q", b.prefix)
+	}
+	b.cancel = cancel
+	b.closer = func() {}
+	if config.WriteBack != nil {
+		messages, closer, err := SubscribeChan(b.hub, config.WriteBack, 0)
+		if err != nil {
+			cancel()
+			return nil, errors.Trace(err)
+		}
+		b.closer = closer
+		b.finished.Add(1)
+		go b.writeLoop(ctx, messages)
+	}
+	b.finished.Add(1)
+	go b.watchLoop(events)
+	return b, nil
+}
+
+func (b *keyValueBridge) defaultKeyToTopic(key string) (Topic, bool) {
+	name := strings.TrimPrefix(key, b.prefix)
+	if name == "" {
+		return "", false
+	}
+	return Topic(strings.Replace(name, "/", ".", -1)), true
+}
+
+func (b *keyValueBridge) defaultTopicToKey(topic Topic) (string, bool) {
+	if topic == "" {
+		return "", false
+	}
+	return b.prefix + strings.Replace(string(topic), ".", "/", -1), true
+}
+
+func (b *keyValueBridge) watchLoop(events <-chan KeyEvent) {
+	defer b.finished.Done()
+	for event := range events {
+		topic, ok := b.keyToTopic(event.Key)
+		if !ok || b.echoed(event) {
+			continue
+		}
+		data := make(map[string]interface{})
+		if !event.Deleted {
+			if err := b.codec.Unmarshal(event.Value, &data); err != nil {
+				b.logger.Errorf("bridge %q decoding %q: %v", b.name, event.Key, err)
+				continue
+			}
+		}
+		headers := Headers{
+			KeyHeader:         event.Key,
+			KeyRevisionHeader: strconv.FormatUint(event.Revision, 10),
+		}
+		if event.Deleted {
+			headers[KeyDeletedHeader] = "true"
+		}
+		headers, err := forwardedHeaders(nil, headers, b.transport, 0)
+		if err != nil {
+			b.logger.Errorf("bridge %q publishing %q: %v", b.name, event.Key, err)
+			continue
+		}
+		ctx := WithHeaders(context.Background(), headers)
+		if _, err := PublishCtx(ctx, b.hub, topic, data); err != nil {
+			b.logger.Errorf("bridge %q publishing %q: %v", b.name, event.Key, err)
+		}
+	}
+}
+
+// echoed returns true if the event is for the value the bridge last wrote
+// back to the key.
+func (b *keyValueBridge) echoed(event KeyEvent) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	written, ok := b.written[event.Key]
+	if !ok {
+		return false
+	}
+	delete(b.written, event.Key)
+	return !event.Deleted && bytes.Equal(written, event.Value)
+}
+
+func (b *keyValueBridge) writeLoop(ctx context.Context, messages <-chan Message) {
+	defer b.finished.Done()
+	for message := range messages {
+		if message.Delivery.Headers[PeerTransportHeader] == b.transport {
+			continue
+		}
+		key, ok := b.topicToKey(message.Topic)
+		if !ok {
+			continue
+		}
+		value, err := b.codec.Marshal(message.Data)
+		if err != nil {
+			b.logger.Errorf("bridge %q encoding %q: %v", b.name, message.Topic, err)
+			continue
+		}
+		b.mutex.Lock()
+		b.written[key] = value
+		b.mutex.Unlock()
+		if err := b.store.Put(ctx, key, value); err != nil {
+			b.mutex.Lock()
+			delete(b.written, key)
+			b.mutex.Unlock()
+			b.logger.Errorf("bridge %q writing %q: %v", b.name, key, err)
+		}
+	}
+}
+
+// Unsubscribe implements Unsubscriber, and stops the bridge.
+func (b *keyValueBridge) Unsubscribe() {
+	b.cancel()
+	b.closer()
+	b.finished.Wait()
+}
+
+// NewMemoryKeyValueStore returns a KeyValueStore that keeps the keys in
+// memory, for tests and for processes that don't share their
+// configuration.
+func NewMemoryKeyValueStore() *MemoryKeyValueStore {
+	return &MemoryKeyValueStore{values: make(map[string][]byte)}
+}
+
+// MemoryKeyValueStore is a KeyValueStore that keeps the keys in memory.
+type MemoryKeyValueStore struct {
+	mutex    sync.Mutex
+	revision uint64
+	values   map[string][]byte
+	watchers []*keyWatcher
+}
+
+// Get returns the value of the key, or false if it isn't set.
+func (s *MemoryKeyValueStore) Get(key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Put implements KeyValueStore.
+func (s *MemoryKeyValueStore) Put(_ context.Context, key string, value []byte) error {
+	value = append([]byte(nil), value...)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = value
+	s.changed(KeyEvent{Key: key, Value: value})
+	return nil
+}
+
+// Delete removes the key. Deleting a key that isn't set does nothing.
+func (s *MemoryKeyValueStore) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.values[key]; !ok {
+		return
+	}
+	delete(s.values, key)
+	s.changed(KeyEvent{Key: key, Deleted: true})
+}
+
+// changed tells the watchers of the key about the change. The mutex must
+// be held.
+func (s *MemoryKeyValueStore) changed(event KeyEvent) {
+	s.revision++
+	event.Revision = s.revision
+	for _, watcher := range s.watchers {
+		if strings.HasPrefix(event.Key, watcher.prefix) {
+			watcher.add(event)
+		}
+	}
+}
+
+// Watch implements KeyValueStore.
+func (s *MemoryKeyValueStore) Watch(ctx context.Context, prefix string) (<-chan KeyEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	watcher := &keyWatcher{
+		prefix: prefix,
+		ready:  make(chan struct{}, 1),
+	}
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		watcher.add(KeyEvent{Key: key, Value: s.values[key], Revision: s.revision})
+	}
+	s.watchers = append(s.watchers, watcher)
+	events := make(chan KeyEvent)
+	go func() {
+		defer close(events)
+		defer s.removeWatcher(watcher)
+		for {
+			event, ok := watcher.next(ctx)
+			if !ok {
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (s *MemoryKeyValueStore) removeWatcher(watcher *keyWatcher) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, existing := range s.watchers {
+		if existing == watcher {
+			s.watchers = append(s.watchers[:i:i], s.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// keyWatcher queues the events for a watch, so changing the store never
+// waits for the watchers.
+type keyWatcher struct {
+	prefix string
+
+	mutex  sync.Mutex
+	events []KeyEvent
+	ready  chan struct{}
+}
+
+func (w *keyWatcher) add(event KeyEvent) {
+	w.mutex.Lock()
+	w.events = append(w.events, event)
+	w.mutex.Unlock()
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the next event, returning false if the context is done
+// first.
+func (w *keyWatcher) next(ctx context.Context) (KeyEvent, bool) {
+	for {
+		w.mutex.Lock()
+		if len(w.events) > 0 {
+			event := w.events[0]
+			w.events = w.events[1:]
+			w.mutex.Unlock()
+			return event, true
+		}
+		w.mutex.Unlock()
+		select {
+		case <-w.ready:
+		case <-ctx.Done():
+			return KeyEvent{}, false
+		}
+	}
+}
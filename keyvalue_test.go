@@ -0,0 +1,152 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type KeyValueSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&KeyValueSuite{})
+
+func (*KeyValueSuite) TestConfigValidate(c *gc.C) {
+	err := pubsub.KeyValueBridgeConfig{}.Validate()
+	c.Check(err, gc.ErrorMatches, "missing Hub not valid")
+	err = pubsub.KeyValueBridgeConfig{Hub: pubsub.NewSimpleHub()}.Validate()
+	c.Check(err, gc.ErrorMatches, "missing Store not valid")
+}
+
+func (*KeyValueSuite) TestPublishesChanges(c *gc.C) {
+	store := pubsub.NewMemoryKeyValueStore()
+	ctx := context.Background()
+	c.Assert(store.Put(ctx, "config/db/host", []byte(`{"value": "db-0"}`)), jc.ErrorIsNil)
+	c.Assert(store.Put(ctx, "other/key", []byte(`{"value": "ignored"}`)), jc.ErrorIsNil)
+
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	bridge, err := pubsub.NewKeyValueBridge(pubsub.KeyValueBridgeConfig{
+		Name:   "config",
+		Hub:    hub,
+		Store:  store,
+		Prefix: "config/",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	// The current value is published first.
+	message := receive(c, messages)
+	c.Check(message.Topic, gc.Equals, pubsub.Topic("db.host"))
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"value": "db-0"})
+	c.Check(message.Delivery.Headers[pubsub.KeyHeader], gc.Equals, "config/db/host")
+	c.Check(message.Delivery.Headers[pubsub.PeerTransportHeader], gc.Equals, "keyvalue")
+
+	c.Assert(store.Put(ctx, "config/db/host", []byte(`{"value": "db-1"}`)), jc.ErrorIsNil)
+	message = receive(c, messages)
+	c.Check(message.Topic, gc.Equals, pubsub.Topic("db.host"))
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"value": "db-1"})
+	c.Check(message.Delivery.Headers[pubsub.KeyRevisionHeader], gc.Equals, "3")
+
+	// Values that can't be decoded are skipped.
+	c.Assert(store.Put(ctx, "config/bad", []byte("not json")), jc.ErrorIsNil)
+	store.Delete("config/db/host")
+	message = receive(c, messages)
+	c.Check(message.Topic, gc.Equals, pubsub.Topic("db.host"))
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{})
+	c.Check(message.Delivery.Headers[pubsub.KeyDeletedHeader], gc.Equals, "true")
+
+	bridge.Unsubscribe()
+	c.Assert(store.Put(ctx, "config/db/host", []byte(`{"value": "db-2"}`)), jc.ErrorIsNil)
+	select {
+	case message := <-messages:
+		c.Fatalf("unexpected message %#v", message)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (*KeyValueSuite) TestStructuredHub(c *gc.C) {
+	store := pubsub.NewMemoryKeyValueStore()
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan Emitter, 1)
+	_, err := hub.Subscribe(pubsub.Topic("emitter"), func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	bridge, err := pubsub.NewKeyValueBridge(pubsub.KeyValueBridgeConfig{
+		Hub:   hub,
+		Store: store,
+		KeyToTopic: func(key string) (pubsub.Topic, bool) {
+			return pubsub.Topic(key), key == "emitter"
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	err = store.Put(context.Background(), "emitter", []byte(`{"origin": "etcd", "id": 42}`))
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data, jc.DeepEquals, Emitter{Origin: "etcd", ID: 42})
+	case <-time.After(time.Second):
+		c.Fatal("message not received")
+	}
+}
+
+func (*KeyValueSuite) TestWriteBack(c *gc.C) {
+	store := pubsub.NewMemoryKeyValueStore()
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	bridge, err := pubsub.NewKeyValueBridge(pubsub.KeyValueBridgeConfig{
+		Hub:       hub,
+		Store:     store,
+		Prefix:    "config/",
+		WriteBack: pubsub.Topic("db.host"),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	done, err := hub.Publish("db.host", map[string]interface{}{"value": "db-3"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(receive(c, messages).Topic, gc.Equals, pubsub.Topic("db.host"))
+	// The bridge doesn't publish the change it wrote.
+	for attempt := 0; ; attempt++ {
+		value, ok := store.Get("config/db/host")
+		if ok {
+			c.Check(string(value), gc.Equals, `{"value":"db-3"}`)
+			break
+		}
+		if attempt > 100 {
+			c.Fatal("value not written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Changes made by others are published, but not written back.
+	err = store.Put(context.Background(), "config/db/host", []byte(`{"value": "db-4"}`))
+	c.Assert(err, jc.ErrorIsNil)
+	message := receive(c, messages)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"value": "db-4"})
+	select {
+	case message := <-messages:
+		c.Fatalf("unexpected message %#v", message)
+	case <-time.After(10 * time.Millisecond):
+	}
+	value, _ := store.Get("config/db/host")
+	c.Check(string(value), gc.Equals, `{"value": "db-4"}`)
+}
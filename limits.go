@@ -0,0 +1,134 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DecodeLimits guard the subscribers of a structured hub against payloads
+// that would take too long to convert into the handler's structure. When a
+// limit is exceeded the handler is called with the zero value of its
+// structure and a *DecodeLimitError. Zero values mean no limit.
+type DecodeLimits struct {
+	// MaxDepth is the maximum nesting of maps and slices in the published
+	// data.
+	MaxDepth int
+
+	// MaxSize is the maximum size in bytes of the data serialized by the
+	// Marshaller.
+	MaxSize int
+
+	// Timeout is the maximum time to wait for the Marshaller to unmarshal
+	// the data into the handler's structure. Go provides no way to stop
+	// the unmarshalling, so it continues in the background, but the
+	// subscriber is free to continue with its next message.
+	Timeout time.Duration
+}
+
+// DecodeLimitError is the error passed to a structured hub handler when the
+// published data exceeds one of the configured DecodeLimits.
+type DecodeLimitError struct {
+	// Limit is one of "depth", "size" or "timeout".
+	Limit string
+
+	// Max is the configured limit. Timeouts are described in nanoseconds.
+	Max int64
+}
+
+// Error implements error.
+func (e *DecodeLimitError) Error() string {
+	if e.Limit == "timeout" {
+		return fmt.Sprintf("decode timeout of %v exceeded", time.Duration(e.Max))
+	}
+	return fmt.Sprintf("decode %s limit of %d exceeded", e.Limit, e.Max)
+}
+
+// IsDecodeLimitError returns true if the cause of the error is a
+// *DecodeLimitError.
+func IsDecodeLimitError(err error) bool {
+	_, ok := errors.Cause(err).(*DecodeLimitError)
+	return ok
+}
+
+func (l DecodeLimits) checkDepth(data map[string]interface{}) error {
+	if l.MaxDepth <= 0 {
+		return nil
+	}
+	if !withinDepth(data, l.MaxDepth) {
+		return &DecodeLimitError{Limit: "depth", Max: int64(l.MaxDepth)}
+	}
+	return nil
+}
+
+// withinDepth returns false if the value has more than depth levels of
+// nested maps and slices.
+func withinDepth(value interface{}, depth int) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if depth == 0 {
+			return false
+		}
+		for _, item := range v {
+			if !withinDepth(item, depth-1) {
+				return false
+			}
+		}
+	case []interface{}:
+		if depth == 0 {
+			return false
+		}
+		for _, item := range v {
+			if !withinDepth(item, depth-1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (l DecodeLimits) checkSize(bytes []byte) error {
+	if l.MaxSize > 0 && len(bytes) > l.MaxSize {
+		return &DecodeLimitError{Limit: "size", Max: int64(l.MaxSize)}
+	}
+	return nil
+}
+
+// checkMapSize serializes the data to check its size, for conversions
+// such as MapUnmarshaler that never otherwise pass the data through the
+// marshaller.
+func (l DecodeLimits) checkMapSize(marshaller Marshaller, data map[string]interface{}) error {
+	if l.MaxSize <= 0 {
+		return nil
+	}
+	bytes, err := marshaller.Marshal(data)
+	if err != nil {
+		return errors.Annotate(err, "marshalling data")
+	}
+	return l.checkSize(bytes)
+}
+
+// unmarshal calls the marshaller's Unmarshal method, giving up when the
+// timeout expires. If the timeout expires the target value is still being
+// written to by the marshaller, so it must not be used.
+func (l DecodeLimits) unmarshal(marshaller Marshaller, bytes []byte, target interface{}) error {
+	if l.Timeout <= 0 {
+		return marshaller.Unmarshal(bytes, target)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- marshaller.Unmarshal(bytes, target)
+	}()
+	timer := time.NewTimer(l.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return &DecodeLimitError{Limit: "timeout", Max: int64(l.Timeout)}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// localWait is passed through the publish context to count the calls for
+// the subscription given to PublishAndWaitLocal.
+type localWait struct {
+	sub  *subscriber
+	wait sync.WaitGroup
+}
+
+type localWaitKey struct{}
+
+func localWaitFromContext(ctx context.Context) *localWait {
+	local, _ := ctx.Value(localWaitKey{}).(*localWait)
+	return local
+}
+
+// PublishAndWaitLocal implements LocalPublisher.
+func (h *simplehub) PublishAndWaitLocal(topic Topic, data interface{}, local Subscription) (Completer, error) {
+	sub, ok := local.(*handle)
+	if !ok || sub.hub != h {
+		return nil, errors.NotValidf("subscription from another hub")
+	}
+	wait := &localWait{sub: sub.sub}
+	// The embedding hub's PublishCtx is used so the data of structured
+	// hubs is serialized in the same way as for Publish.
+	ctx := context.WithValue(context.Background(), localWaitKey{}, wait)
+	if _, err := h.publish(ctx, topic, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		wait.wait.Wait()
+		close(done)
+	}()
+	return &doneHandle{done: done}, nil
+}
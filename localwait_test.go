@@ -0,0 +1,101 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type LocalWaitSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&LocalWaitSuite{})
+
+func (*LocalWaitSuite) TestWaitsOnlyForLocal(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slow, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {
+		started <- struct{}{}
+		<-release
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer slow.Unsubscribe()
+	receiver := &orderedReceiver{}
+	local, err := hub.Subscribe(topic, receiver.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer local.Unsubscribe()
+
+	done, err := hub.(pubsub.LocalPublisher).PublishAndWaitLocal(topic, "hello", local)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{"hello"})
+	// The slow handler is still running.
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		c.Fatal("slow handler not called")
+	}
+	c.Check(slow.Pending(), gc.Equals, 0)
+	close(release)
+}
+
+func (*LocalWaitSuite) TestLocalNotMatching(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	local, err := hub.Subscribe(pubsub.MatchRegex("other"), func(pubsub.Topic, interface{}) {
+		c.Error("handler called")
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer local.Unsubscribe()
+
+	done, err := hub.(pubsub.LocalPublisher).PublishAndWaitLocal(topic, "hello", local)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+}
+
+func (*LocalWaitSuite) TestSubscriptionFromAnotherHub(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	other, err := pubsub.NewSimpleHub().Subscribe(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	defer other.Unsubscribe()
+
+	done, err := hub.(pubsub.LocalPublisher).PublishAndWaitLocal(topic, "hello", other)
+	c.Check(err, gc.ErrorMatches, "subscription from another hub not valid")
+	c.Check(done, gc.IsNil)
+}
+
+func (*LocalWaitSuite) TestStructured(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	release := make(chan struct{})
+	slow, err := hub.Subscribe(topic, func(pubsub.Topic, map[string]interface{}, error) {
+		<-release
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer slow.Unsubscribe()
+	received := make(chan Emitter, 1)
+	local, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer local.Unsubscribe()
+
+	done, err := hub.(pubsub.LocalPublisher).PublishAndWaitLocal(topic, Emitter{Origin: "origin", ID: 42}, local)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	select {
+	case data := <-received:
+		c.Check(data, jc.DeepEquals, Emitter{Origin: "origin", ID: 42})
+	case <-time.After(time.Second):
+		c.Fatal("local handler not called")
+	}
+	close(release)
+}
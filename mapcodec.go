@@ -0,0 +1,169 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+// MapMarshaler is implemented by types that can convert themselves into the
+// map[string]interface{} form used by the structured hub. The map must be
+// the same as the one produced by marshalling the value to JSON and back,
+// so numbers are float64 values, slices are []interface{} and structures
+// are map[string]interface{}.
+//
+// The structured hub uses MarshalMap in preference to the Marshaller when
+// the hub is using the JSONMarshaller. Implementations are normally
+// generated by the pubsubgen tool rather than written by hand.
+type MapMarshaler interface {
+	MarshalMap() (map[string]interface{}, error)
+}
+
+// MapUnmarshaler is implemented by types that can set themselves from the
+// map[string]interface{} form used by the structured hub, following the
+// same rules as unmarshalling JSON.
+//
+// The structured hub uses UnmarshalMap in preference to the Marshaller
+// when the subscription is using the JSONMarshaller and the hub has no
+// DecodeHook.
+type MapUnmarshaler interface {
+	UnmarshalMap(map[string]interface{}) error
+}
+
+var mapUnmarshalerType = reflect.TypeOf((*MapUnmarshaler)(nil)).Elem()
+
+// The following functions are used by the code generated by the pubsubgen
+// tool. They are exported so the generated code can call them, and are not
+// expected to be useful elsewhere.
+
+// MapValue returns the value for the key, matching the key case
+// insensitively if there is no exact match, as JSON unmarshalling does.
+func MapValue(data map[string]interface{}, key string) (interface{}, bool) {
+	found, ok := findKey(data, key)
+	if !ok {
+		return nil, false
+	}
+	return data[found], true
+}
+
+// DecodeString returns the value as a string.
+func DecodeString(value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", errors.NotValidf("%T as string", value)
+	}
+	return s, nil
+}
+
+// DecodeBool returns the value as a bool.
+func DecodeBool(value interface{}) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, errors.NotValidf("%T as bool", value)
+	}
+	return b, nil
+}
+
+// DecodeFloat returns the value as a float that fits in bitSize bits.
+func DecodeFloat(value interface{}, bitSize int) (float64, error) {
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case float32:
+		f = float64(v)
+	case int:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+	case json.Number:
+		var err error
+		if f, err = v.Float64(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	default:
+		return 0, errors.NotValidf("%T as float%d", value, bitSize)
+	}
+	if bitSize == 32 && math.Abs(f) > math.MaxFloat32 {
+		return 0, errors.NotValidf("%v as float32", f)
+	}
+	return f, nil
+}
+
+// DecodeInt returns the value as an integer that fits in bitSize bits.
+func DecodeInt(value interface{}, bitSize int) (int64, error) {
+	f, err := DecodeFloat(value, 64)
+	if err != nil {
+		return 0, errors.NotValidf("%T as int%d", value, bitSize)
+	}
+	limit := math.Ldexp(1, bitSize-1)
+	if f != math.Trunc(f) || f < -limit || f >= limit {
+		return 0, errors.NotValidf("%v as int%d", f, bitSize)
+	}
+	return int64(f), nil
+}
+
+// DecodeUint returns the value as an unsigned integer that fits in bitSize
+// bits.
+func DecodeUint(value interface{}, bitSize int) (uint64, error) {
+	f, err := DecodeFloat(value, 64)
+	if err != nil {
+		return 0, errors.NotValidf("%T as uint%d", value, bitSize)
+	}
+	if f != math.Trunc(f) || f < 0 || f >= math.Ldexp(1, bitSize) {
+		return 0, errors.NotValidf("%v as uint%d", f, bitSize)
+	}
+	return uint64(f), nil
+}
+
+// EncodeValue converts a value that the generated code has no special
+// handling for into its map form by marshalling it to JSON and back.
+func EncodeValue(value interface{}) (interface{}, error) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result interface{}
+	if err := json.Unmarshal(bytes, &result); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// DecodeValue sets the target, which must be a pointer, from a value in
+// map form by marshalling it to JSON and back.
+func DecodeValue(value interface{}, target interface{}) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(json.Unmarshal(bytes, target))
+}
+
+// IsEmptyValue returns true if the value would be omitted from the JSON
+// encoding of a field with the omitempty option.
+func IsEmptyValue(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
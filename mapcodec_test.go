@@ -0,0 +1,188 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type MapCodecSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MapCodecSuite{})
+
+// mapPayload implements the map interfaces by hand, in the same way as
+// the code generated by pubsubgen, and counts the calls.
+type mapPayload struct {
+	Name string `json:"name"`
+}
+
+var mapCalls struct {
+	marshal   int
+	unmarshal int
+}
+
+func (p mapPayload) MarshalMap() (map[string]interface{}, error) {
+	mapCalls.marshal++
+	return map[string]interface{}{"name": p.Name}, nil
+}
+
+func (p *mapPayload) UnmarshalMap(data map[string]interface{}) error {
+	mapCalls.unmarshal++
+	value, ok := pubsub.MapValue(data, "name")
+	if !ok {
+		return errors.NotFoundf("name")
+	}
+	name, err := pubsub.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	p.Name = name
+	return nil
+}
+
+func (s *MapCodecSuite) SetUpTest(c *gc.C) {
+	s.LoggingCleanupSuite.SetUpTest(c)
+	mapCalls.marshal = 0
+	mapCalls.unmarshal = 0
+}
+
+func (*MapCodecSuite) TestStructuredHubUsesMapMethods(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan mapPayload, 1)
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data mapPayload, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, mapPayload{Name: "fred"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data.Name, gc.Equals, "fred")
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	c.Check(mapCalls.marshal, gc.Equals, 1)
+	c.Check(mapCalls.unmarshal, gc.Equals, 1)
+}
+
+func (*MapCodecSuite) TestOtherMarshallerIgnoresMapMethods(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		Marshaller: &yamlMarshaller{},
+	})
+	received := make(chan mapPayload, 1)
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data mapPayload, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, mapPayload{Name: "fred"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	c.Check(mapCalls.marshal, gc.Equals, 0)
+	c.Check(mapCalls.unmarshal, gc.Equals, 0)
+}
+
+func (*MapCodecSuite) TestDecodeLimits(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		DecodeLimits: pubsub.DecodeLimits{MaxSize: 20},
+	})
+	errs := make(chan error, 2)
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data mapPayload, err error) {
+		errs <- err
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, map[string]interface{}{"name": "fred"})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, map[string]interface{}{"name": strings.Repeat("x", 20)})
+	c.Assert(err, jc.ErrorIsNil)
+	for _, expected := range []string{"", "decode size limit of 20 exceeded"} {
+		select {
+		case err := <-errs:
+			if expected == "" {
+				c.Check(err, jc.ErrorIsNil)
+			} else {
+				c.Check(err, gc.ErrorMatches, expected)
+			}
+		case <-time.After(time.Second):
+			c.Fatal("handler not called")
+		}
+	}
+	// Only the message within the limit reaches UnmarshalMap.
+	c.Check(mapCalls.unmarshal, gc.Equals, 1)
+}
+
+func (*MapCodecSuite) TestMapValue(c *gc.C) {
+	data := map[string]interface{}{"Name": "exact", "other": 1}
+	value, ok := pubsub.MapValue(data, "Name")
+	c.Check(ok, jc.IsTrue)
+	c.Check(value, gc.Equals, "exact")
+	value, ok = pubsub.MapValue(data, "OTHER")
+	c.Check(ok, jc.IsTrue)
+	c.Check(value, gc.Equals, 1)
+	_, ok = pubsub.MapValue(data, "missing")
+	c.Check(ok, jc.IsFalse)
+}
+
+func (*MapCodecSuite) TestDecodeNumbers(c *gc.C) {
+	i, err := pubsub.DecodeInt(float64(-128), 8)
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(i, gc.Equals, int64(-128))
+	_, err = pubsub.DecodeInt(float64(128), 8)
+	c.Check(err, gc.ErrorMatches, "128 as int8 not valid")
+	_, err = pubsub.DecodeInt(1.5, 64)
+	c.Check(err, gc.ErrorMatches, "1.5 as int64 not valid")
+	_, err = pubsub.DecodeInt("1", 64)
+	c.Check(err, gc.ErrorMatches, "string as int64 not valid")
+
+	u, err := pubsub.DecodeUint(float64(65535), 16)
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(u, gc.Equals, uint64(65535))
+	_, err = pubsub.DecodeUint(float64(-1), 16)
+	c.Check(err, gc.ErrorMatches, "-1 as uint16 not valid")
+
+	f, err := pubsub.DecodeFloat(2, 64)
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(f, gc.Equals, float64(2))
+	_, err = pubsub.DecodeFloat(1e300, 32)
+	c.Check(err, gc.ErrorMatches, "1e\\+300 as float32 not valid")
+}
+
+func (*MapCodecSuite) TestEncodeDecodeValue(c *gc.C) {
+	value, err := pubsub.EncodeValue([]int{1, 2})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(value, jc.DeepEquals, []interface{}{float64(1), float64(2)})
+
+	var target []int
+	err = pubsub.DecodeValue(value, &target)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(target, jc.DeepEquals, []int{1, 2})
+}
+
+func (*MapCodecSuite) TestIsEmptyValue(c *gc.C) {
+	var nilPointer *int
+	for _, value := range []interface{}{nil, "", 0, false, []int{}, map[string]int{}, nilPointer} {
+		c.Check(pubsub.IsEmptyValue(value), jc.IsTrue, gc.Commentf("%#v", value))
+	}
+	for _, value := range []interface{}{"a", 1, true, []int{1}, struct{}{}} {
+		c.Check(pubsub.IsEmptyValue(value), jc.IsFalse, gc.Commentf("%#v", value))
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// mapPool holds the maps that the published data of a structured hub was
+// converted into, once the subscribers have finished with them, so they
+// can be reused for the data of the same type. Maps keep the space for
+// their entries when they are cleared, so reusing one for data of the same
+// type avoids growing a new map for every publish.
+type mapPool struct {
+	// pools holds a *sync.Pool for each type of data.
+	pools sync.Map
+}
+
+func newMapPool(enabled bool) *mapPool {
+	if !enabled {
+		return nil
+	}
+	return &mapPool{}
+}
+
+// get returns an empty map that was used for data of the type before, or
+// nil if there isn't one. A nil pool always returns nil.
+func (p *mapPool) get(rt reflect.Type) map[string]interface{} {
+	if p == nil {
+		return nil
+	}
+	pool, ok := p.pools.Load(rt)
+	if !ok {
+		return nil
+	}
+	m, _ := pool.(*sync.Pool).Get().(map[string]interface{})
+	return m
+}
+
+// put empties the map and keeps it for the next data of the type. Only the
+// map itself is reused, as the values in it may be shared with maps and
+// slices that were published.
+func (p *mapPool) put(rt reflect.Type, m map[string]interface{}) {
+	for key := range m {
+		delete(m, key)
+	}
+	pool, _ := p.pools.LoadOrStore(rt, new(sync.Pool))
+	pool.(*sync.Pool).Put(m)
+}
+
+// pooledData is the map form of a published message that goes back to the
+// pool once every publish of it has completed. A handler that publishes
+// the map it was given again, with the context it was given, delays the
+// map's return until that publish completes too.
+type pooledData struct {
+	data map[string]interface{}
+	refs int32
+
+	pool     *mapPool
+	dataType reflect.Type
+}
+
+type pooledDataKey struct{}
+
+// withPooledData returns a context for publishing the map, which was taken
+// from the pool for data of the type, that returns it to the pool once the
+// subscribers have finished with it.
+func (p *mapPool) withPooledData(ctx context.Context, rt reflect.Type, data map[string]interface{}) context.Context {
+	return context.WithValue(ctx, pooledDataKey{}, &pooledData{
+		data:     data,
+		pool:     p,
+		dataType: rt,
+	})
+}
+
+// acquirePooledData returns the pooledData of the context, holding a
+// reference to it until it is released, if the data being published is
+// its map. Otherwise it returns nil.
+func acquirePooledData(ctx context.Context, data interface{}) *pooledData {
+	pooled, ok := ctx.Value(pooledDataKey{}).(*pooledData)
+	if !ok {
+		return nil
+	}
+	m, ok := data.(map[string]interface{})
+	if !ok || !sameMap(m, pooled.data) {
+		return nil
+	}
+	atomic.AddInt32(&pooled.refs, 1)
+	return pooled
+}
+
+// release returns the map to the pool once the last reference to it is
+// released.
+func (p *pooledData) release() {
+	if atomic.AddInt32(&p.refs, -1) == 0 {
+		p.pool.put(p.dataType, p.data)
+	}
+}
+
+func sameMap(a, b map[string]interface{}) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// CopyData is a subscribe option for subscriptions that want to modify or
+// keep the data of the messages they are given. The subscription is given
+// its own copy of the map form of each message, including the maps and
+// slices nested in it, rather than the one shared with the other
+// subscribers. Other data is passed as it is. See
+// StructuredHubConfig.PoolMaps.
+func CopyData() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.copyData = true
+	}
+}
+
+// copyPooled is the internal subscribe option for subscribers, such as
+// those of channels, that keep the data after the handler returns. They are
+// given a copy of the data of the messages whose map is reused.
+func copyPooled() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.copyPooled = true
+	}
+}
+
+// copyCallData gives the call its own copy of the data, if the subscriber
+// asked for one. The calls are made for each subscriber, so only the data
+// they hold is replaced.
+func (s *subscriber) copyCallData(call *handlerCallback) {
+	if s.copyData || s.copyPooled && call.pooled {
+		call.data = copyValue(call.data)
+	}
+}
+
+// copyValue returns a deep copy of the maps and slices in the form that
+// structured data is unmarshalled into. Other values are returned as they
+// are.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = copyValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = copyValue(item)
+		}
+		return result
+	}
+	return value
+}
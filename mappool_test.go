@@ -0,0 +1,160 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type MapPoolSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MapPoolSuite{})
+
+// Optional has fields that are left out of its map form when they are
+// empty.
+type Optional struct {
+	A string   `json:"a,omitempty"`
+	B string   `json:"b,omitempty"`
+	C []string `json:"c,omitempty"`
+}
+
+func newPoolingHub() pubsub.StructuredHub {
+	return pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		PoolMaps: true,
+	})
+}
+
+// mapKeeper keeps the maps it is given.
+type mapKeeper struct {
+	mutex sync.Mutex
+	maps  []map[string]interface{}
+}
+
+func (k *mapKeeper) handle(_ pubsub.Topic, data map[string]interface{}, err error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.maps = append(k.maps, data)
+}
+
+func (k *mapKeeper) get() []map[string]interface{} {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return append([]map[string]interface{}(nil), k.maps...)
+}
+
+func (*MapPoolSuite) TestMapsReused(c *gc.C) {
+	hub := newPoolingHub()
+	seen := make(map[uintptr]bool)
+	reused := false
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data map[string]interface{}, err error) {
+		pointer := reflect.ValueOf(data).Pointer()
+		reused = reused || seen[pointer]
+		seen[pointer] = true
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	for i := 0; i < 20; i++ {
+		done, err := hub.Publish(topic, Emitter{ID: i})
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	c.Check(reused, jc.IsTrue)
+}
+
+func (*MapPoolSuite) TestReusedMapsEmptied(c *gc.C) {
+	hub := newPoolingHub()
+	var received []Optional
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Optional, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received = append(received, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	published := []Optional{{A: "a"}, {B: "b"}, {C: []string{"c"}}, {}}
+	for _, data := range published {
+		done, err := hub.Publish(topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	c.Check(received, jc.DeepEquals, published)
+}
+
+func (*MapPoolSuite) TestCopyData(c *gc.C) {
+	hub := newPoolingHub()
+	var keeper mapKeeper
+	_, err := hub.Subscribe(topic, keeper.handle, pubsub.CopyData())
+	c.Assert(err, jc.ErrorIsNil)
+	for _, data := range []Optional{{A: "a", C: []string{"c"}}, {B: "b"}} {
+		done, err := hub.Publish(topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	c.Check(keeper.get(), jc.DeepEquals, []map[string]interface{}{
+		{"a": "a", "c": []interface{}{"c"}},
+		{"b": "b"},
+	})
+}
+
+func (*MapPoolSuite) TestCopyDataNotPooled(c *gc.C) {
+	// The subscriber gets its own copy whether or not the maps are
+	// reused.
+	hub := pubsub.NewStructuredHub(nil)
+	var copied, shared mapKeeper
+	_, err := hub.Subscribe(topic, copied.handle, pubsub.CopyData())
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, shared.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	done, err := hub.Publish(topic, Optional{A: "a"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+
+	c.Assert(copied.get(), gc.HasLen, 1)
+	c.Assert(shared.get(), gc.HasLen, 1)
+	c.Check(copied.get()[0], jc.DeepEquals, shared.get()[0])
+	c.Check(reflect.ValueOf(copied.get()[0]).Pointer(), gc.Not(gc.Equals), reflect.ValueOf(shared.get()[0]).Pointer())
+}
+
+func (*MapPoolSuite) TestChannelsGetCopies(c *gc.C) {
+	hub := newPoolingHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(topic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	for _, data := range []Optional{{A: "a"}, {B: "b"}} {
+		done, err := hub.Publish(topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	for _, expected := range []map[string]interface{}{{"a": "a"}, {"b": "b"}} {
+		select {
+		case message := <-messages:
+			c.Check(message.Data, jc.DeepEquals, expected)
+		case <-time.After(time.Second):
+			c.Fatal("message not received")
+		}
+	}
+}
+
+func (*MapPoolSuite) TestPublishSerializedNotReused(c *gc.C) {
+	hub := newPoolingHub()
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	done, message, err := hub.PublishSerialized(context.Background(), topic, Optional{A: "a"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	for i := 0; i < 5; i++ {
+		done, err := hub.Publish(topic, Optional{B: "b"})
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"a": "a"})
+}
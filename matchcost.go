@@ -0,0 +1,124 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// matchCost records the time spent matching topics against the matcher of
+// a subscriber, for hubs configured with TrackMatchCost or SlowMatch.
+type matchCost struct {
+	// slow is the time a match can take before it is logged.
+	slow time.Duration
+
+	mutex   sync.Mutex
+	matches uint64
+	total   time.Duration
+	max     time.Duration
+	slowest uint64
+	warned  bool
+}
+
+// match returns true if the matcher of the subscriber matches the topic,
+// timing the match if the hub tracks the cost of matching.
+func (s *subscriber) match(topic Topic) bool {
+	if s.matchCost == nil {
+		return s.topicMatcher.Match(topic)
+	}
+	start := time.Now()
+	matched := s.topicMatcher.Match(topic)
+	s.matchCost.record(s, topic, time.Since(start))
+	return matched
+}
+
+func (m *matchCost) record(s *subscriber, topic Topic, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.matches++
+	m.total += elapsed
+	if elapsed > m.max {
+		m.max = elapsed
+	}
+	if m.slow <= 0 || elapsed <= m.slow {
+		return
+	}
+	m.slowest++
+	// Only the first slow match of each subscriber is logged, as a slow
+	// pattern is likely to be slow for every publish.
+	if !m.warned {
+		m.warned = true
+		logger.Warningf("subscriber %d matching %q against %s took %v, more than %v",
+			s.id, topic, describeMatcher(s.topicMatcher), elapsed, m.slow)
+	}
+}
+
+// matchCostTotals adds up the cost of matching for the subscribers with
+// the same pattern.
+type matchCostTotals struct {
+	matches uint64
+	total   time.Duration
+	max     time.Duration
+	slow    uint64
+}
+
+// matchCostReport returns the cost of matching for each pattern of the
+// subscribers, with the most expensive patterns first, or nil if the cost
+// isn't tracked.
+func matchCostReport(subscribers []*subscriber) []interface{} {
+	totals := make(map[string]*matchCostTotals)
+	for _, s := range subscribers {
+		if s.matchCost == nil {
+			continue
+		}
+		pattern := describeMatcher(s.topicMatcher)
+		t, ok := totals[pattern]
+		if !ok {
+			t = new(matchCostTotals)
+			totals[pattern] = t
+		}
+		s.matchCost.mutex.Lock()
+		t.matches += s.matchCost.matches
+		t.total += s.matchCost.total
+		if s.matchCost.max > t.max {
+			t.max = s.matchCost.max
+		}
+		t.slow += s.matchCost.slowest
+		s.matchCost.mutex.Unlock()
+	}
+	if len(totals) == 0 {
+		return nil
+	}
+	patterns := make([]string, 0, len(totals))
+	for pattern := range totals {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		ti, tj := totals[patterns[i]], totals[patterns[j]]
+		if ti.total != tj.total {
+			return ti.total > tj.total
+		}
+		return patterns[i] < patterns[j]
+	})
+	result := make([]interface{}, len(patterns))
+	for i, pattern := range patterns {
+		t := totals[pattern]
+		entry := map[string]interface{}{
+			"pattern": pattern,
+			"matches": t.matches,
+			"total":   t.total.String(),
+			"max":     t.max.String(),
+		}
+		if t.matches > 0 {
+			entry["mean"] = (t.total / time.Duration(t.matches)).String()
+		}
+		if t.slow > 0 {
+			entry["slow"] = t.slow
+		}
+		result[i] = entry
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type MatchCostSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MatchCostSuite{})
+
+// slowMatcher takes its time over every match.
+type slowMatcher struct{}
+
+func (slowMatcher) Match(pubsub.Topic) bool {
+	time.Sleep(5 * time.Millisecond)
+	return true
+}
+
+func (slowMatcher) String() string {
+	return "slow"
+}
+
+func (*MatchCostSuite) TestNotTracked(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	_, ok := hub.(pubsub.Reporter).Report()["match-costs"]
+	c.Check(ok, jc.IsFalse)
+}
+
+func (*MatchCostSuite) TestReport(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		TrackMatchCost: true,
+	})
+	handler := func(pubsub.Topic, interface{}) {}
+	_, err := hub.Subscribe(slowMatcher{}, handler)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(first, handler)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(first, handler)
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i := 0; i < 3; i++ {
+		_, err = hub.Publish(first, nil)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	costs := hub.(pubsub.Reporter).Report()["match-costs"].([]interface{})
+	c.Assert(costs, gc.HasLen, 2)
+
+	// The slow matcher isn't cached, so it is matched every time, and it
+	// is the most expensive.
+	slow := costs[0].(map[string]interface{})
+	c.Check(slow["pattern"], gc.Equals, "slow")
+	c.Check(slow["matches"], gc.Equals, uint64(3))
+	maxCost, err := time.ParseDuration(slow["max"].(string))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(maxCost >= 5*time.Millisecond, jc.IsTrue)
+	_, ok := slow["slow"]
+	c.Check(ok, jc.IsFalse)
+
+	// The subscribers with the same pattern are added together, and the
+	// topic is only matched until it is cached.
+	exact := costs[1].(map[string]interface{})
+	c.Check(exact["pattern"], gc.Equals, string(first))
+	c.Check(exact["matches"], gc.Equals, uint64(2))
+}
+
+func (*MatchCostSuite) TestSlowMatchWarning(c *gc.C) {
+	var tw loggo.TestWriter
+	c.Assert(loggo.RegisterWriter("match-cost-test", &tw), jc.ErrorIsNil)
+	defer loggo.RemoveWriter("match-cost-test")
+
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		SlowMatch: time.Millisecond,
+	})
+	_, err := hub.Subscribe(slowMatcher{}, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	for i := 0; i < 2; i++ {
+		_, err = hub.Publish(first, nil)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+
+	costs := hub.(pubsub.Reporter).Report()["match-costs"].([]interface{})
+	c.Assert(costs, gc.HasLen, 1)
+	c.Check(costs[0].(map[string]interface{})["slow"], gc.Equals, uint64(2))
+
+	// Only the first slow match is logged.
+	var warnings []string
+	for _, entry := range tw.Log() {
+		if entry.Level == loggo.WARNING {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	c.Assert(warnings, gc.HasLen, 1)
+	c.Check(warnings[0], gc.Matches, `subscriber 0 matching "first" against slow took .*, more than 1ms`)
+}
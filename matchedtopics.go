@@ -0,0 +1,72 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sort"
+)
+
+// maxMatchedTopics is the number of distinct topics recorded for each
+// subscriber. See Subscription.MatchedTopics.
+const maxMatchedTopics = 100
+
+// recordMatched records the topic of the call among the topics matched by
+// the subscriber. Barriers and the messages sent with a Handoff aren't
+// matched, so they aren't recorded. The mutex must be held.
+func (s *subscriber) recordMatched(call *handlerCallback) {
+	if call.barrier || call.direct {
+		return
+	}
+	if _, ok := s.matched[call.topic]; ok {
+		return
+	}
+	if len(s.matched) >= maxMatchedTopics {
+		s.matchedTruncated = true
+		return
+	}
+	if s.matched == nil {
+		s.matched = make(map[Topic]struct{})
+	}
+	s.matched[call.topic] = struct{}{}
+}
+
+// matchedTopics returns the topics recorded by recordMatched, in order.
+// The mutex must be held.
+func (s *subscriber) matchedTopics() []Topic {
+	if len(s.matched) == 0 {
+		return nil
+	}
+	topics := make([]Topic, 0, len(s.matched))
+	for topic := range s.matched {
+		topics = append(topics, topic)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i] < topics[j]
+	})
+	return topics
+}
+
+// reportMatched adds the matched topics to the report of the subscriber,
+// unless it is subscribed to a single topic. The mutex must be held.
+func (s *subscriber) reportMatched(result map[string]interface{}) {
+	topics := s.matchedTopics()
+	if _, exact := s.topicMatcher.(Topic); exact || topics == nil {
+		return
+	}
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = string(topic)
+	}
+	result["matched-topics"] = names
+	if s.matchedTruncated {
+		result["matched-topics-truncated"] = true
+	}
+}
+
+// MatchedTopics implements Subscription.
+func (h *handle) MatchedTopics() []Topic {
+	h.sub.mutex.Lock()
+	defer h.sub.mutex.Unlock()
+	return h.sub.matchedTopics()
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type MatchedTopicsSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MatchedTopicsSuite{})
+
+func (*MatchedTopicsSuite) TestMatchedTopics(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	sub, err := hub.Subscribe(pubsub.MatchRegex(`^unit\.`), func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(sub.MatchedTopics(), gc.HasLen, 0)
+	_, ok := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})["matched-topics"]
+	c.Check(ok, jc.IsFalse)
+
+	for _, topic := range []pubsub.Topic{"unit.started", "unit.removed", "unit.started", "machine.started"} {
+		done, err := hub.Publish(topic, nil)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	barrier, err := hub.(pubsub.Barrierer).Barrier("unit.barrier")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, barrier)
+
+	c.Check(sub.MatchedTopics(), jc.DeepEquals, []pubsub.Topic{"unit.removed", "unit.started"})
+	report := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})
+	c.Check(report["matched-topics"], jc.DeepEquals, []string{"unit.removed", "unit.started"})
+	_, ok = report["matched-topics-truncated"]
+	c.Check(ok, jc.IsFalse)
+}
+
+func (*MatchedTopicsSuite) TestBounded(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	sub, err := hub.Subscribe(pubsub.MatchAll, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	for i := 0; i < 150; i++ {
+		_, err := hub.Publish(pubsub.Topic(fmt.Sprintf("topic.%03d", i)), map[string]interface{}{})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	matched := sub.MatchedTopics()
+	c.Assert(matched, gc.HasLen, 100)
+	c.Check(matched[0], gc.Equals, pubsub.Topic("topic.000"))
+	c.Check(matched[99], gc.Equals, pubsub.Topic("topic.099"))
+	report := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"].(map[string]interface{})
+	c.Check(report["matched-topics-truncated"], gc.Equals, true)
+}
@@ -6,6 +6,7 @@ package pubsub
 import (
 	"fmt"
 	"regexp"
+	"strings"
 )
 
 // Match implements TopicMatcher. One topic matches another if they
@@ -14,6 +15,15 @@ func (t Topic) Match(topic Topic) bool {
 	return t == topic
 }
 
+// ExactMatch returns a topic matcher that matches only the topic, compared
+// as a plain string, so dots and the other characters that are special in
+// regular expressions don't need escaping. It is the same as using the
+// Topic itself as the matcher. The hubs find the subscribers to exact
+// topics with a map lookup, rather than by matching each of them.
+func ExactMatch(topic string) TopicMatcher {
+	return Topic(topic)
+}
+
 type regexMatcher struct {
 	match *regexp.Regexp
 }
@@ -23,6 +33,9 @@ type regexMatcher struct {
 // is to be able to do something like:
 //
 //     hub.Subscribe(pubsub.MatchRegex("prefix.*suffix"), handler)
+//
+// The parts of the topic captured by the groups of the expression are
+// passed to the handler, which gets them with CapturesFromContext.
 func MatchRegex(expression string) TopicMatcher {
 	matcher, err := regexp.Compile(expression)
 	if err != nil {
@@ -37,6 +50,11 @@ func (m *regexMatcher) Match(topic Topic) bool {
 	return m.match.MatchString(string(topic))
 }
 
+// String returns the regular expression used for matching.
+func (m *regexMatcher) String() string {
+	return m.match.String()
+}
+
 type allMatcher struct{}
 
 // Match implements TopicMatcher.  All topics match for the allMatcher.
@@ -44,5 +62,84 @@ func (*allMatcher) Match(topic Topic) bool {
 	return true
 }
 
+// String returns a description of the matcher.
+func (*allMatcher) String() string {
+	return "all topics"
+}
+
 // MatchAll is a topic matcher that matches all topics.
 var MatchAll TopicMatcher = (*allMatcher)(nil)
+
+type anyMatcher struct {
+	matchers []TopicMatcher
+}
+
+// MatchAny returns a topic matcher that matches a topic if any of the
+// matchers do. It allows a single subscription, with one queue and one
+// handler, to subscribe to several patterns, without combining them into a
+// single regular expression. For example:
+//
+//     hub.Subscribe(pubsub.MatchAny(
+//         pubsub.Topic("machine.added"),
+//         pubsub.MatchRegex("^unit\\."),
+//     ), handler)
+func MatchAny(matchers ...TopicMatcher) TopicMatcher {
+	return &anyMatcher{matchers: append([]TopicMatcher(nil), matchers...)}
+}
+
+// Match implements TopicMatcher.
+func (m *anyMatcher) Match(topic Topic) bool {
+	for _, matcher := range m.matchers {
+		if matcher.Match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a description of the matchers.
+func (m *anyMatcher) String() string {
+	descriptions := make([]string, len(m.matchers))
+	for i, matcher := range m.matchers {
+		descriptions[i] = describeMatcher(matcher)
+	}
+	return "any of [" + strings.Join(descriptions, ", ") + "]"
+}
+
+type prefixMatcher struct {
+	prefix string
+}
+
+// MatchPrefix returns a topic matcher that matches the topics that start
+// with the prefix, compared as a plain string, so "unit." matches
+// "unit.added" but not "units". It avoids the escaping that the same
+// match needs as a regular expression.
+func MatchPrefix(prefix string) TopicMatcher {
+	return &prefixMatcher{prefix: prefix}
+}
+
+// Match implements TopicMatcher.
+func (m *prefixMatcher) Match(topic Topic) bool {
+	return strings.HasPrefix(string(topic), m.prefix)
+}
+
+// String returns a description of the matcher.
+func (m *prefixMatcher) String() string {
+	return fmt.Sprintf("prefix %q", m.prefix)
+}
+
+// MatcherFunc is an adapter that allows an ordinary function to be used as
+// a TopicMatcher, for custom matching logic. For example:
+//
+//     hub.Subscribe(pubsub.MatcherFunc(func(topic pubsub.Topic) bool {
+//         return len(topic) < 10
+//     }), handler)
+//
+// The hubs can't tell whether the function always gives the same answer
+// for a topic, so the results aren't cached.
+type MatcherFunc func(Topic) bool
+
+// Match implements TopicMatcher by calling the function.
+func (f MatcherFunc) Match(topic Topic) bool {
+	return f(topic)
+}
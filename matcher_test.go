@@ -4,6 +4,8 @@
 package pubsub_test
 
 import (
+	"fmt"
+
 	"github.com/juju/pubsub"
 	"github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
@@ -31,6 +33,14 @@ func (*MatcherSuite) TestTopicMatches(c *gc.C) {
 	c.Assert(matcher.Match(space), jc.IsFalse)
 }
 
+func (*MatcherSuite) TestExactMatch(c *gc.C) {
+	matcher := pubsub.ExactMatch("first.next")
+	c.Assert(matcher.Match(firstdot), jc.IsTrue)
+	c.Assert(matcher.Match("firstXnext"), jc.IsFalse)
+	c.Assert(matcher.Match(first), jc.IsFalse)
+	c.Assert(matcher, gc.Equals, pubsub.TopicMatcher(firstdot))
+}
+
 func (*MatcherSuite) TestMatchAll(c *gc.C) {
 	matcher := pubsub.MatchAll
 	c.Assert(matcher.Match(first), jc.IsTrue)
@@ -50,3 +60,50 @@ func (*MatcherSuite) TestMatchRegex(c *gc.C) {
 	c.Assert(matcher.Match(second), jc.IsFalse)
 	c.Assert(matcher.Match(space), jc.IsFalse)
 }
+
+func (*MatcherSuite) TestMatchAny(c *gc.C) {
+	matcher := pubsub.MatchAny(second, pubsub.MatchRegex("^first"))
+	c.Assert(matcher.Match(first), jc.IsTrue)
+	c.Assert(matcher.Match(firstdot), jc.IsTrue)
+	c.Assert(matcher.Match(second), jc.IsTrue)
+	c.Assert(matcher.Match(space), jc.IsFalse)
+	c.Assert(pubsub.MatchAny().Match(first), jc.IsFalse)
+	c.Assert(matcher.(fmt.Stringer).String(), gc.Equals, "any of [second, ^first]")
+}
+
+func (*MatcherSuite) TestMatchAnySubscription(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder topicRecorder
+	sub, err := hub.Subscribe(pubsub.MatchAny(first, pubsub.MatchRegex("^first"), second), recorder.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	publishTopics(c, hub, first, firstdot, space, second)
+	c.Check(recorder.get(), jc.DeepEquals, []pubsub.Topic{first, firstdot, second})
+
+	results := hub.(pubsub.Explainer).Explain("frist")
+	c.Assert(results, gc.HasLen, 1)
+	c.Check(results[0].Pattern, gc.Equals, "any of [first, ^first, second]")
+	c.Check(results[0].NearMiss, gc.Equals, "first: edit distance of 2")
+}
+
+func (*MatcherSuite) TestMatchPrefix(c *gc.C) {
+	matcher := pubsub.MatchPrefix("first.")
+	c.Assert(matcher.Match(firstdot), jc.IsTrue)
+	c.Assert(matcher.Match("first.next.more"), jc.IsTrue)
+	c.Assert(matcher.Match(first), jc.IsFalse)
+	c.Assert(matcher.Match("firstXnext"), jc.IsFalse)
+	c.Assert(matcher.(fmt.Stringer).String(), gc.Equals, `prefix "first."`)
+}
+
+func (*MatcherSuite) TestMatcherFunc(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder topicRecorder
+	short := pubsub.MatcherFunc(func(topic pubsub.Topic) bool {
+		return len(topic) < 7
+	})
+	sub, err := hub.Subscribe(short, recorder.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	publishTopics(c, hub, first, firstdot, space, second)
+	c.Check(recorder.get(), jc.DeepEquals, []pubsub.Topic{first, second})
+}
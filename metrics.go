@@ -0,0 +1,68 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"time"
+)
+
+// Metrics is implemented by the metrics subsystem of the application, and
+// is given to a hub in its config. The hub calls it for each message its
+// subscribers handle or drop, passing the labels given to the subscription
+// with the WithLabels option, so the metrics can be grouped by the
+// component, worker or model that the subscription belongs to. The labels
+// map is shared and must not be modified.
+//
+// The methods are called from the subscriber goroutines, so they must be
+// safe for concurrent use and should not block.
+type Metrics interface {
+	// Delivered is called after a handler returns. The latency is the time
+	// between the message being queued for the subscriber and the handler
+	// returning.
+	Delivered(labels map[string]string, topic Topic, latency time.Duration)
+
+	// Dropped is called when a subscriber drops a message without calling
+	// its handler, either because the message was published with
+	// WithDropOnCancel and its context is done, or because the
+	// subscription was unsubscribed before it was handled.
+	Dropped(labels map[string]string, topic Topic)
+}
+
+// WithLabels is a subscribe option that attaches metric labels, such as
+// the component, worker or model, to the subscription. The labels are
+// passed to the Metrics of the hub, and are included in the hub Report.
+func WithLabels(labels map[string]string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.labels = make(map[string]string, len(labels))
+		for key, value := range labels {
+			o.labels[key] = value
+		}
+	}
+}
+
+// recordDelivered records that the handler returned for the call, with
+// the error it returned.
+func (s *subscriber) recordDelivered(call *handlerCallback, err error) {
+	outcome := OutcomeDelivered
+	if err != nil {
+		outcome = OutcomeFailed
+	}
+	s.receipts.add(s, call, outcome)
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.Delivered(s.labels, call.topic, time.Since(call.queued))
+}
+
+// recordDropped records that the call was dropped.
+func (s *subscriber) recordDropped(call *handlerCallback) {
+	if call.barrier {
+		return
+	}
+	s.errs.add(countDropped, false, time.Now())
+	s.receipts.add(s, call, OutcomeDropped)
+	if s.metrics != nil {
+		s.metrics.Dropped(s.labels, call.topic)
+	}
+}
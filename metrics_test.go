@@ -0,0 +1,157 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type MetricsSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MetricsSuite{})
+
+type metricEvent struct {
+	event  string
+	labels map[string]string
+	topic  pubsub.Topic
+}
+
+type metricsRecorder struct {
+	mu        sync.Mutex
+	events    []metricEvent
+	latencies []time.Duration
+}
+
+func (r *metricsRecorder) Delivered(labels map[string]string, topic pubsub.Topic, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, metricEvent{"delivered", labels, topic})
+	r.latencies = append(r.latencies, latency)
+}
+
+func (r *metricsRecorder) Dropped(labels map[string]string, topic pubsub.Topic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, metricEvent{"dropped", labels, topic})
+}
+
+func (r *metricsRecorder) get() []metricEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]metricEvent(nil), r.events...)
+}
+
+func (*MetricsSuite) TestDelivered(c *gc.C) {
+	metrics := &metricsRecorder{}
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Metrics: metrics})
+	labels := map[string]string{"component": "uniter", "model": "default"}
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {
+		time.Sleep(10 * veryShortTime)
+	}, pubsub.WithLabels(labels))
+	c.Assert(err, jc.ErrorIsNil)
+	// Changing the labels passed in doesn't affect the subscription.
+	labels["model"] = "changed"
+	_, err = hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+
+	result, err := hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+
+	// The subscribers are notified concurrently, so the events are put
+	// in order, with the labelled subscriber's first.
+	events := metrics.get()
+	sort.Slice(events, func(i, j int) bool {
+		return len(events[i].labels) > len(events[j].labels)
+	})
+	c.Check(events, jc.DeepEquals, []metricEvent{
+		{"delivered", map[string]string{"component": "uniter", "model": "default"}, topic},
+		{"delivered", nil, topic},
+	})
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	c.Check(metrics.latencies[0] >= 10*veryShortTime || metrics.latencies[1] >= 10*veryShortTime, jc.IsTrue)
+}
+
+func (*MetricsSuite) TestDroppedOnUnsubscribe(c *gc.C) {
+	metrics := &metricsRecorder{}
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Metrics: metrics})
+	labels := map[string]string{"worker": "logger"}
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle, pubsub.WithLabels(labels))
+	c.Assert(err, jc.ErrorIsNil)
+	first, err := hub.Publish(topic, "first")
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, handler)
+	_, err = hub.Publish(topic, "discarded")
+	c.Assert(err, jc.ErrorIsNil)
+	// Barriers aren't messages, so they aren't counted.
+	_, err = hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	sub.Unsubscribe()
+	close(handler.release)
+	waitComplete(c, first)
+
+	c.Check(metrics.get(), jc.DeepEquals, []metricEvent{
+		{"dropped", labels, topic},
+		{"delivered", labels, topic},
+	})
+}
+
+func (*MetricsSuite) TestDropCancelled(c *gc.C) {
+	metrics := &metricsRecorder{}
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Metrics: metrics})
+	labels := map[string]string{"worker": "logger"}
+	handler := newBlockingHandler()
+	_, err := hub.Subscribe(topic, handler.handle, pubsub.WithLabels(labels))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, "first")
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, handler)
+
+	ctx, cancel := context.WithCancel(pubsub.WithDropOnCancel(context.Background()))
+	result, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, "cancelled")
+	c.Assert(err, jc.ErrorIsNil)
+	cancel()
+	close(handler.release)
+	waitComplete(c, result)
+
+	c.Check(metrics.get(), jc.DeepEquals, []metricEvent{
+		{"delivered", labels, topic},
+		{"dropped", labels, topic},
+	})
+}
+
+func (*MetricsSuite) TestReport(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {},
+		pubsub.WithLabels(map[string]string{"component": "uniter"}))
+	c.Assert(err, jc.ErrorIsNil)
+	subscribers := hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})
+	c.Assert(subscribers["0"], jc.DeepEquals, map[string]interface{}{
+		"matcher":   "testing",
+		"pending":   0,
+		"delivered": uint64(0),
+		"labels":    map[string]interface{}{"component": "uniter"},
+	})
+}
+
+func waitComplete(c *gc.C, completer pubsub.Completer) {
+	select {
+	case <-completer.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+}
@@ -4,6 +4,7 @@
 package pubsub
 
 import (
+	"context"
 	"sync"
 
 	"github.com/juju/errors"
@@ -22,13 +23,14 @@ type Multiplexer interface {
 
 type element struct {
 	matcher  TopicMatcher
+	capture  CapturingMatcher
 	callback *structuredCallback
 }
 
 type multiplexer struct {
-	mu         sync.Mutex
-	outputs    []element
-	marshaller Marshaller
+	mu      sync.Mutex
+	outputs []element
+	decoder decoder
 }
 
 // NewMultiplexer creates a new multiplexer for the hub and subscribes it.
@@ -44,8 +46,16 @@ func NewMultiplexer(hub Hub) (Unsubscriber, Multiplexer, error) {
 	if !ok {
 		return nil, nil, errors.New("hub was not a StructuredHub")
 	}
-	mp := &multiplexer{marshaller: shub.marshaller}
-	unsub, err := hub.Subscribe(mp, mp.callback)
+	mp := &multiplexer{decoder: shub.decoder}
+	// The multiplexer decodes the data for its handlers itself, so its
+	// own handler takes the map form of the data even on a strict hub.
+	decoder := shub.decoder
+	decoder.strict = false
+	callback, err := newStructuredCallback(decoder, mp.callback)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	unsub, err := shub.simplehub.Subscribe(mp, callback.handler)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
@@ -56,15 +66,19 @@ func NewMultiplexer(hub Hub) (Unsubscriber, Multiplexer, error) {
 func (m *multiplexer) Add(matcher TopicMatcher, handler interface{}) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	callback, err := newStructuredCallback(m.marshaller, handler)
+	callback, err := newStructuredCallback(m.decoder, handler)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	m.outputs = append(m.outputs, element{matcher: matcher, callback: callback})
+	m.outputs = append(m.outputs, element{
+		matcher:  matcher,
+		capture:  capturingMatcher(matcher),
+		callback: callback,
+	})
 	return nil
 }
 
-func (m *multiplexer) callback(topic Topic, data map[string]interface{}, err error) {
+func (m *multiplexer) callback(ctx context.Context, topic Topic, data map[string]interface{}, err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	// Should never error here.
@@ -74,7 +88,12 @@ func (m *multiplexer) callback(topic Topic, data map[string]interface{}, err err
 	}
 	for _, element := range m.outputs {
 		if element.matcher.Match(topic) {
-			element.callback.handler(topic, data)
+			// The handlers share the subscription, so their errors are
+			// reported but never retried.
+			ctx := captureTopic(ctx, element.capture, topic)
+			if err := element.callback.handler(ctx, topic, data); err != nil {
+				reportSubscriberError(ctx, PhaseHandler, topic, err)
+			}
 		}
 	}
 }
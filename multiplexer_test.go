@@ -65,8 +65,8 @@ func (*MultiplexerHubSuite) TestMultiplexerAdd(c *gc.C) {
 			err:         "expected 3 args, got 2, incorrect handler signature not valid",
 		}, {
 			description: "bad return values in handler function",
-			handler:     func(pubsub.Topic, interface{}, error) error { return nil },
-			err:         "expected no return values, got 1, incorrect handler signature not valid",
+			handler:     func(pubsub.Topic, map[string]interface{}, error) bool { return false },
+			err:         "expected no return values or an error, incorrect handler signature not valid",
 		}, {
 			description: "bad first arg",
 			handler:     func(string, map[string]interface{}, error) {},
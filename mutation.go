@@ -0,0 +1,178 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// MutationError is the error reported when the data of a message was
+// changed by its subscribers. See SimpleHubConfig.DetectMutations.
+type MutationError struct {
+	Topic    Topic
+	Sequence uint64
+}
+
+// Error implements error.
+func (e *MutationError) Error() string {
+	return fmt.Sprintf("data of message %d on %q modified by a subscriber", e.Sequence, e.Topic)
+}
+
+// IsMutationError returns true if the cause of the error is a
+// *MutationError.
+func IsMutationError(err error) bool {
+	_, ok := errors.Cause(err).(*MutationError)
+	return ok
+}
+
+// frozen holds the checksum of the data of a message taken when it was
+// published.
+type frozen struct {
+	topic    Topic
+	sequence uint64
+	data     interface{}
+	sum      uint64
+}
+
+func freeze(topic Topic, sequence uint64, data interface{}) *frozen {
+	return &frozen{
+		topic:    topic,
+		sequence: sequence,
+		data:     data,
+		sum:      checksum(data),
+	}
+}
+
+// checkFrozen is called once all the subscribers have finished with the
+// message, and reports the message if its data has changed.
+func (h *simplehub) checkFrozen(f *frozen) {
+	if checksum(f.data) == f.sum {
+		return
+	}
+	err := &MutationError{Topic: f.topic, Sequence: f.sequence}
+	h.reportError(&HubError{
+		Phase:      PhaseHandler,
+		Topic:      f.topic,
+		Subscriber: NoSubscriber,
+		Err:        err,
+	})
+	if h.onMutation == nil {
+		panic(err)
+	}
+	h.onMutation(err)
+}
+
+// checksum returns a hash of the value, following pointers, so that it
+// changes if anything reachable from the value is changed.
+func checksum(data interface{}) uint64 {
+	hash := fnv.New64a()
+	w := checksumWriter{hash: hash, seen: make(map[uintptr]bool)}
+	w.write(reflect.ValueOf(data))
+	return hash.Sum64()
+}
+
+type checksumWriter struct {
+	hash hash.Hash64
+	// seen holds the pointers being followed, so cycles end.
+	seen map[uintptr]bool
+}
+
+func (w checksumWriter) uint(value uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], value)
+	w.hash.Write(buf[:])
+}
+
+func (w checksumWriter) string(value string) {
+	w.uint(uint64(len(value)))
+	w.hash.Write([]byte(value))
+}
+
+func (w checksumWriter) write(v reflect.Value) {
+	if !v.IsValid() {
+		w.uint(0)
+		return
+	}
+	w.uint(uint64(v.Kind()))
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			w.uint(1)
+		} else {
+			w.uint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.uint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		w.uint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		w.uint(math.Float64bits(real(v.Complex())))
+		w.uint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		w.string(v.String())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			w.write(v.Index(i))
+		}
+	case reflect.Slice:
+		w.uint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			w.write(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			w.write(v.Field(i))
+		}
+	case reflect.Map, reflect.Ptr:
+		if v.IsNil() {
+			w.uint(0)
+			return
+		}
+		if w.seen[v.Pointer()] {
+			w.uint(uint64(v.Pointer()))
+			return
+		}
+		w.seen[v.Pointer()] = true
+		if v.Kind() == reflect.Map {
+			w.writeMap(v)
+		} else {
+			w.write(v.Elem())
+		}
+		delete(w.seen, v.Pointer())
+	case reflect.Interface:
+		w.write(v.Elem())
+	default:
+		// Functions, channels and unsafe pointers can't be changed
+		// through the value, only replaced.
+		w.uint(uint64(v.Pointer()))
+	}
+}
+
+// writeMap hashes the entries of the map in an order that doesn't depend
+// on the iteration order of the map.
+func (w checksumWriter) writeMap(v reflect.Value) {
+	w.uint(uint64(v.Len()))
+	sums := make([]uint64, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		entry := checksumWriter{hash: fnv.New64a(), seen: w.seen}
+		entry.write(iter.Key())
+		entry.write(iter.Value())
+		sums = append(sums, entry.hash.Sum64())
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i] < sums[j] })
+	for _, sum := range sums {
+		w.uint(sum)
+	}
+}
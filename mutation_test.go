@@ -0,0 +1,128 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"sync"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type MutationSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MutationSuite{})
+
+// mutationRecorder records the mutations found by a hub.
+type mutationRecorder struct {
+	mutex     sync.Mutex
+	mutations []pubsub.MutationError
+}
+
+func (r *mutationRecorder) record(err *pubsub.MutationError) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.mutations = append(r.mutations, *err)
+}
+
+func (r *mutationRecorder) get() []pubsub.MutationError {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.mutations
+}
+
+type Node struct {
+	Name string
+	Next *Node
+}
+
+func (*MutationSuite) TestDetectsMutation(c *gc.C) {
+	var recorder mutationRecorder
+	var errs errorCollector
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		DetectMutations: true,
+		OnMutation:      recorder.record,
+		ErrorHandler:    errs.handle,
+	})
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data interface{}) {
+		data.(map[string]interface{})["seen"] = true
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(first, func(_ pubsub.Topic, data interface{}) {
+		// Reading the data is fine.
+		_ = data.(*Node).Next.Name
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	done, err := hub.Publish(first, &Node{Name: "a", Next: &Node{Name: "b"}})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(recorder.get(), gc.HasLen, 0)
+
+	done, err = hub.Publish(topic, map[string]interface{}{"value": 1})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(recorder.get(), jc.DeepEquals, []pubsub.MutationError{{Topic: topic, Sequence: 2}})
+	reported := errs.get()
+	c.Assert(reported, gc.HasLen, 1)
+	c.Check(reported[0].Phase, gc.Equals, pubsub.PhaseHandler)
+	c.Check(reported[0], jc.Satisfies, pubsub.IsMutationError)
+	c.Check(reported[0], gc.ErrorMatches, `handler "testing": data of message 2 on "testing" modified by a subscriber`)
+}
+
+func (*MutationSuite) TestDetectsMutationThroughPointers(c *gc.C) {
+	var recorder mutationRecorder
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		DetectMutations: true,
+		OnMutation:      recorder.record,
+	})
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data interface{}) {
+		data.(*Node).Next.Name = "changed"
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Cycles are followed once.
+	node := &Node{Name: "a", Next: &Node{Name: "b"}}
+	node.Next.Next = node
+	done, err := hub.Publish(topic, node)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(recorder.get(), gc.HasLen, 1)
+}
+
+func (*MutationSuite) TestStructuredHub(c *gc.C) {
+	var recorder mutationRecorder
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			DetectMutations: true,
+			OnMutation:      recorder.record,
+		},
+	})
+	// Handlers that take structures are given their own copy.
+	sub, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Emitter, err error) {
+		data.Origin = "changed"
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	done, err := hub.Publish(topic, Emitter{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(recorder.get(), gc.HasLen, 0)
+
+	// The structure subscriber is removed, so the mutating subscriber
+	// isn't racing it while it decodes the same map.
+	sub.Unsubscribe()
+	_, err = hub.Subscribe(topic, func(_ pubsub.Topic, data map[string]interface{}, err error) {
+		data["origin"] = "changed"
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	done, err = hub.Publish(topic, Emitter{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(recorder.get(), gc.HasLen, 1)
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// PublishErrorer is implemented by the Completers of structured hubs that
+// serialize messages in the background. See
+// StructuredHubConfig.SerializeWorkers.
+type PublishErrorer interface {
+	// PublishError returns the error that stopped the message from being
+	// published, once the Completer is complete. It is nil for messages
+	// that were published.
+	PublishError() error
+}
+
+// serializeOffload serializes the messages published on a structured hub
+// on other goroutines, and then publishes them in the order they were
+// handed over.
+type serializeOffload struct {
+	hub *structuredHub
+
+	// slots limits the number of messages being serialized at once.
+	slots chan struct{}
+
+	// last is closed once the last message handed over has been
+	// published, so the next one can be.
+	mutex sync.Mutex
+	last  chan struct{}
+}
+
+func newSerializeOffload(hub *structuredHub, workers int) *serializeOffload {
+	if workers <= 0 {
+		return nil
+	}
+	return &serializeOffload{
+		hub:   hub,
+		slots: make(chan struct{}, workers),
+	}
+}
+
+// offloadHandle is the Completer of a message that is published in the
+// background. It completes once the message has been published and the
+// Completer of the publish is complete.
+type offloadHandle struct {
+	done chan struct{}
+
+	// published and err are set before done is closed.
+	published Completer
+	err       error
+}
+
+// Complete implements Completer.
+func (h *offloadHandle) Complete() <-chan struct{} {
+	return h.done
+}
+
+// Dropped implements DropCounter.
+func (h *offloadHandle) Dropped() int {
+	select {
+	case <-h.done:
+	default:
+		return 0
+	}
+	if counter, ok := h.published.(DropCounter); ok {
+		return counter.Dropped()
+	}
+	return 0
+}
+
+// PublishError implements PublishErrorer.
+func (h *offloadHandle) PublishError() error {
+	select {
+	case <-h.done:
+		return h.err
+	default:
+		return nil
+	}
+}
+
+// publish serializes the data in the background, and publishes the
+// message after the messages handed over before it.
+func (o *serializeOffload) publish(ctx context.Context, topic Topic, data interface{}) Completer {
+	return o.handOver(func() (func() (Completer, error), error) {
+		ctx, message, err := o.hub.serializePooled(ctx, topic, data)
+		if err != nil {
+			return nil, err
+		}
+		return func() (Completer, error) {
+			published, _, err := o.hub.publishMessage(ctx, message)
+			return published, err
+		}, nil
+	})
+}
+
+// barrier queues the barrier after the messages handed over before it.
+func (o *serializeOffload) barrier(topic Topic) Completer {
+	return o.handOver(func() (func() (Completer, error), error) {
+		return func() (Completer, error) {
+			return o.hub.simplehub.Barrier(topic)
+		}, nil
+	})
+}
+
+// handOver runs the prepare function on another goroutine once a slot is
+// free, and then calls the function it returns after the functions
+// handed over before it have been called. Waiting for a slot blocks the
+// caller, which keeps the messages waiting to be serialized bounded.
+func (o *serializeOffload) handOver(prepare func() (func() (Completer, error), error)) Completer {
+	handle := &offloadHandle{done: make(chan struct{})}
+	published := make(chan struct{})
+	o.mutex.Lock()
+	previous := o.last
+	o.last = published
+	o.mutex.Unlock()
+
+	o.slots <- struct{}{}
+	go func() {
+		publish, err := prepare()
+		<-o.slots
+		if previous != nil {
+			<-previous
+		}
+		if err == nil {
+			handle.published, err = publish()
+		}
+		close(published)
+		handle.err = err
+		if handle.published != nil {
+			<-handle.published.Complete()
+		}
+		close(handle.done)
+	}()
+	return handle
+}
+
+// Barrier implements Barrierer. The barriers of hubs that serialize messages in
+// the background are queued after the messages published before them.
+func (h *structuredHub) Barrier(topic Topic) (Completer, error) {
+	if h.offload != nil {
+		return h.offload.barrier(topic), nil
+	}
+	return h.simplehub.Barrier(topic)
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type OffloadSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&OffloadSuite{})
+
+// SlowPayload blocks its serialization until it is released.
+type SlowPayload struct {
+	release chan struct{}
+}
+
+func (p SlowPayload) MarshalJSON() ([]byte, error) {
+	<-p.release
+	return []byte(`{"slow":true}`), nil
+}
+
+// BrokenPayload can't be serialized.
+type BrokenPayload struct{}
+
+func (BrokenPayload) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("broken")
+}
+
+func newOffloadHub(collector *errorCollector) pubsub.StructuredHub {
+	return pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			ErrorHandler: collector.handle,
+		},
+		SerializeWorkers: 4,
+	})
+}
+
+func (*OffloadSuite) TestPublishDoesNotWait(c *gc.C) {
+	hub := newOffloadHub(&errorCollector{})
+	received := make(chan map[string]interface{}, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	payload := SlowPayload{release: make(chan struct{})}
+	done, err := hub.Publish(topic, payload)
+	c.Assert(err, jc.ErrorIsNil)
+	checkNotComplete(c, done)
+
+	close(payload.release)
+	waitComplete(c, done)
+	select {
+	case data := <-received:
+		c.Check(data, jc.DeepEquals, map[string]interface{}{"slow": true})
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	c.Check(done.(pubsub.PublishErrorer).PublishError(), jc.ErrorIsNil)
+}
+
+func (*OffloadSuite) TestOrderKept(c *gc.C) {
+	hub := newOffloadHub(&errorCollector{})
+	var mutex sync.Mutex
+	var received []int
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data.ID)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		// Some of the messages take much longer to serialize.
+		message := Emitter{ID: i}
+		if i%10 == 0 {
+			message.Message = strings.Repeat("x", 1<<16)
+		}
+		_, err := hub.Publish(topic, message)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	barrier, err := hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, barrier)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.Assert(received, gc.HasLen, count)
+	for i, id := range received {
+		c.Check(id, gc.Equals, i)
+	}
+}
+
+func (*OffloadSuite) TestSerializeError(c *gc.C) {
+	collector := &errorCollector{}
+	hub := newOffloadHub(collector)
+	done, err := hub.Publish(topic, BrokenPayload{})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(done.(pubsub.PublishErrorer).PublishError(), gc.ErrorMatches, ".*broken")
+
+	reported := collector.get()
+	c.Assert(reported, gc.HasLen, 1)
+	c.Check(reported[0].Phase, gc.Equals, pubsub.PhaseSerialize)
+}
+
+func (*OffloadSuite) TestPublishSerializedNotOffloaded(c *gc.C) {
+	hub := newOffloadHub(&errorCollector{})
+	_, _, err := hub.PublishSerialized(context.Background(), topic, BrokenPayload{})
+	c.Check(err, gc.ErrorMatches, ".*broken")
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"time"
+)
+
+// SubscribeOption configures a single subscription. Options are passed as
+// the optional trailing arguments to the Subscribe method of a Hub.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	parallel   int
+	deliver    deliverRetained
+	marshaller Marshaller
+	name       string
+	durable    *DurableConfig
+	failover   *FailoverConfig
+	labels     map[string]string
+	retry      *RetryPolicy
+	warmUp     *time.Duration
+	accept     []string
+	queue      Queue
+	owner      interface{}
+	ownerDone  <-chan struct{}
+	timestamps *TimestampConfig
+	queueGroup *QueueGroupConfig
+	projection []string
+	priority   int
+	ledger     Ledger
+	copyData   bool
+	copyPooled bool
+}
+
+func newSubscribeOptions(options []SubscribeOption) subscribeOptions {
+	var result subscribeOptions
+	for _, option := range options {
+		option(&result)
+	}
+	return result
+}
+
+// Parallel allows up to n messages to be handled at the same time by the
+// subscription, as long as the messages were published with different
+// ordering keys (see WithOrderingKey). Messages with the same ordering key
+// are always handled one at a time in the order they were published.
+// Messages published without an ordering key are handled on their own,
+// after all the messages before them have been handled and before any
+// after them are started, so they retain the normal ordering guarantees.
+//
+// Values of n less than two leave the subscription handling one message at
+// a time.
+func Parallel(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.parallel = n
+	}
+}
+
+// WithMarshaller is a subscribe option for structured hubs that makes the
+// subscription use the marshaller to convert the published data into the
+// handler's structure, or into bytes for handlers that take a []byte,
+// instead of the hub's Marshaller. It is ignored by simple hubs.
+func WithMarshaller(marshaller Marshaller) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.marshaller = marshaller
+	}
+}
+
+// Named gives the subscription a name, which is included in the hub Report
+// and in the HubErrors reported for the subscription.
+func Named(name string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.name = name
+	}
+}
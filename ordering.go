@@ -0,0 +1,98 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+type orderingKey struct{}
+
+// WithOrderingKey returns a context that, when passed to PublishCtx, gives
+// the published message the ordering key. Subscriptions using the Parallel
+// option handle messages with the same ordering key one at a time, in the
+// order they were published, while messages with different keys may be
+// handled concurrently. This is similar to partition keys in other message
+// systems, and is typically used to keep the messages about a particular
+// entity in order without having to handle all messages serially.
+func WithOrderingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, orderingKey{}, key)
+}
+
+func orderingKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(orderingKey{}).(string)
+	return key
+}
+
+// workerBuffer is the number of calls that can be waiting for each worker
+// of a parallel subscriber before the dispatching loop blocks.
+const workerBuffer = 16
+
+// workers handle the keyed calls for a parallel subscriber. Calls with the
+// same key always go to the same worker, which keeps them in order.
+type workers struct {
+	calls  []chan *handlerCallback
+	active sync.WaitGroup
+}
+
+func (s *subscriber) startWorkers(count int) {
+	s.workers = &workers{}
+	for i := 0; i < count; i++ {
+		calls := make(chan *handlerCallback, workerBuffer)
+		s.workers.calls = append(s.workers.calls, calls)
+		go s.work(calls)
+	}
+}
+
+func (s *subscriber) work(calls <-chan *handlerCallback) {
+	goroutine := goroutineID()
+	for call := range calls {
+		select {
+		case <-s.done:
+			s.recordDropped(call)
+			call.done()
+		default:
+			call.goroutine = goroutine
+			s.execute(call)
+		}
+		s.workers.active.Done()
+	}
+}
+
+// dispatchParallel passes keyed calls to the appropriate worker. Calls
+// without a key wait for all the outstanding keyed calls to finish and are
+// then executed directly. It returns false if the subscriber was closed.
+func (s *subscriber) dispatchParallel(call *handlerCallback) bool {
+	if call.key == "" {
+		s.workers.active.Wait()
+		select {
+		case <-s.done:
+			s.recordDropped(call)
+			call.done()
+			return false
+		default:
+		}
+		return s.execute(call)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(call.key))
+	index := int(hash.Sum32() % uint32(len(s.workers.calls)))
+	s.workers.active.Add(1)
+	s.workers.calls[index] <- call
+	return true
+}
+
+func (s *subscriber) stopWorkers() {
+	if s.workers == nil {
+		return
+	}
+	// The loop is the only thing sending calls to the workers, and it is
+	// finished, so the channels can be closed. The workers mark any
+	// remaining calls done.
+	for _, calls := range s.workers.calls {
+		close(calls)
+	}
+}
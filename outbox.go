@@ -0,0 +1,208 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+)
+
+// OutboxMessage is a message published in an outbox transaction.
+type OutboxMessage struct {
+	// ID identifies the message, and is published as its
+	// MessageIDHeader, so subscribers made Idempotent skip it if it is
+	// replayed after it was published.
+	ID string `json:"id"`
+
+	Topic   Topic       `json:"topic"`
+	Data    interface{} `json:"data"`
+	Headers Headers     `json:"headers,omitempty"`
+}
+
+// OutboxConfig is the argument struct for NewOutbox.
+type OutboxConfig struct {
+	// Hub is the hub the messages are published on once their
+	// transaction has committed. It must implement ContextPublisher.
+	Hub Hub
+
+	// Published, if set, is called with the messages of each committed
+	// transaction, and of each Replay, once they have all been
+	// published. It is where the messages saved with the state change
+	// are marked as published or deleted, so they aren't replayed.
+	// Errors are logged, as the messages have already been published.
+	Published func(messages []OutboxMessage) error
+}
+
+// Validate checks that the config values are valid.
+func (config OutboxConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if _, ok := config.Hub.(ContextPublisher); !ok {
+		return errors.NotValidf("Hub %T without PublishCtx", config.Hub)
+	}
+	return nil
+}
+
+// Outbox publishes the messages that announce a state change only once the
+// change has been committed, so subscribers are never told about changes
+// that were rolled back. The messages are published in a transaction
+// function with OutboxTx.Publish, which holds them until the function
+// returns. The function makes the change in a transaction of its own, such
+// as a database transaction, and can write the messages from
+// OutboxTx.Messages in the same transaction, so that if the process stops
+// after the commit but before they are published they can be loaded and
+// given to Replay when it restarts. For example:
+//
+//	_, err := outbox.Transact(ctx, func(tx *pubsub.OutboxTx) error {
+//		return db.Run(func(txn *db.Txn) error {
+//			if err := txn.Insert(unit); err != nil {
+//				return err
+//			}
+//			if err := tx.Publish("unit.added", unit); err != nil {
+//				return err
+//			}
+//			return txn.Insert(outboxRecords(tx.Messages()))
+//		})
+//	})
+type Outbox struct {
+	config OutboxConfig
+	logger loggo.Logger
+}
+
+// NewOutbox returns an Outbox that publishes on the hub of the config.
+func NewOutbox(config OutboxConfig) (*Outbox, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Outbox{
+		config: config,
+		logger: loggo.GetLogger("pubsub.outbox"),
+	}, nil
+}
+
+// Transact calls the transaction function, and publishes the messages it
+// published with the OutboxTx, in order, if it returns nil. The function
+// must only return nil once its own transaction has committed. If it
+// returns an error or panics, the messages are discarded, and the error is
+// returned or the panic continues. The returned Completer completes once
+// all the messages have been delivered.
+//
+// If publishing a message fails, the messages after it aren't published,
+// so they can be replayed in order, and the error is returned.
+func (o *Outbox) Transact(ctx context.Context, txn func(tx *OutboxTx) error) (Completer, error) {
+	tx := &OutboxTx{}
+	err := func() error {
+		defer tx.finish()
+		return txn(tx)
+	}()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return o.publish(ctx, tx.messages)
+}
+
+// Replay publishes the messages, in order, that were saved by transactions
+// that committed but weren't published, such as when the process stopped
+// between the two. They keep their IDs, so subscribers made Idempotent
+// skip those that were published after all.
+func (o *Outbox) Replay(ctx context.Context, messages []OutboxMessage) (Completer, error) {
+	for _, message := range messages {
+		if message.ID == "" {
+			return nil, errors.NotValidf("message on %q without ID", message.Topic)
+		}
+	}
+	return o.publish(ctx, messages)
+}
+
+func (o *Outbox) publish(ctx context.Context, messages []OutboxMessage) (Completer, error) {
+	if len(messages) == 0 {
+		return completed(), nil
+	}
+	completers := make([]Completer, 0, len(messages))
+	for _, message := range messages {
+		headers := make(Headers, len(message.Headers)+1)
+		for key, value := range message.Headers {
+			headers[key] = value
+		}
+		headers[MessageIDHeader] = message.ID
+		done, err := PublishCtx(WithHeaders(ctx, headers), o.config.Hub, message.Topic, message.Data)
+		if err != nil {
+			return nil, errors.Annotatef(err, "publishing %q", message.Topic)
+		}
+		completers = append(completers, done)
+	}
+	if o.config.Published != nil {
+		if err := o.config.Published(messages); err != nil {
+			o.logger.Warningf("recording %d published messages: %v", len(messages), err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, completer := range completers {
+			<-completer.Complete()
+		}
+		close(done)
+	}()
+	return &doneHandle{done: done}, nil
+}
+
+// OutboxTx holds the messages published in an outbox transaction until it
+// commits. See Outbox.Transact.
+type OutboxTx struct {
+	mutex    sync.Mutex
+	messages []OutboxMessage
+	finished bool
+}
+
+// Publish adds a message on the topic to the transaction, to be published
+// once it commits.
+func (tx *OutboxTx) Publish(topic Topic, data interface{}) error {
+	return tx.PublishHeaders(topic, data, nil)
+}
+
+// PublishHeaders adds a message on the topic with the headers to the
+// transaction, to be published once it commits. The headers are copied.
+func (tx *OutboxTx) PublishHeaders(topic Topic, data interface{}, headers Headers) error {
+	id, err := newMessageID()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var copied Headers
+	if len(headers) > 0 {
+		copied = make(Headers, len(headers))
+		for key, value := range headers {
+			copied[key] = value
+		}
+	}
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if tx.finished {
+		return errors.Errorf("publishing %q after the outbox transaction finished", topic)
+	}
+	tx.messages = append(tx.messages, OutboxMessage{
+		ID:      id,
+		Topic:   topic,
+		Data:    data,
+		Headers: copied,
+	})
+	return nil
+}
+
+// Messages returns the messages published in the transaction so far, to be
+// saved in the same transaction as the state change.
+func (tx *OutboxTx) Messages() []OutboxMessage {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	return append([]OutboxMessage(nil), tx.messages...)
+}
+
+func (tx *OutboxTx) finish() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	tx.finished = true
+}
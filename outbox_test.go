@@ -0,0 +1,189 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type OutboxSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&OutboxSuite{})
+
+// outboxReceiver records the data and message IDs of the messages it is
+// given.
+type outboxReceiver struct {
+	mutex sync.Mutex
+	data  []interface{}
+	ids   []string
+}
+
+func (r *outboxReceiver) handle(ctx context.Context, _ pubsub.Topic, data interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.data = append(r.data, data)
+	r.ids = append(r.ids, pubsub.HeadersFromContext(ctx)[pubsub.MessageIDHeader])
+}
+
+func (r *outboxReceiver) get() ([]interface{}, []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]interface{}(nil), r.data...), append([]string(nil), r.ids...)
+}
+
+func (*OutboxSuite) newOutbox(c *gc.C, config pubsub.OutboxConfig) (*pubsub.Outbox, *outboxReceiver) {
+	if config.Hub == nil {
+		config.Hub = pubsub.NewSimpleHub()
+	}
+	var receiver outboxReceiver
+	_, err := config.Hub.Subscribe(pubsub.MatchAll, receiver.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	outbox, err := pubsub.NewOutbox(config)
+	c.Assert(err, jc.ErrorIsNil)
+	return outbox, &receiver
+}
+
+func (*OutboxSuite) TestValidate(c *gc.C) {
+	_, err := pubsub.NewOutbox(pubsub.OutboxConfig{})
+	c.Check(err, gc.ErrorMatches, "missing Hub not valid")
+}
+
+func (s *OutboxSuite) TestPublishedAfterCommit(c *gc.C) {
+	outbox, receiver := s.newOutbox(c, pubsub.OutboxConfig{})
+	var saved []pubsub.OutboxMessage
+	done, err := outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+		c.Check(tx.Publish(first, "one"), jc.ErrorIsNil)
+		c.Check(tx.Publish(second, "two"), jc.ErrorIsNil)
+		data, _ := receiver.get()
+		c.Check(data, gc.HasLen, 0)
+		saved = tx.Messages()
+		return nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+
+	data, ids := receiver.get()
+	c.Check(data, jc.DeepEquals, []interface{}{"one", "two"})
+	c.Assert(saved, gc.HasLen, 2)
+	c.Check(ids, jc.DeepEquals, []string{saved[0].ID, saved[1].ID})
+	c.Check(saved[0].ID, gc.Not(gc.Equals), saved[1].ID)
+}
+
+func (s *OutboxSuite) TestRolledBack(c *gc.C) {
+	outbox, receiver := s.newOutbox(c, pubsub.OutboxConfig{})
+	var late *pubsub.OutboxTx
+	_, err := outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+		c.Check(tx.Publish(first, "one"), jc.ErrorIsNil)
+		late = tx
+		return errors.New("conflict")
+	})
+	c.Assert(err, gc.ErrorMatches, "conflict")
+	c.Check(late.Publish(second, "two"), gc.ErrorMatches, `publishing "second" after the outbox transaction finished`)
+
+	c.Check(func() {
+		outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+			c.Check(tx.Publish(first, "three"), jc.ErrorIsNil)
+			panic("boom")
+		})
+	}, gc.PanicMatches, "boom")
+
+	done, err := outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+		return tx.Publish(first, "four")
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	data, _ := receiver.get()
+	c.Check(data, jc.DeepEquals, []interface{}{"four"})
+}
+
+func (s *OutboxSuite) TestHeaders(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	headers := make(chan pubsub.Headers, 1)
+	_, err := hub.Subscribe(topic, func(ctx context.Context, _ pubsub.Topic, _ interface{}) {
+		headers <- pubsub.HeadersFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	outbox, _ := s.newOutbox(c, pubsub.OutboxConfig{Hub: hub})
+	var id string
+	done, err := outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+		c.Check(tx.PublishHeaders(topic, "data", pubsub.Headers{"trace": "abc"}), jc.ErrorIsNil)
+		id = tx.Messages()[0].ID
+		return nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(<-headers, jc.DeepEquals, pubsub.Headers{
+		"trace":                "abc",
+		pubsub.MessageIDHeader: id,
+	})
+}
+
+func (s *OutboxSuite) TestPublishedHook(c *gc.C) {
+	var published [][]pubsub.OutboxMessage
+	outbox, _ := s.newOutbox(c, pubsub.OutboxConfig{
+		Published: func(messages []pubsub.OutboxMessage) error {
+			published = append(published, messages)
+			return errors.New("ignored")
+		},
+	})
+	var saved []pubsub.OutboxMessage
+	done, err := outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+		c.Check(tx.Publish(first, "one"), jc.ErrorIsNil)
+		saved = tx.Messages()
+		return nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	_, err = outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+		return errors.New("rolled back")
+	})
+	c.Assert(err, gc.NotNil)
+	c.Check(published, jc.DeepEquals, [][]pubsub.OutboxMessage{saved})
+}
+
+func (s *OutboxSuite) TestReplay(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var mutex sync.Mutex
+	var received []interface{}
+	_, err := hub.Subscribe(pubsub.MatchAll, func(_ pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data)
+	}, pubsub.Named("worker"), pubsub.Idempotent(pubsub.NewMemoryLedger(0)))
+	c.Assert(err, jc.ErrorIsNil)
+	outbox, err := pubsub.NewOutbox(pubsub.OutboxConfig{Hub: hub})
+	c.Assert(err, jc.ErrorIsNil)
+
+	var saved []pubsub.OutboxMessage
+	done, err := outbox.Transact(context.Background(), func(tx *pubsub.OutboxTx) error {
+		c.Check(tx.Publish(first, "one"), jc.ErrorIsNil)
+		saved = tx.Messages()
+		return nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+
+	// The saved message is replayed as though it may not have been
+	// published, along with one that wasn't.
+	saved = append(saved, pubsub.OutboxMessage{ID: "unpublished", Topic: second, Data: "two"})
+	done, err = outbox.Replay(context.Background(), saved)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	mutex.Lock()
+	c.Check(received, jc.DeepEquals, []interface{}{"one", "two"})
+	mutex.Unlock()
+
+	_, err = outbox.Replay(context.Background(), []pubsub.OutboxMessage{{Topic: first}})
+	c.Check(err, gc.ErrorMatches, `message on "first" without ID not valid`)
+}
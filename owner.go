@@ -0,0 +1,135 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// OwnedBy ties the lifetime of the subscription to an owner, as a safety
+// net for subscriptions that are never unsubscribed. If the owner becomes
+// unreachable and is garbage collected, or the done channel is closed,
+// while the subscription is still subscribed, the subscription is
+// unsubscribed and a leak warning is logged. Either of the owner or done
+// may be nil.
+//
+// The owner is watched with runtime.SetFinalizer, which brings its
+// constraints:
+//   - The owner must be a pointer to the start of an object allocated with
+//     new, a composite literal or make, such as a pointer to the struct of
+//     the component that subscribed. A pointer to a field of a struct or
+//     an element of a slice makes the runtime throw a fatal error, which
+//     can't be recovered.
+//   - Nothing else may set a finalizer on the owner, before or after it is
+//     passed to OwnedBy, as setting a second finalizer is also fatal.
+//   - Package level variables are never collected, and nor are objects of
+//     less than 16 bytes without pointers that share an allocation with
+//     others, so for those the owner does nothing.
+//
+// Only the done channel is free of these constraints.
+//
+// The hub holds on to the handler, so the owner is never collected if the
+// handler refers to it, such as when the handler is a method value of the
+// owner. Garbage collection happens at the runtime's convenience, so the
+// owner is only a last resort, and subscriptions should still be
+// unsubscribed explicitly.
+func OwnedBy(owner interface{}, done <-chan struct{}) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.owner = owner
+		o.ownerDone = done
+	}
+}
+
+// checkOwner returns an error if the owner can't have a finalizer.
+func checkOwner(owner interface{}) error {
+	if owner == nil {
+		return nil
+	}
+	if reflect.ValueOf(owner).Kind() != reflect.Ptr || reflect.ValueOf(owner).IsNil() {
+		return errors.NotValidf("owner of type %T", owner)
+	}
+	return nil
+}
+
+// owned holds the subscriptions of each owner that has a finalizer. The
+// owners are keyed by address so they are not kept reachable by the map.
+// An owner's entry is only removed when its finalizer runs, so the
+// finalizer is only ever set once.
+var owned = struct {
+	mutex   sync.Mutex
+	handles map[uintptr][]*handle
+}{
+	handles: make(map[uintptr][]*handle),
+}
+
+// own arranges for the subscription to be unsubscribed when its owner is
+// collected or its done channel is closed.
+func (h *handle) own(options subscribeOptions) {
+	if options.ownerDone != nil {
+		go func() {
+			select {
+			case <-options.ownerDone:
+				h.unsubscribeLeaked("its done channel was closed")
+			case <-h.sub.done:
+			}
+		}()
+	}
+	if options.owner == nil {
+		return
+	}
+	key := reflect.ValueOf(options.owner).Pointer()
+	owned.mutex.Lock()
+	defer owned.mutex.Unlock()
+	handles, exists := owned.handles[key]
+	// Forget the subscriptions that have been unsubscribed, so a long
+	// lived owner doesn't accumulate them.
+	live := handles[:0]
+	for _, existing := range handles {
+		if !existing.sub.isClosed() {
+			live = append(live, existing)
+		}
+	}
+	owned.handles[key] = append(live, h)
+	if !exists {
+		runtime.SetFinalizer(options.owner, func(interface{}) {
+			ownerCollected(key)
+		})
+	}
+}
+
+// ownerCollected unsubscribes the subscriptions of an owner that has been
+// garbage collected.
+func ownerCollected(key uintptr) {
+	owned.mutex.Lock()
+	handles := owned.handles[key]
+	delete(owned.handles, key)
+	owned.mutex.Unlock()
+	for _, h := range handles {
+		h.unsubscribeLeaked("its owner was garbage collected")
+	}
+}
+
+// unsubscribeLeaked unsubscribes the subscription if it is still
+// subscribed, and warns that it was leaked.
+func (h *handle) unsubscribeLeaked(reason string) {
+	if h.sub.isClosed() {
+		return
+	}
+	h.hub.logger.Warningf("subscription %d to %v leaked: unsubscribing as %s", h.sub.id, h.sub.topicMatcher, reason)
+	h.Unsubscribe()
+}
+
+// isClosed returns true once the subscriber has been unsubscribed.
+func (s *subscriber) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type OwnerSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&OwnerSuite{})
+
+type owner struct {
+	name string
+}
+
+func waitSubscriberCount(c *gc.C, hub pubsub.Hub, count int, gc func()) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if gc != nil {
+			gc()
+		}
+		if hub.(pubsub.Reporter).Report()["subscriber-count"] == count {
+			return
+		}
+	}
+	c.Fatalf("subscriber count not %d", count)
+}
+
+func (*OwnerSuite) TestInvalidOwner(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := func(pubsub.Topic, interface{}) {}
+	_, err := hub.Subscribe(topic, handler, pubsub.OwnedBy("owner", nil))
+	c.Check(err, gc.ErrorMatches, "owner of type string not valid")
+	var nilOwner *owner
+	_, err = hub.Subscribe(topic, handler, pubsub.OwnedBy(nilOwner, nil))
+	c.Check(err, gc.ErrorMatches, `owner of type \*pubsub_test.owner not valid`)
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+}
+
+func (*OwnerSuite) TestDoneClosed(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	done := make(chan struct{})
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {}, pubsub.OwnedBy(nil, done))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 1)
+
+	close(done)
+	waitSubscriberCount(c, hub, 0, nil)
+}
+
+func (*OwnerSuite) TestOwnerCollected(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := func(pubsub.Topic, interface{}) {}
+	subscribe := func() {
+		o := &owner{name: "worker"}
+		for i := 0; i < 2; i++ {
+			_, err := hub.Subscribe(topic, handler, pubsub.OwnedBy(o, nil))
+			c.Assert(err, jc.ErrorIsNil)
+		}
+	}
+	subscribe()
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 2)
+
+	waitSubscriberCount(c, hub, 0, runtime.GC)
+}
+
+func (*OwnerSuite) TestOwnerReachable(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	o := &owner{name: "worker"}
+	first, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {}, pubsub.OwnedBy(o, nil))
+	c.Assert(err, jc.ErrorIsNil)
+	// Unsubscribing doesn't stop the owner being used again.
+	first.Unsubscribe()
+	_, err = hub.Subscribe(topic, func(pubsub.Topic, interface{}) {}, pubsub.OwnedBy(o, nil))
+	c.Assert(err, jc.ErrorIsNil)
+
+	runtime.GC()
+	runtime.GC()
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 1)
+	runtime.KeepAlive(o)
+}
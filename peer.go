@@ -0,0 +1,120 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Headers set on the messages that transports such as bridges forward from
+// one hub to another. PeerOriginHeader is the ID of the hub the message was
+// first published on, PeerTransportHeader names the transport that last
+// forwarded it, and PeerHopsHeader counts the times it has been forwarded.
+const (
+	PeerOriginHeader    = "pubsub-peer-origin"
+	PeerTransportHeader = "pubsub-peer-transport"
+	PeerHopsHeader      = "pubsub-peer-hops"
+)
+
+// DefaultMaxHops is the number of times a message may be forwarded between
+// hubs when the transport doesn't configure its own limit.
+const DefaultMaxHops = 16
+
+// Peer describes where a forwarded message came from.
+type Peer struct {
+	// Origin is the ID of the hub the message was first published on.
+	Origin string
+
+	// Transport names the transport that last forwarded the message.
+	Transport string
+
+	// Hops is the number of times the message has been forwarded.
+	Hops int
+}
+
+// PeerFromContext returns where the message being handled came from. The
+// bool result is false if the message was published on the hub directly
+// rather than forwarded from another hub.
+func PeerFromContext(ctx context.Context) (Peer, bool) {
+	return peerFromHeaders(HeadersFromContext(ctx))
+}
+
+func peerFromHeaders(headers Headers) (Peer, bool) {
+	value, ok := headers[PeerHopsHeader]
+	if !ok {
+		return Peer{}, false
+	}
+	hops, err := strconv.Atoi(value)
+	if err != nil {
+		return Peer{}, false
+	}
+	return Peer{
+		Origin:    headers[PeerOriginHeader],
+		Transport: headers[PeerTransportHeader],
+		Hops:      hops,
+	}, true
+}
+
+// hubIdentity is implemented by the hubs of this package, so transports
+// can record the origin of the messages they forward.
+type hubIdentity interface {
+	hubID() string
+}
+
+// hubID returns the ID of the hub, see SimpleHubConfig.ID.
+func (h *simplehub) hubID() string {
+	return h.id
+}
+
+// newHubID returns a random ID for a hub that wasn't configured with one.
+func newHubID(h *simplehub) string {
+	id, err := newMessageID()
+	if err != nil {
+		return fmt.Sprintf("hub-%p", h)
+	}
+	return id
+}
+
+// forwardedHeaders returns the headers of a message being forwarded from
+// the source hub by the transport, with the peer headers set. Messages
+// first published on the source hub are given its ID as their origin, if
+// it has one, and messages without a PublishedAtHeader are given the time
+// they are forwarded. An error is returned if the message has already been
+// forwarded the maximum number of times, so messages can't circulate
+// forever around the loops of a mesh of hubs.
+func forwardedHeaders(source Hub, headers Headers, transport string, maxHops int) (Headers, error) {
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	var hops int
+	if value, ok := headers[PeerHopsHeader]; ok {
+		var err error
+		if hops, err = strconv.Atoi(value); err != nil {
+			return nil, errors.NotValidf("%s header %q", PeerHopsHeader, value)
+		}
+	}
+	if hops >= maxHops {
+		return nil, errors.Errorf("not forwarding message after %d hops", hops)
+	}
+	forwarded := make(Headers, len(headers)+4)
+	for key, value := range headers {
+		forwarded[key] = value
+	}
+	if _, ok := forwarded[PeerOriginHeader]; !ok {
+		if identity, ok := source.(hubIdentity); ok {
+			forwarded[PeerOriginHeader] = identity.hubID()
+		}
+	}
+	if _, ok := forwarded[PublishedAtHeader]; !ok {
+		forwarded[PublishedAtHeader] = formatPublishedAt(time.Now())
+	}
+	forwarded[PeerTransportHeader] = transport
+	forwarded[PeerHopsHeader] = strconv.Itoa(hops + 1)
+	return forwarded, nil
+}
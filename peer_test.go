@@ -0,0 +1,114 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type PeerSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&PeerSuite{})
+
+func bridgeAll(c *gc.C, source, target pubsub.Hub, config pubsub.BridgeConfig) pubsub.Bridge {
+	config.Source = source
+	config.Target = target
+	config.Rules = []pubsub.BridgeRule{{Name: "all", Matcher: pubsub.MatchAll}}
+	bridge, err := pubsub.NewBridge(config)
+	c.Assert(err, jc.ErrorIsNil)
+	return bridge
+}
+
+func (*PeerSuite) TestPeerFromContext(c *gc.C) {
+	source := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: "source"})
+	target := pubsub.NewStructuredHub(nil)
+	defer bridgeAll(c, source, target, pubsub.BridgeConfig{Transport: "websocket"}).Unsubscribe()
+
+	peers := make(chan pubsub.Peer, 2)
+	forwarded := make(chan bool, 2)
+	_, err := target.Subscribe(topic, func(ctx context.Context, _ pubsub.Topic, _ map[string]interface{}, _ error) {
+		peer, ok := pubsub.PeerFromContext(ctx)
+		peers <- peer
+		forwarded <- ok
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = source.Publish(topic, map[string]interface{}{"message": "hello"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(<-peers, jc.DeepEquals, pubsub.Peer{Origin: "source", Transport: "websocket", Hops: 1})
+	c.Check(<-forwarded, jc.IsTrue)
+
+	done, err := target.Publish(topic, map[string]interface{}{"message": "local"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(<-peers, jc.DeepEquals, pubsub.Peer{})
+	c.Check(<-forwarded, jc.IsFalse)
+}
+
+func (*PeerSuite) TestDefaultHubID(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	target := pubsub.NewSimpleHub()
+	defer bridgeAll(c, source, target, pubsub.BridgeConfig{}).Unsubscribe()
+	messages, closer := subscribeAll(c, target)
+	defer closer()
+
+	for i := 0; i < 2; i++ {
+		_, err := source.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	first := expectMessage(c, messages, topic).Delivery.Headers[pubsub.PeerOriginHeader]
+	second := expectMessage(c, messages, topic).Delivery.Headers[pubsub.PeerOriginHeader]
+	c.Check(first, gc.Not(gc.Equals), "")
+	c.Check(second, gc.Equals, first)
+}
+
+func (*PeerSuite) TestMaxHopsStopsLoops(c *gc.C) {
+	one := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: "one"})
+	two := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: "two"})
+	oneMessages, closer := subscribeAll(c, one)
+	defer closer()
+	twoMessages, closer := subscribeAll(c, two)
+	defer closer()
+	defer bridgeAll(c, one, two, pubsub.BridgeConfig{MaxHops: 4}).Unsubscribe()
+	defer bridgeAll(c, two, one, pubsub.BridgeConfig{MaxHops: 4}).Unsubscribe()
+
+	_, err := one.Publish(topic, "looping")
+	c.Assert(err, jc.ErrorIsNil)
+	var oneHops, twoHops []string
+	for i := 0; i < 3; i++ {
+		oneHops = append(oneHops, expectMessage(c, oneMessages, topic).Delivery.Headers[pubsub.PeerHopsHeader])
+	}
+	for i := 0; i < 2; i++ {
+		message := expectMessage(c, twoMessages, topic)
+		c.Check(message.Delivery.Headers[pubsub.PeerOriginHeader], gc.Equals, "one")
+		twoHops = append(twoHops, message.Delivery.Headers[pubsub.PeerHopsHeader])
+	}
+	c.Check(oneHops, jc.DeepEquals, []string{"", "2", "4"})
+	c.Check(twoHops, jc.DeepEquals, []string{"1", "3"})
+	expectNoMessage(c, oneMessages)
+	expectNoMessage(c, twoMessages)
+}
+
+func (*PeerSuite) TestInvalidHops(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	target := pubsub.NewSimpleHub()
+	defer bridgeAll(c, source, target, pubsub.BridgeConfig{}).Unsubscribe()
+	messages, closer := subscribeAll(c, target)
+	defer closer()
+
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{pubsub.PeerHopsHeader: "many"})
+	_, err := source.(pubsub.ContextPublisher).PublishCtx(ctx, topic, "bad")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = source.Publish(topic, "good")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(expectMessage(c, messages, topic).Data, gc.Equals, "good")
+}
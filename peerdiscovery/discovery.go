@@ -0,0 +1,405 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package peerdiscovery peers hubs with the other hubs on the network that
+// they find, such as with mDNS, connecting them with wire bridges.
+package peerdiscovery
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+
+	"github.com/juju/pubsub"
+)
+
+// HelloTopic is the topic of the frame that hubs peered by a Discovery
+// exchange when they connect, before any messages. The frame has the ID of
+// the hub that sends it in its pubsub.PeerOriginHeader.
+const HelloTopic = "pubsub.peer.hello"
+
+// Transport is the transport that a Discovery forwards messages with. All
+// its connections use the same transport, so messages received from one
+// peer are not forwarded to the others.
+const Transport = "peer"
+
+// DefaultDialTimeout is how long a Discovery waits for a peer to connect
+// and say hello, unless it is configured otherwise.
+const DefaultDialTimeout = 10 * time.Second
+
+// Service is a hub that can be peered with, as advertised and found by a
+// Discoverer.
+type Service struct {
+	// ID identifies the hub to its peers. See Config.ID.
+	ID string
+
+	// Address is the host and port that the hub accepts the connections
+	// of its peers on.
+	Address string
+}
+
+// Discoverer advertises hubs on a network and finds the hubs that others
+// have advertised. See NewMDNSDiscoverer.
+type Discoverer interface {
+	// Advertise advertises the service until the returned Unsubscriber
+	// is unsubscribed.
+	Advertise(service Service) (pubsub.Unsubscriber, error)
+
+	// Browse calls found with each service advertised on the network
+	// until the returned Unsubscriber is unsubscribed. A service may be
+	// found more than once, and found may be called concurrently.
+	Browse(found func(Service)) (pubsub.Unsubscriber, error)
+}
+
+// Config is the argument struct for New.
+type Config struct {
+	// Hub is the hub whose messages are exchanged with its peers.
+	Hub pubsub.Hub
+
+	// ID is the ID the hub is advertised with, and that it says hello
+	// to its peers with. It is usually the ID the hub was configured with,
+	// see pubsub.SimpleHubConfig.ID.
+	ID string
+
+	// Discoverer advertises the hub and finds its peers.
+	Discoverer Discoverer
+
+	// Listener accepts the connections of the peers. It is closed when
+	// the discovery stops. Use a TLS listener that requires client
+	// certificates, along with a Dial that presents one, for the peers to
+	// be authenticated. See Allowlist.
+	Listener net.Listener
+
+	// Address is the address advertised for the Listener, for when its
+	// own address isn't the one that peers can connect to. It defaults to
+	// the address of the Listener.
+	Address string
+
+	// Allowlist holds the IDs of the hubs that may be peered with. Hubs
+	// that aren't in it are ignored when they are found, and their
+	// connections are closed.
+	//
+	// The Allowlist is not a security boundary. The ID of a peer is the
+	// one it says hello with, which isn't authenticated, so anything that
+	// can connect to the Listener can claim an allowed ID and publish on
+	// the hub. It keeps the hubs of separate environments sharing a
+	// network apart, and nothing more.
+	Allowlist []string
+
+	// Forward matches the topics of the messages published on the hub
+	// that are sent to its peers. It defaults to pubsub.MatchAll.
+	Forward pubsub.TopicMatcher
+
+	// Dial connects to a peer at the address. It defaults to a TCP
+	// connection.
+	Dial func(address string) (io.ReadWriteCloser, error)
+
+	// DialTimeout is how long to wait for a peer to connect and say hello.
+	// It defaults to DefaultDialTimeout.
+	DialTimeout time.Duration
+}
+
+// Validate checks that the config has all the required values.
+func (config Config) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if config.ID == "" {
+		return errors.NotValidf("missing ID")
+	}
+	if config.Discoverer == nil {
+		return errors.NotValidf("missing Discoverer")
+	}
+	if config.Listener == nil {
+		return errors.NotValidf("missing Listener")
+	}
+	if len(config.Allowlist) == 0 {
+		return errors.NotValidf("empty Allowlist")
+	}
+	if config.DialTimeout < 0 {
+		return errors.NotValidf("negative DialTimeout")
+	}
+	return nil
+}
+
+// Discovery peers a hub with the other hubs on the network that are in its
+// allowlist, as they are found, so processes sharing a LAN, such as those
+// of a development environment, don't each need to be told where the
+// others are. The peers are connected with wire bridges (see
+// pubsub.NewWireBridge), and only the hub with the lower ID of each pair
+// dials the other, so there is one connection between them. A peer that
+// disconnects is connected again once it is found again.
+type Discovery struct {
+	config    Config
+	id        string
+	allowed   map[string]bool
+	logger    loggo.Logger
+	advertise pubsub.Unsubscriber
+	browse    pubsub.Unsubscriber
+
+	mutex    sync.Mutex
+	stopped  bool
+	peers    map[string]pubsub.Unsubscriber
+	pending  map[string]bool
+	finished sync.WaitGroup
+}
+
+// New advertises the hub with the Discoverer, and starts
+// peering with the hubs in the allowlist that it finds. Unsubscribe must
+// be called to stop it.
+func New(config Config) (*Discovery, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if config.Forward == nil {
+		config.Forward = pubsub.MatchAll
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = DefaultDialTimeout
+	}
+	if config.Address == "" {
+		config.Address = config.Listener.Addr().String()
+	}
+	d := &Discovery{
+		config:  config,
+		id:      config.ID,
+		allowed: make(map[string]bool),
+		logger:  loggo.GetLogger("pubsub.discovery"),
+		peers:   make(map[string]pubsub.Unsubscriber),
+		pending: make(map[string]bool),
+	}
+	for _, id := range config.Allowlist {
+		d.allowed[id] = true
+	}
+	if d.config.Dial == nil {
+		d.config.Dial = d.dialTCP
+	}
+
+	d.finished.Add(1)
+	go d.acceptLoop()
+	var err error
+	d.advertise, err = config.Discoverer.Advertise(Service{ID: d.id, Address: config.Address})
+	if err != nil {
+		d.Unsubscribe()
+		return nil, errors.Annotate(err, "advertising hub")
+	}
+	d.browse, err = config.Discoverer.Browse(d.found)
+	if err != nil {
+		d.Unsubscribe()
+		return nil, errors.Annotate(err, "browsing for peers")
+	}
+	return d, nil
+}
+
+// Peers returns the IDs of the hubs that are connected, in order.
+func (d *Discovery) Peers() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ids := make([]string, 0, len(d.peers))
+	for id := range d.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Unsubscribe implements pubsub.Unsubscriber. It stops advertising the hub
+// and finding its peers, closes the Listener, and disconnects the peers.
+func (d *Discovery) Unsubscribe() {
+	if d.browse != nil {
+		d.browse.Unsubscribe()
+	}
+	if d.advertise != nil {
+		d.advertise.Unsubscribe()
+	}
+	d.mutex.Lock()
+	d.stopped = true
+	peers := d.peers
+	d.peers = make(map[string]pubsub.Unsubscriber)
+	d.mutex.Unlock()
+	if err := d.config.Listener.Close(); err != nil {
+		d.logger.Debugf("closing listener: %v", err)
+	}
+	for _, bridge := range peers {
+		bridge.Unsubscribe()
+	}
+	d.finished.Wait()
+}
+
+// found dials the service if it is a peer that isn't connected, and this
+// hub is the one of the pair that dials.
+func (d *Discovery) found(service Service) {
+	if service.ID == d.id || !d.allowed[service.ID] || service.ID < d.id {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped || d.peers[service.ID] != nil || d.pending[service.ID] {
+		return
+	}
+	d.pending[service.ID] = true
+	d.finished.Add(1)
+	go func() {
+		defer d.finished.Done()
+		if err := d.dial(service); err != nil {
+			d.logger.Warningf("peering with %q at %s: %v", service.ID, service.Address, err)
+		}
+		d.mutex.Lock()
+		delete(d.pending, service.ID)
+		d.mutex.Unlock()
+	}()
+}
+
+func (d *Discovery) dial(service Service) error {
+	conn, err := d.config.Dial(service.Address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	setDeadline(conn, time.Now().Add(d.config.DialTimeout))
+	if err := d.hello(conn); err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	id, err := readHello(conn)
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	if id != service.ID {
+		conn.Close()
+		return errors.Errorf("peer says it is %q", id)
+	}
+	setDeadline(conn, time.Time{})
+	return errors.Trace(d.connected(id, conn))
+}
+
+func (d *Discovery) acceptLoop() {
+	defer d.finished.Done()
+	for {
+		conn, err := d.config.Listener.Accept()
+		if err != nil {
+			d.mutex.Lock()
+			stopped := d.stopped
+			d.mutex.Unlock()
+			if !stopped {
+				d.logger.Errorf("accepting peers: %v", err)
+			}
+			return
+		}
+		d.finished.Add(1)
+		go func() {
+			defer d.finished.Done()
+			if err := d.accept(conn); err != nil {
+				d.logger.Warningf("accepting peer from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (d *Discovery) accept(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(d.config.DialTimeout))
+	id, err := readHello(conn)
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	if !d.allowed[id] {
+		conn.Close()
+		return errors.NotValidf("peer %q not in allowlist", id)
+	}
+	if err := d.hello(conn); err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	conn.SetDeadline(time.Time{})
+	return errors.Trace(d.connected(id, conn))
+}
+
+// connected starts the bridge to the peer, unless it is already connected.
+func (d *Discovery) connected(id string, conn io.ReadWriteCloser) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		conn.Close()
+		return nil
+	}
+	if d.peers[id] != nil {
+		conn.Close()
+		return errors.AlreadyExistsf("peer %q", id)
+	}
+	// The peer is forgotten when its connection closes, so it is
+	// connected again when it is next found.
+	var bridge pubsub.Unsubscriber
+	watched := &peerConn{ReadWriteCloser: conn, closed: func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.peers[id] == bridge {
+			delete(d.peers, id)
+		}
+	}}
+	bridge, err := pubsub.NewWireBridge(pubsub.WireBridgeConfig{
+		Name:      id,
+		Hub:       d.config.Hub,
+		Conn:      watched,
+		Forward:   d.config.Forward,
+		Transport: Transport,
+	})
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	d.peers[id] = bridge
+	d.logger.Infof("peered with %q", id)
+	return nil
+}
+
+func (d *Discovery) hello(w io.Writer) error {
+	return pubsub.WriteWireFrame(w, pubsub.WireFrame{
+		Topic:   HelloTopic,
+		Headers: pubsub.Headers{pubsub.PeerOriginHeader: d.id},
+	})
+}
+
+func readHello(r io.Reader) (string, error) {
+	frame, err := pubsub.ReadWireFrame(r, 0)
+	if err != nil {
+		return "", errors.Annotate(err, "reading hello")
+	}
+	id := frame.Headers[pubsub.PeerOriginHeader]
+	if frame.Topic != HelloTopic || id == "" {
+		return "", errors.NotValidf("hello %q", frame.Topic)
+	}
+	return id, nil
+}
+
+func (d *Discovery) dialTCP(address string) (io.ReadWriteCloser, error) {
+	return net.DialTimeout("tcp", address, d.config.DialTimeout)
+}
+
+// setDeadline sets the deadline of the connection, if it has one.
+func setDeadline(conn io.ReadWriteCloser, t time.Time) {
+	if conn, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		conn.SetDeadline(t)
+	}
+}
+
+// peerConn is the connection of a bridge to a peer, which tells the
+// discovery when it is closed.
+type peerConn struct {
+	io.ReadWriteCloser
+
+	once   sync.Once
+	closed func()
+}
+
+// Close implements io.Closer.
+func (c *peerConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.once.Do(c.closed)
+	return err
+}
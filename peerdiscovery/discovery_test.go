@@ -0,0 +1,223 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package peerdiscovery_test
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/peerdiscovery"
+)
+
+type DiscoverySuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&DiscoverySuite{})
+
+const topic pubsub.Topic = "testing"
+
+// fakeDiscoverer finds the services advertised with it, as though they
+// were on the same network.
+type fakeDiscoverer struct {
+	mutex    sync.Mutex
+	services map[*peerdiscovery.Service]bool
+	browsers map[*func(peerdiscovery.Service)]bool
+}
+
+func newFakeDiscoverer() *fakeDiscoverer {
+	return &fakeDiscoverer{
+		services: make(map[*peerdiscovery.Service]bool),
+		browsers: make(map[*func(peerdiscovery.Service)]bool),
+	}
+}
+
+type unsubscribeFunc func()
+
+func (f unsubscribeFunc) Unsubscribe() {
+	f()
+}
+
+func (d *fakeDiscoverer) Advertise(service peerdiscovery.Service) (pubsub.Unsubscriber, error) {
+	d.mutex.Lock()
+	d.services[&service] = true
+	d.mutex.Unlock()
+	d.announce()
+	return unsubscribeFunc(func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		delete(d.services, &service)
+	}), nil
+}
+
+func (d *fakeDiscoverer) Browse(found func(peerdiscovery.Service)) (pubsub.Unsubscriber, error) {
+	d.mutex.Lock()
+	d.browsers[&found] = true
+	d.mutex.Unlock()
+	d.announce()
+	return unsubscribeFunc(func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		delete(d.browsers, &found)
+	}), nil
+}
+
+// announce tells every browser about every service, as they would be told
+// after the next interval of a real discoverer.
+func (d *fakeDiscoverer) announce() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for found := range d.browsers {
+		for service := range d.services {
+			(*found)(*service)
+		}
+	}
+}
+
+func (*DiscoverySuite) startPeer(c *gc.C, discoverer peerdiscovery.Discoverer, id string, allowlist ...string) (pubsub.Hub, *peerdiscovery.Discovery) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: id})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, jc.ErrorIsNil)
+	discovery, err := peerdiscovery.New(peerdiscovery.Config{
+		Hub:        hub,
+		ID:         id,
+		Discoverer: discoverer,
+		Listener:   listener,
+		Allowlist:  allowlist,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return hub, discovery
+}
+
+func waitPeers(c *gc.C, discovery *peerdiscovery.Discovery, expected ...string) {
+	if expected == nil {
+		expected = []string{}
+	}
+	deadline := time.After(5 * time.Second)
+	for {
+		peers := discovery.Peers()
+		if len(peers) == len(expected) {
+			c.Assert(peers, jc.DeepEquals, expected)
+			return
+		}
+		select {
+		case <-deadline:
+			c.Fatalf("peers %v, expected %v", peers, expected)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func receiveData(c *gc.C, messages <-chan pubsub.Message) interface{} {
+	select {
+	case message := <-messages:
+		return message.Data
+	case <-time.After(5 * time.Second):
+		c.Fatal("message not received")
+	}
+	return nil
+}
+
+func (*DiscoverySuite) TestValidate(c *gc.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, jc.ErrorIsNil)
+	defer listener.Close()
+	valid := peerdiscovery.Config{
+		Hub:        pubsub.NewSimpleHub(),
+		ID:         "hub",
+		Discoverer: newFakeDiscoverer(),
+		Listener:   listener,
+		Allowlist:  []string{"other"},
+	}
+	c.Check(valid.Validate(), jc.ErrorIsNil)
+	for i, test := range []struct {
+		change func(*peerdiscovery.Config)
+		err    string
+	}{{
+		change: func(config *peerdiscovery.Config) { config.Hub = nil },
+		err:    "missing Hub not valid",
+	}, {
+		change: func(config *peerdiscovery.Config) { config.ID = "" },
+		err:    "missing ID not valid",
+	}, {
+		change: func(config *peerdiscovery.Config) { config.Discoverer = nil },
+		err:    "missing Discoverer not valid",
+	}, {
+		change: func(config *peerdiscovery.Config) { config.Listener = nil },
+		err:    "missing Listener not valid",
+	}, {
+		change: func(config *peerdiscovery.Config) { config.Allowlist = nil },
+		err:    "empty Allowlist not valid",
+	}, {
+		change: func(config *peerdiscovery.Config) { config.DialTimeout = -time.Second },
+		err:    "negative DialTimeout not valid",
+	}} {
+		c.Logf("test %d", i)
+		config := valid
+		test.change(&config)
+		c.Check(config.Validate(), gc.ErrorMatches, test.err)
+	}
+}
+
+func (s *DiscoverySuite) TestPeered(c *gc.C) {
+	discoverer := newFakeDiscoverer()
+	hubA, discoveryA := s.startPeer(c, discoverer, "a", "b")
+	defer discoveryA.Unsubscribe()
+	hubB, discoveryB := s.startPeer(c, discoverer, "b", "a")
+	defer discoveryB.Unsubscribe()
+	waitPeers(c, discoveryA, "b")
+	waitPeers(c, discoveryB, "a")
+
+	fromA, closeA, err := hubA.(pubsub.ChanSubscriber).SubscribeChan(topic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closeA()
+	fromB, closeB, err := hubB.(pubsub.ChanSubscriber).SubscribeChan(topic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closeB()
+
+	_, err = hubA.Publish(topic, map[string]interface{}{"from": "a"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(receiveData(c, fromA), jc.DeepEquals, map[string]interface{}{"from": "a"})
+	c.Check(receiveData(c, fromB), jc.DeepEquals, map[string]interface{}{"from": "a"})
+
+	_, err = hubB.Publish(topic, map[string]interface{}{"from": "b"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(receiveData(c, fromB), jc.DeepEquals, map[string]interface{}{"from": "b"})
+	c.Check(receiveData(c, fromA), jc.DeepEquals, map[string]interface{}{"from": "b"})
+}
+
+func (s *DiscoverySuite) TestAllowlist(c *gc.C) {
+	discoverer := newFakeDiscoverer()
+	_, discoveryA := s.startPeer(c, discoverer, "a", "c")
+	defer discoveryA.Unsubscribe()
+	_, discoveryB := s.startPeer(c, discoverer, "b", "a")
+	defer discoveryB.Unsubscribe()
+	_, discoveryC := s.startPeer(c, discoverer, "c", "a")
+	defer discoveryC.Unsubscribe()
+
+	waitPeers(c, discoveryA, "c")
+	waitPeers(c, discoveryC, "a")
+	waitPeers(c, discoveryB)
+}
+
+func (s *DiscoverySuite) TestReconnected(c *gc.C) {
+	discoverer := newFakeDiscoverer()
+	_, discoveryA := s.startPeer(c, discoverer, "a", "b")
+	defer discoveryA.Unsubscribe()
+	_, discoveryB := s.startPeer(c, discoverer, "b", "a")
+	waitPeers(c, discoveryA, "b")
+
+	discoveryB.Unsubscribe()
+	waitPeers(c, discoveryA)
+
+	_, discoveryB = s.startPeer(c, discoverer, "b", "a")
+	defer discoveryB.Unsubscribe()
+	waitPeers(c, discoveryA, "b")
+}
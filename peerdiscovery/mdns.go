@@ -0,0 +1,546 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package peerdiscovery
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+
+	"github.com/juju/pubsub"
+)
+
+// DefaultMDNSService is the DNS-SD service type that hubs are advertised
+// as by an mDNS Discoverer unless it is configured otherwise.
+const DefaultMDNSService = "_pubsub._tcp"
+
+// DefaultMDNSInterval is how often an mDNS Discoverer announces the hubs
+// it advertises, and asks for the hubs of others, unless it is configured
+// otherwise.
+const DefaultMDNSInterval = 10 * time.Second
+
+// mdnsGroup is the IPv4 multicast group and port of mDNS.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSConfig is the argument struct for NewMDNSDiscoverer.
+type MDNSConfig struct {
+	// Service is the DNS-SD service type the hubs are advertised as,
+	// such as "_pubsub._tcp". Hubs only find those advertised as the same
+	// service, so separate environments sharing a LAN can use different
+	// services. It defaults to DefaultMDNSService.
+	Service string
+
+	// Interface is the network interface that mDNS messages are sent and
+	// received on. If it is nil, the system's default multicast interface
+	// is used.
+	Interface *net.Interface
+
+	// Interval is how often the hubs advertised are announced, and the
+	// network is asked for others. It defaults to DefaultMDNSInterval.
+	Interval time.Duration
+}
+
+// Validate checks that the config values are valid.
+func (config MDNSConfig) Validate() error {
+	if config.Service != "" {
+		labels := strings.Split(config.Service, ".")
+		if len(labels) != 2 || !strings.HasPrefix(labels[0], "_") ||
+			(labels[1] != "_tcp" && labels[1] != "_udp") {
+			return errors.NotValidf("Service %q", config.Service)
+		}
+	}
+	if config.Interval < 0 {
+		return errors.NotValidf("negative Interval")
+	}
+	return nil
+}
+
+type mdnsDiscoverer struct {
+	service  string
+	iface    *net.Interface
+	interval time.Duration
+	logger   loggo.Logger
+}
+
+// NewMDNSDiscoverer returns a Discoverer that advertises and finds hubs
+// with multicast DNS service discovery (DNS-SD over mDNS) on the local
+// network. Each hub is advertised as an instance of the service named by
+// its ID, with the ID and its address in its TXT record. An address with
+// no host, or an unspecified one, is found as the address that the
+// announcement came from.
+func NewMDNSDiscoverer(config MDNSConfig) (Discoverer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	d := &mdnsDiscoverer{
+		service:  config.Service,
+		iface:    config.Interface,
+		interval: config.Interval,
+		logger:   loggo.GetLogger("pubsub.mdns"),
+	}
+	if d.service == "" {
+		d.service = DefaultMDNSService
+	}
+	if d.interval == 0 {
+		d.interval = DefaultMDNSInterval
+	}
+	d.service += ".local."
+	return d, nil
+}
+
+// Advertise implements Discoverer.
+func (d *mdnsDiscoverer) Advertise(service Service) (pubsub.Unsubscriber, error) {
+	if service.ID == "" || len(service.ID) > 63 || strings.Contains(service.ID, ".") {
+		return nil, errors.NotValidf("ID %q for mDNS", service.ID)
+	}
+	if _, _, err := net.SplitHostPort(service.Address); err != nil {
+		return nil, errors.NotValidf("address %q", service.Address)
+	}
+	announcement, err := d.announcement(service).marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return d.run(func(conn *net.UDPConn) {
+		d.send(conn, announcement)
+	}, func(conn *net.UDPConn, message mdnsMessage, _ net.IP) {
+		if !message.response && message.asks(d.service) {
+			d.send(conn, announcement)
+		}
+	})
+}
+
+// Browse implements Discoverer.
+func (d *mdnsDiscoverer) Browse(found func(Service)) (pubsub.Unsubscriber, error) {
+	query, err := mdnsMessage{
+		questions: []mdnsQuestion{{name: d.service, qtype: mdnsTypePTR}},
+	}.marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return d.run(func(conn *net.UDPConn) {
+		d.send(conn, query)
+	}, func(_ *net.UDPConn, message mdnsMessage, source net.IP) {
+		if !message.response {
+			return
+		}
+		for _, service := range d.services(message, source) {
+			found(service)
+		}
+	})
+}
+
+// announcement returns the response that advertises the service.
+func (d *mdnsDiscoverer) announcement(service Service) mdnsMessage {
+	instance := service.ID + "." + d.service
+	_, port, _ := net.SplitHostPort(service.Address)
+	number, _ := strconv.ParseUint(port, 10, 16)
+	return mdnsMessage{
+		response: true,
+		records: []mdnsRecord{{
+			name:   d.service,
+			rtype:  mdnsTypePTR,
+			ttl:    mdnsTTL,
+			target: instance,
+		}, {
+			name:   instance,
+			rtype:  mdnsTypeSRV,
+			ttl:    mdnsTTL,
+			target: service.ID + ".local.",
+			port:   uint16(number),
+		}, {
+			name:  instance,
+			rtype: mdnsTypeTXT,
+			ttl:   mdnsTTL,
+			text:  []string{"id=" + service.ID, "addr=" + service.Address},
+		}},
+	}
+}
+
+// services returns the instances of the service in the response, which
+// came from the source.
+func (d *mdnsDiscoverer) services(message mdnsMessage, source net.IP) []Service {
+	type instance struct {
+		text []string
+		port uint16
+	}
+	instances := make(map[string]*instance)
+	var order []string
+	for _, record := range message.records {
+		if record.ttl == 0 || !strings.HasSuffix(record.name, "."+d.service) {
+			continue
+		}
+		if record.rtype != mdnsTypeTXT && record.rtype != mdnsTypeSRV {
+			continue
+		}
+		found := instances[record.name]
+		if found == nil {
+			found = &instance{}
+			instances[record.name] = found
+			order = append(order, record.name)
+		}
+		if record.rtype == mdnsTypeTXT {
+			found.text = record.text
+		} else {
+			found.port = record.port
+		}
+	}
+	var services []Service
+	for _, name := range order {
+		found := instances[name]
+		service := Service{ID: strings.TrimSuffix(name, "."+d.service)}
+		for _, text := range found.text {
+			if strings.HasPrefix(text, "id=") {
+				service.ID = text[len("id="):]
+			} else if strings.HasPrefix(text, "addr=") {
+				service.Address = text[len("addr="):]
+			}
+		}
+		if service.Address == "" && found.port != 0 {
+			service.Address = net.JoinHostPort("", strconv.Itoa(int(found.port)))
+		}
+		host, port, err := net.SplitHostPort(service.Address)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			service.Address = net.JoinHostPort(source.String(), port)
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+// run listens for mDNS messages, passing them to receive, and calls tick
+// straight away and then at each interval, until the returned
+// Unsubscriber is unsubscribed.
+func (d *mdnsDiscoverer) run(tick func(*net.UDPConn), receive func(*net.UDPConn, mdnsMessage, net.IP)) (pubsub.Unsubscriber, error) {
+	conn, err := net.ListenMulticastUDP("udp4", d.iface, mdnsGroup)
+	if err != nil {
+		return nil, errors.Annotate(err, "joining mDNS group")
+	}
+	if err := enableMulticastLoopback(conn); err != nil {
+		d.logger.Debugf("enabling mDNS loopback: %v", err)
+	}
+	r := &mdnsRunner{
+		conn: conn,
+		stop: make(chan struct{}),
+	}
+	r.finished.Add(2)
+	go func() {
+		defer r.finished.Done()
+		buf := make([]byte, mdnsMaxPacket)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				select {
+				case <-r.stop:
+				default:
+					d.logger.Errorf("receiving mDNS: %v", err)
+				}
+				return
+			}
+			message, err := parseMDNSMessage(buf[:n])
+			if err != nil {
+				d.logger.Tracef("ignoring mDNS message from %s: %v", from, err)
+				continue
+			}
+			receive(conn, message, from.IP)
+		}
+	}()
+	go func() {
+		defer r.finished.Done()
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			tick(conn)
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (d *mdnsDiscoverer) send(conn *net.UDPConn, packet []byte) {
+	if _, err := conn.WriteToUDP(packet, mdnsGroup); err != nil {
+		d.logger.Debugf("sending mDNS: %v", err)
+	}
+}
+
+type mdnsRunner struct {
+	conn     *net.UDPConn
+	stop     chan struct{}
+	once     sync.Once
+	finished sync.WaitGroup
+}
+
+// Unsubscribe implements pubsub.Unsubscriber.
+func (r *mdnsRunner) Unsubscribe() {
+	r.once.Do(func() {
+		close(r.stop)
+		r.conn.Close()
+	})
+	r.finished.Wait()
+}
+
+// The parts of DNS messages (RFC 1035) used by DNS-SD (RFC 6763) over
+// mDNS (RFC 6762).
+const (
+	mdnsTypePTR = 12
+	mdnsTypeTXT = 16
+	mdnsTypeSRV = 33
+	mdnsTypeANY = 255
+
+	mdnsClassIN = 1
+
+	// mdnsCacheFlush is set in the class of the records that only the
+	// responder has.
+	mdnsCacheFlush = 0x8000
+
+	// mdnsFlagsResponse marks a message as an authoritative response.
+	mdnsFlagsResponse = 0x8400
+
+	mdnsTTL       = 120
+	mdnsMaxPacket = 9000
+)
+
+type mdnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type mdnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+
+	// target is the name a PTR record points to, or the host of an SRV
+	// record, port is the port of an SRV record, and text holds the
+	// strings of a TXT record.
+	target string
+	port   uint16
+	text   []string
+}
+
+type mdnsMessage struct {
+	response  bool
+	questions []mdnsQuestion
+	records   []mdnsRecord
+}
+
+// asks returns true if the message has a question for the PTR records of
+// the name.
+func (m mdnsMessage) asks(name string) bool {
+	for _, question := range m.questions {
+		if strings.EqualFold(question.name, name) && (question.qtype == mdnsTypePTR || question.qtype == mdnsTypeANY) {
+			return true
+		}
+	}
+	return false
+}
+
+// marshal encodes the message, without compressing the names. The records
+// are all answers.
+func (m mdnsMessage) marshal() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	if m.response {
+		binary.BigEndian.PutUint16(b[2:], mdnsFlagsResponse)
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.records)))
+	var err error
+	for _, question := range m.questions {
+		if b, err = appendDNSName(b, question.name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		b = appendUint16(b, int(question.qtype))
+		b = appendUint16(b, mdnsClassIN)
+	}
+	for _, record := range m.records {
+		if b, err = appendDNSName(b, record.name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		class := mdnsClassIN
+		if record.rtype != mdnsTypePTR {
+			class |= mdnsCacheFlush
+		}
+		b = appendUint16(b, int(record.rtype))
+		b = appendUint16(b, class)
+		b = append(b, byte(record.ttl>>24), byte(record.ttl>>16), byte(record.ttl>>8), byte(record.ttl))
+		lengthAt := len(b)
+		b = append(b, 0, 0)
+		switch record.rtype {
+		case mdnsTypePTR:
+			b, err = appendDNSName(b, record.target)
+		case mdnsTypeSRV:
+			// The priority and weight are zero.
+			b = append(b, 0, 0, 0, 0)
+			b = appendUint16(b, int(record.port))
+			b, err = appendDNSName(b, record.target)
+		case mdnsTypeTXT:
+			for _, text := range record.text {
+				if len(text) > 255 {
+					return nil, errors.NotValidf("TXT string of %d bytes", len(text))
+				}
+				b = append(b, byte(len(text)))
+				b = append(b, text...)
+			}
+		default:
+			return nil, errors.NotSupportedf("record type %d", record.rtype)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		binary.BigEndian.PutUint16(b[lengthAt:], uint16(len(b)-lengthAt-2))
+	}
+	return b, nil
+}
+
+func appendUint16(b []byte, n int) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+// appendDNSName appends the name, such as "_pubsub._tcp.local.", as a
+// sequence of labels.
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			return nil, errors.NotValidf("DNS label %q", label)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// parseMDNSMessage decodes the questions of a message, and the PTR, SRV
+// and TXT records of all its sections. Other records are skipped.
+func parseMDNSMessage(b []byte) (mdnsMessage, error) {
+	if len(b) < 12 {
+		return mdnsMessage{}, errors.NotValidf("truncated message")
+	}
+	message := mdnsMessage{
+		response: b[2]&0x80 != 0,
+	}
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	records := 0
+	for i := 6; i < 12; i += 2 {
+		records += int(binary.BigEndian.Uint16(b[i:]))
+	}
+	offset := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readDNSName(b, offset)
+		if err != nil {
+			return mdnsMessage{}, errors.Trace(err)
+		}
+		if next+4 > len(b) {
+			return mdnsMessage{}, errors.NotValidf("truncated question")
+		}
+		message.questions = append(message.questions, mdnsQuestion{
+			name:  name,
+			qtype: binary.BigEndian.Uint16(b[next:]),
+		})
+		offset = next + 4
+	}
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(b, offset)
+		if err != nil {
+			return mdnsMessage{}, errors.Trace(err)
+		}
+		if next+10 > len(b) {
+			return mdnsMessage{}, errors.NotValidf("truncated record")
+		}
+		record := mdnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(b[next:]),
+			ttl:   binary.BigEndian.Uint32(b[next+4:]),
+		}
+		start := next + 10
+		end := start + int(binary.BigEndian.Uint16(b[next+8:]))
+		if end > len(b) {
+			return mdnsMessage{}, errors.NotValidf("truncated record")
+		}
+		offset = end
+		switch record.rtype {
+		case mdnsTypePTR:
+			if record.target, _, err = readDNSName(b, start); err != nil {
+				return mdnsMessage{}, errors.Trace(err)
+			}
+		case mdnsTypeSRV:
+			if end-start < 7 {
+				return mdnsMessage{}, errors.NotValidf("truncated SRV record")
+			}
+			record.port = binary.BigEndian.Uint16(b[start+4:])
+			if record.target, _, err = readDNSName(b, start+6); err != nil {
+				return mdnsMessage{}, errors.Trace(err)
+			}
+		case mdnsTypeTXT:
+			for at := start; at < end; {
+				length := int(b[at])
+				if at+1+length > end {
+					return mdnsMessage{}, errors.NotValidf("truncated TXT record")
+				}
+				if length > 0 {
+					record.text = append(record.text, string(b[at+1:at+1+length]))
+				}
+				at += 1 + length
+			}
+		default:
+			continue
+		}
+		message.records = append(message.records, record)
+	}
+	return message, nil
+}
+
+// readDNSName reads the name at the offset of the message, following any
+// compression pointers, and returns it with a trailing dot, along with
+// the offset after it.
+func readDNSName(b []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(b) {
+			return "", 0, errors.NotValidf("truncated name")
+		}
+		length := int(b[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(b) {
+				return "", 0, errors.NotValidf("truncated name")
+			}
+			if jumps++; jumps > 10 {
+				return "", 0, errors.NotValidf("name with too many pointers")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(b[offset:]) & 0x3fff)
+		case length > 63:
+			return "", 0, errors.NotValidf("label of %d bytes", length)
+		default:
+			if offset+1+length > len(b) {
+				return "", 0, errors.NotValidf("truncated name")
+			}
+			labels = append(labels, string(b[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package peerdiscovery
+
+import (
+	"net"
+)
+
+// enableMulticastLoopback leaves the connection as it is on platforms
+// where the socket option isn't set, so only hubs on other hosts are
+// found.
+func enableMulticastLoopback(conn *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package peerdiscovery
+
+import (
+	"encoding/hex"
+	"net"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type MDNSSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MDNSSuite{})
+
+func (*MDNSSuite) newDiscoverer(c *gc.C) *mdnsDiscoverer {
+	d, err := NewMDNSDiscoverer(MDNSConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	return d.(*mdnsDiscoverer)
+}
+
+func (*MDNSSuite) TestValidate(c *gc.C) {
+	for i, test := range []struct {
+		config MDNSConfig
+		err    string
+	}{{
+		config: MDNSConfig{Service: "_dev._tcp"},
+	}, {
+		config: MDNSConfig{Service: "dev._tcp"},
+		err:    `Service "dev._tcp" not valid`,
+	}, {
+		config: MDNSConfig{Service: "_dev._sctp"},
+		err:    `Service "_dev._sctp" not valid`,
+	}, {
+		config: MDNSConfig{Interval: -1},
+		err:    "negative Interval not valid",
+	}} {
+		c.Logf("test %d", i)
+		err := test.config.Validate()
+		if test.err == "" {
+			c.Check(err, jc.ErrorIsNil)
+		} else {
+			c.Check(err, gc.ErrorMatches, test.err)
+		}
+	}
+}
+
+func (s *MDNSSuite) TestAnnouncementRoundTrip(c *gc.C) {
+	d := s.newDiscoverer(c)
+	announcement := d.announcement(Service{ID: "hub-a", Address: "10.0.0.1:7000"})
+	packet, err := announcement.marshal()
+	c.Assert(err, jc.ErrorIsNil)
+	parsed, err := parseMDNSMessage(packet)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(parsed, jc.DeepEquals, announcement)
+
+	services := d.services(parsed, net.ParseIP("10.0.0.9"))
+	c.Check(services, jc.DeepEquals, []Service{{ID: "hub-a", Address: "10.0.0.1:7000"}})
+}
+
+func (s *MDNSSuite) TestUnspecifiedHost(c *gc.C) {
+	d := s.newDiscoverer(c)
+	for _, address := range []string{":7000", "0.0.0.0:7000", "[::]:7000"} {
+		services := d.services(d.announcement(Service{ID: "hub-a", Address: address}), net.ParseIP("10.0.0.9"))
+		c.Check(services, jc.DeepEquals, []Service{{ID: "hub-a", Address: "10.0.0.9:7000"}}, gc.Commentf("address %q", address))
+	}
+}
+
+func (s *MDNSSuite) TestQuery(c *gc.C) {
+	d := s.newDiscoverer(c)
+	packet, err := mdnsMessage{
+		questions: []mdnsQuestion{{name: d.service, qtype: mdnsTypePTR}},
+	}.marshal()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(hex.EncodeToString(packet), gc.Equals, "000000000001000000000000"+
+		"075f707562737562045f746370056c6f63616c00"+"000c"+"0001")
+	parsed, err := parseMDNSMessage(packet)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(parsed.response, jc.IsFalse)
+	c.Check(parsed.asks("_pubsub._tcp.local."), jc.IsTrue)
+	c.Check(parsed.asks("_other._tcp.local."), jc.IsFalse)
+}
+
+func (s *MDNSSuite) TestCompressedNames(c *gc.C) {
+	d := s.newDiscoverer(c)
+	// A response from another responder, with the instance name of the
+	// SRV and TXT records compressed to point at the PTR target, and an A
+	// record that is skipped.
+	packet := "000084000000000400000000" +
+		// PTR _pubsub._tcp.local. -> hub-b._pubsub._tcp.local.
+		"075f707562737562045f746370056c6f63616c00" + "000c0001" + "00000078" + "0008" +
+		"056875622d62c00c" +
+		// SRV, named with a pointer to the PTR target at offset 42.
+		"c02a" + "00218001" + "00000078" + "000e" + "00000000" + "1b58" + "056875622d62c019" +
+		// TXT with no address, so the SRV port is used.
+		"c02a" + "00108001" + "00000078" + "0009" + "0869643d6875622d62" +
+		// A record.
+		"c02a" + "00018001" + "00000078" + "0004" + "0a000002"
+	b, err := hex.DecodeString(packet)
+	c.Assert(err, jc.ErrorIsNil)
+	parsed, err := parseMDNSMessage(b)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(parsed.records, gc.HasLen, 3)
+	c.Check(parsed.records[0].target, gc.Equals, "hub-b._pubsub._tcp.local.")
+	c.Check(parsed.records[1].name, gc.Equals, "hub-b._pubsub._tcp.local.")
+	c.Check(parsed.records[1].target, gc.Equals, "hub-b.local.")
+	c.Check(d.services(parsed, net.ParseIP("10.0.0.2")), jc.DeepEquals, []Service{{ID: "hub-b", Address: "10.0.0.2:7000"}})
+}
+
+func (*MDNSSuite) TestInvalidMessages(c *gc.C) {
+	for i, test := range []struct {
+		packet string
+		err    string
+	}{{
+		packet: "0000",
+		err:    "truncated message not valid",
+	}, {
+		packet: "000000000001000000000000" + "05616263",
+		err:    "truncated name not valid",
+	}, {
+		packet: "000000000001000000000000" + "c00c",
+		err:    "name with too many pointers not valid",
+	}, {
+		packet: "000084000000000100000000" + "00" + "000c0001" + "00000078" + "0010" + "00",
+		err:    "truncated record not valid",
+	}} {
+		c.Logf("test %d", i)
+		b, err := hex.DecodeString(test.packet)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = parseMDNSMessage(b)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (s *MDNSSuite) TestAdvertiseInvalid(c *gc.C) {
+	d := s.newDiscoverer(c)
+	_, err := d.Advertise(Service{ID: "a.b", Address: "10.0.0.1:7000"})
+	c.Check(err, gc.ErrorMatches, `ID "a.b" for mDNS not valid`)
+	_, err = d.Advertise(Service{ID: "a", Address: "nowhere"})
+	c.Check(err, gc.ErrorMatches, `address "nowhere" not valid`)
+}
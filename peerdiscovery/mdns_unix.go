@@ -0,0 +1,33 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package peerdiscovery
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// enableMulticastLoopback has the messages sent to the multicast group on
+// the connection delivered to the other sockets of the host in the group,
+// which ListenMulticastUDP turns off, so hubs on the same host find each
+// other.
+func enableMulticastLoopback(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		optErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+	})
+	if err == nil {
+		err = optErr
+	}
+	return errors.Trace(err)
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"github.com/juju/errors"
+)
+
+// pin is a pattern added with PinTopic.
+type pin struct {
+	matcher TopicMatcher
+}
+
+// absentDurable is a named durable subscriber that has unsubscribed, and
+// may come back with the same name, such as after an upgrade of the
+// component that owns it.
+type absentDurable struct {
+	matcher TopicMatcher
+	config  DurableConfig
+
+	// next is the record sequence that the next pinned message is written
+	// with, following those the subscriber spilled.
+	next uint64
+}
+
+// PinTopic implements TopicPinner.
+func (h *simplehub) PinTopic(matcher TopicMatcher) (Unsubscriber, error) {
+	if matcher == nil {
+		return nil, errors.NotValidf("missing matcher")
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	p := &pin{matcher: matcher}
+	h.pins = append(h.pins, p)
+	h.setSubscribers(h.subscribers)
+	return &pinHandle{hub: h, pin: p}, nil
+}
+
+func (h *simplehub) removePin(p *pin) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, existing := range h.pins {
+		if existing == p {
+			h.pins = append(h.pins[:i:i], h.pins[i+1:]...)
+			h.setSubscribers(h.subscribers)
+			return
+		}
+	}
+}
+
+type pinHandle struct {
+	hub *simplehub
+	pin *pin
+}
+
+// Unsubscribe implements Unsubscriber, and removes the pin. The messages
+// already written for absent subscribers are kept for them.
+func (h *pinHandle) Unsubscribe() {
+	h.hub.removePin(h.pin)
+}
+
+// pinned returns true if a pin matches the topic. The hub mutex must be
+// held.
+func (h *simplehub) pinned(topic Topic) bool {
+	for _, p := range h.pins {
+		if p.matcher.Match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// departed remembers the subscriber, which has been closed, if it is a
+// named durable subscriber, so the messages on pinned topics are kept for
+// it. The hub mutex must be held.
+func (h *simplehub) departed(sub *subscriber) {
+	if sub.durable == nil {
+		return
+	}
+	sub.mutex.Lock()
+	absent := &absentDurable{
+		matcher: sub.topicMatcher,
+		config:  sub.durable.config,
+		next:    sub.durable.next,
+	}
+	sub.mutex.Unlock()
+	if h.absent == nil {
+		h.absent = make(map[string]*absentDurable)
+	}
+	h.absent[sub.name] = absent
+}
+
+// returned forgets the absent subscriber with the name, as it has been
+// subscribed again and has restored the pinned messages. The hub mutex
+// must be held.
+func (h *simplehub) returned(name string) {
+	delete(h.absent, name)
+}
+
+// keepPinned writes the message of the call to the stores of the absent
+// subscribers that it would have been delivered to, if its topic is
+// pinned. The hub mutex must be held.
+func (h *simplehub) keepPinned(call *handlerCallback) {
+	if len(h.absent) == 0 || !h.pinned(call.topic) {
+		return
+	}
+	for name, absent := range h.absent {
+		if !absent.matcher.Match(call.topic) {
+			continue
+		}
+		record, err := spilledRecord(absent.config.Marshaller, absent.next, call)
+		if err == nil {
+			err = absent.config.Store.Put(name, record)
+		}
+		if err != nil {
+			h.reportError(&HubError{
+				Phase:          PhaseDispatch,
+				Topic:          call.topic,
+				SubscriberName: name,
+				Err:            errors.Annotatef(err, "pinning for %q", name),
+			})
+			continue
+		}
+		absent.next++
+	}
+}
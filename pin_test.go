@@ -0,0 +1,90 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type PinSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&PinSuite{})
+
+func (*PinSuite) subscribe(c *gc.C, hub pubsub.Hub, store pubsub.Store, recorder *topicRecorder) pubsub.Subscription {
+	sub, err := hub.Subscribe(pubsub.MatchRegex(`^(unit|machine)\.`), recorder.handle,
+		pubsub.Named("upgrader"),
+		pubsub.Durable(pubsub.DurableConfig{Store: store, SpillAfter: 10}),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	return sub
+}
+
+func (s *PinSuite) TestPinnedWhileAbsent(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	store := pubsub.NewMemoryStore()
+	_, err := hub.(pubsub.TopicPinner).PinTopic(pubsub.MatchRegex(`^unit\.`))
+	c.Assert(err, jc.ErrorIsNil)
+
+	var before topicRecorder
+	sub := s.subscribe(c, hub, store, &before)
+	publishTopics(c, hub, "unit.1")
+	sub.Unsubscribe()
+
+	// Only the pinned topics that the subscriber matches are kept.
+	publishTopics(c, hub, "unit.2", "machine.1", "unit.3", "other")
+	c.Check(storedCount(c, store, "upgrader"), gc.Equals, 2)
+
+	var after topicRecorder
+	s.subscribe(c, hub, store, &after)
+	publishTopics(c, hub, "unit.4", "machine.2")
+	c.Check(before.get(), jc.DeepEquals, []pubsub.Topic{"unit.1"})
+	c.Check(after.get(), jc.DeepEquals, []pubsub.Topic{"unit.2", "unit.3", "unit.4", "machine.2"})
+
+	// The subscriber is back, so nothing more is kept.
+	publishTopics(c, hub, "unit.5")
+	c.Check(storedCount(c, store, "upgrader"), gc.Equals, 0)
+}
+
+func (s *PinSuite) TestUnpin(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	store := pubsub.NewMemoryStore()
+	pin, err := hub.(pubsub.TopicPinner).PinTopic(pubsub.MatchAll)
+	c.Assert(err, jc.ErrorIsNil)
+
+	var before topicRecorder
+	sub := s.subscribe(c, hub, store, &before)
+	waitComplete(c, sub.UnsubscribeFlush())
+	publishTopics(c, hub, "unit.1")
+	pin.Unsubscribe()
+	publishTopics(c, hub, "unit.2")
+
+	var after topicRecorder
+	s.subscribe(c, hub, store, &after)
+	publishTopics(c, hub, "unit.3")
+	c.Check(after.get(), jc.DeepEquals, []pubsub.Topic{"unit.1", "unit.3"})
+}
+
+func (*PinSuite) TestNotDurable(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.(pubsub.TopicPinner).PinTopic(nil)
+	c.Check(err, gc.ErrorMatches, "missing matcher not valid")
+
+	_, err = hub.(pubsub.TopicPinner).PinTopic(pubsub.MatchAll)
+	c.Assert(err, jc.ErrorIsNil)
+	var recorder topicRecorder
+	sub, err := hub.Subscribe(pubsub.MatchAll, recorder.handle, pubsub.Named("plain"))
+	c.Assert(err, jc.ErrorIsNil)
+	sub.Unsubscribe()
+	publishTopics(c, hub, first)
+	_, err = hub.Subscribe(pubsub.MatchAll, recorder.handle, pubsub.Named("plain"))
+	c.Assert(err, jc.ErrorIsNil)
+	publishTopics(c, hub, second)
+	c.Check(recorder.get(), jc.DeepEquals, []pubsub.Topic{second})
+}
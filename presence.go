@@ -0,0 +1,278 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// PresenceTopicPrefix is the prefix of the topics that presence
+// announcements are published on. See PresenceTopic.
+const PresenceTopicPrefix = "pubsub.presence."
+
+// MatchPresence is a topic matcher that matches the topics of all the
+// presence announcements.
+var MatchPresence = MatchRegex(`^pubsub\.presence\.`)
+
+// PresenceTopic returns the topic that the presence of the named component
+// is announced on.
+func PresenceTopic(name string) Topic {
+	return Topic(PresenceTopicPrefix + name)
+}
+
+const defaultMissedAnnouncements = 3
+
+// PresenceAnnouncement is the message published on the presence topic of a
+// component each time it announces that it is alive, and once more when it
+// stops announcing.
+type PresenceAnnouncement struct {
+	Name string `json:"name"`
+
+	// Time is when the announcement was made, and Interval is how long
+	// until the next one.
+	Time     time.Time     `json:"time"`
+	Interval time.Duration `json:"interval"`
+
+	// Leaving is true for the final announcement of a component.
+	Leaving bool `json:"leaving,omitempty"`
+}
+
+// PresenceConfig is the argument struct for NewPresence.
+type PresenceConfig struct {
+	// Hub is the hub the announcements are published on. For components
+	// to be seen as alive as soon as a Presence is created, rather than
+	// after their next announcement, the hub must retain messages. See
+	// SimpleHubConfig.Retain. Hubs other than those of this package must
+	// implement ChanSubscriber.
+	Hub Hub
+
+	// MissedAnnouncements is the number of announcements in a row that a
+	// component can miss before it is no longer considered alive. It
+	// defaults to 3.
+	MissedAnnouncements int
+}
+
+// Validate checks that the config values are valid.
+func (config PresenceConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if _, ok := config.Hub.(rawSubscriber); !ok {
+		if _, ok := config.Hub.(ChanSubscriber); !ok {
+			return errors.NotValidf("Hub %T without SubscribeChan", config.Hub)
+		}
+	}
+	if config.MissedAnnouncements < 0 {
+		return errors.NotValidf("negative MissedAnnouncements")
+	}
+	return nil
+}
+
+// Presence tracks which components sharing a hub are alive. Components
+// announce themselves at regular intervals with Announce, and anyone can
+// ask which are alive with Alive, or subscribe to MatchPresence to see the
+// announcements as they are made.
+type Presence struct {
+	config      PresenceConfig
+	unsubscribe func()
+
+	mutex         sync.Mutex
+	expiries      map[string]time.Time
+	announcements map[*Announcement]bool
+}
+
+// rawSubscriber is implemented by the hubs of this package, to subscribe
+// handlers that take the data in the form it is published on the simple
+// hub.
+type rawSubscriber interface {
+	subscribe(matcher TopicMatcher, handler interface{}, options []SubscribeOption, fetch bool) (Subscription, []Message, error)
+}
+
+// NewPresence starts tracking the components announced on the hub. Close
+// must be called to stop it.
+func NewPresence(config PresenceConfig) (*Presence, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if config.MissedAnnouncements == 0 {
+		config.MissedAnnouncements = defaultMissedAnnouncements
+	}
+	p := &Presence{
+		config:        config,
+		expiries:      make(map[string]time.Time),
+		announcements: make(map[*Announcement]bool),
+	}
+	raw, ok := config.Hub.(rawSubscriber)
+	if !ok {
+		// Other hubs, such as wrappers of the hubs of this package, are
+		// watched through a channel, without the retained messages.
+		messages, closer, err := SubscribeChan(config.Hub, MatchPresence, 0)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		go func() {
+			for message := range messages {
+				p.observe(message.Data)
+			}
+		}()
+		p.unsubscribe = closer
+		return p, nil
+	}
+	handler := func(_ Topic, data interface{}) {
+		p.observe(data)
+	}
+	sub, fetched, err := raw.subscribe(MatchPresence, handler, nil, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, message := range fetched {
+		p.observe(message.Data)
+	}
+	p.unsubscribe = sub.Unsubscribe
+	return p, nil
+}
+
+// observe records the announcement. The data is the announcement itself
+// for simple hubs, and its map form for structured hubs.
+func (p *Presence) observe(data interface{}) {
+	announcement, ok := data.(PresenceAnnouncement)
+	if !ok {
+		bytes, err := JSONMarshaller.Marshal(data)
+		if err == nil {
+			err = JSONMarshaller.Unmarshal(bytes, &announcement)
+		}
+		if err != nil {
+			logger.Warningf("ignoring presence announcement %v: %v", data, err)
+			return
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if announcement.Leaving {
+		delete(p.expiries, announcement.Name)
+		return
+	}
+	expiry := announcement.Time.Add(announcement.Interval * time.Duration(p.config.MissedAnnouncements))
+	if expiry.After(p.expiries[announcement.Name]) {
+		p.expiries[announcement.Name] = expiry
+	}
+}
+
+// Alive returns the components that are alive, along with the time each
+// will stop being considered alive unless it announces itself again.
+func (p *Presence) Alive() map[string]time.Time {
+	now := time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	result := make(map[string]time.Time)
+	for name, expiry := range p.expiries {
+		if expiry.After(now) {
+			result[name] = expiry
+		} else {
+			delete(p.expiries, name)
+		}
+	}
+	return result
+}
+
+// IsAlive returns true if the named component is alive.
+func (p *Presence) IsAlive(name string) bool {
+	_, ok := p.Alive()[name]
+	return ok
+}
+
+// Announce publishes the presence of the named component straight away,
+// and then at the interval until the announcement is stopped.
+func (p *Presence) Announce(name string, interval time.Duration) (*Announcement, error) {
+	if name == "" {
+		return nil, errors.NotValidf("empty name")
+	}
+	if interval <= 0 {
+		return nil, errors.NotValidf("interval %v", interval)
+	}
+	a := &Announcement{
+		presence: p,
+		name:     name,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := a.publish(false); err != nil {
+		return nil, errors.Trace(err)
+	}
+	p.mutex.Lock()
+	p.announcements[a] = true
+	p.mutex.Unlock()
+	go a.loop()
+	return a, nil
+}
+
+// Close stops the announcements made with Announce, and stops tracking
+// the components.
+func (p *Presence) Close() {
+	p.mutex.Lock()
+	announcements := make([]*Announcement, 0, len(p.announcements))
+	for a := range p.announcements {
+		announcements = append(announcements, a)
+	}
+	p.mutex.Unlock()
+	for _, a := range announcements {
+		a.Stop()
+	}
+	p.unsubscribe()
+}
+
+// Announcement is the regular announcement of the presence of a component.
+type Announcement struct {
+	presence *Presence
+	name     string
+	interval time.Duration
+	once     sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (a *Announcement) loop() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			if err := a.publish(false); err != nil {
+				logger.Warningf("announcing presence of %q: %v", a.name, err)
+			}
+		}
+	}
+}
+
+func (a *Announcement) publish(leaving bool) error {
+	_, err := a.presence.config.Hub.Publish(PresenceTopic(a.name), PresenceAnnouncement{
+		Name:     a.name,
+		Time:     time.Now(),
+		Interval: a.interval,
+		Leaving:  leaving,
+	})
+	return errors.Trace(err)
+}
+
+// Stop stops the announcements, and announces that the component is
+// leaving, so it is no longer considered alive.
+func (a *Announcement) Stop() {
+	a.once.Do(func() {
+		close(a.stop)
+		<-a.done
+		if err := a.publish(true); err != nil {
+			logger.Warningf("announcing departure of %q: %v", a.name, err)
+		}
+		a.presence.mutex.Lock()
+		delete(a.presence.announcements, a)
+		a.presence.mutex.Unlock()
+	})
+}
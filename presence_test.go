@@ -0,0 +1,156 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type PresenceSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&PresenceSuite{})
+
+func (*PresenceSuite) TestValidate(c *gc.C) {
+	_, err := pubsub.NewPresence(pubsub.PresenceConfig{})
+	c.Check(err, gc.ErrorMatches, "missing Hub not valid")
+	_, err = pubsub.NewPresence(pubsub.PresenceConfig{
+		Hub:                 pubsub.NewSimpleHub(),
+		MissedAnnouncements: -1,
+	})
+	c.Check(err, gc.ErrorMatches, "negative MissedAnnouncements not valid")
+}
+
+func newPresence(c *gc.C, hub pubsub.Hub) *pubsub.Presence {
+	presence, err := pubsub.NewPresence(pubsub.PresenceConfig{Hub: hub})
+	c.Assert(err, jc.ErrorIsNil)
+	return presence
+}
+
+// syncPresence waits for the announcements published so far to be handled.
+func syncPresence(c *gc.C, hub pubsub.Hub, name string) {
+	done, err := hub.(pubsub.Barrierer).Barrier(pubsub.PresenceTopic(name))
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+}
+
+func (*PresenceSuite) TestAnnounce(c *gc.C) {
+	for _, hub := range []pubsub.Hub{pubsub.NewSimpleHub(), pubsub.NewStructuredHub(nil)} {
+		presence := newPresence(c, hub)
+		c.Check(presence.Alive(), gc.HasLen, 0)
+
+		start := time.Now()
+		announcement, err := presence.Announce("worker", time.Minute)
+		c.Assert(err, jc.ErrorIsNil)
+		syncPresence(c, hub, "worker")
+		alive := presence.Alive()
+		c.Assert(alive, gc.HasLen, 1)
+		c.Check(alive["worker"].After(start.Add(3*time.Minute)), jc.IsTrue)
+		c.Check(presence.IsAlive("worker"), jc.IsTrue)
+
+		announcement.Stop()
+		announcement.Stop()
+		syncPresence(c, hub, "worker")
+		c.Check(presence.IsAlive("worker"), jc.IsFalse)
+		presence.Close()
+	}
+}
+
+func (*PresenceSuite) TestSubscribe(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchPresence, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	presence := newPresence(c, hub)
+	_, err = presence.Announce("worker", time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	presence.Close()
+
+	for _, leaving := range []bool{false, true} {
+		select {
+		case message := <-messages:
+			c.Check(message.Topic, gc.Equals, pubsub.Topic("pubsub.presence.worker"))
+			announcement := message.Data.(pubsub.PresenceAnnouncement)
+			c.Check(announcement.Name, gc.Equals, "worker")
+			c.Check(announcement.Interval, gc.Equals, time.Minute)
+			c.Check(announcement.Leaving, gc.Equals, leaving)
+		case <-time.After(time.Second):
+			c.Fatal("announcement not received")
+		}
+	}
+}
+
+func (*PresenceSuite) TestRepeated(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchPresence, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	presence := newPresence(c, hub)
+	defer presence.Close()
+	_, err = presence.Announce("worker", 5*time.Millisecond)
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-messages:
+		case <-time.After(time.Second):
+			c.Fatalf("announcement %d not received", i)
+		}
+	}
+}
+
+func (*PresenceSuite) TestExpiry(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	presence, err := pubsub.NewPresence(pubsub.PresenceConfig{
+		Hub:                 hub,
+		MissedAnnouncements: 2,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer presence.Close()
+
+	now := time.Now()
+	for _, announcement := range []pubsub.PresenceAnnouncement{
+		{Name: "expired", Time: now.Add(-time.Minute), Interval: 20 * time.Second},
+		{Name: "alive", Time: now.Add(-time.Minute), Interval: 40 * time.Second},
+	} {
+		_, err := hub.Publish(pubsub.PresenceTopic(announcement.Name), announcement)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	syncPresence(c, hub, "alive")
+	c.Check(presence.Alive(), jc.DeepEquals, map[string]time.Time{
+		"alive": now.Add(20 * time.Second),
+	})
+}
+
+func (*PresenceSuite) TestRetained(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 1})
+	first := newPresence(c, hub)
+	defer first.Close()
+	_, err := first.Announce("worker", time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	left, err := first.Announce("gone", time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	left.Stop()
+
+	second := newPresence(c, hub)
+	defer second.Close()
+	c.Check(second.IsAlive("worker"), jc.IsTrue)
+	c.Check(second.IsAlive("gone"), jc.IsFalse)
+}
+
+func (*PresenceSuite) TestAnnounceNotValid(c *gc.C) {
+	presence := newPresence(c, pubsub.NewSimpleHub())
+	defer presence.Close()
+	_, err := presence.Announce("", time.Minute)
+	c.Check(err, gc.ErrorMatches, "empty name not valid")
+	_, err = presence.Announce("worker", 0)
+	c.Check(err, gc.ErrorMatches, "interval 0s not valid")
+}
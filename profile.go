@@ -0,0 +1,81 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// The annotation keys used by the standard profile.
+const (
+	AnnotationOrigin    = "origin"
+	AnnotationHostname  = "hostname"
+	AnnotationPID       = "pid"
+	AnnotationTimestamp = "timestamp"
+	AnnotationMessageID = "message-id"
+)
+
+// NewStructuredHubWithProfile returns a structured hub configured with the
+// standard profile for the named agent or service. See ProfileConfig.
+func NewStructuredHubWithProfile(name string) StructuredHub {
+	return NewStructuredHub(ProfileConfig(name))
+}
+
+// ProfileConfig returns the config of the standard profile, so that a fleet
+// of services publish uniformly annotated messages. Every message
+// published is annotated with:
+//
+//	origin      the name passed in
+//	hostname    the host name of the machine
+//	pid         the process ID
+//	timestamp   the time of the publish, in RFC3339 format with nanoseconds
+//	message-id  a random identifier unique to the message
+//
+// As with all annotations, values already in the published data are not
+// replaced. The config can be changed before passing it to
+// NewStructuredHub, although any PostProcess function set should call the
+// one set by the profile.
+func ProfileConfig(name string) *StructuredHubConfig {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return &StructuredHubConfig{
+		Annotations: map[string]interface{}{
+			AnnotationOrigin:   name,
+			AnnotationHostname: hostname,
+			AnnotationPID:      os.Getpid(),
+		},
+		PostProcess: profilePostProcess,
+	}
+}
+
+// profilePostProcess adds the annotations that differ for every message.
+func profilePostProcess(data map[string]interface{}) (map[string]interface{}, error) {
+	id, err := newMessageID()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	annotate(data, map[string]interface{}{
+		AnnotationTimestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		AnnotationMessageID: id,
+	}, nil, "")
+	return data, nil
+}
+
+// newMessageID returns a random version 4 UUID.
+func newMessageID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", errors.Annotate(err, "generating message ID")
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
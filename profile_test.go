@@ -0,0 +1,69 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"os"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ProfileSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ProfileSuite{})
+
+func (*ProfileSuite) receive(c *gc.C, hub pubsub.Hub, data map[string]interface{}) map[string]interface{} {
+	received := make(chan map[string]interface{}, 1)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	_, err = hub.Publish(topic, data)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case result := <-received:
+		return result
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	return nil
+}
+
+func (s *ProfileSuite) TestAnnotations(c *gc.C) {
+	hub := pubsub.NewStructuredHubWithProfile("agent")
+	hostname, err := os.Hostname()
+	c.Assert(err, jc.ErrorIsNil)
+
+	before := time.Now().UTC()
+	first := s.receive(c, hub, map[string]interface{}{"value": 1})
+	c.Check(first["value"], gc.Equals, 1)
+	c.Check(first[pubsub.AnnotationOrigin], gc.Equals, "agent")
+	c.Check(first[pubsub.AnnotationHostname], gc.Equals, hostname)
+	c.Check(first[pubsub.AnnotationPID], gc.Equals, os.Getpid())
+	c.Check(first[pubsub.AnnotationMessageID], gc.Matches, "[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}")
+	timestamp, err := time.Parse(time.RFC3339Nano, first[pubsub.AnnotationTimestamp].(string))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(timestamp.Before(before), jc.IsFalse)
+
+	second := s.receive(c, hub, map[string]interface{}{})
+	c.Check(second[pubsub.AnnotationMessageID], gc.Not(gc.Equals), first[pubsub.AnnotationMessageID])
+}
+
+func (s *ProfileSuite) TestExistingValuesKept(c *gc.C) {
+	hub := pubsub.NewStructuredHubWithProfile("agent")
+	data := s.receive(c, hub, map[string]interface{}{
+		pubsub.AnnotationOrigin:    "elsewhere",
+		pubsub.AnnotationMessageID: "id",
+	})
+	c.Check(data[pubsub.AnnotationOrigin], gc.Equals, "elsewhere")
+	c.Check(data[pubsub.AnnotationMessageID], gc.Equals, "id")
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Project is a subscribe option for structured hubs that declares the
+// fields of the payload that the subscription needs. Only those parts of
+// the map form of the data are decoded into the handler's structure, so
+// subscribers that only look at a few fields of large payloads don't pay
+// to decode the rest. Fields are given as paths of keys of the map form
+// separated by dots, such as "unit.name", so keys containing dots can't
+// be projected. The handler's structure should only have fields for the
+// projected paths, or handlers can take Fields to read them without
+// decoding at all. It is ignored by simple hubs.
+func Project(fields ...string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.projection = append(o.projection, fields...)
+	}
+}
+
+var fieldsType = reflect.TypeOf(Fields{})
+
+// Fields gives a handler of a structured hub access to the fields of the
+// map form of the data without decoding it into a structure. Handlers that
+// take Fields rather than a structure are only given the fields named by
+// the Project option, if the subscription has one. The values are shared
+// with the other subscribers of the message, so they must not be modified.
+type Fields struct {
+	values  map[string]interface{}
+	decoder decoder
+}
+
+// Get returns the value at the path of keys separated by dots, such as
+// "unit.name", or false if there isn't one.
+func (f Fields) Get(path string) (interface{}, bool) {
+	var value interface{} = f.values
+	for _, key := range strings.Split(path, ".") {
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = values[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Decode converts the value at the path into the value that result points
+// to, using the hub's Marshaller. A NotFound error is returned if there is
+// no value at the path.
+func (f Fields) Decode(path string, result interface{}) error {
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.NotValidf("result of type %T", result)
+	}
+	value, ok := f.Get(path)
+	if !ok {
+		return errors.NotFoundf("field %q", path)
+	}
+	return errors.Annotatef(f.decoder.unmarshalInto(v.Elem(), value), "field %q", path)
+}
+
+// parseProjection splits the paths of the Project option into their keys.
+func parseProjection(fields []string) ([][]string, error) {
+	var paths [][]string
+	for _, field := range fields {
+		keys := strings.Split(field, ".")
+		for _, key := range keys {
+			if key == "" {
+				return nil, errors.NotValidf("projected field %q", field)
+			}
+		}
+		paths = append(paths, keys)
+	}
+	return paths, nil
+}
+
+// project returns a copy of the data holding only the values at the paths.
+// The data itself is shared by the subscribers, so it is left as it is.
+func project(data map[string]interface{}, paths [][]string) map[string]interface{} {
+	result := make(map[string]interface{}, len(paths))
+	for _, path := range paths {
+		projectPath(result, data, path)
+	}
+	return result
+}
+
+func projectPath(result, data map[string]interface{}, path []string) {
+	value, ok := data[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		result[path[0]] = value
+		return
+	}
+	values, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	nested, ok := result[path[0]].(map[string]interface{})
+	if !ok {
+		nested = make(map[string]interface{})
+		result[path[0]] = nested
+	}
+	projectPath(nested, values, path[1:])
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ProjectionSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ProjectionSuite{})
+
+type Deployment struct {
+	Unit struct {
+		Name string `json:"name"`
+	} `json:"unit"`
+	Charm string `json:"charm"`
+	Blob  string `json:"blob"`
+}
+
+type UnitName struct {
+	Unit struct {
+		Name string `json:"name"`
+	} `json:"unit"`
+	Blob string `json:"blob"`
+}
+
+var deployment = map[string]interface{}{
+	"unit": map[string]interface{}{
+		"name":   "mysql/0",
+		"series": "focal",
+	},
+	"charm": "mysql",
+	"blob":  "a very large value",
+}
+
+func (*ProjectionSuite) TestProjectedStruct(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan UnitName, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data UnitName, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	}, pubsub.Project("unit.name"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, deployment)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data.Unit.Name, gc.Equals, "mysql/0")
+		// Fields that aren't projected aren't decoded.
+		c.Check(data.Blob, gc.Equals, "")
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (*ProjectionSuite) TestFields(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan pubsub.Fields, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, fields pubsub.Fields, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- fields
+	}, pubsub.Project("unit.name", "charm", "missing.field"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, deployment)
+	c.Assert(err, jc.ErrorIsNil)
+	var fields pubsub.Fields
+	select {
+	case fields = <-received:
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	value, ok := fields.Get("unit.name")
+	c.Check(ok, jc.IsTrue)
+	c.Check(value, gc.Equals, "mysql/0")
+	_, ok = fields.Get("unit.series")
+	c.Check(ok, jc.IsFalse)
+	_, ok = fields.Get("blob")
+	c.Check(ok, jc.IsFalse)
+
+	var charm string
+	c.Check(fields.Decode("charm", &charm), jc.ErrorIsNil)
+	c.Check(charm, gc.Equals, "mysql")
+	err = fields.Decode("missing.field", &charm)
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (*ProjectionSuite) TestFieldsWithoutProjection(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan pubsub.Fields, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, fields pubsub.Fields, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- fields
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, deployment)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case fields := <-received:
+		value, ok := fields.Get("blob")
+		c.Check(ok, jc.IsTrue)
+		c.Check(value, gc.Equals, "a very large value")
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (*ProjectionSuite) TestOtherSubscribersUnaffected(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	projected := make(chan UnitName, 1)
+	full := make(chan Deployment, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data UnitName, err error) {
+		projected <- data
+	}, pubsub.Project("unit.name"))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, func(_ pubsub.Topic, data Deployment, err error) {
+		full <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	done, err := hub.Publish(topic, deployment)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check((<-projected).Blob, gc.Equals, "")
+	data := <-full
+	c.Check(data.Unit.Name, gc.Equals, "mysql/0")
+	c.Check(data.Charm, gc.Equals, "mysql")
+	c.Check(data.Blob, gc.Equals, "a very large value")
+}
+
+func (*ProjectionSuite) TestInvalidProjection(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, UnitName, error) {}, pubsub.Project("unit..name"))
+	c.Check(err, gc.ErrorMatches, `projected field "unit..name" not valid`)
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// ProvenanceHeader is the header that holds the provenance of the fields of
+// a message published on a structured hub with TrackProvenance set. See
+// ProvenanceFromContext.
+const ProvenanceHeader = "pubsub-provenance"
+
+// The sources of the fields recorded in a Provenance.
+const (
+	// ProvenanceContext is the source of the fields set from the
+	// annotations of the context passed to PublishCtx.
+	ProvenanceContext = "context"
+
+	// ProvenanceHub is the source of the fields set from the hub's
+	// Annotations.
+	ProvenanceHub = "hub"
+
+	// ProvenanceProcessed is the source of the fields added by the hub's
+	// PostProcess function or by interceptors.
+	ProvenanceProcessed = "processed"
+
+	// ProvenanceLayerPrefix is followed by the name of the annotation
+	// layer for the fields set by one of the hub's AnnotationLayers.
+	ProvenanceLayerPrefix = "layer:"
+)
+
+// Provenance maps the fields of a message that were added by the hub to
+// where they came from. Fields that aren't in the map came from the data
+// passed to Publish. Fields that the publisher set but PostProcess or an
+// interceptor changed are not recorded.
+type Provenance map[string]string
+
+// FromPayload returns true if the field was not added by the hub.
+func (p Provenance) FromPayload(field string) bool {
+	_, added := p[field]
+	return !added
+}
+
+// ProvenanceFromContext returns the provenance of the fields of the message
+// being handled. The bool result is false if the message was not published
+// on a hub that tracks provenance.
+func ProvenanceFromContext(ctx context.Context) (Provenance, bool) {
+	value, ok := HeadersFromContext(ctx)[ProvenanceHeader]
+	if !ok {
+		return nil, false
+	}
+	var provenance Provenance
+	if err := json.Unmarshal([]byte(value), &provenance); err != nil {
+		logger.Warningf("invalid %s header %q: %v", ProvenanceHeader, value, err)
+		return nil, false
+	}
+	if provenance == nil {
+		provenance = make(Provenance)
+	}
+	return provenance, true
+}
+
+// record notes the source of the field. The provenance may be nil, in
+// which case nothing is recorded.
+func (p Provenance) record(field, source string) {
+	if p != nil {
+		p[field] = source
+	}
+}
+
+// keys returns the fields of the data, so the fields added by post
+// processing can be found. It returns nil if the provenance is nil.
+func (p Provenance) keys(data map[string]interface{}) map[string]bool {
+	if p == nil {
+		return nil
+	}
+	keys := make(map[string]bool, len(data))
+	for key := range data {
+		keys[key] = true
+	}
+	return keys
+}
+
+// processed records the fields of the data that weren't there before post
+// processing, and forgets the fields that were removed.
+func (p Provenance) processed(before map[string]bool, data map[string]interface{}) {
+	for key := range data {
+		if !before[key] {
+			p[key] = ProvenanceProcessed
+		}
+	}
+	for key := range p {
+		if _, exists := data[key]; !exists {
+			delete(p, key)
+		}
+	}
+}
+
+// withProvenance returns a context that adds the provenance header to the
+// published message.
+func withProvenance(ctx context.Context, provenance Provenance) context.Context {
+	encoded, err := json.Marshal(provenance)
+	if err != nil {
+		// A map of strings always marshals.
+		logger.Errorf("encoding provenance: %v", err)
+		return ctx
+	}
+	headers := make(Headers)
+	for key, value := range headersFromPublishContext(ctx) {
+		headers[key] = value
+	}
+	headers[ProvenanceHeader] = string(encoded)
+	return context.WithValue(ctx, headersKey{}, headers)
+}
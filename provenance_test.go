@@ -0,0 +1,131 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ProvenanceSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ProvenanceSuite{})
+
+type provenanceResult struct {
+	data       map[string]interface{}
+	provenance pubsub.Provenance
+	tracked    bool
+}
+
+func publishForProvenance(c *gc.C, hub pubsub.StructuredHub, ctx context.Context, data interface{}) provenanceResult {
+	var result provenanceResult
+	sub, err := hub.Subscribe(topic, func(ctx context.Context, _ pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		result.data = data
+		result.provenance, result.tracked = pubsub.ProvenanceFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, data)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	return result
+}
+
+func (*ProvenanceSuite) TestNotTracked(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		Annotations: map[string]interface{}{"origin": "hub"},
+	})
+	result := publishForProvenance(c, hub, context.Background(), map[string]interface{}{"message": "hello"})
+	c.Check(result.tracked, jc.IsFalse)
+	c.Check(result.provenance, gc.IsNil)
+	c.Check(result.data["origin"], gc.Equals, "hub")
+}
+
+func (*ProvenanceSuite) TestSources(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		TrackProvenance: true,
+		Annotations: map[string]interface{}{
+			"origin":  "hub",
+			"message": "ignored",
+			"model":   "default",
+		},
+		AnnotationLayers: []pubsub.AnnotationLayer{{
+			Name:        "tenant",
+			Annotations: map[string]interface{}{"tenant": "acme", "model": "tenant-model"},
+			Policy:      pubsub.Override,
+		}},
+		PostProcess: func(data map[string]interface{}) (map[string]interface{}, error) {
+			data["stamp"] = "now"
+			delete(data, "request")
+			return data, nil
+		},
+	})
+	ctx := pubsub.WithAnnotations(context.Background(), map[string]interface{}{
+		"request": "r1",
+		"user":    "fred",
+	})
+	result := publishForProvenance(c, hub, ctx, map[string]interface{}{
+		"message": "hello",
+		"origin":  "",
+	})
+	c.Assert(result.tracked, jc.IsTrue)
+	c.Check(result.data, jc.DeepEquals, map[string]interface{}{
+		"message": "hello",
+		"origin":  "hub",
+		"model":   "tenant-model",
+		"tenant":  "acme",
+		"user":    "fred",
+		"stamp":   "now",
+	})
+	c.Check(result.provenance, jc.DeepEquals, pubsub.Provenance{
+		"origin": pubsub.ProvenanceHub,
+		"model":  pubsub.ProvenanceLayerPrefix + "tenant",
+		"tenant": pubsub.ProvenanceLayerPrefix + "tenant",
+		"user":   pubsub.ProvenanceContext,
+		"stamp":  pubsub.ProvenanceProcessed,
+	})
+	c.Check(result.provenance.FromPayload("message"), jc.IsTrue)
+	c.Check(result.provenance.FromPayload("origin"), jc.IsFalse)
+}
+
+func (*ProvenanceSuite) TestNothingAdded(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{TrackProvenance: true})
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{"trace": "abc"})
+	var headers pubsub.Headers
+	sub, err := hub.Subscribe(topic, func(ctx context.Context, _ pubsub.Topic, _ map[string]interface{}, _ error) {
+		headers = pubsub.HeadersFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, map[string]interface{}{"message": "hello"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(headers, jc.DeepEquals, pubsub.Headers{
+		"trace":                 "abc",
+		pubsub.ProvenanceHeader: "{}",
+	})
+}
+
+func (*ProvenanceSuite) TestInvalidHeader(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var tracked bool
+	sub, err := hub.Subscribe(topic, func(ctx context.Context, _ pubsub.Topic, _ interface{}) {
+		_, tracked = pubsub.ProvenanceFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{pubsub.ProvenanceHeader: "bad"})
+	done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(tracked, jc.IsFalse)
+}
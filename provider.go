@@ -0,0 +1,153 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+var topicType = reflect.TypeOf(Topic(""))
+
+// Providers hold the values that a hub injects into the handlers that take
+// more arguments than the usual signatures. Any arguments after the data,
+// or after the error of structured hub handlers, are given the value
+// provided for their type, so handlers can ask for things such as a
+// loggo.Logger, a clock, or a metrics scope rather than having them
+// captured when the handler is built:
+//
+//	providers := pubsub.NewProviders()
+//	providers.Provide(loggo.GetLogger("app.worker"))
+//	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+//		Providers: providers,
+//	})
+//	hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}, logger loggo.Logger) {
+//		logger.Infof("got %v", data)
+//	})
+//
+// The arguments of a handler are checked when it is subscribed, so a
+// handler asking for a type without a provider fails to subscribe.
+// Providers may be added at any time, but only the providers added before
+// a handler is subscribed are used for it.
+type Providers struct {
+	mutex     sync.Mutex
+	providers map[reflect.Type]provider
+}
+
+// provider returns the value to inject for the message being handled.
+type provider func(ctx context.Context, topic Topic) reflect.Value
+
+// NewProviders returns an empty set of providers.
+func NewProviders() *Providers {
+	return &Providers{providers: make(map[reflect.Type]provider)}
+}
+
+// Provide injects the value into the handler arguments of its type.
+func (p *Providers) Provide(value interface{}) error {
+	if value == nil {
+		return errors.NotValidf("nil value")
+	}
+	v := reflect.ValueOf(value)
+	return errors.Trace(p.add(v.Type(), func(context.Context, Topic) reflect.Value {
+		return v
+	}))
+}
+
+// ProvideFunc injects the result of the function into the handler
+// arguments of its result type. The function must have the signature
+//
+//	func(context.Context, pubsub.Topic) T
+//
+// and is called for each message, with the context and topic that are
+// passed to the handler. Interface types, such as a clock, are provided
+// with a function returning the interface.
+func (p *Providers) ProvideFunc(fn interface{}) error {
+	if fn == nil {
+		return errors.NotValidf("nil func")
+	}
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(0) != contextType || t.In(1) != topicType || t.NumOut() != 1 {
+		return errors.NotValidf("provider func of type %T", fn)
+	}
+	return errors.Trace(p.add(t.Out(0), func(ctx context.Context, topic Topic) reflect.Value {
+		return v.Call([]reflect.Value{reflect.ValueOf(&ctx).Elem(), reflect.ValueOf(topic)})[0]
+	}))
+}
+
+func (p *Providers) add(t reflect.Type, provide provider) error {
+	switch t {
+	case contextType, topicType, errorType:
+		return errors.NotValidf("provider for %v", t)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.providers[t]; ok {
+		return errors.AlreadyExistsf("provider for %v", t)
+	}
+	p.providers[t] = provide
+	return nil
+}
+
+// inject returns the handler unchanged if it takes no more than the args
+// of the usual handler signatures, not counting the optional context. If
+// it takes more, the function returned takes the context followed by the
+// usual args, and calls the handler with the provided values as the rest
+// of its args. The providers may be nil, in which case handlers with extra
+// args are left for the usual checks to reject.
+func (p *Providers) inject(handler interface{}, args int) (interface{}, error) {
+	t := reflect.TypeOf(handler)
+	if p == nil || t == nil || t.Kind() != reflect.Func {
+		return handler, nil
+	}
+	wantsContext := t.NumIn() > 0 && t.In(0) == contextType
+	base := args
+	if wantsContext {
+		base++
+	}
+	if t.NumIn() <= base || t.IsVariadic() {
+		return handler, nil
+	}
+	providers := make([]provider, 0, t.NumIn()-base)
+	p.mutex.Lock()
+	for i := base; i < t.NumIn(); i++ {
+		provide, ok := p.providers[t.In(i)]
+		if !ok {
+			p.mutex.Unlock()
+			return nil, errors.NotValidf("handler arg %d of type %v without a provider", i+1, t.In(i))
+		}
+		providers = append(providers, provide)
+	}
+	p.mutex.Unlock()
+
+	in := []reflect.Type{contextType}
+	for i := base - args; i < base; i++ {
+		in = append(in, t.In(i))
+	}
+	if in[1] != topicType {
+		return nil, errors.NotValidf("first arg should be a pubsub.Topic, incorrect handler signature")
+	}
+	out := make([]reflect.Type, t.NumOut())
+	for i := range out {
+		out[i] = t.Out(i)
+	}
+	callback := reflect.ValueOf(handler)
+	injected := reflect.MakeFunc(reflect.FuncOf(in, out, false), func(values []reflect.Value) []reflect.Value {
+		ctx := values[0].Interface().(context.Context)
+		topic := values[1].Interface().(Topic)
+		if !wantsContext {
+			values = values[1:]
+		}
+		call := make([]reflect.Value, 0, t.NumIn())
+		call = append(call, values...)
+		for _, provide := range providers {
+			call = append(call, provide(ctx, topic))
+		}
+		return callback.Call(call)
+	})
+	return injected.Interface(), nil
+}
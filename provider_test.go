@@ -0,0 +1,165 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ProviderSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ProviderSuite{})
+
+// Clock is an interface type provided with ProvideFunc.
+type Clock interface {
+	Now() time.Time
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+var epoch = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Scope is provided for each message.
+type Scope struct {
+	Topic pubsub.Topic
+}
+
+func newProviders(c *gc.C) *pubsub.Providers {
+	providers := pubsub.NewProviders()
+	c.Assert(providers.Provide(loggo.GetLogger("test.provider")), jc.ErrorIsNil)
+	c.Assert(providers.ProvideFunc(func(context.Context, pubsub.Topic) Clock {
+		return fixedClock(epoch)
+	}), jc.ErrorIsNil)
+	c.Assert(providers.ProvideFunc(func(_ context.Context, topic pubsub.Topic) *Scope {
+		return &Scope{Topic: topic}
+	}), jc.ErrorIsNil)
+	return providers
+}
+
+func (*ProviderSuite) TestProvideErrors(c *gc.C) {
+	providers := pubsub.NewProviders()
+	c.Check(providers.Provide(nil), gc.ErrorMatches, "nil value not valid")
+	c.Check(providers.Provide(pubsub.Topic("x")), gc.ErrorMatches, "provider for pubsub.Topic not valid")
+	c.Check(providers.ProvideFunc(func() Clock { return nil }), gc.ErrorMatches, `provider func of type func\(\) pubsub_test.Clock not valid`)
+	c.Check(providers.ProvideFunc(func(context.Context, pubsub.Topic) context.Context { return nil }), gc.ErrorMatches, "provider for context.Context not valid")
+
+	c.Assert(providers.Provide(42), jc.ErrorIsNil)
+	err := providers.Provide(7)
+	c.Check(err, jc.Satisfies, errors.IsAlreadyExists)
+	c.Check(err, gc.ErrorMatches, "provider for int already exists")
+}
+
+func (*ProviderSuite) TestSimpleHub(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Providers: newProviders(c),
+	})
+	type injected struct {
+		logger loggo.Logger
+		now    time.Time
+		scope  *Scope
+		ctx    bool
+	}
+	results := make(chan injected, 2)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data interface{}, logger loggo.Logger, clock Clock, scope *Scope) {
+		results <- injected{logger: logger, now: clock.Now(), scope: scope}
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, func(ctx context.Context, _ pubsub.Topic, data interface{}, scope *Scope) error {
+		results <- injected{scope: scope, ctx: ctx != nil}
+		return nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, "data")
+	c.Assert(err, jc.ErrorIsNil)
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-results:
+			c.Check(result.scope, jc.DeepEquals, &Scope{Topic: topic})
+			if result.ctx {
+				continue
+			}
+			c.Check(result.logger.Name(), gc.Equals, "test.provider")
+			c.Check(result.now, gc.Equals, epoch)
+		case <-time.After(time.Second):
+			c.Fatal("handler not called")
+		}
+	}
+}
+
+func (*ProviderSuite) TestMissingProvider(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Providers: pubsub.NewProviders(),
+	})
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}, Clock) {})
+	c.Check(err, gc.ErrorMatches, "handler arg 3 of type pubsub_test.Clock without a provider not valid")
+
+	// Hubs without providers reject the extra args as before.
+	hub = pubsub.NewSimpleHub()
+	_, err = hub.Subscribe(topic, func(pubsub.Topic, interface{}, Clock) {})
+	c.Check(err, gc.ErrorMatches, "incorrect handler signature not valid")
+}
+
+func (*ProviderSuite) TestReplace(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Providers: newProviders(c),
+	})
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	scopes := make(chan *Scope, 1)
+	err = sub.Replace(func(_ pubsub.Topic, _ interface{}, scope *Scope) {
+		scopes <- scope
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case scope := <-scopes:
+		c.Check(scope.Topic, gc.Equals, topic)
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (*ProviderSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			Providers: newProviders(c),
+		},
+	})
+	received := make(chan Emitter, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Emitter, err error, clock Clock) {
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(clock.Now(), gc.Equals, epoch)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, func(pubsub.Topic, Emitter, error, *loggo.Logger) {})
+	c.Check(err, gc.ErrorMatches, `handler arg 4 of type \*loggo.Logger without a provider not valid`)
+
+	_, err = hub.Publish(topic, Emitter{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data.Origin, gc.Equals, "test")
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package pubsubbench runs benchmark scenarios against hubs, with a number
+// of publishers and subscribers, a mix of exact and pattern matchers, and
+// payloads of a given size, and reports the throughput, the latency of the
+// deliveries, and the allocations per message. The reports make
+// performance regressions measurable across changes to the hubs, and help
+// users size hubs for their workloads.
+package pubsubbench
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/pubsub"
+)
+
+// Scenario describes a benchmark run.
+type Scenario struct {
+	// Name identifies the scenario in the report.
+	Name string
+
+	// Structured runs the scenario against a structured hub rather than
+	// a simple hub.
+	Structured bool
+
+	// NewHub, if set, creates the hub for the run, for benchmarking hubs
+	// with particular configurations. It must return a structured hub
+	// if Structured is set, and a simple hub otherwise.
+	NewHub func() pubsub.Hub
+
+	// Publishers is the number of goroutines publishing, and Messages is
+	// the number of messages each publishes.
+	Publishers int
+	Messages   int
+
+	// Subscribers is the number of subscribers.
+	Subscribers int
+
+	// Topics is the number of topics the messages are spread across. It
+	// defaults to one.
+	Topics int
+
+	// PatternFraction is the fraction of the subscribers that use a
+	// regular expression matching all the topics. The rest subscribe to
+	// one topic each, shared out evenly.
+	PatternFraction float64
+
+	// PayloadSize is the size of the body of each message in bytes.
+	PayloadSize int
+
+	// HandlerLatency is injected into each call to a handler, to stand in
+	// for the work that real handlers do.
+	HandlerLatency time.Duration
+
+	// PublishInterval, if set, paces each publisher, rather than having
+	// them publish as fast as they can.
+	PublishInterval time.Duration
+}
+
+// Validate checks that the scenario values are valid.
+func (s Scenario) Validate() error {
+	if s.Publishers <= 0 {
+		return errors.NotValidf("Publishers %d", s.Publishers)
+	}
+	if s.Messages <= 0 {
+		return errors.NotValidf("Messages %d", s.Messages)
+	}
+	if s.Subscribers < 0 {
+		return errors.NotValidf("negative Subscribers")
+	}
+	if s.Topics < 0 {
+		return errors.NotValidf("negative Topics")
+	}
+	if s.PatternFraction < 0 || s.PatternFraction > 1 {
+		return errors.NotValidf("PatternFraction %v", s.PatternFraction)
+	}
+	if s.PayloadSize < 0 {
+		return errors.NotValidf("negative PayloadSize")
+	}
+	if s.HandlerLatency < 0 {
+		return errors.NotValidf("negative HandlerLatency")
+	}
+	if s.PublishInterval < 0 {
+		return errors.NotValidf("negative PublishInterval")
+	}
+	return nil
+}
+
+// Payload is the data of the published messages.
+type Payload struct {
+	Sent time.Time `json:"sent"`
+	Body string    `json:"body"`
+}
+
+// Report holds the results of a run.
+type Report struct {
+	Name string
+
+	// Published is the number of messages published, and Delivered is the
+	// number of handler calls for them.
+	Published int
+	Delivered int
+
+	// Duration is the time from the first publish until every message
+	// was handled.
+	Duration time.Duration
+
+	// Throughput is the number of deliveries per second.
+	Throughput float64
+
+	// The latencies are the times from publishing a message to its
+	// handler being called, across all the deliveries.
+	LatencyP50 time.Duration
+	LatencyP90 time.Duration
+	LatencyP99 time.Duration
+	LatencyMax time.Duration
+
+	// AllocsPerMessage and BytesPerMessage are the heap allocations made
+	// during the run for each published message, including those of the
+	// handlers.
+	AllocsPerMessage float64
+	BytesPerMessage  float64
+}
+
+// String returns a one line summary of the report.
+func (r *Report) String() string {
+	return fmt.Sprintf("%s: %d published, %d delivered in %v (%.0f/s), latency p50 %v p90 %v p99 %v max %v, %.1f allocs %.0f B/msg",
+		r.Name, r.Published, r.Delivered, r.Duration, r.Throughput,
+		r.LatencyP50, r.LatencyP90, r.LatencyP99, r.LatencyMax,
+		r.AllocsPerMessage, r.BytesPerMessage)
+}
+
+// topicName returns the name of the nth topic of a run.
+func topicName(n int) pubsub.Topic {
+	return pubsub.Topic(fmt.Sprintf("bench.topic.%d", n))
+}
+
+// recorder collects the latencies of the deliveries.
+type recorder struct {
+	mutex     sync.Mutex
+	latencies []time.Duration
+	latency   time.Duration
+}
+
+func (r *recorder) record(payload Payload) {
+	latency := time.Since(payload.Sent)
+	if r.latency > 0 {
+		time.Sleep(r.latency)
+	}
+	r.mutex.Lock()
+	r.latencies = append(r.latencies, latency)
+	r.mutex.Unlock()
+}
+
+// Run runs the scenario, and returns once every message has been handled
+// by all the subscribers. Cancelling the context stops the publishers.
+func Run(ctx context.Context, scenario Scenario) (*Report, error) {
+	if err := scenario.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if scenario.Topics == 0 {
+		scenario.Topics = 1
+	}
+	hub := newHub(scenario)
+	if _, ok := hub.(pubsub.Barrierer); !ok {
+		return nil, errors.NotValidf("hub %T without Barrier", hub)
+	}
+	rec := &recorder{
+		latencies: make([]time.Duration, 0, scenario.Publishers*scenario.Messages*scenario.Subscribers),
+		latency:   scenario.HandlerLatency,
+	}
+	patterns := int(float64(scenario.Subscribers) * scenario.PatternFraction)
+	for i := 0; i < scenario.Subscribers; i++ {
+		var matcher pubsub.TopicMatcher = topicName(i % scenario.Topics)
+		if i < patterns {
+			matcher = pubsub.MatchRegex(`^bench\.topic\.`)
+		}
+		sub, err := hub.Subscribe(matcher, handler(scenario.Structured, rec))
+		if err != nil {
+			return nil, errors.Annotatef(err, "subscriber %d", i)
+		}
+		defer sub.Unsubscribe()
+	}
+
+	body := strings.Repeat("x", scenario.PayloadSize)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	for p := 0; p < scenario.Publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			err := publish(ctx, hub, scenario, p, body)
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = errors.Annotatef(err, "publisher %d", p)
+				}
+				mutex.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	duration := time.Since(start)
+	runtime.ReadMemStats(&after)
+	published := scenario.Publishers * scenario.Messages
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	report := &Report{
+		Name:             scenario.Name,
+		Published:        published,
+		Delivered:        len(rec.latencies),
+		Duration:         duration,
+		AllocsPerMessage: float64(after.Mallocs-before.Mallocs) / float64(published),
+		BytesPerMessage:  float64(after.TotalAlloc-before.TotalAlloc) / float64(published),
+	}
+	if duration > 0 {
+		report.Throughput = float64(report.Delivered) / duration.Seconds()
+	}
+	if len(rec.latencies) > 0 {
+		sort.Slice(rec.latencies, func(i, j int) bool {
+			return rec.latencies[i] < rec.latencies[j]
+		})
+		report.LatencyP50 = percentile(rec.latencies, 50)
+		report.LatencyP90 = percentile(rec.latencies, 90)
+		report.LatencyP99 = percentile(rec.latencies, 99)
+		report.LatencyMax = rec.latencies[len(rec.latencies)-1]
+	}
+	return report, nil
+}
+
+func newHub(scenario Scenario) pubsub.Hub {
+	switch {
+	case scenario.NewHub != nil:
+		return scenario.NewHub()
+	case scenario.Structured:
+		return pubsub.NewStructuredHub(nil)
+	}
+	return pubsub.NewSimpleHub()
+}
+
+func handler(structured bool, rec *recorder) interface{} {
+	if structured {
+		return func(_ pubsub.Topic, payload Payload, err error) {
+			if err == nil {
+				rec.record(payload)
+			}
+		}
+	}
+	return func(_ pubsub.Topic, data interface{}) {
+		if payload, ok := data.(Payload); ok {
+			rec.record(payload)
+		}
+	}
+}
+
+// publish publishes the messages of one publisher, and waits for them to
+// be handled.
+func publish(ctx context.Context, hub pubsub.Hub, scenario Scenario, p int, body string) error {
+	var ticker *time.Ticker
+	if scenario.PublishInterval > 0 {
+		ticker = time.NewTicker(scenario.PublishInterval)
+		defer ticker.Stop()
+	}
+	for i := 0; i < scenario.Messages; i++ {
+		if ticker != nil && i > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return errors.Trace(ctx.Err())
+			}
+		} else if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		topic := topicName((p + i) % scenario.Topics)
+		if _, err := hub.Publish(topic, Payload{Sent: time.Now(), Body: body}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	// Every subscriber matches at least one topic, and handles its
+	// messages in order, so once it reaches a barrier it has handled all
+	// the messages of this publisher.
+	for t := 0; t < scenario.Topics; t++ {
+		done, err := hub.(pubsub.Barrierer).Barrier(topicName(t))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		select {
+		case <-done.Complete():
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+	}
+	return nil
+}
+
+// percentile returns the value at the percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	index := (len(sorted)*p+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
+
+// Benchmark runs the scenario as a Go benchmark, with b.N messages for each
+// publisher, and reports the latencies and deliveries per second as extra
+// metrics.
+func Benchmark(b *testing.B, scenario Scenario) {
+	scenario.Messages = b.N
+	b.ReportAllocs()
+	b.ResetTimer()
+	report, err := Run(context.Background(), scenario)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	b.ReportMetric(report.Throughput, "deliveries/s")
+	b.ReportMetric(float64(report.LatencyP50.Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(report.LatencyP99.Nanoseconds()), "p99-ns")
+}
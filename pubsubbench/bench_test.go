@@ -0,0 +1,125 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubbench_test
+
+import (
+	"context"
+	stdtesting "testing"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/pubsubbench"
+)
+
+type BenchSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&BenchSuite{})
+
+func (*BenchSuite) TestValidate(c *gc.C) {
+	for i, test := range []struct {
+		scenario pubsubbench.Scenario
+		err      string
+	}{{
+		scenario: pubsubbench.Scenario{Messages: 1},
+		err:      "Publishers 0 not valid",
+	}, {
+		scenario: pubsubbench.Scenario{Publishers: 1},
+		err:      "Messages 0 not valid",
+	}, {
+		scenario: pubsubbench.Scenario{Publishers: 1, Messages: 1, Subscribers: -1},
+		err:      "negative Subscribers not valid",
+	}, {
+		scenario: pubsubbench.Scenario{Publishers: 1, Messages: 1, PatternFraction: 1.5},
+		err:      "PatternFraction 1.5 not valid",
+	}, {
+		scenario: pubsubbench.Scenario{Publishers: 1, Messages: 1, HandlerLatency: -time.Second},
+		err:      "negative HandlerLatency not valid",
+	}} {
+		c.Logf("test %d", i)
+		c.Check(test.scenario.Validate(), gc.ErrorMatches, test.err)
+		_, err := pubsubbench.Run(context.Background(), test.scenario)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (*BenchSuite) TestRun(c *gc.C) {
+	for _, structured := range []bool{false, true} {
+		report, err := pubsubbench.Run(context.Background(), pubsubbench.Scenario{
+			Name:            "mixed",
+			Structured:      structured,
+			Publishers:      3,
+			Messages:        20,
+			Subscribers:     4,
+			Topics:          2,
+			PatternFraction: 0.5,
+			PayloadSize:     64,
+		})
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(report.Name, gc.Equals, "mixed")
+		c.Check(report.Published, gc.Equals, 60)
+		// The two pattern subscribers get every message, and the two
+		// others get the messages of one topic each.
+		c.Check(report.Delivered, gc.Equals, 180)
+		c.Check(report.Throughput > 0, jc.IsTrue)
+		c.Check(report.LatencyP50 <= report.LatencyP90, jc.IsTrue)
+		c.Check(report.LatencyP90 <= report.LatencyP99, jc.IsTrue)
+		c.Check(report.LatencyP99 <= report.LatencyMax, jc.IsTrue)
+		c.Check(report.AllocsPerMessage > 0, jc.IsTrue)
+		c.Check(report.String(), gc.Matches, `mixed: 60 published, 180 delivered in .*`)
+	}
+}
+
+func (*BenchSuite) TestHandlerLatency(c *gc.C) {
+	report, err := pubsubbench.Run(context.Background(), pubsubbench.Scenario{
+		Publishers:     1,
+		Messages:       3,
+		Subscribers:    1,
+		HandlerLatency: 5 * time.Millisecond,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(report.Delivered, gc.Equals, 3)
+	c.Check(report.Duration >= 15*time.Millisecond, jc.IsTrue)
+	// The last message waits for the two before it to be handled.
+	c.Check(report.LatencyMax >= 10*time.Millisecond, jc.IsTrue)
+}
+
+func (*BenchSuite) TestNewHub(c *gc.C) {
+	report, err := pubsubbench.Run(context.Background(), pubsubbench.Scenario{
+		NewHub: func() pubsub.Hub {
+			return pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{MaxInFlight: 1})
+		},
+		Publishers:  2,
+		Messages:    10,
+		Subscribers: 3,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(report.Delivered, gc.Equals, 60)
+}
+
+func (*BenchSuite) TestCancelled(c *gc.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := pubsubbench.Run(ctx, pubsubbench.Scenario{
+		Publishers:  1,
+		Messages:    10,
+		Subscribers: 1,
+	})
+	c.Check(err, gc.ErrorMatches, "publisher 0: context canceled")
+}
+
+func BenchmarkFanOut(b *stdtesting.B) {
+	pubsubbench.Benchmark(b, pubsubbench.Scenario{
+		Publishers:      4,
+		Subscribers:     16,
+		Topics:          8,
+		PatternFraction: 0.25,
+		PayloadSize:     256,
+	})
+}
@@ -0,0 +1,335 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package pubsubdebug provides an http.Handler that shows the state of a
+// hub, in the same way that expvar and net/http/pprof do for the process,
+// so it can be attached to an existing debug server.
+package pubsubdebug
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/pubsub"
+)
+
+// Path is the conventional path to serve the handler on.
+const Path = "/debug/pubsub"
+
+const (
+	defaultMaxTopics     = 100
+	defaultMaxDataLength = 200
+)
+
+// Config is the argument struct for NewHandler.
+type Config struct {
+	// Hub is the hub that is shown. It must implement pubsub.Reporter,
+	// and pubsub.ChanSubscriber if RecentMessages is set.
+	Hub pubsub.Hub
+
+	// RecentMessages is the number of recent messages kept for each topic.
+	// If it is zero, no messages are recorded and the handler doesn't
+	// subscribe to the hub.
+	RecentMessages int
+
+	// MaxTopics bounds the number of topics that recent messages are kept
+	// for. Once it is reached, the topic published on least recently is
+	// forgotten. It defaults to 100.
+	MaxTopics int
+
+	// MaxDataLength is the length that the text form of the data of each
+	// recent message is truncated to. It defaults to 200.
+	MaxDataLength int
+
+	// Redactor, if set, masks the secret values of the recent messages
+	// before they are recorded.
+	Redactor *pubsub.Redactor
+}
+
+// Validate checks that the config values are valid.
+func (config Config) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if _, ok := config.Hub.(pubsub.Reporter); !ok {
+		return errors.NotValidf("Hub %T without Report", config.Hub)
+	}
+	if config.RecentMessages < 0 {
+		return errors.NotValidf("negative RecentMessages")
+	}
+	if config.MaxTopics < 0 {
+		return errors.NotValidf("negative MaxTopics")
+	}
+	if config.MaxDataLength < 0 {
+		return errors.NotValidf("negative MaxDataLength")
+	}
+	return nil
+}
+
+// Handler serves the Report of a hub, along with the recent messages of
+// each topic. The page is HTML unless the request has a format=json query
+// parameter or accepts application/json, in which case the same values are
+// served as a JSON object with "report" and "recent" keys.
+type Handler struct {
+	config Config
+	close  func()
+	done   chan struct{}
+
+	mu     sync.Mutex
+	topics map[pubsub.Topic]*topicHistory
+}
+
+// RecentMessage describes a message recorded by the handler.
+type RecentMessage struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Data     string    `json:"data"`
+}
+
+type topicHistory struct {
+	// messages is a ring of the recent messages, and next is the index the
+	// next message is written to.
+	messages []RecentMessage
+	next     int
+	count    int
+	last     time.Time
+}
+
+// NewHandler returns a handler for the hub. If the handler records recent
+// messages, Close must be called to unsubscribe from the hub.
+func NewHandler(config Config) (*Handler, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if config.MaxTopics == 0 {
+		config.MaxTopics = defaultMaxTopics
+	}
+	if config.MaxDataLength == 0 {
+		config.MaxDataLength = defaultMaxDataLength
+	}
+	h := &Handler{
+		config: config,
+		done:   make(chan struct{}),
+		topics: make(map[pubsub.Topic]*topicHistory),
+	}
+	if config.RecentMessages == 0 {
+		h.close = func() {}
+		close(h.done)
+		return h, nil
+	}
+	messages, closer, err := pubsub.SubscribeChan(config.Hub, pubsub.MatchAll, config.RecentMessages)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	h.close = closer
+	go h.loop(messages)
+	return h, nil
+}
+
+// Close unsubscribes the handler from the hub. The handler still serves
+// the report, and the messages recorded before it was closed.
+func (h *Handler) Close() {
+	h.close()
+	<-h.done
+}
+
+func (h *Handler) loop(messages <-chan pubsub.Message) {
+	defer close(h.done)
+	for message := range messages {
+		h.record(message)
+	}
+}
+
+func (h *Handler) record(message pubsub.Message) {
+	now := time.Now()
+	value, err := h.config.Redactor.Redact(message.Topic, message.Data)
+	if err != nil {
+		value = fmt.Sprintf("redacting data: %v", err)
+	}
+	data := fmt.Sprintf("%v", value)
+	if len(data) > h.config.MaxDataLength {
+		data = data[:h.config.MaxDataLength] + "..."
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	history, ok := h.topics[message.Topic]
+	if !ok {
+		if len(h.topics) >= h.config.MaxTopics {
+			h.forgetOldest()
+		}
+		history = &topicHistory{messages: make([]RecentMessage, h.config.RecentMessages)}
+		h.topics[message.Topic] = history
+	}
+	history.messages[history.next] = RecentMessage{
+		Sequence: message.Delivery.Sequence,
+		Time:     now,
+		Data:     data,
+	}
+	history.next = (history.next + 1) % len(history.messages)
+	if history.count < len(history.messages) {
+		history.count++
+	}
+	history.last = now
+}
+
+// forgetOldest removes the topic that was published on least recently.
+// The mutex must be held.
+func (h *Handler) forgetOldest() {
+	var (
+		oldest pubsub.Topic
+		last   time.Time
+		found  bool
+	)
+	for topic, history := range h.topics {
+		if !found || history.last.Before(last) {
+			oldest, last, found = topic, history.last, true
+		}
+	}
+	delete(h.topics, oldest)
+}
+
+// Recent returns the recent messages of each topic, oldest first.
+func (h *Handler) Recent() map[pubsub.Topic][]RecentMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make(map[pubsub.Topic][]RecentMessage, len(h.topics))
+	for topic, history := range h.topics {
+		messages := make([]RecentMessage, 0, history.count)
+		start := history.next - history.count
+		if start < 0 {
+			start += len(history.messages)
+		}
+		for i := 0; i < history.count; i++ {
+			messages = append(messages, history.messages[(start+i)%len(history.messages)])
+		}
+		result[topic] = messages
+	}
+	return result
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := h.config.Hub.(pubsub.Reporter).Report()
+	recent := h.Recent()
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"report": report,
+			"recent": recent,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	page, err := newPage(report, recent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+type page struct {
+	Published   interface{}
+	Subscribers []pageSubscriber
+	Topics      []pageTopic
+	Report      string
+}
+
+type pageSubscriber struct {
+	ID        string
+	Name      interface{}
+	Matcher   interface{}
+	Pending   interface{}
+	Delivered interface{}
+}
+
+type pageTopic struct {
+	Topic    pubsub.Topic
+	Messages []RecentMessage
+}
+
+func newPage(report map[string]interface{}, recent map[pubsub.Topic][]RecentMessage) (*page, error) {
+	text, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, errors.Annotate(err, "serializing report")
+	}
+	result := &page{
+		Published: report["published"],
+		Report:    string(text),
+	}
+	subscribers, _ := report["subscribers"].(map[string]interface{})
+	for id, value := range subscribers {
+		sub, _ := value.(map[string]interface{})
+		result.Subscribers = append(result.Subscribers, pageSubscriber{
+			ID:        id,
+			Name:      sub["name"],
+			Matcher:   sub["matcher"],
+			Pending:   sub["pending"],
+			Delivered: sub["delivered"],
+		})
+	}
+	sort.Slice(result.Subscribers, func(i, j int) bool {
+		a, b := result.Subscribers[i].ID, result.Subscribers[j].ID
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	for topic, messages := range recent {
+		result.Topics = append(result.Topics, pageTopic{Topic: topic, Messages: messages})
+	}
+	sort.Slice(result.Topics, func(i, j int) bool {
+		return result.Topics[i].Topic < result.Topics[j].Topic
+	})
+	return result, nil
+}
+
+var pageTemplate = template.Must(template.New("pubsub").Parse(`<!DOCTYPE html>
+<html>
+<head><title>pubsub</title></head>
+<body>
+<h1>pubsub</h1>
+<p>Published: {{.Published}}</p>
+<h2>Subscribers</h2>
+<table>
+<tr><th>ID</th><th>Name</th><th>Matcher</th><th>Pending</th><th>Delivered</th></tr>
+{{range .Subscribers}}<tr><td>{{.ID}}</td><td>{{.Name}}</td><td>{{.Matcher}}</td><td>{{.Pending}}</td><td>{{.Delivered}}</td></tr>
+{{end}}</table>
+<h2>Recent messages</h2>
+{{range .Topics}}<h3>{{.Topic}}</h3>
+<table>
+<tr><th>Sequence</th><th>Time</th><th>Data</th></tr>
+{{range .Messages}}<tr><td>{{.Sequence}}</td><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.Data}}</td></tr>
+{{end}}</table>
+{{else}}<p>None recorded.</p>
+{{end}}<h2>Report</h2>
+<pre>{{.Report}}</pre>
+</body>
+</html>
+`))
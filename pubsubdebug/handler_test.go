@@ -0,0 +1,239 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubdebug_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/pubsubdebug"
+)
+
+type HandlerSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&HandlerSuite{})
+
+func (*HandlerSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	for i, test := range []struct {
+		config pubsubdebug.Config
+		err    string
+	}{{
+		config: pubsubdebug.Config{},
+		err:    "missing Hub not valid",
+	}, {
+		config: pubsubdebug.Config{Hub: hub, RecentMessages: -1},
+		err:    "negative RecentMessages not valid",
+	}, {
+		config: pubsubdebug.Config{Hub: hub, MaxTopics: -1},
+		err:    "negative MaxTopics not valid",
+	}, {
+		config: pubsubdebug.Config{Hub: hub, MaxDataLength: -1},
+		err:    "negative MaxDataLength not valid",
+	}, {
+		config: pubsubdebug.Config{Hub: hub},
+	}} {
+		c.Logf("test %d", i)
+		err := test.config.Validate()
+		if test.err == "" {
+			c.Check(err, jc.ErrorIsNil)
+		} else {
+			c.Check(err, gc.ErrorMatches, test.err)
+		}
+	}
+}
+
+func newHandler(c *gc.C, config pubsubdebug.Config) *pubsubdebug.Handler {
+	handler, err := pubsubdebug.NewHandler(config)
+	c.Assert(err, jc.ErrorIsNil)
+	return handler
+}
+
+func publish(c *gc.C, hub pubsub.Hub, topic pubsub.Topic, data interface{}) {
+	done, err := hub.Publish(topic, data)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-done.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+}
+
+// waitRecorded waits until the handler has recorded the given number of
+// messages.
+func waitRecorded(c *gc.C, handler *pubsubdebug.Handler, count int) map[pubsub.Topic][]pubsubdebug.RecentMessage {
+	deadline := time.After(time.Second)
+	for {
+		recent := handler.Recent()
+		total := 0
+		for _, messages := range recent {
+			total += len(messages)
+		}
+		if total >= count {
+			return recent
+		}
+		select {
+		case <-deadline:
+			c.Fatalf("only %d of %d messages recorded", total, count)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// waitTopic waits until the handler has recorded a message on the topic.
+func waitTopic(c *gc.C, handler *pubsubdebug.Handler, topic pubsub.Topic) map[pubsub.Topic][]pubsubdebug.RecentMessage {
+	deadline := time.After(time.Second)
+	for {
+		recent := handler.Recent()
+		if len(recent[topic]) > 0 {
+			return recent
+		}
+		select {
+		case <-deadline:
+			c.Fatalf("no message recorded on %q", topic)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (*HandlerSuite) TestRecentBounded(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newHandler(c, pubsubdebug.Config{
+		Hub:            hub,
+		RecentMessages: 2,
+		MaxTopics:      2,
+		MaxDataLength:  5,
+	})
+	defer handler.Close()
+
+	publish(c, hub, "first", "one")
+	publish(c, hub, "first", "two")
+	publish(c, hub, "first", "three and more")
+	publish(c, hub, "second", 4)
+	recent := waitRecorded(c, handler, 3)
+	c.Assert(recent, gc.HasLen, 2)
+	first := recent["first"]
+	c.Assert(first, gc.HasLen, 2)
+	c.Check(first[0].Sequence, gc.Equals, uint64(2))
+	c.Check(first[0].Data, gc.Equals, "two")
+	c.Check(first[1].Sequence, gc.Equals, uint64(3))
+	c.Check(first[1].Data, gc.Equals, "three...")
+	c.Check(recent["second"][0].Data, gc.Equals, "4")
+
+	// A third topic pushes out the one published on least recently.
+	publish(c, hub, "third", nil)
+	recent = waitTopic(c, handler, "third")
+	c.Check(recent, gc.HasLen, 2)
+	c.Check(recent["first"], gc.HasLen, 0)
+	c.Check(recent["third"][0].Data, gc.Equals, "<nil>")
+}
+
+func (*HandlerSuite) TestClose(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newHandler(c, pubsubdebug.Config{Hub: hub, RecentMessages: 1})
+	publish(c, hub, "first", "one")
+	waitRecorded(c, handler, 1)
+	handler.Close()
+
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+	publish(c, hub, "second", "two")
+	c.Check(handler.Recent(), gc.HasLen, 1)
+}
+
+func (*HandlerSuite) TestNoRecentDoesNotSubscribe(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newHandler(c, pubsubdebug.Config{Hub: hub})
+	defer handler.Close()
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+}
+
+func (*HandlerSuite) TestJSON(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	handler := newHandler(c, pubsubdebug.Config{Hub: hub, RecentMessages: 5})
+	defer handler.Close()
+	_, err := hub.Subscribe(pubsub.MatchAll, func(pubsub.Topic, map[string]interface{}, error) {},
+		pubsub.Named("watcher"))
+	c.Assert(err, jc.ErrorIsNil)
+	publish(c, hub, "first", map[string]interface{}{"key": "value"})
+	waitRecorded(c, handler, 1)
+
+	for i, request := range []*http.Request{
+		httptest.NewRequest("GET", pubsubdebug.Path+"?format=json", nil),
+		func() *http.Request {
+			r := httptest.NewRequest("GET", pubsubdebug.Path, nil)
+			r.Header.Set("Accept", "application/json")
+			return r
+		}(),
+	} {
+		c.Logf("request %d", i)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		c.Assert(w.Code, gc.Equals, http.StatusOK)
+		c.Check(w.Header().Get("Content-Type"), gc.Equals, "application/json")
+
+		var result struct {
+			Report struct {
+				Published   int                               `json:"published"`
+				Subscribers map[string]map[string]interface{} `json:"subscribers"`
+			} `json:"report"`
+			Recent map[string][]pubsubdebug.RecentMessage `json:"recent"`
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &result)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(result.Report.Published, gc.Equals, 1)
+		c.Check(result.Report.Subscribers, gc.HasLen, 2)
+		c.Assert(result.Recent["first"], gc.HasLen, 1)
+		c.Check(result.Recent["first"][0].Data, gc.Equals, "map[key:value]")
+	}
+}
+
+func (*HandlerSuite) TestHTML(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newHandler(c, pubsubdebug.Config{Hub: hub, RecentMessages: 5})
+	defer handler.Close()
+	_, err := hub.Subscribe(pubsub.MatchAll, func(pubsub.Topic, interface{}) {},
+		pubsub.Named("watcher"))
+	c.Assert(err, jc.ErrorIsNil)
+	publish(c, hub, "first", "<script>")
+	waitRecorded(c, handler, 1)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", pubsubdebug.Path, nil))
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	c.Check(w.Header().Get("Content-Type"), gc.Equals, "text/html; charset=utf-8")
+	body := w.Body.String()
+	c.Check(body, jc.Contains, "<td>watcher</td>")
+	c.Check(body, jc.Contains, "<h3>first</h3>")
+	c.Check(body, jc.Contains, "&lt;script&gt;")
+	c.Check(strings.Contains(body, "<script>"), jc.IsFalse)
+}
+
+func (*HandlerSuite) TestMethodNotAllowed(c *gc.C) {
+	handler := newHandler(c, pubsubdebug.Config{Hub: pubsub.NewSimpleHub()})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", pubsubdebug.Path, nil))
+	c.Check(w.Code, gc.Equals, http.StatusMethodNotAllowed)
+}
+
+func (*HandlerSuite) TestRedactor(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	redactor, err := pubsub.NewRedactor(pubsub.RedactorConfig{KeyPatterns: []string{"password"}})
+	c.Assert(err, jc.ErrorIsNil)
+	handler := newHandler(c, pubsubdebug.Config{Hub: hub, RecentMessages: 1, Redactor: redactor})
+	defer handler.Close()
+
+	publish(c, hub, "first", map[string]interface{}{"user": "admin", "password": "hunter2"})
+	recent := waitTopic(c, handler, "first")
+	c.Check(recent["first"][0].Data, gc.Equals, "map[password:[redacted] user:admin]")
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubdebug
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+
+	"github.com/juju/pubsub"
+)
+
+var logger = loggo.GetLogger("pubsub.debug")
+
+// expvarMetrics counts the messages delivered and dropped, and the total
+// latency of those delivered, in an expvar.Map.
+type expvarMetrics struct {
+	vars *expvar.Map
+}
+
+var expvarMutex sync.Mutex
+
+// NewExpvarMetrics returns metrics kept in the named expvar.Map, which is
+// served by the expvar handler. The map is shared by the metrics created
+// with the same name, as expvar names can only be published once. If the
+// name is taken by another kind of variable, the map isn't published.
+func NewExpvarMetrics(name string) pubsub.Metrics {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	existing := expvar.Get(name)
+	vars, ok := existing.(*expvar.Map)
+	switch {
+	case existing == nil:
+		vars = expvar.NewMap(name)
+	case !ok:
+		logger.Warningf("expvar %q is not a map, hub metrics not published", name)
+		vars = new(expvar.Map).Init()
+	}
+	return &expvarMetrics{vars: vars}
+}
+
+// Delivered implements pubsub.Metrics.
+func (m *expvarMetrics) Delivered(labels map[string]string, topic pubsub.Topic, latency time.Duration) {
+	m.vars.Add("delivered", 1)
+	m.vars.Add("latency-ns", int64(latency))
+}
+
+// Dropped implements pubsub.Metrics.
+func (m *expvarMetrics) Dropped(labels map[string]string, topic pubsub.Topic) {
+	m.vars.Add("dropped", 1)
+}
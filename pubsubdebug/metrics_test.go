@@ -0,0 +1,50 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubdebug_test
+
+import (
+	"expvar"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/pubsubdebug"
+)
+
+type MetricsSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MetricsSuite{})
+
+func (*MetricsSuite) TestExpvarMetrics(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		Metrics: pubsubdebug.NewExpvarMetrics("pubsub-test"),
+	})
+	vars := expvar.Get("pubsub-test").(*expvar.Map)
+	var before int64
+	if delivered, ok := vars.Get("delivered").(*expvar.Int); ok {
+		before = delivered.Value()
+	}
+
+	_, err := hub.Subscribe(pubsub.Topic("topic"), func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	publish(c, hub, "topic", "data")
+
+	delivered := vars.Get("delivered").(*expvar.Int).Value()
+	c.Check(delivered-before, gc.Equals, int64(1))
+
+	// Other metrics with the same name share the map.
+	c.Check(pubsubdebug.NewExpvarMetrics("pubsub-test"), gc.NotNil)
+}
+
+func (*MetricsSuite) TestExpvarNameTaken(c *gc.C) {
+	expvar.NewString("pubsub-taken")
+	metrics := pubsubdebug.NewExpvarMetrics("pubsub-taken")
+	metrics.Dropped(nil, "topic")
+	_, ok := expvar.Get("pubsub-taken").(*expvar.String)
+	c.Check(ok, jc.IsTrue)
+}
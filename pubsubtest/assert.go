@@ -0,0 +1,246 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubtest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/pubsub"
+)
+
+// TestingT is the part of a test that the assertions use. Both *testing.T
+// and the *check.C of gocheck satisfy it.
+type TestingT interface {
+	Fatalf(format string, args ...interface{})
+}
+
+// helper marks the calling function as a test helper, for tests that
+// support it.
+func helper(t TestingT) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+}
+
+// PayloadMatcher decides whether the data of a message is what a test is
+// waiting for. A nil PayloadMatcher matches any data.
+type PayloadMatcher func(data interface{}) bool
+
+// PayloadEquals returns a matcher for data that is deeply equal to the
+// expected value.
+func PayloadEquals(expected interface{}) PayloadMatcher {
+	return func(data interface{}) bool {
+		return reflect.DeepEqual(data, expected)
+	}
+}
+
+// PayloadHasFields returns a matcher for the map form of the data of a
+// structured hub that has all the fields given, with deeply equal values.
+// Other fields are ignored.
+func PayloadHasFields(fields map[string]interface{}) PayloadMatcher {
+	return func(data interface{}) bool {
+		asMap, ok := data.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, expected := range fields {
+			value, exists := asMap[key]
+			if !exists || !reflect.DeepEqual(value, expected) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (m PayloadMatcher) match(data interface{}) bool {
+	return m == nil || m(data)
+}
+
+// Watcher records the messages published on a hub from when it is created,
+// so tests can assert on messages published by the code under test without
+// their own subscriptions and polling loops. Each message satisfies at most
+// one AssertPublished call, so a test can wait for the same message to be
+// published more than once.
+type Watcher struct {
+	closer func()
+	done   chan struct{}
+
+	mutex    sync.Mutex
+	messages []pubsub.Message
+	claimed  []bool
+	changed  chan struct{}
+}
+
+// NewWatcher starts watching the messages published on the hub. Close the
+// watcher at the end of the test.
+func NewWatcher(hub pubsub.Hub) (*Watcher, error) {
+	if hub == nil {
+		return nil, errors.NotValidf("missing hub")
+	}
+	messages, closer, err := pubsub.SubscribeChan(hub, pubsub.MatchAll, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	w := &Watcher{
+		closer:  closer,
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	go w.loop(messages)
+	return w, nil
+}
+
+func (w *Watcher) loop(messages <-chan pubsub.Message) {
+	defer close(w.done)
+	for message := range messages {
+		w.mutex.Lock()
+		w.messages = append(w.messages, message)
+		w.claimed = append(w.claimed, false)
+		close(w.changed)
+		w.changed = make(chan struct{})
+		w.mutex.Unlock()
+	}
+}
+
+// Messages returns all the messages the watcher has seen, in the order
+// they were published.
+func (w *Watcher) Messages() []pubsub.Message {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]pubsub.Message(nil), w.messages...)
+}
+
+// Close stops watching the hub.
+func (w *Watcher) Close() {
+	w.closer()
+	<-w.done
+}
+
+// find returns the index of the first unclaimed message that matches, or
+// -1, along with a channel that is closed when another message arrives.
+func (w *Watcher) find(topic pubsub.TopicMatcher, payload PayloadMatcher) (int, <-chan struct{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for i, message := range w.messages {
+		if !w.claimed[i] && topic.Match(message.Topic) && payload.match(message.Data) {
+			return i, nil
+		}
+	}
+	return -1, w.changed
+}
+
+// wait waits until a matching message has been seen, or the time is up.
+// It returns the index of the message, or -1.
+func (w *Watcher) wait(topic pubsub.TopicMatcher, payload PayloadMatcher, within time.Duration) int {
+	timer := time.NewTimer(within)
+	defer timer.Stop()
+	for {
+		index, changed := w.find(topic, payload)
+		if index >= 0 {
+			return index
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return -1
+		}
+	}
+}
+
+// AssertPublished waits for a message on a topic that the matcher matches,
+// with data that the payload matcher matches, to be published, and fails
+// the test if there isn't one within the time given. Messages published
+// before the call are considered, as long as they were published after the
+// watcher was created. The message is returned, and won't satisfy later
+// calls.
+func (w *Watcher) AssertPublished(t TestingT, topic pubsub.TopicMatcher, payload PayloadMatcher, within time.Duration) pubsub.Message {
+	helper(t)
+	index := w.wait(topic, payload, within)
+	if index < 0 {
+		t.Fatalf("no matching message published on %v within %v%s", topic, within, w.seen(topic))
+		return pubsub.Message{}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.claimed[index] = true
+	return w.messages[index]
+}
+
+// AssertNoPublish waits for the time given, and fails the test if a message
+// on a topic that the matcher matches, with data that the payload matcher
+// matches, has been published. Messages that satisfied an AssertPublished
+// call are not considered.
+func (w *Watcher) AssertNoPublish(t TestingT, topic pubsub.TopicMatcher, payload PayloadMatcher, within time.Duration) {
+	helper(t)
+	index := w.wait(topic, payload, within)
+	if index >= 0 {
+		w.mutex.Lock()
+		message := w.messages[index]
+		w.mutex.Unlock()
+		t.Fatalf("unexpected message published on %q: %#v", message.Topic, message.Data)
+	}
+}
+
+// seen describes the messages seen on the topic, for failure messages.
+func (w *Watcher) seen(topic pubsub.TopicMatcher) string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var lines []string
+	for i, message := range w.messages {
+		if topic.Match(message.Topic) {
+			claimed := ""
+			if w.claimed[i] {
+				claimed = " (already matched)"
+			}
+			lines = append(lines, fmt.Sprintf("\n    %q: %#v%s", message.Topic, message.Data, claimed))
+		}
+	}
+	if len(lines) == 0 {
+		return ", no messages seen on the topic"
+	}
+	return ", messages seen on the topic:" + strings.Join(lines, "")
+}
+
+// AssertPublished waits for a matching message to be published on the hub
+// after the call, and fails the test if there isn't one within the time
+// given. It suits messages published by other goroutines, such as workers
+// that publish as they run. To also consider messages published before the
+// call, use a Watcher.
+func AssertPublished(t TestingT, hub pubsub.Hub, topic pubsub.TopicMatcher, payload PayloadMatcher, within time.Duration) pubsub.Message {
+	helper(t)
+	w := newWatcher(t, hub)
+	if w == nil {
+		return pubsub.Message{}
+	}
+	defer w.Close()
+	return w.AssertPublished(t, topic, payload, within)
+}
+
+// AssertNoPublish fails the test if a matching message is published on
+// the hub within the time given after the call.
+func AssertNoPublish(t TestingT, hub pubsub.Hub, topic pubsub.TopicMatcher, payload PayloadMatcher, within time.Duration) {
+	helper(t)
+	w := newWatcher(t, hub)
+	if w == nil {
+		return
+	}
+	defer w.Close()
+	w.AssertNoPublish(t, topic, payload, within)
+}
+
+func newWatcher(t TestingT, hub pubsub.Hub) *Watcher {
+	helper(t)
+	w, err := NewWatcher(hub)
+	if err != nil {
+		t.Fatalf("watching hub: %v", err)
+	}
+	return w
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubtest_test
+
+import (
+	"fmt"
+	stdtesting "testing"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/pubsubtest"
+)
+
+type AssertSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&AssertSuite{})
+
+// failures records the failures of the assertions, rather than stopping
+// the test.
+type failures []string
+
+func (f *failures) Fatalf(format string, args ...interface{}) {
+	*f = append(*f, fmt.Sprintf(format, args...))
+}
+
+func (*AssertSuite) TestPayloadMatchers(c *gc.C) {
+	c.Check(pubsubtest.PayloadEquals("hello")("hello"), jc.IsTrue)
+	c.Check(pubsubtest.PayloadEquals("hello")("world"), jc.IsFalse)
+
+	fields := pubsubtest.PayloadHasFields(map[string]interface{}{"name": "fred"})
+	c.Check(fields(map[string]interface{}{"name": "fred", "age": 42.0}), jc.IsTrue)
+	c.Check(fields(map[string]interface{}{"name": "mary"}), jc.IsFalse)
+	c.Check(fields(map[string]interface{}{}), jc.IsFalse)
+	c.Check(fields("fred"), jc.IsFalse)
+}
+
+func (*AssertSuite) TestWatcherPublishedBefore(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	watcher, err := pubsubtest.NewWatcher(hub)
+	c.Assert(err, jc.ErrorIsNil)
+	defer watcher.Close()
+
+	for _, name := range []string{"fred", "mary", "fred"} {
+		done, err := hub.Publish(topic, map[string]interface{}{"name": name})
+		c.Assert(err, jc.ErrorIsNil)
+		<-done.Complete()
+	}
+	fred := pubsubtest.PayloadHasFields(map[string]interface{}{"name": "fred"})
+	first := watcher.AssertPublished(c, topic, fred, time.Second)
+	second := watcher.AssertPublished(c, topic, fred, time.Second)
+	c.Check(first.Delivery.Sequence, gc.Equals, uint64(1))
+	c.Check(second.Delivery.Sequence, gc.Equals, uint64(3))
+	watcher.AssertNoPublish(c, topic, fred, 10*time.Millisecond)
+	c.Check(watcher.Messages(), gc.HasLen, 3)
+
+	var f failures
+	watcher.AssertPublished(&f, topic, fred, 10*time.Millisecond)
+	c.Assert(f, gc.HasLen, 1)
+	c.Check(f[0], gc.Matches, `(?s)no matching message published on testing within 10ms, messages seen on the topic:
+    "testing": .*"fred".* \(already matched\)
+    "testing": .*"mary".*
+    "testing": .*"fred".* \(already matched\)`)
+}
+
+func (*AssertSuite) TestAssertPublished(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(5 * time.Millisecond)
+			hub.Publish(topic, i)
+		}
+	}()
+	message := pubsubtest.AssertPublished(c, hub, pubsub.MatchAll, pubsubtest.PayloadEquals(3), time.Second)
+	c.Check(message.Topic, gc.Equals, topic)
+	c.Check(message.Data, gc.Equals, 3)
+}
+
+func (*AssertSuite) TestAssertPublishedFails(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var f failures
+	message := pubsubtest.AssertPublished(&f, hub, topic, nil, 10*time.Millisecond)
+	c.Check(message.Topic, gc.Equals, pubsub.Topic(""))
+	c.Check(f, jc.DeepEquals, failures{
+		"no matching message published on testing within 10ms, no messages seen on the topic",
+	})
+
+	f = nil
+	pubsubtest.AssertPublished(&f, nil, topic, nil, time.Millisecond)
+	c.Check(f, jc.DeepEquals, failures{"watching hub: missing hub not valid"})
+}
+
+func (*AssertSuite) TestAssertNoPublish(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	pubsubtest.AssertNoPublish(c, hub, topic, nil, 10*time.Millisecond)
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		hub.Publish("other", "ignored")
+		hub.Publish(topic, "unwanted")
+	}()
+	var f failures
+	pubsubtest.AssertNoPublish(&f, hub, topic, nil, time.Second)
+	c.Check(f, jc.DeepEquals, failures{`unexpected message published on "testing": "unwanted"`})
+}
+
+func TestAssertPublishedStdlib(t *stdtesting.T) {
+	hub := pubsub.NewSimpleHub()
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		hub.Publish(topic, "hello")
+	}()
+	pubsubtest.AssertPublished(t, hub, topic, pubsubtest.PayloadEquals("hello"), time.Second)
+}
@@ -0,0 +1,274 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package pubsubtest provides helpers for testing code that uses the pubsub
+// package.
+package pubsubtest
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/pubsub"
+)
+
+// ChaosConfig defines how often a ChaosHub misbehaves. The rates are the
+// probability, between zero and one, of each published message being
+// affected. A message is only affected by one kind of misbehaviour, which
+// is checked in the order drop, duplicate, delay, reorder.
+type ChaosConfig struct {
+	// Seed seeds the random source that decides what happens to each
+	// message, so a sequence of publishes is always affected in the same
+	// way for a given seed.
+	Seed int64
+
+	// DropRate is the probability of a message not being published at all.
+	DropRate float64
+
+	// DuplicateRate is the probability of a message being published twice.
+	DuplicateRate float64
+
+	// DelayRate is the probability of a message being published after a
+	// delay of up to MaxDelay. Messages published during the delay are
+	// delivered before the delayed message.
+	DelayRate float64
+	MaxDelay  time.Duration
+
+	// ReorderRate is the probability of a message being held back until
+	// after the next message is published, swapping the order of the two.
+	ReorderRate float64
+}
+
+// Validate checks that the rates are all valid probabilities.
+func (config ChaosConfig) Validate() error {
+	for name, rate := range map[string]float64{
+		"DropRate":      config.DropRate,
+		"DuplicateRate": config.DuplicateRate,
+		"DelayRate":     config.DelayRate,
+		"ReorderRate":   config.ReorderRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return errors.NotValidf("%s %v", name, rate)
+		}
+	}
+	if config.DelayRate > 0 && config.MaxDelay <= 0 {
+		return errors.NotValidf("DelayRate without MaxDelay")
+	}
+	return nil
+}
+
+// ChaosStats counts the messages that a ChaosHub has misbehaved with.
+type ChaosStats struct {
+	Published  int
+	Dropped    int
+	Duplicated int
+	Delayed    int
+	Reordered  int
+}
+
+// ChaosHub wraps a hub, and misbehaves when messages are published in the
+// ways defined by its config. It is intended to test that the consumers of
+// messages are resilient to lost, duplicated, late and out of order
+// messages, such as can happen when messages are bridged between
+// processes. Note that delays and reordering break the normal ordering
+// guarantees of the hub.
+//
+// Messages passed to Publish, PublishCtx, PublishAndWaitLocal and Requeue
+// are all interfered with. The wrapped hub must implement the optional
+// interface of each of these that is used, as well as pubsub.Barrierer for
+// Barrier.
+type ChaosHub struct {
+	pubsub.Hub
+
+	config ChaosConfig
+
+	mutex  sync.Mutex
+	random *rand.Rand
+	stats  ChaosStats
+	held   *heldMessage
+	wait   sync.WaitGroup
+}
+
+type heldMessage struct {
+	publish func() (pubsub.Completer, error)
+	done    chan struct{}
+}
+
+// NewChaosHub returns a ChaosHub that wraps the hub.
+func NewChaosHub(hub pubsub.Hub, config ChaosConfig) (*ChaosHub, error) {
+	if hub == nil {
+		return nil, errors.NotValidf("nil hub")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &ChaosHub{
+		Hub:    hub,
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+	}, nil
+}
+
+// Publish implements pubsub.Hub.
+func (h *ChaosHub) Publish(topic pubsub.Topic, data interface{}) (pubsub.Completer, error) {
+	return h.PublishCtx(context.Background(), topic, data)
+}
+
+// PublishCtx implements pubsub.ContextPublisher.
+func (h *ChaosHub) PublishCtx(ctx context.Context, topic pubsub.Topic, data interface{}) (pubsub.Completer, error) {
+	return h.misbehave(func() (pubsub.Completer, error) {
+		return pubsub.PublishCtx(ctx, h.Hub, topic, data)
+	})
+}
+
+// PublishAndWaitLocal implements pubsub.LocalPublisher.
+func (h *ChaosHub) PublishAndWaitLocal(topic pubsub.Topic, data interface{}, local pubsub.Subscription) (pubsub.Completer, error) {
+	publisher, ok := h.Hub.(pubsub.LocalPublisher)
+	if !ok {
+		return nil, errors.NotValidf("hub %T without PublishAndWaitLocal", h.Hub)
+	}
+	return h.misbehave(func() (pubsub.Completer, error) {
+		return publisher.PublishAndWaitLocal(topic, data, local)
+	})
+}
+
+// Requeue implements pubsub.Requeuer. Each of the messages is interfered
+// with separately.
+func (h *ChaosHub) Requeue(messages []pubsub.Message) (pubsub.Completer, error) {
+	requeuer, ok := h.Hub.(pubsub.Requeuer)
+	if !ok {
+		return nil, errors.NotValidf("hub %T without Requeue", h.Hub)
+	}
+	var results []pubsub.Completer
+	for _, message := range messages {
+		message := message
+		result, err := h.misbehave(func() (pubsub.Completer, error) {
+			return requeuer.Requeue([]pubsub.Message{message})
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		results = append(results, result)
+	}
+	done := make(completer)
+	go func() {
+		for _, result := range results {
+			<-result.Complete()
+		}
+		close(done)
+	}()
+	return done, nil
+}
+
+// Barrier implements pubsub.Barrierer. The barrier is not a message, so it
+// is not interfered with, and it doesn't wait for the messages that are
+// held back or delayed. Call Flush first to include them.
+func (h *ChaosHub) Barrier(topic pubsub.Topic) (pubsub.Completer, error) {
+	barrierer, ok := h.Hub.(pubsub.Barrierer)
+	if !ok {
+		return nil, errors.NotValidf("hub %T without Barrier", h.Hub)
+	}
+	return barrierer.Barrier(topic)
+}
+
+// misbehave calls publish to pass a message on to the wrapped hub, as many
+// times and when the config dictates.
+func (h *ChaosHub) misbehave(publish func() (pubsub.Completer, error)) (pubsub.Completer, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stats.Published++
+
+	// Any held message is released after this one, whatever happens to
+	// this one.
+	held := h.held
+	h.held = nil
+	defer func() {
+		if held != nil {
+			h.release(held)
+		}
+	}()
+
+	switch {
+	case h.chance(h.config.DropRate):
+		h.stats.Dropped++
+		return completed(), nil
+	case h.chance(h.config.DuplicateRate):
+		h.stats.Duplicated++
+		if _, err := publish(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return publish()
+	case h.chance(h.config.DelayRate):
+		h.stats.Delayed++
+		delay := time.Duration(h.random.Int63n(int64(h.config.MaxDelay)) + 1)
+		message := &heldMessage{publish: publish, done: make(chan struct{})}
+		h.wait.Add(1)
+		time.AfterFunc(delay, func() {
+			defer h.wait.Done()
+			h.mutex.Lock()
+			defer h.mutex.Unlock()
+			h.release(message)
+		})
+		return completer(message.done), nil
+	case held == nil && h.chance(h.config.ReorderRate):
+		h.stats.Reordered++
+		h.held = &heldMessage{publish: publish, done: make(chan struct{})}
+		return completer(h.held.done), nil
+	}
+	return publish()
+}
+
+func (h *ChaosHub) chance(rate float64) bool {
+	return rate > 0 && h.random.Float64() < rate
+}
+
+// release publishes the held message, and closes its done channel when the
+// publish completes. The mutex must be held.
+func (h *ChaosHub) release(message *heldMessage) {
+	result, err := message.publish()
+	if err != nil {
+		close(message.done)
+		return
+	}
+	go func() {
+		<-result.Complete()
+		close(message.done)
+	}()
+}
+
+// Flush publishes any message held back for reordering, and waits for all
+// the delayed messages to be published.
+func (h *ChaosHub) Flush() {
+	h.mutex.Lock()
+	if h.held != nil {
+		h.release(h.held)
+		h.held = nil
+	}
+	h.mutex.Unlock()
+	h.wait.Wait()
+}
+
+// Stats returns the counts of the messages that have been published, and
+// those that have been interfered with.
+func (h *ChaosHub) Stats() ChaosStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stats
+}
+
+type completer chan struct{}
+
+// Complete implements pubsub.Completer.
+func (c completer) Complete() <-chan struct{} {
+	return c
+}
+
+func completed() pubsub.Completer {
+	done := make(completer)
+	close(done)
+	return done
+}
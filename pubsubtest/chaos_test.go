@@ -0,0 +1,183 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubtest_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/pubsubtest"
+)
+
+type ChaosSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ChaosSuite{})
+
+const topic pubsub.Topic = "testing"
+
+func (*ChaosSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := pubsubtest.NewChaosHub(nil, pubsubtest.ChaosConfig{})
+	c.Check(err, gc.ErrorMatches, "nil hub not valid")
+	_, err = pubsubtest.NewChaosHub(hub, pubsubtest.ChaosConfig{DropRate: 1.5})
+	c.Check(err, gc.ErrorMatches, "DropRate 1.5 not valid")
+	_, err = pubsubtest.NewChaosHub(hub, pubsubtest.ChaosConfig{DelayRate: 0.5})
+	c.Check(err, gc.ErrorMatches, "DelayRate without MaxDelay not valid")
+}
+
+// run publishes count messages through a chaos hub with the config, and
+// returns the messages received by a subscriber along with the stats.
+func run(c *gc.C, config pubsubtest.ChaosConfig, count int) ([]int, pubsubtest.ChaosStats) {
+	var (
+		mutex    sync.Mutex
+		received []int
+	)
+	hub, err := pubsubtest.NewChaosHub(pubsub.NewSimpleHub(), config)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data.(int))
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	var results []pubsub.Completer
+	for i := 0; i < count; i++ {
+		result, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	hub.Flush()
+	for _, result := range results {
+		select {
+		case <-result.Complete():
+		case <-time.After(time.Second):
+			c.Fatal("publish did not complete")
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return received, hub.Stats()
+}
+
+func (*ChaosSuite) TestNoChaos(c *gc.C) {
+	received, stats := run(c, pubsubtest.ChaosConfig{}, 5)
+	c.Assert(received, jc.DeepEquals, []int{0, 1, 2, 3, 4})
+	c.Assert(stats, jc.DeepEquals, pubsubtest.ChaosStats{Published: 5})
+}
+
+func (*ChaosSuite) TestDrop(c *gc.C) {
+	received, stats := run(c, pubsubtest.ChaosConfig{DropRate: 1}, 5)
+	c.Assert(received, gc.HasLen, 0)
+	c.Assert(stats.Dropped, gc.Equals, 5)
+}
+
+func (*ChaosSuite) TestDuplicate(c *gc.C) {
+	received, stats := run(c, pubsubtest.ChaosConfig{DuplicateRate: 1}, 2)
+	c.Assert(received, jc.DeepEquals, []int{0, 0, 1, 1})
+	c.Assert(stats.Duplicated, gc.Equals, 2)
+}
+
+func (*ChaosSuite) TestReorder(c *gc.C) {
+	received, stats := run(c, pubsubtest.ChaosConfig{ReorderRate: 1}, 5)
+	// Only one message is held at a time, so every other message is
+	// swapped with the next.
+	c.Assert(received, jc.DeepEquals, []int{1, 0, 3, 2, 4})
+	c.Assert(stats.Reordered, gc.Equals, 3)
+}
+
+func (*ChaosSuite) TestDelay(c *gc.C) {
+	received, stats := run(c, pubsubtest.ChaosConfig{
+		DelayRate: 1,
+		MaxDelay:  10 * time.Millisecond,
+	}, 5)
+	c.Assert(received, jc.SameContents, []int{0, 1, 2, 3, 4})
+	c.Assert(stats.Delayed, gc.Equals, 5)
+}
+
+func (*ChaosSuite) TestDeterministic(c *gc.C) {
+	config := pubsubtest.ChaosConfig{
+		Seed:          42,
+		DropRate:      0.2,
+		DuplicateRate: 0.2,
+		ReorderRate:   0.2,
+	}
+	first, firstStats := run(c, config, 50)
+	second, secondStats := run(c, config, 50)
+	c.Assert(first, jc.DeepEquals, second)
+	c.Assert(firstStats, jc.DeepEquals, secondStats)
+	c.Assert(firstStats.Dropped > 0, jc.IsTrue)
+	c.Assert(firstStats.Duplicated > 0, jc.IsTrue)
+	c.Assert(firstStats.Reordered > 0, jc.IsTrue)
+}
+
+// subscribe returns a chaos hub with the config wrapping a simple hub, and
+// a subscription to it that records the data of the messages.
+func subscribe(c *gc.C, config pubsubtest.ChaosConfig) (*pubsubtest.ChaosHub, pubsub.Subscription, func() []int) {
+	var (
+		mutex    sync.Mutex
+		received []int
+	)
+	hub, err := pubsubtest.NewChaosHub(pubsub.NewSimpleHub(), config)
+	c.Assert(err, jc.ErrorIsNil)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data.(int))
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return hub, sub, func() []int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]int(nil), received...)
+	}
+}
+
+func waitComplete(c *gc.C, result pubsub.Completer) {
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+}
+
+func (*ChaosSuite) TestPublishAndWaitLocal(c *gc.C) {
+	hub, sub, received := subscribe(c, pubsubtest.ChaosConfig{DuplicateRate: 1})
+	result, err := hub.PublishAndWaitLocal(topic, 1, sub)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	c.Assert(received(), jc.DeepEquals, []int{1, 1})
+	c.Assert(hub.Stats(), jc.DeepEquals, pubsubtest.ChaosStats{Published: 1, Duplicated: 1})
+}
+
+func (*ChaosSuite) TestRequeue(c *gc.C) {
+	hub, _, received := subscribe(c, pubsubtest.ChaosConfig{ReorderRate: 1})
+	result, err := hub.Requeue([]pubsub.Message{
+		{Topic: topic, Data: 1},
+		{Topic: topic, Data: 2},
+		{Topic: topic, Data: 3},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	hub.Flush()
+	waitComplete(c, result)
+	c.Assert(received(), jc.DeepEquals, []int{2, 1, 3})
+	c.Assert(hub.Stats(), jc.DeepEquals, pubsubtest.ChaosStats{Published: 3, Reordered: 2})
+}
+
+func (*ChaosSuite) TestBarrier(c *gc.C) {
+	hub, _, received := subscribe(c, pubsubtest.ChaosConfig{})
+	_, err := hub.Publish(topic, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	c.Assert(received(), jc.DeepEquals, []int{1})
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/pubsub"
+)
+
+// RecordedMessage is a message in a recording. Recordings are written as
+// one JSON object per line, so they can be read and edited with standard
+// tools.
+type RecordedMessage struct {
+	Sequence    uint64          `json:"sequence"`
+	Time        time.Time       `json:"time"`
+	Topic       pubsub.Topic    `json:"topic"`
+	OrderingKey string          `json:"ordering-key,omitempty"`
+	Headers     pubsub.Headers  `json:"headers,omitempty"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// RecorderConfig is the argument struct for NewRecorder.
+type RecorderConfig struct {
+	// Hub is the hub whose messages are recorded.
+	Hub pubsub.Hub
+
+	// Writer is where the recording is written.
+	Writer io.Writer
+
+	// Matcher determines which messages are recorded. If it is not set,
+	// all messages are recorded.
+	Matcher pubsub.TopicMatcher
+
+	// Redactor, if set, masks the secret values of the messages before
+	// they are written.
+	Redactor *pubsub.Redactor
+}
+
+// Validate checks that the config values are valid.
+func (config RecorderConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if config.Writer == nil {
+		return errors.NotValidf("missing Writer")
+	}
+	return nil
+}
+
+// Recorder writes the messages published on a hub, with their sequence and
+// the time they reached the recorder, so the session can be replayed later
+// with Replay. The data is written using JSON, so for simple hubs it must be
+// serializable.
+type Recorder struct {
+	config RecorderConfig
+	closer func()
+	done   chan struct{}
+
+	mutex sync.Mutex
+	count int
+	err   error
+}
+
+// NewRecorder starts recording the messages published on the hub.
+func NewRecorder(config RecorderConfig) (*Recorder, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	matcher := config.Matcher
+	if matcher == nil {
+		matcher = pubsub.MatchAll
+	}
+	messages, closer, err := pubsub.SubscribeChan(config.Hub, matcher, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	r := &Recorder{
+		config: config,
+		closer: closer,
+		done:   make(chan struct{}),
+	}
+	go r.loop(messages)
+	return r, nil
+}
+
+func (r *Recorder) loop(messages <-chan pubsub.Message) {
+	defer close(r.done)
+	encoder := json.NewEncoder(r.config.Writer)
+	for message := range messages {
+		err := r.write(encoder, message)
+		r.mutex.Lock()
+		if err == nil {
+			r.count++
+		} else if r.err == nil {
+			r.err = errors.Annotatef(err, "recording message %d", message.Delivery.Sequence)
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func (r *Recorder) write(encoder *json.Encoder, message pubsub.Message) error {
+	data, err := r.config.Redactor.Redact(message.Topic, message.Data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(encoder.Encode(RecordedMessage{
+		Sequence:    message.Delivery.Sequence,
+		Time:        time.Now(),
+		Topic:       message.Topic,
+		OrderingKey: message.Delivery.OrderingKey,
+		Headers:     message.Delivery.Headers,
+		Data:        bytes,
+	}))
+}
+
+// Count returns the number of messages recorded so far.
+func (r *Recorder) Count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.count
+}
+
+// Close stops the recording, and returns the first error writing the
+// messages. Messages that can't be written are skipped, so the rest of the
+// session is still recorded. Messages are only sure to be recorded once
+// their publish has completed.
+func (r *Recorder) Close() error {
+	r.closer()
+	<-r.done
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+// ReadRecording reads all the messages of a recording.
+func ReadRecording(reader io.Reader) ([]RecordedMessage, error) {
+	var result []RecordedMessage
+	err := readRecording(reader, func(message RecordedMessage) error {
+		result = append(result, message)
+		return nil
+	})
+	return result, errors.Trace(err)
+}
+
+func readRecording(reader io.Reader, handle func(RecordedMessage) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var message RecordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return errors.Annotatef(err, "line %d", line)
+		}
+		if err := handle(message); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(scanner.Err())
+}
+
+// ReplayConfig is the argument struct for Replay.
+type ReplayConfig struct {
+	// Hub is the hub the recorded messages are published on. It is
+	// typically a fresh hub with the subscribers under test.
+	Hub pubsub.Hub
+
+	// Reader is where the recording is read from.
+	Reader io.Reader
+
+	// Speed is how much faster than the original session the messages
+	// are published, so 1 keeps the original gaps between the messages
+	// and 10 makes them ten times shorter. If it is zero, the messages
+	// are published as fast as they are handled.
+	Speed float64
+
+	// BeforePublish, if set, is called before each message is published.
+	// Returning an error stops the replay.
+	BeforePublish func(message RecordedMessage) error
+
+	// AfterHandled, if set, is called once each message has been handled
+	// by all the subscribers, so the side effects of the subscribers can
+	// be compared with those of the original session. Returning an error
+	// stops the replay.
+	AfterHandled func(message RecordedMessage) error
+}
+
+// Validate checks that the config values are valid.
+func (config ReplayConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if config.Reader == nil {
+		return errors.NotValidf("missing Reader")
+	}
+	if config.Speed < 0 {
+		return errors.NotValidf("negative Speed")
+	}
+	return nil
+}
+
+// Replay publishes the recorded messages on the hub, in the order they were
+// recorded, with their original ordering keys and headers. Each message is
+// only published once the one before it has been handled by all the
+// subscribers, so the subscribers see the messages in the same order every
+// time the recording is replayed. The data of the messages is published in
+// its JSON decoded form. Replay returns the number of messages published.
+func Replay(ctx context.Context, config ReplayConfig) (int, error) {
+	if err := config.Validate(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	var (
+		count    int
+		previous time.Time
+	)
+	err := readRecording(config.Reader, func(message RecordedMessage) error {
+		if config.Speed > 0 && !previous.IsZero() {
+			gap := time.Duration(float64(message.Time.Sub(previous)) / config.Speed)
+			if err := sleep(ctx, gap); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		previous = message.Time
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		if config.BeforePublish != nil {
+			if err := config.BeforePublish(message); err != nil {
+				return errors.Annotatef(err, "before message %d", message.Sequence)
+			}
+		}
+		var data interface{}
+		if err := json.Unmarshal(message.Data, &data); err != nil {
+			return errors.Annotatef(err, "message %d", message.Sequence)
+		}
+		publishCtx := pubsub.WithOrderingKey(ctx, message.OrderingKey)
+		if message.Headers != nil {
+			publishCtx = pubsub.WithHeaders(publishCtx, message.Headers)
+		}
+		done, err := pubsub.PublishCtx(publishCtx, config.Hub, message.Topic, data)
+		if err != nil {
+			return errors.Annotatef(err, "publishing message %d", message.Sequence)
+		}
+		select {
+		case <-done.Complete():
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+		count++
+		if config.AfterHandled != nil {
+			if err := config.AfterHandled(message); err != nil {
+				return errors.Annotatef(err, "after message %d", message.Sequence)
+			}
+		}
+		return nil
+	})
+	return count, errors.Trace(err)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsubtest_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+	"github.com/juju/pubsub/pubsubtest"
+)
+
+type RecorderSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&RecorderSuite{})
+
+func (*RecorderSuite) TestValidate(c *gc.C) {
+	_, err := pubsubtest.NewRecorder(pubsubtest.RecorderConfig{Writer: &bytes.Buffer{}})
+	c.Check(err, gc.ErrorMatches, "missing Hub not valid")
+	_, err = pubsubtest.NewRecorder(pubsubtest.RecorderConfig{Hub: pubsub.NewSimpleHub()})
+	c.Check(err, gc.ErrorMatches, "missing Writer not valid")
+
+	_, err = pubsubtest.Replay(context.Background(), pubsubtest.ReplayConfig{Reader: &bytes.Buffer{}})
+	c.Check(err, gc.ErrorMatches, "missing Hub not valid")
+	_, err = pubsubtest.Replay(context.Background(), pubsubtest.ReplayConfig{Hub: pubsub.NewSimpleHub()})
+	c.Check(err, gc.ErrorMatches, "missing Reader not valid")
+	_, err = pubsubtest.Replay(context.Background(), pubsubtest.ReplayConfig{
+		Hub:    pubsub.NewSimpleHub(),
+		Reader: &bytes.Buffer{},
+		Speed:  -1,
+	})
+	c.Check(err, gc.ErrorMatches, "negative Speed not valid")
+}
+
+// record publishes the messages on a structured hub while recording it,
+// and returns the recording.
+func record(c *gc.C, messages ...map[string]interface{}) *bytes.Buffer {
+	hub := pubsub.NewStructuredHub(nil)
+	var buf bytes.Buffer
+	recorder, err := pubsubtest.NewRecorder(pubsubtest.RecorderConfig{Hub: hub, Writer: &buf})
+	c.Assert(err, jc.ErrorIsNil)
+	for i, data := range messages {
+		ctx := pubsub.WithOrderingKey(context.Background(), "key")
+		if i == 0 {
+			ctx = pubsub.WithHeaders(ctx, pubsub.Headers{"trace": "abc"})
+		}
+		done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		<-done.Complete()
+	}
+	c.Assert(recorder.Close(), jc.ErrorIsNil)
+	c.Check(recorder.Count(), gc.Equals, len(messages))
+	return &buf
+}
+
+func (*RecorderSuite) TestRecord(c *gc.C) {
+	buf := record(c,
+		map[string]interface{}{"value": 1},
+		map[string]interface{}{"value": 2},
+	)
+	c.Check(strings.Count(buf.String(), "\n"), gc.Equals, 2)
+	messages, err := pubsubtest.ReadRecording(buf)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(messages, gc.HasLen, 2)
+	c.Check(messages[0].Sequence, gc.Equals, uint64(1))
+	c.Check(messages[0].Topic, gc.Equals, topic)
+	c.Check(messages[0].OrderingKey, gc.Equals, "key")
+	c.Check(messages[0].Headers, jc.DeepEquals, pubsub.Headers{"trace": "abc"})
+	c.Check(string(messages[0].Data), gc.Equals, `{"value":1}`)
+	c.Check(messages[1].Sequence, gc.Equals, uint64(2))
+	c.Check(messages[1].Headers, gc.IsNil)
+	c.Check(messages[1].Time.Before(messages[0].Time), jc.IsFalse)
+}
+
+func (*RecorderSuite) TestRecordError(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var buf bytes.Buffer
+	recorder, err := pubsubtest.NewRecorder(pubsubtest.RecorderConfig{Hub: hub, Writer: &buf})
+	c.Assert(err, jc.ErrorIsNil)
+	for _, data := range []interface{}{make(chan int), "fine"} {
+		done, err := hub.Publish(topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		<-done.Complete()
+	}
+	err = recorder.Close()
+	c.Check(err, gc.ErrorMatches, "recording message 1: json: unsupported type: chan int")
+	c.Check(recorder.Count(), gc.Equals, 1)
+}
+
+func (*RecorderSuite) TestReplay(c *gc.C) {
+	buf := record(c,
+		map[string]interface{}{"value": 1},
+		map[string]interface{}{"value": 2},
+		map[string]interface{}{"value": 3},
+	)
+
+	hub := pubsub.NewStructuredHub(nil)
+	var handled []int
+	var keys []string
+	_, err := hub.Subscribe(topic, func(ctx context.Context, _ pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		delivery, _ := pubsub.DeliveryFromContext(ctx)
+		keys = append(keys, delivery.OrderingKey)
+		handled = append(handled, int(data["value"].(float64)))
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	var before, after []uint64
+	count, err := pubsubtest.Replay(context.Background(), pubsubtest.ReplayConfig{
+		Hub:    hub,
+		Reader: buf,
+		Speed:  1000,
+		BeforePublish: func(message pubsubtest.RecordedMessage) error {
+			before = append(before, message.Sequence)
+			return nil
+		},
+		AfterHandled: func(message pubsubtest.RecordedMessage) error {
+			after = append(after, message.Sequence)
+			// Each message has been handled before the hook is called.
+			c.Check(handled, gc.HasLen, len(after))
+			return nil
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(count, gc.Equals, 3)
+	c.Check(handled, jc.DeepEquals, []int{1, 2, 3})
+	c.Check(keys, jc.DeepEquals, []string{"key", "key", "key"})
+	c.Check(before, jc.DeepEquals, []uint64{1, 2, 3})
+	c.Check(after, jc.DeepEquals, []uint64{1, 2, 3})
+}
+
+func (*RecorderSuite) TestReplayHookStops(c *gc.C) {
+	buf := record(c,
+		map[string]interface{}{"value": 1},
+		map[string]interface{}{"value": 2},
+	)
+	count, err := pubsubtest.Replay(context.Background(), pubsubtest.ReplayConfig{
+		Hub:    pubsub.NewSimpleHub(),
+		Reader: buf,
+		AfterHandled: func(message pubsubtest.RecordedMessage) error {
+			return errors.New("side effects differ")
+		},
+	})
+	c.Check(err, gc.ErrorMatches, "after message 1: side effects differ")
+	c.Check(count, gc.Equals, 1)
+}
+
+func (*RecorderSuite) TestReplaySpeed(c *gc.C) {
+	start := time.Now()
+	recording := `{"sequence":1,"time":"2016-01-01T00:00:00Z","topic":"testing","data":1}
+{"sequence":2,"time":"2016-01-01T00:00:01Z","topic":"testing","data":2}
+`
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	count, err := pubsubtest.Replay(ctx, pubsubtest.ReplayConfig{
+		Hub:    pubsub.NewSimpleHub(),
+		Reader: strings.NewReader(recording),
+		Speed:  1,
+	})
+	// The second message is due a second after the first.
+	c.Check(err, gc.ErrorMatches, "context deadline exceeded")
+	c.Check(count, gc.Equals, 1)
+
+	count, err = pubsubtest.Replay(context.Background(), pubsubtest.ReplayConfig{
+		Hub:    pubsub.NewSimpleHub(),
+		Reader: strings.NewReader(recording),
+		Speed:  100,
+	})
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(count, gc.Equals, 2)
+	c.Check(time.Since(start) >= 50*time.Millisecond+10*time.Millisecond, jc.IsTrue)
+}
+
+func (*RecorderSuite) TestReadRecordingError(c *gc.C) {
+	_, err := pubsubtest.ReadRecording(strings.NewReader("{}\nnot json\n"))
+	c.Check(err, gc.ErrorMatches, "line 2: invalid character .*")
+}
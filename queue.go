@@ -0,0 +1,223 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/juju/utils/deque"
+)
+
+// Queue holds the messages waiting to be handled by a subscriber. Each
+// subscription has its own queue, which is only used while the subscriber
+// holds its lock, so implementations don't need to be safe for concurrent
+// use.
+//
+// The queue also holds the markers queued by Barrier, and those queued to
+// call the OnRebalance callbacks of queue groups. Queues that reorder
+// messages should keep the markers behind the messages queued before them,
+// and queues that evict messages may evict the markers, which completes the
+// barrier early.
+type Queue interface {
+	// Push adds the message to the queue. If the queue has no room for
+	// the message it evicts one, which may be the message pushed, and
+	// returns it and true. Evicted messages are dropped.
+	Push(message QueuedMessage) (QueuedMessage, bool)
+
+	// Pop removes and returns the next message to be handled, or returns
+	// false if the queue is empty.
+	Pop() (QueuedMessage, bool)
+
+	// Len returns the number of messages in the queue.
+	Len() int
+}
+
+// QueuedMessage is a message in the Queue of a subscriber.
+type QueuedMessage struct {
+	call *handlerCallback
+}
+
+// Message returns the message. Barrier markers have an empty topic and
+// no data.
+func (m QueuedMessage) Message() Message {
+	return Message{
+		Topic: m.call.topic,
+		Data:  m.call.data,
+		Delivery: Delivery{
+			Sequence:    m.call.sequence,
+			OrderingKey: m.call.key,
+			Headers:     m.call.headers,
+			Retry:       m.call.retry,
+			Coalesced:   len(m.call.merged),
+		},
+	}
+}
+
+// Barrier returns true if the message is a marker queued by Barrier, or
+// for a queue group rebalance, rather than a published message.
+func (m QueuedMessage) Barrier() bool {
+	return m.call.barrier
+}
+
+// WithQueue has the subscription hold its waiting messages in the queue
+// rather than in the default unbounded first in, first out queue. The
+// queue must not be shared with any other subscription. Durable
+// subscriptions, which spill their queue to a store, can't be given a
+// queue.
+func WithQueue(queue Queue) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queue = queue
+	}
+}
+
+// fifoQueue is the default queue, which never evicts.
+type fifoQueue struct {
+	calls *deque.Deque
+}
+
+func newFIFOQueue() *fifoQueue {
+	return &fifoQueue{calls: deque.New()}
+}
+
+// Push implements Queue.
+func (q *fifoQueue) Push(message QueuedMessage) (QueuedMessage, bool) {
+	q.calls.PushBack(message.call)
+	return QueuedMessage{}, false
+}
+
+// Pop implements Queue.
+func (q *fifoQueue) Pop() (QueuedMessage, bool) {
+	call, ok := q.calls.PopFront()
+	if !ok {
+		return QueuedMessage{}, false
+	}
+	return QueuedMessage{call: call.(*handlerCallback)}, true
+}
+
+// Len implements Queue.
+func (q *fifoQueue) Len() int {
+	return q.calls.Len()
+}
+
+// NewRingQueue returns a queue that holds up to size messages. Once it is
+// full, each message pushed evicts the oldest message, so a slow
+// subscriber always handles the most recent messages. A size of less than
+// one is treated as one.
+func NewRingQueue(size int) Queue {
+	if size < 1 {
+		size = 1
+	}
+	return &ringQueue{messages: make([]QueuedMessage, size)}
+}
+
+type ringQueue struct {
+	messages []QueuedMessage
+	head     int
+	count    int
+}
+
+// Push implements Queue.
+func (q *ringQueue) Push(message QueuedMessage) (QueuedMessage, bool) {
+	if q.count < len(q.messages) {
+		q.messages[(q.head+q.count)%len(q.messages)] = message
+		q.count++
+		return QueuedMessage{}, false
+	}
+	evicted := q.messages[q.head]
+	q.messages[q.head] = message
+	q.head = (q.head + 1) % len(q.messages)
+	return evicted, true
+}
+
+// Pop implements Queue.
+func (q *ringQueue) Pop() (QueuedMessage, bool) {
+	if q.count == 0 {
+		return QueuedMessage{}, false
+	}
+	message := q.messages[q.head]
+	q.messages[q.head] = QueuedMessage{}
+	q.head = (q.head + 1) % len(q.messages)
+	q.count--
+	return message, true
+}
+
+// Len implements Queue.
+func (q *ringQueue) Len() int {
+	return q.count
+}
+
+// NewPriorityQueue returns an unbounded queue that hands out the messages
+// with the highest priority first, and messages with the same priority in
+// the order they were pushed. The priority function is called once for
+// each message as it is pushed. Barrier markers are given the lowest
+// possible priority, so they are handed out after all the messages queued
+// before them.
+func NewPriorityQueue(priority func(Message) int) Queue {
+	return &priorityQueue{priority: priority}
+}
+
+type priorityQueue struct {
+	priority func(Message) int
+	items    priorityItems
+	pushed   uint64
+}
+
+type priorityItem struct {
+	message  QueuedMessage
+	priority int
+	order    uint64
+}
+
+// priorityItems implements heap.Interface.
+type priorityItems []priorityItem
+
+func (p priorityItems) Len() int { return len(p) }
+
+func (p priorityItems) Less(i, j int) bool {
+	if p[i].priority != p[j].priority {
+		return p[i].priority > p[j].priority
+	}
+	return p[i].order < p[j].order
+}
+
+func (p priorityItems) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p *priorityItems) Push(x interface{}) { *p = append(*p, x.(priorityItem)) }
+
+func (p *priorityItems) Pop() interface{} {
+	old := *p
+	item := old[len(old)-1]
+	old[len(old)-1] = priorityItem{}
+	*p = old[:len(old)-1]
+	return item
+}
+
+// Push implements Queue.
+func (q *priorityQueue) Push(message QueuedMessage) (QueuedMessage, bool) {
+	priority := math.MinInt
+	if !message.Barrier() {
+		priority = q.priority(message.Message())
+	}
+	q.pushed++
+	heap.Push(&q.items, priorityItem{
+		message:  message,
+		priority: priority,
+		order:    q.pushed,
+	})
+	return QueuedMessage{}, false
+}
+
+// Pop implements Queue.
+func (q *priorityQueue) Pop() (QueuedMessage, bool) {
+	if len(q.items) == 0 {
+		return QueuedMessage{}, false
+	}
+	return heap.Pop(&q.items).(priorityItem).message, true
+}
+
+// Len implements Queue.
+func (q *priorityQueue) Len() int {
+	return len(q.items)
+}
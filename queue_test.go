@@ -0,0 +1,123 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type QueueSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&QueueSuite{})
+
+func (*QueueSuite) TestDurableWithQueue(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {},
+		pubsub.Named("test"),
+		pubsub.WithQueue(pubsub.NewRingQueue(1)),
+		pubsub.Durable(pubsub.DurableConfig{Store: pubsub.NewMemoryStore(), SpillAfter: 1}))
+	c.Check(err, gc.ErrorMatches, "durable subscription with a queue not valid")
+}
+
+func (*QueueSuite) TestRingQueueEvictsOldest(c *gc.C) {
+	metrics := &metricsRecorder{}
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Metrics: metrics})
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle, pubsub.WithQueue(pubsub.NewRingQueue(2)))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	var dones []pubsub.Completer
+	for i := 0; i < 5; i++ {
+		done, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		dones = append(dones, done)
+		if i == 0 {
+			waitStarted(c, handler)
+		}
+	}
+	// The evicted messages are done without being handled.
+	waitComplete(c, dones[1])
+	waitComplete(c, dones[2])
+	c.Check(sub.Pending(), gc.Equals, 2)
+
+	close(handler.release)
+	for _, done := range dones {
+		waitComplete(c, done)
+	}
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{0, 3, 4})
+	var dropped int
+	for _, event := range metrics.get() {
+		if event.event == "dropped" {
+			dropped++
+		}
+	}
+	c.Check(dropped, gc.Equals, 2)
+}
+
+func headerPriority(message pubsub.Message) int {
+	priority, _ := strconv.Atoi(message.Delivery.Headers["priority"])
+	return priority
+}
+
+func (*QueueSuite) TestPriorityQueue(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle, pubsub.WithQueue(pubsub.NewPriorityQueue(headerPriority)))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publish := func(data string, priority string) pubsub.Completer {
+		ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{"priority": priority})
+		done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		return done
+	}
+	publish("first", "0")
+	waitStarted(c, handler)
+	publish("low", "0")
+	publish("high", "10")
+	barrier, err := hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	publish("later-low", "-1")
+	done := publish("medium", "5")
+
+	close(handler.release)
+	waitComplete(c, done)
+	waitComplete(c, barrier)
+	// The barrier is only complete once the messages queued before it are
+	// handled, so it is behind all of them.
+	c.Check(handler.get(), jc.DeepEquals, []interface{}{"first", "high", "medium", "low", "later-low"})
+}
+
+func (*QueueSuite) TestDrain(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle, pubsub.WithQueue(pubsub.NewRingQueue(2)))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	defer close(handler.release)
+
+	for i := 0; i < 4; i++ {
+		_, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		if i == 0 {
+			waitStarted(c, handler)
+		}
+	}
+	var data []interface{}
+	for _, message := range sub.Drain() {
+		data = append(data, message.Data)
+	}
+	c.Check(data, jc.DeepEquals, []interface{}{2, 3})
+}
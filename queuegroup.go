@@ -0,0 +1,231 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// QueueGroupConfig defines a queue group. See the QueueGroup subscribe
+// option.
+type QueueGroupConfig struct {
+	// Group is the name of the queue group. All the subscriptions with
+	// the same group name on a hub form the group.
+	Group string
+
+	// Sticky keeps each ordering key with the member it is assigned to
+	// for as long as the member stays in the group, so only the keys of
+	// members that leave are moved when the group is rebalanced. Without
+	// it, the keys are spread evenly over the members again each time
+	// the membership changes. All the members of a group must agree.
+	Sticky bool
+
+	// OnRebalance, if set, is called each time a subscription joins or
+	// leaves the group, with the changes to the keys assigned to this
+	// member. See Rebalance.
+	OnRebalance func(Rebalance)
+}
+
+// Rebalance describes a change to the membership of a queue group, as seen
+// by one of its members.
+type Rebalance struct {
+	// Group is the name of the queue group.
+	Group string
+
+	// Members is the number of members of the group after the change.
+	Members int
+
+	// Assigned are the ordering keys moved to this member from another,
+	// and Revoked are the keys moved from this member to another. Keys
+	// that haven't been published with yet are not included.
+	Assigned []string
+	Revoked  []string
+}
+
+// QueueGroup is a subscribe option that makes the subscription part of a
+// queue group. Each message is given to only one of the members of the
+// group, so the members share the work. Messages published with an ordering
+// key are always given to the member the key is assigned to, so the
+// messages of each key are handled in order by one member. Messages
+// without a key are given to each member in turn.
+//
+// When a member joins or leaves, the keys are reassigned and the OnRebalance
+// callback of each member is called. The callback is queued behind the
+// messages already waiting for the member, so by the time a member is told
+// a key has been revoked it has handled all the messages it was given for
+// the key, and can safely flush any state it holds for it.
+//
+// The subscriptions in a group should all use the same topic matcher, as
+// the member is chosen once a message matches any of them. Retained
+// messages are only delivered to the first member of a group. Queue
+// groups can't be combined with failover groups or durable subscriptions.
+func QueueGroup(config QueueGroupConfig) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queueGroup = &config
+	}
+}
+
+// queueGroup holds the members of a queue group, and is protected by the
+// hub mutex.
+type queueGroup struct {
+	sticky  bool
+	members []*subscriber
+
+	// next is used to give the messages without an ordering key to each
+	// member in turn.
+	next int
+
+	// keys are the members that the ordering keys published so far are
+	// assigned to.
+	keys map[string]*subscriber
+}
+
+// checkQueueGroup validates the queue group of a new subscription. The hub
+// mutex must be held.
+func (h *simplehub) checkQueueGroup(opts subscribeOptions) error {
+	config := opts.queueGroup
+	if config == nil {
+		return nil
+	}
+	if config.Group == "" {
+		return errors.NotValidf("queue group without a group")
+	}
+	if opts.failover != nil {
+		return errors.NotValidf("failover subscription in a queue group")
+	}
+	if opts.durable != nil {
+		return errors.NotValidf("durable subscription in a queue group")
+	}
+	if group, ok := h.queueGroups[config.Group]; ok && group.sticky != config.Sticky {
+		return errors.NotValidf("queue group %q with different Sticky", config.Group)
+	}
+	return nil
+}
+
+// joinQueueGroup adds the subscriber to its queue group, if it has one.
+// The hub mutex must be held.
+func (h *simplehub) joinQueueGroup(sub *subscriber) {
+	if sub.queueGroup == nil {
+		return
+	}
+	if h.queueGroups == nil {
+		h.queueGroups = make(map[string]*queueGroup)
+	}
+	name := sub.queueGroup.Group
+	group, ok := h.queueGroups[name]
+	if !ok {
+		group = &queueGroup{
+			sticky: sub.queueGroup.Sticky,
+			keys:   make(map[string]*subscriber),
+		}
+		h.queueGroups[name] = group
+	}
+	group.members = append(group.members, sub)
+	group.rebalance(name)
+}
+
+// removeQueueGroup removes the subscriber from its queue group. The hub
+// mutex must be held.
+func (h *simplehub) removeQueueGroup(sub *subscriber) {
+	if sub.queueGroup == nil {
+		return
+	}
+	name := sub.queueGroup.Group
+	group := h.queueGroups[name]
+	for i, member := range group.members {
+		if member == sub {
+			group.members = append(group.members[:i:i], group.members[i+1:]...)
+			break
+		}
+	}
+	if len(group.members) == 0 {
+		delete(h.queueGroups, name)
+		return
+	}
+	group.rebalance(name)
+}
+
+// queueTarget returns the subscriber that is given a message that matched
+// the subscriber, which is another member if the subscriber is in a queue
+// group. It returns false if a member of the group has already been given
+// the message. Served records the groups given the message, and is
+// created as needed. The hub mutex must be held.
+func (h *simplehub) queueTarget(sub *subscriber, key string, served *map[*queueGroup]bool) (*subscriber, bool) {
+	if sub.queueGroup == nil {
+		return sub, true
+	}
+	group := h.queueGroups[sub.queueGroup.Group]
+	if (*served)[group] {
+		return nil, false
+	}
+	if *served == nil {
+		*served = make(map[*queueGroup]bool)
+	}
+	(*served)[group] = true
+	return group.pick(key), true
+}
+
+// pick returns the member to give a message with the ordering key.
+func (g *queueGroup) pick(key string) *subscriber {
+	if key == "" {
+		member := g.members[g.next%len(g.members)]
+		g.next++
+		return member
+	}
+	owner, ok := g.keys[key]
+	if !ok {
+		owner = g.hashed(key)
+		g.keys[key] = owner
+	}
+	return owner
+}
+
+// hashed returns the member that the key is spread to.
+func (g *queueGroup) hashed(key string) *subscriber {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return g.members[int(hash.Sum32()%uint32(len(g.members)))]
+}
+
+// rebalance reassigns the keys after the membership has changed, and
+// queues the rebalance callbacks for the members.
+func (g *queueGroup) rebalance(name string) {
+	current := make(map[*subscriber]bool, len(g.members))
+	for _, member := range g.members {
+		current[member] = true
+	}
+	assigned := make(map[*subscriber][]string)
+	revoked := make(map[*subscriber][]string)
+	for key, owner := range g.keys {
+		if g.sticky && current[owner] {
+			continue
+		}
+		moved := g.hashed(key)
+		if moved == owner {
+			continue
+		}
+		g.keys[key] = moved
+		assigned[moved] = append(assigned[moved], key)
+		revoked[owner] = append(revoked[owner], key)
+	}
+	for _, member := range g.members {
+		if member.queueGroup.OnRebalance == nil {
+			continue
+		}
+		sort.Strings(assigned[member])
+		sort.Strings(revoked[member])
+		member.notify(&handlerCallback{
+			barrier: true,
+			rebalance: &Rebalance{
+				Group:    name,
+				Members:  len(g.members),
+				Assigned: assigned[member],
+				Revoked:  revoked[member],
+			},
+		})
+	}
+}
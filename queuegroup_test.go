@@ -0,0 +1,336 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type QueueGroupSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&QueueGroupSuite{})
+
+// groupMember records the messages and rebalances seen by a member of a
+// queue group, in the order it saw them.
+type groupMember struct {
+	mutex      sync.Mutex
+	messages   []string
+	keys       map[string][]string
+	rebalances []pubsub.Rebalance
+	events     []string
+}
+
+func newGroupMember() *groupMember {
+	return &groupMember{keys: make(map[string][]string)}
+}
+
+func (m *groupMember) handle(ctx context.Context, topic pubsub.Topic, data interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	message := data.(string)
+	m.messages = append(m.messages, message)
+	delivery, _ := pubsub.DeliveryFromContext(ctx)
+	if key := delivery.OrderingKey; key != "" {
+		m.keys[key] = append(m.keys[key], message)
+	}
+	m.events = append(m.events, message)
+}
+
+func (m *groupMember) rebalanced(rebalance pubsub.Rebalance) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rebalances = append(m.rebalances, rebalance)
+	for _, key := range rebalance.Revoked {
+		m.events = append(m.events, "revoked "+key)
+	}
+}
+
+func (m *groupMember) subscribe(c *gc.C, hub pubsub.Hub, sticky bool, options ...pubsub.SubscribeOption) pubsub.Unsubscriber {
+	sub, err := hub.Subscribe(topic, m.handle, append(options, pubsub.QueueGroup(pubsub.QueueGroupConfig{
+		Group:       "workers",
+		Sticky:      sticky,
+		OnRebalance: m.rebalanced,
+	}))...)
+	c.Assert(err, jc.ErrorIsNil)
+	return sub
+}
+
+func (m *groupMember) ownedKeys() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var keys []string
+	for key := range m.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *groupMember) lastRebalance() pubsub.Rebalance {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.rebalances) == 0 {
+		return pubsub.Rebalance{}
+	}
+	return m.rebalances[len(m.rebalances)-1]
+}
+
+func (m *groupMember) reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = nil
+	m.keys = make(map[string][]string)
+	m.events = nil
+}
+
+// publishKeys publishes a message for each of the keys, and waits for
+// them to be handled.
+func publishKeys(c *gc.C, hub pubsub.Hub, keys int, label string) {
+	// The keys are handled by different members, so each publish is
+	// waited for.
+	var results []pubsub.Completer
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		ctx := pubsub.WithOrderingKey(context.Background(), key)
+		done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, fmt.Sprintf("%s %s", label, key))
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, done)
+	}
+	for _, done := range results {
+		waitComplete(c, done)
+	}
+}
+
+// waitRebalanced waits for the rebalance callbacks already queued.
+func waitRebalanced(c *gc.C, hub pubsub.Hub) {
+	done, err := hub.(pubsub.Barrierer).Barrier(topic)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+}
+
+func (*QueueGroupSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	noop := func(pubsub.Topic, interface{}) {}
+	_, err := hub.Subscribe(topic, noop, pubsub.QueueGroup(pubsub.QueueGroupConfig{}))
+	c.Check(err, gc.ErrorMatches, "queue group without a group not valid")
+	group := pubsub.QueueGroup(pubsub.QueueGroupConfig{Group: "workers"})
+	_, err = hub.Subscribe(topic, noop, group, pubsub.Failover(pubsub.FailoverConfig{Group: "workers"}))
+	c.Check(err, gc.ErrorMatches, "failover subscription in a queue group not valid")
+	_, err = hub.Subscribe(topic, noop, group, pubsub.Named("durable"), pubsub.Durable(pubsub.DurableConfig{
+		Store: pubsub.NewMemoryStore(),
+	}))
+	c.Check(err, gc.ErrorMatches, "durable subscription in a queue group not valid")
+
+	sub, err := hub.Subscribe(topic, noop, group)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	_, err = hub.Subscribe(topic, noop, pubsub.QueueGroup(pubsub.QueueGroupConfig{Group: "workers", Sticky: true}))
+	c.Check(err, gc.ErrorMatches, `queue group "workers" with different Sticky not valid`)
+}
+
+func (*QueueGroupSuite) TestSharesMessages(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	members := []*groupMember{newGroupMember(), newGroupMember(), newGroupMember()}
+	for _, member := range members {
+		defer member.subscribe(c, hub, false).Unsubscribe()
+	}
+	var others topicRecorder
+	sub, err := hub.Subscribe(topic, others.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	var results []pubsub.Completer
+	for i := 0; i < 30; i++ {
+		done, err := hub.Publish(topic, fmt.Sprint(i))
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, done)
+	}
+	for _, done := range results {
+		waitComplete(c, done)
+	}
+	seen := make(map[string]bool)
+	for _, member := range members {
+		c.Check(member.messages, gc.HasLen, 10)
+		for _, message := range member.messages {
+			c.Check(seen[message], jc.IsFalse)
+			seen[message] = true
+		}
+	}
+	c.Check(seen, gc.HasLen, 30)
+	c.Check(others.get(), gc.HasLen, 30)
+}
+
+func (*QueueGroupSuite) TestKeysStayWithOneMember(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	members := []*groupMember{newGroupMember(), newGroupMember()}
+	for _, member := range members {
+		defer member.subscribe(c, hub, false).Unsubscribe()
+	}
+	for round := 0; round < 3; round++ {
+		publishKeys(c, hub, 10, fmt.Sprint(round))
+	}
+	owners := make(map[string]int)
+	for _, member := range members {
+		for key, messages := range member.keys {
+			owners[key]++
+			c.Check(messages, jc.DeepEquals, []string{"0 " + key, "1 " + key, "2 " + key})
+		}
+	}
+	c.Check(owners, gc.HasLen, 10)
+	for key, count := range owners {
+		c.Check(count, gc.Equals, 1, gc.Commentf("key %s", key))
+	}
+}
+
+func (*QueueGroupSuite) TestRebalance(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	first, second, third := newGroupMember(), newGroupMember(), newGroupMember()
+	defer first.subscribe(c, hub, false).Unsubscribe()
+	defer second.subscribe(c, hub, false).Unsubscribe()
+	publishKeys(c, hub, 20, "before")
+	members := []*groupMember{first, second, third}
+	expected := make(map[*groupMember]map[string]bool)
+	for _, member := range members {
+		expected[member] = make(map[string]bool)
+		for _, key := range member.ownedKeys() {
+			expected[member][key] = true
+		}
+	}
+
+	defer third.subscribe(c, hub, false).Unsubscribe()
+	waitRebalanced(c, hub)
+	c.Check(third.lastRebalance().Revoked, gc.HasLen, 0)
+	c.Check(third.lastRebalance().Assigned, gc.Not(gc.HasLen), 0)
+	var assigned, revoked []string
+	for _, member := range members {
+		rebalance := member.lastRebalance()
+		c.Check(rebalance.Group, gc.Equals, "workers")
+		c.Check(rebalance.Members, gc.Equals, 3)
+		for _, key := range rebalance.Revoked {
+			c.Check(expected[member][key], jc.IsTrue, gc.Commentf("revoked %s", key))
+			delete(expected[member], key)
+		}
+		for _, key := range rebalance.Assigned {
+			expected[member][key] = true
+		}
+		assigned = append(assigned, rebalance.Assigned...)
+		revoked = append(revoked, rebalance.Revoked...)
+	}
+	sort.Strings(assigned)
+	sort.Strings(revoked)
+	c.Check(revoked, jc.DeepEquals, assigned)
+
+	// The messages follow the keys.
+	for _, member := range members {
+		member.reset()
+	}
+	publishKeys(c, hub, 20, "after")
+	for _, member := range members {
+		var keys []string
+		for key := range expected[member] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		c.Check(member.ownedKeys(), jc.DeepEquals, keys)
+	}
+}
+
+func (*QueueGroupSuite) TestSticky(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	first, second, third := newGroupMember(), newGroupMember(), newGroupMember()
+	firstSub := first.subscribe(c, hub, true)
+	defer second.subscribe(c, hub, true).Unsubscribe()
+	publishKeys(c, hub, 20, "before")
+	firstKeys := first.ownedKeys()
+	secondKeys := second.ownedKeys()
+
+	// Keys aren't taken from the members that stay.
+	defer third.subscribe(c, hub, true).Unsubscribe()
+	waitRebalanced(c, hub)
+	for _, member := range []*groupMember{first, second, third} {
+		rebalance := member.lastRebalance()
+		c.Check(rebalance.Members, gc.Equals, 3)
+		c.Check(rebalance.Assigned, gc.HasLen, 0)
+		c.Check(rebalance.Revoked, gc.HasLen, 0)
+	}
+	second.reset()
+	publishKeys(c, hub, 20, "joined")
+	c.Check(second.ownedKeys(), jc.DeepEquals, secondKeys)
+	c.Check(third.ownedKeys(), gc.HasLen, 0)
+
+	// The keys of a member that leaves are shared by the others.
+	firstSub.Unsubscribe()
+	waitRebalanced(c, hub)
+	moved := append(second.lastRebalance().Assigned, third.lastRebalance().Assigned...)
+	sort.Strings(moved)
+	c.Check(moved, jc.DeepEquals, firstKeys)
+	c.Check(second.lastRebalance().Revoked, gc.HasLen, 0)
+	c.Check(second.lastRebalance().Members, gc.Equals, 2)
+}
+
+func (*QueueGroupSuite) TestRevokedAfterQueuedMessages(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	first, second := newGroupMember(), newGroupMember()
+	blocking := newBlockingHandler()
+	firstSub, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		blocking.handle(topic, data)
+		first.handle(ctx, topic, data)
+	}, pubsub.QueueGroup(pubsub.QueueGroupConfig{Group: "workers", OnRebalance: first.rebalanced}))
+	c.Assert(err, jc.ErrorIsNil)
+	defer firstSub.Unsubscribe()
+
+	// With one member, the first owns every key.
+	var done pubsub.Completer
+	for i := 0; i < 10; i++ {
+		ctx := pubsub.WithOrderingKey(context.Background(), fmt.Sprintf("key-%d", i))
+		done, err = hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, fmt.Sprintf("queued key-%d", i))
+		c.Assert(err, jc.ErrorIsNil)
+		if i == 0 {
+			waitStarted(c, blocking)
+		}
+	}
+	defer second.subscribe(c, hub, false).Unsubscribe()
+	close(blocking.release)
+	waitComplete(c, done)
+	waitRebalanced(c, hub)
+
+	first.mutex.Lock()
+	events := first.events
+	first.mutex.Unlock()
+	revoked := first.lastRebalance().Revoked
+	c.Assert(revoked, gc.Not(gc.HasLen), 0)
+	c.Assert(events, gc.HasLen, 10+len(revoked))
+	for i, event := range events[:10] {
+		c.Check(event, gc.Equals, fmt.Sprintf("queued key-%d", i))
+	}
+}
+
+func (*QueueGroupSuite) TestRetainedToFirstMember(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 1})
+	done, err := hub.Publish(topic, "retained")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+
+	first, second := newGroupMember(), newGroupMember()
+	defer first.subscribe(c, hub, false, pubsub.DeliverLastRetained()).Unsubscribe()
+	defer second.subscribe(c, hub, false, pubsub.DeliverLastRetained()).Unsubscribe()
+	waitRebalanced(c, hub)
+	first.mutex.Lock()
+	c.Check(first.messages, jc.DeepEquals, []string{"retained"})
+	first.mutex.Unlock()
+	second.mutex.Lock()
+	c.Check(second.messages, gc.HasLen, 0)
+	second.mutex.Unlock()
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// QuotaAlertTopic is the topic that a hub publishes a QuotaAlert message on
+// whenever one of its soft quotas is exceeded or recovers.
+const QuotaAlertTopic Topic = "pubsub.quota-alert"
+
+// Names of the quotas in a QuotaAlert.
+const (
+	QuotaQueued      = "queued"
+	QuotaQueuedBytes = "queued-bytes"
+	QuotaSubscribers = "subscribers"
+)
+
+// QuotaAlert is the message published when a soft quota is exceeded, and
+// again when it recovers.
+type QuotaAlert struct {
+	// Quota is the name of the quota, one of QuotaQueued,
+	// QuotaQueuedBytes, or QuotaSubscribers.
+	Quota string `json:"quota"`
+
+	// Exceeded is true when the value has gone over the limit, and false
+	// when it has come back down to the limit or below.
+	Exceeded bool `json:"exceeded"`
+
+	// Value is the value that crossed the limit.
+	Value int64 `json:"value"`
+	Limit int64 `json:"limit"`
+}
+
+// SoftQuotas are thresholds that warn of a hub being under pressure before
+// any hard limits are reached. Nothing is dropped or refused when a soft
+// quota is exceeded. Zero values are not checked.
+type SoftQuotas struct {
+	// MaxQueued is the total number of messages queued across all the
+	// subscribers.
+	MaxQueued int64
+
+	// MaxQueuedBytes is the estimated memory used by the data of the
+	// queued messages. Each message is counted once for each subscriber
+	// that it is queued for. Estimating the size of the data takes time
+	// when each message is published, so it is only done if this is set.
+	MaxQueuedBytes int64
+
+	// MaxSubscribers is the number of subscribers.
+	MaxSubscribers int64
+
+	// Alert, if set, is called with each alert, as well as the alert being
+	// published on QuotaAlertTopic. The alerts are passed in order from a
+	// separate goroutine, so the alert function may use the hub.
+	Alert func(QuotaAlert)
+}
+
+// quotaTracker keeps the values that the soft quotas of a hub are checked
+// against.
+type quotaTracker struct {
+	quotas  SoftQuotas
+	publish func(ctx context.Context, topic Topic, data interface{}) (Completer, error)
+
+	mutex       sync.Mutex
+	queued      int64
+	queuedBytes int64
+	exceeded    map[string]bool
+
+	// alerts are waiting to be sent by the sending goroutine, which is
+	// only running while sending is true.
+	alerts  []QuotaAlert
+	sending bool
+}
+
+func newQuotaTracker(quotas *SoftQuotas, publish func(context.Context, Topic, interface{}) (Completer, error)) *quotaTracker {
+	if quotas == nil {
+		return nil
+	}
+	return &quotaTracker{
+		quotas:   *quotas,
+		publish:  publish,
+		exceeded: make(map[string]bool),
+	}
+}
+
+// measure returns the estimated size of the data, if it is needed.
+func (q *quotaTracker) measure(data interface{}) int64 {
+	if q == nil || q.quotas.MaxQueuedBytes <= 0 {
+		return 0
+	}
+	return estimateSize(reflect.ValueOf(data))
+}
+
+// add changes the number of queued messages and their size.
+func (q *quotaTracker) add(count, size int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.queued += count
+	q.queuedBytes += size
+	q.check(QuotaQueued, q.queued, q.quotas.MaxQueued)
+	q.check(QuotaQueuedBytes, q.queuedBytes, q.quotas.MaxQueuedBytes)
+}
+
+func (q *quotaTracker) subscribers(count int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.check(QuotaSubscribers, int64(count), q.quotas.MaxSubscribers)
+}
+
+// check queues an alert if the value has crossed the limit. The mutex
+// must be held.
+func (q *quotaTracker) check(quota string, value, limit int64) {
+	if limit <= 0 {
+		return
+	}
+	exceeded := value > limit
+	if exceeded == q.exceeded[quota] {
+		return
+	}
+	q.exceeded[quota] = exceeded
+	q.alerts = append(q.alerts, QuotaAlert{
+		Quota:    quota,
+		Exceeded: exceeded,
+		Value:    value,
+		Limit:    limit,
+	})
+	if !q.sending {
+		q.sending = true
+		go q.send()
+	}
+}
+
+// send passes on the queued alerts, and stops once there are none left.
+// The alerts are sent from their own goroutine as they are noticed while
+// messages are being queued, when the hub can't be used.
+func (q *quotaTracker) send() {
+	for {
+		q.mutex.Lock()
+		if len(q.alerts) == 0 {
+			q.sending = false
+			q.mutex.Unlock()
+			return
+		}
+		alert := q.alerts[0]
+		q.alerts = q.alerts[1:]
+		q.mutex.Unlock()
+
+		if q.quotas.Alert != nil {
+			q.quotas.Alert(alert)
+		}
+		if _, err := q.publish(context.Background(), QuotaAlertTopic, alert); err != nil {
+			logger.Warningf("publishing quota alert: %v", err)
+		}
+	}
+}
+
+// report returns the values of the quotas for the hub report.
+func (q *quotaTracker) report() map[string]interface{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var exceeded []string
+	for _, quota := range []string{QuotaQueued, QuotaQueuedBytes, QuotaSubscribers} {
+		if q.exceeded[quota] {
+			exceeded = append(exceeded, quota)
+		}
+	}
+	result := map[string]interface{}{
+		"queued": q.queued,
+	}
+	if q.quotas.MaxQueuedBytes > 0 {
+		result["queued-bytes"] = q.queuedBytes
+	}
+	if len(exceeded) > 0 {
+		result["exceeded"] = exceeded
+	}
+	return result
+}
+
+// queue counts the call as queued for a subscriber. The tracker may be
+// nil. The alerts themselves are not counted, so they can't cause further
+// alerts.
+func (q *quotaTracker) queue(call *handlerCallback) {
+	if q == nil || call.barrier || call.topic == QuotaAlertTopic {
+		return
+	}
+	call.mu.Lock()
+	call.quota = q
+	call.mu.Unlock()
+	q.add(1, call.size)
+}
+
+// estimateSize returns a rough estimate of the memory used by the value,
+// which is enough to compare with a quota.
+func estimateSize(v reflect.Value) int64 {
+	const word = 8
+	switch v.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.String:
+		return 2*word + int64(v.Len())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return word
+		}
+		return word + estimateSize(v.Elem())
+	case reflect.Slice, reflect.Array:
+		size := int64(3 * word)
+		for i := 0; i < v.Len(); i++ {
+			size += estimateSize(v.Index(i))
+		}
+		return size
+	case reflect.Map:
+		size := int64(6 * word)
+		for iter := v.MapRange(); iter.Next(); {
+			size += estimateSize(iter.Key()) + estimateSize(iter.Value())
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += estimateSize(v.Field(i))
+		}
+		return size
+	}
+	return int64(v.Type().Size())
+}
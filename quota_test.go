@@ -0,0 +1,149 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type QuotaSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&QuotaSuite{})
+
+func nextAlert(c *gc.C, alerts <-chan pubsub.QuotaAlert) pubsub.QuotaAlert {
+	select {
+	case alert := <-alerts:
+		return alert
+	case <-time.After(time.Second):
+		c.Fatal("no alert")
+	}
+	return pubsub.QuotaAlert{}
+}
+
+func noAlert(c *gc.C, alerts <-chan pubsub.QuotaAlert) {
+	select {
+	case alert := <-alerts:
+		c.Fatalf("unexpected alert %#v", alert)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (*QuotaSuite) TestQueued(c *gc.C) {
+	alerts := make(chan pubsub.QuotaAlert, 10)
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		SoftQuotas: &pubsub.SoftQuotas{
+			MaxQueued: 2,
+			Alert:     func(alert pubsub.QuotaAlert) { alerts <- alert },
+		},
+	})
+	published, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.QuotaAlertTopic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	var results []pubsub.Completer
+	for i := 0; i < 4; i++ {
+		result, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	exceeded := pubsub.QuotaAlert{Quota: pubsub.QuotaQueued, Exceeded: true, Value: 3, Limit: 2}
+	c.Check(nextAlert(c, alerts), jc.DeepEquals, exceeded)
+	noAlert(c, alerts)
+	c.Check(hub.(pubsub.Reporter).Report()["quotas"], jc.DeepEquals, map[string]interface{}{
+		"queued":   int64(4),
+		"exceeded": []string{pubsub.QuotaQueued},
+	})
+
+	close(handler.release)
+	for _, result := range results {
+		waitComplete(c, result)
+	}
+	recovered := pubsub.QuotaAlert{Quota: pubsub.QuotaQueued, Exceeded: false, Value: 2, Limit: 2}
+	c.Check(nextAlert(c, alerts), jc.DeepEquals, recovered)
+	c.Check(hub.(pubsub.Reporter).Report()["quotas"], jc.DeepEquals, map[string]interface{}{
+		"queued": int64(0),
+	})
+
+	// The alerts are also published on the hub.
+	c.Check(receive(c, published).Data, jc.DeepEquals, exceeded)
+	c.Check(receive(c, published).Data, jc.DeepEquals, recovered)
+}
+
+func (*QuotaSuite) TestQueuedBytes(c *gc.C) {
+	alerts := make(chan pubsub.QuotaAlert, 10)
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			SoftQuotas: &pubsub.SoftQuotas{
+				MaxQueuedBytes: 100,
+				Alert:          func(alert pubsub.QuotaAlert) { alerts <- alert },
+			},
+		},
+	})
+	release := make(chan struct{})
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, map[string]interface{}, error) {
+		<-release
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	result, err := hub.Publish(topic, JustOrigin{Origin: "small"})
+	c.Assert(err, jc.ErrorIsNil)
+	noAlert(c, alerts)
+	result2, err := hub.Publish(topic, JustOrigin{Origin: strings.Repeat("x", 100)})
+	c.Assert(err, jc.ErrorIsNil)
+	alert := nextAlert(c, alerts)
+	c.Check(alert.Quota, gc.Equals, pubsub.QuotaQueuedBytes)
+	c.Check(alert.Exceeded, jc.IsTrue)
+	c.Check(alert.Value > 100, jc.IsTrue)
+
+	close(release)
+	waitComplete(c, result)
+	waitComplete(c, result2)
+	alert = nextAlert(c, alerts)
+	c.Check(alert.Quota, gc.Equals, pubsub.QuotaQueuedBytes)
+	c.Check(alert.Exceeded, jc.IsFalse)
+	c.Check(hub.(pubsub.Reporter).Report()["quotas"], jc.DeepEquals, map[string]interface{}{
+		"queued":       int64(0),
+		"queued-bytes": int64(0),
+	})
+}
+
+func (*QuotaSuite) TestSubscribers(c *gc.C) {
+	alerts := make(chan pubsub.QuotaAlert, 10)
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		SoftQuotas: &pubsub.SoftQuotas{
+			MaxSubscribers: 1,
+			Alert:          func(alert pubsub.QuotaAlert) { alerts <- alert },
+		},
+	})
+	noop := func(pubsub.Topic, interface{}) {}
+	sub1, err := hub.Subscribe(topic, noop)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub1.Unsubscribe()
+	noAlert(c, alerts)
+
+	sub2, err := hub.Subscribe(topic, noop)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(nextAlert(c, alerts), jc.DeepEquals, pubsub.QuotaAlert{
+		Quota: pubsub.QuotaSubscribers, Exceeded: true, Value: 2, Limit: 1,
+	})
+	sub2.Unsubscribe()
+	c.Check(nextAlert(c, alerts), jc.DeepEquals, pubsub.QuotaAlert{
+		Quota: pubsub.QuotaSubscribers, Exceeded: false, Value: 1, Limit: 1,
+	})
+}
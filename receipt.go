@@ -0,0 +1,144 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeliveryReceiptTopic is the topic that a hub publishes a DeliveryReceipt
+// on each time a subscriber finishes with a message, if the hub is
+// configured with DeliveryReceipts.
+const DeliveryReceiptTopic Topic = "pubsub.delivery-receipt"
+
+// MessageIDHeader identifies a message across the hubs it is forwarded
+// between. Hubs that publish delivery receipts give each message published
+// without one an ID made from the hub ID and the sequence of the message.
+const MessageIDHeader = "pubsub-message-id"
+
+// The outcomes of a DeliveryReceipt.
+const (
+	OutcomeDelivered = "delivered"
+	OutcomeFailed    = "failed"
+	OutcomeDropped   = "dropped"
+)
+
+// DeliveryReceipt records what a subscriber did with a message, so that a
+// collector subscribed to the receipts of the hubs of a distributed
+// deployment can follow each message through the components that handled
+// it.
+type DeliveryReceipt struct {
+	// MessageID is the MessageIDHeader of the message.
+	MessageID string `json:"id"`
+
+	// Topic is the topic of the message.
+	Topic Topic `json:"topic"`
+
+	// Hub is the ID of the hub of the subscriber.
+	Hub string `json:"hub"`
+
+	// Subscriber is the ID of the subscriber, as shown in the hub Report,
+	// and SubscriberName is the name given to it with the Named option.
+	Subscriber     int    `json:"subscriber"`
+	SubscriberName string `json:"name,omitempty"`
+
+	// Latency is the time between the message being queued for the
+	// subscriber and the subscriber finishing with it.
+	Latency time.Duration `json:"latency"`
+
+	// Outcome is OutcomeDelivered if the handler returned without an
+	// error, OutcomeFailed if it returned an error, or OutcomeDropped if
+	// the handler was never called.
+	Outcome string `json:"outcome"`
+}
+
+// receiptSender publishes the delivery receipts of a hub.
+type receiptSender struct {
+	matcher TopicMatcher
+	hub     string
+	publish func(ctx context.Context, topic Topic, data interface{}) (Completer, error)
+
+	// receipts are waiting to be published by the sending goroutine,
+	// which is only running while sending is true.
+	mutex    sync.Mutex
+	receipts []DeliveryReceipt
+	sending  bool
+}
+
+func newReceiptSender(matcher TopicMatcher, hub string, publish func(context.Context, Topic, interface{}) (Completer, error)) *receiptSender {
+	if matcher == nil {
+		return nil
+	}
+	return &receiptSender{
+		matcher: matcher,
+		hub:     hub,
+		publish: publish,
+	}
+}
+
+// withMessageID returns the headers of a message being published, with a
+// MessageIDHeader if the hub publishes receipts for the topic and they
+// don't already have one. The sender may be nil.
+func (r *receiptSender) withMessageID(topic Topic, headers Headers, sequence uint64) Headers {
+	if r == nil || !r.matcher.Match(topic) {
+		return headers
+	}
+	if _, ok := headers[MessageIDHeader]; ok {
+		return headers
+	}
+	// The headers may be shared with other publishes, so they are copied.
+	withID := make(Headers, len(headers)+1)
+	for key, value := range headers {
+		withID[key] = value
+	}
+	withID[MessageIDHeader] = r.hub + ":" + strconv.FormatUint(sequence, 10)
+	return withID
+}
+
+// add queues a receipt for the call. The sender may be nil.
+func (r *receiptSender) add(s *subscriber, call *handlerCallback, outcome string) {
+	if r == nil || call.barrier || call.topic == DeliveryReceiptTopic || !r.matcher.Match(call.topic) {
+		return
+	}
+	receipt := DeliveryReceipt{
+		MessageID:      call.headers[MessageIDHeader],
+		Topic:          call.topic,
+		Hub:            r.hub,
+		Subscriber:     s.id,
+		SubscriberName: s.name,
+		Latency:        time.Since(call.queued),
+		Outcome:        outcome,
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.receipts = append(r.receipts, receipt)
+	if !r.sending {
+		r.sending = true
+		go r.send()
+	}
+}
+
+// send publishes the queued receipts, and stops once there are none left.
+// The receipts are published from their own goroutine as messages can be
+// dropped while the hub mutex is held.
+func (r *receiptSender) send() {
+	for {
+		r.mutex.Lock()
+		if len(r.receipts) == 0 {
+			r.sending = false
+			r.mutex.Unlock()
+			return
+		}
+		receipt := r.receipts[0]
+		r.receipts = r.receipts[1:]
+		r.mutex.Unlock()
+
+		if _, err := r.publish(context.Background(), DeliveryReceiptTopic, receipt); err != nil {
+			logger.Warningf("publishing delivery receipt: %v", err)
+		}
+	}
+}
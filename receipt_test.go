@@ -0,0 +1,131 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ReceiptSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ReceiptSuite{})
+
+func receiveReceipt(c *gc.C, messages <-chan pubsub.Message) pubsub.DeliveryReceipt {
+	message := receive(c, messages)
+	receipt := message.Data.(pubsub.DeliveryReceipt)
+	c.Check(receipt.Latency >= 0, jc.IsTrue)
+	receipt.Latency = 0
+	return receipt
+}
+
+func (*ReceiptSuite) TestReceipts(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		ID:               "hub-1",
+		DeliveryReceipts: pubsub.MatchAll,
+	})
+	receipts, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.DeliveryReceiptTopic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	_, err = hub.Subscribe(topic, func(_ pubsub.Topic, data interface{}) error {
+		if data == "fail" {
+			return errors.New("boom")
+		}
+		return nil
+	}, pubsub.Named("worker"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, "ok")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(receiveReceipt(c, receipts), jc.DeepEquals, pubsub.DeliveryReceipt{
+		MessageID:      "hub-1:1",
+		Topic:          topic,
+		Hub:            "hub-1",
+		Subscriber:     1,
+		SubscriberName: "worker",
+		Outcome:        pubsub.OutcomeDelivered,
+	})
+
+	// An ID that the message already has is kept.
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{pubsub.MessageIDHeader: "upstream"})
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, "fail")
+	c.Assert(err, jc.ErrorIsNil)
+	receipt := receiveReceipt(c, receipts)
+	c.Check(receipt.MessageID, gc.Equals, "upstream")
+	c.Check(receipt.Outcome, gc.Equals, pubsub.OutcomeFailed)
+}
+
+func (*ReceiptSuite) TestDroppedReceipts(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		DeliveryReceipts: topic,
+	})
+	receipts, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.DeliveryReceiptTopic, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(pubsub.MatchAll, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, "first")
+	c.Assert(err, jc.ErrorIsNil)
+	waitStarted(c, handler)
+	_, err = hub.Publish(topic, "second")
+	c.Assert(err, jc.ErrorIsNil)
+	// Topics that don't match aren't given receipts.
+	_, err = hub.Publish(first, "other")
+	c.Assert(err, jc.ErrorIsNil)
+	sub.Unsubscribe()
+	close(handler.release)
+
+	outcomes := map[string]int{}
+	for i := 0; i < 2; i++ {
+		outcomes[receiveReceipt(c, receipts).Outcome]++
+	}
+	c.Check(outcomes, jc.DeepEquals, map[string]int{
+		pubsub.OutcomeDelivered: 1,
+		pubsub.OutcomeDropped:   1,
+	})
+	select {
+	case message := <-receipts:
+		c.Fatalf("unexpected receipt %#v", message.Data)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (*ReceiptSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			ID:               "hub-2",
+			DeliveryReceipts: pubsub.MatchAll,
+		},
+	})
+	received := make(chan pubsub.DeliveryReceipt, 1)
+	_, err := hub.Subscribe(pubsub.DeliveryReceiptTopic, func(_ pubsub.Topic, receipt pubsub.DeliveryReceipt, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- receipt
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, func(pubsub.Topic, Emitter, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, Emitter{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case receipt := <-received:
+		c.Check(receipt.MessageID, gc.Equals, "hub-2:1")
+		c.Check(receipt.Subscriber, gc.Equals, 1)
+		c.Check(receipt.Outcome, gc.Equals, pubsub.OutcomeDelivered)
+	case <-time.After(time.Second):
+		c.Fatal("receipt not received")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// RedactedValue replaces the values of the fields that a Redactor masks.
+const RedactedValue = "[redacted]"
+
+// RedactorConfig is the argument struct for NewRedactor.
+type RedactorConfig struct {
+	// KeyPatterns are regular expressions matched against the keys of the
+	// data, at any depth. The values of matching keys are masked.
+	KeyPatterns []string
+
+	// Types holds the payload type of each topic, for masking the fields
+	// tagged `pubsub:"secret"` in data that is already in its map form,
+	// as it is for structured hubs. Values should be structures or
+	// pointers to them. Fields of data published as a structure are
+	// masked using the type of the data itself.
+	Types map[Topic]interface{}
+}
+
+// Validate checks that the config values are valid.
+func (config RedactorConfig) Validate() error {
+	for _, pattern := range config.KeyPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return errors.NotValidf("key pattern %q", pattern)
+		}
+	}
+	for topic, payload := range config.Types {
+		if structType(reflect.TypeOf(payload)) == nil {
+			return errors.NotValidf("type %T for topic %q", payload, topic)
+		}
+	}
+	return nil
+}
+
+// Redactor masks the secret values in messages before they are handed to
+// code that shouldn't see them, such as debug handlers, logs, and bridges
+// to untrusted hubs. Subscribers of the hub itself still receive the full
+// data.
+type Redactor struct {
+	patterns []*regexp.Regexp
+	types    map[Topic]reflect.Type
+}
+
+// NewRedactor returns a redactor that masks the fields tagged
+// `pubsub:"secret"` and the keys that match the configured patterns.
+func NewRedactor(config RedactorConfig) (*Redactor, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	r := &Redactor{types: make(map[Topic]reflect.Type)}
+	for _, pattern := range config.KeyPatterns {
+		r.patterns = append(r.patterns, regexp.MustCompile(pattern))
+	}
+	for topic, payload := range config.Types {
+		r.types[topic] = reflect.TypeOf(payload)
+	}
+	return r, nil
+}
+
+// Redact returns a copy of the data with the secret values masked. Data
+// published as a structure, or a pointer to one, is returned in its map
+// form, using the JSONMarshaller. Other data that isn't a map is returned
+// unchanged. The data passed in is never modified. A nil Redactor returns
+// the data unchanged.
+func (r *Redactor) Redact(topic Topic, data interface{}) (interface{}, error) {
+	if r == nil {
+		return data, nil
+	}
+	t := r.types[topic]
+	asMap, ok := data.(map[string]interface{})
+	if !ok {
+		t = structType(reflect.TypeOf(data))
+		if t == nil {
+			return data, nil
+		}
+		bytes, err := JSONMarshaller.Marshal(data)
+		if err != nil {
+			return nil, errors.Annotate(err, "marshalling data")
+		}
+		if err := JSONMarshaller.Unmarshal(bytes, &asMap); err != nil {
+			return nil, errors.Annotate(err, "unmarshalling data")
+		}
+		if asMap == nil {
+			return nil, nil
+		}
+	}
+	return r.redactMap(asMap, structType(t)), nil
+}
+
+// structType returns the structure type of t, or of what t points to. It
+// returns nil if t is neither.
+func structType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+func (r *Redactor) redactMap(data map[string]interface{}, t reflect.Type) map[string]interface{} {
+	fields := redactFields(t)
+	result := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		field, known := fields[strings.ToLower(key)]
+		if r.matchKey(key) || (known && field.secret) {
+			result[key] = RedactedValue
+			continue
+		}
+		result[key] = r.redactValue(value, field.typ)
+	}
+	return result
+}
+
+func (r *Redactor) redactValue(value interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Map {
+			elem = t.Elem()
+		}
+		if elem == nil {
+			return r.redactMap(v, t)
+		}
+		// The values of maps all have the element type.
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if r.matchKey(key) {
+				result[key] = RedactedValue
+				continue
+			}
+			result[key] = r.redactValue(item, elem)
+		}
+		return result
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = r.redactValue(item, elem)
+		}
+		return result
+	}
+	return value
+}
+
+func (r *Redactor) matchKey(key string) bool {
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+type redactField struct {
+	typ    reflect.Type
+	secret bool
+}
+
+// redactFields returns the fields of the structure keyed by the lower case
+// form of their keys in the map form of the data. The fields of embedded
+// structures without a name in their tag are included as fields of the
+// outer structure.
+func redactFields(t reflect.Type) map[string]redactField {
+	result := make(map[string]redactField)
+	if t == nil || t.Kind() != reflect.Struct {
+		return result
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := fieldKey(field)
+		if !ok {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && name == field.Name {
+			for key, embedded := range redactFields(field.Type) {
+				if _, exists := result[key]; !exists {
+					result[key] = embedded
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		result[strings.ToLower(name)] = redactField{
+			typ:    field.Type,
+			secret: hasTagOption(field.Tag.Get("pubsub"), "secret"),
+		}
+	}
+	return result
+}
+
+// hasTagOption returns true if the comma separated tag contains the
+// option.
+func hasTagOption(tag, option string) bool {
+	for _, value := range strings.Split(tag, ",") {
+		if strings.TrimSpace(value) == option {
+			return true
+		}
+	}
+	return false
+}
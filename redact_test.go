@@ -0,0 +1,154 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type RedactSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&RedactSuite{})
+
+type Credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password" pubsub:"secret"`
+}
+
+type Login struct {
+	Credentials
+	Host    string                 `json:"host"`
+	Backups []Credentials          `json:"backups"`
+	Extra   map[string]Credentials `json:"extra,omitempty"`
+	Token   string                 `pubsub:"secret"`
+}
+
+func (*RedactSuite) TestValidate(c *gc.C) {
+	for i, test := range []struct {
+		config pubsub.RedactorConfig
+		err    string
+	}{{
+		config: pubsub.RedactorConfig{KeyPatterns: []string{"("}},
+		err:    `key pattern "\(" not valid`,
+	}, {
+		config: pubsub.RedactorConfig{Types: map[pubsub.Topic]interface{}{first: "a string"}},
+		err:    `type string for topic "first" not valid`,
+	}, {
+		config: pubsub.RedactorConfig{
+			KeyPatterns: []string{"(?i)secret"},
+			Types:       map[pubsub.Topic]interface{}{first: &Login{}},
+		},
+	}} {
+		c.Logf("test %d", i)
+		err := test.config.Validate()
+		if test.err == "" {
+			c.Check(err, jc.ErrorIsNil)
+		} else {
+			c.Check(err, gc.ErrorMatches, test.err)
+		}
+	}
+}
+
+func (*RedactSuite) TestRedactStruct(c *gc.C) {
+	redactor, err := pubsub.NewRedactor(pubsub.RedactorConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	login := Login{
+		Credentials: Credentials{User: "admin", Password: "hunter2"},
+		Host:        "localhost",
+		Backups:     []Credentials{{User: "backup", Password: "swordfish"}},
+		Extra:       map[string]Credentials{"db": {User: "db", Password: "letmein"}},
+		Token:       "abc",
+	}
+	redacted, err := redactor.Redact(first, &login)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(redacted, jc.DeepEquals, map[string]interface{}{
+		"user":     "admin",
+		"password": pubsub.RedactedValue,
+		"host":     "localhost",
+		"backups": []interface{}{
+			map[string]interface{}{"user": "backup", "password": pubsub.RedactedValue},
+		},
+		"extra": map[string]interface{}{
+			"db": map[string]interface{}{"user": "db", "password": pubsub.RedactedValue},
+		},
+		"Token": pubsub.RedactedValue,
+	})
+	// The original is untouched.
+	c.Check(login.Password, gc.Equals, "hunter2")
+}
+
+func (*RedactSuite) TestRedactMapForm(c *gc.C) {
+	redactor, err := pubsub.NewRedactor(pubsub.RedactorConfig{
+		KeyPatterns: []string{"(?i)api-key"},
+		Types:       map[pubsub.Topic]interface{}{first: Credentials{}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	data := map[string]interface{}{
+		"user":     "admin",
+		"password": "hunter2",
+		"nested":   map[string]interface{}{"API-Key": "xyz", "other": 1},
+	}
+	redacted, err := redactor.Redact(first, data)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(redacted, jc.DeepEquals, map[string]interface{}{
+		"user":     "admin",
+		"password": pubsub.RedactedValue,
+		"nested":   map[string]interface{}{"API-Key": pubsub.RedactedValue, "other": 1},
+	})
+	c.Check(data["password"], gc.Equals, "hunter2")
+
+	// Without a type for the topic only the patterns apply.
+	redacted, err = redactor.Redact(second, data)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(redacted.(map[string]interface{})["password"], gc.Equals, "hunter2")
+}
+
+func (*RedactSuite) TestRedactOther(c *gc.C) {
+	redactor, err := pubsub.NewRedactor(pubsub.RedactorConfig{KeyPatterns: []string{"."}})
+	c.Assert(err, jc.ErrorIsNil)
+	redacted, err := redactor.Redact(first, "a string")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(redacted, gc.Equals, "a string")
+
+	var nilRedactor *pubsub.Redactor
+	redacted, err = nilRedactor.Redact(first, Credentials{Password: "hunter2"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(redacted, gc.Equals, Credentials{Password: "hunter2"})
+}
+
+func (*RedactSuite) TestUntrustedBridge(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	target := pubsub.NewSimpleHub()
+	redactor, err := pubsub.NewRedactor(pubsub.RedactorConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Source:   source,
+		Target:   target,
+		Rules:    []pubsub.BridgeRule{{Name: "all", Matcher: pubsub.MatchAll}},
+		Redactor: redactor,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	local, closeLocal, err := source.(pubsub.ChanSubscriber).SubscribeChan(first, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closeLocal()
+	remote, closeRemote, err := target.(pubsub.ChanSubscriber).SubscribeChan(first, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closeRemote()
+
+	_, err = source.Publish(first, Credentials{User: "admin", Password: "hunter2"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(receive(c, local).Data, gc.Equals, Credentials{User: "admin", Password: "hunter2"})
+	c.Check(receive(c, remote).Data, jc.DeepEquals, map[string]interface{}{
+		"user":     "admin",
+		"password": pubsub.RedactedValue,
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+// PayloadTypeError is returned from Publish on a structured hub when the
+// data published on a topic can't be converted into the payload type that
+// was registered for that topic.
+type PayloadTypeError struct {
+	Topic    Topic
+	Expected reflect.Type
+	Actual   reflect.Type
+	Err      error
+}
+
+// Error implements error.
+func (e *PayloadTypeError) Error() string {
+	return fmt.Sprintf("payload of type %v for topic %q does not match registered type %v: %v",
+		e.Actual, e.Topic, e.Expected, e.Err)
+}
+
+// IsPayloadTypeError returns true if the cause of the error is a
+// *PayloadTypeError.
+func IsPayloadTypeError(err error) bool {
+	_, ok := errors.Cause(err).(*PayloadTypeError)
+	return ok
+}
+
+// RegisterTopic implements StructuredHub.
+func (h *structuredHub) RegisterTopic(topic Topic, payload interface{}) error {
+	rt := reflect.TypeOf(payload)
+	if rt == nil {
+		return errors.NotValidf("nil payload")
+	}
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt.Kind() != reflect.Struct {
+		return errors.NotValidf("payload of type %T", payload)
+	}
+	h.registryMutex.Lock()
+	defer h.registryMutex.Unlock()
+	if existing, ok := h.payloadTypes[topic]; ok && existing != rt {
+		return errors.AlreadyExistsf("payload type %v for topic %q", existing, topic)
+	}
+	if h.payloadTypes == nil {
+		h.payloadTypes = make(map[Topic]reflect.Type)
+	}
+	h.payloadTypes[topic] = rt
+	return nil
+}
+
+func (h *structuredHub) registeredType(topic Topic) reflect.Type {
+	h.registryMutex.Lock()
+	defer h.registryMutex.Unlock()
+	return h.payloadTypes[topic]
+}
+
+// checkPayload makes sure that the data published on the topic can be
+// converted into the registered type for the topic, if there is one. On a
+// strict hub the topic must have a registered type. The data is the value
+// passed to Publish, and asMap is what it was converted into, before it is
+// annotated or intercepted.
+func (h *structuredHub) checkPayload(topic Topic, data interface{}, asMap map[string]interface{}) error {
+	expected := h.registeredType(topic)
+	if expected == nil {
+		if h.decoder.strict {
+			return errors.NotValidf("unregistered topic %q on strict hub", topic)
+		}
+		return nil
+	}
+	actual := reflect.TypeOf(data)
+	if actual == nil {
+		return &PayloadTypeError{
+			Topic:    topic,
+			Expected: expected,
+			Err:      errors.NotValidf("nil payload"),
+		}
+	}
+	if actual == expected || (actual.Kind() == reflect.Ptr && actual.Elem() == expected) {
+		return nil
+	}
+	if _, err := h.decoder.toHanderType(expected, asMap); err != nil {
+		return &PayloadTypeError{
+			Topic:    topic,
+			Expected: expected,
+			Actual:   actual,
+			Err:      err,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type RegistrySuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&RegistrySuite{})
+
+type Colour string
+
+func (c *Colour) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value {
+	case "red", "green", "blue":
+		*c = Colour(value)
+		return nil
+	}
+	return errors.Errorf("unknown colour %q", value)
+}
+
+type Paint struct {
+	Colour Colour `json:"colour"`
+}
+
+func (*RegistrySuite) TestRegisterTopicBadPayload(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	err := hub.RegisterTopic(topic, nil)
+	c.Check(err, gc.ErrorMatches, "nil payload not valid")
+	err = hub.RegisterTopic(topic, "string")
+	c.Check(err, gc.ErrorMatches, "payload of type string not valid")
+}
+
+func (*RegistrySuite) TestRegisterTopicTwice(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	err := hub.RegisterTopic(topic, Paint{})
+	c.Assert(err, jc.ErrorIsNil)
+	err = hub.RegisterTopic(topic, &Paint{})
+	c.Assert(err, jc.ErrorIsNil)
+	err = hub.RegisterTopic(topic, Emitter{})
+	c.Assert(err, gc.ErrorMatches, `payload type pubsub_test.Paint for topic "testing" already exists`)
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+}
+
+func (*RegistrySuite) TestPublishChecksPayload(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	err := hub.RegisterTopic(topic, Paint{})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, Paint{Colour: "red"})
+	c.Check(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, &Paint{Colour: "red"})
+	c.Check(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, map[string]interface{}{"colour": "blue"})
+	c.Check(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, map[string]interface{}{"colour": "mauve"})
+	c.Check(err, gc.ErrorMatches, `payload of type map\[string\]interface {} for topic "testing" does not match registered type pubsub_test.Paint: unmarshalling data: .*unknown colour "mauve"`)
+	c.Check(err, jc.Satisfies, pubsub.IsPayloadTypeError)
+	_, err = hub.Publish(topic, JustOrigin{Origin: "other"})
+	c.Check(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, Emitter{ID: 42})
+	c.Check(err, jc.ErrorIsNil)
+
+	// Other topics aren't checked.
+	_, err = hub.Publish(first, map[string]interface{}{"colour": "mauve"})
+	c.Check(err, jc.ErrorIsNil)
+}
+
+func (*RegistrySuite) TestPublishTypeMismatch(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	err := hub.RegisterTopic(topic, Emitter{})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, BadID{ID: "forty-two"})
+	c.Assert(err, jc.Satisfies, pubsub.IsPayloadTypeError)
+	cause := errors.Cause(err).(*pubsub.PayloadTypeError)
+	c.Check(cause.Topic, gc.Equals, topic)
+	c.Check(cause.Expected.Name(), gc.Equals, "Emitter")
+	c.Check(cause.Actual.Name(), gc.Equals, "BadID")
+}
+
+func (*RegistrySuite) TestPublishNil(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	err := hub.RegisterTopic(topic, Paint{})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, nil)
+	c.Check(err, gc.ErrorMatches, `payload of type <nil> for topic "testing" does not match registered type pubsub_test.Paint: nil payload not valid`)
+	c.Assert(err, jc.Satisfies, pubsub.IsPayloadTypeError)
+	c.Check(errors.Cause(err).(*pubsub.PayloadTypeError).Actual, gc.IsNil)
+
+	_, err = hub.Publish(first, nil)
+	c.Check(err, gc.ErrorMatches, "nil data not valid")
+}
+
+func (*RegistrySuite) TestPublishCheckedBeforeIntercept(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	err := hub.RegisterTopic(topic, Paint{})
+	c.Assert(err, jc.ErrorIsNil)
+	unsub, err := hub.Intercept(topic, func(topic pubsub.Topic, data map[string]interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+		return topic, map[string]interface{}{"colour": "blue"}, true
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer unsub.Unsubscribe()
+
+	// The payload the caller published is checked, not the one the
+	// interceptor replaced it with.
+	_, err = hub.Publish(topic, map[string]interface{}{"colour": "mauve"})
+	c.Check(err, jc.Satisfies, pubsub.IsPayloadTypeError)
+	_, err = hub.Publish(topic, map[string]interface{}{"colour": "red"})
+	c.Check(err, jc.ErrorIsNil)
+}
+
+func (*RegistrySuite) TestStrictPublish(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{Strict: true})
+	err := hub.RegisterTopic(topic, Paint{})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, Paint{Colour: "red"})
+	c.Check(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, map[string]interface{}{"colour": "blue"})
+	c.Check(err, gc.ErrorMatches, "untyped publish on strict hub not valid")
+	c.Check(err, jc.Satisfies, errors.IsNotValid)
+	_, err = hub.PublishJSON(topic, strings.NewReader(`{"colour": "blue"}`))
+	c.Check(err, gc.ErrorMatches, "untyped publish on strict hub not valid")
+	_, err = hub.Publish(first, Paint{Colour: "red"})
+	c.Check(err, gc.ErrorMatches, `unregistered topic "first" on strict hub not valid`)
+	c.Check(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (*RegistrySuite) TestStrictSubscribe(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{Strict: true})
+	_, err := hub.Subscribe(topic, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Check(err, gc.ErrorMatches, "map handler on strict hub not valid")
+	_, err = hub.Subscribe(topic, pubsub.Union(
+		func(pubsub.Topic, Paint, error) {},
+		func(pubsub.Topic, map[string]interface{}, error) {},
+	))
+	c.Check(err, gc.ErrorMatches, "union handler 1: map handler on strict hub not valid")
+
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, Paint, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	err = sub.Replace(func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Check(err, gc.ErrorMatches, "map handler on strict hub not valid")
+}
+
+func (*RegistrySuite) TestStrictMultiplexer(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{Strict: true})
+	err := hub.RegisterTopic(topic, Paint{})
+	c.Assert(err, jc.ErrorIsNil)
+	unsub, multi, err := pubsub.NewMultiplexer(hub)
+	c.Assert(err, jc.ErrorIsNil)
+	defer unsub.Unsubscribe()
+
+	err = multi.Add(topic, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Check(err, gc.ErrorMatches, "map handler on strict hub not valid")
+	colours := make(chan Colour, 1)
+	err = multi.Add(topic, func(_ pubsub.Topic, paint Paint, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		colours <- paint.Colour
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, Paint{Colour: "green"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case colour := <-colours:
+		c.Check(colour, gc.Equals, Colour("green"))
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Reporter is implemented by all the hubs. The Report method follows the
+// convention of the juju dependency engine, so a worker that embeds a hub
+// can include the hub's report in its own, and the hub statistics are shown
+// in the engine introspection output.
+type Reporter interface {
+	// Report returns a map describing the state of the receiver. The map
+	// is expected to be serialized, so it only contains simple values,
+	// slices, and maps with string keys.
+	Report() map[string]interface{}
+}
+
+// Report implements Reporter.
+func (h *simplehub) Report() map[string]interface{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	subscribers := make(map[string]interface{})
+	order := make([]int, 0, len(h.subscribers))
+	for _, s := range h.subscribers {
+		order = append(order, s.id)
+		report := s.report()
+		if s.failover != nil {
+			report["failover-group"] = s.failover.config.Group
+			report["standby"] = h.isStandby(s)
+		}
+		subscribers[fmt.Sprint(s.id)] = report
+	}
+	result := map[string]interface{}{
+		"published":        atomic.LoadUint64(&h.sequence),
+		"subscriber-count": len(h.subscribers),
+		"subscribers":      subscribers,
+		"fan-out-order":    order,
+	}
+	if h.quotas != nil {
+		result["quotas"] = h.quotas.report()
+	}
+	if costs := matchCostReport(h.subscribers); costs != nil {
+		result["match-costs"] = costs
+	}
+	return result
+}
+
+func (s *subscriber) report() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := map[string]interface{}{
+		"matcher":   describeMatcher(s.topicMatcher),
+		"pending":   s.pendingCount(),
+		"delivered": s.delivered,
+	}
+	if s.name != "" {
+		result["name"] = s.name
+	}
+	if s.priority != 0 {
+		result["priority"] = s.priority
+	}
+	if s.duplicates > 0 {
+		result["duplicates"] = s.duplicates
+	}
+	s.errs.report(result)
+	s.reportMatched(result)
+	if s.warmUp != nil && !s.warmUp.isReady() {
+		result["warming-up"] = true
+	}
+	if len(s.labels) > 0 {
+		labels := make(map[string]interface{}, len(s.labels))
+		for key, value := range s.labels {
+			labels[key] = value
+		}
+		result["labels"] = labels
+	}
+	return result
+}
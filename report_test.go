@@ -0,0 +1,76 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ReportSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ReportSuite{})
+
+func (*ReportSuite) TestReportEmpty(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	c.Assert(hub.(pubsub.Reporter).Report(), jc.DeepEquals, map[string]interface{}{
+		"published":        uint64(0),
+		"subscriber-count": 0,
+		"subscribers":      map[string]interface{}{},
+		"fan-out-order":    []int{},
+	})
+}
+
+func (*ReportSuite) TestReport(c *gc.C) {
+	wait := make(chan struct{})
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Subscribe(first, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(pubsub.MatchRegex("^second"), func(pubsub.Topic, map[string]interface{}, error) {
+		<-wait
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	var result pubsub.Completer
+	for _, t := range []pubsub.Topic{first, second, second, second} {
+		result, err = hub.Publish(t, map[string]interface{}{})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	// Wait for the first to be processed and the second subscriber to
+	// be blocked.
+	time.Sleep(10 * veryShortTime)
+	report := hub.(pubsub.Reporter).Report()
+	close(wait)
+	<-result.Complete()
+
+	c.Assert(report, jc.DeepEquals, map[string]interface{}{
+		"published":        uint64(4),
+		"subscriber-count": 2,
+		"subscribers": map[string]interface{}{
+			"0": map[string]interface{}{
+				"matcher":   "first",
+				"pending":   0,
+				"delivered": uint64(1),
+			},
+			"1": map[string]interface{}{
+				"matcher":        "^second",
+				"pending":        2,
+				"delivered":      uint64(0),
+				"matched-topics": []string{"second"},
+			},
+		},
+		"fan-out-order": []int{0, 1},
+	})
+
+	reporter := hub.(pubsub.Reporter)
+	subscribers := reporter.Report()["subscribers"].(map[string]interface{})
+	c.Assert(subscribers["1"].(map[string]interface{})["delivered"], gc.Equals, uint64(3))
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"github.com/juju/errors"
+)
+
+// Resubscribe implements Resubscriber.
+func (h *simplehub) Resubscribe(old Subscription, matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	replaced, err := h.resubscribing(old)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	subscription, _, err := h.addSubscriber(matcher, handler, options, false, replaced)
+	return subscription, errors.Trace(err)
+}
+
+// Resubscribe implements Resubscriber.
+func (h *structuredHub) Resubscribe(old Subscription, matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, error) {
+	callback, err := h.newCallback(handler, options)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	subscription, err := h.simplehub.Resubscribe(old, matcher, callback.handler, options...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.replaceable(subscription, options), nil
+}
+
+// resubscribing returns the subscriber of the subscription being replaced.
+// The hub mutex must be held.
+func (h *simplehub) resubscribing(old Subscription) (*subscriber, error) {
+	subscription, ok := old.(*handle)
+	if !ok || subscription.hub != h {
+		return nil, errors.NotValidf("subscription from another hub")
+	}
+	sub := subscription.sub
+	found := false
+	for _, s := range h.subscribers {
+		found = found || s == sub
+	}
+	if !found {
+		return nil, errors.NotFoundf("subscription %d", sub.id)
+	}
+	if sub.durable != nil {
+		return nil, errors.NotSupportedf("resubscribing durable subscription")
+	}
+	if sub.workers != nil {
+		return nil, errors.NotSupportedf("resubscribing parallel subscription")
+	}
+	return sub, nil
+}
+
+// handOver passes the messages queued for the subscriber that the next
+// subscriber's matcher matches to the next subscriber, and drops the rest.
+// The messages notified to the subscriber from then on are forwarded in
+// the same way, and the subscriber is closed. A handler call that is
+// already running is left to finish.
+func (s *subscriber) handOver(next *subscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.successor = next
+	for message, ok := s.pending.Pop(); ok; message, ok = s.pending.Pop() {
+		s.stopCoalescing(message.call)
+		s.forward(message.call)
+	}
+	s.coalescing = nil
+	close(s.done)
+}
+
+// forward passes the call to the successor of the subscriber if its
+// matcher matches the topic, or drops it. The mutex must be held.
+func (s *subscriber) forward(call *handlerCallback) {
+	if call.barrier || s.successor.topicMatcher.Match(call.topic) {
+		s.successor.notify(call)
+		return
+	}
+	s.recordDropped(call)
+	call.done()
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type ResubscribeSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&ResubscribeSuite{})
+
+func (*ResubscribeSuite) TestQueueHandedOver(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	blocking := newBlockingHandler()
+	old, err := hub.Subscribe(pubsub.MatchAll, blocking.handle)
+	c.Assert(err, jc.ErrorIsNil)
+
+	var completers []pubsub.Completer
+	for i, t := range []pubsub.Topic{first, first, second, first} {
+		done, err := hub.Publish(t, i)
+		c.Assert(err, jc.ErrorIsNil)
+		completers = append(completers, done)
+		if i == 0 {
+			waitStarted(c, blocking)
+		}
+	}
+
+	var mutex sync.Mutex
+	var received []interface{}
+	sub, err := hub.(pubsub.Resubscriber).Resubscribe(old, first, func(_ pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(sub.Pending(), gc.Equals, 2)
+	c.Check(old.Pending(), gc.Equals, 0)
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 1)
+
+	// The old handler finishes the message it was handling.
+	close(blocking.release)
+	for _, done := range completers {
+		waitComplete(c, done)
+	}
+	c.Check(blocking.get(), jc.DeepEquals, []interface{}{0})
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.Check(received, jc.DeepEquals, []interface{}{1, 3})
+}
+
+func (*ResubscribeSuite) TestNoMessagesMissedOrDoubled(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var mutex sync.Mutex
+	seen := make(map[int]int)
+	handler := func(_ pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[data.(int)]++
+	}
+	sub, err := hub.Subscribe(topic, handler)
+	c.Assert(err, jc.ErrorIsNil)
+
+	const count = 500
+	published := make(chan []pubsub.Completer, 1)
+	go func() {
+		var completers []pubsub.Completer
+		for i := 0; i < count; i++ {
+			done, err := hub.Publish(topic, i)
+			c.Check(err, jc.ErrorIsNil)
+			completers = append(completers, done)
+		}
+		published <- completers
+	}()
+	for i := 0; i < 10; i++ {
+		sub, err = hub.(pubsub.Resubscriber).Resubscribe(sub, topic, handler)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	select {
+	case completers := <-published:
+		for _, done := range completers {
+			waitComplete(c, done)
+		}
+	case <-time.After(5 * time.Second):
+		c.Fatal("publishing not finished")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.Assert(seen, gc.HasLen, count)
+	for i := 0; i < count; i++ {
+		c.Check(seen[i], gc.Equals, 1, gc.Commentf("message %d", i))
+	}
+}
+
+func (*ResubscribeSuite) TestErrors(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	other := pubsub.NewSimpleHub()
+	handler := func(pubsub.Topic, interface{}) {}
+	foreign, err := other.Subscribe(topic, handler)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.(pubsub.Resubscriber).Resubscribe(foreign, topic, handler)
+	c.Check(err, gc.ErrorMatches, "subscription from another hub not valid")
+
+	gone, err := hub.Subscribe(topic, handler)
+	c.Assert(err, jc.ErrorIsNil)
+	gone.Unsubscribe()
+	_, err = hub.(pubsub.Resubscriber).Resubscribe(gone, topic, handler)
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+
+	parallel, err := hub.Subscribe(topic, handler, pubsub.Parallel(2))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.(pubsub.Resubscriber).Resubscribe(parallel, topic, handler)
+	c.Check(err, gc.ErrorMatches, "resubscribing parallel subscription not supported")
+
+	// A failed resubscribe leaves the old subscription in place.
+	sub, err := hub.Subscribe(topic, handler)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.(pubsub.Resubscriber).Resubscribe(sub, topic, "not a handler")
+	c.Check(err, gc.ErrorMatches, "handler of type string not valid")
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 2)
+}
+
+func (*ResubscribeSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	old, err := hub.Subscribe(topic, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	received := make(chan Emitter, 1)
+	_, err = hub.(pubsub.Resubscriber).Resubscribe(old, topic, func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, Emitter{Origin: "test"})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data.Origin, gc.Equals, "test")
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// deliverRetained values determine which retained messages are delivered
+// to a new subscription.
+type deliverRetained int
+
+const (
+	deliverNew deliverRetained = iota
+	deliverLastRetained
+	deliverAllRetained
+)
+
+// DeliverNew is a subscribe option that makes the subscription only
+// receive messages published after it was created. This is the default.
+func DeliverNew() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deliver = deliverNew
+	}
+}
+
+// DeliverLastRetained is a subscribe option that makes the subscription
+// start with the most recent retained message of each topic that it
+// matches, in the order they were published, followed by all the messages
+// published after it was created. This has no effect on hubs that don't
+// retain messages.
+func DeliverLastRetained() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deliver = deliverLastRetained
+	}
+}
+
+// DeliverAllRetained is a subscribe option that makes the subscription
+// start with all the retained messages of the topics that it matches, in
+// the order they were published, followed by all the messages published
+// after it was created. This has no effect on hubs that don't retain
+// messages.
+func DeliverAllRetained() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deliver = deliverAllRetained
+	}
+}
+
+// retainedMessage is a published message kept by the hub.
+type retainedMessage struct {
+	topic    Topic
+	data     interface{}
+	sequence uint64
+	key      string
+	headers  Headers
+}
+
+// retain keeps the message if the hub retains messages. The hub mutex must
+// be held.
+func (h *simplehub) retain(message retainedMessage) {
+	if h.retainCount <= 0 {
+		return
+	}
+	if h.retained == nil {
+		h.retained = make(map[Topic][]retainedMessage)
+	}
+	messages := append(h.retained[message.topic], message)
+	if excess := len(messages) - h.retainCount; excess > 0 {
+		messages = append([]retainedMessage(nil), messages[excess:]...)
+	}
+	h.retained[message.topic] = messages
+}
+
+// retainedFor returns the retained messages that the subscriber is to
+// receive, in the order they were published. The hub mutex must be held.
+func (h *simplehub) retainedFor(matcher TopicMatcher, deliver deliverRetained) []retainedMessage {
+	if deliver == deliverNew {
+		return nil
+	}
+	var result []retainedMessage
+	for topic, messages := range h.retained {
+		if !matcher.Match(topic) {
+			continue
+		}
+		if deliver == deliverLastRetained {
+			messages = messages[len(messages)-1:]
+		}
+		result = append(result, messages...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].sequence < result[j].sequence
+	})
+	return result
+}
+
+// retainedMessages converts the retained messages into Messages.
+func retainedMessages(retained []retainedMessage) []Message {
+	if len(retained) == 0 {
+		return nil
+	}
+	result := make([]Message, len(retained))
+	for i, message := range retained {
+		result[i] = Message{
+			Topic: message.topic,
+			Data:  message.data,
+			Delivery: Delivery{
+				Sequence:    message.sequence,
+				OrderingKey: message.key,
+				Headers:     message.headers,
+			},
+		}
+	}
+	return result
+}
+
+// SubscribeAndFetch implements FetchingSubscriber.
+func (h *simplehub) SubscribeAndFetch(matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, []Message, error) {
+	return h.subscribe(matcher, handler, options, true)
+}
+
+// SubscribeAndFetch implements FetchingSubscriber.
+func (h *structuredHub) SubscribeAndFetch(matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, []Message, error) {
+	callback, err := h.newCallback(handler, options)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	subscription, fetched, err := h.simplehub.SubscribeAndFetch(matcher, callback.handler, options...)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return h.replaceable(subscription, options), fetched, nil
+}
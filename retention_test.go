@@ -0,0 +1,193 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type RetentionSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&RetentionSuite{})
+
+func (*RetentionSuite) publishAll(c *gc.C, hub pubsub.Hub) {
+	for i, t := range []pubsub.Topic{first, second, first, firstdot, first, second} {
+		_, err := hub.Publish(t, i)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+}
+
+func (*RetentionSuite) subscribe(c *gc.C, hub pubsub.Hub, options ...pubsub.SubscribeOption) func() []int {
+	var (
+		mutex    sync.Mutex
+		received []int
+	)
+	_, err := hub.Subscribe(pubsub.MatchRegex("^first"), func(topic pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data.(int))
+	}, options...)
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(first, 100)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	return func() []int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return received
+	}
+}
+
+func (s *RetentionSuite) TestDeliverNew(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 2})
+	s.publishAll(c, hub)
+	received := s.subscribe(c, hub, pubsub.DeliverNew())
+	c.Assert(received(), jc.DeepEquals, []int{100})
+	// New is the default.
+	received = s.subscribe(c, hub)
+	c.Assert(received(), jc.DeepEquals, []int{100})
+}
+
+func (s *RetentionSuite) TestDeliverLastRetained(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 2})
+	s.publishAll(c, hub)
+	received := s.subscribe(c, hub, pubsub.DeliverLastRetained())
+	c.Assert(received(), jc.DeepEquals, []int{3, 4, 100})
+}
+
+func (s *RetentionSuite) TestDeliverAllRetained(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 2})
+	s.publishAll(c, hub)
+	received := s.subscribe(c, hub, pubsub.DeliverAllRetained())
+	// Only the last two messages for the first topic are retained.
+	c.Assert(received(), jc.DeepEquals, []int{2, 3, 4, 100})
+}
+
+func (s *RetentionSuite) TestNoRetention(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	s.publishAll(c, hub)
+	received := s.subscribe(c, hub, pubsub.DeliverAllRetained())
+	c.Assert(received(), jc.DeepEquals, []int{100})
+}
+
+func (s *RetentionSuite) TestStructuredHub(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{Retain: 1},
+	})
+	_, err := hub.Publish(first, JustOrigin{"retained"})
+	c.Assert(err, jc.ErrorIsNil)
+	received := make(chan string, 1)
+	_, err = hub.Subscribe(first, func(topic pubsub.Topic, data JustOrigin, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data.Origin
+	}, pubsub.DeliverLastRetained())
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case origin := <-received:
+		c.Assert(origin, gc.Equals, "retained")
+	case <-time.After(time.Second):
+		c.Fatal("retained message not received")
+	}
+}
+
+func (s *RetentionSuite) TestSubscribeAndFetch(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 2})
+	s.publishAll(c, hub)
+	received := make(chan int, 10)
+	_, fetched, err := hub.(pubsub.FetchingSubscriber).SubscribeAndFetch(pubsub.MatchRegex("^first"), func(topic pubsub.Topic, data interface{}) {
+		received <- data.(int)
+	}, pubsub.DeliverAllRetained())
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(fetched, jc.DeepEquals, []pubsub.Message{
+		{Topic: firstdot, Data: 3, Delivery: pubsub.Delivery{Sequence: 4}},
+		{Topic: first, Data: 4, Delivery: pubsub.Delivery{Sequence: 5}},
+	})
+
+	_, err = hub.Publish(first, 100)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		// The fetched messages are not delivered, even though the option
+		// asked for them.
+		c.Assert(data, gc.Equals, 100)
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (s *RetentionSuite) TestSubscribeAndFetchNoGap(c *gc.C) {
+	const count = 1000
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Retain: 1})
+	_, err := hub.Publish(first, -1)
+	c.Assert(err, jc.ErrorIsNil)
+
+	var last pubsub.Completer
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < count; i++ {
+			result, err := hub.Publish(first, i)
+			c.Check(err, jc.ErrorIsNil)
+			last = result
+		}
+	}()
+
+	var (
+		mutex    sync.Mutex
+		received []int
+	)
+	_, fetched, err := hub.(pubsub.FetchingSubscriber).SubscribeAndFetch(first, func(topic pubsub.Topic, data interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data.(int))
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(fetched, gc.HasLen, 1)
+
+	<-published
+	select {
+	case <-last.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	// Every message after the fetched one is received exactly once.
+	expected := []int{}
+	for i := fetched[0].Data.(int) + 1; i < count; i++ {
+		expected = append(expected, i)
+	}
+	if received == nil {
+		received = []int{}
+	}
+	c.Assert(received, jc.DeepEquals, expected)
+}
+
+func (s *RetentionSuite) TestSubscribeAndFetchStructured(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{Retain: 1},
+	})
+	_, err := hub.Publish(first, map[string]interface{}{"value": "retained"})
+	c.Assert(err, jc.ErrorIsNil)
+	_, fetched, err := hub.(pubsub.FetchingSubscriber).SubscribeAndFetch(first, func(topic pubsub.Topic, data map[string]interface{}, err error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(fetched, gc.HasLen, 1)
+	c.Assert(fetched[0].Data, jc.DeepEquals, map[string]interface{}{"value": "retained"})
+
+	_, _, err = hub.(pubsub.FetchingSubscriber).SubscribeAndFetch(first, func(topic pubsub.Topic, data interface{}) {})
+	c.Assert(err, gc.ErrorMatches, "expected 3 args, got 2, incorrect handler signature not valid")
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DeadLetterTopic is the topic that messages are published on when a
+// subscription with a RetryPolicy has run out of attempts, unless the
+// policy gives a different topic.
+const DeadLetterTopic Topic = "pubsub.dead-letter"
+
+// DeadLetter is the message published when a subscription gives up on a
+// message.
+type DeadLetter struct {
+	// Topic and Data are the topic and data of the original message. For
+	// structured hubs the data is in its map form.
+	Topic Topic       `json:"topic"`
+	Data  interface{} `json:"data"`
+
+	// Subscriber and SubscriberName identify the subscription, as they do
+	// in a HubError.
+	Subscriber     int    `json:"subscriber"`
+	SubscriberName string `json:"subscriber-name,omitempty"`
+
+	// Attempts is the number of times the handler was called, and Error is
+	// the error it returned the last time.
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// RetryPolicy defines how the messages are retried when the handler of a
+// subscription returns an error. See the Retry subscribe option.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times the handler is called for a
+	// message before the message is sent to the dead letter topic.
+	MaxAttempts int
+
+	// InitialDelay is how long to wait before the first retry. Each retry
+	// after that waits Multiplier times longer than the one before, up to
+	// MaxDelay if it is set.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+
+	// Multiplier defaults to 2 if it is not set.
+	Multiplier float64
+
+	// Jitter is the fraction, between zero and one, by which each delay is
+	// randomly increased or decreased, so that the retries of subscribers
+	// that failed at the same time are spread out.
+	Jitter float64
+
+	// DeadLetterTopic is the topic the messages are published on once the
+	// attempts are used up. If it is not set, DeadLetterTopic is used.
+	DeadLetterTopic Topic
+}
+
+// Validate checks that the policy values are valid.
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.NotValidf("MaxAttempts %d", p.MaxAttempts)
+	}
+	if p.InitialDelay < 0 {
+		return errors.NotValidf("negative InitialDelay")
+	}
+	if p.MaxDelay < 0 {
+		return errors.NotValidf("negative MaxDelay")
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return errors.NotValidf("Multiplier %v", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.NotValidf("Jitter %v", p.Jitter)
+	}
+	return nil
+}
+
+// Retry is a subscribe option that retries the messages that the handler
+// returns an error for. Rather than blocking the subscription, the message
+// is queued again for the subscription once the retry delay has passed, so
+// other messages may be handled before it. Once the handler has returned
+// an error MaxAttempts times, a DeadLetter is published on the hub. The
+// Completer of the message only completes once it has been handled or sent
+// to the dead letter topic.
+//
+// Handlers return errors by having an error result. Subscriptions without
+// a retry policy report the errors to the hub's ErrorHandler, and move on.
+// Retry can't be combined with Durable.
+func Retry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+// delay returns how long to wait before the next retry of a message that
+// has already been retried the given number of times.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(retry))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// handlerFailed reports the error returned by the handler, and arranges for
+// the message to be retried or sent to the dead letter topic if the
+// subscription has a retry policy.
+func (s *subscriber) handlerFailed(call *handlerCallback, err error) {
+	s.reportError(&HubError{
+		Phase:          PhaseHandler,
+		Topic:          call.topic,
+		Subscriber:     s.id,
+		SubscriberName: s.name,
+		Err:            err,
+	})
+	if s.retry == nil {
+		return
+	}
+	if call.retry+1 < s.retry.MaxAttempts {
+		next := call.handOff()
+		// If the subscriber is closed in the meantime, notify marks the
+		// message done.
+		time.AfterFunc(s.retry.delay(call.retry), func() {
+			s.notify(next)
+		})
+		return
+	}
+	topic := s.retry.DeadLetterTopic
+	if topic == "" {
+		topic = DeadLetterTopic
+	}
+	ctx := WithOrderingKey(context.Background(), call.key)
+	if call.headers != nil {
+		ctx = WithHeaders(ctx, call.headers)
+	}
+	data := call.data
+	if call.pooled {
+		// The map is reused once the call is done, which may be before
+		// the dead letter has been serialized.
+		data = copyValue(data)
+	}
+	_, publishErr := s.publish(ctx, topic, DeadLetter{
+		Topic:          call.topic,
+		Data:           data,
+		Subscriber:     s.id,
+		SubscriberName: s.name,
+		Attempts:       call.retry + 1,
+		Error:          err.Error(),
+	})
+	if publishErr != nil {
+		s.reportError(&HubError{
+			Phase:          PhaseHandler,
+			Topic:          call.topic,
+			Subscriber:     s.id,
+			SubscriberName: s.name,
+			Err:            errors.Annotate(publishErr, "publishing dead letter"),
+		})
+	}
+}
+
+// handOff returns a copy of the call for the next attempt at the message.
+// The copy takes over marking the message done.
+func (h *handlerCallback) handOff() *handlerCallback {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	next := &handlerCallback{
+		topic:    h.topic,
+		data:     h.data,
+		sequence: h.sequence,
+		key:      h.key,
+		headers:  h.headers,
+		wg:       h.wg,
+		local:    h.local,
+		retry:    h.retry + 1,
+		queued:   time.Now(),
+		size:     h.size,
+		cancel:   h.cancel,
+		handle:   h.handle,
+		merged:   h.merged,
+		pooled:   h.pooled,
+	}
+	h.wg = nil
+	h.local = nil
+	h.merged = nil
+	return next
+}
@@ -0,0 +1,248 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type RetrySuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&RetrySuite{})
+
+// failingHandler returns an error for the first failures calls, recording
+// the retry count of each call.
+type failingHandler struct {
+	mutex    sync.Mutex
+	failures int
+	retries  []int
+}
+
+func (f *failingHandler) handle(ctx context.Context, topic pubsub.Topic, data interface{}) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delivery, _ := pubsub.DeliveryFromContext(ctx)
+	f.retries = append(f.retries, delivery.Retry)
+	if len(f.retries) <= f.failures {
+		return errors.Errorf("failure %d", len(f.retries))
+	}
+	return nil
+}
+
+func (f *failingHandler) get() []int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]int(nil), f.retries...)
+}
+
+func (*RetrySuite) TestValidate(c *gc.C) {
+	for _, test := range []struct {
+		policy pubsub.RetryPolicy
+		err    string
+	}{{
+		policy: pubsub.RetryPolicy{},
+		err:    "MaxAttempts 0 not valid",
+	}, {
+		policy: pubsub.RetryPolicy{MaxAttempts: 1, InitialDelay: -1},
+		err:    "negative InitialDelay not valid",
+	}, {
+		policy: pubsub.RetryPolicy{MaxAttempts: 1, MaxDelay: -1},
+		err:    "negative MaxDelay not valid",
+	}, {
+		policy: pubsub.RetryPolicy{MaxAttempts: 1, Multiplier: 0.5},
+		err:    "Multiplier 0.5 not valid",
+	}, {
+		policy: pubsub.RetryPolicy{MaxAttempts: 1, Jitter: 2},
+		err:    "Jitter 2 not valid",
+	}} {
+		c.Check(test.policy.Validate(), gc.ErrorMatches, test.err)
+		hub := pubsub.NewSimpleHub()
+		_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {}, pubsub.Retry(test.policy))
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (*RetrySuite) TestErrorsReported(c *gc.C) {
+	collector := &errorCollector{}
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ErrorHandler: collector.handle})
+	handler := &failingHandler{failures: 1}
+	_, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+
+	// Without a retry policy the message isn't retried.
+	c.Check(handler.get(), jc.DeepEquals, []int{0})
+	reported := collector.get()
+	c.Assert(reported, gc.HasLen, 1)
+	c.Check(reported[0].Phase, gc.Equals, pubsub.PhaseHandler)
+	c.Check(reported[0], gc.ErrorMatches, `handler "testing" for subscriber 0: failure 1`)
+}
+
+func (*RetrySuite) TestRetrySucceeds(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := &failingHandler{failures: 2}
+	_, err := hub.Subscribe(topic, handler.handle, pubsub.Retry(pubsub.RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: veryShortTime,
+		Jitter:       0.5,
+	}))
+	c.Assert(err, jc.ErrorIsNil)
+	deadLetters := make(chan interface{}, 1)
+	_, err = hub.Subscribe(pubsub.DeadLetterTopic, func(topic pubsub.Topic, data interface{}) {
+		deadLetters <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	result, err := hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	c.Check(handler.get(), jc.DeepEquals, []int{0, 1, 2})
+	select {
+	case letter := <-deadLetters:
+		c.Fatalf("unexpected dead letter %v", letter)
+	case <-time.After(10 * veryShortTime):
+	}
+}
+
+func (*RetrySuite) TestRetryDoesNotBlock(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var (
+		mutex    sync.Mutex
+		received []interface{}
+	)
+	failed := false
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data)
+		if data == "first" && !failed {
+			failed = true
+			return errors.New("boom")
+		}
+		return nil
+	}, pubsub.Retry(pubsub.RetryPolicy{MaxAttempts: 2, InitialDelay: 10 * veryShortTime}))
+	c.Assert(err, jc.ErrorIsNil)
+
+	first, err := hub.Publish(topic, "first")
+	c.Assert(err, jc.ErrorIsNil)
+	second, err := hub.Publish(topic, "second")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, first)
+	waitComplete(c, second)
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.Check(received, jc.DeepEquals, []interface{}{"first", "second", "first"})
+}
+
+func (*RetrySuite) TestDeadLetter(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	attempts := 0
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data Emitter, err error) error {
+		attempts++
+		return errors.Errorf("attempt %d failed", attempts)
+	}, pubsub.Named("emitter"), pubsub.Retry(pubsub.RetryPolicy{
+		MaxAttempts:     2,
+		InitialDelay:    veryShortTime,
+		DeadLetterTopic: "failed",
+	}))
+	c.Assert(err, jc.ErrorIsNil)
+	deadLetters := make(chan pubsub.DeadLetter, 1)
+	_, err = hub.Subscribe(pubsub.Topic("failed"), func(topic pubsub.Topic, data pubsub.DeadLetter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		deadLetters <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	result, err := hub.Publish(topic, Emitter{Origin: "test", ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	select {
+	case letter := <-deadLetters:
+		c.Check(letter, jc.DeepEquals, pubsub.DeadLetter{
+			Topic: topic,
+			Data: map[string]interface{}{
+				"origin":  "test",
+				"message": "",
+				"id":      float64(42),
+			},
+			Subscriber:     0,
+			SubscriberName: "emitter",
+			Attempts:       2,
+			Error:          "attempt 2 failed",
+		})
+	case <-time.After(time.Second):
+		c.Fatal("no dead letter")
+	}
+}
+
+func (*RetrySuite) TestDeadLetterPooled(c *gc.C) {
+	// The map of each message goes back to the pool as soon as the
+	// message is done, and the dead letters are serialized afterwards.
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		PoolMaps:         true,
+		SerializeWorkers: 4,
+	})
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data Emitter, err error) error {
+		return errors.New("failed")
+	}, pubsub.Retry(pubsub.RetryPolicy{MaxAttempts: 1}))
+	c.Assert(err, jc.ErrorIsNil)
+	deadLetters := make(chan pubsub.DeadLetter, 20)
+	_, err = hub.Subscribe(pubsub.DeadLetterTopic, func(topic pubsub.Topic, data pubsub.DeadLetter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		deadLetters <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i := 0; i < 20; i++ {
+		result, err := hub.Publish(topic, Emitter{Origin: "test", ID: i})
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, result)
+	}
+	ids := make(map[float64]bool)
+	for i := 0; i < 20; i++ {
+		select {
+		case letter := <-deadLetters:
+			data, ok := letter.Data.(map[string]interface{})
+			c.Assert(ok, jc.IsTrue, gc.Commentf("data %#v", letter.Data))
+			c.Check(data["origin"], gc.Equals, "test")
+			id, _ := data["id"].(float64)
+			ids[id] = true
+		case <-time.After(time.Second):
+			c.Fatal("no dead letter")
+		}
+	}
+	c.Check(ids, gc.HasLen, 20)
+}
+
+func (*RetrySuite) TestUnsubscribeWhileWaiting(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := &failingHandler{failures: 1}
+	sub, err := hub.Subscribe(topic, handler.handle, pubsub.Retry(pubsub.RetryPolicy{
+		MaxAttempts:  2,
+		InitialDelay: 10 * veryShortTime,
+	}))
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	// Wait for the first attempt.
+	for a := 0; a < 100 && len(handler.get()) == 0; a++ {
+		time.Sleep(veryShortTime)
+	}
+	sub.Unsubscribe()
+	waitComplete(c, result)
+	c.Check(handler.get(), jc.DeepEquals, []int{0})
+}
@@ -0,0 +1,302 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// SchemaVersionHeader is the header that holds the schema version of the
+// data of a message. See WithSchemaVersion.
+const SchemaVersionHeader = "pubsub-schema-version"
+
+// Migration converts the map form of the data of a message from one schema
+// version to another. The map passed in may be shared with the subscribers
+// of the message, so a migration must return a new map rather than change
+// the one it is given.
+type Migration func(data map[string]interface{}) (map[string]interface{}, error)
+
+// Schemas records the schema versions that the publishers and subscribers
+// of a hub use for each topic, along with the migrations between the
+// versions. Bridges use the schemas of the hubs on both sides to agree on
+// the version each topic is forwarded in, so fleets of processes using
+// different versions can interoperate during a rolling upgrade. See
+// BridgeConfig.
+type Schemas struct {
+	mutex  sync.Mutex
+	topics map[Topic]*topicSchema
+}
+
+type topicSchema struct {
+	current    int
+	supported  map[int]bool
+	migrations map[int]map[int]Migration
+}
+
+// NewSchemas returns an empty set of schemas.
+func NewSchemas() *Schemas {
+	return &Schemas{topics: make(map[Topic]*topicSchema)}
+}
+
+// Register records the versions of the topic's schema. Publishers on the
+// hub use the current version, and its subscribers can handle the
+// supported versions. The current version is always supported.
+func (s *Schemas) Register(topic Topic, current int, supported ...int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.topics[topic]; exists {
+		return errors.AlreadyExistsf("schema for topic %q", topic)
+	}
+	schema := &topicSchema{
+		current:    current,
+		supported:  map[int]bool{current: true},
+		migrations: make(map[int]map[int]Migration),
+	}
+	for _, version := range supported {
+		schema.supported[version] = true
+	}
+	s.topics[topic] = schema
+	return nil
+}
+
+// AddMigration adds the migration of the topic's data from one version to
+// another. Migrations can upgrade or downgrade the data, and are chained
+// to convert between versions more than one step apart. The topic must
+// have been registered.
+func (s *Schemas) AddMigration(topic Topic, from, to int, migration Migration) error {
+	if migration == nil {
+		return errors.NotValidf("nil migration")
+	}
+	if from == to {
+		return errors.NotValidf("migration from version %d to itself", from)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schema, ok := s.topics[topic]
+	if !ok {
+		return errors.NotFoundf("schema for topic %q", topic)
+	}
+	if schema.migrations[from] == nil {
+		schema.migrations[from] = make(map[int]Migration)
+	}
+	if _, exists := schema.migrations[from][to]; exists {
+		return errors.AlreadyExistsf("migration of %q from version %d to %d", topic, from, to)
+	}
+	schema.migrations[from][to] = migration
+	return nil
+}
+
+// Versions returns the current version of the topic's schema, and the
+// supported versions in ascending order. The bool result is false if the
+// topic has not been registered.
+func (s *Schemas) Versions(topic Topic) (int, []int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schema, ok := s.topics[topic]
+	if !ok {
+		return 0, nil, false
+	}
+	supported := make([]int, 0, len(schema.supported))
+	for version := range schema.supported {
+		supported = append(supported, version)
+	}
+	sort.Ints(supported)
+	return schema.current, supported, true
+}
+
+// WithSchemaVersion returns a context that, when passed to PublishCtx,
+// marks the published data as having the schema version. The version is
+// added to any headers already attached to the context.
+func WithSchemaVersion(ctx context.Context, version int) context.Context {
+	headers := make(Headers)
+	for key, value := range headersFromPublishContext(ctx) {
+		headers[key] = value
+	}
+	headers[SchemaVersionHeader] = strconv.Itoa(version)
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// SchemaVersionFromContext returns the schema version of the message being
+// handled. The bool result is false if the message was not published with
+// a version.
+func SchemaVersionFromContext(ctx context.Context) (int, bool) {
+	return schemaVersion(HeadersFromContext(ctx))
+}
+
+func schemaVersion(headers Headers) (int, bool) {
+	value, ok := headers[SchemaVersionHeader]
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// topicMigrations is the migration graph of a topic, made from the
+// migrations registered on both sides of a bridge.
+type topicMigrations map[int]map[int]Migration
+
+func (s *Schemas) addMigrations(topic Topic, graph topicMigrations) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schema, ok := s.topics[topic]
+	if !ok {
+		return
+	}
+	for from, targets := range schema.migrations {
+		if graph[from] == nil {
+			graph[from] = make(map[int]Migration)
+		}
+		for to, migration := range targets {
+			if _, exists := graph[from][to]; !exists {
+				graph[from][to] = migration
+			}
+		}
+	}
+}
+
+// path returns the shortest chain of migrations from one version to
+// another. The bool result is false if there is no such chain.
+func (g topicMigrations) path(from, to int) ([]Migration, bool) {
+	if from == to {
+		return nil, true
+	}
+	type step struct {
+		version   int
+		migration Migration
+	}
+	previous := map[int]step{from: {}}
+	queue := []int{from}
+	for len(queue) > 0 {
+		version := queue[0]
+		queue = queue[1:]
+		// The next versions are sorted so the chosen path doesn't depend
+		// on the map order.
+		next := make([]int, 0, len(g[version]))
+		for target := range g[version] {
+			next = append(next, target)
+		}
+		sort.Ints(next)
+		for _, target := range next {
+			if _, seen := previous[target]; seen {
+				continue
+			}
+			previous[target] = step{version: version, migration: g[version][target]}
+			if target == to {
+				var result []Migration
+				for v := to; v != from; v = previous[v].version {
+					result = append([]Migration{previous[v].migration}, result...)
+				}
+				return result, true
+			}
+			queue = append(queue, target)
+		}
+	}
+	return nil, false
+}
+
+// negotiatedTopic holds the version that a bridge forwards a topic in.
+type negotiatedTopic struct {
+	version    int
+	source     int
+	migrations topicMigrations
+}
+
+// negotiateSchemas works out the version that each topic registered on
+// both sides of a bridge is forwarded in. The target's current version is
+// used if the source's current version can be migrated to it, otherwise
+// the highest version supported by the target that can be reached.
+func negotiateSchemas(source, target *Schemas) (map[Topic]*negotiatedTopic, error) {
+	result := make(map[Topic]*negotiatedTopic)
+	if source == nil || target == nil {
+		return result, nil
+	}
+	source.mutex.Lock()
+	topics := make([]Topic, 0, len(source.topics))
+	for topic := range source.topics {
+		topics = append(topics, topic)
+	}
+	source.mutex.Unlock()
+
+	for _, topic := range topics {
+		sourceCurrent, _, _ := source.Versions(topic)
+		targetCurrent, targetSupported, ok := target.Versions(topic)
+		if !ok {
+			continue
+		}
+		graph := make(topicMigrations)
+		source.addMigrations(topic, graph)
+		target.addMigrations(topic, graph)
+		candidates := append([]int{targetCurrent}, reversed(targetSupported)...)
+		found := false
+		for _, version := range candidates {
+			if _, ok := graph.path(sourceCurrent, version); ok {
+				result[topic] = &negotiatedTopic{
+					version:    version,
+					source:     sourceCurrent,
+					migrations: graph,
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("no schema version of topic %q can be migrated from version %d to one of %v",
+				topic, sourceCurrent, targetSupported)
+		}
+	}
+	return result, nil
+}
+
+func reversed(versions []int) []int {
+	result := make([]int, len(versions))
+	for i, version := range versions {
+		result[len(versions)-1-i] = version
+	}
+	return result
+}
+
+// convert migrates the data of a message to the negotiated version, and
+// returns the data with the headers to forward it with. Messages without a
+// version are taken to be in the source's current version.
+func (n *negotiatedTopic) convert(data interface{}, headers Headers) (interface{}, Headers, error) {
+	version, ok := schemaVersion(headers)
+	if !ok {
+		version = n.source
+	}
+	forwarded := make(Headers, len(headers)+1)
+	for key, value := range headers {
+		forwarded[key] = value
+	}
+	forwarded[SchemaVersionHeader] = strconv.Itoa(n.version)
+	if version == n.version {
+		return data, forwarded, nil
+	}
+	migrations, ok := n.migrations.path(version, n.version)
+	if !ok {
+		return nil, nil, errors.Errorf("no migration from version %d to %d", version, n.version)
+	}
+	asMap, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.Errorf("migrating data of type %T, expected map[string]interface{}", data)
+	}
+	for _, migration := range migrations {
+		var err error
+		if asMap, err = migration(asMap); err != nil {
+			return nil, nil, errors.Annotatef(err, "migrating to version %d", n.version)
+		}
+	}
+	return asMap, forwarded, nil
+}
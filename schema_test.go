@@ -0,0 +1,188 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type SchemaSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&SchemaSuite{})
+
+// renameField returns a migration that renames a field of the data.
+func renameField(from, to string) pubsub.Migration {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		result := make(map[string]interface{}, len(data))
+		for key, value := range data {
+			if key == from {
+				key = to
+			}
+			result[key] = value
+		}
+		return result, nil
+	}
+}
+
+func (*SchemaSuite) TestRegister(c *gc.C) {
+	schemas := pubsub.NewSchemas()
+	err := schemas.Register(first, 2, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	err = schemas.Register(first, 3)
+	c.Check(err, jc.Satisfies, errors.IsAlreadyExists)
+
+	current, supported, ok := schemas.Versions(first)
+	c.Check(ok, jc.IsTrue)
+	c.Check(current, gc.Equals, 2)
+	c.Check(supported, jc.DeepEquals, []int{1, 2})
+	_, _, ok = schemas.Versions(second)
+	c.Check(ok, jc.IsFalse)
+}
+
+func (*SchemaSuite) TestAddMigration(c *gc.C) {
+	schemas := pubsub.NewSchemas()
+	err := schemas.AddMigration(first, 1, 2, renameField("a", "b"))
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+	err = schemas.Register(first, 2, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	err = schemas.AddMigration(first, 1, 2, nil)
+	c.Check(err, gc.ErrorMatches, "nil migration not valid")
+	err = schemas.AddMigration(first, 1, 1, renameField("a", "b"))
+	c.Check(err, gc.ErrorMatches, "migration from version 1 to itself not valid")
+	err = schemas.AddMigration(first, 1, 2, renameField("a", "b"))
+	c.Check(err, jc.ErrorIsNil)
+	err = schemas.AddMigration(first, 1, 2, renameField("a", "b"))
+	c.Check(err, jc.Satisfies, errors.IsAlreadyExists)
+}
+
+func (*SchemaSuite) TestSchemaVersionContext(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	versions := make(chan int, 1)
+	headers := make(chan pubsub.Headers, 1)
+	_, err := hub.Subscribe(first, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		version, _ := pubsub.SchemaVersionFromContext(ctx)
+		versions <- version
+		headers <- pubsub.HeadersFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{"trace": "abc"})
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(pubsub.WithSchemaVersion(ctx, 3), first, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(<-versions, gc.Equals, 3)
+	c.Check(<-headers, jc.DeepEquals, pubsub.Headers{
+		"trace":                    "abc",
+		pubsub.SchemaVersionHeader: "3",
+	})
+}
+
+// newVersionedBridge bridges two structured hubs where the source uses
+// version 1 of the first topic, and the target uses version 2.
+func newVersionedBridge(c *gc.C) (pubsub.StructuredHub, pubsub.StructuredHub, pubsub.Bridge) {
+	source := pubsub.NewStructuredHub(nil)
+	target := pubsub.NewStructuredHub(nil)
+	sourceSchemas := pubsub.NewSchemas()
+	c.Assert(sourceSchemas.Register(first, 1), jc.ErrorIsNil)
+	c.Assert(sourceSchemas.Register(second, 1), jc.ErrorIsNil)
+	targetSchemas := pubsub.NewSchemas()
+	c.Assert(targetSchemas.Register(first, 2), jc.ErrorIsNil)
+	c.Assert(targetSchemas.AddMigration(first, 1, 2, renameField("origin", "source")), jc.ErrorIsNil)
+	c.Assert(targetSchemas.AddMigration(first, 2, 1, renameField("source", "origin")), jc.ErrorIsNil)
+
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Name:          "test",
+		Source:        source,
+		Target:        target,
+		Rules:         []pubsub.BridgeRule{{Name: "all", Matcher: pubsub.MatchAll}},
+		SourceSchemas: sourceSchemas,
+		TargetSchemas: targetSchemas,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return source, target, bridge
+}
+
+func (*SchemaSuite) TestBridgeMigrates(c *gc.C) {
+	source, target, bridge := newVersionedBridge(c)
+	defer bridge.Unsubscribe()
+	c.Check(bridge.SchemaVersions(), jc.DeepEquals, map[pubsub.Topic]int{first: 2})
+
+	received, closer, err := target.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	// Messages without a version are in the source's current version.
+	_, err = source.Publish(first, JustOrigin{"one"})
+	c.Assert(err, jc.ErrorIsNil)
+	message := receive(c, received)
+	c.Check(message.Topic, gc.Equals, first)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"source": "one"})
+	c.Check(message.Delivery.Headers[pubsub.SchemaVersionHeader], gc.Equals, "2")
+
+	// Messages already in the negotiated version are not migrated.
+	ctx := pubsub.WithSchemaVersion(context.Background(), 2)
+	_, err = source.(pubsub.ContextPublisher).PublishCtx(ctx, first, map[string]interface{}{"source": "two"})
+	c.Assert(err, jc.ErrorIsNil)
+	message = receive(c, received)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"source": "two"})
+
+	// Messages that can't be migrated are dropped.
+	ctx = pubsub.WithSchemaVersion(context.Background(), 7)
+	_, err = source.(pubsub.ContextPublisher).PublishCtx(ctx, first, JustOrigin{"three"})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Topics registered on only one side are forwarded unchanged.
+	_, err = source.Publish(second, JustOrigin{"four"})
+	c.Assert(err, jc.ErrorIsNil)
+	message = receive(c, received)
+	c.Check(message.Topic, gc.Equals, second)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"origin": "four"})
+	_, versioned := message.Delivery.Headers[pubsub.SchemaVersionHeader]
+	c.Check(versioned, jc.IsFalse)
+}
+
+func (*SchemaSuite) TestNegotiationFails(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	sourceSchemas := pubsub.NewSchemas()
+	c.Assert(sourceSchemas.Register(first, 1), jc.ErrorIsNil)
+	targetSchemas := pubsub.NewSchemas()
+	c.Assert(targetSchemas.Register(first, 3, 2), jc.ErrorIsNil)
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Source:        source,
+		Target:        pubsub.NewSimpleHub(),
+		SourceSchemas: sourceSchemas,
+		TargetSchemas: targetSchemas,
+	})
+	c.Check(err, gc.ErrorMatches, `negotiating schemas: no schema version of topic "first" can be migrated from version 1 to one of \[2 3\]`)
+	c.Check(bridge, gc.IsNil)
+}
+
+func (*SchemaSuite) TestNegotiationChainsMigrations(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	sourceSchemas := pubsub.NewSchemas()
+	c.Assert(sourceSchemas.Register(first, 1), jc.ErrorIsNil)
+	c.Assert(sourceSchemas.AddMigration(first, 1, 2, renameField("a", "b")), jc.ErrorIsNil)
+	targetSchemas := pubsub.NewSchemas()
+	// The target's current version can't be reached, so the highest
+	// reachable supported version is used.
+	c.Assert(targetSchemas.Register(first, 4, 3, 2), jc.ErrorIsNil)
+	c.Assert(targetSchemas.AddMigration(first, 2, 3, renameField("b", "c")), jc.ErrorIsNil)
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Source:        source,
+		Target:        pubsub.NewSimpleHub(),
+		SourceSchemas: sourceSchemas,
+		TargetSchemas: targetSchemas,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+	c.Check(bridge.SchemaVersions(), jc.DeepEquals, map[pubsub.Topic]int{first: 3})
+}
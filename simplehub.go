@@ -4,7 +4,10 @@
 package pubsub
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/juju/loggo"
@@ -19,22 +22,341 @@ import (
 //
 // All handler functions passed into Subscribe methods of a SimpleHub should
 // be `func(Topic, interface{})`. The topic of the published method is the first
-// parameter, and the published data is the seconnd parameter.
+// parameter, and the published data is the seconnd parameter. Handlers may
+// also take a context.Context as an additional first parameter, from which
+// the Delivery information can be retrieved with DeliveryFromContext.
 func NewSimpleHub() Hub {
-	return &simplehub{
+	return NewSimpleHubWithConfig(nil)
+}
+
+// SimpleHubConfig is the argument struct for NewSimpleHubWithConfig. It is
+// also embedded in the StructuredHubConfig as the structured hub is built on
+// top of the simple hub.
+type SimpleHubConfig struct {
+	// MaxInFlight limits the number of handler functions that can be
+	// running at any one time across all the subscribers of the hub. When
+	// the limit is reached, subscribers wait for a running handler to
+	// finish before calling their handler. Subscribers still get their
+	// messages in order. Zero means no limit.
+	//
+	// Note that with a limit, a handler that waits on the Completer of a
+	// message it published may deadlock the hub, as the handlers of that
+	// message may be waiting for the slot held by the waiting handler.
+	MaxInFlight int
+
+	// QueueSize, if positive, bounds the queue of each subscriber that
+	// isn't given a queue of its own with WithQueue, or made durable. Once
+	// a queue is full, each message queued evicts the oldest, as with
+	// NewRingQueue, and the evicted message is counted as dropped.
+	QueueSize int
+
+	// MaxSubscribers, if positive, is the most subscribers the hub can
+	// have at once, and MaxSubscribersPerPattern is the most with the same
+	// matcher, as described in the hub Report. Subscribing beyond either
+	// fails with a *SubscriberLimitError, so subscriptions that leak, such
+	// as those of plugins that are reloaded without unsubscribing, are
+	// caught before they exhaust the process. Zero means no limit.
+	MaxSubscribers           int
+	MaxSubscribersPerPattern int
+
+	// Retain is the number of the most recent messages that the hub keeps
+	// for each topic, so they can be delivered to subscriptions created
+	// later using the DeliverLastRetained or DeliverAllRetained subscribe
+	// options. Zero means that messages are not retained. Note that the
+	// messages of every topic ever published are retained, so retention
+	// is only suitable for hubs with a bounded set of topics.
+	Retain int
+
+	// ErrorHandler, if set, is called with every error that occurs inside
+	// the hub, wrapped in a *HubError describing where it occurred. This
+	// includes errors that are also returned from Publish or passed to
+	// handlers. It may be called concurrently from the publishing and
+	// subscriber goroutines, so it must be safe for concurrent use and
+	// should not block. If it is not set the errors are logged at debug
+	// level.
+	ErrorHandler func(*HubError)
+
+	// Metrics, if set, is told about the messages that each subscriber
+	// handles or drops, along with the labels of the subscription.
+	Metrics Metrics
+
+	// SoftQuotas, if set, are checked as messages are queued and handled,
+	// and as subscribers come and go. An alert is published on
+	// QuotaAlertTopic each time a quota is exceeded or recovers.
+	SoftQuotas *SoftQuotas
+
+	// Codecs are the marshallers for each content type, used to convert
+	// the encoded data of messages for subscriptions that only accept some
+	// content types. See AcceptContentTypes.
+	Codecs map[string]Marshaller
+
+	// ErrorBudget, if set, configures the window over which the errors of
+	// each subscriber are counted for the hub Report, and quarantines
+	// subscribers that have too many. Without it, the errors of the last
+	// minute are counted, and subscribers are never quarantined.
+	ErrorBudget *ErrorBudget
+
+	// ID identifies the hub in the PeerOriginHeader of the messages that
+	// transports such as bridges forward from it. If it is not set, the
+	// hub is given a random ID.
+	ID string
+
+	// TopicCacheSize is the number of distinct topics whose matching
+	// subscribers are remembered, so publishing on the same topics again
+	// doesn't match them against every subscriber. The cache is emptied
+	// as subscribers come and go. It defaults to DefaultTopicCacheSize,
+	// and a negative size disables the cache.
+	TopicCacheSize int
+
+	// RecentTopics is the number of distinct published topics that are
+	// remembered, so DryRunPattern can check new patterns against them.
+	// It defaults to DefaultRecentTopics, and a negative number disables
+	// remembering them.
+	RecentTopics int
+
+	// Coalesce are the rules for the topics whose identical messages are
+	// collapsed into one delivery while they wait for a subscriber. The
+	// first rule that matches the topic of a message is used. Rules that
+	// are not valid are ignored, and the error is logged.
+	Coalesce []CoalesceRule
+
+	// DetectMutations, if true, enforces the rule that subscribers must not
+	// modify the data of the messages they are given, which is shared
+	// between them. The data of each message is checksummed as it is
+	// published, and checked again once all the subscribers have finished
+	// with it. If it has changed, a *MutationError is reported to the
+	// ErrorHandler and passed to OnMutation, or the hub panics if
+	// OnMutation is not set, so tests that break the rule fail loudly.
+	// Everything reachable from the data is walked twice for each
+	// message, so it is meant for tests and debug builds.
+	DetectMutations bool
+
+	// OnMutation, if set, is called with the messages that DetectMutations
+	// finds were modified, instead of the hub panicking.
+	OnMutation func(*MutationError)
+
+	// DeliveryReceipts, if set, matches the topics of the messages that
+	// the hub publishes a DeliveryReceipt for on DeliveryReceiptTopic,
+	// each time a subscriber handles or drops one. The messages on the
+	// matching topics are given a MessageIDHeader if they don't have one.
+	DeliveryReceipts TopicMatcher
+
+	// Providers, if set, provide the values for the extra arguments of
+	// handlers. See Providers.
+	Providers *Providers
+
+	// TrackMatchCost, if true, times each match of a published topic
+	// against the matchers of the subscribers, so that patterns that slow
+	// down every publish can be found. The time spent on each pattern is
+	// shown in the "match-costs" of the hub Report, most expensive first.
+	// Topics found in the topic cache aren't matched again, so only the
+	// first publish on each topic is timed for patterns that are cached.
+	TrackMatchCost bool
+
+	// SlowMatch, if set, is the time a single match can take before a
+	// warning is logged, once for each subscriber, and the match is
+	// counted as slow in the hub Report. Setting it also tracks the cost
+	// of matching.
+	SlowMatch time.Duration
+}
+
+// NewSimpleHubWithConfig returns a new Hub instance configured with the
+// config values. A nil config is the same as calling NewSimpleHub.
+func NewSimpleHubWithConfig(config *SimpleHubConfig) Hub {
+	hub := &simplehub{
 		logger: loggo.GetLogger("pubsub.simple"),
 	}
+	hub.publish = hub.PublishCtx
+	hub.configure(config)
+	return hub
 }
 
+// The hubs of this package implement all the optional interfaces, as the
+// structured hub embeds the simple hub.
+var (
+	_ Reporter           = (*simplehub)(nil)
+	_ ContextPublisher   = (*simplehub)(nil)
+	_ LocalPublisher     = (*simplehub)(nil)
+	_ Barrierer          = (*simplehub)(nil)
+	_ Requeuer           = (*simplehub)(nil)
+	_ MultiSubscriber    = (*simplehub)(nil)
+	_ FetchingSubscriber = (*simplehub)(nil)
+	_ Resubscriber       = (*simplehub)(nil)
+	_ ChanSubscriber     = (*simplehub)(nil)
+	_ Explainer          = (*simplehub)(nil)
+	_ PatternDryRunner   = (*simplehub)(nil)
+	_ InFlightReporter   = (*simplehub)(nil)
+	_ SyncTapper         = (*simplehub)(nil)
+	_ TopicPinner        = (*simplehub)(nil)
+)
+
 type simplehub struct {
-	mutex       sync.Mutex
+	// sequence is first so it is aligned for atomic access on 32 bit
+	// platforms.
+	sequence uint64
+
+	mutex sync.Mutex
+	idx   int
+
+	// subscribers is only changed while the mutex is held, and is never
+	// modified in place. Each new slice is also stored in snapshot so
+	// Publish can read it without taking the mutex.
+	subscribers []*subscriber
+	snapshot    atomic.Value
+
+	// taps are the taps added with TapSync. Like the subscribers, they
+	// are replaced rather than modified, and stored in the snapshot.
+	taps []*tap
+
+	// pins are the patterns added with PinTopic, and absent holds the
+	// named durable subscribers that have unsubscribed, by name, which
+	// the messages on pinned topics are kept for.
+	pins   []*pin
+	absent map[string]*absentDurable
+
+	logger loggo.Logger
+
+	// inFlight is a semaphore limiting the number of running handlers. It
+	// is nil when there is no limit.
+	inFlight chan struct{}
+
+	retainCount int
+	retained    map[Topic][]retainedMessage
+
+	// failover holds the subscribers of each failover group, with the
+	// primary first.
+	failover map[string][]*subscriber
+
+	// queueGroups holds the members of each queue group.
+	queueGroups map[string]*queueGroup
+
+	// flushing holds the subscribers that have been removed by
+	// UnsubscribeFlush, until they have handled their queued messages.
+	flushing map[int]*subscriber
+
+	id             string
+	queueSize      int
+	maxSubscribers int
+	maxPerPattern  int
+	topicCacheSize int
+	recent         *recentTopics
+	errorHandler   func(*HubError)
+	metrics        Metrics
+	quotas         *quotaTracker
+	codecs         map[string]Marshaller
+	errorBudget    *ErrorBudget
+	coalesceRules  []CoalesceRule
+
+	// detectMutations and onMutation are from the SimpleHubConfig.
+	detectMutations bool
+	onMutation      func(*MutationError)
+
+	// receipts is nil unless the hub publishes delivery receipts.
+	receipts *receiptSender
+
+	// providers is nil unless the hub injects handler arguments.
+	providers *Providers
+
+	// trackMatchCost and slowMatch are from the SimpleHubConfig.
+	trackMatchCost bool
+	slowMatch      time.Duration
+
+	// publish is the PublishCtx method of the hub that embeds the simple
+	// hub, which is used to publish the messages that come from the hub
+	// itself, such as dead letters.
+	publish func(ctx context.Context, topic Topic, data interface{}) (Completer, error)
+}
+
+func (h *simplehub) configure(config *SimpleHubConfig) {
+	if config == nil {
+		config = new(SimpleHubConfig)
+	}
+	if config.MaxInFlight > 0 {
+		h.inFlight = make(chan struct{}, config.MaxInFlight)
+	}
+	h.id = config.ID
+	if h.id == "" {
+		h.id = newHubID(h)
+	}
+	h.queueSize = config.QueueSize
+	h.maxSubscribers = config.MaxSubscribers
+	h.maxPerPattern = config.MaxSubscribersPerPattern
+	h.topicCacheSize = config.TopicCacheSize
+	h.recent = newRecentTopics(config.RecentTopics)
+	h.retainCount = config.Retain
+	h.errorHandler = config.ErrorHandler
+	h.metrics = config.Metrics
+	h.quotas = newQuotaTracker(config.SoftQuotas, h.publish)
+	h.errorBudget = config.ErrorBudget
+	for _, rule := range config.Coalesce {
+		if err := rule.Validate(); err != nil {
+			h.logger.Errorf("ignoring coalesce rule: %v", err)
+			continue
+		}
+		h.coalesceRules = append(h.coalesceRules, rule)
+	}
+	h.detectMutations = config.DetectMutations
+	h.receipts = newReceiptSender(config.DeliveryReceipts, h.id, h.publish)
+	h.onMutation = config.OnMutation
+	h.providers = config.Providers
+	h.trackMatchCost = config.TrackMatchCost || config.SlowMatch > 0
+	h.slowMatch = config.SlowMatch
+	h.codecs = make(map[string]Marshaller, len(config.Codecs))
+	for contentType, codec := range config.Codecs {
+		h.codecs[contentType] = codec
+	}
+	h.snapshot.Store(&subscriberSnapshot{
+		locked: h.retainCount > 0,
+		topics: newTopicCache(h.topicCacheSize),
+	})
+}
+
+// subscriberSnapshot is an immutable copy of the subscribers of a hub.
+type subscriberSnapshot struct {
 	subscribers []*subscriber
-	idx         int
-	logger      loggo.Logger
+
+	// locked is true if Publish must hold the hub mutex, because the hub
+	// retains messages, has failover or queue groups, or pins topics.
+	locked bool
+
+	// topics caches the subscribers that match the topics published
+	// while the snapshot is current.
+	topics *topicCache
+
+	// exact holds the positions of the subscribers to exactly one topic,
+	// by topic, wildcards those of the subscribers with wildcard
+	// patterns, and others the positions of the rest. See
+	// indexSubscribers.
+	exact     map[Topic][]int
+	wildcards wildcardIndex
+	others    []int
+
+	taps []*tap
+}
+
+// setSubscribers replaces the subscribers of the hub. The slice must not be
+// modified after it is set. The hub mutex must be held.
+func (h *simplehub) setSubscribers(subscribers []*subscriber) {
+	h.subscribers = subscribers
+	if h.quotas != nil {
+		h.quotas.subscribers(len(subscribers))
+	}
+	snapshot := &subscriberSnapshot{
+		subscribers: subscribers,
+		locked:      h.retainCount > 0 || len(h.failover) > 0 || len(h.queueGroups) > 0 || len(h.pins) > 0,
+		topics:      newTopicCache(h.topicCacheSize),
+		taps:        h.taps,
+	}
+	snapshot.indexSubscribers()
+	h.snapshot.Store(snapshot)
 }
 
 type doneHandle struct {
 	done chan struct{}
+
+	// dropped is the number of subscribers that dropped the message. It
+	// is accessed atomically.
+	dropped int32
 }
 
 // Complete implements Completer.
@@ -42,85 +364,405 @@ func (d *doneHandle) Complete() <-chan struct{} {
 	return d.done
 }
 
+// completed returns a Completer that is already complete.
+func completed() Completer {
+	done := make(chan struct{})
+	close(done)
+	return &doneHandle{done: done}
+}
+
 // Publish implements Hub.
 func (h *simplehub) Publish(topic Topic, data interface{}) (Completer, error) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	return h.PublishCtx(context.Background(), topic, data)
+}
+
+// PublishCtx implements ContextPublisher.
+func (h *simplehub) PublishCtx(ctx context.Context, topic Topic, data interface{}) (Completer, error) {
+	key := orderingKeyFromContext(ctx)
+	headers := headersFromPublishContext(ctx)
+	var cancel context.Context
+	if dropOnCancel(ctx) {
+		cancel = ctx
+	}
+	local := localWaitFromContext(ctx)
 
+	// Subscribe and Unsubscribe replace the subscribers rather than
+	// changing them, so Publish only needs the hub mutex when the retained
+	// messages or the failover and queue groups need to be kept consistent
+	// with the subscribers.
+	snapshot := h.snapshot.Load().(*subscriberSnapshot)
+	if snapshot.locked {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if len(h.failover) > 0 {
+			h.checkHeartbeats()
+		}
+		snapshot = h.snapshot.Load().(*subscriberSnapshot)
+	}
+
+	pooled := acquirePooledData(ctx, data)
 	done := make(chan struct{})
 	wait := sync.WaitGroup{}
+	handle := &doneHandle{done: done}
+	sequence := atomic.AddUint64(&h.sequence, 1)
+	headers = h.receipts.withMessageID(topic, headers, sequence)
+	now := time.Now()
+	size := h.quotas.measure(data)
+	coalesce := h.coalesceFor(topic, data)
+	var check *frozen
+	if h.detectMutations {
+		// The data is checksummed before any subscriber can see it.
+		check = freeze(topic, sequence, data)
+	}
 
-	for _, s := range h.subscribers {
-		if s.topicMatcher.Match(topic) {
-			wait.Add(1)
-			s.notify(
-				&handlerCallback{
-					topic: topic,
-					data:  data,
-					wg:    &wait,
-				})
+	matches := snapshot.topics.lookup(topic, snapshot)
+	topic = matches.topic
+	h.recent.add(topic)
+	if snapshot.locked && len(h.pins) > 0 {
+		h.keepPinned(&handlerCallback{
+			topic:    topic,
+			data:     data,
+			sequence: sequence,
+			key:      key,
+			headers:  headers,
+		})
+	}
+	callTaps(snapshot.taps, topic, data)
+	var served map[*queueGroup]bool
+	for _, s := range matches.candidates {
+		if !s.staticMatcher && !s.match(topic) {
+			continue
+		}
+		// Only locked snapshots can have failover or queue groups.
+		if snapshot.locked {
+			if h.isStandby(s) {
+				continue
+			}
+			var ok bool
+			if s, ok = h.queueTarget(s, key, &served); !ok {
+				continue
+			}
+		}
+		wait.Add(1)
+		call := &handlerCallback{
+			topic:    topic,
+			data:     data,
+			sequence: sequence,
+			key:      key,
+			headers:  headers,
+			wg:       &wait,
+			queued:   now,
+			size:     size,
+			cancel:   cancel,
+			handle:   handle,
+			coalesce: coalesce,
+			pooled:   pooled != nil,
+		}
+		if local != nil && local.sub == s {
+			local.wait.Add(1)
+			call.local = &local.wait
 		}
+		s.notify(call)
+	}
+
+	if snapshot.locked {
+		h.retain(retainedMessage{
+			topic:    topic,
+			data:     data,
+			sequence: sequence,
+			key:      key,
+			headers:  headers,
+		})
 	}
 
 	go func() {
 		wait.Wait()
+		if check != nil {
+			h.checkFrozen(check)
+		}
+		if pooled != nil {
+			pooled.release()
+		}
 		close(done)
 	}()
 
-	return &doneHandle{done: done}, nil
+	return handle, nil
 }
 
 // Subscribe implements Hub.
-func (h *simplehub) Subscribe(matcher TopicMatcher, handler interface{}) (Unsubscriber, error) {
+func (h *simplehub) Subscribe(matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, error) {
+	subscription, _, err := h.subscribe(matcher, handler, options, false)
+	return subscription, err
+}
+
+// subscribe creates the subscriber. If fetch is true, the most recent
+// retained message of each matching topic is returned instead of being
+// delivered to the subscriber.
+func (h *simplehub) subscribe(matcher TopicMatcher, handler interface{}, options []SubscribeOption, fetch bool) (Subscription, []Message, error) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
+	return h.addSubscriber(matcher, handler, options, fetch, nil)
+}
 
-	sub, err := newSubscriber(matcher, handler)
+// addSubscriber creates the subscriber, in place of the replaced
+// subscriber if it isn't nil (see Resubscribe). The hub mutex must be
+// held.
+func (h *simplehub) addSubscriber(matcher TopicMatcher, handler interface{}, options []SubscribeOption, fetch bool, replaced *subscriber) (Subscription, []Message, error) {
+	opts := newSubscribeOptions(options)
+	if fetch {
+		opts.deliver = deliverNew
+	}
+	if err := checkOwner(opts.owner); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if err := h.checkSubscriberLimits(matcher, replaced); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	failover, err := h.newFailover(opts.failover)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if err := h.checkQueueGroup(opts); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	handler, err = h.providers.inject(handler, 2)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	sub, err := newSubscriber(subscriberConfig{
+		id:          h.idx,
+		matcher:     matcher,
+		handler:     handler,
+		inFlight:    h.inFlight,
+		queueSize:   h.queueSize,
+		reportError: h.reportError,
+		metrics:     h.metrics,
+		quotas:      h.quotas,
+		codecs:      h.codecs,
+		errorBudget: h.errorBudget,
+		publish:     h.publish,
+		receipts:    h.receipts,
+		failover:    failover,
+		options:     opts,
+		matchCost:   h.trackMatchCost,
+		slowMatch:   h.slowMatch,
+	})
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
+	}
+	if sub.durable != nil {
+		h.returned(sub.name)
+	}
+	// The retained messages are queued while the hub mutex is held, so no
+	// message published after them can get in ahead of them.
+	now := time.Now()
+	retained := h.retainedFor(matcher, opts.deliver)
+	if opts.queueGroup != nil && h.queueGroups[opts.queueGroup.Group] != nil || replaced != nil {
+		// The first member of the queue group, or the replaced
+		// subscriber, has been given them.
+		retained = nil
+	}
+	for _, message := range retained {
+		sub.notify(&handlerCallback{
+			topic:    message.topic,
+			data:     message.data,
+			sequence: message.sequence,
+			key:      message.key,
+			headers:  message.headers,
+			queued:   now,
+		})
 	}
 
-	sub.id = h.idx
 	h.idx++
-	h.subscribers = append(h.subscribers, sub)
-	return &handle{hub: h, id: sub.id}, nil
+	subscribers := h.subscribers
+	if replaced != nil {
+		// The queued messages are handed over before the subscribers
+		// change, and the replaced subscriber forwards the messages of
+		// the publishes still using the old subscribers, so none are
+		// missed.
+		replaced.handOver(sub)
+		subscribers = withoutSubscriber(subscribers, replaced)
+		h.removeFailover(replaced)
+		h.removeQueueGroup(replaced)
+	}
+	h.joinFailover(sub)
+	h.joinQueueGroup(sub)
+	h.setSubscribers(insertSubscriber(subscribers, sub))
+	var fetched []Message
+	if fetch {
+		fetched = retainedMessages(h.retainedFor(matcher, deliverLastRetained))
+	}
+	subscription := &handle{hub: h, sub: sub}
+	subscription.own(opts)
+	return subscription, fetched, nil
 }
 
 func (h *simplehub) unsubscribe(id int) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	for i, sub := range h.subscribers {
+	if sub := h.remove(id); sub != nil {
+		sub.close()
+		h.departed(sub)
+		return
+	}
+	// A subscriber that is being flushed has already been removed.
+	if sub, ok := h.flushing[id]; ok {
+		delete(h.flushing, id)
+		sub.close()
+	}
+}
+
+// remove removes the subscriber from the hub and its groups, without
+// closing it, and returns it. It returns nil if the subscriber has already
+// been removed. The hub mutex must be held.
+func (h *simplehub) remove(id int) *subscriber {
+	for _, sub := range h.subscribers {
 		if sub.id == id {
-			sub.close()
-			h.subscribers = append(h.subscribers[0:i], h.subscribers[i+1:]...)
-			return
+			h.removeFailover(sub)
+			h.removeQueueGroup(sub)
+			h.setSubscribers(withoutSubscriber(h.subscribers, sub))
+			return sub
 		}
 	}
+	return nil
 }
 
 type handle struct {
 	hub *simplehub
-	id  int
+	sub *subscriber
+
+	// convert, if set, converts the handlers passed to Replace into the
+	// form the subscriber calls. The structured hub sets it to wrap the
+	// handlers in a structured callback.
+	convert func(handler interface{}) (interface{}, error)
 }
 
 // Unsubscribe implements Unsubscriber.
 func (h *handle) Unsubscribe() {
-	h.hub.unsubscribe(h.id)
+	h.hub.unsubscribe(h.sub.id)
+}
+
+// Pending implements Subscription.
+func (h *handle) Pending() int {
+	h.sub.mutex.Lock()
+	defer h.sub.mutex.Unlock()
+	return h.sub.pendingCount()
+}
+
+// Replace implements Subscription.
+func (h *handle) Replace(handler interface{}) error {
+	if h.convert != nil {
+		converted, err := h.convert(handler)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		handler = converted
+	} else {
+		injected, err := h.hub.providers.inject(handler, 2)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		handler = injected
+	}
+	f, err := checkHandler(handler)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	h.sub.mutex.Lock()
+	h.sub.handler = f
+	h.sub.mutex.Unlock()
+	if h.sub.errs.release() {
+		h.sub.quarantineChanged(false)
+	}
+	return nil
+}
+
+// LastDelivered implements Subscription.
+func (h *handle) LastDelivered() time.Time {
+	h.sub.mutex.Lock()
+	defer h.sub.mutex.Unlock()
+	return h.sub.lastDelivered
 }
 
 type handlerCallback struct {
-	topic Topic
-	data  interface{}
-	wg    *sync.WaitGroup
-	mu    sync.Mutex
+	topic    Topic
+	data     interface{}
+	sequence uint64
+	key      string
+	headers  Headers
+	wg       *sync.WaitGroup
+	mu       sync.Mutex
+
+	// local is also marked done with the call, if the call is for the
+	// subscription passed to PublishAndWaitLocal.
+	local *sync.WaitGroup
+
+	// record is the sequence of the message in the store of a durable
+	// subscriber, or zero if it was never spilled.
+	record uint64
+
+	// barrier is true for the markers queued by Barrier, and for those
+	// that call the OnRebalance callback of a queue group member, which
+	// also have rebalance set.
+	barrier   bool
+	rebalance *Rebalance
+
+	// retry is the number of times the message has been retried.
+	retry int
+
+	// goroutine is the ID of the goroutine that handles the call.
+	goroutine uint64
+
+	// direct is true for the messages sent with a Handoff, whose topics
+	// weren't matched.
+	direct bool
+
+	// pooled is true if the map of the data is reused once the publish
+	// is complete. See StructuredHubConfig.PoolMaps.
+	pooled bool
+
+	// queued is when the message was queued for the subscriber.
+	queued time.Time
+
+	// size is the estimated size of the data, if the hub has a quota for
+	// it, and quota is the tracker that counts the call as queued until it
+	// is done.
+	size  int64
+	quota *quotaTracker
+
+	// cancel is the context of the publish if the message is to be
+	// dropped when it is done, and handle counts the drops.
+	cancel context.Context
+	handle *doneHandle
+
+	// coalesce is set if the message may be coalesced with identical
+	// messages, and merged are the calls of the messages coalesced with
+	// this one, which are done when it is.
+	coalesce *coalesce
+	merged   []*handlerCallback
 }
 
 func (h *handlerCallback) done() {
 	h.mu.Lock()
-	defer h.mu.Unlock()
+	// The quota is released first, so the hub's counts are up to date once
+	// the publish is complete.
+	if h.quota != nil {
+		h.quota.add(-1, -h.size)
+		h.quota = nil
+	}
+	if h.local != nil {
+		h.local.Done()
+		h.local = nil
+	}
 	if h.wg != nil {
 		h.wg.Done()
 		h.wg = nil
 	}
+	merged := h.merged
+	h.merged = nil
+	h.mu.Unlock()
+	for _, call := range merged {
+		call.done()
+	}
 }
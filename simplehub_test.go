@@ -4,6 +4,7 @@
 package pubsub_test
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -185,6 +186,67 @@ func (*SimpleHubSuite) TestUnsubscribe(c *gc.C) {
 	c.Assert(called, jc.IsFalse)
 }
 
+func (*SimpleHubSuite) TestUnsubscribeCancelsHandlerContext(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	sub, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			stopped <- ctx.Err()
+		case <-time.After(time.Second):
+			stopped <- nil
+		}
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	<-started
+
+	sub.Unsubscribe()
+	c.Check(<-stopped, gc.Equals, context.Canceled)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+}
+
+func (*SimpleHubSuite) TestPublishWhileUnsubscribing(c *gc.C) {
+	// Publish doesn't hold the hub mutex, so it may notify subscribers
+	// that are being unsubscribed. The messages must still complete.
+	hub := pubsub.NewSimpleHub()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sub, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+				c.Check(err, jc.ErrorIsNil)
+				sub.Unsubscribe()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				result, err := hub.Publish(topic, nil)
+				c.Check(err, jc.ErrorIsNil)
+				select {
+				case <-result.Complete():
+				case <-time.After(time.Second):
+					c.Error("publish did not complete")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(hub.(pubsub.Reporter).Report()["published"], gc.Equals, uint64(400))
+	c.Assert(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+}
+
 func (*SimpleHubSuite) TestSubscriberMultipleCallbacks(c *gc.C) {
 	firstCalled := false
 	secondCalled := false
@@ -208,3 +270,385 @@ func (*SimpleHubSuite) TestSubscriberMultipleCallbacks(c *gc.C) {
 	c.Check(secondCalled, jc.IsTrue)
 	c.Check(thirdCalled, jc.IsTrue)
 }
+
+func (*SimpleHubSuite) TestReentrantPublishOrdering(c *gc.C) {
+	const depth = 100
+	gate := make(chan struct{})
+	done := make(chan struct{})
+	mutex := sync.Mutex{}
+	var chain, recorded []string
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(pubsub.MatchAll, func(topic pubsub.Topic, data interface{}) {
+		<-gate
+		mutex.Lock()
+		chain = append(chain, fmt.Sprintf("%s-%d", topic, data))
+		mutex.Unlock()
+		if topic != "chain" {
+			return
+		}
+		if n := data.(int); n < depth {
+			_, err := hub.Publish("chain", n+1)
+			c.Check(err, jc.ErrorIsNil)
+		} else {
+			close(done)
+		}
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(pubsub.MatchAll, func(topic pubsub.Topic, data interface{}) {
+		<-gate
+		mutex.Lock()
+		defer mutex.Unlock()
+		recorded = append(recorded, fmt.Sprintf("%s-%d", topic, data))
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Both subscribers are blocked, so all these messages are queued
+	// before the first re-entrant publish.
+	for i, t := range []pubsub.Topic{"chain", "outer", "outer"} {
+		_, err := hub.Publish(t, i)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	close(gate)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("re-entrant chain did not complete")
+	}
+	// Wait for the other subscriber to process the last message.
+	result, err := hub.Publish("end", 0)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+
+	expected := []string{"chain-0", "outer-1", "outer-2"}
+	for i := 1; i <= depth; i++ {
+		expected = append(expected, fmt.Sprintf("chain-%d", i))
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.Check(chain, jc.DeepEquals, append(expected, "end-0"))
+	c.Check(recorded, jc.DeepEquals, append(expected, "end-0"))
+}
+
+func (*SimpleHubSuite) TestReentrantPublishWaitingOnOthers(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var called bool
+	_, err := hub.Subscribe(second, func(topic pubsub.Topic, data interface{}) {
+		called = true
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(first, func(topic pubsub.Topic, data interface{}) {
+		// Waiting on a message that isn't delivered to this subscriber
+		// is fine.
+		result, err := hub.Publish(second, nil)
+		c.Check(err, jc.ErrorIsNil)
+		<-result.Complete()
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	result, err := hub.Publish(first, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	c.Assert(called, jc.IsTrue)
+}
+
+func (*SimpleHubSuite) TestDeliverySequence(c *gc.C) {
+	mutex := sync.Mutex{}
+	var sequences []uint64
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(first, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		delivery, ok := pubsub.DeliveryFromContext(ctx)
+		c.Check(ok, jc.IsTrue)
+		mutex.Lock()
+		defer mutex.Unlock()
+		sequences = append(sequences, delivery.Sequence)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	var result pubsub.Completer
+	for _, t := range []pubsub.Topic{first, second, first, first} {
+		result, err = hub.Publish(t, nil)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	select {
+	case <-result.Complete():
+	case <-time.After(veryShortTime):
+		c.Fatal("publish did not complete")
+	}
+	// The sequence is hub wide, so the gap shows the message on the
+	// other topic.
+	c.Assert(sequences, jc.DeepEquals, []uint64{1, 3, 4})
+}
+
+func (*SimpleHubSuite) TestDeliveryFromOtherContext(c *gc.C) {
+	_, ok := pubsub.DeliveryFromContext(context.Background())
+	c.Assert(ok, jc.IsFalse)
+}
+
+func (*SimpleHubSuite) TestMaxInFlight(c *gc.C) {
+	const limit = 2
+	var (
+		mutex    sync.Mutex
+		running  int
+		maxSeen  int
+		calls    int
+		release  = make(chan struct{})
+		started  = make(chan struct{}, 10)
+		handlers = 5
+	)
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{MaxInFlight: limit})
+	for i := 0; i < handlers; i++ {
+		_, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {
+			mutex.Lock()
+			running++
+			calls++
+			if running > maxSeen {
+				maxSeen = running
+			}
+			mutex.Unlock()
+			started <- struct{}{}
+			<-release
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	result, err := hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i := 0; i < limit; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			c.Fatal("handler not started")
+		}
+	}
+	select {
+	case <-started:
+		c.Fatal("too many handlers started")
+	case <-time.After(10 * veryShortTime):
+	}
+	close(release)
+
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.Check(calls, gc.Equals, handlers)
+	c.Check(maxSeen, gc.Equals, limit)
+}
+
+func (*SimpleHubSuite) TestMaxInFlightUnsubscribeWhileWaiting(c *gc.C) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{MaxInFlight: 1})
+	_, err := hub.Subscribe(first, func(pubsub.Topic, interface{}) {
+		close(started)
+		<-release
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	waiting, err := hub.Subscribe(second, func(pubsub.Topic, interface{}) {
+		c.Error("handler should not be called")
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(first, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		c.Fatal("handler not started")
+	}
+	result, err := hub.Publish(second, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	// Give the second subscriber time to be waiting for the slot.
+	time.Sleep(10 * veryShortTime)
+	waiting.Unsubscribe()
+
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	close(release)
+}
+
+func (*SimpleHubSuite) TestParallelOrderingKeys(c *gc.C) {
+	var (
+		mutex    sync.Mutex
+		handled  = make(map[string][]int)
+		unkeyed  []int
+		blockA   = make(chan struct{})
+		handledB = make(chan struct{})
+	)
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		delivery, _ := pubsub.DeliveryFromContext(ctx)
+		key := delivery.OrderingKey
+		if key == "a" && data.(int) == 0 {
+			<-blockA
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if key == "" {
+			// All the keyed messages published before are done.
+			c.Check(handled["a"], gc.HasLen, 3)
+			c.Check(handled["b"], gc.HasLen, 3)
+			unkeyed = append(unkeyed, data.(int))
+			return
+		}
+		handled[key] = append(handled[key], data.(int))
+		if key == "b" && len(handled[key]) == 3 {
+			close(handledB)
+		}
+	}, pubsub.Parallel(4))
+	c.Assert(err, jc.ErrorIsNil)
+
+	ctxA := pubsub.WithOrderingKey(context.Background(), "a")
+	ctxB := pubsub.WithOrderingKey(context.Background(), "b")
+	for i := 0; i < 3; i++ {
+		_, err := hub.(pubsub.ContextPublisher).PublishCtx(ctxA, topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.(pubsub.ContextPublisher).PublishCtx(ctxB, topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	result, err := hub.Publish(topic, 42)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The messages for b are handled even though a is blocked.
+	select {
+	case <-handledB:
+	case <-time.After(time.Second):
+		c.Fatal("key b messages not handled")
+	}
+	close(blockA)
+
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.Check(handled, jc.DeepEquals, map[string][]int{
+		"a": {0, 1, 2},
+		"b": {0, 1, 2},
+	})
+	c.Check(unkeyed, jc.DeepEquals, []int{42})
+}
+
+func (*SimpleHubSuite) TestParallelUnsubscribeMarksDone(c *gc.C) {
+	wait := make(chan struct{})
+	hub := pubsub.NewSimpleHub()
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) {
+		<-wait
+	}, pubsub.Parallel(2))
+	c.Assert(err, jc.ErrorIsNil)
+
+	var results []pubsub.Completer
+	for _, key := range []string{"a", "a", "b", "", "b"} {
+		ctx := pubsub.WithOrderingKey(context.Background(), key)
+		result, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, nil)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	sub.Unsubscribe()
+	close(wait)
+	for _, result := range results {
+		select {
+		case <-result.Complete():
+		case <-time.After(time.Second):
+			c.Fatal("publish did not complete")
+		}
+	}
+}
+
+func (*SimpleHubSuite) TestPendingAndLastDelivered(c *gc.C) {
+	started := make(chan struct{}, 3)
+	wait := make(chan struct{})
+	hub := pubsub.NewSimpleHub()
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data interface{}) {
+		started <- struct{}{}
+		<-wait
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(sub.Pending(), gc.Equals, 0)
+	c.Check(sub.LastDelivered().IsZero(), jc.IsTrue)
+
+	var results []pubsub.Completer
+	for i := 0; i < 3; i++ {
+		result, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+	// The first message is being handled, the other two are queued.
+	c.Check(sub.Pending(), gc.Equals, 2)
+	c.Check(sub.LastDelivered().IsZero(), jc.IsTrue)
+
+	before := time.Now()
+	close(wait)
+	for _, result := range results {
+		select {
+		case <-result.Complete():
+		case <-time.After(time.Second):
+			c.Fatal("publish did not complete")
+		}
+	}
+	c.Check(sub.Pending(), gc.Equals, 0)
+	c.Check(sub.LastDelivered().Before(before), jc.IsFalse)
+}
+
+func (*SimpleHubSuite) TestReplace(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	old := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, old.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	var results []pubsub.Completer
+	for i := 0; i < 3; i++ {
+		result, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	waitStarted(c, old)
+
+	// The queued messages go to the new handler, in order.
+	replacement := newBlockingHandler()
+	close(replacement.release)
+	err = sub.Replace(replacement.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	close(old.release)
+	for _, result := range results {
+		select {
+		case <-result.Complete():
+		case <-time.After(time.Second):
+			c.Fatal("publish did not complete")
+		}
+	}
+	c.Check(old.get(), jc.DeepEquals, []interface{}{0})
+	c.Check(replacement.get(), jc.DeepEquals, []interface{}{1, 2})
+}
+
+func (*SimpleHubSuite) TestReplaceInvalid(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	err = sub.Replace(func(pubsub.Topic) {})
+	c.Assert(err, gc.ErrorMatches, "incorrect handler signature not valid")
+}
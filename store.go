@@ -0,0 +1,105 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Record is a single serialized message held in a Store.
+type Record struct {
+	// Sequence orders the records within a stream. Sequences must be
+	// strictly increasing within a stream.
+	Sequence uint64
+	Topic    Topic
+	Data     []byte
+}
+
+// Store defines the persistence used by the features that need to keep
+// messages, such as retention, journals and durable subscriptions. Records
+// are kept in named streams so one store can be shared by several features.
+//
+// NewMemoryStore provides a simple in-memory implementation, and the
+// boltstore package provides one backed by a BoltDB file. Other stores can
+// be supplied by implementing this interface.
+type Store interface {
+	// Put adds the records to the end of the named stream. The sequence
+	// of each record must be greater than any already in the stream.
+	Put(stream string, records ...Record) error
+
+	// GetRange returns the records in the stream with a sequence greater
+	// than or equal to from, and less than to, in sequence order.
+	GetRange(stream string, from, to uint64) ([]Record, error)
+
+	// Trim removes all the records in the stream with a sequence less than
+	// before.
+	Trim(stream string, before uint64) error
+}
+
+// NewMemoryStore returns a Store that keeps all the records in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		streams: make(map[string][]Record),
+	}
+}
+
+type memoryStore struct {
+	mutex   sync.Mutex
+	streams map[string][]Record
+}
+
+// Put implements Store.
+func (s *memoryStore) Put(stream string, records ...Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	existing := s.streams[stream]
+	for _, record := range records {
+		if count := len(existing); count > 0 && existing[count-1].Sequence >= record.Sequence {
+			return errors.NotValidf("sequence %d in stream %q", record.Sequence, stream)
+		}
+		if record.Data != nil {
+			record.Data = append([]byte(nil), record.Data...)
+		}
+		existing = append(existing, record)
+	}
+	s.streams[stream] = existing
+	return nil
+}
+
+// GetRange implements Store.
+func (s *memoryStore) GetRange(stream string, from, to uint64) ([]Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records := s.streams[stream]
+	start := sort.Search(len(records), func(i int) bool {
+		return records[i].Sequence >= from
+	})
+	var result []Record
+	for _, record := range records[start:] {
+		if record.Sequence >= to {
+			break
+		}
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+// Trim implements Store.
+func (s *memoryStore) Trim(stream string, before uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records := s.streams[stream]
+	start := sort.Search(len(records), func(i int) bool {
+		return records[i].Sequence >= before
+	})
+	if start == len(records) {
+		delete(s.streams, stream)
+		return nil
+	}
+	s.streams[stream] = append([]Record(nil), records[start:]...)
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"math"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type MemoryStoreSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&MemoryStoreSuite{})
+
+func (*MemoryStoreSuite) TestPutGetRange(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	err := store.Put("stream", pubsub.Record{Sequence: 1, Topic: first, Data: []byte("one")})
+	c.Assert(err, jc.ErrorIsNil)
+	err = store.Put("stream",
+		pubsub.Record{Sequence: 2, Topic: second, Data: []byte("two")},
+		pubsub.Record{Sequence: 5, Topic: first, Data: []byte("five")},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+
+	records, err := store.GetRange("stream", 2, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, jc.DeepEquals, []pubsub.Record{
+		{Sequence: 2, Topic: second, Data: []byte("two")},
+		{Sequence: 5, Topic: first, Data: []byte("five")},
+	})
+	records, err = store.GetRange("stream", 0, 5)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, gc.HasLen, 2)
+	records, err = store.GetRange("other", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, gc.HasLen, 0)
+}
+
+func (*MemoryStoreSuite) TestPutOutOfOrder(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	err := store.Put("stream", pubsub.Record{Sequence: 2})
+	c.Assert(err, jc.ErrorIsNil)
+	err = store.Put("stream", pubsub.Record{Sequence: 2})
+	c.Assert(err, gc.ErrorMatches, `sequence 2 in stream "stream" not valid`)
+}
+
+func (*MemoryStoreSuite) TestTrim(c *gc.C) {
+	store := pubsub.NewMemoryStore()
+	for i := uint64(1); i <= 5; i++ {
+		err := store.Put("stream", pubsub.Record{Sequence: i})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	err := store.Trim("stream", 4)
+	c.Assert(err, jc.ErrorIsNil)
+	records, err := store.GetRange("stream", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, jc.DeepEquals, []pubsub.Record{{Sequence: 4}, {Sequence: 5}})
+
+	err = store.Trim("stream", 10)
+	c.Assert(err, jc.ErrorIsNil)
+	records, err = store.GetRange("stream", 0, math.MaxUint64)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(records, gc.HasLen, 0)
+}
@@ -4,31 +4,83 @@
 package pubsub
 
 import (
+	"context"
 	"reflect"
 
 	"github.com/juju/errors"
 )
 
-type structuredCallback struct {
+// decoder holds the values used to convert the published data into the
+// types that the handlers want.
+type decoder struct {
 	marshaller Marshaller
-	callback   reflect.Value
-	dataType   reflect.Type
+	hook       DecodeHook
+	limits     DecodeLimits
+	codecs     payloadCodecs
+
+	// strict is true for the decoders of strict hubs, which don't allow
+	// handlers to take the map form of the data.
+	strict bool
+
+	// providers inject the extra arguments of the handlers, if the hub
+	// has any.
+	providers *Providers
 }
 
-func newStructuredCallback(marshaller Marshaller, handler interface{}) (*structuredCallback, error) {
-	rt, err := checkStructuredHandler(handler)
+type structuredCallback struct {
+	decoder  decoder
+	callback reflect.Value
+	dataType reflect.Type
+	// wantsContext is true if the handler takes a context.Context as the
+	// first argument.
+	wantsContext bool
+	// topicFields are the fields of the structure that are set to the
+	// topic of the message.
+	topicFields [][]int
+	// union is only set for the handlers returned from Union, and holds
+	// the callbacks of the handlers in the union.
+	union []*structuredCallback
+	// projection holds the paths of the fields given to the Project
+	// option, if the subscription has one.
+	projection [][]string
+}
+
+func newStructuredCallback(decoder decoder, handler interface{}) (*structuredCallback, error) {
+	if union, ok := handler.(*unionHandler); ok {
+		return newUnionCallback(decoder, union)
+	}
+	handler, err := decoder.providers.inject(handler, 3)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rt, wantsContext, err := checkStructuredHandler(handler)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if decoder.strict && rt.Kind() == reflect.Map {
+		return nil, errors.NotValidf("map handler on strict hub")
+	}
+	fields, err := topicFields(rt)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	logger.Tracef("new structured callback, return type %v", rt)
 	return &structuredCallback{
-		marshaller: marshaller,
-		callback:   reflect.ValueOf(handler),
-		dataType:   rt,
+		decoder:      decoder,
+		callback:     reflect.ValueOf(handler),
+		dataType:     rt,
+		wantsContext: wantsContext,
+		topicFields:  fields,
 	}, nil
 }
 
-func (s *structuredCallback) handler(topic Topic, data interface{}) {
+func (s *structuredCallback) handler(ctx context.Context, topic Topic, data interface{}) error {
+	if asMap, ok := data.(map[string]interface{}); ok && s.projection != nil {
+		data = project(asMap, s.projection)
+	}
+	if s.union != nil {
+		return s.handleUnion(ctx, topic, data)
+	}
 	var (
 		err   error
 		value reflect.Value
@@ -37,68 +89,166 @@ func (s *structuredCallback) handler(topic Topic, data interface{}) {
 	if !ok {
 		err = errors.Errorf("bad data: %v", data)
 		value = reflect.Indirect(reflect.New(s.dataType))
+		reportSubscriberError(ctx, PhaseDispatch, topic, err)
 	} else {
 		logger.Tracef("convert map to %v", s.dataType)
-		value, err = toHanderType(s.marshaller, s.dataType, asMap)
+		var report *DecodeReport
+		if s.wantsContext && s.dataType.Kind() == reflect.Struct && s.dataType != fieldsType {
+			report = new(DecodeReport)
+			ctx = withDecodeReport(ctx, report)
+		}
+		value, err = s.decoder.decode(s.dataType, asMap, report)
+		if err != nil {
+			reportSubscriberError(ctx, PhaseDecode, topic, err)
+		}
 	}
+	return s.call(ctx, topic, value, err)
+}
+
+// call calls the handler with the decoded value, and the error decoding
+// it, if there was one.
+func (s *structuredCallback) call(ctx context.Context, topic Topic, value reflect.Value, err error) error {
+	setTopicFields(value, s.topicFields, topic)
 	// NOTE: you can't just use reflect.ValueOf(err) as that doesn't work
 	// with nil errors. reflect.ValueOf(nil) isn't a valid value. So we need
 	// to make  sure that we get the type of the parameter correct, which is
 	// the error interface.
 	errValue := reflect.Indirect(reflect.ValueOf(&err))
 	args := []reflect.Value{reflect.ValueOf(topic), value, errValue}
-	s.callback.Call(args)
+	if s.wantsContext {
+		args = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, args...)
+	}
+	results := s.callback.Call(args)
+	if len(results) == 1 && !results[0].IsNil() {
+		return results[0].Interface().(error)
+	}
+	return nil
+}
+
+func (d decoder) toHanderType(rt reflect.Type, data map[string]interface{}) (reflect.Value, error) {
+	return d.decode(rt, data, nil)
 }
 
-func toHanderType(marshaller Marshaller, rt reflect.Type, data map[string]interface{}) (reflect.Value, error) {
+// decode converts the data into the type rt. If report is not nil, it is
+// filled in with details of how the data matched the structure.
+func (d decoder) decode(rt reflect.Type, data map[string]interface{}, report *DecodeReport) (reflect.Value, error) {
 	mapType := reflect.TypeOf(data)
 	if mapType == rt {
 		return reflect.ValueOf(data), nil
 	}
+	if rt == fieldsType {
+		return reflect.ValueOf(Fields{values: data, decoder: d}), nil
+	}
+	if rt == bytesType {
+		bytes, err := d.marshaller.Marshal(data)
+		if err != nil {
+			return reflect.Zero(rt), errors.Annotate(err, "marshalling data")
+		}
+		return reflect.ValueOf(bytes), nil
+	}
 	sv := reflect.New(rt) // returns a Value containing *StructType
-	bytes, err := marshaller.Marshal(data)
+	if report != nil {
+		report.matchFields("", rt, data)
+		defer report.sort()
+	}
+	if err := d.limits.checkDepth(data); err != nil {
+		return reflect.Indirect(sv), errors.Trace(err)
+	}
+	if d.hook == nil && d.marshaller == JSONMarshaller && reflect.PtrTo(rt).Implements(mapUnmarshalerType) {
+		// The type knows how to set itself from the map without the
+		// round trip through the marshaller, but the size limit still
+		// applies.
+		if err := d.limits.checkMapSize(d.marshaller, data); err != nil {
+			return reflect.Indirect(sv), errors.Trace(err)
+		}
+		if err := sv.Interface().(MapUnmarshaler).UnmarshalMap(data); err != nil {
+			return reflect.Indirect(sv), errors.Annotate(err, "unmarshalling data")
+		}
+		return reflect.Indirect(sv), nil
+	}
+	if d.hook != nil {
+		hooked, err := applyDecodeHook(d.hook, rt, data)
+		if err != nil {
+			return reflect.Indirect(sv), errors.Annotate(err, "decode hook")
+		}
+		if report != nil {
+			report.findCoerced("", data, hooked)
+		}
+		data = hooked
+	}
+	if d.codecs.needed(rt) {
+		if err := d.decodeValue(sv.Elem(), data); err != nil {
+			if IsDecodeLimitError(err) {
+				return reflect.Indirect(reflect.New(rt)), errors.Trace(err)
+			}
+			return reflect.Indirect(sv), errors.Annotate(err, "unmarshalling data")
+		}
+		return reflect.Indirect(sv), nil
+	}
+	bytes, err := d.marshaller.Marshal(data)
 	if err != nil {
 		return reflect.Indirect(sv), errors.Annotate(err, "marshalling data")
 	}
-	err = marshaller.Unmarshal(bytes, sv.Interface())
+	if err := d.limits.checkSize(bytes); err != nil {
+		return reflect.Indirect(sv), errors.Trace(err)
+	}
+	err = d.limits.unmarshal(d.marshaller, bytes, sv.Interface())
 	if err != nil {
+		if IsDecodeLimitError(err) {
+			return reflect.Indirect(reflect.New(rt)), errors.Trace(err)
+		}
 		return reflect.Indirect(sv), errors.Annotate(err, "unmarshalling data")
 	}
 	return reflect.Indirect(sv), nil
 }
 
 // checkStructuredHandler makes sure that the handler is a function that takes
-// a Topic, a structure, and an error. Returns the reflect.Type for the
-// structure.
-func checkStructuredHandler(handler interface{}) (reflect.Type, error) {
+// a Topic, a structure, map or []byte, and an error, optionally preceded by a
+// context.Context, and that returns nothing or an error. Returns the
+// reflect.Type for the structure, and whether the handler takes a context.
+func checkStructuredHandler(handler interface{}) (reflect.Type, bool, error) {
 	if handler == nil {
-		return nil, errors.NotValidf("nil handler")
+		return nil, false, errors.NotValidf("nil handler")
 	}
 	mapType := reflect.TypeOf(map[string]interface{}{})
 	t := reflect.TypeOf(handler)
 	if t.Kind() != reflect.Func {
-		return nil, errors.NotValidf("handler of type %T", handler)
+		return nil, false, errors.NotValidf("handler of type %T", handler)
 	}
-	if t.NumIn() != 3 {
-		return nil, errors.NotValidf("expected 3 args, got %d, incorrect handler signature", t.NumIn())
+	var args []reflect.Type
+	for i := 0; i < t.NumIn(); i++ {
+		args = append(args, t.In(i))
 	}
-	if t.NumOut() != 0 {
-		return nil, errors.NotValidf("expected no return values, got %d, incorrect handler signature", t.NumOut())
+	wantsContext := len(args) == 4 && args[0] == contextType
+	if wantsContext {
+		args = args[1:]
+	}
+	if len(args) != 3 {
+		return nil, false, errors.NotValidf("expected 3 args, got %d, incorrect handler signature", t.NumIn())
+	}
+	if t.NumOut() > 1 || t.NumOut() == 1 && t.Out(0) != errorType {
+		return nil, false, errors.NotValidf("expected no return values or an error, incorrect handler signature")
 	}
 	var topic Topic
 	var topicType = reflect.TypeOf(topic)
 
-	arg1 := t.In(0)
-	arg2 := t.In(1)
-	arg3 := t.In(2)
+	arg1 := args[0]
+	arg2 := args[1]
+	arg3 := args[2]
 	if arg1 != topicType {
-		return nil, errors.NotValidf("first arg should be a pubsub.Topic, incorrect handler signature")
+		return nil, false, errors.NotValidf("first arg should be a pubsub.Topic, incorrect handler signature")
 	}
-	if arg2.Kind() != reflect.Struct && arg2 != mapType {
-		return nil, errors.NotValidf("second arg should be a structure for data, incorrect handler signature")
+	if arg2.Kind() != reflect.Struct && arg2 != mapType && arg2 != bytesType {
+		return nil, false, errors.NotValidf("second arg should be a structure for data, incorrect handler signature")
 	}
 	if arg3.Kind() != reflect.Interface || arg3.Name() != "error" {
-		return nil, errors.NotValidf("third arg should be error for deserialization errors, incorrect handler signature")
+		return nil, false, errors.NotValidf("third arg should be error for deserialization errors, incorrect handler signature")
 	}
-	return arg2, nil
+	return arg2, wantsContext, nil
 }
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	bytesType   = reflect.TypeOf([]byte(nil))
+)
@@ -4,8 +4,11 @@
 package pubsub
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"reflect"
+	"sync"
 
 	"github.com/juju/errors"
 	"github.com/juju/loggo"
@@ -16,7 +19,56 @@ type structuredHub struct {
 
 	marshaller  Marshaller
 	annotations map[string]interface{}
+	layers      []AnnotationLayer
 	postProcess func(map[string]interface{}) (map[string]interface{}, error)
+	decoder     decoder
+
+	trackProvenance bool
+
+	registryMutex sync.Mutex
+	payloadTypes  map[Topic]reflect.Type
+
+	interceptMutex sync.Mutex
+	interceptors   []*interceptor
+	interceptIdx   int
+
+	// offload is nil unless the hub serializes messages in the background.
+	offload *serializeOffload
+
+	// maps is nil unless the hub reuses the maps of the published data.
+	maps *mapPool
+}
+
+// StructuredHub is a Hub that converts the published data into a
+// map[string]interface{}, and allows subscribers to have the data
+// converted into structures of their choosing.
+type StructuredHub interface {
+	Hub
+
+	// RegisterTopic records the payload type for the topic. The payload is
+	// an example value of a structure type. Once registered, all data
+	// published on the topic is checked to make sure that it can be
+	// converted into the payload type, and a *PayloadTypeError is returned
+	// from Publish if it can't. A topic can only have one payload type.
+	RegisterTopic(topic Topic, payload interface{}) error
+
+	// Intercept adds an interceptor for the topics that the matcher
+	// matches. See Interceptor.
+	Intercept(matcher TopicMatcher, interceptor Interceptor) (Unsubscriber, error)
+
+	// PublishJSON publishes the JSON object read from the reader. The
+	// object is decoded straight into the map form of the data, so a
+	// request body can be published without first being read into memory
+	// and decoded into a structure. The reader must contain exactly one
+	// JSON object. Numbers are decoded as float64, as they are when
+	// structures are published through the JSONMarshaller.
+	PublishJSON(topic Topic, r io.Reader) (Completer, error)
+
+	// PublishSerialized is the same as PublishCtx, but also returns the
+	// message as it was given to the subscribers, so callers that store
+	// or forward the message can use exactly what was published rather
+	// than serializing the data again.
+	PublishSerialized(ctx context.Context, topic Topic, data interface{}) (Completer, *PublishedMessage, error)
 }
 
 // Marshaller defines the Marshal and Unmarshal methods used to serialize and
@@ -29,6 +81,9 @@ type Marshaller interface {
 
 // StructuredHubConfig is the argument struct for NewStructuredHub.
 type StructuredHubConfig struct {
+	// SimpleHubConfig holds the configuration of the underlying simple hub.
+	SimpleHubConfig
+
 	// Marshaller defines how the structured hub will convert from structures to
 	// a map[string]interface{} and back. If this is not specified, the
 	// `JSONMarshaller` is used.
@@ -38,9 +93,97 @@ type StructuredHubConfig struct {
 	// the values are not already set.
 	Annotations map[string]interface{}
 
+	// AnnotationLayers are further annotations that are stacked between
+	// those of the context passed to PublishCtx and the hub's Annotations.
+	// The values are applied in order of precedence: the published data
+	// itself, then the context annotations, then each layer in the order
+	// given, and the hub's Annotations last. Each layer has its own policy
+	// for keys that already have a value, so a layer can override the
+	// values set before it, or refuse to publish messages that conflict
+	// with it.
+	AnnotationLayers []AnnotationLayer
+
 	// PostProcess allows the caller to modify the resulting
 	// map[string]interface{}.
 	PostProcess func(map[string]interface{}) (map[string]interface{}, error)
+
+	// DecodeHook, if specified, is called for each field of a handler's
+	// structure as the published data is converted into it. This allows
+	// the data to be converted into custom types without those types
+	// needing to implement the unmarshalling interfaces of the Marshaller.
+	DecodeHook DecodeHook
+
+	// DecodeLimits guard the subscribers against pathological payloads.
+	DecodeLimits DecodeLimits
+
+	// KeyCodecs, if specified, convert the keys of maps with the given key
+	// types to and from strings, so payloads can contain maps with keys
+	// that the Marshaller can't use as object keys. Structures containing
+	// such maps are converted using the names from their `json` struct
+	// tags, so they should be published and subscribed to as structures
+	// rather than through types with their own marshalling methods.
+	KeyCodecs map[reflect.Type]KeyCodec
+
+	// CanonicalText, if true, converts the values in the payloads whose
+	// types implement encoding.TextMarshaler, or failing that
+	// encoding.BinaryMarshaler, into their text form in the map form of the
+	// data, with binary forms encoded as base64. Subscribers get the values
+	// back using UnmarshalText or UnmarshalBinary. This is done even where
+	// the Marshaller wouldn't use the methods, such as for methods with
+	// pointer receivers on values that aren't addressable, or for
+	// marshallers that don't know about the interfaces. Types that
+	// implement json.Marshaler are left to the Marshaller.
+	CanonicalText bool
+
+	// TrackProvenance, if true, records which fields of each message were
+	// added by the hub rather than published, and passes the record to
+	// the handlers in the ProvenanceHeader of the message. Handlers get it
+	// with ProvenanceFromContext.
+	TrackProvenance bool
+
+	// Strict, if true, forces all the publishers and subscribers of the
+	// hub to use the payload types registered with RegisterTopic, so the
+	// shape of the messages can't drift from the registered types.
+	// Publishing on a topic without a registered type, or publishing data
+	// that is a map[string]interface{}, including through PublishJSON,
+	// fails with a NotValid error. Subscribing or replacing with a handler
+	// that takes the map form of the data also fails. Messages forwarded
+	// between hubs are published as maps, so a strict hub can't be the
+	// target of a bridge or a peer.
+	Strict bool
+
+	// SerializeWorkers, if positive, moves the serialization of the data
+	// published with Publish and PublishCtx off the publisher's goroutine,
+	// so publishing a large payload doesn't hold up the publisher. Up to
+	// this many messages are serialized at once, and Publish only blocks
+	// when that many are already being serialized. The messages are still
+	// passed to the subscribers in the order they were published, and
+	// Barriers are queued after the messages published before them.
+	//
+	// The Completer returned covers the serialization as well as the
+	// subscribers, and implements PublishErrorer, as serialization errors
+	// can't be returned from Publish. They are also reported to the
+	// ErrorHandler. As the data is serialized after Publish returns, it
+	// must not be modified once it is published. PublishSerialized and
+	// PublishAndWaitLocal serialize on the publisher's goroutine as
+	// before, so their messages may overtake those still being serialized.
+	SerializeWorkers int
+
+	// PoolMaps, if true, reuses the maps that the data published with
+	// Publish and PublishCtx is converted into, once every subscriber has
+	// finished with the message, for the next data of the same type. It
+	// cuts the allocations of hubs that publish at a high rate. Only maps
+	// made by the JSONMarshaller are reused, and only the map itself, not
+	// the values nested in it.
+	//
+	// Handlers, taps and interceptors that are given the map form of the
+	// data must not keep it after they return, or publish it again with
+	// another context. Subscriptions that need to keep the data, or change
+	// it, should use the CopyData option. The channels of SubscribeChan,
+	// and the messages returned from Drain, are given copies. The maps of
+	// PublishSerialized are never reused, as they are returned to the
+	// publisher. PoolMaps is ignored by hubs that Retain messages.
+	PoolMaps bool
 }
 
 // JSONMarshaller simply wraps the json.Marshal and json.Unmarshal calls for the
@@ -57,72 +200,303 @@ func (*jsonMarshaller) Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
-// NewStructuredHub returns a new Hub instance.
-func NewStructuredHub(config *StructuredHubConfig) Hub {
+// NewStructuredHub returns a new StructuredHub instance.
+func NewStructuredHub(config *StructuredHubConfig) StructuredHub {
 	if config == nil {
 		config = new(StructuredHubConfig)
 	}
 	if config.Marshaller == nil {
 		config.Marshaller = JSONMarshaller
 	}
-	return &structuredHub{
+	hub := &structuredHub{
 		simplehub: simplehub{
 			logger: loggo.GetLogger("pubsub.structured"),
 		},
-		marshaller:  config.Marshaller,
-		annotations: config.Annotations,
-		postProcess: config.PostProcess,
+		marshaller:      config.Marshaller,
+		annotations:     config.Annotations,
+		layers:          append([]AnnotationLayer(nil), config.AnnotationLayers...),
+		postProcess:     config.PostProcess,
+		trackProvenance: config.TrackProvenance,
+		decoder: decoder{
+			marshaller: config.Marshaller,
+			hook:       config.DecodeHook,
+			limits:     config.DecodeLimits,
+			codecs: payloadCodecs{
+				keys: config.KeyCodecs,
+				text: config.CanonicalText,
+			},
+			strict:    config.Strict,
+			providers: config.Providers,
+		},
 	}
+	hub.offload = newSerializeOffload(hub, config.SerializeWorkers)
+	hub.maps = newMapPool(config.PoolMaps && config.Retain <= 0)
+	hub.publish = hub.PublishCtx
+	hub.configure(&config.SimpleHubConfig)
+	return hub
 }
 
 // Publish implements Hub.
 func (h *structuredHub) Publish(topic Topic, data interface{}) (Completer, error) {
-	asMap, err := h.toStringMap(data)
+	return h.PublishCtx(context.Background(), topic, data)
+}
+
+// PublishCtx implements ContextPublisher.
+func (h *structuredHub) PublishCtx(ctx context.Context, topic Topic, data interface{}) (Completer, error) {
+	if h.offload != nil && localWaitFromContext(ctx) == nil {
+		return h.offload.publish(ctx, topic, data), nil
+	}
+	ctx, message, err := h.serializePooled(ctx, topic, data)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, err
+	}
+	result, _, err := h.publishMessage(ctx, message)
+	return result, err
+}
+
+// PublishSerialized implements StructuredHub.
+func (h *structuredHub) PublishSerialized(ctx context.Context, topic Topic, data interface{}) (Completer, *PublishedMessage, error) {
+	ctx, message, err := h.serialize(ctx, topic, data)
+	if err != nil {
+		return nil, nil, err
 	}
-	for key, defaultValue := range h.annotations {
-		if value, exists := asMap[key]; !exists || value == reflect.Zero(reflect.TypeOf(value)).Interface() {
-			asMap[key] = defaultValue
+	return h.publishMessage(ctx, message)
+}
+
+// serialize converts the data into the map form that is passed to the
+// subscribers. The context returned is the one to publish the message
+// with.
+func (h *structuredHub) serialize(ctx context.Context, topic Topic, data interface{}) (context.Context, *PublishedMessage, error) {
+	return h.serializeMap(ctx, topic, data, nil)
+}
+
+// serializePooled is serialize for messages that aren't returned to the
+// publisher, so the map can be taken from the pool of the hub, if it has
+// one, and returned to it once the message has been handled.
+func (h *structuredHub) serializePooled(ctx context.Context, topic Topic, data interface{}) (context.Context, *PublishedMessage, error) {
+	return h.serializeMap(ctx, topic, data, h.maps)
+}
+
+func (h *structuredHub) serializeMap(ctx context.Context, topic Topic, data interface{}, pool *mapPool) (context.Context, *PublishedMessage, error) {
+	if h.decoder.strict && isMap(data) {
+		return nil, nil, h.publishError(PhasePublish, topic, errors.NotValidf("untyped publish on strict hub"))
+	}
+	if data == nil {
+		// There is nothing to convert, so a registered topic reports the
+		// payload type it was expecting.
+		err := h.checkPayload(topic, data, nil)
+		if err == nil {
+			err = errors.NotValidf("nil data")
 		}
+		return nil, nil, h.publishError(PhasePublish, topic, errors.Trace(err))
+	}
+	asMap, pooled, err := h.toMap(data, pool)
+	if err != nil {
+		return nil, nil, h.publishError(PhaseSerialize, topic, errors.Trace(err))
+	}
+	// The payload is checked against the type registered for the topic the
+	// caller used, before the annotations and interceptors change either.
+	if err := h.checkPayload(topic, data, asMap); err != nil {
+		return nil, nil, h.publishError(PhasePublish, topic, errors.Trace(err))
+	}
+	pooledMap := asMap
+	var provenance Provenance
+	if h.trackProvenance {
+		provenance = make(Provenance)
+	}
+	annotate(asMap, AnnotationsFromContext(ctx), provenance, ProvenanceContext)
+	if err := applyLayers(ctx, topic, asMap, h.layers, provenance); err != nil {
+		return nil, nil, h.publishError(PhaseSerialize, topic, errors.Trace(err))
 	}
+	annotate(asMap, h.annotations, provenance, ProvenanceHub)
+	annotated := provenance.keys(asMap)
 	if h.postProcess != nil {
 		asMap, err = h.postProcess(asMap)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return nil, nil, h.publishError(PhaseSerialize, topic, errors.Trace(err))
 		}
 	}
-	h.logger.Tracef("publish %q: %#v", topic, asMap)
-	return h.simplehub.Publish(topic, asMap)
+	topic, asMap, ok := h.intercept(topic, asMap)
+	if !ok {
+		h.logger.Tracef("publish %q vetoed by interceptor", topic)
+		return ctx, &PublishedMessage{Topic: topic, Vetoed: true}, nil
+	}
+	if provenance != nil {
+		provenance.processed(annotated, asMap)
+		ctx = withProvenance(ctx, provenance)
+	}
+	if pool != nil && pooled && sameMap(asMap, pooledMap) {
+		// The map is only reused if the post processing and interceptors
+		// kept it.
+		ctx = pool.withPooledData(ctx, reflect.TypeOf(data), asMap)
+	}
+	return ctx, &PublishedMessage{
+		Topic:      topic,
+		Data:       asMap,
+		marshaller: h.marshaller,
+	}, nil
+}
+
+// publishMessage passes the serialized message to the subscribers.
+func (h *structuredHub) publishMessage(ctx context.Context, message *PublishedMessage) (Completer, *PublishedMessage, error) {
+	if message.Vetoed {
+		return completed(), message, nil
+	}
+	h.logger.Tracef("publish %q: %#v", message.Topic, message.Data)
+	result, err := h.simplehub.PublishCtx(ctx, message.Topic, message.Data)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return result, message, nil
+}
+
+// PublishedMessage is the form of a message as it was published on a
+// structured hub, returned from PublishSerialized.
+type PublishedMessage struct {
+	// Topic is the topic the message was published on, which may have
+	// been changed by an interceptor.
+	Topic Topic
+
+	// Data is the map form of the data that was passed to the
+	// subscribers, with the annotations, post processing, and
+	// interceptors applied. It is shared with the subscribers, so it must
+	// not be modified.
+	Data map[string]interface{}
+
+	// Vetoed is true if an interceptor stopped the message from being
+	// published. The Data is nil for vetoed messages.
+	Vetoed bool
+
+	marshaller Marshaller
+}
+
+// Encode returns the data serialized by the hub's Marshaller, for storing
+// or forwarding the message exactly as it was published.
+func (m *PublishedMessage) Encode() ([]byte, error) {
+	if m.Vetoed {
+		return nil, errors.Errorf("message on %q was vetoed", m.Topic)
+	}
+	bytes, err := m.marshaller.Marshal(m.Data)
+	return bytes, errors.Trace(err)
+}
+
+// PublishJSON implements StructuredHub.
+func (h *structuredHub) PublishJSON(topic Topic, r io.Reader) (Completer, error) {
+	decoder := json.NewDecoder(r)
+	var data map[string]interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil, h.publishError(PhaseSerialize, topic, errors.Annotate(err, "decoding JSON"))
+	}
+	if data == nil {
+		return nil, h.publishError(PhaseSerialize, topic, errors.New("decoding JSON: null object"))
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, h.publishError(PhaseSerialize, topic, errors.New("decoding JSON: data after object"))
+	}
+	return h.PublishCtx(context.Background(), topic, data)
+}
+
+// isMap returns true if the data is published as the map form of the data
+// rather than as a value of a payload type.
+func isMap(data interface{}) bool {
+	dataType := reflect.TypeOf(data)
+	return dataType != nil && dataType.AssignableTo(reflect.TypeOf(map[string]interface{}(nil)))
 }
 
 func (h *structuredHub) toStringMap(data interface{}) (map[string]interface{}, error) {
+	result, _, err := h.toMap(data, nil)
+	return result, err
+}
+
+// toMap converts the data into its map form. The bool result is true if
+// the map was made by the hub with the JSONMarshaller, and so can be
+// returned to the pool once the message has been handled. If the pool
+// isn't nil, the map is taken from it if it has one for the type of the
+// data.
+func (h *structuredHub) toMap(data interface{}, pool *mapPool) (map[string]interface{}, bool, error) {
 	var result map[string]interface{}
 	resultType := reflect.TypeOf(result)
 	dataType := reflect.TypeOf(data)
 	if dataType.AssignableTo(resultType) {
 		cast, ok := data.(map[string]interface{})
 		if !ok {
-			return nil, errors.Errorf("%T assignable to map[string]interface{} but isn't one?", data)
+			return nil, false, errors.Errorf("%T assignable to map[string]interface{} but isn't one?", data)
 		}
-		return cast, nil
+		return cast, false, nil
+	}
+	if m, ok := data.(MapMarshaler); ok && h.marshaller == JSONMarshaller {
+		result, err := m.MarshalMap()
+		if err != nil {
+			return nil, false, errors.Annotate(err, "marshalling")
+		}
+		return result, false, nil
+	}
+	if h.decoder.codecs.needed(dataType) {
+		encoded, err := h.decoder.codecs.encode(reflect.ValueOf(data))
+		if err != nil {
+			return nil, false, errors.Annotate(err, "marshalling")
+		}
+		data = encoded
 	}
 	bytes, err := h.marshaller.Marshal(data)
 	if err != nil {
-		return nil, errors.Annotate(err, "marshalling")
+		return nil, false, errors.Annotate(err, "marshalling")
+	}
+	if h.marshaller == JSONMarshaller {
+		// Unmarshalling into a map adds to it rather than replacing it,
+		// and the maps in the pool are empty.
+		result = pool.get(dataType)
 	}
 	err = h.marshaller.Unmarshal(bytes, &result)
 	if err != nil {
-		return nil, errors.Annotate(err, "unmarshalling")
+		return nil, false, errors.Annotate(err, "unmarshalling")
 	}
-	return result, nil
+	return result, h.marshaller == JSONMarshaller, nil
 }
 
 // Subscribe implements Hub.
-func (h *structuredHub) Subscribe(matcher TopicMatcher, handler interface{}) (Unsubscriber, error) {
-	callback, err := newStructuredCallback(h.marshaller, handler)
+func (h *structuredHub) Subscribe(matcher TopicMatcher, handler interface{}, options ...SubscribeOption) (Subscription, error) {
+	callback, err := h.newCallback(handler, options)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	subscription, err := h.simplehub.Subscribe(matcher, callback.handler, options...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.replaceable(subscription, options), nil
+}
+
+// replaceable arranges for the handlers passed to Replace on the
+// subscription to be wrapped like those passed to Subscribe.
+func (h *structuredHub) replaceable(subscription Subscription, options []SubscribeOption) Subscription {
+	subscription.(*handle).convert = func(handler interface{}) (interface{}, error) {
+		callback, err := h.newCallback(handler, options)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return callback.handler, nil
+	}
+	return subscription
+}
+
+// newCallback returns the callback that converts the published data for
+// the handler, using the marshaller and projection from the options if
+// there are any.
+func (h *structuredHub) newCallback(handler interface{}, options []SubscribeOption) (*structuredCallback, error) {
+	decoder := h.decoder
+	opts := newSubscribeOptions(options)
+	if opts.marshaller != nil {
+		decoder.marshaller = opts.marshaller
+	}
+	projection, err := parseProjection(opts.projection)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	callback, err := newStructuredCallback(decoder, handler)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	return h.simplehub.Subscribe(matcher, callback.handler)
+	callback.projection = projection
+	return callback, nil
 }
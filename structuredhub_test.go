@@ -4,7 +4,11 @@
 package pubsub_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -61,8 +65,8 @@ func (*StructuredHubSuite) TestSubscribeHandler(c *gc.C) {
 			err:         "expected 3 args, got 2, incorrect handler signature not valid",
 		}, {
 			description: "bad return values in handler function",
-			handler:     func(pubsub.Topic, interface{}, error) error { return nil },
-			err:         "expected no return values, got 1, incorrect handler signature not valid",
+			handler:     func(pubsub.Topic, map[string]interface{}, error) bool { return false },
+			err:         "expected no return values or an error, incorrect handler signature not valid",
 		}, {
 			description: "bad first arg",
 			handler:     func(string, map[string]interface{}, error) {},
@@ -85,6 +89,13 @@ func (*StructuredHubSuite) TestSubscribeHandler(c *gc.C) {
 		}, {
 			description: "accept struct value",
 			handler:     func(pubsub.Topic, Emitter, error) {},
+		}, {
+			description: "accept context",
+			handler:     func(context.Context, pubsub.Topic, Emitter, error) {},
+		}, {
+			description: "bad context position",
+			handler:     func(pubsub.Topic, Emitter, error, context.Context) {},
+			err:         "expected 3 args, got 4, incorrect handler signature not valid",
 		},
 	} {
 		c.Logf("test %d: %s", i, test.description)
@@ -412,3 +423,602 @@ func (*StructuredHubSuite) TestMultipleSubscribersSingleInstance(c *gc.C) {
 	c.Check(w.fromMap, jc.DeepEquals, []string{message})
 	c.Check(w.fromStruct, jc.DeepEquals, []string{message})
 }
+
+type Level int
+
+const (
+	LevelUnknown Level = iota
+	LevelInfo
+	LevelError
+)
+
+type LevelMessage struct {
+	Message string `json:"message"`
+	Level   Level  `json:"level"`
+}
+
+var levelType = reflect.TypeOf(LevelUnknown)
+
+func levelDecodeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != levelType || from.Kind() != reflect.String {
+		return data, nil
+	}
+	switch data {
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	}
+	return nil, errors.New("unknown level")
+}
+
+func (*StructuredHubSuite) TestDecodeHook(c *gc.C) {
+	var obtained []LevelMessage
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			DecodeHook: levelDecodeHook,
+		})
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data LevelMessage, err error) {
+		if err != nil {
+			c.Check(err, gc.ErrorMatches, `decode hook: field "Level": unknown level`)
+			return
+		}
+		obtained = append(obtained, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	source := map[string]interface{}{"message": "hello", "level": "error"}
+	_, err = hub.Publish(topic, source)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, map[string]interface{}{"message": "bad", "level": "wat"})
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, map[string]interface{}{"message": "world", "level": 1})
+	c.Assert(err, jc.ErrorIsNil)
+
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	c.Check(obtained, jc.DeepEquals, []LevelMessage{
+		{Message: "hello", Level: LevelError},
+		{Message: "world", Level: LevelInfo},
+	})
+	// The published map is not modified by the hook.
+	c.Check(source["level"], gc.Equals, "error")
+}
+
+type LevelMap struct {
+	Levels map[string]Level `json:"levels"`
+}
+
+func (*StructuredHubSuite) TestDecodeHookMap(c *gc.C) {
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			DecodeHook: levelDecodeHook,
+		})
+	received := make(chan LevelMap, 1)
+	errs := make(chan error, 1)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data LevelMap, err error) {
+		if err != nil {
+			errs <- err
+			return
+		}
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	source := map[string]interface{}{"info": "info", "error": "error"}
+	_, err = hub.Publish(topic, map[string]interface{}{"levels": source})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data.Levels, jc.DeepEquals, map[string]Level{
+			"info":  LevelInfo,
+			"error": LevelError,
+		})
+	case <-time.After(time.Second):
+		c.Fatal("map not received")
+	}
+	// The published map is not modified by the hook.
+	c.Check(source["info"], gc.Equals, "info")
+
+	_, err = hub.Publish(topic, map[string]interface{}{"levels": map[string]interface{}{"bad": "wat"}})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case err := <-errs:
+		c.Check(err, gc.ErrorMatches, `decode hook: field "Levels": key "bad": unknown level`)
+	case <-time.After(time.Second):
+		c.Fatal("error not received")
+	}
+}
+
+type EmbeddedLevel struct {
+	LevelMessage
+	Source string `json:"source"`
+}
+
+type EmbeddedLevelPointer struct {
+	*LevelMessage
+	Level string `json:"level"`
+}
+
+func (*StructuredHubSuite) TestDecodeHookEmbedded(c *gc.C) {
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			DecodeHook: levelDecodeHook,
+		})
+	embedded := make(chan EmbeddedLevel, 1)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data EmbeddedLevel, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		embedded <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	// The outer Level field shadows the embedded one, so the hook leaves
+	// the value alone.
+	shadowed := make(chan EmbeddedLevelPointer, 1)
+	sub, err = hub.Subscribe(topic, func(topic pubsub.Topic, data EmbeddedLevelPointer, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		shadowed <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	_, err = hub.Publish(topic, map[string]interface{}{"message": "hello", "level": "error", "source": "unit"})
+	c.Assert(err, jc.ErrorIsNil)
+
+	select {
+	case data := <-embedded:
+		c.Check(data, jc.DeepEquals, EmbeddedLevel{
+			LevelMessage: LevelMessage{Message: "hello", Level: LevelError},
+			Source:       "unit",
+		})
+	case <-time.After(time.Second):
+		c.Fatal("embedded struct not received")
+	}
+	select {
+	case data := <-shadowed:
+		c.Check(data, jc.DeepEquals, EmbeddedLevelPointer{
+			LevelMessage: &LevelMessage{Message: "hello"},
+			Level:        "error",
+		})
+	case <-time.After(time.Second):
+		c.Fatal("embedded pointer not received")
+	}
+}
+
+func (*StructuredHubSuite) TestContextHandler(c *gc.C) {
+	var sequence uint64
+	hub := pubsub.NewStructuredHub(nil)
+	sub, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data JustOrigin, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(data.Origin, gc.Equals, "origin")
+		delivery, ok := pubsub.DeliveryFromContext(ctx)
+		c.Check(ok, jc.IsTrue)
+		sequence = delivery.Sequence
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	_, err = hub.Publish(first, JustOrigin{"other"})
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, JustOrigin{"origin"})
+	c.Assert(err, jc.ErrorIsNil)
+
+	select {
+	case <-result.Complete():
+	case <-time.After(veryShortTime):
+		c.Fatal("publish did not complete")
+	}
+	c.Assert(sequence, gc.Equals, uint64(2))
+}
+
+type Nested struct {
+	Value interface{} `json:"value"`
+}
+
+type slowMarshaller struct {
+	release chan struct{}
+}
+
+func (*slowMarshaller) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (m *slowMarshaller) Unmarshal(data []byte, v interface{}) error {
+	if _, ok := v.(*Nested); ok {
+		<-m.release
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (*StructuredHubSuite) TestDecodeLimits(c *gc.C) {
+	marshaller := &slowMarshaller{release: make(chan struct{})}
+	defer close(marshaller.release)
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			Marshaller: marshaller,
+			DecodeLimits: pubsub.DecodeLimits{
+				MaxDepth: 3,
+				MaxSize:  100,
+				Timeout:  10 * veryShortTime,
+			},
+		})
+	var errs []string
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data Nested, err error) {
+		c.Check(err, jc.Satisfies, pubsub.IsDecodeLimitError)
+		c.Check(data.Value, gc.IsNil)
+		errs = append(errs, err.Error())
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	var mapCalls int
+	sub, err = hub.Subscribe(topic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		// The limits only apply to conversion into structures.
+		c.Check(err, jc.ErrorIsNil)
+		mapCalls++
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	deep := map[string]interface{}{"value": []interface{}{map[string]interface{}{"a": []interface{}{1}}}}
+	_, err = hub.Publish(topic, deep)
+	c.Assert(err, jc.ErrorIsNil)
+	large := map[string]interface{}{"value": strings.Repeat("x", 100)}
+	_, err = hub.Publish(topic, large)
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, map[string]interface{}{"value": "slow"})
+	c.Assert(err, jc.ErrorIsNil)
+
+	select {
+	case <-result.Complete():
+	case <-time.After(time.Second):
+		c.Fatal("publish did not complete")
+	}
+	c.Check(errs, jc.DeepEquals, []string{
+		"decode depth limit of 3 exceeded",
+		"decode size limit of 100 exceeded",
+		"decode timeout of 10ms exceeded",
+	})
+	c.Check(mapCalls, gc.Equals, 3)
+}
+
+func (*StructuredHubSuite) TestContextAnnotations(c *gc.C) {
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			Annotations: map[string]interface{}{
+				"origin":  "hub",
+				"message": "default",
+			},
+		})
+	received := make(chan map[string]interface{}, 1)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	ctx := pubsub.WithAnnotations(context.Background(), map[string]interface{}{
+		"origin":  "request",
+		"request": "one",
+	})
+	ctx = pubsub.WithAnnotations(ctx, map[string]interface{}{
+		"request": "two",
+		"user":    "fred",
+	})
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, MessageID{Key: 42})
+	c.Assert(err, jc.ErrorIsNil)
+
+	select {
+	case data := <-received:
+		c.Assert(data, jc.DeepEquals, map[string]interface{}{
+			"origin":  "request",
+			"message": "default",
+			"id":      float64(42),
+			"request": "two",
+			"user":    "fred",
+		})
+	case <-time.After(time.Second):
+		c.Fatal("message not received")
+	}
+}
+
+func (*StructuredHubSuite) TestAnnotationLayers(c *gc.C) {
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			Annotations: map[string]interface{}{
+				"origin":  "hub",
+				"message": "default",
+				"region":  "hub",
+			},
+			AnnotationLayers: []pubsub.AnnotationLayer{{
+				Name:        "namespace",
+				Annotations: map[string]interface{}{"region": "namespace", "user": "namespace"},
+				Provider: func(ctx context.Context, topic pubsub.Topic) map[string]interface{} {
+					return map[string]interface{}{"topic": string(topic)}
+				},
+			}, {
+				Name:        "tenant",
+				Annotations: map[string]interface{}{"tenant": "acme"},
+				Policy:      pubsub.Override,
+			}},
+		})
+	received := make(chan map[string]interface{}, 1)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	ctx := pubsub.WithAnnotations(context.Background(), map[string]interface{}{
+		"user": "request",
+	})
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, map[string]interface{}{"tenant": "other", "id": 42})
+	c.Assert(err, jc.ErrorIsNil)
+
+	select {
+	case data := <-received:
+		c.Assert(data, jc.DeepEquals, map[string]interface{}{
+			"origin":  "hub",
+			"message": "default",
+			"region":  "namespace",
+			"user":    "request",
+			"topic":   "testing",
+			"tenant":  "acme",
+			"id":      42,
+		})
+	case <-time.After(time.Second):
+		c.Fatal("message not received")
+	}
+}
+
+func (*StructuredHubSuite) TestAnnotationLayerReject(c *gc.C) {
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			AnnotationLayers: []pubsub.AnnotationLayer{{
+				Name:        "tenant",
+				Annotations: map[string]interface{}{"origin": "acme"},
+				Policy:      pubsub.Reject,
+			}},
+		})
+	received := make(chan map[string]interface{}, 1)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	_, err = hub.Publish(topic, JustOrigin{Origin: "other"})
+	c.Check(err, gc.ErrorMatches, `annotation "origin" of layer "tenant" conflicts with value other`)
+
+	// Matching and missing values are fine.
+	for _, origin := range []string{"acme", ""} {
+		_, err = hub.Publish(topic, JustOrigin{Origin: origin})
+		c.Assert(err, jc.ErrorIsNil)
+		select {
+		case data := <-received:
+			c.Check(data, jc.DeepEquals, map[string]interface{}{"origin": "acme"})
+		case <-time.After(time.Second):
+			c.Fatal("message not received")
+		}
+	}
+}
+
+func (*StructuredHubSuite) TestAnnotationLayerTopics(c *gc.C) {
+	hub := pubsub.NewStructuredHub(
+		&pubsub.StructuredHubConfig{
+			AnnotationLayers: []pubsub.AnnotationLayer{{
+				Name:        "api",
+				Annotations: map[string]interface{}{"api-version": "v2"},
+				Topics:      pubsub.MatchRegex(`^api\.`),
+			}, {
+				Name:        "users",
+				Annotations: map[string]interface{}{"api-version": "v3", "table": "users"},
+				Topics:      pubsub.Topic("api.users"),
+			}},
+		})
+	received := make(chan map[string]interface{}, 1)
+	sub, err := hub.Subscribe(pubsub.MatchAll, func(topic pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	for _, test := range []struct {
+		topic    pubsub.Topic
+		expected map[string]interface{}
+	}{{
+		topic:    "api.users",
+		expected: map[string]interface{}{"id": 1, "api-version": "v2", "table": "users"},
+	}, {
+		topic:    "api.models",
+		expected: map[string]interface{}{"id": 1, "api-version": "v2"},
+	}, {
+		topic:    "internal.tick",
+		expected: map[string]interface{}{"id": 1},
+	}} {
+		_, err = hub.Publish(test.topic, map[string]interface{}{"id": 1})
+		c.Assert(err, jc.ErrorIsNil)
+		select {
+		case data := <-received:
+			c.Check(data, jc.DeepEquals, test.expected, gc.Commentf("topic %q", test.topic))
+		case <-time.After(time.Second):
+			c.Fatal("message not received")
+		}
+	}
+}
+
+func (*StructuredHubSuite) TestSubscriptionCodecOverride(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	var (
+		raw       []string
+		yamlRaw   []string
+		fromYAML  []Emitter
+		fromJSON  []Emitter
+		waitGroup sync.WaitGroup
+	)
+	waitGroup.Add(4)
+	sub, err := hub.Subscribe(topic, func(topic pubsub.Topic, data []byte, err error) {
+		defer waitGroup.Done()
+		c.Check(err, jc.ErrorIsNil)
+		raw = append(raw, string(data))
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	sub, err = hub.Subscribe(topic, func(topic pubsub.Topic, data []byte, err error) {
+		defer waitGroup.Done()
+		c.Check(err, jc.ErrorIsNil)
+		yamlRaw = append(yamlRaw, string(data))
+	}, pubsub.WithMarshaller(&yamlMarshaller{}))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	sub, err = hub.Subscribe(topic, func(topic pubsub.Topic, data Emitter, err error) {
+		defer waitGroup.Done()
+		c.Check(err, jc.ErrorIsNil)
+		fromYAML = append(fromYAML, data)
+	}, pubsub.WithMarshaller(&yamlMarshaller{}))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	sub, err = hub.Subscribe(topic, func(topic pubsub.Topic, data Emitter, err error) {
+		defer waitGroup.Done()
+		c.Check(err, jc.ErrorIsNil)
+		fromJSON = append(fromJSON, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	_, err = hub.Publish(topic, Emitter{Origin: "test", ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+	waitGroup.Wait()
+
+	c.Check(raw, jc.DeepEquals, []string{`{"id":42,"message":"","origin":"test"}`})
+	c.Check(yamlRaw, jc.DeepEquals, []string{"id: 42\nmessage: \"\"\norigin: test\n"})
+	// The yaml marshaller ignores the json tags, but the lower cased field
+	// names match the keys.
+	c.Check(fromYAML, jc.DeepEquals, []Emitter{{Origin: "test", ID: 42}})
+	c.Check(fromJSON, jc.DeepEquals, []Emitter{{Origin: "test", ID: 42}})
+}
+
+func (*StructuredHubSuite) TestReplace(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	sub, err := hub.Subscribe(topic, func(pubsub.Topic, map[string]interface{}, error) {})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	// The replacement must be a structured handler, but need not take the
+	// same data type as the original.
+	err = sub.Replace(func(pubsub.Topic, interface{}) {})
+	c.Assert(err, gc.ErrorMatches, "expected 3 args, got 2, incorrect handler signature not valid")
+	received := make(chan Emitter, 1)
+	err = sub.Replace(func(topic pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(topic, Emitter{Origin: "test", ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Assert(data, jc.DeepEquals, Emitter{Origin: "test", ID: 42})
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (*StructuredHubSuite) TestPublishJSON(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		Annotations: map[string]interface{}{"origin": "hub"},
+	})
+	received := make(chan Emitter, 1)
+	_, err := hub.Subscribe(topic, func(topic pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.PublishJSON(topic, strings.NewReader(`{"message": "hello", "id": 42}`))
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data, jc.DeepEquals, Emitter{Origin: "hub", Message: "hello", ID: 42})
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
+
+func (*StructuredHubSuite) TestPublishJSONErrors(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	for _, test := range []struct {
+		input string
+		err   string
+	}{{
+		input: `[1, 2]`,
+		err:   "decoding JSON: json: cannot unmarshal array .*",
+	}, {
+		input: `{"id": `,
+		err:   "decoding JSON: unexpected EOF",
+	}, {
+		input: `null`,
+		err:   "decoding JSON: null object",
+	}, {
+		input: `{} {}`,
+		err:   "decoding JSON: data after object",
+	}} {
+		c.Logf("input %q", test.input)
+		_, err := hub.PublishJSON(topic, strings.NewReader(test.input))
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (*StructuredHubSuite) TestPublishSerialized(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		Annotations: map[string]interface{}{"origin": "hub"},
+	})
+	_, err := hub.Intercept(pubsub.Topic("old.name"), func(topic pubsub.Topic, data map[string]interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+		return "new.name", data, true
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+
+	done, published, err := hub.PublishSerialized(context.Background(), "old.name", Emitter{Message: "hello", ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(published.Topic, gc.Equals, pubsub.Topic("new.name"))
+	c.Check(published.Vetoed, jc.IsFalse)
+	c.Check(published.Data, jc.DeepEquals, map[string]interface{}{
+		"origin": "hub", "message": "hello", "id": float64(42),
+	})
+	message := <-messages
+	c.Check(message.Topic, gc.Equals, published.Topic)
+	c.Check(message.Data, jc.DeepEquals, published.Data)
+
+	bytes, err := published.Encode()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(string(bytes), gc.Equals, `{"id":42,"message":"hello","origin":"hub"}`)
+}
+
+func (*StructuredHubSuite) TestPublishSerializedVetoed(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Intercept(topic, func(topic pubsub.Topic, data map[string]interface{}) (pubsub.Topic, map[string]interface{}, bool) {
+		return topic, data, false
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	done, published, err := hub.PublishSerialized(context.Background(), topic, Emitter{Message: "hello"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check(published.Vetoed, jc.IsTrue)
+	c.Check(published.Data, gc.IsNil)
+	_, err = published.Encode()
+	c.Check(err, gc.ErrorMatches, `message on "testing" was vetoed`)
+}
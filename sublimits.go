@@ -0,0 +1,72 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// SubscriberLimitError is the error returned when subscribing to a hub
+// that already has as many subscribers as one of its limits allows. See
+// SimpleHubConfig.MaxSubscribers and MaxSubscribersPerPattern.
+type SubscriberLimitError struct {
+	// Pattern is the matcher of the subscription, as described in the hub
+	// Report, if the limit is the one on the subscribers with the same
+	// pattern. It is empty for the limit on all the subscribers.
+	Pattern string
+
+	// Max is the limit that was reached.
+	Max int
+}
+
+// Error implements error.
+func (e *SubscriberLimitError) Error() string {
+	if e.Pattern == "" {
+		return fmt.Sprintf("hub limit of %d subscribers reached", e.Max)
+	}
+	return fmt.Sprintf("limit of %d subscribers to %q reached", e.Max, e.Pattern)
+}
+
+// IsSubscriberLimitError returns true if the cause of the error is a
+// *SubscriberLimitError.
+func IsSubscriberLimitError(err error) bool {
+	_, ok := errors.Cause(err).(*SubscriberLimitError)
+	return ok
+}
+
+// checkSubscriberLimits returns a *SubscriberLimitError if adding a
+// subscriber with the matcher would go over the limits of the hub. The
+// replaced subscriber, if any, isn't counted. The hub mutex must be held.
+func (h *simplehub) checkSubscriberLimits(matcher TopicMatcher, replaced *subscriber) error {
+	if h.maxSubscribers <= 0 && h.maxPerPattern <= 0 {
+		return nil
+	}
+	total := len(h.subscribers)
+	if replaced != nil {
+		total--
+	}
+	if h.maxSubscribers > 0 && total >= h.maxSubscribers {
+		err := &SubscriberLimitError{Max: h.maxSubscribers}
+		h.logger.Warningf("%v", err)
+		return err
+	}
+	if h.maxPerPattern <= 0 {
+		return nil
+	}
+	pattern := describeMatcher(matcher)
+	count := 0
+	for _, s := range h.subscribers {
+		if s != replaced && describeMatcher(s.topicMatcher) == pattern {
+			count++
+		}
+	}
+	if count >= h.maxPerPattern {
+		err := &SubscriberLimitError{Pattern: pattern, Max: h.maxPerPattern}
+		h.logger.Warningf("%v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type SubscriberLimitSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&SubscriberLimitSuite{})
+
+func (*SubscriberLimitSuite) TestMaxSubscribers(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+		MaxSubscribers: 2,
+	})
+	handler := func(pubsub.Topic, interface{}) {}
+	_, err := hub.Subscribe(first, handler)
+	c.Assert(err, jc.ErrorIsNil)
+	sub, err := hub.Subscribe(second, handler)
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Subscribe(topic, handler)
+	c.Check(err, gc.ErrorMatches, "hub limit of 2 subscribers reached")
+	c.Check(err, jc.Satisfies, pubsub.IsSubscriberLimitError)
+	c.Check(err.(interface{ Cause() error }).Cause(), jc.DeepEquals, &pubsub.SubscriberLimitError{Max: 2})
+
+	// Replacing a subscription doesn't count against the limit, and
+	// unsubscribing makes room.
+	sub, err = hub.(pubsub.Resubscriber).Resubscribe(sub, topic, handler)
+	c.Assert(err, jc.ErrorIsNil)
+	sub.Unsubscribe()
+	_, err = hub.Subscribe(topic, handler)
+	c.Check(err, jc.ErrorIsNil)
+}
+
+func (*SubscriberLimitSuite) TestMaxSubscribersPerPattern(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			MaxSubscribersPerPattern: 2,
+		},
+	})
+	handler := func(pubsub.Topic, map[string]interface{}, error) {}
+	for i := 0; i < 2; i++ {
+		_, err := hub.Subscribe(pubsub.MatchRegex(`^unit`), handler)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	_, err := hub.Subscribe(pubsub.MatchRegex(`^unit`), handler)
+	c.Check(err, gc.ErrorMatches, `limit of 2 subscribers to "\^unit" reached`)
+	c.Check(err, jc.Satisfies, pubsub.IsSubscriberLimitError)
+
+	// Other patterns have their own count.
+	_, err = hub.Subscribe(pubsub.MatchRegex(`^machine`), handler)
+	c.Check(err, jc.ErrorIsNil)
+	_, _, err = hub.(pubsub.ChanSubscriber).SubscribeChan(first, 0)
+	c.Check(err, jc.ErrorIsNil)
+}
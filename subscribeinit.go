@@ -0,0 +1,41 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"github.com/juju/errors"
+)
+
+// SubscribeWithInit subscribes the handler to the topics that the matcher
+// matches on the hub, and then calls init, typically to load the state that
+// the handler keeps up to date. Messages published once the subscription
+// is registered are queued while init runs, and are only handled after it
+// returns, so no change is missed between loading the state and handling
+// the messages. If init fails or panics, the subscription is unsubscribed,
+// dropping the queued messages, and the error is returned.
+//
+// The subscription is held back with the WarmUp option, so any WarmUp
+// option passed in is ignored.
+func SubscribeWithInit(hub Hub, matcher TopicMatcher, init func() error, handler interface{}, options ...SubscribeOption) (Subscription, error) {
+	if init == nil {
+		return nil, errors.NotValidf("missing init")
+	}
+	options = append(options[:len(options):len(options)], WarmUp(0))
+	subscription, err := hub.Subscribe(matcher, handler, options...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	initialized := false
+	defer func() {
+		if !initialized {
+			subscription.Unsubscribe()
+		}
+	}()
+	if err := init(); err != nil {
+		return nil, errors.Annotate(err, "initializing subscription")
+	}
+	initialized = true
+	subscription.Ready()
+	return subscription, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type SubscribeInitSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&SubscribeInitSuite{})
+
+func (*SubscribeInitSuite) TestMissingInit(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := pubsub.SubscribeWithInit(hub, topic, nil, func(pubsub.Topic, interface{}) {})
+	c.Check(err, gc.ErrorMatches, "missing init not valid")
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+}
+
+func (*SubscribeInitSuite) TestBadHandler(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	called := false
+	_, err := pubsub.SubscribeWithInit(hub, topic, func() error {
+		called = true
+		return nil
+	}, "not a handler")
+	c.Check(err, gc.ErrorMatches, "handler of type string not valid")
+	c.Check(called, jc.IsFalse)
+}
+
+func (*SubscribeInitSuite) TestMessagesDuringInitQueued(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	receiver := &orderedReceiver{}
+	var published []pubsub.Completer
+	sub, err := pubsub.SubscribeWithInit(hub, topic, func() error {
+		// The state is loaded while other goroutines publish changes.
+		for i := 0; i < 3; i++ {
+			done, err := hub.Publish(topic, i)
+			c.Assert(err, jc.ErrorIsNil)
+			published = append(published, done)
+		}
+		select {
+		case <-published[0].Complete():
+			c.Fatal("message handled before init finished")
+		case <-time.After(10 * time.Millisecond):
+		}
+		c.Check(receiver.get(), gc.HasLen, 0)
+		return nil
+	}, receiver.handle, pubsub.WarmUp(time.Millisecond))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	for _, done := range published {
+		waitComplete(c, done)
+	}
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{0, 1, 2})
+}
+
+func (*SubscribeInitSuite) TestInitFails(c *gc.C) {
+	metrics := &metricsRecorder{}
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{Metrics: metrics})
+	receiver := &orderedReceiver{}
+	var done pubsub.Completer
+	sub, err := pubsub.SubscribeWithInit(hub, topic, func() error {
+		var err error
+		done, err = hub.Publish(topic, "queued")
+		c.Assert(err, jc.ErrorIsNil)
+		return errors.New("no state")
+	}, receiver.handle)
+	c.Check(err, gc.ErrorMatches, "initializing subscription: no state")
+	c.Check(sub, gc.IsNil)
+	waitComplete(c, done)
+	c.Check(receiver.get(), gc.HasLen, 0)
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+	c.Check(metrics.get(), gc.HasLen, 1)
+}
+
+func (*SubscribeInitSuite) TestInitPanics(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	c.Check(func() {
+		pubsub.SubscribeWithInit(hub, topic, func() error {
+			panic("boom")
+		}, func(pubsub.Topic, interface{}) {})
+	}, gc.PanicMatches, "boom")
+	c.Check(hub.(pubsub.Reporter).Report()["subscriber-count"], gc.Equals, 0)
+}
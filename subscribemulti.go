@@ -0,0 +1,38 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"github.com/juju/errors"
+)
+
+// topicsMatcher returns a matcher for the topics of SubscribeMulti.
+func topicsMatcher(topics []string) (TopicMatcher, error) {
+	if len(topics) == 0 {
+		return nil, errors.NotValidf("missing topics")
+	}
+	matchers := make([]TopicMatcher, len(topics))
+	for i, topic := range topics {
+		matchers[i] = Topic(topic)
+	}
+	return MatchAny(matchers...), nil
+}
+
+// SubscribeMulti implements MultiSubscriber.
+func (h *simplehub) SubscribeMulti(topics []string, handler interface{}, options ...SubscribeOption) (Subscription, error) {
+	matcher, err := topicsMatcher(topics)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.Subscribe(matcher, handler, options...)
+}
+
+// SubscribeMulti implements MultiSubscriber.
+func (h *structuredHub) SubscribeMulti(topics []string, handler interface{}, options ...SubscribeOption) (Subscription, error) {
+	matcher, err := topicsMatcher(topics)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.Subscribe(matcher, handler, options...)
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type SubscribeMultiSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&SubscribeMultiSuite{})
+
+func (*SubscribeMultiSuite) TestOrderedAcrossTopics(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder topicRecorder
+	_, err := hub.(pubsub.MultiSubscriber).SubscribeMulti([]string{"first", "second"}, recorder.handle)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The messages aren't waited for one at a time, so they are queued
+	// for the subscriber together.
+	var expected []pubsub.Topic
+	var done pubsub.Completer
+	for i := 0; i < 20; i++ {
+		for _, published := range []pubsub.Topic{first, firstdot, second} {
+			done, err = hub.Publish(published, nil)
+			c.Assert(err, jc.ErrorIsNil)
+			if published != firstdot {
+				expected = append(expected, published)
+			}
+		}
+	}
+	waitComplete(c, done)
+	c.Check(recorder.get(), jc.DeepEquals, expected)
+}
+
+func (*SubscribeMultiSuite) TestUnsubscribe(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var recorder topicRecorder
+	sub, err := hub.(pubsub.MultiSubscriber).SubscribeMulti([]string{"first", "second"}, recorder.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	publishTopics(c, hub, first)
+	sub.Unsubscribe()
+	publishTopics(c, hub, first, second)
+	c.Check(recorder.get(), jc.DeepEquals, []pubsub.Topic{first})
+}
+
+func (*SubscribeMultiSuite) TestStructured(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	var received []Emitter
+	_, err := hub.(pubsub.MultiSubscriber).SubscribeMulti([]string{"first", "second"}, func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received = append(received, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	for i, published := range []pubsub.Topic{first, space, second} {
+		done, err := hub.Publish(published, Emitter{ID: i})
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	c.Check(received, jc.DeepEquals, []Emitter{{ID: 0}, {ID: 2}})
+}
+
+func (*SubscribeMultiSuite) TestMissingTopics(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.(pubsub.MultiSubscriber).SubscribeMulti(nil, func(pubsub.Topic, interface{}) {})
+	c.Check(err, gc.ErrorMatches, "missing topics not valid")
+}
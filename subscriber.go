@@ -4,31 +4,165 @@
 package pubsub
 
 import (
+	"context"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/juju/loggo"
-	"github.com/juju/utils/deque"
 )
 
 var logger = loggo.GetLogger("pubsub.subscriber")
 
 type subscriber struct {
-	id int
+	id   int
+	name string
 
 	topicMatcher TopicMatcher
-	handler      func(topic Topic, data interface{})
+
+	// staticMatcher is true if the results of the topic matcher can be
+	// cached.
+	staticMatcher bool
+
+	// capture is the topic matcher if it captures parts of the topics it
+	// matches for the handler.
+	capture CapturingMatcher
+
+	// handler is protected by the mutex, as it can be replaced.
+	handler func(ctx context.Context, topic Topic, data interface{}) error
+
+	// ctx is the parent of the contexts passed to the handler, and is
+	// cancelled when the subscriber is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	mutex   sync.Mutex
-	pending *deque.Deque
+	pending Queue
 	closed  chan struct{}
 	data    chan struct{}
 	done    chan struct{}
+
+	// inFlight is the hub's semaphore limiting running handlers, and is
+	// nil if there is no limit.
+	inFlight chan struct{}
+
+	// reportError is the hub's function for reporting errors.
+	reportError func(*HubError)
+
+	// metrics is the hub's Metrics, if it has any, and labels are the
+	// metric labels of the subscription.
+	metrics Metrics
+	labels  map[string]string
+
+	// quotas is the hub's tracker of its soft quotas, if it has any.
+	quotas *quotaTracker
+
+	// accept are the content types that the handler accepts, and codecs
+	// are the hub's marshallers used to convert the messages to them.
+	accept []string
+	codecs map[string]Marshaller
+
+	// priority orders the subscriber among the subscribers of the hub,
+	// see Priority.
+	priority int
+
+	// running holds the calls whose handler is running, and when each
+	// started. See InFlight.
+	running map[*handlerCallback]time.Time
+
+	// matched holds the distinct topics of the messages queued for the
+	// subscriber, up to maxMatchedTopics, and matchedTruncated is set if
+	// there were more.
+	matched          map[Topic]struct{}
+	matchedTruncated bool
+
+	// ledger is only set for Idempotent subscribers, and duplicates counts
+	// the messages skipped because the ledger had seen them.
+	ledger     Ledger
+	duplicates uint64
+
+	// copyData is set for the subscribers that asked for their own copy of
+	// the data with CopyData, and copyPooled for those that keep the data
+	// of the messages whose map is reused. See copyCallData.
+	copyData   bool
+	copyPooled bool
+
+	// matchCost is only set for the subscribers of hubs that track the
+	// cost of matching topics.
+	matchCost *matchCost
+
+	// successor is the subscriber that replaced this one, which is given
+	// the messages still notified to it. See Resubscribe.
+	successor *subscriber
+
+	// timestamps is only set for subscribers that validate the timestamps
+	// of the messages they handle.
+	timestamps *TimestampConfig
+
+	// errs counts the errors of the subscriber.
+	errs *errorTracker
+
+	// failover is only set for subscribers in a failover group.
+	failover *failoverState
+
+	// queueGroup is only set for subscribers in a queue group.
+	queueGroup *QueueGroupConfig
+
+	// retry is only set for subscribers that retry failed messages, and
+	// publish is the hub's function used to publish their dead letters.
+	retry   *RetryPolicy
+	publish func(ctx context.Context, topic Topic, data interface{}) (Completer, error)
+
+	// durable is only set for subscribers that spill their queue to a
+	// store. It is protected by the mutex.
+	durable *durableQueue
+
+	// warmUp is only set for subscribers that hold back their messages
+	// until they are ready.
+	warmUp *warmUp
+
+	// workers is only set for subscribers that handle keyed messages in
+	// parallel.
+	workers *workers
+
+	// receipts publishes the hub's delivery receipts, if it has any.
+	receipts *receiptSender
+
+	// coalescing holds the calls waiting in the queue that later calls
+	// on the same topic may be merged into. It is protected by the mutex.
+	coalescing map[Topic][]*handlerCallback
+
+	// delivered is the number of messages that the handler has been called
+	// for, and lastDelivered is when the last of those calls finished. They
+	// are protected by the mutex.
+	delivered     uint64
+	lastDelivered time.Time
+}
+
+// subscriberConfig holds the values used to create a subscriber.
+type subscriberConfig struct {
+	id          int
+	matcher     TopicMatcher
+	handler     interface{}
+	inFlight    chan struct{}
+	queueSize   int
+	reportError func(*HubError)
+	metrics     Metrics
+	quotas      *quotaTracker
+	codecs      map[string]Marshaller
+	errorBudget *ErrorBudget
+	publish     func(ctx context.Context, topic Topic, data interface{}) (Completer, error)
+	failover    *failoverState
+	receipts    *receiptSender
+	options     subscribeOptions
+	matchCost   bool
+	slowMatch   time.Duration
 }
 
-func newSubscriber(matcher TopicMatcher, handler interface{}) (*subscriber, error) {
-	f, err := checkHandler(handler)
+func newSubscriber(config subscriberConfig) (*subscriber, error) {
+	matcher := config.matcher
+	f, err := checkHandler(config.handler)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -37,13 +171,90 @@ func newSubscriber(matcher TopicMatcher, handler interface{}) (*subscriber, erro
 	// call in the loop function.
 	closed := make(chan struct{})
 	close(closed)
+	ctx, cancel := context.WithCancel(context.Background())
 	sub := &subscriber{
+		ctx:          ctx,
+		cancel:       cancel,
+		id:           config.id,
+		name:         config.options.name,
+		metrics:      config.metrics,
+		quotas:       config.quotas,
+		accept:       config.options.accept,
+		codecs:       config.codecs,
+		labels:       config.options.labels,
+		failover:     config.failover,
+		retry:        config.options.retry,
+		publish:      config.publish,
 		topicMatcher: matcher,
 		handler:      f,
-		pending:      deque.New(),
+		pending:      newFIFOQueue(),
 		data:         make(chan struct{}, 1),
 		done:         make(chan struct{}),
 		closed:       closed,
+		inFlight:     config.inFlight,
+		errs:         newErrorTracker(config.errorBudget),
+	}
+	sub.reportError = sub.countingErrors(config.reportError)
+	sub.staticMatcher = isStaticMatcher(matcher)
+	sub.capture = capturingMatcher(matcher)
+	sub.queueGroup = config.options.queueGroup
+	sub.receipts = config.receipts
+	sub.priority = config.options.priority
+	sub.copyData = config.options.copyData
+	sub.copyPooled = config.options.copyPooled
+	sub.running = make(map[*handlerCallback]time.Time)
+	if config.options.ledger != nil {
+		if sub.name == "" {
+			return nil, errors.NotValidf("idempotent subscription without a name")
+		}
+		sub.ledger = config.options.ledger
+	}
+	if config.matchCost {
+		sub.matchCost = &matchCost{slow: config.slowMatch}
+	}
+	if timestamps := config.options.timestamps; timestamps != nil {
+		if err := timestamps.Validate(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		sub.timestamps = timestamps
+	}
+	if retry := config.options.retry; retry != nil {
+		if err := retry.Validate(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if config.options.queue != nil {
+		if config.options.durable != nil {
+			return nil, errors.NotValidf("durable subscription with a queue")
+		}
+		sub.pending = config.options.queue
+	} else if config.queueSize > 0 && config.options.durable == nil {
+		sub.pending = NewRingQueue(config.queueSize)
+	}
+	if durable := config.options.durable; durable != nil {
+		if config.options.parallel > 1 {
+			return nil, errors.NotValidf("durable subscription with Parallel")
+		}
+		if config.options.retry != nil {
+			// A retried message is handled out of order, and the store
+			// is trimmed up to each record handled, so the record of a
+			// message waiting for its retry could be trimmed.
+			return nil, errors.NotValidf("durable subscription with Retry")
+		}
+		sub.durable, err = newDurableQueue(config.options.name, *durable)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if sub.durable.len() > 0 {
+			// Start the loop delivering the restored messages.
+			sub.data <- struct{}{}
+		}
+	}
+	if config.options.warmUp != nil {
+		sub.warmUp = newWarmUp(*config.options.warmUp)
+	}
+	if config.options.parallel > 1 {
+		sub.startWorkers(config.options.parallel)
 	}
 	go sub.loop()
 	logger.Debugf("created subscriber %p for %v", sub, matcher)
@@ -51,17 +262,39 @@ func newSubscriber(matcher TopicMatcher, handler interface{}) (*subscriber, erro
 }
 
 func (s *subscriber) close() {
+	// Running handlers are told straight away, so they can give up on work
+	// that is no longer needed.
+	s.cancel()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	// need to iterate through all the pending calls and make sure the wait group
 	// is decremented. this isn't exposed yet, but needs to be.
-	for call, ok := s.pending.PopFront(); ok; call, ok = s.pending.PopFront() {
-		call.(*handlerCallback).done()
+	for message, ok := s.pending.Pop(); ok; message, ok = s.pending.Pop() {
+		s.recordDropped(message.call)
+		message.call.done()
+	}
+	s.coalescing = nil
+	if s.durable != nil {
+		// The spilled messages stay in the store for the next durable
+		// subscriber with the same name.
+		for call, ok := s.durable.calls.PopFront(); ok; call, ok = s.durable.calls.PopFront() {
+			s.recordDropped(call.(*handlerCallback))
+			call.(*handlerCallback).done()
+		}
+		s.durable.restored = 0
 	}
 	close(s.done)
 }
 
 func (s *subscriber) loop() {
+	defer s.stopWorkers()
+	// A subscriber that is replaced by Resubscribe isn't cancelled until
+	// its running handler has finished.
+	defer s.cancel()
+	if !s.waitReady() {
+		return
+	}
+	goroutine := goroutineID()
 	var next <-chan struct{}
 	for {
 		select {
@@ -81,40 +314,213 @@ func (s *subscriber) loop() {
 		}
 		// call *should* never be nil as we should only be calling
 		// popOne in the situations where there is actually something to pop.
-		if call != nil {
-			logger.Tracef("exec callback %p (%d) func %p", s, s.id, s.handler)
-			s.handler(call.topic, call.data)
-			call.done()
+		if call == nil {
+			continue
 		}
+		call.goroutine = goroutine
+		if !s.dispatch(call) {
+			return
+		}
+	}
+}
+
+// dispatch arranges for the handler to be called for the call. It returns
+// false if the subscriber has been closed.
+func (s *subscriber) dispatch(call *handlerCallback) bool {
+	if s.workers != nil {
+		return s.dispatchParallel(call)
+	}
+	return s.execute(call)
+}
+
+// execute calls the handler for the call, and marks the call as done. It
+// returns false if the subscriber was closed while waiting to call the
+// handler.
+func (s *subscriber) execute(call *handlerCallback) bool {
+	if call.barrier {
+		if call.rebalance != nil {
+			s.queueGroup.OnRebalance(*call.rebalance)
+		}
+		s.durableHandled(call)
+		call.done()
+		return true
+	}
+	if call.cancelled() {
+		logger.Tracef("dropping cancelled call %p (%d)", s, s.id)
+		s.recordDropped(call)
+		s.durableHandled(call)
+		call.done()
+		return true
+	}
+	if s.quarantined() || s.duplicate(call) {
+		s.recordDropped(call)
+		s.durableHandled(call)
+		call.done()
+		return true
+	}
+	data, headers, err := s.convertContent(call)
+	if err != nil {
+		s.reportError(&HubError{
+			Phase:          PhaseDecode,
+			Topic:          call.topic,
+			Subscriber:     s.id,
+			SubscriberName: s.name,
+			Err:            err,
+		})
+		s.recordDropped(call)
+		s.durableHandled(call)
+		call.done()
+		return true
+	}
+	ctx, valid := s.checkTimestamp(s.ctx, call, headers)
+	if !valid {
+		s.recordDropped(call)
+		s.durableHandled(call)
+		call.done()
+		return true
+	}
+	if !s.acquire() {
+		// Unsubscribed while waiting, close has already
+		// marked the pending calls done, but not this one.
+		s.recordDropped(call)
+		call.done()
+		return false
+	}
+	s.mutex.Lock()
+	handler := s.handler
+	s.running[call] = time.Now()
+	s.mutex.Unlock()
+	logger.Tracef("exec callback %p (%d) func %p", s, s.id, handler)
+	ctx = withDelivery(ctx, Delivery{
+		Sequence:    call.sequence,
+		OrderingKey: call.key,
+		Headers:     headers,
+		Retry:       call.retry,
+		Coalesced:   len(call.merged),
+	})
+	ctx = withSubscriberErrors(ctx, s)
+	ctx = captureTopic(ctx, s.capture, call.topic)
+	if s.failover != nil {
+		err = s.callFailoverHandler(ctx, handler, call.topic, data)
+	} else {
+		err = s.callHandler(ctx, handler, call.topic, data)
+	}
+	if err == nil {
+		s.recordProcessed(call)
+	}
+	s.durableHandled(call)
+	s.release()
+	s.recordDelivered(call, err)
+	s.mutex.Lock()
+	delete(s.running, call)
+	s.delivered++
+	s.lastDelivered = time.Now()
+	s.mutex.Unlock()
+	if err != nil {
+		s.handlerFailed(call, err)
+	}
+	call.done()
+	return true
+}
+
+// acquire waits for an in flight slot if the hub limits the number of
+// running handlers. It returns false if the subscriber is closed while
+// waiting.
+func (s *subscriber) acquire() bool {
+	if s.inFlight == nil {
+		return true
+	}
+	select {
+	case s.inFlight <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *subscriber) release() {
+	if s.inFlight != nil {
+		<-s.inFlight
 	}
 }
 
 func (s *subscriber) popOne() (*handlerCallback, bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	val, ok := s.pending.PopFront()
+	s.loadSpilled()
+	message, ok := s.pending.Pop()
 	if !ok {
 		// nothing to do
 		return nil, true
 	}
-	empty := s.pending.Len() == 0
-	return val.(*handlerCallback), empty
+	s.stopCoalescing(message.call)
+	return message.call, s.pendingCount() == 0
 }
 
 func (s *subscriber) notify(call *handlerCallback) {
 	logger.Tracef("notify %d", s.id)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.pending.PushBack(call)
+	if s.successor != nil {
+		s.forward(call)
+		return
+	}
+	select {
+	case <-s.done:
+		// Publish doesn't hold the hub mutex, so it may be using the
+		// subscribers from before the subscriber was closed.
+		call.done()
+		return
+	default:
+	}
+	s.copyCallData(call)
+	s.recordMatched(call)
+	if s.coalesced(call) {
+		return
+	}
+	s.quotas.queue(call)
+	if s.durable != nil {
+		s.notifyDurable(call)
+		select {
+		case s.data <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if evicted, ok := s.pending.Push(QueuedMessage{call: call}); ok {
+		s.stopCoalescing(evicted.call)
+		s.recordDropped(evicted.call)
+		evicted.call.done()
+	}
 	if s.pending.Len() == 1 {
-		s.data <- struct{}{}
+		// notify runs on the publisher's goroutine, so signalling the loop
+		// must never block. The data channel holds a single signal, and if
+		// one is already waiting the loop is going to look at the pending
+		// queue anyway.
+		select {
+		case s.data <- struct{}{}:
+		default:
+		}
 	}
 }
 
+// pendingCount returns the number of messages waiting to be handled,
+// including those spilled to a store. The mutex must be held.
+func (s *subscriber) pendingCount() int {
+	count := s.pending.Len()
+	if s.durable != nil {
+		count += s.durable.len()
+	}
+	return count
+}
+
 // checkHandler makes sure that the handler value passed in is a function
-// and has the signature:
+// and has one of the signatures:
 //    func(Topic, interface{})
-func checkHandler(handler interface{}) (func(Topic, interface{}), error) {
+//    func(context.Context, Topic, interface{})
+//    func(Topic, interface{}) error
+//    func(context.Context, Topic, interface{}) error
+func checkHandler(handler interface{}) (func(context.Context, Topic, interface{}) error, error) {
 	logger.Tracef("checkHandler, handler func %v", handler)
 	if handler == nil {
 		return nil, errors.NotValidf("missing handler")
@@ -123,15 +529,23 @@ func checkHandler(handler interface{}) (func(Topic, interface{}), error) {
 	if t.Kind() != reflect.Func {
 		return nil, errors.NotValidf("handler of type %T", handler)
 	}
-	var result func(Topic, interface{})
-	rt := reflect.TypeOf(result)
-	if !t.AssignableTo(rt) {
-		return nil, errors.NotValidf("incorrect handler signature")
-	}
-	f, ok := handler.(func(Topic, interface{}))
-	if !ok {
-		// This shouldn't happen due to the assignable check just above.
-		return nil, errors.NotValidf("incorrect handler signature")
+	switch f := handler.(type) {
+	case func(context.Context, Topic, interface{}) error:
+		return f, nil
+	case func(Topic, interface{}) error:
+		return func(_ context.Context, topic Topic, data interface{}) error {
+			return f(topic, data)
+		}, nil
+	case func(context.Context, Topic, interface{}):
+		return func(ctx context.Context, topic Topic, data interface{}) error {
+			f(ctx, topic, data)
+			return nil
+		}, nil
+	case func(Topic, interface{}):
+		return func(_ context.Context, topic Topic, data interface{}) error {
+			f(topic, data)
+			return nil
+		}, nil
 	}
-	return f, nil
+	return nil, errors.NotValidf("incorrect handler signature")
 }
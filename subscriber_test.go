@@ -4,6 +4,8 @@
 package pubsub
 
 import (
+	"context"
+
 	"github.com/juju/errors"
 	"github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
@@ -33,6 +35,11 @@ func (*SubscriberSuite) TestHander(c *gc.C) {
 		errText: "incorrect handler signature not valid",
 	}, {
 		handler: func(Topic, interface{}) {},
+	}, {
+		handler: func(context.Context, Topic, interface{}) {},
+	}, {
+		handler: func(Topic, interface{}, context.Context) {},
+		errText: "incorrect handler signature not valid",
 	}} {
 		c.Logf("test %d", i)
 		handlerFunc, err := checkHandler(test.handler)
@@ -0,0 +1,74 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"github.com/juju/errors"
+)
+
+// Tap is called inline by Publish for each message whose topic matches the
+// matcher the tap was added with, before the message is queued for any
+// subscribers. Taps suit counters and invariant checks that are too cheap
+// to be worth a subscription and its goroutine.
+//
+// Taps are called on the publishing goroutine, in the order they were
+// added, so they must be fast and must not block. A tap must not call any
+// methods of the hub, as the hub may hold its mutex while calling taps,
+// and a tap that panics panics the publisher. The data must not be
+// modified; for structured hubs it is the map form of the data.
+type Tap func(topic Topic, data interface{})
+
+type tap struct {
+	matcher TopicMatcher
+	tap     Tap
+}
+
+// TapSync implements SyncTapper.
+func (h *simplehub) TapSync(matcher TopicMatcher, handler Tap) (Unsubscriber, error) {
+	if matcher == nil {
+		return nil, errors.NotValidf("missing matcher")
+	}
+	if handler == nil {
+		return nil, errors.NotValidf("missing tap")
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	t := &tap{matcher: matcher, tap: handler}
+	// The taps are replaced rather than changed, as publishers may be
+	// calling the old ones.
+	h.taps = append(h.taps[:len(h.taps):len(h.taps)], t)
+	h.setSubscribers(h.subscribers)
+	return &tapHandle{hub: h, tap: t}, nil
+}
+
+func (h *simplehub) removeTap(t *tap) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, existing := range h.taps {
+		if existing == t {
+			h.taps = append(h.taps[:i:i], h.taps[i+1:]...)
+			h.setSubscribers(h.subscribers)
+			return
+		}
+	}
+}
+
+// callTaps calls the taps that match the topic.
+func callTaps(taps []*tap, topic Topic, data interface{}) {
+	for _, t := range taps {
+		if t.matcher.Match(topic) {
+			t.tap(topic, data)
+		}
+	}
+}
+
+type tapHandle struct {
+	hub *simplehub
+	tap *tap
+}
+
+// Unsubscribe implements Unsubscriber, and removes the tap.
+func (h *tapHandle) Unsubscribe() {
+	h.hub.removeTap(h.tap)
+}
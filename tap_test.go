@@ -0,0 +1,94 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type TapSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&TapSuite{})
+
+func (*TapSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.(pubsub.SyncTapper).TapSync(nil, func(pubsub.Topic, interface{}) {})
+	c.Check(err, gc.ErrorMatches, "missing matcher not valid")
+	_, err = hub.(pubsub.SyncTapper).TapSync(topic, nil)
+	c.Check(err, gc.ErrorMatches, "missing tap not valid")
+}
+
+func (*TapSuite) TestCalledInline(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	// The taps are only called on the publishing goroutine, so the
+	// test can read what they saw without locking.
+	var firstTaps, allTaps []interface{}
+	_, err := hub.(pubsub.SyncTapper).TapSync(first, func(topic pubsub.Topic, data interface{}) {
+		firstTaps = append(firstTaps, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.(pubsub.SyncTapper).TapSync(pubsub.MatchAll, func(topic pubsub.Topic, data interface{}) {
+		allTaps = append(allTaps, topic)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = hub.Publish(first, "one")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(firstTaps, jc.DeepEquals, []interface{}{"one"})
+	_, err = hub.Publish(second, "two")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(firstTaps, jc.DeepEquals, []interface{}{"one"})
+	c.Check(allTaps, jc.DeepEquals, []interface{}{first, second})
+}
+
+func (*TapSuite) TestBeforeSubscribers(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	handler := newBlockingHandler()
+	sub, err := hub.Subscribe(topic, handler.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	var handled []interface{}
+	_, err = hub.(pubsub.SyncTapper).TapSync(topic, func(topic pubsub.Topic, data interface{}) {
+		handled = append(handled, len(handler.get()))
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	done, err := hub.Publish(topic, "data")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(handled, jc.DeepEquals, []interface{}{0})
+	close(handler.release)
+	waitComplete(c, done)
+}
+
+func (*TapSuite) TestUnsubscribe(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var count int
+	tap, err := hub.(pubsub.SyncTapper).TapSync(topic, func(pubsub.Topic, interface{}) { count++ })
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	tap.Unsubscribe()
+	tap.Unsubscribe()
+	_, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(count, gc.Equals, 1)
+}
+
+func (*TapSuite) TestStructuredMapForm(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	var seen []interface{}
+	_, err := hub.(pubsub.SyncTapper).TapSync(topic, func(topic pubsub.Topic, data interface{}) {
+		seen = append(seen, data)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, JustOrigin{Origin: "tap"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(seen, jc.DeepEquals, []interface{}{map[string]interface{}{"origin": "tap"}})
+}
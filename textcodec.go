@@ -0,0 +1,100 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"encoding"
+	"encoding/base64"
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+var (
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// hasTextForm returns true if the canonical text form of values of the
+// type is used, because either the type or a pointer to it implements
+// encoding.TextMarshaler or encoding.BinaryMarshaler.
+func (k payloadCodecs) hasTextForm(t reflect.Type) bool {
+	if !k.text || t.Kind() == reflect.Interface {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	ptr := reflect.PtrTo(t)
+	if t.Implements(jsonMarshalerType) || ptr.Implements(jsonMarshalerType) {
+		return false
+	}
+	return ptr.Implements(textMarshalerType) || ptr.Implements(binaryMarshalerType)
+}
+
+// encodeText returns the text form of the value, which is a string, or nil
+// for nil pointers.
+func encodeText(v reflect.Value) (interface{}, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	// The methods may have pointer receivers, so the value is copied if it
+	// isn't addressable.
+	if !v.CanAddr() {
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		v = copied
+	}
+	switch m := v.Addr().Interface().(type) {
+	case encoding.TextMarshaler:
+		text, err := m.MarshalText()
+		if err != nil {
+			return nil, errors.Annotatef(err, "marshalling %v as text", v.Type())
+		}
+		return string(text), nil
+	case encoding.BinaryMarshaler:
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return nil, errors.Annotatef(err, "marshalling %v as binary", v.Type())
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+	return nil, errors.Errorf("%v has no text form", v.Type())
+}
+
+// decodeText sets v, which must be addressable, from the text form in the
+// data.
+func decodeText(v reflect.Value, data interface{}) error {
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		ptr := reflect.New(t.Elem())
+		if err := decodeText(ptr.Elem(), data); err != nil {
+			return errors.Trace(err)
+		}
+		v.Set(ptr)
+		return nil
+	}
+	text, ok := data.(string)
+	if !ok {
+		return errors.Errorf("expected string for %v, got %T", t, data)
+	}
+	ptr := reflect.PtrTo(t)
+	switch {
+	case ptr.Implements(textMarshalerType) && ptr.Implements(textUnmarshalerType):
+		err := v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+		return errors.Annotatef(err, "unmarshalling %v from text", t)
+	case ptr.Implements(binaryUnmarshalerType):
+		bytes, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return errors.Annotatef(err, "decoding %v", t)
+		}
+		err = v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(bytes)
+		return errors.Annotatef(err, "unmarshalling %v from binary", t)
+	}
+	return errors.Errorf("%v can't be unmarshalled from its text form", t)
+}
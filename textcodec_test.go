@@ -0,0 +1,148 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type TextCodecSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&TextCodecSuite{})
+
+// MachineID has pointer receiver text methods, and no exported fields, so
+// the JSON marshaller only uses the methods if the value is addressable.
+type MachineID struct {
+	n int
+}
+
+func (id *MachineID) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("machine-%d", id.n)), nil
+}
+
+func (id *MachineID) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "machine-%d", &id.n)
+	return err
+}
+
+// Fingerprint only has a binary form.
+type Fingerprint struct {
+	bytes []byte
+}
+
+func (f *Fingerprint) MarshalBinary() ([]byte, error) {
+	return f.bytes, nil
+}
+
+func (f *Fingerprint) UnmarshalBinary(data []byte) error {
+	f.bytes = append([]byte(nil), data...)
+	return nil
+}
+
+type Placement struct {
+	Machine     MachineID   `json:"machine"`
+	Parent      *MachineID  `json:"parent,omitempty"`
+	Others      []MachineID `json:"others,omitempty"`
+	Fingerprint Fingerprint `json:"fingerprint"`
+	Started     time.Time   `json:"started"`
+}
+
+// publishPlacement publishes the data, and returns it in its map form, and
+// as a Placement along with the error decoding it.
+func publishPlacement(c *gc.C, hub pubsub.StructuredHub, data interface{}) (map[string]interface{}, Placement, error) {
+	var (
+		asMap     map[string]interface{}
+		placement Placement
+		decodeErr error
+	)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data map[string]interface{}, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		asMap = data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Subscribe(topic, func(_ pubsub.Topic, data Placement, err error) {
+		placement, decodeErr = data, err
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := hub.Publish(topic, data)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	return asMap, placement, decodeErr
+}
+
+func (*TextCodecSuite) TestWithoutCanonicalText(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	asMap, _, err := publishPlacement(c, hub, Placement{Machine: MachineID{3}})
+	// The struct was not addressable, so it was decomposed into its
+	// (absent) fields, and can't be decoded.
+	c.Check(asMap["machine"], jc.DeepEquals, map[string]interface{}{})
+	c.Check(err, gc.ErrorMatches, "unmarshalling data: json: cannot unmarshal object .*")
+}
+
+func (*TextCodecSuite) TestCanonicalText(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{CanonicalText: true})
+	started := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	asMap, placement, err := publishPlacement(c, hub, Placement{
+		Machine:     MachineID{3},
+		Parent:      &MachineID{1},
+		Others:      []MachineID{{4}, {5}},
+		Fingerprint: Fingerprint{[]byte{1, 2, 3}},
+		Started:     started,
+	})
+	c.Check(asMap, jc.DeepEquals, map[string]interface{}{
+		"machine":     "machine-3",
+		"parent":      "machine-1",
+		"others":      []interface{}{"machine-4", "machine-5"},
+		"fingerprint": "AQID",
+		"started":     "2016-01-02T03:04:05Z",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(placement, jc.DeepEquals, Placement{
+		Machine:     MachineID{3},
+		Parent:      &MachineID{1},
+		Others:      []MachineID{{4}, {5}},
+		Fingerprint: Fingerprint{[]byte{1, 2, 3}},
+		Started:     started,
+	})
+}
+
+func (*TextCodecSuite) TestCanonicalTextOmitEmpty(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{CanonicalText: true})
+	asMap, placement, err := publishPlacement(c, hub, &Placement{Machine: MachineID{3}})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(asMap, jc.DeepEquals, map[string]interface{}{
+		"machine":     "machine-3",
+		"fingerprint": "",
+		"started":     "0001-01-01T00:00:00Z",
+	})
+	c.Check(placement, jc.DeepEquals, Placement{
+		Machine: MachineID{3},
+	})
+}
+
+func (*TextCodecSuite) TestCanonicalTextDecodeError(c *gc.C) {
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{CanonicalText: true})
+	errs := make(chan error, 1)
+	_, err := hub.Subscribe(topic, func(_ pubsub.Topic, data Placement, err error) {
+		errs <- err
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(topic, map[string]interface{}{"machine": 42})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case err := <-errs:
+		c.Check(err, gc.ErrorMatches, `unmarshalling data: field "Machine": expected string for pubsub_test.MachineID, got int`)
+	case <-time.After(time.Second):
+		c.Fatal("handler not called")
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// PublishedAtHeader is the header that holds the time a message was
+// published, in RFC3339 format with nanoseconds. Transports such as bridges
+// set it on the messages they forward, if the publisher didn't, so the hubs
+// receiving them can check how old they are. See ValidateTimestamps.
+const PublishedAtHeader = "pubsub-published-at"
+
+// WithPublishedAt returns a context that, when passed to PublishCtx, records
+// the time the message was published in its headers. The time is added to
+// any headers already attached to the context.
+func WithPublishedAt(ctx context.Context, published time.Time) context.Context {
+	headers := make(Headers)
+	for key, value := range headersFromPublishContext(ctx) {
+		headers[key] = value
+	}
+	headers[PublishedAtHeader] = formatPublishedAt(published)
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// PublishedAtFromContext returns the time the message being handled was
+// published. The bool result is false if the message doesn't have a valid
+// PublishedAtHeader.
+func PublishedAtFromContext(ctx context.Context) (time.Time, bool) {
+	value, ok := HeadersFromContext(ctx)[PublishedAtHeader]
+	if !ok {
+		return time.Time{}, false
+	}
+	published, err := time.Parse(time.RFC3339Nano, value)
+	return published, err == nil
+}
+
+func formatPublishedAt(published time.Time) string {
+	return published.UTC().Format(time.RFC3339Nano)
+}
+
+// TimestampConfig is the argument for ValidateTimestamps.
+type TimestampConfig struct {
+	// MaxAge is how long before it is handled that a message may have
+	// been published. Zero means messages are never too old.
+	MaxAge time.Duration
+
+	// Skew is how far the clocks of the hubs the messages come from may
+	// be out from the local clock. Messages published up to Skew in the
+	// future are valid, as are those up to MaxAge plus Skew in the past.
+	Skew time.Duration
+
+	// Drop stops the messages with invalid timestamps from being passed
+	// to the handler, and reports a *TimestampError to the hub's
+	// ErrorHandler for each. Otherwise the messages are passed on, and
+	// the handler can get the error using TimestampErrorFromContext.
+	Drop bool
+}
+
+// Validate checks that the config values are valid.
+func (config TimestampConfig) Validate() error {
+	if config.MaxAge < 0 {
+		return errors.NotValidf("negative MaxAge")
+	}
+	if config.Skew < 0 {
+		return errors.NotValidf("negative Skew")
+	}
+	return nil
+}
+
+// ValidateTimestamps is a subscribe option that checks the PublishedAtHeader
+// of each message against the local time before it is handled, to protect
+// handlers that act on time sensitive events from messages that were
+// delayed on their way from another hub, or that come from hubs with badly
+// set clocks. Messages without the header, such as those published on the
+// hub directly, are always valid. The config is validated when the
+// subscription is made.
+func ValidateTimestamps(config TimestampConfig) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.timestamps = &config
+	}
+}
+
+// TimestampError describes a message whose timestamp is not valid.
+type TimestampError struct {
+	// Published is the time in the message's PublishedAtHeader. It is
+	// zero if the header couldn't be parsed.
+	Published time.Time
+
+	// Received is the local time the timestamp was checked.
+	Received time.Time
+
+	// Err is the error parsing the header, if it couldn't be parsed.
+	Err error
+}
+
+// Error implements error.
+func (e *TimestampError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("timestamp not valid: %v", e.Err)
+	}
+	if e.Published.After(e.Received) {
+		return fmt.Sprintf("message published %v in the future", e.Published.Sub(e.Received))
+	}
+	return fmt.Sprintf("message published %v ago", e.Received.Sub(e.Published))
+}
+
+type timestampErrorKey struct{}
+
+// TimestampErrorFromContext returns the error flagged for the timestamp of
+// the message being handled, by a subscription that validates timestamps
+// without dropping the messages. The bool result is false if the timestamp
+// is valid.
+func TimestampErrorFromContext(ctx context.Context) (*TimestampError, bool) {
+	err, ok := ctx.Value(timestampErrorKey{}).(*TimestampError)
+	return err, ok
+}
+
+// check returns an error if the timestamp in the headers is not valid.
+func (config *TimestampConfig) check(headers Headers, now time.Time) *TimestampError {
+	value, ok := headers[PublishedAtHeader]
+	if !ok {
+		return nil
+	}
+	published, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return &TimestampError{Received: now, Err: errors.Trace(err)}
+	}
+	tooNew := published.Sub(now) > config.Skew
+	tooOld := config.MaxAge > 0 && now.Sub(published) > config.MaxAge+config.Skew
+	if !tooNew && !tooOld {
+		return nil
+	}
+	return &TimestampError{Published: published, Received: now}
+}
+
+// checkTimestamp validates the timestamp of the call for subscriptions that
+// validate timestamps. It returns false if the call should be dropped,
+// along with the context to pass to the handler otherwise.
+func (s *subscriber) checkTimestamp(ctx context.Context, call *handlerCallback, headers Headers) (context.Context, bool) {
+	if s.timestamps == nil {
+		return ctx, true
+	}
+	timestampErr := s.timestamps.check(headers, time.Now())
+	if timestampErr == nil {
+		return ctx, true
+	}
+	if !s.timestamps.Drop {
+		return context.WithValue(ctx, timestampErrorKey{}, timestampErr), true
+	}
+	s.reportError(&HubError{
+		Phase:          PhaseDispatch,
+		Topic:          call.topic,
+		Subscriber:     s.id,
+		SubscriberName: s.name,
+		Err:            timestampErr,
+	})
+	return ctx, false
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type TimestampSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&TimestampSuite{})
+
+// withoutPublishedAt checks that the headers of a forwarded message have a
+// timestamp, and returns the other headers.
+func withoutPublishedAt(c *gc.C, headers pubsub.Headers) pubsub.Headers {
+	value, ok := headers[pubsub.PublishedAtHeader]
+	c.Check(ok, jc.IsTrue)
+	published, err := time.Parse(time.RFC3339Nano, value)
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(time.Since(published) < time.Minute, jc.IsTrue)
+	result := make(pubsub.Headers)
+	for key, value := range headers {
+		if key != pubsub.PublishedAtHeader {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// timestampReceiver records the data handled, along with any timestamp
+// error flagged for it.
+type timestampReceiver struct {
+	mutex  sync.Mutex
+	data   []interface{}
+	errors []*pubsub.TimestampError
+}
+
+func (r *timestampReceiver) handle(ctx context.Context, topic pubsub.Topic, data interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.data = append(r.data, data)
+	err, _ := pubsub.TimestampErrorFromContext(ctx)
+	r.errors = append(r.errors, err)
+}
+
+func (r *timestampReceiver) get() ([]interface{}, []*pubsub.TimestampError) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.data, r.errors
+}
+
+// publishTimestamps publishes messages published at the times given
+// relative to now, one with a header that isn't a time, and one without
+// a timestamp.
+func publishTimestamps(c *gc.C, hub pubsub.Hub) {
+	now := time.Now()
+	for _, offset := range []time.Duration{0, -2 * time.Minute, time.Hour, 500 * time.Millisecond, -30 * time.Second} {
+		ctx := pubsub.WithPublishedAt(context.Background(), now.Add(offset))
+		done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, offset.String())
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{pubsub.PublishedAtHeader: "yesterday"})
+	done, err := hub.(pubsub.ContextPublisher).PublishCtx(ctx, topic, "yesterday")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	done, err = hub.Publish(topic, "local")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+}
+
+var timestampConfig = pubsub.TimestampConfig{
+	MaxAge: time.Minute,
+	Skew:   time.Second,
+}
+
+func (*TimestampSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	noop := func(pubsub.Topic, interface{}) {}
+	_, err := hub.Subscribe(topic, noop, pubsub.ValidateTimestamps(pubsub.TimestampConfig{MaxAge: -1}))
+	c.Check(err, gc.ErrorMatches, "negative MaxAge not valid")
+	_, err = hub.Subscribe(topic, noop, pubsub.ValidateTimestamps(pubsub.TimestampConfig{Skew: -1}))
+	c.Check(err, gc.ErrorMatches, "negative Skew not valid")
+}
+
+func (*TimestampSuite) TestPublishedAtFromContext(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	published := time.Date(2016, 11, 2, 10, 30, 0, 42, time.UTC)
+	received := make(chan time.Time, 2)
+	_, err := hub.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		value, _ := pubsub.PublishedAtFromContext(ctx)
+		received <- value
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	done, err := hub.(pubsub.ContextPublisher).PublishCtx(pubsub.WithPublishedAt(context.Background(), published), topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	done, err = hub.Publish(topic, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check((<-received).Equal(published), jc.IsTrue)
+	c.Check((<-received).IsZero(), jc.IsTrue)
+}
+
+func (*TimestampSuite) TestFlagged(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var receiver timestampReceiver
+	sub, err := hub.Subscribe(topic, receiver.handle, pubsub.ValidateTimestamps(timestampConfig))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishTimestamps(c, hub)
+	data, errs := receiver.get()
+	c.Check(data, jc.DeepEquals, []interface{}{"0s", "-2m0s", "1h0m0s", "500ms", "-30s", "yesterday", "local"})
+	c.Assert(errs, gc.HasLen, 7)
+	c.Check(errs[0], gc.IsNil)
+	c.Check(errs[1], gc.ErrorMatches, `message published 2m0.*s ago`)
+	c.Check(errs[2], gc.ErrorMatches, `message published 59m59.*s in the future`)
+	c.Check(errs[3], gc.IsNil)
+	c.Check(errs[4], gc.IsNil)
+	c.Check(errs[5], gc.ErrorMatches, `timestamp not valid: parsing time "yesterday".*`)
+	c.Check(errs[5].Published.IsZero(), jc.IsTrue)
+	c.Check(errs[6], gc.IsNil)
+}
+
+func (*TimestampSuite) TestDropped(c *gc.C) {
+	var collector errorCollector
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ErrorHandler: collector.handle})
+	var receiver timestampReceiver
+	config := timestampConfig
+	config.Drop = true
+	sub, err := hub.Subscribe(topic, receiver.handle, pubsub.ValidateTimestamps(config))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishTimestamps(c, hub)
+	data, _ := receiver.get()
+	c.Check(data, jc.DeepEquals, []interface{}{"0s", "500ms", "-30s", "local"})
+	errs := collector.get()
+	c.Assert(errs, gc.HasLen, 3)
+	for _, err := range errs {
+		c.Check(err.Phase, gc.Equals, pubsub.PhaseDispatch)
+		_, ok := err.Err.(*pubsub.TimestampError)
+		c.Check(ok, jc.IsTrue)
+	}
+}
+
+func (*TimestampSuite) TestBridgeStampsMessages(c *gc.C) {
+	source := pubsub.NewSimpleHub()
+	target := pubsub.NewSimpleHub()
+	bridge, err := pubsub.NewBridge(pubsub.BridgeConfig{
+		Name:   "timestamps",
+		Source: source,
+		Target: target,
+		Rules:  []pubsub.BridgeRule{{Name: "all", Matcher: pubsub.MatchAll}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+	received := make(chan pubsub.Headers, 2)
+	_, err = target.Subscribe(topic, func(ctx context.Context, topic pubsub.Topic, data interface{}) {
+		received <- pubsub.HeadersFromContext(ctx)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	before := time.Now()
+	_, err = source.Publish(topic, "stamped")
+	c.Assert(err, jc.ErrorIsNil)
+	published := time.Date(2016, 11, 2, 10, 30, 0, 0, time.UTC)
+	_, err = source.(pubsub.ContextPublisher).PublishCtx(pubsub.WithPublishedAt(context.Background(), published), topic, "kept")
+	c.Assert(err, jc.ErrorIsNil)
+
+	for _, check := range []func(time.Time){
+		func(t time.Time) { c.Check(t.Before(before), jc.IsFalse) },
+		func(t time.Time) { c.Check(t.Equal(published), jc.IsTrue) },
+	} {
+		select {
+		case headers := <-received:
+			value, err := time.Parse(time.RFC3339Nano, headers[pubsub.PublishedAtHeader])
+			c.Assert(err, jc.ErrorIsNil)
+			check(value)
+		case <-time.After(time.Second):
+			c.Fatal("message not forwarded")
+		}
+	}
+}
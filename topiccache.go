@@ -0,0 +1,149 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultTopicCacheSize is the number of distinct topics whose matching
+// subscribers a hub caches, if the SimpleHubConfig doesn't give a size.
+const DefaultTopicCacheSize = 1024
+
+// topicMatches is the cached result of matching a topic against the
+// subscribers of a snapshot.
+type topicMatches struct {
+	// topic is the interned copy of the topic, shared by the messages
+	// published on it.
+	topic Topic
+
+	// candidates are the subscribers that matched the topic, along with
+	// those whose matchers may change their results, in the order of the
+	// snapshot.
+	candidates []*subscriber
+}
+
+// topicCache holds the topics published while a snapshot of the subscribers
+// is current. Each snapshot has its own cache, so subscribing and
+// unsubscribing invalidate it.
+type topicCache struct {
+	size int
+
+	mutex   sync.RWMutex
+	matches map[Topic]*topicMatches
+}
+
+func newTopicCache(size int) *topicCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultTopicCacheSize
+	}
+	return &topicCache{size: size}
+}
+
+// lookup returns the matches for the topic, matching it against the
+// subscribers if it hasn't been seen before. A nil cache matches the
+// topic each time.
+func (c *topicCache) lookup(topic Topic, snapshot *subscriberSnapshot) *topicMatches {
+	if c == nil {
+		return matchTopic(topic, snapshot)
+	}
+	c.mutex.RLock()
+	matches, ok := c.matches[topic]
+	c.mutex.RUnlock()
+	if ok {
+		return matches
+	}
+	matches = matchTopic(topic, snapshot)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if existing, ok := c.matches[topic]; ok {
+		return existing
+	}
+	// When the cache is full it is emptied, rather than tracking how
+	// recently each topic was used, so the topics published often are
+	// soon cached again.
+	if c.matches == nil || len(c.matches) >= c.size {
+		c.matches = make(map[Topic]*topicMatches)
+	}
+	c.matches[topic] = matches
+	return matches
+}
+
+// matchTopic matches the topic against the subscribers of the snapshot.
+// The subscribers to exactly the topic, and those with wildcard patterns
+// that match it, are found in the indexes of the snapshot, so only the
+// others are matched.
+func matchTopic(topic Topic, snapshot *subscriberSnapshot) *topicMatches {
+	matches := &topicMatches{topic: topic}
+	exact := snapshot.exact[topic]
+	if snapshot.wildcards != nil {
+		exact = append(snapshot.wildcards.match(topic), exact...)
+		sort.Ints(exact)
+	}
+	for _, i := range snapshot.others {
+		for len(exact) > 0 && exact[0] < i {
+			matches.candidates = append(matches.candidates, snapshot.subscribers[exact[0]])
+			exact = exact[1:]
+		}
+		s := snapshot.subscribers[i]
+		if !s.staticMatcher || s.match(topic) {
+			matches.candidates = append(matches.candidates, s)
+		}
+	}
+	for _, i := range exact {
+		matches.candidates = append(matches.candidates, snapshot.subscribers[i])
+	}
+	return matches
+}
+
+// indexSubscribers sets the positions of the subscribers of the snapshot
+// that are subscribed to exactly one topic, by topic, and those with
+// wildcard patterns, by level, and of the other subscribers, which have to
+// be matched. Subscribers whose match cost is tracked are always matched,
+// so they are timed like the others.
+func (snapshot *subscriberSnapshot) indexSubscribers() {
+	for i, s := range snapshot.subscribers {
+		if wildcard, ok := s.topicMatcher.(*wildcardMatcher); ok && s.matchCost == nil {
+			if snapshot.wildcards == nil {
+				snapshot.wildcards = make(wildcardIndex)
+			}
+			snapshot.wildcards.add(wildcard, i)
+			continue
+		}
+		topic, ok := s.topicMatcher.(Topic)
+		if !ok || s.matchCost != nil {
+			snapshot.others = append(snapshot.others, i)
+			continue
+		}
+		if snapshot.exact == nil {
+			snapshot.exact = make(map[Topic][]int)
+		}
+		snapshot.exact[topic] = append(snapshot.exact[topic], i)
+	}
+}
+
+// isStaticMatcher returns true if the matcher always gives the same result
+// for a topic, so the result can be cached. Matchers from other packages,
+// and those like the multiplexer whose patterns change, are matched each
+// time a message is published.
+func isStaticMatcher(matcher TopicMatcher) bool {
+	switch m := matcher.(type) {
+	case Topic, *regexMatcher, *prefixMatcher, *allMatcher, *wildcardMatcher:
+		return true
+	case *aggregateMatcher:
+		return isStaticMatcher(m.matcher)
+	case *anyMatcher:
+		for _, matcher := range m.matchers {
+			if !isStaticMatcher(matcher) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
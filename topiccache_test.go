@@ -0,0 +1,179 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	stdtesting "testing"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type TopicCacheSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&TopicCacheSuite{})
+
+// topicRecorder records the topics of the messages it handles.
+type topicRecorder struct {
+	mutex  sync.Mutex
+	topics []pubsub.Topic
+}
+
+func (r *topicRecorder) handle(topic pubsub.Topic, _ interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.topics = append(r.topics, topic)
+}
+
+func (r *topicRecorder) get() []pubsub.Topic {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]pubsub.Topic(nil), r.topics...)
+}
+
+// toggleMatcher is a matcher from outside the package whose results
+// change, so they mustn't be cached.
+type toggleMatcher struct {
+	enabled int32
+}
+
+func (m *toggleMatcher) Match(pubsub.Topic) bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+func publishTopics(c *gc.C, hub pubsub.Hub, topics ...pubsub.Topic) {
+	for _, topic := range topics {
+		done, err := hub.Publish(topic, nil)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+}
+
+func (*TopicCacheSuite) TestSubscribeInvalidates(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	var early, late topicRecorder
+	sub, err := hub.Subscribe(pubsub.MatchRegex("^first"), early.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	publishTopics(c, hub, first, second, first)
+
+	lateSub, err := hub.Subscribe(pubsub.MatchAll, late.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer lateSub.Unsubscribe()
+	publishTopics(c, hub, first, second)
+
+	sub.Unsubscribe()
+	publishTopics(c, hub, first)
+
+	c.Check(early.get(), jc.DeepEquals, []pubsub.Topic{first, first, first})
+	c.Check(late.get(), jc.DeepEquals, []pubsub.Topic{first, second, first})
+}
+
+func (*TopicCacheSuite) TestChangingMatcher(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	matcher := &toggleMatcher{}
+	var recorder topicRecorder
+	sub, err := hub.Subscribe(matcher, recorder.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	publishTopics(c, hub, first)
+	atomic.StoreInt32(&matcher.enabled, 1)
+	publishTopics(c, hub, first, second)
+	atomic.StoreInt32(&matcher.enabled, 0)
+	publishTopics(c, hub, first)
+
+	c.Check(recorder.get(), jc.DeepEquals, []pubsub.Topic{first, second})
+}
+
+func (*TopicCacheSuite) TestCacheSizes(c *gc.C) {
+	for _, size := range []int{-1, 0, 2} {
+		c.Logf("cache size %d", size)
+		hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{TopicCacheSize: size})
+		var recorder topicRecorder
+		sub, err := hub.Subscribe(pubsub.MatchRegex("^topic-[0-9]*[02468]$"), recorder.handle)
+		c.Assert(err, jc.ErrorIsNil)
+
+		var expected []pubsub.Topic
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 5; i++ {
+				topic := pubsub.Topic(fmt.Sprintf("topic-%d", i))
+				publishTopics(c, hub, topic)
+				if i%2 == 0 {
+					expected = append(expected, topic)
+				}
+			}
+		}
+		c.Check(recorder.get(), jc.DeepEquals, expected)
+		sub.Unsubscribe()
+	}
+}
+
+// benchmarkRepeatedTopics publishes on topics that repeat nine times out
+// of ten to a hub with many pattern subscribers, like a hub whose
+// publishers report the status of a fixed set of entities.
+func benchmarkRepeatedTopics(b *stdtesting.B, cacheSize int) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{TopicCacheSize: cacheSize})
+	noop := func(pubsub.Topic, interface{}) {}
+	for i := 0; i < 100; i++ {
+		pattern := pubsub.MatchRegex(fmt.Sprintf(`^entity\.%d\.(status|config)$`, i))
+		if _, err := hub.Subscribe(pattern, noop); err != nil {
+			b.Fatal(err)
+		}
+	}
+	repeated := make([]pubsub.Topic, 20)
+	for i := range repeated {
+		repeated[i] = pubsub.Topic(fmt.Sprintf("entity.%d.status", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topic := repeated[i%len(repeated)]
+		if i%10 == 9 {
+			topic = pubsub.Topic(fmt.Sprintf("entity.new-%d.status", i))
+		}
+		if _, err := hub.Publish(topic, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishRepeatedTopics(b *stdtesting.B) {
+	benchmarkRepeatedTopics(b, 0)
+}
+
+func BenchmarkPublishRepeatedTopicsUncached(b *stdtesting.B) {
+	benchmarkRepeatedTopics(b, -1)
+}
+
+func (*TopicCacheSuite) TestExactSubscribers(c *gc.C) {
+	for _, size := range []int{0, -1} {
+		c.Logf("topic cache size %d", size)
+		hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+			TopicCacheSize: size,
+		})
+		var exact, other, regex, all topicRecorder
+		_, err := hub.Subscribe(pubsub.ExactMatch("first.next"), exact.handle)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.Subscribe(pubsub.MatchRegex("^first"), regex.handle)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.Subscribe(second, other.handle)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.Subscribe(pubsub.MatchAll, all.handle)
+		c.Assert(err, jc.ErrorIsNil)
+
+		publishTopics(c, hub, firstdot, "firstXnext", second, first)
+		c.Check(exact.get(), jc.DeepEquals, []pubsub.Topic{firstdot})
+		c.Check(other.get(), jc.DeepEquals, []pubsub.Topic{second})
+		c.Check(regex.get(), jc.DeepEquals, []pubsub.Topic{firstdot, "firstXnext", first})
+		c.Check(all.get(), jc.DeepEquals, []pubsub.Topic{firstdot, "firstXnext", second, first})
+	}
+}
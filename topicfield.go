@@ -0,0 +1,56 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+// topicFields returns the index of each field of the structure tagged
+// `pubsub:"topic"`, including those of embedded structures. The handlers of
+// a structured hub have these fields set to the topic of the message they
+// are given, so a handler that forwards the structure on doesn't need to
+// copy the topic into it. The fields must be strings, such as Topic.
+func topicFields(rt reflect.Type) ([][]int, error) {
+	if rt.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	var result [][]int
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embedded, err := topicFields(field.Type)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			for _, index := range embedded {
+				result = append(result, append([]int{i}, index...))
+			}
+			continue
+		}
+		if !hasTagOption(field.Tag.Get("pubsub"), "topic") {
+			continue
+		}
+		if field.PkgPath != "" {
+			return nil, errors.NotValidf("unexported topic field %q", field.Name)
+		}
+		if field.Type.Kind() != reflect.String {
+			return nil, errors.NotValidf("topic field %q of type %v", field.Name, field.Type)
+		}
+		result = append(result, field.Index)
+	}
+	return result, nil
+}
+
+// setTopicFields sets the topic fields of the structure to the topic.
+func setTopicFields(value reflect.Value, fields [][]int, topic Topic) {
+	if len(fields) == 0 || !value.CanSet() {
+		return
+	}
+	for _, index := range fields {
+		value.FieldByIndex(index).SetString(string(topic))
+	}
+}
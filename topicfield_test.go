@@ -0,0 +1,77 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type TopicFieldSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&TopicFieldSuite{})
+
+type Routed struct {
+	Topic pubsub.Topic `pubsub:"topic" json:"topic"`
+}
+
+type Forwarded struct {
+	Routed
+	Name   string `json:"name"`
+	Source string `pubsub:"topic" json:"-"`
+}
+
+func (*TopicFieldSuite) TestPopulated(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan Forwarded, 2)
+	_, err := hub.Subscribe(pubsub.MatchAll, func(topic pubsub.Topic, data Forwarded, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	done, err := hub.Publish(first, Forwarded{Name: "fred"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	done, err = hub.Publish(second, map[string]interface{}{"name": "mary", "topic": "wrong"})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+
+	c.Check(<-received, jc.DeepEquals, Forwarded{Routed: Routed{first}, Name: "fred", Source: string(first)})
+	c.Check(<-received, jc.DeepEquals, Forwarded{Routed: Routed{second}, Name: "mary", Source: string(second)})
+}
+
+func (*TopicFieldSuite) TestPopulatedOnError(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	received := make(chan Routed, 1)
+	_, err := hub.Subscribe(first, func(topic pubsub.Topic, data Routed, err error) {
+		c.Check(err, gc.NotNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	done, err := hub.Publish(first, map[string]interface{}{"topic": 42})
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, done)
+	c.Check((<-received).Topic, gc.Equals, first)
+}
+
+func (*TopicFieldSuite) TestInvalidFields(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	type numbered struct {
+		Topic int `pubsub:"topic"`
+	}
+	_, err := hub.Subscribe(first, func(pubsub.Topic, numbered, error) {})
+	c.Check(err, gc.ErrorMatches, `topic field "Topic" of type int not valid`)
+
+	type hidden struct {
+		topic string `pubsub:"topic"`
+	}
+	_, err = hub.Subscribe(first, func(pubsub.Topic, hidden, error) {})
+	c.Check(err, gc.ErrorMatches, `unexported topic field "topic" not valid`)
+}
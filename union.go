@@ -0,0 +1,124 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// TryDecode converts the map form of the data of a structured hub into the
+// first of the candidates that it strictly matches, and returns the index
+// of that candidate. The candidates are pointers to the values to fill in.
+// The data strictly matches a structure if it decodes without error and
+// has no keys that don't correspond to a field of the structure. Fields
+// missing from the data are allowed, so candidates with optional fields
+// should come after those without. This is useful when a topic carries a
+// small union of payload shapes. The data is converted using the
+// JSONMarshaller. If no candidate matches, a NotFound error is returned,
+// describing why each candidate didn't match.
+func TryDecode(data map[string]interface{}, candidates ...interface{}) (int, error) {
+	for i, candidate := range candidates {
+		v := reflect.ValueOf(candidate)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return -1, errors.NotValidf("candidate %d of type %T", i, candidate)
+		}
+	}
+	d := decoder{marshaller: JSONMarshaller}
+	var reasons []string
+	for i, candidate := range candidates {
+		v := reflect.ValueOf(candidate)
+		value, _, err := d.decodeStrict(v.Type().Elem(), data)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%v: %v", v.Type().Elem(), err))
+			continue
+		}
+		v.Elem().Set(value)
+		return i, nil
+	}
+	return -1, noMatchError(reasons)
+}
+
+// Union returns a handler for a structured hub that passes each message to
+// the first of the handlers whose structure the data strictly matches, in
+// the same way as TryDecode, using the marshaller of the hub. Each handler
+// must be valid for the structured hub, and may take a context. If none of
+// the handlers match, a decode error is reported to the hub's ErrorHandler
+// and no handler is called.
+//
+//	hub.Subscribe(topic, pubsub.Union(
+//	    func(topic pubsub.Topic, started Started, err error) {...},
+//	    func(topic pubsub.Topic, stopped Stopped, err error) {...},
+//	))
+func Union(handlers ...interface{}) interface{} {
+	return &unionHandler{handlers: handlers}
+}
+
+type unionHandler struct {
+	handlers []interface{}
+}
+
+func newUnionCallback(decoder decoder, union *unionHandler) (*structuredCallback, error) {
+	if len(union.handlers) == 0 {
+		return nil, errors.NotValidf("empty union")
+	}
+	callbacks := make([]*structuredCallback, len(union.handlers))
+	for i, handler := range union.handlers {
+		if _, ok := handler.(*unionHandler); ok {
+			return nil, errors.NotValidf("nested union")
+		}
+		callback, err := newStructuredCallback(decoder, handler)
+		if err != nil {
+			return nil, errors.Annotatef(err, "union handler %d", i)
+		}
+		callbacks[i] = callback
+	}
+	return &structuredCallback{decoder: decoder, union: callbacks}, nil
+}
+
+// handleUnion calls the first handler of the union that the data strictly
+// matches.
+func (s *structuredCallback) handleUnion(ctx context.Context, topic Topic, data interface{}) error {
+	asMap, ok := data.(map[string]interface{})
+	if !ok {
+		reportSubscriberError(ctx, PhaseDispatch, topic, errors.Errorf("bad data: %v", data))
+		return nil
+	}
+	var reasons []string
+	for _, callback := range s.union {
+		value, report, err := callback.decoder.decodeStrict(callback.dataType, asMap)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%v: %v", callback.dataType, err))
+			continue
+		}
+		if callback.wantsContext && callback.dataType.Kind() == reflect.Struct {
+			ctx = withDecodeReport(ctx, report)
+		}
+		return callback.call(ctx, topic, value, nil)
+	}
+	reportSubscriberError(ctx, PhaseDecode, topic, noMatchError(reasons))
+	return nil
+}
+
+// decodeStrict converts the data into the type rt, returning an error if
+// the data has keys that don't correspond to a field of the structure.
+func (d decoder) decodeStrict(rt reflect.Type, data map[string]interface{}) (reflect.Value, *DecodeReport, error) {
+	report := new(DecodeReport)
+	value, err := d.decode(rt, data, report)
+	if err != nil {
+		return value, nil, errors.Trace(err)
+	}
+	if len(report.Unknown) > 0 {
+		return value, nil, errors.NotValidf("unknown fields %s", strings.Join(report.Unknown, ", "))
+	}
+	return value, report, nil
+}
+
+func noMatchError(reasons []string) error {
+	return errors.NotFoundf("type matching data (%s)", strings.Join(reasons, "; "))
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type UnionSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&UnionSuite{})
+
+type Started struct {
+	Unit string `json:"unit"`
+	PID  int    `json:"pid"`
+}
+
+type Stopped struct {
+	Unit   string `json:"unit"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (*UnionSuite) TestTryDecode(c *gc.C) {
+	var started Started
+	var stopped Stopped
+	index, err := pubsub.TryDecode(map[string]interface{}{"unit": "a/0", "pid": 42.0}, &started, &stopped)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(index, gc.Equals, 0)
+	c.Check(started, jc.DeepEquals, Started{Unit: "a/0", PID: 42})
+
+	index, err = pubsub.TryDecode(map[string]interface{}{"unit": "a/0", "reason": "done"}, &started, &stopped)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(index, gc.Equals, 1)
+	c.Check(stopped, jc.DeepEquals, Stopped{Unit: "a/0", Reason: "done"})
+
+	// Missing fields are allowed, so the order matters.
+	index, err = pubsub.TryDecode(map[string]interface{}{"unit": "a/1"}, &stopped, &started)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(index, gc.Equals, 0)
+
+	index, err = pubsub.TryDecode(map[string]interface{}{"unit": "a/0", "pid": "wrong"}, &started, &stopped)
+	c.Check(index, gc.Equals, -1)
+	c.Check(errors.IsNotFound(err), jc.IsTrue)
+	c.Check(err, gc.ErrorMatches, `type matching data \(pubsub_test.Started: unmarshalling data: .*; pubsub_test.Stopped: unknown fields pid not valid\) not found`)
+
+	_, err = pubsub.TryDecode(nil, started)
+	c.Check(err, gc.ErrorMatches, "candidate 0 of type pubsub_test.Started not valid")
+}
+
+func (*UnionSuite) TestUnionHandler(c *gc.C) {
+	var collector errorCollector
+	hub := pubsub.NewStructuredHub(&pubsub.StructuredHubConfig{
+		SimpleHubConfig: pubsub.SimpleHubConfig{
+			ErrorHandler: collector.handle,
+		},
+	})
+	received := make(chan interface{}, 10)
+	_, err := hub.Subscribe(topic, pubsub.Union(
+		func(topic pubsub.Topic, data Started, err error) {
+			c.Check(err, jc.ErrorIsNil)
+			received <- data
+		},
+		func(ctx context.Context, topic pubsub.Topic, data Stopped, err error) {
+			c.Check(err, jc.ErrorIsNil)
+			report, ok := pubsub.DecodeReportFromContext(ctx)
+			c.Check(ok, jc.IsTrue)
+			c.Check(report.Clean(), jc.IsTrue)
+			received <- data
+		},
+	))
+	c.Assert(err, jc.ErrorIsNil)
+
+	for _, data := range []interface{}{
+		Started{Unit: "a/0", PID: 42},
+		Stopped{Unit: "a/0", Reason: "crashed"},
+		map[string]interface{}{"unit": "a/0", "exit-code": 1},
+	} {
+		done, err := hub.Publish(topic, data)
+		c.Assert(err, jc.ErrorIsNil)
+		waitComplete(c, done)
+	}
+	c.Check(<-received, jc.DeepEquals, Started{Unit: "a/0", PID: 42})
+	c.Check(<-received, jc.DeepEquals, Stopped{Unit: "a/0", Reason: "crashed"})
+	c.Check(received, gc.HasLen, 0)
+	errs := collector.get()
+	c.Assert(errs, gc.HasLen, 1)
+	c.Check(errs[0].Phase, gc.Equals, pubsub.PhaseDecode)
+	c.Check(errs[0].Err, gc.ErrorMatches, `type matching data .*unknown fields exit-code.* not found`)
+}
+
+func (*UnionSuite) TestUnionValidation(c *gc.C) {
+	hub := pubsub.NewStructuredHub(nil)
+	_, err := hub.Subscribe(topic, pubsub.Union())
+	c.Check(err, gc.ErrorMatches, "empty union not valid")
+	_, err = hub.Subscribe(topic, pubsub.Union(func(pubsub.Topic, Started, error) {}, func(pubsub.Topic, string) {}))
+	c.Check(err, gc.ErrorMatches, "union handler 1: .* not valid")
+	_, err = hub.Subscribe(topic, pubsub.Union(pubsub.Union(func(pubsub.Topic, Started, error) {})))
+	c.Check(err, gc.ErrorMatches, "nested union not valid")
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// WarmUp is a subscribe option that holds back the messages for the
+// subscription until it is ready, so a component can subscribe before it
+// has finished initializing without racing the first messages. The
+// subscription becomes ready when Ready is called on it, or once the period
+// has passed if it is greater than zero. Messages published in the
+// meantime are queued, and are handled in order once the subscription is
+// ready. Barriers for the subscription also wait for it to be ready.
+func WarmUp(period time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.warmUp = &period
+	}
+}
+
+// warmUp holds a subscriber back until it is ready.
+type warmUp struct {
+	ready chan struct{}
+	once  sync.Once
+
+	// mutex protects the timer, which may fire before it is assigned.
+	mutex sync.Mutex
+	timer *time.Timer
+}
+
+func newWarmUp(period time.Duration) *warmUp {
+	w := &warmUp{ready: make(chan struct{})}
+	if period > 0 {
+		w.mutex.Lock()
+		w.timer = time.AfterFunc(period, w.markReady)
+		w.mutex.Unlock()
+	}
+	return w
+}
+
+func (w *warmUp) markReady() {
+	w.once.Do(func() {
+		w.mutex.Lock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		w.mutex.Unlock()
+		close(w.ready)
+	})
+}
+
+func (w *warmUp) isReady() bool {
+	select {
+	case <-w.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitReady waits for the subscriber to be ready. It returns false if the
+// subscriber is closed first.
+func (s *subscriber) waitReady() bool {
+	if s.warmUp == nil {
+		return true
+	}
+	select {
+	case <-s.warmUp.ready:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// Ready implements Subscription.
+func (h *handle) Ready() {
+	if h.sub.warmUp != nil {
+		h.sub.warmUp.markReady()
+	}
+}
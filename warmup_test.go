@@ -0,0 +1,121 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type WarmUpSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&WarmUpSuite{})
+
+type orderedReceiver struct {
+	mutex    sync.Mutex
+	received []interface{}
+}
+
+func (r *orderedReceiver) handle(topic pubsub.Topic, data interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.received = append(r.received, data)
+}
+
+func (r *orderedReceiver) get() []interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]interface{}(nil), r.received...)
+}
+
+func (*WarmUpSuite) TestReady(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	receiver := &orderedReceiver{}
+	sub, err := hub.Subscribe(topic, receiver.handle, pubsub.WarmUp(0))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	var results []pubsub.Completer
+	for i := 0; i < 3; i++ {
+		result, err := hub.Publish(topic, i)
+		c.Assert(err, jc.ErrorIsNil)
+		results = append(results, result)
+	}
+	select {
+	case <-results[0].Complete():
+		c.Fatal("message delivered before the subscription was ready")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Check(sub.Pending(), gc.Equals, 3)
+	c.Check(hub.(pubsub.Reporter).Report()["subscribers"], jc.DeepEquals, map[string]interface{}{
+		"0": map[string]interface{}{
+			"matcher":    "testing",
+			"pending":    3,
+			"delivered":  uint64(0),
+			"warming-up": true,
+		},
+	})
+
+	sub.Ready()
+	sub.Ready()
+	for _, result := range results {
+		waitComplete(c, result)
+	}
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{0, 1, 2})
+	c.Check(hub.(pubsub.Reporter).Report()["subscribers"].(map[string]interface{})["0"], jc.DeepEquals, map[string]interface{}{
+		"matcher":   "testing",
+		"pending":   0,
+		"delivered": uint64(3),
+	})
+}
+
+func (*WarmUpSuite) TestPeriod(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	receiver := &orderedReceiver{}
+	start := time.Now()
+	sub, err := hub.Subscribe(topic, receiver.handle, pubsub.WarmUp(20*time.Millisecond))
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+
+	result, err := hub.Publish(topic, "hello")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	c.Check(time.Since(start) >= 20*time.Millisecond, jc.IsTrue)
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{"hello"})
+}
+
+func (*WarmUpSuite) TestUnsubscribeWhileWarmingUp(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	receiver := &orderedReceiver{}
+	sub, err := hub.Subscribe(topic, receiver.handle, pubsub.WarmUp(0))
+	c.Assert(err, jc.ErrorIsNil)
+
+	result, err := hub.Publish(topic, "hello")
+	c.Assert(err, jc.ErrorIsNil)
+	sub.Unsubscribe()
+	waitComplete(c, result)
+	c.Check(receiver.get(), gc.HasLen, 0)
+}
+
+func (*WarmUpSuite) TestReadyWithoutWarmUp(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	receiver := &orderedReceiver{}
+	sub, err := hub.Subscribe(topic, receiver.handle)
+	c.Assert(err, jc.ErrorIsNil)
+	defer sub.Unsubscribe()
+	sub.Ready()
+
+	result, err := hub.Publish(topic, "hello")
+	c.Assert(err, jc.ErrorIsNil)
+	waitComplete(c, result)
+	c.Check(receiver.get(), jc.DeepEquals, []interface{}{"hello"})
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// SingleLevelWildcard matches exactly one level of a hierarchical
+	// topic. See MatchWildcard.
+	SingleLevelWildcard = "+"
+
+	// MultiLevelWildcard matches any number of levels at the end of a
+	// hierarchical topic. See MatchWildcard.
+	MultiLevelWildcard = "#"
+)
+
+type wildcardMatcher struct {
+	pattern   string
+	separator string
+	levels    []string
+}
+
+// MatchWildcard returns a topic matcher for hierarchical topics whose
+// levels are separated by the separator, usually '.' or '/', with
+// wildcards like those of MQTT. A level of the pattern that is just "+"
+// matches any single level of the topic, and a last level that is just "#"
+// matches any number of levels, including none, so "unit.#" matches
+// "unit", "unit.added" and "unit.0.status". Other levels match the same
+// level of the topic exactly, without any characters needing escaping.
+// For example:
+//
+//	hub.Subscribe(pubsub.MatchWildcard("unit.+.status", '.'), handler)
+//
+// The levels matched by each "+", and then those matched by "#" joined
+// with the separator, are passed to the handler as the Groups of the
+// Captures. If the pattern or separator is not valid, the function panics.
+//
+// The hubs index the subscribers with wildcard patterns by level, so they
+// aren't each matched against the topics published.
+func MatchWildcard(pattern string, separator byte) TopicMatcher {
+	matcher, err := parseWildcard(pattern, separator)
+	if err != nil {
+		panic(fmt.Sprintf("pattern must be a valid wildcard pattern: %v", err))
+	}
+	return matcher
+}
+
+func parseWildcard(pattern string, separator byte) (*wildcardMatcher, error) {
+	sep := string(separator)
+	if sep == SingleLevelWildcard || sep == MultiLevelWildcard {
+		return nil, fmt.Errorf("separator %q is a wildcard", sep)
+	}
+	levels := strings.Split(pattern, sep)
+	for i, level := range levels {
+		if level == SingleLevelWildcard {
+			continue
+		}
+		if level == MultiLevelWildcard {
+			if i != len(levels)-1 {
+				return nil, fmt.Errorf("%q in %q is not the last level", MultiLevelWildcard, pattern)
+			}
+			continue
+		}
+		if strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard) {
+			return nil, fmt.Errorf("level %q of %q mixes a wildcard with other characters", level, pattern)
+		}
+	}
+	return &wildcardMatcher{
+		pattern:   pattern,
+		separator: sep,
+		levels:    levels,
+	}, nil
+}
+
+// Match implements TopicMatcher.
+func (m *wildcardMatcher) Match(topic Topic) bool {
+	_, ok := m.capture(topic, false)
+	return ok
+}
+
+// Capture implements CapturingMatcher.
+func (m *wildcardMatcher) Capture(topic Topic) (Captures, bool) {
+	groups, ok := m.capture(topic, true)
+	if !ok || groups == nil {
+		return Captures{}, false
+	}
+	return Captures{Groups: groups}, true
+}
+
+// capture matches the topic, and returns the levels matched by the
+// wildcards if groups is true.
+func (m *wildcardMatcher) capture(topic Topic, groups bool) ([]string, bool) {
+	levels := strings.Split(string(topic), m.separator)
+	var captured []string
+	for i, level := range m.levels {
+		if level == MultiLevelWildcard {
+			if groups {
+				captured = append(captured, strings.Join(levels[i:], m.separator))
+			}
+			return captured, true
+		}
+		if i == len(levels) {
+			return nil, false
+		}
+		if level == SingleLevelWildcard {
+			if groups {
+				captured = append(captured, levels[i])
+			}
+		} else if level != levels[i] {
+			return nil, false
+		}
+	}
+	return captured, len(levels) == len(m.levels)
+}
+
+// hasWildcards returns true if the pattern has any wildcards.
+func (m *wildcardMatcher) hasWildcards() bool {
+	for _, level := range m.levels {
+		if level == SingleLevelWildcard || level == MultiLevelWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the pattern.
+func (m *wildcardMatcher) String() string {
+	return m.pattern
+}
+
+// wildcardNode is a level of the index of the wildcard patterns of the
+// subscribers of a snapshot.
+type wildcardNode struct {
+	children map[string]*wildcardNode
+
+	// single is the node for a "+" at this level.
+	single *wildcardNode
+
+	// multi are the positions of the subscribers whose pattern ends with
+	// "#" at this level, and end those of the subscribers whose pattern
+	// ends at this level.
+	multi []int
+	end   []int
+}
+
+// wildcardIndex indexes the wildcard patterns by separator.
+type wildcardIndex map[string]*wildcardNode
+
+// add adds the pattern of the subscriber at the position to the index.
+func (index wildcardIndex) add(m *wildcardMatcher, position int) {
+	node := index[m.separator]
+	if node == nil {
+		node = &wildcardNode{}
+		index[m.separator] = node
+	}
+	for i, level := range m.levels {
+		if level == MultiLevelWildcard {
+			node.multi = append(node.multi, position)
+			return
+		}
+		var next *wildcardNode
+		if level == SingleLevelWildcard {
+			if node.single == nil {
+				node.single = &wildcardNode{}
+			}
+			next = node.single
+		} else {
+			if node.children == nil {
+				node.children = make(map[string]*wildcardNode)
+			}
+			next = node.children[level]
+			if next == nil {
+				next = &wildcardNode{}
+				node.children[level] = next
+			}
+		}
+		node = next
+		if i == len(m.levels)-1 {
+			node.end = append(node.end, position)
+		}
+	}
+}
+
+// match returns the positions of the subscribers whose patterns match the
+// topic, in order.
+func (index wildcardIndex) match(topic Topic) []int {
+	var positions []int
+	for separator, node := range index {
+		positions = node.match(strings.Split(string(topic), separator), positions)
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+func (n *wildcardNode) match(levels []string, positions []int) []int {
+	positions = append(positions, n.multi...)
+	if len(levels) == 0 {
+		return append(positions, n.end...)
+	}
+	if child := n.children[levels[0]]; child != nil {
+		positions = child.match(levels[1:], positions)
+	}
+	if n.single != nil {
+		positions = n.single.match(levels[1:], positions)
+	}
+	return positions
+}
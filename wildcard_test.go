@@ -0,0 +1,125 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"context"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type WildcardSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&WildcardSuite{})
+
+func (*WildcardSuite) TestMatch(c *gc.C) {
+	for i, test := range []struct {
+		pattern   string
+		separator byte
+		matches   []pubsub.Topic
+		misses    []pubsub.Topic
+	}{{
+		pattern: "unit.added",
+		matches: []pubsub.Topic{"unit.added"},
+		misses:  []pubsub.Topic{"unit", "unitXadded", "unit.added.more"},
+	}, {
+		pattern: "unit.+.status",
+		matches: []pubsub.Topic{"unit.0.status", "unit..status"},
+		misses:  []pubsub.Topic{"unit.status", "unit.0.1.status", "unit.0.status.more"},
+	}, {
+		pattern: "unit.#",
+		matches: []pubsub.Topic{"unit", "unit.added", "unit.0.status", "unit."},
+		misses:  []pubsub.Topic{"units", "machine.unit"},
+	}, {
+		pattern: "+.#",
+		matches: []pubsub.Topic{"unit", "unit.added", ""},
+	}, {
+		pattern: "#",
+		matches: []pubsub.Topic{"", "unit", "a.b.c"},
+	}, {
+		pattern:   "unit/+/status",
+		separator: '/',
+		matches:   []pubsub.Topic{"unit/0/status", "unit/a.b/status"},
+		misses:    []pubsub.Topic{"unit.0.status", "unit/0/1/status"},
+	}} {
+		c.Logf("test %d: %q", i, test.pattern)
+		separator := test.separator
+		if separator == 0 {
+			separator = '.'
+		}
+		matcher := pubsub.MatchWildcard(test.pattern, separator)
+		for _, topic := range test.matches {
+			c.Check(matcher.Match(topic), jc.IsTrue, gc.Commentf("topic %q", topic))
+		}
+		for _, topic := range test.misses {
+			c.Check(matcher.Match(topic), jc.IsFalse, gc.Commentf("topic %q", topic))
+		}
+	}
+}
+
+func (*WildcardSuite) TestInvalid(c *gc.C) {
+	c.Check(func() { pubsub.MatchWildcard("unit.#.status", '.') }, gc.PanicMatches,
+		`pattern must be a valid wildcard pattern: "#" in "unit.#.status" is not the last level`)
+	c.Check(func() { pubsub.MatchWildcard("unit.a+", '.') }, gc.PanicMatches,
+		`pattern must be a valid wildcard pattern: level "a\+" of "unit.a\+" mixes a wildcard with other characters`)
+	c.Check(func() { pubsub.MatchWildcard("unit+a", '+') }, gc.PanicMatches,
+		`pattern must be a valid wildcard pattern: separator "\+" is a wildcard`)
+}
+
+func (*WildcardSuite) TestCaptures(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	captured := make(chan pubsub.Captures, 10)
+	_, err := hub.Subscribe(pubsub.MatchWildcard("model.+.unit.+.#", '.'), func(ctx context.Context, _ pubsub.Topic, _ interface{}) {
+		captures, ok := pubsub.CapturesFromContext(ctx)
+		c.Check(ok, jc.IsTrue)
+		captured <- captures
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	publishTopics(c, hub, "model.m1.unit.u0.status.changed", "model.m2.unit.u1")
+	c.Check(<-captured, jc.DeepEquals, pubsub.Captures{Groups: []string{"m1", "u0", "status.changed"}})
+	c.Check(<-captured, jc.DeepEquals, pubsub.Captures{Groups: []string{"m2", "u1", ""}})
+}
+
+func (*WildcardSuite) TestIndexedSubscribers(c *gc.C) {
+	for _, size := range []int{0, -1} {
+		c.Logf("topic cache size %d", size)
+		hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{
+			TopicCacheSize: size,
+		})
+		var single, multi, slash, exact, regex topicRecorder
+		_, err := hub.Subscribe(pubsub.MatchWildcard("unit.+.status", '.'), single.handle)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.Subscribe(pubsub.MatchRegex(`^unit/`), regex.handle)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.Subscribe(pubsub.MatchWildcard("unit.#", '.'), multi.handle)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.Subscribe(pubsub.Topic("unit.0.status"), exact.handle)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = hub.Subscribe(pubsub.MatchWildcard("unit/+/status", '/'), slash.handle)
+		c.Assert(err, jc.ErrorIsNil)
+
+		publishTopics(c, hub, "unit.0.status", "unit.1", "unit/0/status", "machine.0.status")
+		c.Check(single.get(), jc.DeepEquals, []pubsub.Topic{"unit.0.status"})
+		c.Check(multi.get(), jc.DeepEquals, []pubsub.Topic{"unit.0.status", "unit.1"})
+		c.Check(exact.get(), jc.DeepEquals, []pubsub.Topic{"unit.0.status"})
+		c.Check(slash.get(), jc.DeepEquals, []pubsub.Topic{"unit/0/status"})
+		c.Check(regex.get(), jc.DeepEquals, []pubsub.Topic{"unit/0/status"})
+	}
+}
+
+func (*WildcardSuite) TestExplain(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	_, err := hub.Subscribe(pubsub.MatchWildcard("unit.#", '.'), func(pubsub.Topic, interface{}) {})
+	c.Assert(err, jc.ErrorIsNil)
+	results := hub.(pubsub.Explainer).Explain("unit.added")
+	c.Assert(results, gc.HasLen, 1)
+	c.Check(results[0].Pattern, gc.Equals, "unit.#")
+	c.Check(results[0].Matched, jc.IsTrue)
+}
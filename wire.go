@@ -0,0 +1,433 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+)
+
+// WireVersion is the version of the wire protocol written by WriteWireFrame.
+//
+// The wire protocol frames the messages exchanged with hubs over streams
+// such as WebSocket or gRPC byte streams and TCP connections, so that
+// clients written in other languages can publish and subscribe to hubs
+// embedded in Go services. All integers are unsigned and big-endian, and
+// all strings are UTF-8. Each frame is:
+//
+//	length       uint32  the number of bytes of the frame after the length
+//	version      uint8   WireVersion
+//	topic        string
+//	headerCount  uint16
+//	headers      headerCount pairs of key string, value string, in
+//	             ascending order of key
+//	contentType  string
+//	payload      the rest of the frame
+//
+// where each string is a uint16 length followed by that many bytes. The
+// content type describes the encoding of the payload, such as
+// "application/json", and is not repeated in the headers. Readers reject
+// frames with another version, and frames longer than their limit.
+const WireVersion = 1
+
+// DefaultMaxWireFrameSize is the size of the largest frame read when no
+// other limit is given.
+const DefaultMaxWireFrameSize = 16 << 20
+
+const maxWireString = 1<<16 - 1
+
+// WireFrame is a message in the form it is sent over the wire protocol.
+type WireFrame struct {
+	Topic       Topic
+	Headers     Headers
+	ContentType string
+	Payload     []byte
+}
+
+// WriteWireFrame writes the frame to the writer in the wire protocol.
+func WriteWireFrame(w io.Writer, frame WireFrame) error {
+	if len(frame.Headers) > maxWireString {
+		return errors.NotValidf("%d headers", len(frame.Headers))
+	}
+	body := []byte{WireVersion}
+	var err error
+	if body, err = appendWireString(body, "topic", string(frame.Topic)); err != nil {
+		return errors.Trace(err)
+	}
+	keys := make([]string, 0, len(frame.Headers))
+	for key := range frame.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	body = appendUint16(body, len(keys))
+	for _, key := range keys {
+		if body, err = appendWireString(body, "header key", key); err != nil {
+			return errors.Trace(err)
+		}
+		if body, err = appendWireString(body, "header "+key, frame.Headers[key]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if body, err = appendWireString(body, "content type", frame.ContentType); err != nil {
+		return errors.Trace(err)
+	}
+	body = append(body, frame.Payload...)
+	if uint64(len(body)) > 1<<32-1 {
+		return errors.NotValidf("frame of %d bytes", len(body))
+	}
+	framed := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(framed, uint32(len(body)))
+	_, err = w.Write(append(framed, body...))
+	return errors.Trace(err)
+}
+
+func appendUint16(b []byte, n int) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendWireString(b []byte, what, s string) ([]byte, error) {
+	if len(s) > maxWireString {
+		return nil, errors.NotValidf("%s of %d bytes", what, len(s))
+	}
+	return append(appendUint16(b, len(s)), s...), nil
+}
+
+// ReadWireFrame reads a frame in the wire protocol from the reader. Frames
+// longer than maxSize are rejected, and if maxSize is zero it defaults to
+// DefaultMaxWireFrameSize. The error is io.EOF if the reader ends before
+// the frame starts.
+func ReadWireFrame(r io.Reader, maxSize int) (WireFrame, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxWireFrameSize
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		if err == io.EOF {
+			return WireFrame{}, io.EOF
+		}
+		return WireFrame{}, errors.Annotate(err, "reading frame length")
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if uint64(size) > uint64(maxSize) {
+		return WireFrame{}, errors.NotValidf("frame of %d bytes, limit %d", size, maxSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return WireFrame{}, errors.Annotate(err, "reading frame")
+	}
+	return parseWireFrame(body)
+}
+
+func parseWireFrame(body []byte) (WireFrame, error) {
+	p := wireParser{body: body}
+	if version := p.byte(); p.err == nil && version != WireVersion {
+		return WireFrame{}, errors.NotSupportedf("wire version %d", version)
+	}
+	frame := WireFrame{Topic: Topic(p.string())}
+	if count := p.uint16(); count > 0 {
+		frame.Headers = make(Headers, count)
+		for i := 0; i < count && p.err == nil; i++ {
+			key := p.string()
+			frame.Headers[key] = p.string()
+		}
+	}
+	frame.ContentType = p.string()
+	if p.err != nil {
+		return WireFrame{}, errors.Trace(p.err)
+	}
+	frame.Payload = p.body
+	return frame, nil
+}
+
+// wireParser reads the fields of a frame, remembering the first error.
+type wireParser struct {
+	body []byte
+	err  error
+}
+
+func (p *wireParser) take(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.body) < n {
+		p.err = errors.NotValidf("truncated frame")
+		return nil
+	}
+	result := p.body[:n]
+	p.body = p.body[n:]
+	return result
+}
+
+func (p *wireParser) byte() byte {
+	if b := p.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *wireParser) uint16() int {
+	if b := p.take(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (p *wireParser) string() string {
+	return string(p.take(p.uint16()))
+}
+
+// WireBridgeConfig is the argument struct for NewWireBridge.
+type WireBridgeConfig struct {
+	// Name identifies the bridge in its log messages.
+	Name string
+
+	// Hub is the hub that the bridge forwards messages to and from. It
+	// must implement ContextPublisher, and ChanSubscriber if Forward is
+	// set.
+	Hub Hub
+
+	// Conn is the stream that frames are exchanged over, such as a
+	// WebSocket connection or gRPC stream wrapped as a byte stream. It is
+	// closed when the bridge stops.
+	Conn io.ReadWriteCloser
+
+	// Forward matches the topics of the messages published on the hub
+	// that are sent over the connection. If it isn't set, messages are
+	// only received.
+	Forward TopicMatcher
+
+	// Codec encodes the data of the messages sent that aren't already
+	// encoded, and decodes the payloads received with the ContentType
+	// into the map form of the data. It defaults to the JSONMarshaller.
+	Codec Marshaller
+
+	// ContentType is the content type of the payloads encoded by the
+	// Codec. It defaults to "application/json". Payloads received with
+	// other content types are published as a []byte with the
+	// ContentTypeHeader set.
+	ContentType string
+
+	// Transport names the transport in the PeerTransportHeader of the
+	// received messages. It defaults to "wire". Messages received by a
+	// bridge with the same transport are not sent over the connection, so
+	// each connection needs its own transport for messages to be
+	// forwarded from one connection to another.
+	Transport string
+
+	// MaxHops is the number of times a message may have been forwarded
+	// between hubs for the bridge to publish it. It defaults to
+	// DefaultMaxHops.
+	MaxHops int
+
+	// MaxFrameSize is the size of the largest frame read from the
+	// connection. It defaults to DefaultMaxWireFrameSize.
+	MaxFrameSize int
+}
+
+// Validate checks that the config has all the required values.
+func (config WireBridgeConfig) Validate() error {
+	if config.Hub == nil {
+		return errors.NotValidf("missing Hub")
+	}
+	if _, ok := config.Hub.(ContextPublisher); !ok {
+		return errors.NotValidf("Hub %T without PublishCtx", config.Hub)
+	}
+	if config.Forward != nil {
+		if _, ok := config.Hub.(ChanSubscriber); !ok {
+			return errors.NotValidf("Hub %T without SubscribeChan", config.Hub)
+		}
+	}
+	if config.Conn == nil {
+		return errors.NotValidf("missing Conn")
+	}
+	if config.MaxHops < 0 {
+		return errors.NotValidf("negative MaxHops")
+	}
+	if config.MaxFrameSize < 0 {
+		return errors.NotValidf("negative MaxFrameSize")
+	}
+	return nil
+}
+
+type wireBridge struct {
+	name         string
+	hub          Hub
+	conn         io.ReadWriteCloser
+	codec        Marshaller
+	contentType  string
+	transport    string
+	maxHops      int
+	maxFrameSize int
+	logger       loggo.Logger
+
+	closer   func()
+	once     sync.Once
+	finished sync.WaitGroup
+}
+
+// NewWireBridge creates a bridge that exchanges messages with a client over
+// the connection using the wire protocol (see WireVersion). The messages
+// received are published on the hub with the peer headers set, and the
+// messages published on the hub that match Forward are sent to the client.
+// Data that isn't a []byte is encoded with the Codec, and the headers of
+// the messages are sent with them. The bridge stops when the connection
+// fails or ends, or when it is unsubscribed.
+func NewWireBridge(config WireBridgeConfig) (Unsubscriber, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	b := &wireBridge{
+		name:         config.Name,
+		hub:          config.Hub,
+		conn:         config.Conn,
+		codec:        config.Codec,
+		contentType:  config.ContentType,
+		transport:    config.Transport,
+		maxHops:      config.MaxHops,
+		maxFrameSize: config.MaxFrameSize,
+		logger:       loggo.GetLogger("pubsub.wire"),
+		closer:       func() {},
+	}
+	if b.codec == nil {
+		b.codec = JSONMarshaller
+	}
+	if b.contentType == "" {
+		b.contentType = "application/json"
+	}
+	if b.transport == "" {
+		b.transport = "wire"
+	}
+	if config.Forward != nil {
+		messages, closer, err := SubscribeChan(b.hub, config.Forward, 0)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		b.closer = closer
+		b.finished.Add(1)
+		go b.sendLoop(messages)
+	}
+	b.finished.Add(1)
+	go b.receiveLoop()
+	return b, nil
+}
+
+// Unsubscribe implements Unsubscriber.
+func (b *wireBridge) Unsubscribe() {
+	b.stop()
+	b.finished.Wait()
+}
+
+func (b *wireBridge) stop() {
+	b.once.Do(func() {
+		b.closer()
+		if err := b.conn.Close(); err != nil {
+			b.logger.Debugf("bridge %q closing connection: %v", b.name, err)
+		}
+	})
+}
+
+func (b *wireBridge) sendLoop(messages <-chan Message) {
+	defer b.finished.Done()
+	// Stop reading the messages once the connection has failed, so the
+	// subscription doesn't queue them for nothing.
+	defer b.stop()
+	w := bufio.NewWriter(b.conn)
+	for message := range messages {
+		if message.Delivery.Headers[PeerTransportHeader] == b.transport {
+			continue
+		}
+		frame, err := b.encode(message)
+		if err != nil {
+			b.logger.Errorf("bridge %q encoding %q: %v", b.name, message.Topic, err)
+			continue
+		}
+		if err := WriteWireFrame(w, frame); err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			b.logger.Errorf("bridge %q sending %q: %v", b.name, message.Topic, err)
+			return
+		}
+	}
+}
+
+func (b *wireBridge) encode(message Message) (WireFrame, error) {
+	headers := make(Headers, len(message.Delivery.Headers)+1)
+	for key, value := range message.Delivery.Headers {
+		headers[key] = value
+	}
+	contentType := headers[ContentTypeHeader]
+	delete(headers, ContentTypeHeader)
+	if _, ok := headers[PeerOriginHeader]; !ok {
+		if identity, ok := b.hub.(hubIdentity); ok {
+			headers[PeerOriginHeader] = identity.hubID()
+		}
+	}
+	payload, ok := message.Data.([]byte)
+	if !ok {
+		var err error
+		if payload, err = b.codec.Marshal(message.Data); err != nil {
+			return WireFrame{}, errors.Trace(err)
+		}
+		contentType = b.contentType
+	}
+	return WireFrame{
+		Topic:       message.Topic,
+		Headers:     headers,
+		ContentType: contentType,
+		Payload:     payload,
+	}, nil
+}
+
+func (b *wireBridge) receiveLoop() {
+	defer b.finished.Done()
+	defer b.stop()
+	r := bufio.NewReader(b.conn)
+	for {
+		frame, err := ReadWireFrame(r, b.maxFrameSize)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			b.logger.Errorf("bridge %q receiving: %v", b.name, err)
+			return
+		}
+		b.publish(frame)
+	}
+}
+
+func (b *wireBridge) publish(frame WireFrame) {
+	var data interface{} = frame.Payload
+	headers := frame.Headers
+	if frame.ContentType == b.contentType {
+		decoded := make(map[string]interface{})
+		if err := b.codec.Unmarshal(frame.Payload, &decoded); err != nil {
+			b.logger.Errorf("bridge %q decoding %q: %v", b.name, frame.Topic, err)
+			return
+		}
+		data = decoded
+	} else if frame.ContentType != "" {
+		headers = make(Headers, len(frame.Headers)+1)
+		for key, value := range frame.Headers {
+			headers[key] = value
+		}
+		headers[ContentTypeHeader] = frame.ContentType
+	}
+	headers, err := forwardedHeaders(nil, headers, b.transport, b.maxHops)
+	if err != nil {
+		b.logger.Warningf("bridge %q publishing %q: %v", b.name, frame.Topic, err)
+		return
+	}
+	ctx := WithHeaders(context.Background(), headers)
+	if _, err := PublishCtx(ctx, b.hub, frame.Topic, data); err != nil {
+		b.logger.Errorf("bridge %q publishing %q: %v", b.name, frame.Topic, err)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package pubsub_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/pubsub"
+)
+
+type WireSuite struct {
+	testing.LoggingCleanupSuite
+}
+
+var _ = gc.Suite(&WireSuite{})
+
+// wireVectors are the conformance vectors of the wire protocol. Clients in
+// other languages should read each frame from its encoding, and write the
+// same bytes for the frame.
+var wireVectors = []struct {
+	about   string
+	frame   pubsub.WireFrame
+	encoded string
+}{{
+	about:   "topic only",
+	frame:   pubsub.WireFrame{Topic: "a"},
+	encoded: "00000008" + "01" + "000161" + "0000" + "0000",
+}, {
+	about: "headers in key order, content type and payload",
+	frame: pubsub.WireFrame{
+		Topic:       "a.b",
+		Headers:     pubsub.Headers{"z": "1", "k": "v"},
+		ContentType: "application/json",
+		Payload:     []byte(`{"x":1}`),
+	},
+	encoded: "0000002d" + "01" + "0003612e62" + "0002" +
+		"00016b" + "000176" + "00017a" + "000131" +
+		"00106170706c69636174696f6e2f6a736f6e" +
+		"7b2278223a317d",
+}, {
+	about: "empty header value and binary payload",
+	frame: pubsub.WireFrame{
+		Topic:       "bin",
+		Headers:     pubsub.Headers{"empty": ""},
+		ContentType: "application/octet-stream",
+		Payload:     []byte{0, 1, 255},
+	},
+	encoded: "0000002e" + "01" + "000362696e" + "0001" +
+		"0005656d707479" + "0000" +
+		"0018" + hex.EncodeToString([]byte("application/octet-stream")) +
+		"0001ff",
+}}
+
+func (*WireSuite) TestVectors(c *gc.C) {
+	for i, test := range wireVectors {
+		c.Logf("test %d: %s", i, test.about)
+		var buf bytes.Buffer
+		err := pubsub.WriteWireFrame(&buf, test.frame)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(hex.EncodeToString(buf.Bytes()), gc.Equals, test.encoded)
+
+		encoded, err := hex.DecodeString(test.encoded)
+		c.Assert(err, jc.ErrorIsNil)
+		frame, err := pubsub.ReadWireFrame(bytes.NewReader(encoded), 0)
+		c.Assert(err, jc.ErrorIsNil)
+		if len(frame.Payload) == 0 {
+			frame.Payload = nil
+		}
+		c.Check(frame, jc.DeepEquals, test.frame)
+	}
+}
+
+func (*WireSuite) TestInvalidFrames(c *gc.C) {
+	for i, test := range []struct {
+		about   string
+		encoded string
+		maxSize int
+		err     string
+	}{{
+		about:   "unknown version",
+		encoded: "00000008" + "02" + "000161" + "0000" + "0000",
+		err:     "wire version 2 not supported",
+	}, {
+		about:   "string past the end of the frame",
+		encoded: "00000004" + "01" + "0005" + "61",
+		err:     "truncated frame not valid",
+	}, {
+		about:   "missing content type",
+		encoded: "00000006" + "01" + "000161" + "0000",
+		err:     "truncated frame not valid",
+	}, {
+		about:   "stream ends in the frame",
+		encoded: "00000008" + "01" + "0001",
+		err:     "reading frame: unexpected EOF",
+	}, {
+		about:   "frame too long",
+		encoded: "00000008" + "01" + "000161" + "0000" + "0000",
+		maxSize: 7,
+		err:     "frame of 8 bytes, limit 7 not valid",
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		encoded, err := hex.DecodeString(test.encoded)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = pubsub.ReadWireFrame(bytes.NewReader(encoded), test.maxSize)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (*WireSuite) TestEndOfStream(c *gc.C) {
+	_, err := pubsub.ReadWireFrame(bytes.NewReader(nil), 0)
+	c.Check(err, gc.Equals, io.EOF)
+}
+
+func (*WireSuite) TestWriteTooLong(c *gc.C) {
+	err := pubsub.WriteWireFrame(&bytes.Buffer{}, pubsub.WireFrame{
+		Topic: pubsub.Topic(strings.Repeat("a", 1<<16)),
+	})
+	c.Check(err, gc.ErrorMatches, "topic of 65536 bytes not valid")
+}
+
+func (*WireSuite) TestValidate(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	for i, test := range []struct {
+		config pubsub.WireBridgeConfig
+		err    string
+	}{{
+		config: pubsub.WireBridgeConfig{Conn: conn},
+		err:    "missing Hub not valid",
+	}, {
+		config: pubsub.WireBridgeConfig{Hub: hub},
+		err:    "missing Conn not valid",
+	}, {
+		config: pubsub.WireBridgeConfig{Hub: hub, Conn: conn, MaxHops: -1},
+		err:    "negative MaxHops not valid",
+	}, {
+		config: pubsub.WireBridgeConfig{Hub: hub, Conn: conn, MaxFrameSize: -1},
+		err:    "negative MaxFrameSize not valid",
+	}} {
+		c.Logf("test %d", i)
+		err := test.config.Validate()
+		c.Check(err, gc.ErrorMatches, test.err)
+		bridge, err := pubsub.NewWireBridge(test.config)
+		c.Check(err, gc.ErrorMatches, test.err)
+		c.Check(bridge, gc.IsNil)
+	}
+}
+
+func (*WireSuite) TestReceive(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	messages, closer, err := hub.(pubsub.ChanSubscriber).SubscribeChan(pubsub.MatchAll, 10)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closer()
+	conn, client := net.Pipe()
+	bridge, err := pubsub.NewWireBridge(pubsub.WireBridgeConfig{
+		Name: "test",
+		Hub:  hub,
+		Conn: conn,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	err = pubsub.WriteWireFrame(client, pubsub.WireFrame{
+		Topic:       first,
+		Headers:     pubsub.Headers{"trace": "abc"},
+		ContentType: "application/json",
+		Payload:     []byte(`{"origin":"client"}`),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	message := receive(c, messages)
+	c.Check(message.Topic, gc.Equals, first)
+	c.Check(message.Data, jc.DeepEquals, map[string]interface{}{"origin": "client"})
+	c.Check(message.Delivery.Headers["trace"], gc.Equals, "abc")
+	c.Check(message.Delivery.Headers[pubsub.PeerTransportHeader], gc.Equals, "wire")
+	c.Check(message.Delivery.Headers[pubsub.PeerHopsHeader], gc.Equals, "1")
+
+	// Payloads of other content types are published as they are.
+	err = pubsub.WriteWireFrame(client, pubsub.WireFrame{
+		Topic:       second,
+		ContentType: "text/plain",
+		Payload:     []byte("hello"),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	message = receive(c, messages)
+	c.Check(message.Data, jc.DeepEquals, []byte("hello"))
+	c.Check(message.Delivery.Headers[pubsub.ContentTypeHeader], gc.Equals, "text/plain")
+}
+
+func (*WireSuite) TestSend(c *gc.C) {
+	hub := pubsub.NewSimpleHubWithConfig(&pubsub.SimpleHubConfig{ID: "hub-1"})
+	conn, client := net.Pipe()
+	bridge, err := pubsub.NewWireBridge(pubsub.WireBridgeConfig{
+		Hub:     hub,
+		Conn:    conn,
+		Forward: pubsub.MatchRegex("^first"),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	_, err = hub.Publish(second, map[string]interface{}{"skipped": true})
+	c.Assert(err, jc.ErrorIsNil)
+	ctx := pubsub.WithHeaders(context.Background(), pubsub.Headers{"trace": "abc"})
+	_, err = hub.(pubsub.ContextPublisher).PublishCtx(ctx, first, map[string]interface{}{"value": 1})
+	c.Assert(err, jc.ErrorIsNil)
+
+	frame, err := pubsub.ReadWireFrame(client, 0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(frame.Topic, gc.Equals, first)
+	c.Check(frame.ContentType, gc.Equals, "application/json")
+	c.Check(string(frame.Payload), gc.Equals, `{"value":1}`)
+	c.Check(frame.Headers["trace"], gc.Equals, "abc")
+	c.Check(frame.Headers[pubsub.PeerOriginHeader], gc.Equals, "hub-1")
+}
+
+func (*WireSuite) TestNoEcho(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	conn, client := net.Pipe()
+	bridge, err := pubsub.NewWireBridge(pubsub.WireBridgeConfig{
+		Hub:     hub,
+		Conn:    conn,
+		Forward: pubsub.MatchAll,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+
+	err = pubsub.WriteWireFrame(client, pubsub.WireFrame{
+		Topic:       first,
+		ContentType: "application/json",
+		Payload:     []byte(`{}`),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = hub.Publish(second, map[string]interface{}{})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The message received from the client isn't sent back to it.
+	frame, err := pubsub.ReadWireFrame(client, 0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(frame.Topic, gc.Equals, second)
+}
+
+func (*WireSuite) TestBetweenHubs(c *gc.C) {
+	source := pubsub.NewStructuredHub(nil)
+	target := pubsub.NewStructuredHub(nil)
+	left, right := net.Pipe()
+	sender, err := pubsub.NewWireBridge(pubsub.WireBridgeConfig{
+		Hub:     source,
+		Conn:    left,
+		Forward: topic,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer sender.Unsubscribe()
+	receiver, err := pubsub.NewWireBridge(pubsub.WireBridgeConfig{
+		Hub:  target,
+		Conn: right,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer receiver.Unsubscribe()
+
+	received := make(chan Emitter, 1)
+	_, err = target.Subscribe(topic, func(_ pubsub.Topic, data Emitter, err error) {
+		c.Check(err, jc.ErrorIsNil)
+		received <- data
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = source.Publish(topic, Emitter{Origin: "left", Message: "hello", ID: 42})
+	c.Assert(err, jc.ErrorIsNil)
+	select {
+	case data := <-received:
+		c.Check(data, jc.DeepEquals, Emitter{Origin: "left", Message: "hello", ID: 42})
+	case <-time.After(time.Second):
+		c.Fatal("message not received")
+	}
+}
+
+func (*WireSuite) TestStopsWhenConnectionCloses(c *gc.C) {
+	hub := pubsub.NewSimpleHub()
+	conn, client := net.Pipe()
+	bridge, err := pubsub.NewWireBridge(pubsub.WireBridgeConfig{
+		Hub:     hub,
+		Conn:    conn,
+		Forward: pubsub.MatchAll,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(client.Close(), jc.ErrorIsNil)
+	bridge.Unsubscribe()
+
+	// Garbage from the client stops the bridge too.
+	conn, client = net.Pipe()
+	bridge, err = pubsub.NewWireBridge(pubsub.WireBridgeConfig{Hub: hub, Conn: conn})
+	c.Assert(err, jc.ErrorIsNil)
+	defer bridge.Unsubscribe()
+	go client.Write([]byte{0, 0, 0, 1, 9})
+	_, err = client.Read(make([]byte, 1))
+	c.Check(errors.Cause(err), gc.Equals, io.EOF)
+}